@@ -0,0 +1,339 @@
+// Package age provides an encryption middleware writing the age v1 format
+// (age-encryption.org/v1), so spilled buffers can be decrypted with the
+// standard age CLI during incident response:
+//
+//	age -d -i key.txt spilled.bin > plain
+//
+// Streams are encrypted to X25519 recipients ("age1..." public keys from
+// age-keygen) or to a passphrase with a scrypt recipient. Writers only need
+// recipients, so hosts spilling buffers never hold the secret key.
+package age
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+const (
+	fileKeySize = 16
+	nonceSize   = 16
+	chunkSize   = 64 << 10
+)
+
+var (
+	// ErrIncorrectIdentity is returned by Identity.Unwrap if no stanza is
+	// addressed to the identity
+	ErrIncorrectIdentity = errors.New("age: incorrect identity for recipient block")
+
+	// ErrNoIdentityMatch is returned by Readers if none of the identities
+	// can unwrap the file key
+	ErrNoIdentityMatch = errors.New("age: no identity matched any of the recipients")
+
+	// ErrNotAuthentic is returned by Readers for modified or truncated streams
+	ErrNotAuthentic = errors.New("age: message authentication failed")
+
+	// ErrNoRecipients is returned by NewE without recipients and identities,
+	// and by Writers without recipients
+	ErrNoRecipients = errors.New("age: no recipients")
+)
+
+// Recipient wraps the file key of a stream in one or more stanzas
+type Recipient interface {
+	Wrap(fileKey []byte) ([]*Stanza, error)
+}
+
+// Identity unwraps the file key from the stanzas of a stream. It returns
+// ErrIncorrectIdentity if no stanza is addressed to it.
+type Identity interface {
+	Unwrap(stanzas []*Stanza) ([]byte, error)
+}
+
+// Middleware encrypts streams in the age format
+type Middleware struct {
+	recipients []Recipient
+	identities []Identity
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Roled      = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+	_ middleware.MemoryUser = (*Middleware)(nil)
+)
+
+// Option configures the middleware
+type Option func(*Middleware)
+
+// WithRecipients adds recipients that can decrypt written streams
+func WithRecipients(r ...Recipient) Option {
+	return func(m *Middleware) {
+		m.recipients = append(m.recipients, r...)
+	}
+}
+
+// WithIdentities adds identities used to decrypt streams
+func WithIdentities(id ...Identity) Option {
+	return func(m *Middleware) {
+		m.identities = append(m.identities, id...)
+	}
+}
+
+// New creates an age middleware. New panics on an invalid configuration.
+func New(opts ...Option) *Middleware {
+	m, err := NewE(opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return m
+}
+
+// NewE is like New, but returns an error instead of panicking
+func NewE(opts ...Option) (*Middleware, error) {
+	m := &Middleware{}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if len(m.recipients) == 0 && len(m.identities) == 0 {
+		return nil, ErrNoRecipients
+	}
+	for _, r := range m.recipients {
+		if _, ok := r.(*ScryptRecipient); ok && len(m.recipients) > 1 {
+			return nil, errors.New("age: a scrypt recipient cannot be combined with other recipients")
+		}
+	}
+	return m, nil
+}
+
+// Role returns middleware.RoleEncryption
+func (m *Middleware) Role() middleware.Role { return middleware.RoleEncryption }
+
+// MemoryUsage returns the memory of a Writer or Reader, which buffer the
+// fixed 64 KiB chunks of the age format twice
+func (m *Middleware) MemoryUsage() int64 {
+	return 2 * (chunkSize + chacha20poly1305.Overhead)
+}
+
+// Describe reports the age format and the number of recipients
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:      string(middleware.RoleEncryption),
+		Algorithm: "chacha20-poly1305",
+		KeyBits:   256,
+		Integrity: "aead",
+		Properties: map[string]string{
+			"format":         "age-v1",
+			"key_management": "recipients",
+			"recipients":     fmt.Sprint(len(m.recipients)),
+		},
+	}
+}
+
+// Writer encrypts to the recipients. Closing it writes the final chunk; it
+// does not close w.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return &writer{m: m, w: w, state: middleware.WriterState{Layer: "age"}}
+}
+
+type writer struct {
+	m       *Middleware
+	w       io.Writer
+	aead    *payload
+	buf     []byte
+	started bool
+	state   middleware.WriterState
+}
+
+// start writes the header and payload nonce
+func (w *writer) start() error {
+	w.started = true
+	if len(w.m.recipients) == 0 {
+		return ErrNoRecipients
+	}
+	fileKey := make([]byte, fileKeySize)
+	if _, err := io.ReadFull(middleware.Rand(), fileKey); err != nil {
+		return err
+	}
+	defer clear(fileKey)
+	var stanzas []*Stanza
+	for _, r := range w.m.recipients {
+		s, err := r.Wrap(fileKey)
+		if err != nil {
+			return fmt.Errorf("age: failed to wrap key: %w", err)
+		}
+		stanzas = append(stanzas, s...)
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(middleware.Rand(), nonce); err != nil {
+		return err
+	}
+	aead, err := newPayload(fileKey, nonce)
+	if err != nil {
+		return err
+	}
+	w.aead = aead
+	w.buf = make([]byte, 0, chunkSize)
+	_, err = w.w.Write(append(marshalHeader(fileKey, stanzas), nonce...))
+	return err
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if !w.started {
+		if err := w.start(); err != nil {
+			return 0, w.state.Fail(err)
+		}
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is sealed once more data follows, the last one on Close
+		if len(w.buf) == chunkSize {
+			if _, err := w.w.Write(w.aead.seal(w.buf, false)); err != nil {
+				return written, w.state.Fail(err)
+			}
+			w.buf = w.buf[:0]
+		}
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if !w.started {
+			if err := w.start(); err != nil {
+				return err
+			}
+		}
+		_, err := w.w.Write(w.aead.seal(w.buf, true))
+		return err
+	})
+}
+
+// Reader decrypts with the identities
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return &reader{m: m, src: r, state: middleware.ReaderState{Layer: "age"}}
+}
+
+type reader struct {
+	m     *Middleware
+	src   io.Reader
+	br    *bufio.Reader
+	aead  *payload
+	chunk []byte // ciphertext buffer
+	plain []byte // unread plaintext of the current chunk
+	last  bool
+	state middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	if r.aead == nil {
+		if err := r.start(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	for len(r.plain) == 0 {
+		if r.last {
+			return r.state.Track(0, io.EOF)
+		}
+		if err := r.next(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return r.state.Track(n, nil)
+}
+
+// start parses the header and unwraps the file key
+func (r *reader) start() error {
+	if len(r.m.identities) == 0 {
+		return errors.New("age: no identities to decrypt with")
+	}
+	r.br = bufio.NewReaderSize(r.src, chunkSize+chacha20poly1305.Overhead)
+	h, err := parseHeader(r.br)
+	if err != nil {
+		return err
+	}
+	var fileKey []byte
+	for _, id := range r.m.identities {
+		fileKey, err = id.Unwrap(h.stanzas)
+		if errors.Is(err, ErrIncorrectIdentity) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+	if fileKey == nil {
+		return ErrNoIdentityMatch
+	}
+	defer clear(fileKey)
+	if len(fileKey) != fileKeySize || !h.verify(fileKey) {
+		return errors.New("age: bad header MAC")
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := io.ReadFull(r.br, nonce); err != nil {
+		return fmt.Errorf("age: failed to read nonce: %w", err)
+	}
+	aead, err := newPayload(fileKey, nonce)
+	if err != nil {
+		return err
+	}
+	r.aead = aead
+	r.chunk = make([]byte, chunkSize+chacha20poly1305.Overhead)
+	return nil
+}
+
+// next reads and opens the next chunk
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.br, r.chunk)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		_, err := r.br.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := r.aead.open(r.chunk[:n], last)
+	if err != nil {
+		return err
+	}
+	// only the payload of an empty stream ends with an empty chunk
+	if last && len(plain) == 0 && r.aead.counter > 1 {
+		return fmt.Errorf("%w: empty last chunk", ErrNotAuthentic)
+	}
+	r.plain, r.last = plain, last
+	return nil
+}
+
+func init() {
+	middleware.RegisterFormat("age-header", func(p []byte) (string, int, bool) {
+		n, ok := headerLength(p)
+		if !ok {
+			return "", 0, false
+		}
+		return "age-encryption.org/v1", n, true
+	})
+}
@@ -0,0 +1,297 @@
+package age_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/age"
+)
+
+// Streams written by the age reference implementation
+const (
+	vectorIdentity  = "AGE-SECRET-KEY-1XFDE62WX4UQTHNCA3CYGV2MW5JYHGE9UQDAFPM5GR2ARGU0RNNGS2TCRNV"
+	vectorRecipient = "age1myvdzh5t26qep4yny9jrlpygwd0e82jnhwjcglutrv2md0sx0adsxclkad"
+	vectorX25519    = "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IFgyNTUxOSBXc3dmQ3I3SjNtanV5SjIvVGY1TGhlcFlTRmI0VkM5RWJyaElqTkNGb2tZCmVpWGl0R2VMallnMVZPbnpBU3pRNHdrVGw3REhMd0FyaHVMZng1L3lwQ3MKLS0tIGV2cnJLbU9ZdTRqMDU0WmYzS0RpNml1RGJTclQxdmJFKzdnRTFlYnIrbTQKoc84qIfTG+livBa7AGtD1w+v/rgi6J4AK0oQbIc1+YU5v0GDwO5u7g0jfcJNcQcT+SI8fAQ9vg=="
+	vectorScrypt    = "YWdlLWVuY3J5cHRpb24ub3JnL3YxCi0+IHNjcnlwdCA4cFZUZFhLUEMzcWt0MVhxUS9CZVdBIDEwCkxIUWhkazVySlFtdmNoYkNIZmVDcWhDd3paMXBieUVHRGdhTTZTL0dFMUUKLS0tIDVsQVRUQTdQK1MxaFBYMzR4amVJK0luM29KNTQ3akxLalBHU0ZVT204UlUKyy4hv38YbTtM+ez7mQYwHzOJc6KXiD889l/GtGaTvhJVtTm1Y9OoapITDjhkscy7nVAG1+M="
+	vectorPassword  = "correct horse battery staple"
+)
+
+const chunkSize = 64 << 10
+
+func vector(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func encrypt(t *testing.T, m *age.Middleware, data []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func decrypt(m *age.Middleware, enc []byte) ([]byte, error) {
+	return io.ReadAll(m.Reader(bytes.NewReader(enc)))
+}
+
+func TestDecryptReferenceStreams(t *testing.T) {
+	id, err := age.ParseX25519Identity(vectorIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := id.Recipient().String(); got != vectorRecipient {
+		t.Fatalf("recipient %s, want %s", got, vectorRecipient)
+	}
+	got, err := decrypt(age.New(age.WithIdentities(id)), vector(t, vectorX25519))
+	if err != nil || string(got) != "hello from the age CLI\n" {
+		t.Fatalf("X25519: got %q, %v", got, err)
+	}
+
+	sid, err := age.NewScryptIdentity(vectorPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = decrypt(age.New(age.WithIdentities(sid)), vector(t, vectorScrypt))
+	if err != nil || string(got) != "passphrase protected\n" {
+		t.Fatalf("scrypt: got %q, %v", got, err)
+	}
+}
+
+func TestKeyEncoding(t *testing.T) {
+	id := newIdentity(t)
+	parsed, err := age.ParseX25519Identity(id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != id.String() {
+		t.Fatal("identity changed by encoding")
+	}
+	r, err := age.ParseX25519Recipient(id.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != id.Recipient().String() {
+		t.Fatal("recipient changed by encoding")
+	}
+
+	for _, s := range []string{
+		"",
+		"age1",
+		strings.ToUpper(vectorRecipient),
+		vectorRecipient[:len(vectorRecipient)-1] + "q",
+		strings.Replace(vectorRecipient, "age1", "agf1", 1),
+		vectorIdentity,
+	} {
+		if _, err := age.ParseX25519Recipient(s); err == nil {
+			t.Fatalf("recipient %q accepted", s)
+		}
+	}
+	for _, s := range []string{
+		vectorRecipient,
+		vectorIdentity[:len(vectorIdentity)-1] + "Q",
+		strings.ToLower(vectorIdentity[:20]) + vectorIdentity[20:],
+	} {
+		if _, err := age.ParseX25519Identity(s); err == nil {
+			t.Fatalf("identity %q accepted", s)
+		}
+	}
+}
+
+func TestParseIdentities(t *testing.T) {
+	a, b := newIdentity(t), newIdentity(t)
+	file := fmt.Sprintf("# created: today\n# public key: %s\n%s\n\n%s\n", a.Recipient(), a, b)
+	ids, err := age.ParseIdentities(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("got %d identities, want 2", len(ids))
+	}
+	for _, file := range []string{"", "# only a comment\n", "AGE-SECRET-KEY-1INVALID\n"} {
+		if _, err := age.ParseIdentities(strings.NewReader(file)); err == nil {
+			t.Fatalf("identity file %q accepted", file)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	id := newIdentity(t)
+	m := age.New(age.WithRecipients(id.Recipient()), age.WithIdentities(id))
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 2*chunkSize + 17} {
+		data := make([]byte, size)
+		rand.Read(data)
+		got, err := decrypt(m, encrypt(t, m, data))
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestMultipleRecipients(t *testing.T) {
+	a, b, other := newIdentity(t), newIdentity(t), newIdentity(t)
+	enc := encrypt(t, age.New(age.WithRecipients(a.Recipient(), b.Recipient())), []byte("shared"))
+	for _, id := range []*age.X25519Identity{a, b} {
+		// the identities of a middleware are tried in order
+		got, err := decrypt(age.New(age.WithIdentities(other, id)), enc)
+		if err != nil || string(got) != "shared" {
+			t.Fatalf("got %q, %v", got, err)
+		}
+	}
+	if _, err := decrypt(age.New(age.WithIdentities(other)), enc); !errors.Is(err, age.ErrNoIdentityMatch) {
+		t.Fatalf("got %v, want ErrNoIdentityMatch", err)
+	}
+}
+
+func TestScrypt(t *testing.T) {
+	r, err := age.NewScryptRecipient("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(10)
+	enc := encrypt(t, age.New(age.WithRecipients(r)), []byte("secret"))
+
+	id, err := age.NewScryptIdentity("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decrypt(age.New(age.WithIdentities(id)), enc); err != nil || string(got) != "secret" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	wrong, err := age.NewScryptIdentity("wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decrypt(age.New(age.WithIdentities(wrong)), enc); !errors.Is(err, age.ErrNoIdentityMatch) {
+		t.Fatalf("wrong passphrase: got %v, want ErrNoIdentityMatch", err)
+	}
+	// work factors above the maximum are rejected before any work is done
+	id.SetMaxWorkFactor(9)
+	if _, err := decrypt(age.New(age.WithIdentities(id)), enc); err == nil {
+		t.Fatal("work factor above the maximum accepted")
+	}
+
+	if _, err := age.NewE(age.WithRecipients(r, newIdentity(t).Recipient())); err == nil {
+		t.Fatal("scrypt recipient combined with another recipient")
+	}
+	if _, err := age.NewE(); !errors.Is(err, age.ErrNoRecipients) {
+		t.Fatalf("got %v, want ErrNoRecipients", err)
+	}
+}
+
+// splitHeader returns the header up to and including "---" and the rest
+func splitHeader(t *testing.T, enc []byte) (string, []byte) {
+	t.Helper()
+	i := bytes.Index(enc, []byte("\n--- "))
+	if i < 0 {
+		t.Fatal("no header footer")
+	}
+	return string(enc[:i+4]), enc[i+4:]
+}
+
+func TestHostileStreams(t *testing.T) {
+	id := newIdentity(t)
+	m := age.New(age.WithRecipients(id.Recipient()), age.WithIdentities(id))
+	msg := make([]byte, chunkSize+100)
+	rand.Read(msg)
+	valid := encrypt(t, m, msg)
+	header, rest := splitHeader(t, valid)
+	macLine := rest[:bytes.IndexByte(rest, '\n')+1]
+	payload := rest[len(macLine):]
+	stanzas := strings.TrimPrefix(header, "age-encryption.org/v1\n")
+	stanzas = strings.TrimSuffix(stanzas, "---")
+
+	join := func(parts ...string) []byte {
+		return []byte(strings.Join(parts, ""))
+	}
+	zeroMAC := " " + base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n"
+	lowOrder := "-> X25519 " + base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n" +
+		base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n"
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"empty", nil, nil},
+		{"not age", []byte("hello\n"), nil},
+		{"other version", join("age-encryption.org/v2\n", string(valid[22:])), nil},
+		{"truncated header", valid[:len(header)-10], nil},
+		{"no footer MAC", join(header, "\n"), nil},
+		{"malformed footer", join(header, "x\n"), nil},
+		{"changed MAC", join(header, zeroMAC, string(payload)), nil},
+		{"malformed stanza line", join("age-encryption.org/v1\n", "-> \n\n", "---", string(macLine)), nil},
+		{"stanza body line too long", join("age-encryption.org/v1\n", "-> X\n", strings.Repeat("A", 68), "\n", "---", string(macLine)), nil},
+		{"header line too long", join("age-encryption.org/v1\n", "-> X ", strings.Repeat("A", 8192), "\n"), nil},
+		{"too many stanzas", join("age-encryption.org/v1\n", strings.Repeat("-> X\n\n", 300), "---", string(macLine)), nil},
+		{"low order share", join("age-encryption.org/v1\n", lowOrder, "---", string(macLine)), nil},
+		{"foreign stanza only", join("age-encryption.org/v1\n", "-> X\n\n", "---", string(macLine)), age.ErrNoIdentityMatch},
+		{"missing nonce", join(header, string(macLine), string(payload[:8])), nil},
+		{"no payload", join(header, string(macLine), string(payload[:16])), age.ErrNotAuthentic},
+		{"flipped chunk", append(bytes.Clone(valid[:len(valid)-1]), valid[len(valid)-1]^1), age.ErrNotAuthentic},
+		{"dropped last chunk", valid[:len(valid)-(100+16)], age.ErrNotAuthentic},
+		{"truncated last chunk", valid[:len(valid)-1], age.ErrNotAuthentic},
+		{"appended data", append(bytes.Clone(valid), 0), age.ErrNotAuthentic},
+		{"duplicated stanzas", join("age-encryption.org/v1\n", stanzas, stanzas, "---", string(macLine), string(payload)), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(m, tt.data)
+			if err == nil {
+				t.Fatal("hostile stream accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if !bytes.HasPrefix(msg, got) {
+				t.Fatal("returned data that is not part of the plaintext")
+			}
+		})
+	}
+}
+
+func TestScryptStanzaMustBeAlone(t *testing.T) {
+	r, err := age.NewScryptRecipient("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetWorkFactor(1)
+	enc := encrypt(t, age.New(age.WithRecipients(r)), []byte("secret"))
+	header, rest := splitHeader(t, enc)
+	other := "-> X25519 " + base64.RawStdEncoding.EncodeToString(make([]byte, 32)) + "\n\n"
+	mixed := []byte("age-encryption.org/v1\n" + other + strings.TrimPrefix(header, "age-encryption.org/v1\n") + string(rest))
+
+	id, err := age.NewScryptIdentity("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decrypt(age.New(age.WithIdentities(id)), mixed); err == nil {
+		t.Fatal("scrypt stanza accepted next to another stanza")
+	}
+}
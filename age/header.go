@@ -0,0 +1,215 @@
+package age
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	intro        = "age-encryption.org/v1\n"
+	stanzaPrefix = "-> "
+	footerPrefix = "---"
+
+	// columns of a wrapped stanza body line
+	columns = 64
+
+	// limits against hostile headers
+	maxStanzas    = 256
+	maxLineLength = 4096
+)
+
+var b64 = base64.RawStdEncoding.Strict()
+
+// Stanza is a recipient stanza of the age header, holding the file key
+// wrapped for one recipient
+type Stanza struct {
+	Type string
+	Args []string
+	Body []byte
+}
+
+// marshal appends the stanza in its text form
+func (s *Stanza) marshal(b []byte) []byte {
+	b = append(b, stanzaPrefix...)
+	b = append(b, s.Type...)
+	for _, a := range s.Args {
+		b = append(b, ' ')
+		b = append(b, a...)
+	}
+	b = append(b, '\n')
+	body := b64.EncodeToString(s.Body)
+	for len(body) >= columns {
+		b = append(b, body[:columns]...)
+		b = append(b, '\n')
+		body = body[columns:]
+	}
+	// the last line is always shorter than a full one, possibly empty
+	b = append(b, body...)
+	return append(b, '\n')
+}
+
+// headerMAC returns the MAC of the header text up to and including "---"
+func headerMAC(fileKey, header []byte) []byte {
+	h := hmac.New(sha256.New, hkdfKey(fileKey, nil, "header", 32))
+	h.Write(header)
+	return h.Sum(nil)
+}
+
+func hkdfKey(secret, salt []byte, info string, size int) []byte {
+	key := make([]byte, size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		panic("age: hkdf: " + err.Error())
+	}
+	return key
+}
+
+// marshalHeader returns the header of a stream with the given stanzas
+func marshalHeader(fileKey []byte, stanzas []*Stanza) []byte {
+	b := []byte(intro)
+	for _, s := range stanzas {
+		b = s.marshal(b)
+	}
+	b = append(b, footerPrefix...)
+	mac := headerMAC(fileKey, b)
+	b = append(b, ' ')
+	b = append(b, b64.EncodeToString(mac)...)
+	return append(b, '\n')
+}
+
+// header is a parsed age header
+type header struct {
+	stanzas []*Stanza
+	raw     []byte // header text up to and including "---"
+	mac     []byte
+}
+
+// parseHeader reads the header from br, leaving br at the payload
+func parseHeader(br *bufio.Reader) (*header, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+	if line != intro {
+		return nil, errors.New("age: not an age v1 stream")
+	}
+	h := &header{raw: []byte(line)}
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, footerPrefix) {
+			rest, ok := strings.CutPrefix(line, footerPrefix+" ")
+			if !ok {
+				return nil, errors.New("age: malformed header footer")
+			}
+			mac, err := b64.DecodeString(strings.TrimSuffix(rest, "\n"))
+			if err != nil || len(mac) != sha256.Size {
+				return nil, errors.New("age: malformed header MAC")
+			}
+			h.raw = append(h.raw, footerPrefix...)
+			h.mac = mac
+			return h, nil
+		}
+		h.raw = append(h.raw, line...)
+		args, ok := strings.CutPrefix(line, stanzaPrefix)
+		if !ok {
+			return nil, fmt.Errorf("age: malformed header line %q", line)
+		}
+		fields := strings.Split(strings.TrimSuffix(args, "\n"), " ")
+		for _, f := range fields {
+			if !isArg(f) {
+				return nil, fmt.Errorf("age: malformed stanza line %q", line)
+			}
+		}
+		if len(h.stanzas) == maxStanzas {
+			return nil, errors.New("age: too many recipient stanzas")
+		}
+		s := &Stanza{Type: fields[0], Args: fields[1:]}
+		for {
+			line, err := readLine(br)
+			if err != nil {
+				return nil, err
+			}
+			h.raw = append(h.raw, line...)
+			text := strings.TrimSuffix(line, "\n")
+			if len(text) > columns {
+				return nil, errors.New("age: stanza body line too long")
+			}
+			b, err := b64.DecodeString(text)
+			if err != nil {
+				return nil, errors.New("age: malformed stanza body")
+			}
+			s.Body = append(s.Body, b...)
+			if len(text) < columns {
+				break
+			}
+		}
+		h.stanzas = append(h.stanzas, s)
+	}
+}
+
+// readLine reads a line including its newline
+func readLine(br *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := br.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > maxLineLength {
+			return "", errors.New("age: header line too long")
+		}
+		switch {
+		case err == nil:
+			return string(line), nil
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF:
+			return "", fmt.Errorf("age: truncated header: %w", io.ErrUnexpectedEOF)
+		default:
+			return "", err
+		}
+	}
+}
+
+// isArg reports whether s is a non-empty string of visible ASCII characters
+func isArg(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < 33 || s[i] > 126 {
+			return false
+		}
+	}
+	return true
+}
+
+// verify checks the header MAC with the unwrapped file key
+func (h *header) verify(fileKey []byte) bool {
+	return hmac.Equal(headerMAC(fileKey, h.raw), h.mac)
+}
+
+// headerLength returns the length of the age header at the start of p
+func headerLength(p []byte) (int, bool) {
+	if !bytes.HasPrefix(p, []byte(intro)) {
+		return 0, false
+	}
+	i := bytes.Index(p, []byte("\n"+footerPrefix+" "))
+	if i < 0 {
+		return 0, false
+	}
+	j := bytes.IndexByte(p[i+1:], '\n')
+	if j < 0 {
+		return 0, false
+	}
+	return i + 1 + j + 1, true
+}
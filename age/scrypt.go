@@ -0,0 +1,132 @@
+package age
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+const scryptLabel = "age-encryption.org/v1/scrypt"
+
+// Default scrypt work factors, as log2 of the scrypt N parameter
+const (
+	DefaultWorkFactor    = 18
+	DefaultMaxWorkFactor = 22
+)
+
+// ScryptRecipient encrypts with a passphrase, like age -p. It cannot be
+// combined with other recipients.
+type ScryptRecipient struct {
+	passphrase []byte
+	workFactor int
+}
+
+// Ensure ScryptRecipient implements Recipient and ScryptIdentity implements Identity
+var (
+	_ Recipient = (*ScryptRecipient)(nil)
+	_ Identity  = (*ScryptIdentity)(nil)
+)
+
+// NewScryptRecipient creates a passphrase recipient with DefaultWorkFactor
+func NewScryptRecipient(passphrase string) (*ScryptRecipient, error) {
+	if passphrase == "" {
+		return nil, errors.New("age: empty passphrase")
+	}
+	return &ScryptRecipient{passphrase: []byte(passphrase), workFactor: DefaultWorkFactor}, nil
+}
+
+// SetWorkFactor sets log2 of the scrypt N parameter, between 1 and 30
+func (r *ScryptRecipient) SetWorkFactor(logN int) {
+	if logN < 1 || logN > 30 {
+		panic("age: invalid scrypt work factor")
+	}
+	r.workFactor = logN
+}
+
+// Wrap wraps the file key with a key derived from the passphrase
+func (r *ScryptRecipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(middleware.Rand(), salt); err != nil {
+		return nil, err
+	}
+	key, err := scryptKey(r.passphrase, salt, r.workFactor)
+	if err != nil {
+		return nil, err
+	}
+	body, err := aeadSeal(key, fileKey)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{b64.EncodeToString(salt), strconv.Itoa(r.workFactor)}
+	return []*Stanza{{Type: "scrypt", Args: args, Body: body}}, nil
+}
+
+// ScryptIdentity decrypts streams encrypted with a passphrase
+type ScryptIdentity struct {
+	passphrase    []byte
+	maxWorkFactor int
+}
+
+// NewScryptIdentity creates a passphrase identity accepting work factors
+// up to DefaultMaxWorkFactor
+func NewScryptIdentity(passphrase string) (*ScryptIdentity, error) {
+	if passphrase == "" {
+		return nil, errors.New("age: empty passphrase")
+	}
+	return &ScryptIdentity{passphrase: []byte(passphrase), maxWorkFactor: DefaultMaxWorkFactor}, nil
+}
+
+// SetMaxWorkFactor sets the largest accepted work factor, which bounds
+// the time and memory a hostile stream can make Unwrap spend
+func (i *ScryptIdentity) SetMaxWorkFactor(logN int) {
+	if logN < 1 || logN > 30 {
+		panic("age: invalid scrypt work factor")
+	}
+	i.maxWorkFactor = logN
+}
+
+// Unwrap returns the file key of a scrypt stanza, which must be the only one
+func (i *ScryptIdentity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type == "scrypt" && len(stanzas) != 1 {
+			return nil, errors.New("age: scrypt stanza must be alone in the header")
+		}
+	}
+	if len(stanzas) != 1 || stanzas[0].Type != "scrypt" {
+		return nil, ErrIncorrectIdentity
+	}
+	s := stanzas[0]
+	if len(s.Args) != 2 || len(s.Body) != fileKeySize+chacha20poly1305.Overhead {
+		return nil, errors.New("age: invalid scrypt stanza")
+	}
+	salt, err := b64.DecodeString(s.Args[0])
+	if err != nil || len(salt) != 16 {
+		return nil, errors.New("age: invalid scrypt stanza")
+	}
+	logN, err := strconv.Atoi(s.Args[1])
+	if err != nil || logN <= 0 || strconv.Itoa(logN) != s.Args[1] {
+		return nil, errors.New("age: invalid scrypt work factor")
+	}
+	if logN > i.maxWorkFactor {
+		return nil, fmt.Errorf("age: scrypt work factor %d exceeds maximum %d", logN, i.maxWorkFactor)
+	}
+	key, err := scryptKey(i.passphrase, salt, logN)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aeadOpen(key, s.Body)
+	if err != nil {
+		return nil, ErrIncorrectIdentity
+	}
+	return fileKey, nil
+}
+
+func scryptKey(passphrase, salt []byte, logN int) ([]byte, error) {
+	s := append([]byte(scryptLabel), salt...)
+	return scrypt.Key(passphrase, s, 1<<logN, 8, 1, chacha20poly1305.KeySize)
+}
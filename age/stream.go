@@ -0,0 +1,51 @@
+package age
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// payload implements the STREAM construction of the age payload: chunks
+// sealed with ChaCha20-Poly1305 under a nonce of an 11 byte big-endian
+// chunk counter and a flag marking the last chunk
+type payload struct {
+	aead    cipher.AEAD
+	nonce   [chacha20poly1305.NonceSize]byte
+	counter uint64
+	out     []byte
+}
+
+func newPayload(fileKey, nonce []byte) (*payload, error) {
+	aead, err := chacha20poly1305.New(hkdfKey(fileKey, nonce, "payload", chacha20poly1305.KeySize))
+	if err != nil {
+		return nil, err
+	}
+	return &payload{aead: aead}, nil
+}
+
+func (p *payload) next(last bool) []byte {
+	binary.BigEndian.PutUint64(p.nonce[3:11], p.counter)
+	p.nonce[11] = 0
+	if last {
+		p.nonce[11] = 1
+	}
+	p.counter++
+	return p.nonce[:]
+}
+
+// seal returns the sealed chunk, valid until the next call
+func (p *payload) seal(plaintext []byte, last bool) []byte {
+	p.out = p.aead.Seal(p.out[:0], p.next(last), plaintext, nil)
+	return p.out
+}
+
+// open opens the chunk in place
+func (p *payload) open(chunk []byte, last bool) ([]byte, error) {
+	plain, err := p.aead.Open(chunk[:0], p.next(last), chunk, nil)
+	if err != nil {
+		return nil, ErrNotAuthentic
+	}
+	return plain, nil
+}
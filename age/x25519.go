@@ -0,0 +1,183 @@
+package age
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+const x25519Label = "age-encryption.org/v1/X25519"
+
+// X25519Recipient encrypts to an age public key, "age1..."
+type X25519Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// Ensure X25519Recipient implements Recipient and X25519Identity implements Identity
+var (
+	_ Recipient = (*X25519Recipient)(nil)
+	_ Identity  = (*X25519Identity)(nil)
+)
+
+// ParseX25519Recipient parses an age public key as printed by age-keygen
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("age: malformed recipient %q: %w", s, err)
+	}
+	if hrp != "age" || strings.ToLower(s) != s {
+		return nil, fmt.Errorf("age: malformed recipient %q", s)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("age: malformed recipient %q: %w", s, err)
+	}
+	return &X25519Recipient{key: key}, nil
+}
+
+// String returns the recipient in its "age1..." form
+func (r *X25519Recipient) String() string {
+	return bech32Encode("age", r.key.Bytes())
+}
+
+// Wrap wraps the file key with a key agreed with a fresh ephemeral key
+func (r *X25519Recipient) Wrap(fileKey []byte) ([]*Stanza, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(middleware.Rand())
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(r.key)
+	if err != nil {
+		return nil, err
+	}
+	share := ephemeral.PublicKey().Bytes()
+	salt := append(append([]byte(nil), share...), r.key.Bytes()...)
+	body, err := aeadSeal(hkdfKey(shared, salt, x25519Label, chacha20poly1305.KeySize), fileKey)
+	if err != nil {
+		return nil, err
+	}
+	return []*Stanza{{Type: "X25519", Args: []string{b64.EncodeToString(share)}, Body: body}}, nil
+}
+
+// X25519Identity decrypts streams encrypted to its recipient
+type X25519Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateX25519Identity creates a new random identity
+func GenerateX25519Identity() (*X25519Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(middleware.Rand())
+	if err != nil {
+		return nil, err
+	}
+	return &X25519Identity{key: key}, nil
+}
+
+// ParseX25519Identity parses an age secret key, "AGE-SECRET-KEY-1..."
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("age: malformed secret key: %w", err)
+	}
+	if hrp != "age-secret-key-" {
+		return nil, errors.New("age: malformed secret key: unknown type")
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("age: malformed secret key: %w", err)
+	}
+	return &X25519Identity{key: key}, nil
+}
+
+// Recipient returns the public key of the identity
+func (i *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{key: i.key.PublicKey()}
+}
+
+// String returns the identity in its "AGE-SECRET-KEY-1..." form
+func (i *X25519Identity) String() string {
+	return strings.ToUpper(bech32Encode("age-secret-key-", i.key.Bytes()))
+}
+
+// Unwrap returns the file key of the first X25519 stanza addressed to the identity
+func (i *X25519Identity) Unwrap(stanzas []*Stanza) ([]byte, error) {
+	for _, s := range stanzas {
+		if s.Type != "X25519" {
+			continue
+		}
+		if len(s.Args) != 1 {
+			return nil, errors.New("age: invalid X25519 stanza")
+		}
+		share, err := b64.DecodeString(s.Args[0])
+		if err != nil || len(share) != 32 {
+			return nil, errors.New("age: invalid X25519 stanza")
+		}
+		if len(s.Body) != fileKeySize+chacha20poly1305.Overhead {
+			return nil, errors.New("age: invalid X25519 stanza")
+		}
+		pub, err := ecdh.X25519().NewPublicKey(share)
+		if err != nil {
+			return nil, errors.New("age: invalid X25519 stanza")
+		}
+		shared, err := i.key.ECDH(pub)
+		if err != nil {
+			// low order share, rejected like an all-zero shared secret
+			return nil, errors.New("age: invalid X25519 stanza")
+		}
+		salt := append(append([]byte(nil), share...), i.key.PublicKey().Bytes()...)
+		fileKey, err := aeadOpen(hkdfKey(shared, salt, x25519Label, chacha20poly1305.KeySize), s.Body)
+		if err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, ErrIncorrectIdentity
+}
+
+// ParseIdentities parses an identity file as written by age-keygen: one
+// secret key per line, with empty lines and "#" comments ignored
+func ParseIdentities(r io.Reader) ([]Identity, error) {
+	data, err := io.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	var ids []Identity
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		id, err := ParseX25519Identity(string(line))
+		if err != nil {
+			return nil, fmt.Errorf("age: identity file line %d: %w", n+1, err)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("age: no identities found")
+	}
+	return ids, nil
+}
+
+// aeadSeal encrypts a file key with ChaCha20-Poly1305 and a zero nonce,
+// which is safe because every wrapping key is used once
+func aeadSeal(key, plaintext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), plaintext, nil), nil
+}
+
+func aeadOpen(key, ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), ciphertext, nil)
+}
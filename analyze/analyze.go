@@ -0,0 +1,193 @@
+// Package analyze provides a passthrough middleware estimating how well the
+// data passing it compresses, to help choosing the pipeline per data
+// source. Place it on the plaintext side of a chain.
+package analyze
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"sync"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+const (
+	// blockSize is the window of the LZ estimate, matches are only found
+	// within a block
+	blockSize = 64 * 1024
+
+	minMatch  = 4
+	tableBits = 14
+
+	// matchCost is the assumed encoded size of a match in bytes
+	matchCost = 3
+)
+
+// Stats summarizes the data seen by an analyzer
+type Stats struct {
+	// Bytes is the number of bytes analyzed
+	Bytes int64
+
+	// Histogram counts the occurrences of every byte value
+	Histogram [256]int64
+
+	// Distinct is the number of byte values that occurred
+	Distinct int
+
+	// Entropy is the order-0 entropy in bits per byte, between 0 and 8
+	Entropy float64
+
+	// LZRatio estimates the compressed size as a fraction of the input from
+	// repeated sequences alone, e.g. 0.3 means the data shrinks to about 30%
+	LZRatio float64
+}
+
+// EntropyRatio returns Entropy/8, the size fraction reachable by entropy
+// coding single bytes
+func (s Stats) EntropyRatio() float64 {
+	return s.Entropy / 8
+}
+
+// Middleware passes data through unchanged and analyzes it on write and read
+type Middleware struct {
+	mu      sync.Mutex
+	hist    [256]int64
+	bytes   int64
+	lzBytes int64 // estimated LZ output for the analyzed bytes
+	block   []byte
+}
+
+// Ensure Middleware implements middleware.Middleware and middleware.Describer interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+)
+
+// New creates an analyzer
+func New() *Middleware {
+	return &Middleware{block: make([]byte, 0, blockSize)}
+}
+
+// Describe reports the analyzer
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{Type: "analysis"}
+}
+
+// Writer wraps w, analyzing written data
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return &writer{m: m, w: w}
+}
+
+// Reader wraps r, analyzing read data
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return &reader{m: m, r: r}
+}
+
+// Stats returns the statistics of all data seen so far. It is safe to call
+// while streams are running.
+func (m *Middleware) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := Stats{Bytes: m.bytes, Histogram: m.hist}
+	if m.bytes == 0 {
+		return s
+	}
+	for _, c := range m.hist {
+		if c == 0 {
+			continue
+		}
+		s.Distinct++
+		p := float64(c) / float64(m.bytes)
+		s.Entropy -= p * math.Log2(p)
+	}
+	s.LZRatio = float64(m.lzBytes+estimate(m.block)) / float64(m.bytes)
+	return s
+}
+
+// Reset discards the statistics
+func (m *Middleware) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hist = [256]int64{}
+	m.bytes, m.lzBytes = 0, 0
+	m.block = m.block[:0]
+}
+
+func (m *Middleware) observe(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes += int64(len(p))
+	for _, b := range p {
+		m.hist[b]++
+	}
+	for len(p) > 0 {
+		n := copy(m.block[len(m.block):cap(m.block)], p)
+		m.block = m.block[:len(m.block)+n]
+		p = p[n:]
+		if len(m.block) == cap(m.block) {
+			m.lzBytes += estimate(m.block)
+			m.block = m.block[:0]
+		}
+	}
+}
+
+// estimate returns the LZ output size of block, counting literals as one
+// byte and matches as matchCost bytes, using a greedy hash match finder
+func estimate(block []byte) int64 {
+	var table [1 << tableBits]int32
+	var out int64
+	i := 0
+	for i+minMatch <= len(block) {
+		h := hash(block[i:])
+		cand := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if cand < 0 || binary.LittleEndian.Uint32(block[cand:]) != binary.LittleEndian.Uint32(block[i:]) {
+			out++
+			i++
+			continue
+		}
+		n := minMatch
+		for i+n < len(block) && block[cand+n] == block[i+n] {
+			n++
+		}
+		out += matchCost
+		i += n
+	}
+	return out + int64(len(block)-i)
+}
+
+func hash(b []byte) uint32 {
+	return (binary.LittleEndian.Uint32(b) * 2654435761) >> (32 - tableBits)
+}
+
+type writer struct {
+	m     *Middleware
+	w     io.Writer
+	state middleware.WriterState
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	w.m.observe(p[:n])
+	return n, w.state.Fail(err)
+}
+
+// Close marks the writer closed; it does not close the underlying writer
+func (w *writer) Close() error {
+	return w.state.Close(nil)
+}
+
+type reader struct {
+	m *Middleware
+	r io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.m.observe(p[:n])
+	return n, err
+}
@@ -0,0 +1,122 @@
+package analyze_test
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/analyze"
+	"schneider.vip/hybridbuffer/middleware/corpus"
+)
+
+func analyzeWrite(t *testing.T, data []byte) analyze.Stats {
+	t.Helper()
+	m := analyze.New()
+	var out bytes.Buffer
+	w := m.Writer(&out)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("data changed")
+	}
+	return m.Stats()
+}
+
+func TestEstimates(t *testing.T) {
+	quarters := make([]byte, 1<<20)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range quarters {
+		quarters[i] = "ACGT"[rng.IntN(4)]
+	}
+	tests := []struct {
+		name         string
+		data         []byte
+		distinct     int     // -1 to skip the check
+		entropy      float64 // expected entropy within 0.01, -1 to skip the check
+		minLZ, maxLZ float64
+	}{
+		{"zeros", make([]byte, 1<<20), 1, 0, 0, 0.01},
+		{"four symbols", quarters, 4, 2, 0.5, 0.9},
+		{"random", corpus.Generate(corpus.Random, 1<<20, 1), 256, 8, 0.99, 1.01},
+		{"json", corpus.Generate(corpus.JSON, 1<<20, 1), -1, -1, 0.1, 0.6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := analyzeWrite(t, tt.data)
+			if s.Bytes != int64(len(tt.data)) {
+				t.Fatalf("analyzed %d bytes", s.Bytes)
+			}
+			if tt.distinct >= 0 && s.Distinct != tt.distinct {
+				t.Errorf("distinct %d, want %d", s.Distinct, tt.distinct)
+			}
+			if tt.entropy >= 0 && math.Abs(s.Entropy-tt.entropy) > 0.01 {
+				t.Errorf("entropy %.3f, want %.1f", s.Entropy, tt.entropy)
+			}
+			if s.LZRatio < tt.minLZ || s.LZRatio > tt.maxLZ {
+				t.Errorf("LZ ratio %.3f, want between %.2f and %.2f", s.LZRatio, tt.minLZ, tt.maxLZ)
+			}
+			if math.Abs(s.EntropyRatio()-s.Entropy/8) > 1e-9 {
+				t.Errorf("entropy ratio %.3f", s.EntropyRatio())
+			}
+		})
+	}
+}
+
+func TestHistogramAndReset(t *testing.T) {
+	m := analyze.New()
+	w := m.Writer(io.Discard)
+	w.Write([]byte("abracadabra"))
+	// reads are analyzed like writes
+	io.ReadAll(m.Reader(bytes.NewReader([]byte("aa"))))
+
+	s := m.Stats()
+	if s.Bytes != 13 || s.Histogram['a'] != 7 || s.Histogram['b'] != 2 || s.Histogram['r'] != 2 || s.Distinct != 5 {
+		t.Fatalf("stats %+v", s)
+	}
+	m.Reset()
+	if s := m.Stats(); s.Bytes != 0 || s.Distinct != 0 || s.LZRatio != 0 {
+		t.Fatalf("after reset: %+v", s)
+	}
+}
+
+func TestWriteChunking(t *testing.T) {
+	// the estimate does not depend on how the data is split into writes
+	data := corpus.Generate(corpus.Text, 300<<10, 3)
+	whole := analyzeWrite(t, data).LZRatio
+
+	m := analyze.New()
+	w := m.Writer(io.Discard)
+	for p := data; len(p) > 0; {
+		n := min(len(p), 1000)
+		w.Write(p[:n])
+		p = p[n:]
+	}
+	if got := m.Stats().LZRatio; got != whole {
+		t.Fatalf("chunked %.4f, whole %.4f", got, whole)
+	}
+}
+
+func TestConcurrentStats(t *testing.T) {
+	m := analyze.New()
+	data := corpus.Generate(corpus.Text, 64<<10, 4)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := m.Writer(io.Discard)
+			for j := 0; j < 16; j++ {
+				w.Write(data)
+				m.Stats()
+			}
+		}()
+	}
+	wg.Wait()
+	if s := m.Stats(); s.Bytes != 4*16*int64(len(data)) {
+		t.Fatalf("analyzed %d bytes", s.Bytes)
+	}
+}
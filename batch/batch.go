@@ -0,0 +1,219 @@
+// Package batch provides a middleware collecting small writes into larger
+// sink writes. A batch is written once it reaches the batch size or, with
+// WithMaxDelay, once its first byte waited for the delay, whichever comes
+// first. Interactive producers writing small records get a bounded latency
+// while bulk producers still get large sink writes.
+//
+// The data is not changed, Readers pass the stream through. Place the
+// layer outermost in a chain to batch the writes reaching the sink.
+package batch
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// DefaultSize is the default batch size
+const DefaultSize = 64 * 1024
+
+// minSize is the smallest batch size ForMemory shrinks to
+const minSize = 512
+
+// Middleware batches writes
+type Middleware struct {
+	size     int
+	maxDelay time.Duration
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware     = (*Middleware)(nil)
+	_ middleware.Describer      = (*Middleware)(nil)
+	_ middleware.MemoryUser     = (*Middleware)(nil)
+	_ middleware.MemoryShrinker = (*Middleware)(nil)
+)
+
+// Option configures the batch middleware
+type Option func(*Middleware)
+
+// WithSize sets the batch size, the number of bytes collected before they
+// are written. Writes of at least size bytes arriving at an empty batch
+// are passed through without copying.
+func WithSize(size int) Option {
+	return func(m *Middleware) {
+		if size > 0 {
+			m.size = size
+		}
+	}
+}
+
+// WithMaxDelay bounds the time the first byte of a batch waits: the batch
+// is written d after its first byte was written, even if it is not full.
+// Such writes happen on a timer goroutine; their errors are returned by
+// the next Write or Close. By default batches wait for the batch size or
+// Close.
+func WithMaxDelay(d time.Duration) Option {
+	return func(m *Middleware) {
+		if d > 0 {
+			m.maxDelay = d
+		}
+	}
+}
+
+// New creates a new batch middleware
+func New(opts ...Option) *Middleware {
+	m := &Middleware{
+		size: DefaultSize,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Describe reports the batch size and delay
+func (m *Middleware) Describe() middleware.Component {
+	c := middleware.Component{
+		Type:       "buffering",
+		Algorithm:  "batch",
+		Properties: map[string]string{"size": fmt.Sprint(m.size)},
+	}
+	if m.maxDelay > 0 {
+		c.Properties["max_delay"] = m.maxDelay.String()
+	}
+	return c
+}
+
+// MemoryUsage estimates the memory of a Writer, the batch buffer
+func (m *Middleware) MemoryUsage() int64 {
+	return int64(m.size)
+}
+
+// ForMemory returns a copy with batches of at most budget bytes, which
+// only costs more sink writes
+func (m *Middleware) ForMemory(budget int64) (middleware.Middleware, bool) {
+	if m.MemoryUsage() <= budget {
+		return m, true
+	}
+	if budget < minSize {
+		return nil, false
+	}
+	c := *m
+	c.size = int(budget)
+	return &c, true
+}
+
+// Writer batches the writes to w. The returned writer has a Flush method
+// writing the pending batch at once. Closing it writes the last batch; it
+// does not close w.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return &Writer{
+		w:        w,
+		buf:      make([]byte, 0, m.size),
+		maxDelay: m.maxDelay,
+		state:    middleware.WriterState{Layer: "batch"},
+	}
+}
+
+// Reader returns r, batching needs no decoding
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return r
+}
+
+// Writer is the writer returned by Middleware.Writer. It is safe to call
+// Flush concurrently with Write.
+type Writer struct {
+	w        io.Writer
+	maxDelay time.Duration
+
+	mu    sync.Mutex
+	buf   []byte
+	timer *time.Timer
+	batch uint64 // number of the pending batch, so late timers are ignored
+	state middleware.WriterState
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if len(w.buf) == 0 && len(p) >= cap(w.buf) {
+		n, err := w.w.Write(p)
+		if err == nil && n < len(p) {
+			err = io.ErrShortWrite
+		}
+		return n, w.state.Fail(err)
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == 0 {
+			w.schedule()
+		}
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// schedule starts the timer of a new batch
+func (w *Writer) schedule() {
+	if w.maxDelay == 0 {
+		return
+	}
+	batch := w.batch
+	w.timer = time.AfterFunc(w.maxDelay, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.batch == batch && w.state.Err() == nil {
+			w.flush()
+		}
+	})
+}
+
+// flush writes the pending batch and stops its timer
+func (w *Writer) flush() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.batch++
+	if len(w.buf) == 0 {
+		return nil
+	}
+	n, err := w.w.Write(w.buf)
+	if err == nil && n < len(w.buf) {
+		err = io.ErrShortWrite
+	}
+	w.buf = w.buf[:0]
+	return w.state.Fail(err)
+}
+
+// Flush writes the pending batch
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.state.Err(); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// Close writes the pending batch
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state.Close(w.flush)
+}
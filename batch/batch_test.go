@@ -0,0 +1,99 @@
+package batch_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/batch"
+)
+
+// recorder records the sizes of the writes reaching it
+type recorder struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes []int
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes, len(p))
+	return r.buf.Write(p)
+}
+
+func (r *recorder) snapshot() ([]byte, []int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return bytes.Clone(r.buf.Bytes()), append([]int(nil), r.writes...)
+}
+
+func TestBatching(t *testing.T) {
+	var rec recorder
+	w := batch.New(batch.WithSize(16)).Writer(&rec)
+	var want []byte
+	for i := range 10 {
+		p := bytes.Repeat([]byte{byte('a' + i)}, 5)
+		w.Write(p)
+		want = append(want, p...)
+	}
+	big := bytes.Repeat([]byte("B"), 40)
+	w.(*batch.Writer).Flush()
+	w.Write(big)
+	want = append(want, big...)
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, writes := rec.snapshot()
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i, n := range writes[:len(writes)-2] {
+		if n != 16 {
+			t.Fatalf("write %d of %d bytes, want batches of 16: %v", i, n, writes)
+		}
+	}
+	if writes[len(writes)-1] != len(big) {
+		t.Fatalf("large write was split: %v", writes)
+	}
+}
+
+func TestMaxDelay(t *testing.T) {
+	var rec recorder
+	w := batch.New(batch.WithSize(1024), batch.WithMaxDelay(10*time.Millisecond)).Writer(&rec)
+	w.Write([]byte("late"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if got, _ := rec.snapshot(); string(got) == "late" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("batch not written after the delay")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// shortWriter accepts at most half of every write without an error
+type shortWriter struct{}
+
+func (shortWriter) Write(p []byte) (int, error) { return len(p) / 2, nil }
+
+func TestShortWrite(t *testing.T) {
+	w := batch.New(batch.WithSize(16)).Writer(shortWriter{})
+	if _, err := w.Write(make([]byte, 32)); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("direct write: got %v, want io.ErrShortWrite", err)
+	}
+
+	w = batch.New(batch.WithSize(16)).Writer(shortWriter{})
+	w.Write(make([]byte, 8))
+	if err := w.(io.Closer).Close(); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("flush: got %v, want io.ErrShortWrite", err)
+	}
+}
@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// BufferIDFormatVersion is the header format version written by BufferIDHeader
+const BufferIDFormatVersion = 1
+
+var bufferIDMagic = [3]byte{'H', 'B', 'U'}
+
+const bufferIDHeaderSize = len(bufferIDMagic) + 1 + len(BufferID{})
+
+func init() {
+	RegisterFormat("buffer-id-header", func(p []byte) (string, int, bool) {
+		if len(p) < bufferIDHeaderSize || !hasPrefix(p, bufferIDMagic[:]...) {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, buffer %s", p[3], BufferID(p[4:bufferIDHeaderSize])), bufferIDHeaderSize, true
+	})
+}
+
+// ErrBufferIDMismatch is returned by Readers when a stream carries another
+// buffer ID than the one set with WithBufferID
+var ErrBufferIDMismatch = errors.New("middleware: buffer ID mismatch")
+
+// BufferID identifies one stored buffer across the systems that write,
+// read, audit and bill it. It is a random (version 4) UUID.
+type BufferID [16]byte
+
+// NewBufferID returns a random buffer ID drawn from Rand()
+func NewBufferID() (BufferID, error) {
+	var id BufferID
+	if _, err := io.ReadFull(Rand(), id[:]); err != nil {
+		return BufferID{}, fmt.Errorf("middleware: failed to generate buffer ID: %w", err)
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id, nil
+}
+
+// ParseBufferID parses the UUID form returned by String
+func ParseBufferID(s string) (BufferID, error) {
+	var id BufferID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return id, fmt.Errorf("middleware: invalid buffer ID %q", s)
+	}
+	h := s[:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	if _, err := hex.Decode(id[:], []byte(h)); err != nil {
+		return BufferID{}, fmt.Errorf("middleware: invalid buffer ID %q", s)
+	}
+	return id, nil
+}
+
+// IsZero reports whether id is unset
+func (id BufferID) IsZero() bool {
+	return id == BufferID{}
+}
+
+// String returns the UUID form of id
+func (id BufferID) String() string {
+	h := hex.EncodeToString(id[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// bufferIDSlot holds the buffer ID of one stream. Writers fill in a zero ID
+// when they embed it, Readers when they find one in a header.
+type bufferIDSlot struct {
+	mu sync.Mutex
+	id BufferID
+}
+
+type bufferIDKey struct{}
+
+// WithBufferID returns a context carrying a buffer ID for one stream.
+// Writers created with WriterContext embed it in their headers; a zero id
+// is replaced by a NewBufferID when the first layer embeds it. Readers
+// created with ReaderContext record the ID found in the stream, failing
+// with ErrBufferIDMismatch if id was not zero and differs. The ID of the
+// stream is available from BufferIDFromContext and reported in Completion.
+func WithBufferID(ctx context.Context, id BufferID) context.Context {
+	return context.WithValue(ctx, bufferIDKey{}, &bufferIDSlot{id: id})
+}
+
+// BufferIDFromContext returns the buffer ID of the stream of ctx, false if
+// ctx has none or it is not known yet
+func BufferIDFromContext(ctx context.Context) (BufferID, bool) {
+	s, ok := ctx.Value(bufferIDKey{}).(*bufferIDSlot)
+	if !ok {
+		return BufferID{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id, !s.id.IsZero()
+}
+
+// AssignBufferID returns the buffer ID for a Writer to embed, generating
+// it if the context carries a zero ID. It returns false if ctx carries no
+// buffer ID, in which case Writers embed nothing.
+func AssignBufferID(ctx context.Context) (BufferID, bool, error) {
+	s, ok := ctx.Value(bufferIDKey{}).(*bufferIDSlot)
+	if !ok {
+		return BufferID{}, false, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.id.IsZero() {
+		id, err := NewBufferID()
+		if err != nil {
+			return BufferID{}, false, err
+		}
+		s.id = id
+	}
+	return s.id, true, nil
+}
+
+// RecordBufferID records the buffer ID a Reader found in a stream header.
+// Layers with authenticated headers call it only after authentication.
+func RecordBufferID(ctx context.Context, id BufferID) error {
+	s, ok := ctx.Value(bufferIDKey{}).(*bufferIDSlot)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.id {
+	case BufferID{}:
+		s.id = id
+	case id:
+	default:
+		return fmt.Errorf("%w: stream %s, expected %s", ErrBufferIDMismatch, id, s.id)
+	}
+	return nil
+}
+
+// BufferIDHeader returns a layer writing the buffer ID ahead of the stream,
+// for pipelines without a layer embedding it. It is authenticated when the
+// layer is placed before an encryption layer. Writers without a buffer ID
+// in their context write a new random one.
+func BufferIDHeader() Middleware {
+	return bufferIDHeader{}
+}
+
+type bufferIDHeader struct{}
+
+// Ensure bufferIDHeader implements the ContextMiddleware and Versioned interfaces
+var (
+	_ ContextMiddleware = bufferIDHeader{}
+	_ Versioned         = bufferIDHeader{}
+)
+
+// FormatVersion returns the header format version written by the Writer
+func (bufferIDHeader) FormatVersion() uint8 { return BufferIDFormatVersion }
+
+// MaxSupportedVersion returns the highest header format version the Reader understands
+func (bufferIDHeader) MaxSupportedVersion() uint8 { return BufferIDFormatVersion }
+
+func (b bufferIDHeader) Writer(w io.Writer) io.Writer {
+	return b.WriterContext(context.Background(), w)
+}
+
+// WriterContext writes the buffer ID of ctx ahead of the first byte
+func (bufferIDHeader) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	id, ok, err := AssignBufferID(ctx)
+	if err == nil && !ok {
+		id, err = NewBufferID()
+	}
+	if err != nil {
+		return &errWriter{err: err}
+	}
+	hdr := append(bufferIDMagic[:], BufferIDFormatVersion)
+	pw := &prefixWriter{w: w, prefix: append(hdr, id[:]...)}
+	return &dynamicWriter{inner: pw, prefix: pw}
+}
+
+func (b bufferIDHeader) Reader(r io.Reader) io.Reader {
+	return b.ReaderContext(context.Background(), r)
+}
+
+// ReaderContext reads the buffer ID header and records it in ctx. Header
+// errors and ErrBufferIDMismatch are returned from Read.
+func (bufferIDHeader) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return &bufferIDReader{ctx: ctx, r: r, state: ReaderState{Layer: "buffer-id"}}
+}
+
+type bufferIDReader struct {
+	ctx    context.Context
+	r      io.Reader
+	header bool
+	state  ReaderState
+}
+
+func (b *bufferIDReader) Read(p []byte) (int, error) {
+	if err := b.state.Err(); err != nil {
+		return 0, err
+	}
+	if !b.header {
+		var hdr [bufferIDHeaderSize]byte
+		if _, err := io.ReadFull(b.r, hdr[:]); err != nil {
+			return b.state.Track(0, fmt.Errorf("middleware: read buffer ID header: %w", err))
+		}
+		if [3]byte(hdr[:3]) != bufferIDMagic {
+			return b.state.Track(0, errors.New("middleware: missing buffer ID header"))
+		}
+		if _, err := CheckVersion("buffer-id", hdr[3], BufferIDFormatVersion, RejectUnknown); err != nil {
+			return b.state.Track(0, err)
+		}
+		if err := RecordBufferID(b.ctx, BufferID(hdr[4:])); err != nil {
+			return b.state.Track(0, err)
+		}
+		b.header = true
+	}
+	return b.state.Track(b.r.Read(p))
+}
@@ -0,0 +1,397 @@
+// Package catalog records the buffers written in a batch in a single
+// manifest stream, for backup-like workflows: which buffers exist, their
+// sizes and digests, the key they were encrypted with and the pipeline
+// they were written through.
+//
+// A Recorder wraps the writers of the batch and collects an Entry for
+// every closed buffer. WriteCatalog writes the collected Catalog, signed
+// with an Ed25519 key and encrypted through a middleware if configured.
+// Open reads it back, verifying the signature, and Catalog.Verify checks
+// stored buffers against their entries.
+package catalog
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// FormatVersion is the format version of catalog streams
+const FormatVersion = 1
+
+var magic = [3]byte{'H', 'B', 'G'}
+
+const (
+	// MaxCatalogSize bounds the encoded entries accepted by Open
+	MaxCatalogSize = 64 << 20
+
+	headerSize = len(magic) + 2 + 4
+	flagSigned = 1
+)
+
+func init() {
+	middleware.RegisterFormat("catalog", func(p []byte) (string, int, bool) {
+		if len(p) < headerSize || [3]byte(p[:3]) != magic {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, signed %t, %d bytes", p[3], p[4]&flagSigned != 0, binary.BigEndian.Uint32(p[5:])), 0, true
+	})
+}
+
+var (
+	// ErrNotSigned is returned by Open with a verifier for unsigned catalogs
+	ErrNotSigned = errors.New("catalog: catalog is not signed")
+
+	// ErrBadSignature is returned by Open if the signature does not match
+	ErrBadSignature = errors.New("catalog: invalid signature")
+
+	// ErrUnknownBuffer is returned by Verify for IDs without entry
+	ErrUnknownBuffer = errors.New("catalog: unknown buffer")
+
+	// ErrMismatch is returned by Verify if a buffer does not match its entry
+	ErrMismatch = errors.New("catalog: buffer does not match catalog")
+)
+
+// Entry describes one buffer of a batch
+type Entry struct {
+	ID           string             `json:"id"`
+	Written      time.Time          `json:"written"`
+	PlainSize    int64              `json:"plain_size"`
+	StoredSize   int64              `json:"stored_size"`
+	PlainSHA256  []byte             `json:"plain_sha256"`
+	StoredSHA256 []byte             `json:"stored_sha256"`
+	KeyID        string             `json:"key_id,omitempty"`
+	Pipeline     *middleware.Report `json:"pipeline,omitempty"`
+}
+
+// Catalog lists the buffers of a batch in the order they were closed
+type Catalog struct {
+	Batch   string    `json:"batch,omitempty"`
+	Created time.Time `json:"created"`
+	Entries []Entry   `json:"entries"`
+}
+
+// Lookup returns the entry of a buffer
+func (c *Catalog) Lookup(id string) (Entry, bool) {
+	for _, e := range c.Entries {
+		if e.ID == id {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Verify reads the stored form of a buffer from stored and checks its size
+// and digest. If m is not nil, the stream is also read through m and the
+// plaintext is checked, which needs the keys of the pipeline.
+func (c *Catalog) Verify(id string, stored io.Reader, m middleware.Middleware) error {
+	e, ok := c.Lookup(id)
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownBuffer, id)
+	}
+	sh := &hashCounter{h: sha256.New()}
+	src := io.TeeReader(stored, sh)
+	if m != nil {
+		ph := &hashCounter{h: sha256.New()}
+		if _, err := io.Copy(ph, m.Reader(src)); err != nil {
+			return fmt.Errorf("catalog: read %q: %w", id, err)
+		}
+		if ph.n != e.PlainSize || !bytes.Equal(ph.h.Sum(nil), e.PlainSHA256) {
+			return fmt.Errorf("%w: %q plaintext", ErrMismatch, id)
+		}
+	}
+	// the pipeline may not have consumed trailing bytes
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return fmt.Errorf("catalog: read %q: %w", id, err)
+	}
+	if sh.n != e.StoredSize || !bytes.Equal(sh.h.Sum(nil), e.StoredSHA256) {
+		return fmt.Errorf("%w: %q stored stream", ErrMismatch, id)
+	}
+	return nil
+}
+
+// Option configures a Recorder, WriteCatalog and Open
+type Option func(*config)
+
+type config struct {
+	batch    string
+	keyID    func(id string) string
+	enc      middleware.Middleware
+	signer   ed25519.PrivateKey
+	verifier ed25519.PublicKey
+	now      func() time.Time
+}
+
+// WithBatch sets the batch name stored in the catalog
+func WithBatch(name string) Option {
+	return func(c *config) {
+		c.batch = name
+	}
+}
+
+// WithKeyID sets the function returning the key ID recorded for a buffer
+func WithKeyID(fn func(id string) string) Option {
+	return func(c *config) {
+		c.keyID = fn
+	}
+}
+
+// WithEncryption encrypts the catalog stream with m, Open must be given an
+// equivalent middleware
+func WithEncryption(m middleware.Middleware) Option {
+	return func(c *config) {
+		c.enc = m
+	}
+}
+
+// WithSigner signs the catalog with key
+func WithSigner(key ed25519.PrivateKey) Option {
+	return func(c *config) {
+		c.signer = key
+	}
+}
+
+// WithVerifier makes Open require a valid signature by key
+func WithVerifier(key ed25519.PublicKey) Option {
+	return func(c *config) {
+		c.verifier = key
+	}
+}
+
+// WithClock sets the time source of the recorded timestamps
+func WithClock(now func() time.Time) Option {
+	return func(c *config) {
+		c.now = now
+	}
+}
+
+func newConfig(opts []Option) *config {
+	c := &config{now: time.Now}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Recorder collects the entries of a batch. It is safe for concurrent use.
+type Recorder struct {
+	m      middleware.Middleware
+	cfg    *config
+	report middleware.Report
+
+	mu      sync.Mutex
+	catalog Catalog
+}
+
+// NewRecorder creates a recorder for buffers written through m. The
+// compliance report of m is recorded as pipeline config of every entry.
+func NewRecorder(m middleware.Middleware, opts ...Option) *Recorder {
+	cfg := newConfig(opts)
+	return &Recorder{
+		m:       m,
+		cfg:     cfg,
+		report:  middleware.ComplianceReport(m),
+		catalog: Catalog{Batch: cfg.batch, Created: cfg.now().UTC()},
+	}
+}
+
+// Writer wraps w with the pipeline of the recorder. Closing the returned
+// writer closes the pipeline writer and records the buffer as id; w is
+// not closed.
+func (r *Recorder) Writer(id string, w io.Writer) io.WriteCloser {
+	stored := &hashCounter{h: sha256.New(), w: w}
+	return &writer{
+		r:      r,
+		id:     id,
+		stored: stored,
+		plain:  &hashCounter{h: sha256.New()},
+		w:      r.m.Writer(stored),
+		state:  middleware.WriterState{Layer: "catalog"},
+	}
+}
+
+// Catalog returns a copy of the catalog recorded so far
+func (r *Recorder) Catalog() *Catalog {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.catalog
+	c.Entries = append([]Entry(nil), c.Entries...)
+	return &c
+}
+
+// WriteCatalog writes the catalog recorded so far to w, see Write
+func (r *Recorder) WriteCatalog(w io.Writer) error {
+	return write(w, r.Catalog(), r.cfg)
+}
+
+func (r *Recorder) record(e Entry) {
+	r.mu.Lock()
+	r.catalog.Entries = append(r.catalog.Entries, e)
+	r.mu.Unlock()
+}
+
+type writer struct {
+	r      *Recorder
+	id     string
+	stored *hashCounter
+	plain  *hashCounter
+	w      io.Writer
+	state  middleware.WriterState
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	w.plain.Write(p[:n])
+	return n, w.state.Fail(err)
+}
+
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if cl, ok := w.w.(io.Closer); ok {
+			if err := cl.Close(); err != nil {
+				return err
+			}
+		}
+		e := Entry{
+			ID:           w.id,
+			Written:      w.r.cfg.now().UTC(),
+			PlainSize:    w.plain.n,
+			StoredSize:   w.stored.n,
+			PlainSHA256:  w.plain.h.Sum(nil),
+			StoredSHA256: w.stored.h.Sum(nil),
+			Pipeline:     &w.r.report,
+		}
+		if w.r.cfg.keyID != nil {
+			e.KeyID = w.r.cfg.keyID(w.id)
+		}
+		w.r.record(e)
+		return nil
+	})
+}
+
+// Write writes c to w, signed and encrypted as configured by WithSigner
+// and WithEncryption
+func Write(w io.Writer, c *Catalog, opts ...Option) error {
+	return write(w, c, newConfig(opts))
+}
+
+func write(w io.Writer, c *Catalog, cfg *config) error {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("catalog: encode: %w", err)
+	}
+	if len(body) > MaxCatalogSize {
+		return fmt.Errorf("catalog: encoded catalog exceeds %d bytes", MaxCatalogSize)
+	}
+	data := make([]byte, headerSize, headerSize+len(body)+ed25519.SignatureSize)
+	copy(data, magic[:])
+	data[3] = FormatVersion
+	if cfg.signer != nil {
+		data[4] = flagSigned
+	}
+	binary.BigEndian.PutUint32(data[5:], uint32(len(body)))
+	data = append(data, body...)
+	if cfg.signer != nil {
+		data = append(data, ed25519.Sign(cfg.signer, data)...)
+	}
+	dst := w
+	if cfg.enc != nil {
+		dst = cfg.enc.Writer(w)
+	}
+	if _, err := dst.Write(data); err != nil {
+		return err
+	}
+	if cfg.enc != nil {
+		if cl, ok := dst.(io.Closer); ok {
+			return cl.Close()
+		}
+	}
+	return nil
+}
+
+// Open reads a catalog written by Write or Recorder.WriteCatalog,
+// decrypting it with the middleware of WithEncryption. With WithVerifier
+// the signature is required and checked, otherwise it is ignored.
+func Open(r io.Reader, opts ...Option) (*Catalog, error) {
+	cfg := newConfig(opts)
+	if cfg.enc != nil {
+		r = cfg.enc.Reader(r)
+	}
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("catalog: read header: %w", err)
+	}
+	if [3]byte(hdr[:3]) != magic {
+		return nil, errors.New("catalog: not a catalog stream")
+	}
+	if _, err := middleware.CheckVersion("catalog", hdr[3], FormatVersion, middleware.RejectUnknown); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[5:])
+	if n > MaxCatalogSize {
+		return nil, fmt.Errorf("catalog: catalog exceeds %d bytes", MaxCatalogSize)
+	}
+	signed := hdr[4]&flagSigned != 0
+	size := int(n)
+	if signed {
+		size += ed25519.SignatureSize
+	}
+	data := make([]byte, headerSize+size)
+	copy(data, hdr)
+	if _, err := io.ReadFull(r, data[headerSize:]); err != nil {
+		return nil, fmt.Errorf("catalog: read catalog: %w", err)
+	}
+	// reading to the end lets an encryption layer authenticate the final package
+	if extra, err := io.CopyN(io.Discard, r, 1); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("catalog: read catalog: %w", err)
+	} else if extra > 0 {
+		return nil, errors.New("catalog: trailing data after catalog")
+	}
+	body := data[headerSize : headerSize+int(n)]
+	if cfg.verifier != nil {
+		if !signed {
+			return nil, ErrNotSigned
+		}
+		if !ed25519.Verify(cfg.verifier, data[:headerSize+int(n)], data[headerSize+int(n):]) {
+			return nil, ErrBadSignature
+		}
+	}
+	c := &Catalog{}
+	if err := json.Unmarshal(body, c); err != nil {
+		return nil, fmt.Errorf("catalog: decode: %w", err)
+	}
+	return c, nil
+}
+
+// hashCounter hashes and counts the bytes written to it, passing them on
+// to w if set
+type hashCounter struct {
+	h hash.Hash
+	w io.Writer
+	n int64
+}
+
+func (c *hashCounter) Write(p []byte) (int, error) {
+	if c.w != nil {
+		n, err := c.w.Write(p)
+		c.h.Write(p[:n])
+		c.n += int64(n)
+		return n, err
+	}
+	c.h.Write(p)
+	c.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,191 @@
+package catalog_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/catalog"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+	"schneider.vip/hybridbuffer/middleware/rle"
+)
+
+var epoch = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// batch records three buffers written through rle and returns the recorder
+// and the stored streams by ID
+func batch(t *testing.T, opts ...catalog.Option) (*catalog.Recorder, map[string][]byte) {
+	t.Helper()
+	rec := catalog.NewRecorder(rle.New(), append([]catalog.Option{
+		catalog.WithBatch("nightly"),
+		catalog.WithClock(func() time.Time { return epoch }),
+		catalog.WithKeyID(func(id string) string { return "key-" + id }),
+	}, opts...)...)
+	stored := make(map[string][]byte)
+	for _, id := range []string{"a", "b", "empty"} {
+		var buf bytes.Buffer
+		w := rec.Writer(id, &buf)
+		if id != "empty" {
+			w.Write(bytes.Repeat([]byte(id), 1000))
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		stored[id] = buf.Bytes()
+	}
+	// an unclosed writer is not recorded
+	rec.Writer("pending", io.Discard).Write([]byte("x"))
+	return rec, stored
+}
+
+func TestRecorder(t *testing.T) {
+	rec, stored := batch(t)
+	c := rec.Catalog()
+	if c.Batch != "nightly" || !c.Created.Equal(epoch) || len(c.Entries) != 3 {
+		t.Fatalf("catalog %+v", c)
+	}
+	e, ok := c.Lookup("a")
+	if !ok || e.PlainSize != 1000 || e.StoredSize != int64(len(stored["a"])) || e.KeyID != "key-a" || !e.Written.Equal(epoch) {
+		t.Fatalf("entry %+v", e)
+	}
+	if e.Pipeline == nil || len(e.Pipeline.Components) == 0 || e.Pipeline.Components[0].Algorithm != "rle" {
+		t.Fatalf("pipeline %+v", e.Pipeline)
+	}
+	if _, ok := c.Lookup("pending"); ok {
+		t.Fatal("unclosed buffer recorded")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	rec, stored := batch(t)
+	c := rec.Catalog()
+	for id, data := range stored {
+		if err := c.Verify(id, bytes.NewReader(data), nil); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if err := c.Verify(id, bytes.NewReader(data), rle.New()); err != nil {
+			t.Fatalf("%s with pipeline: %v", id, err)
+		}
+	}
+
+	tampered := bytes.Clone(stored["a"])
+	tampered[len(tampered)-2] ^= 1
+	tests := []struct {
+		name string
+		id   string
+		data []byte
+		m    middleware.Middleware
+		want error // nil for any error
+	}{
+		{"unknown", "c", stored["a"], nil, catalog.ErrUnknownBuffer},
+		{"swapped", "a", stored["b"], nil, catalog.ErrMismatch},
+		{"tampered", "a", tampered, nil, catalog.ErrMismatch},
+		{"tampered plaintext", "a", tampered, rle.New(), catalog.ErrMismatch},
+		{"trailing data", "a", append(bytes.Clone(stored["a"]), 0), rle.New(), nil},
+		{"trailing data unchecked", "a", append(bytes.Clone(stored["a"]), 0), nil, catalog.ErrMismatch},
+		{"truncated", "a", stored["a"][:len(stored["a"])-1], rle.New(), io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.Verify(tt.id, bytes.NewReader(tt.data), tt.m)
+			if err == nil {
+				t.Fatal("verified")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignedEncrypted(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	key := make([]byte, encryption.KeySize)
+	rand.Read(key)
+	enc := encryption.New(encryption.WithKey(key))
+
+	rec, _ := batch(t, catalog.WithSigner(priv), catalog.WithEncryption(enc))
+	var buf bytes.Buffer
+	if err := rec.WriteCatalog(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("nightly")) {
+		t.Fatal("catalog not encrypted")
+	}
+	c, err := catalog.Open(bytes.NewReader(buf.Bytes()), catalog.WithEncryption(enc), catalog.WithVerifier(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Batch != "nightly" || len(c.Entries) != 3 || c.Entries[2].ID != "empty" {
+		t.Fatalf("catalog %+v", c)
+	}
+
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := catalog.Open(bytes.NewReader(buf.Bytes()), catalog.WithEncryption(enc), catalog.WithVerifier(otherPub)); !errors.Is(err, catalog.ErrBadSignature) {
+		t.Fatalf("other key: got %v, want ErrBadSignature", err)
+	}
+	if _, err := catalog.Open(bytes.NewReader(buf.Bytes())); err == nil {
+		t.Fatal("encrypted catalog opened without key")
+	}
+}
+
+func TestOpenPlain(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	c := &catalog.Catalog{Batch: "manual", Created: epoch, Entries: []catalog.Entry{{ID: "x", PlainSize: 1}}}
+	var unsigned, signed bytes.Buffer
+	if err := catalog.Write(&unsigned, c); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.Write(&signed, c, catalog.WithSigner(priv)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := middleware.Inspect(bytes.NewReader(signed.Bytes()))
+	if err != nil || len(info.Formats) == 0 || info.Formats[0].Name != "catalog" {
+		t.Fatalf("inspect: %+v, %v", info, err)
+	}
+
+	// without a verifier the signature is ignored
+	for _, data := range [][]byte{unsigned.Bytes(), signed.Bytes()} {
+		got, err := catalog.Open(bytes.NewReader(data))
+		if err != nil || got.Batch != "manual" || len(got.Entries) != 1 {
+			t.Fatalf("got %+v, %v", got, err)
+		}
+	}
+	if _, err := catalog.Open(bytes.NewReader(unsigned.Bytes()), catalog.WithVerifier(pub)); !errors.Is(err, catalog.ErrNotSigned) {
+		t.Fatalf("got %v, want ErrNotSigned", err)
+	}
+
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(bytes.Clone(signed.Bytes()))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"magic", modify(func(b []byte) []byte { b[0] = 'X'; return b }), nil},
+		{"version", modify(func(b []byte) []byte { b[3] = 2; return b }), middleware.ErrUnsupportedVersion},
+		{"too large", modify(func(b []byte) []byte { b[5] = 0xff; return b }), nil},
+		{"truncated", signed.Bytes()[:signed.Len()-1], io.ErrUnexpectedEOF},
+		{"trailing data", append(bytes.Clone(signed.Bytes()), 0), nil},
+		{"changed entry", modify(func(b []byte) []byte { return bytes.Replace(b, []byte("manual"), []byte("manuel"), 1) }), catalog.ErrBadSignature},
+		{"unsigned flag", modify(func(b []byte) []byte { b[4] = 0; return b }), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := catalog.Open(bytes.NewReader(tt.data), catalog.WithVerifier(pub))
+			if err == nil {
+				t.Fatal("damaged catalog opened")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
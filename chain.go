@@ -0,0 +1,209 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// Chain composes several middlewares into one. Layers are ordered from the
+// plaintext outwards: on write, data passes the first layer first (e.g.
+// compression before encryption), on read the layers are undone in reverse.
+type Chain struct {
+	layers   []Middleware
+	names    []string      // layer names if built by a Pipeline
+	disabled []atomic.Bool // per layer, see SetEnabled
+	limits   Limits
+	maxWrite int
+	mode     ReadMode
+	logf     Logf
+
+	prevalidate bool
+}
+
+// Ensure Chain implements Middleware and ContextMiddleware interfaces
+var (
+	_ Middleware        = (*Chain)(nil)
+	_ ContextMiddleware = (*Chain)(nil)
+)
+
+// NewChain creates a chain of the given layers, nil layers are skipped
+func NewChain(layers ...Middleware) *Chain {
+	c := &Chain{}
+	for _, m := range layers {
+		if m != nil {
+			c.layers = append(c.layers, m)
+		}
+	}
+	c.names = make([]string, len(c.layers))
+	c.disabled = make([]atomic.Bool, len(c.layers))
+	return c
+}
+
+// Layers returns the layers of the chain, plaintext side first
+func (c *Chain) Layers() []Middleware {
+	return append([]Middleware(nil), c.layers...)
+}
+
+// Len returns the number of layers
+func (c *Chain) Len() int {
+	return len(c.layers)
+}
+
+// Writer wraps w with all layers. Closing the returned writer finalizes every
+// layer in order; the underlying writer w is not closed.
+func (c *Chain) Writer(w io.Writer) io.Writer {
+	return c.writer(nil, w)
+}
+
+// writer builds the chain writer, passing ctx to the layers if not nil
+func (c *Chain) writer(ctx context.Context, w io.Writer) *chainWriter {
+	cw, _, _ := c.splitWriter(ctx, w, false)
+	return cw
+}
+
+// splitWriter builds the chain writer. With split the outermost layer
+// returns its header instead of writing it, see HeaderSplitter.
+func (c *Chain) splitWriter(ctx context.Context, w io.Writer, split bool) (*chainWriter, []byte, error) {
+	layers, layersHeader := c.writeLayers()
+	cw := &chainWriter{maxWrite: c.maxWrite}
+	if layersHeader != nil {
+		cw.prefix = &prefixWriter{w: w, prefix: layersHeader}
+		w = cw.prefix
+	}
+	next := io.Writer(noCloseWriter{w})
+	cw.writers = make([]io.Writer, len(layers))
+	var header []byte
+	for i := len(layers) - 1; i >= 0; i-- {
+		var lw io.Writer
+		if split && i == len(layers)-1 {
+			var err error
+			if lw, header, err = SplitHeaderWriter(layers[i], next); err != nil {
+				return nil, nil, err
+			}
+		} else {
+			lw = WriterContext(ctx, layers[i], next)
+		}
+		cw.writers[i] = lw
+		next = noCloseWriter{lw}
+	}
+	if len(layers) == 0 {
+		cw.top = w
+	} else {
+		cw.top = cw.writers[0]
+	}
+	return cw, header, nil
+}
+
+// Reader wraps r with all layers, undoing the outermost layer first.
+// Limits set with WithLimits and the mode set with WithReadMode apply to
+// the returned reader, seekable sources are checked first with
+// WithPrevalidation.
+func (c *Chain) Reader(r io.Reader) io.Reader {
+	return c.reader(nil, r)
+}
+
+// ReaderContext is like Reader, but passes ctx to the layers, e.g. to
+// report the trace context set with WithTrace
+func (c *Chain) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return c.reader(ctx, r)
+}
+
+func (c *Chain) reader(ctx context.Context, r io.Reader) io.Reader {
+	return c.joinReader(ctx, r, nil)
+}
+
+// joinReader builds the chain reader. A header split off by SplitWriter is
+// passed to the outermost layer; such sources are not prevalidated, as the
+// layer only sees its complete stream after the header was joined.
+func (c *Chain) joinReader(ctx context.Context, r io.Reader, header []byte) io.Reader {
+	if c.prevalidate && header == nil {
+		if err := c.prevalidateSource(r); err != nil {
+			return &errReader{err: err}
+		}
+	}
+	return newLimitReader(c, r, func(src io.Reader) io.Reader {
+		if !c.toggleable() {
+			return c.decode(ctx, src, header, nil)
+		}
+		return &layersReader{c: c, src: src, state: ReaderState{Layer: "chain"},
+			build: func(r io.Reader, enabled []bool) io.Reader { return c.decode(ctx, r, header, enabled) }}
+	})
+}
+
+// decode wraps src, the stream after any layers header, with the layers
+// enabled when it was written, all layers if enabled is nil
+func (c *Chain) decode(ctx context.Context, src io.Reader, header []byte, enabled []bool) io.Reader {
+	layers := c.readLayers(enabled)
+	r := src
+	readers := make([]io.Reader, len(layers))
+	for i := len(layers) - 1; i >= 0; i-- {
+		if header != nil && i == len(layers)-1 {
+			jr, err := JoinHeaderReader(layers[i], r, header)
+			if err != nil {
+				return &errReader{err: err}
+			}
+			r = jr
+		} else {
+			r = ReaderContext(ctx, layers[i], r)
+		}
+		readers[i] = r
+	}
+	if c.mode != DefaultMode && len(layers) > 0 || len(layers) > 1 {
+		r = &trailingReader{readers: readers, src: src, mode: c.mode, logf: c.logf}
+	}
+	return r
+}
+
+type chainWriter struct {
+	top      io.Writer
+	writers  []io.Writer   // plaintext side first
+	prefix   *prefixWriter // layers header, if a layer is disabled
+	maxWrite int
+	ctx      context.Context
+	state    WriterState
+}
+
+func (c *chainWriter) Write(p []byte) (int, error) {
+	if err := c.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.write(p, false)
+	return n, c.state.Fail(err)
+}
+
+// Close closes the layers from the plaintext side outwards, so each layer
+// flushes its tail into the next one before that is closed, and writes
+// the layers header of empty streams
+func (c *chainWriter) Close() error {
+	return c.state.Close(func() error {
+		var errs []error
+		for _, w := range c.writers {
+			if cl, ok := w.(io.Closer); ok {
+				if err := cl.Close(); err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+		if c.prefix != nil && len(errs) == 0 {
+			errs = append(errs, c.prefix.flush())
+		}
+		return errors.Join(errs...)
+	})
+}
+
+// noCloseWriter hides the Close method of a writer, so layers that close
+// their destination (like minio/sio) do not close the next layer early
+type noCloseWriter struct {
+	w io.Writer
+}
+
+func (n noCloseWriter) Write(p []byte) (int, error) {
+	return n.w.Write(p)
+}
+
+// Unwrap returns the wrapped writer, so SeekableSink looks through it
+func (n noCloseWriter) Unwrap() io.Writer {
+	return n.w
+}
@@ -0,0 +1,412 @@
+// Package checksum frames a stream with a digest of its content, placed
+// either as trailer after the payload or as header before it.
+//
+// Trailer placement streams without buffering. Header placement is needed
+// by consumers that can only validate metadata preceding the payload; the
+// digest is written in two passes if the sink is seekable, which includes
+// a seekable sink at the end of a Chain, and otherwise the payload is held
+// in memory up to WithMaxBuffer bytes until Close.
+//
+// Readers verify the digest once the payload was read and return
+// ErrChecksum instead of io.EOF on a mismatch.
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// FormatVersion is the header format version of checksummed streams
+const FormatVersion = 1
+
+var magic = [3]byte{'H', 'B', 'C'}
+
+// fixedSize is the size of the header without digest: magic, version,
+// flags, algorithm and digest length
+const fixedSize = len(magic) + 4
+
+const flagHeader = 1
+
+// DefaultMaxBuffer is the default payload limit of header placement
+// without seekable sink
+const DefaultMaxBuffer = 4 << 20
+
+var (
+	// ErrChecksum is returned by Readers if the digest does not match
+	ErrChecksum = errors.New("checksum: digest mismatch")
+
+	// ErrBufferLimit is returned by Writers with header placement and a
+	// non-seekable sink once the payload exceeds the buffer limit
+	ErrBufferLimit = errors.New("checksum: payload exceeds buffer limit for header placement")
+)
+
+// Algorithm selects the digest function
+type Algorithm byte
+
+// Supported digest algorithms
+const (
+	SHA256 Algorithm = 1
+	SHA512 Algorithm = 2
+	CRC32C Algorithm = 3
+)
+
+// String returns the name of the algorithm
+func (a Algorithm) String() string {
+	switch a {
+	case SHA256:
+		return "sha256"
+	case SHA512:
+		return "sha512"
+	case CRC32C:
+		return "crc32c"
+	default:
+		return fmt.Sprintf("Algorithm(%d)", byte(a))
+	}
+}
+
+func (a Algorithm) new() (hash.Hash, bool) {
+	switch a {
+	case SHA256:
+		return sha256.New(), true
+	case SHA512:
+		return sha512.New(), true
+	case CRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), true
+	default:
+		return nil, false
+	}
+}
+
+// Placement selects where the digest is written
+type Placement int
+
+const (
+	// Trailer writes the digest after the payload
+	Trailer Placement = iota
+
+	// Header writes the digest before the payload
+	Header
+)
+
+// String returns the name of the placement
+func (p Placement) String() string {
+	if p == Header {
+		return "header"
+	}
+	return "trailer"
+}
+
+// Middleware adds and verifies digests
+type Middleware struct {
+	alg       Algorithm
+	placement Placement
+	maxBuffer int
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware   = (*Middleware)(nil)
+	_ middleware.Roled        = (*Middleware)(nil)
+	_ middleware.Describer    = (*Middleware)(nil)
+	_ middleware.MemoryUser   = (*Middleware)(nil)
+	_ middleware.Prevalidator = (*Middleware)(nil)
+)
+
+// Option configures the middleware
+type Option func(*Middleware)
+
+// WithAlgorithm sets the digest algorithm, SHA256 by default
+func WithAlgorithm(a Algorithm) Option {
+	return func(m *Middleware) {
+		m.alg = a
+	}
+}
+
+// WithPlacement sets where the digest is written, Trailer by default.
+// Readers accept both placements.
+func WithPlacement(p Placement) Option {
+	return func(m *Middleware) {
+		m.placement = p
+	}
+}
+
+// WithMaxBuffer sets the payload limit of header placement when the sink
+// is not seekable, DefaultMaxBuffer by default
+func WithMaxBuffer(n int) Option {
+	return func(m *Middleware) {
+		m.maxBuffer = n
+	}
+}
+
+// New creates a checksum middleware. New panics if the algorithm is not supported.
+func New(opts ...Option) *Middleware {
+	m := &Middleware{alg: SHA256, maxBuffer: DefaultMaxBuffer}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if _, ok := m.alg.new(); !ok {
+		panic(fmt.Sprintf("checksum: unsupported algorithm %d", m.alg))
+	}
+	return m
+}
+
+// Role returns middleware.RoleChecksum
+func (m *Middleware) Role() middleware.Role { return middleware.RoleChecksum }
+
+// MemoryUsage returns the payload buffer of Header placement Writers.
+// Trailer placement streams without buffering.
+func (m *Middleware) MemoryUsage() int64 {
+	if m.placement == Header {
+		return int64(m.maxBuffer)
+	}
+	return 0
+}
+
+// Describe reports the algorithm and placement
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:      string(middleware.RoleChecksum),
+		Algorithm: m.alg.String(),
+		Integrity: "digest",
+		Properties: map[string]string{
+			"placement": m.placement.String(),
+		},
+	}
+}
+
+func (m *Middleware) header(h hash.Hash, digest []byte) []byte {
+	hdr := make([]byte, fixedSize, fixedSize+len(digest))
+	copy(hdr, magic[:])
+	hdr[3] = FormatVersion
+	if m.placement == Header {
+		hdr[4] = flagHeader
+	}
+	hdr[5] = byte(m.alg)
+	hdr[6] = byte(h.Size())
+	return append(hdr, digest...)
+}
+
+// Writer wraps w, writing the digest on Close. w is not closed.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	h, _ := m.alg.new()
+	return &writer{m: m, w: w, h: h, state: middleware.WriterState{Layer: "checksum"}}
+}
+
+type writer struct {
+	m       *Middleware
+	w       io.Writer
+	h       hash.Hash
+	started bool
+	buf     *bytes.Buffer           // payload of header placement without seekable sink
+	res     *middleware.Reservation // header of header placement written in two passes
+	state   middleware.WriterState
+}
+
+// Ensure writer implements middleware.OwnedWriter
+var _ middleware.OwnedWriter = (*writer)(nil)
+
+// start writes the trailer placement header, or reserves the header
+// placement header in a seekable sink and falls back to buffering
+func (w *writer) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	if w.m.placement == Trailer {
+		_, err := w.w.Write(w.m.header(w.h, nil))
+		return err
+	}
+	res, err := middleware.Reserve(w.w, fixedSize+w.h.Size())
+	if errors.Is(err, middleware.ErrNotSeekable) {
+		w.buf = &bytes.Buffer{}
+		return nil
+	}
+	w.res = res
+	return err
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if err := w.start(); err != nil {
+		return 0, w.state.Fail(err)
+	}
+	w.h.Write(p)
+	if w.buf != nil {
+		if w.buf.Len()+len(p) > w.m.maxBuffer {
+			return 0, w.state.Fail(ErrBufferLimit)
+		}
+		return w.buf.Write(p)
+	}
+	n, err := w.w.Write(p)
+	return n, w.state.Fail(err)
+}
+
+// WriteOwned is like Write, but hands ownership of p to the next writer
+// after hashing it, see middleware.OwnedWriter
+func (w *writer) WriteOwned(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if err := w.start(); err != nil {
+		return 0, w.state.Fail(err)
+	}
+	if w.buf != nil {
+		return w.Write(p)
+	}
+	w.h.Write(p)
+	n, err := middleware.WriteOwned(w.w, p)
+	return n, w.state.Fail(err)
+}
+
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if err := w.start(); err != nil {
+			return err
+		}
+		digest := w.h.Sum(nil)
+		switch {
+		case w.buf != nil:
+			if _, err := w.w.Write(w.m.header(w.h, digest)); err != nil {
+				return err
+			}
+			_, err := w.w.Write(w.buf.Bytes())
+			return err
+		case w.res != nil:
+			return w.res.Fill(0, w.m.header(w.h, digest))
+		default:
+			_, err := w.w.Write(digest)
+			return err
+		}
+	})
+}
+
+// Reader wraps r, verifying the digest at the end of the payload
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return &reader{r: r, state: middleware.ReaderState{Layer: "checksum"}}
+}
+
+type reader struct {
+	r       io.Reader
+	h       hash.Hash
+	digest  []byte // expected digest of header placement
+	trailer bool
+	buf     []byte // read ahead, the last h.Size() bytes may be the trailer
+	eof     bool
+	state   middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	if r.h == nil {
+		if err := r.start(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	return r.state.Track(r.read(p))
+}
+
+func (r *reader) start() error {
+	var hdr [fixedSize]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return fmt.Errorf("checksum: read header: %w", err)
+	}
+	if [3]byte(hdr[:3]) != magic {
+		return errors.New("checksum: not a checksummed stream")
+	}
+	if _, err := middleware.CheckVersion("checksum", hdr[3], FormatVersion, middleware.RejectUnknown); err != nil {
+		return err
+	}
+	h, ok := Algorithm(hdr[5]).new()
+	if !ok || int(hdr[6]) != h.Size() {
+		return fmt.Errorf("checksum: unsupported algorithm %d", hdr[5])
+	}
+	r.h = h
+	if hdr[4]&flagHeader == 0 {
+		r.trailer = true
+		return nil
+	}
+	r.digest = make([]byte, h.Size())
+	if _, err := io.ReadFull(r.r, r.digest); err != nil {
+		return fmt.Errorf("checksum: read header: %w", err)
+	}
+	return nil
+}
+
+func (r *reader) read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !r.trailer {
+		n, err := r.r.Read(p)
+		r.h.Write(p[:n])
+		if err == io.EOF {
+			err = r.verify(r.digest)
+		}
+		return n, err
+	}
+	size := r.h.Size()
+	for len(r.buf) <= size {
+		if r.eof {
+			if len(r.buf) < size {
+				return 0, fmt.Errorf("%w: truncated trailer", ErrChecksum)
+			}
+			return 0, r.verify(r.buf)
+		}
+		if cap(r.buf)-len(r.buf) < 512 {
+			r.buf = append(make([]byte, 0, size+32<<10), r.buf...)
+		}
+		n, err := r.r.Read(r.buf[len(r.buf):cap(r.buf)])
+		r.buf = r.buf[:len(r.buf)+n]
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf[:len(r.buf)-size])
+	r.h.Write(p[:n])
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *reader) verify(digest []byte) error {
+	if subtle.ConstantTimeCompare(r.h.Sum(nil), digest) != 1 {
+		return ErrChecksum
+	}
+	return io.EOF
+}
+
+// Prevalidate verifies the digest of a stored stream, which only needs the
+// payload to be hashed, see middleware.Prevalidator
+func (m *Middleware) Prevalidate(r io.ReaderAt, size int64) error {
+	_, err := io.Copy(io.Discard, m.Reader(io.NewSectionReader(r, 0, size)))
+	return err
+}
+
+func init() {
+	middleware.RegisterFormat("checksum-header", func(p []byte) (string, int, bool) {
+		if len(p) < fixedSize || [3]byte(p[:3]) != magic {
+			return "", 0, false
+		}
+		n := fixedSize
+		placement := Trailer
+		if p[4]&flagHeader != 0 {
+			placement = Header
+			n += int(p[6])
+		}
+		return fmt.Sprintf("version %d, %s in %s", p[3], Algorithm(p[5]), placement), n, true
+	})
+}
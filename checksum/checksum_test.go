@@ -0,0 +1,166 @@
+package checksum_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/checksum"
+)
+
+var (
+	algorithms = []checksum.Algorithm{checksum.SHA256, checksum.SHA512, checksum.CRC32C}
+	placements = []checksum.Placement{checksum.Trailer, checksum.Header}
+)
+
+func write(t *testing.T, m *checksum.Middleware, w io.Writer, data []byte) {
+	t.Helper()
+	cw := m.Writer(w)
+	if _, err := cw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func encode(t *testing.T, m *checksum.Middleware, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	write(t, m, &buf, data)
+	return buf.Bytes()
+}
+
+func decode(m *checksum.Middleware, enc []byte) ([]byte, error) {
+	return io.ReadAll(m.Reader(bytes.NewReader(enc)))
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, alg := range algorithms {
+		for _, p := range placements {
+			m := checksum.New(checksum.WithAlgorithm(alg), checksum.WithPlacement(p))
+			for _, size := range []int{0, 1, 63, 64, 65, 100 << 10} {
+				data := make([]byte, size)
+				rand.Read(data)
+				got, err := decode(m, encode(t, m, data))
+				if err != nil {
+					t.Fatalf("%s in %s, size %d: %v", alg, p, size, err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("%s in %s, size %d: round trip mismatch", alg, p, size)
+				}
+			}
+		}
+	}
+}
+
+func TestHeaderPlacementSeekableSink(t *testing.T) {
+	// a seekable sink gets the digest in a second pass, without buffering
+	m := checksum.New(checksum.WithPlacement(checksum.Header), checksum.WithMaxBuffer(16))
+	f, err := os.Create(filepath.Join(t.TempDir(), "stream"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := make([]byte, 1000)
+	rand.Read(data)
+	write(t, m, f, data)
+
+	enc, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(enc, encode(t, checksum.New(checksum.WithPlacement(checksum.Header)), data)) {
+		t.Fatal("two pass stream differs from buffered stream")
+	}
+	got, err := decode(m, enc)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestHeaderPlacementBufferLimit(t *testing.T) {
+	m := checksum.New(checksum.WithPlacement(checksum.Header), checksum.WithMaxBuffer(16))
+	w := m.Writer(io.Discard)
+	if _, err := w.Write(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 1)); !errors.Is(err, checksum.ErrBufferLimit) {
+		t.Fatalf("got %v, want ErrBufferLimit", err)
+	}
+}
+
+func TestReaderAcceptsBothPlacements(t *testing.T) {
+	data := []byte("payload")
+	enc := encode(t, checksum.New(checksum.WithPlacement(checksum.Header), checksum.WithAlgorithm(checksum.CRC32C)), data)
+	got, err := decode(checksum.New(), enc)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestHostileStreams(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	m := checksum.New()
+	trailer := encode(t, m, data)
+	header := encode(t, checksum.New(checksum.WithPlacement(checksum.Header)), data)
+
+	modify := func(b []byte, f func(b []byte)) []byte {
+		b = bytes.Clone(b)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"empty", nil, nil},
+		{"truncated header", trailer[:6], nil},
+		{"bad magic", modify(trailer, func(b []byte) { b[0] = 'X' }), nil},
+		{"unknown version", modify(trailer, func(b []byte) { b[3] = 99 }), nil},
+		{"unknown algorithm", modify(trailer, func(b []byte) { b[5] = 9 }), nil},
+		{"wrong digest size", modify(trailer, func(b []byte) { b[6] = 64 }), nil},
+		{"other algorithm", modify(trailer, func(b []byte) { b[5] = byte(checksum.CRC32C) }), nil},
+		{"trailer flipped payload", modify(trailer, func(b []byte) { b[100] ^= 1 }), checksum.ErrChecksum},
+		{"trailer flipped digest", modify(trailer, func(b []byte) { b[len(b)-1] ^= 1 }), checksum.ErrChecksum},
+		{"trailer truncated", trailer[:len(trailer)-1], checksum.ErrChecksum},
+		{"trailer shorter than digest", trailer[:7+31], checksum.ErrChecksum},
+		{"trailer appended byte", append(bytes.Clone(trailer), 0), checksum.ErrChecksum},
+		{"trailer stream as header", modify(trailer, func(b []byte) { b[4] = 1 }), checksum.ErrChecksum},
+		{"header truncated digest", header[:7+31], nil},
+		{"header flipped payload", modify(header, func(b []byte) { b[100] ^= 1 }), checksum.ErrChecksum},
+		{"header flipped digest", modify(header, func(b []byte) { b[7] ^= 1 }), checksum.ErrChecksum},
+		{"header truncated payload", header[:len(header)-1], checksum.ErrChecksum},
+		{"header appended byte", append(bytes.Clone(header), 0), checksum.ErrChecksum},
+		{"header stream as trailer", modify(header, func(b []byte) { b[4] = 0 }), checksum.ErrChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decode(m, tt.data)
+			if err == nil {
+				t.Fatal("hostile stream accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrevalidate(t *testing.T) {
+	m := checksum.New()
+	enc := encode(t, m, []byte("stored stream"))
+	if err := m.Prevalidate(bytes.NewReader(enc), int64(len(enc))); err != nil {
+		t.Fatal(err)
+	}
+	enc[10] ^= 1
+	if err := m.Prevalidate(bytes.NewReader(enc), int64(len(enc))); !errors.Is(err, checksum.ErrChecksum) {
+		t.Fatalf("got %v, want ErrChecksum", err)
+	}
+}
@@ -0,0 +1,212 @@
+// Package chunked provides a middleware emitting HTTP/1.1 chunked transfer
+// encoding (RFC 9112, section 7.1) and decoding it on read, so pipelines can
+// stream into and out of raw sockets or proxies expecting chunked framing
+// without buffering the whole body.
+package chunked
+
+import (
+	"io"
+	"net/http/httputil"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// DefaultChunkSize is the default maximum size of an emitted chunk
+const DefaultChunkSize = 32 * 1024
+
+// Middleware implements HTTP/1.1 chunked transfer encoding
+type Middleware struct {
+	chunkSize int
+	adaptMin  int // adaptive chunk size bounds, 0 if disabled
+	adaptMax  int
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware     = (*Middleware)(nil)
+	_ middleware.Describer      = (*Middleware)(nil)
+	_ middleware.MemoryUser     = (*Middleware)(nil)
+	_ middleware.MemoryShrinker = (*Middleware)(nil)
+)
+
+// chunkedReaderMemory is the buffer httputil.NewChunkedReader adds
+const chunkedReaderMemory = 4 << 10
+
+// Option configures the chunked middleware
+type Option func(*Middleware)
+
+// WithChunkSize sets the maximum chunk size. Writes are buffered up to this
+// size, so small writes do not produce tiny chunks. A size of 0 emits one
+// chunk per Write.
+func WithChunkSize(size int) Option {
+	return func(m *Middleware) {
+		if size >= 0 {
+			m.chunkSize = size
+		}
+	}
+}
+
+// WithAdaptiveChunkSize lets the writer pick the chunk size between min and
+// max from the observed write sizes: bulk streams with large writes get
+// large chunks and less framing overhead, trickle streams with small writes
+// get small chunks that reach the peer sooner. Each chunk carries its size,
+// so readers need no configuration. It overrides WithChunkSize.
+func WithAdaptiveChunkSize(min, max int) Option {
+	return func(m *Middleware) {
+		if min > 0 && max >= min {
+			m.adaptMin, m.adaptMax = min, max
+		}
+	}
+}
+
+// New creates a new chunked transfer encoding middleware
+func New(opts ...Option) *Middleware {
+	m := &Middleware{
+		chunkSize: DefaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Describe reports the framing
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{Type: "framing", Algorithm: "http-chunked"}
+}
+
+// MemoryUsage estimates the memory of a Writer or Reader, the chunk buffer
+func (m *Middleware) MemoryUsage() int64 {
+	if m.adaptMax > 0 {
+		return int64(max(m.adaptMax, chunkedReaderMemory))
+	}
+	return int64(max(m.chunkSize, chunkedReaderMemory))
+}
+
+// ForMemory returns a copy with chunks of at most budget bytes. Below the
+// Reader buffer, writes are emitted as chunks without buffering.
+func (m *Middleware) ForMemory(budget int64) (middleware.Middleware, bool) {
+	if m.MemoryUsage() <= budget {
+		return m, true
+	}
+	if budget < chunkedReaderMemory {
+		return nil, false
+	}
+	c := *m
+	switch {
+	case m.adaptMax > 0:
+		c.adaptMax = int(budget)
+		c.adaptMin = min(m.adaptMin, c.adaptMax)
+	default:
+		c.chunkSize = int(budget)
+	}
+	return &c, true
+}
+
+// Writer wraps an io.Writer with chunked encoding. Closing the returned
+// writer emits the terminating zero-length chunk and the final CRLF; it does
+// not close the underlying writer.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	cw := &writer{
+		dst:    w,
+		chunks: httputil.NewChunkedWriter(w),
+		state:  middleware.WriterState{Layer: "chunked"},
+	}
+	switch {
+	case m.adaptMax > 0:
+		cw.buf = make([]byte, 0, m.adaptMax)
+		cw.min, cw.limit = m.adaptMin, m.adaptMin
+	case m.chunkSize > 0:
+		cw.buf = make([]byte, 0, m.chunkSize)
+		cw.limit = m.chunkSize
+	}
+	return cw
+}
+
+// Reader wraps an io.Reader with chunked decoding. Trailers are not supported.
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return middleware.HardenLayerReader("chunked", httputil.NewChunkedReader(r))
+}
+
+type writer struct {
+	dst    io.Writer
+	chunks io.WriteCloser
+	buf    []byte // pending chunk data, nil if unbuffered
+	limit  int    // current chunk size
+	min    int    // lower bound of the adaptive chunk size, 0 if fixed
+	avg    int    // moving average of the write size
+	state  middleware.WriterState
+}
+
+// adapt updates the chunk size from the size of a write
+func (w *writer) adapt(n int) {
+	if w.min == 0 {
+		return
+	}
+	if w.avg == 0 {
+		w.avg = n
+	} else {
+		w.avg = (w.avg*7 + n) / 8
+	}
+	size := w.min
+	for size < w.avg && size < cap(w.buf) {
+		size *= 2
+	}
+	w.limit = min(size, cap(w.buf))
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if len(p) == 0 {
+		return 0, nil // an empty chunk would terminate the body
+	}
+	if w.buf == nil {
+		n, err := w.chunks.Write(p)
+		return n, w.state.Fail(err)
+	}
+	w.adapt(len(p))
+	if len(w.buf) >= w.limit {
+		// the chunk size shrank below the pending data
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):w.limit], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) >= w.limit {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *writer) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.chunks.Write(w.buf)
+	w.buf = w.buf[:0]
+	return w.state.Fail(err)
+}
+
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		// the chunked writer emits "0\r\n", the empty trailer section ends with "\r\n"
+		if err := w.chunks.Close(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w.dst, "\r\n")
+		return err
+	})
+}
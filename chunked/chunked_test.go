@@ -0,0 +1,78 @@
+package chunked_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/chunked"
+)
+
+func roundTrip(t *testing.T, m *chunked.Middleware, writes [][]byte) {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	var want []byte
+	for _, p := range writes {
+		n, err := w.Write(p)
+		if err != nil || n != len(p) {
+			t.Fatalf("write: %d, %v", n, err)
+		}
+		want = append(want, p...)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(enc.Bytes(), []byte("0\r\n\r\n")) {
+		t.Fatalf("missing terminating chunk: %q", enc.Bytes()[max(0, enc.Len()-16):])
+	}
+	got, err := io.ReadAll(m.Reader(bytes.NewReader(enc.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("round trip mismatch")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	writes := [][]byte{[]byte("hello "), bytes.Repeat([]byte("x"), 100000), nil, []byte("world")}
+	for name, m := range map[string]*chunked.Middleware{
+		"default":    chunked.New(),
+		"small":      chunked.New(chunked.WithChunkSize(7)),
+		"unbuffered": chunked.New(chunked.WithChunkSize(0)),
+		"adaptive":   chunked.New(chunked.WithAdaptiveChunkSize(16, 1024)),
+	} {
+		t.Run(name, func(t *testing.T) { roundTrip(t, m, writes) })
+	}
+}
+
+func TestAdaptiveShrinkBelowPending(t *testing.T) {
+	// a large write grows the chunk size, small writes then shrink it
+	// below the data already pending
+	writes := [][]byte{bytes.Repeat([]byte("a"), 600)}
+	for range 100 {
+		writes = append(writes, []byte("b"))
+	}
+	roundTrip(t, chunked.New(chunked.WithAdaptiveChunkSize(16, 1024)), writes)
+}
+
+func TestHostileInput(t *testing.T) {
+	tests := map[string]string{
+		"bad size":        "zz\r\nhello\r\n0\r\n\r\n",
+		"huge size":       "ffffffffffffffffff\r\nhello\r\n0\r\n\r\n",
+		"short chunk":     "10\r\nhello",
+		"missing crlf":    "5\r\nhelloXX0\r\n\r\n",
+		"no terminator":   "5\r\nhello\r\n",
+		"negative size":   "-5\r\nhello\r\n0\r\n\r\n",
+		"overlong header": strings.Repeat("1", 8192) + "\r\n",
+	}
+	for name, in := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := io.ReadAll(chunked.New().Reader(strings.NewReader(in))); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrCloseTimeout matches every *CloseTimeoutError via errors.Is
+var ErrCloseTimeout = errors.New("middleware: close timed out")
+
+// CloseTimeoutError is returned by Close when finalization did not finish in time
+type CloseTimeoutError struct {
+	Timeout time.Duration
+	// Done receives the result of the abandoned Close once it returns
+	Done <-chan error
+}
+
+func (e *CloseTimeoutError) Error() string {
+	return fmt.Sprintf("middleware: close did not finish within %s", e.Timeout)
+}
+
+// Is reports whether target is ErrCloseTimeout
+func (e *CloseTimeoutError) Is(target error) bool {
+	return target == ErrCloseTimeout
+}
+
+// WithCloseTimeout wraps m so that closing its writers, i.e. flushing the
+// compression tail, writing the final encryption package or completing an
+// upload, returns a *CloseTimeoutError after d instead of hanging on a slow
+// sink during shutdown. The abandoned Close keeps running in the background
+// and reports its result on the error's Done channel. Writes are not limited.
+func WithCloseTimeout(m Middleware, d time.Duration) Middleware {
+	return &closeTimeout{m: m, d: d}
+}
+
+type closeTimeout struct {
+	m Middleware
+	d time.Duration
+}
+
+func (c *closeTimeout) Writer(w io.Writer) io.Writer {
+	return &closeTimeoutWriter{w: c.m.Writer(w), d: c.d}
+}
+
+func (c *closeTimeout) Reader(r io.Reader) io.Reader {
+	return c.m.Reader(r)
+}
+
+// Unwrap returns the wrapped middleware
+func (c *closeTimeout) Unwrap() Middleware {
+	return c.m
+}
+
+type closeTimeoutWriter struct {
+	w     io.Writer
+	d     time.Duration
+	state WriterState
+}
+
+func (c *closeTimeoutWriter) Write(p []byte) (int, error) {
+	if err := c.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.w.Write(p)
+	return n, c.state.Fail(err)
+}
+
+func (c *closeTimeoutWriter) Close() error {
+	return c.state.Close(func() error {
+		cl, ok := c.w.(io.Closer)
+		if !ok {
+			return nil
+		}
+		done := make(chan error, 1)
+		go func() { done <- cl.Close() }()
+		timer := time.NewTimer(c.d)
+		defer timer.Stop()
+		select {
+		case err := <-done:
+			return err
+		case <-timer.C:
+			return &CloseTimeoutError{Timeout: c.d, Done: done}
+		}
+	})
+}
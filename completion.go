@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"hash"
+	"time"
+)
+
+// Completion holds the final numbers of one stream of a layer wrapped with
+// WithStats, for accounting that must not depend on sampled counters
+type Completion struct {
+	Layer string
+
+	// Op is OpWrite for Writers and OpRead for Readers
+	Op Op
+
+	// In and Out are the total bytes as in StatsSink.Observe
+	In, Out int64
+
+	// Started is the creation time of the Writer or Reader, Elapsed the
+	// time until completion and Busy the time spent in its operations
+	Started time.Time
+	Elapsed time.Duration
+	Busy    time.Duration
+
+	// Digest is the SHA-256 of the bytes accepted from the caller of a
+	// Writer, respectively returned to the caller of a Reader
+	Digest []byte
+
+	// Err is the error the stream ended with, nil for a clean Close or EOF
+	Err error
+
+	// Trace is the trace context of the stream, if any
+	Trace TraceContext
+
+	// BufferID is the buffer ID of the stream, if it was created with a
+	// context from WithBufferID and a layer embedded or found the ID
+	BufferID BufferID
+}
+
+// CompletionSink is a StatsSink that also receives the totals of every
+// stream. Complete is called exactly once per stream, after the last
+// Observe: when a Writer is closed, or when a Reader returns io.EOF or
+// another error. Streams that are abandoned without either are not
+// completed.
+type CompletionSink interface {
+	StatsSink
+	Complete(c Completion)
+}
+
+// CompletionFunc adapts a function to a CompletionSink that ignores single
+// operations
+type CompletionFunc func(c Completion)
+
+// Observe does nothing
+func (f CompletionFunc) Observe(layer string, op Op, in, out int64, d time.Duration) {}
+
+// Complete calls f
+func (f CompletionFunc) Complete(c Completion) { f(c) }
+
+// completion accumulates the totals of one stream
+type completion struct {
+	sink CompletionSink
+	ctx  context.Context
+	c    Completion
+	hash hash.Hash
+	done bool
+}
+
+// newCompletion returns a tracker if sink receives completions, else nil
+func newCompletion(ctx context.Context, sink StatsSink, layer string, op Op) *completion {
+	cs, ok := sink.(CompletionSink)
+	if !ok {
+		return nil
+	}
+	tc, _ := TraceFromContext(ctx)
+	return &completion{
+		sink: cs,
+		ctx:  ctx,
+		c:    Completion{Layer: layer, Op: op, Started: time.Now(), Trace: tc},
+		hash: sha256.New(),
+	}
+}
+
+// add records an operation and the caller side bytes p
+func (c *completion) add(p []byte, in, out int64, d time.Duration) {
+	if c == nil || c.done {
+		return
+	}
+	c.hash.Write(p)
+	c.c.In += in
+	c.c.Out += out
+	c.c.Busy += d
+}
+
+// finish publishes the totals once
+func (c *completion) finish(err error) {
+	if c == nil || c.done {
+		return
+	}
+	c.done = true
+	c.c.Elapsed = time.Since(c.c.Started)
+	c.c.Digest = c.hash.Sum(nil)
+	c.c.Err = err
+	c.c.BufferID, _ = BufferIDFromContext(c.ctx)
+	c.sink.Complete(c.c)
+}
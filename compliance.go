@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Component describes the security relevant properties of one layer
+type Component struct {
+	// Layer is the path of the layer: names (or positions in unnamed
+	// chains) of the enclosing chains and the layer, separated by "/"
+	Layer string `json:"layer"`
+	// Type is the kind of layer, e.g. "encryption" or "compression"
+	Type string `json:"type"`
+	// Algorithm names the algorithm, e.g. "aes-256-gcm"
+	Algorithm string `json:"algorithm,omitempty"`
+	// KeyBits is the key length in bits
+	KeyBits int `json:"key_bits,omitempty"`
+	// KDF describes how stream keys are derived, if they are
+	KDF *KDF `json:"kdf,omitempty"`
+	// Integrity names the integrity mechanism, e.g. "aead" or "sha-256"
+	Integrity string `json:"integrity,omitempty"`
+	// Properties holds further layer specific facts
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// KDF describes a key derivation function and its parameters
+type KDF struct {
+	Name   string            `json:"name"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// Describer is implemented by layers that can describe themselves for a
+// compliance report
+type Describer interface {
+	Describe() Component
+}
+
+// Wrapper is implemented by middlewares wrapping another middleware. Compliance
+// reports list the wrapper, if it is a Describer, followed by the wrapped layers.
+type Wrapper interface {
+	Unwrap() Middleware
+}
+
+// Report is a machine-readable description of a pipeline, suitable as
+// evidence for audits. It is meant to be encoded as JSON.
+type Report struct {
+	Components []Component `json:"components"`
+}
+
+// Encrypted reports whether any component is an encryption layer
+func (r Report) Encrypted() bool {
+	for _, c := range r.Components {
+		if c.Type == string(RoleEncryption) {
+			return true
+		}
+	}
+	return false
+}
+
+// ComplianceReport describes the algorithms, key lengths, key derivation and
+// integrity mechanisms of m. Chains are expanded layer by layer, skipping
+// disabled layers, and every variant of a DynamicPipeline is listed. Layers not implementing Describer
+// are listed with type "unknown" and their Go type, so the report never
+// silently omits a layer.
+func ComplianceReport(m Middleware) Report {
+	var r Report
+	describe(&r, "", m)
+	return r
+}
+
+func describe(r *Report, path string, m Middleware) {
+	switch l := m.(type) {
+	case *Chain:
+		for i, layer := range l.layers {
+			if i < len(l.disabled) && l.disabled[i].Load() {
+				continue
+			}
+			name := fmt.Sprint(i)
+			if i < len(l.names) && l.names[i] != "" {
+				name = l.names[i]
+			}
+			describe(r, join(path, name), layer)
+		}
+		return
+	case *DynamicPipeline:
+		names := make([]string, 0, len(l.variants))
+		for name := range l.variants {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			describe(r, join(path, "variant:"+name), NewChain(l.variants[name]...))
+		}
+		return
+	}
+	d, isDescriber := m.(Describer)
+	if isDescriber {
+		c := d.Describe()
+		c.Layer = path
+		r.Components = append(r.Components, c)
+	}
+	if w, ok := m.(Wrapper); ok {
+		describe(r, path, w.Unwrap())
+		return
+	}
+	if isDescriber {
+		return
+	}
+	r.Components = append(r.Components, Component{
+		Layer:      path,
+		Type:       "unknown",
+		Properties: map[string]string{"go_type": fmt.Sprintf("%T", m)},
+	})
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "/" + name
+}
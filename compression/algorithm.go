@@ -0,0 +1,75 @@
+package compression
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Capability describes a feature of a compression algorithm
+type Capability uint8
+
+const (
+	// CapEncode means the algorithm can be written in this build
+	CapEncode Capability = 1 << iota
+	// CapDecode means the algorithm can be read in this build
+	CapDecode
+	// CapStreaming means data is produced incrementally, without buffering the whole stream
+	CapStreaming
+	// CapDictionary means a preset dictionary can be used
+	CapDictionary
+	// CapParallel means compression can use multiple cores
+	CapParallel
+	// CapSeekable means the compressed stream supports random access
+	CapSeekable
+)
+
+// Has reports whether all capabilities in c2 are set in c
+func (c Capability) Has(c2 Capability) bool {
+	return c&c2 == c2
+}
+
+// String returns the names of the set capabilities, separated by "|"
+func (c Capability) String() string {
+	names := []string{"encode", "decode", "streaming", "dictionary", "parallel", "seekable"}
+	var set []string
+	for i, name := range names {
+		if c&(1<<i) != 0 {
+			set = append(set, name)
+		}
+	}
+	if len(set) == 0 {
+		return "none"
+	}
+	return strings.Join(set, "|")
+}
+
+// Capabilities returns the capabilities of the algorithm in this build.
+// Unknown algorithms and algorithms excluded by build tags have none.
+func (a Algorithm) Capabilities() Capability {
+	c, ok := lookup(a)
+	if !ok {
+		return 0
+	}
+	return c.caps()
+}
+
+// Available returns the algorithms that can at least be read in this build
+func Available() []Algorithm {
+	var algos []Algorithm
+	for _, a := range registered() {
+		if a.Capabilities().Has(CapDecode) {
+			algos = append(algos, a)
+		}
+	}
+	return algos
+}
+
+// ParseAlgorithm returns the algorithm for a name as returned by Algorithm.String
+func ParseAlgorithm(name string) (Algorithm, error) {
+	for _, a := range Available() {
+		if strings.EqualFold(name, a.String()) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("compression: unsupported algorithm %q", name)
+}
@@ -0,0 +1,66 @@
+package compression
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// ErrWriteUnsupported is returned by writers of algorithms that can only be read
+var ErrWriteUnsupported = errors.New("compression: writing is not supported for this algorithm")
+
+// Bzip2WriterFunc creates a bzip2 encoder. level is the value given with
+// WithLevel, DefaultCompression if none was set.
+type Bzip2WriterFunc func(w io.Writer, level int) (io.WriteCloser, error)
+
+var (
+	bzip2Mu     sync.RWMutex
+	bzip2Writer Bzip2WriterFunc
+)
+
+// SetBzip2Writer opts in to bzip2 compression. The standard library only
+// decodes bzip2, so an encoder such as github.com/dsnet/compress/bzip2 has
+// to be supplied, which keeps this module free of the dependency:
+//
+//	compression.SetBzip2Writer(func(w io.Writer, level int) (io.WriteCloser, error) {
+//		if level == compression.DefaultCompression {
+//			level = bzip2.DefaultCompression
+//		}
+//		return bzip2.NewWriter(w, &bzip2.WriterConfig{Level: level})
+//	})
+func SetBzip2Writer(fn Bzip2WriterFunc) {
+	bzip2Mu.Lock()
+	bzip2Writer = fn
+	bzip2Mu.Unlock()
+}
+
+// CanWriteBzip2 reports whether a bzip2 encoder was registered
+func CanWriteBzip2() bool {
+	bzip2Mu.RLock()
+	defer bzip2Mu.RUnlock()
+	return bzip2Writer != nil
+}
+
+func newBzip2Writer(w io.Writer, level int) io.Writer {
+	bzip2Mu.RLock()
+	fn := bzip2Writer
+	bzip2Mu.RUnlock()
+	if fn == nil {
+		return &errWriter{err: ErrWriteUnsupported}
+	}
+	bw, err := fn(w, level)
+	if err != nil {
+		return &errWriter{err: err}
+	}
+	return middleware.HardenLayerWriter("compression", bw)
+}
+
+// errWriter reports a fixed error on every call
+type errWriter struct {
+	err error
+}
+
+func (e *errWriter) Write([]byte) (int, error) { return 0, e.err }
+func (e *errWriter) Close() error              { return e.err }
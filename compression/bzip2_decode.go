@@ -0,0 +1,25 @@
+//go:build !hbmw_nobzip2
+
+package compression
+
+import (
+	"compress/bzip2"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+func init() {
+	register(Bzip2, codec{
+		caps: func() Capability {
+			if CanWriteBzip2() {
+				return CapEncode | CapDecode | CapStreaming
+			}
+			return CapDecode | CapStreaming
+		},
+		writer: newBzip2Writer,
+		reader: func(r io.Reader) io.Reader {
+			return middleware.HardenLayerReader("compression", bzip2.NewReader(r))
+		},
+	})
+}
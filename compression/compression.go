@@ -0,0 +1,197 @@
+// Package compression provides a compression middleware built on the
+// implementations of the standard library. The gzip, zlib and raw-deflate
+// framings are supported, the latter two for interoperability with formats
+// and protocols that expect exactly those (PNG/PDF-embedded streams,
+// WebSocket permessage-deflate). Bzip2 can be read for restoring legacy
+// archives; writing it requires registering an encoder with SetBzip2Writer.
+//
+// Every algorithm can be left out of the binary with a build tag named
+// hbmw_no<algorithm>, e.g. hbmw_nobzip2. Available reports what is left.
+package compression
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// Algorithm selects the compression format
+type Algorithm int
+
+const (
+	// Gzip is DEFLATE with gzip framing (RFC 1952)
+	Gzip Algorithm = iota
+	// Zlib is DEFLATE with zlib framing (RFC 1950)
+	Zlib
+	// Deflate is raw DEFLATE without framing or checksum (RFC 1951)
+	Deflate
+	// Bzip2 is read-only unless an encoder is registered with SetBzip2Writer
+	Bzip2
+)
+
+// String returns the name of the algorithm
+func (a Algorithm) String() string {
+	switch a {
+	case Gzip:
+		return "gzip"
+	case Zlib:
+		return "zlib"
+	case Deflate:
+		return "deflate"
+	case Bzip2:
+		return "bzip2"
+	default:
+		return fmt.Sprintf("Algorithm(%d)", int(a))
+	}
+}
+
+// Compression levels, see compress/flate
+const (
+	DefaultCompression = flate.DefaultCompression
+	BestSpeed          = flate.BestSpeed
+	BestCompression    = flate.BestCompression
+	HuffmanOnly        = flate.HuffmanOnly
+)
+
+// Middleware implements compression/decompression middleware
+type Middleware struct {
+	algorithm Algorithm
+	level     int
+	lenient   bool
+	logf      middleware.Logf
+	index     indexConfig
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware   = (*Middleware)(nil)
+	_ middleware.ModeSetter   = (*Middleware)(nil)
+	_ middleware.Roled        = (*Middleware)(nil)
+	_ middleware.Describer    = (*Middleware)(nil)
+	_ middleware.Prevalidator = (*Middleware)(nil)
+)
+
+// Option configures the compression middleware
+type Option func(*Middleware)
+
+// WithAlgorithm selects the compression format, the default is Gzip
+func WithAlgorithm(a Algorithm) Option {
+	return func(m *Middleware) {
+		m.algorithm = a
+	}
+}
+
+// WithLevel sets the compression level
+func WithLevel(level int) Option {
+	return func(m *Middleware) {
+		m.level = level
+	}
+}
+
+// New creates a new compression middleware.
+// New panics if the algorithm or level is invalid, or if indexing is
+// enabled for an algorithm that does not support it.
+func New(opts ...Option) *Middleware {
+	m := &Middleware{
+		algorithm: Gzip,
+		level:     DefaultCompression,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	c, ok := lookup(m.algorithm)
+	if !ok {
+		panic(fmt.Sprintf("compression: unsupported algorithm %v", m.algorithm))
+	}
+	if c.flateLevels && (m.level < HuffmanOnly || m.level > BestCompression) {
+		panic(fmt.Sprintf("compression: invalid level %d", m.level))
+	}
+	if m.index.interval == 0 && (m.index.fn != nil || m.index.appended) {
+		m.index.interval = DefaultIndexInterval
+	}
+	if m.index.interval < 0 || m.index.interval > 0 && c.indexWriter == nil {
+		panic(fmt.Sprintf("compression: indexing is not supported for %v", m.algorithm))
+	}
+	return m
+}
+
+// Algorithm returns the configured algorithm
+func (m *Middleware) Algorithm() Algorithm {
+	return m.algorithm
+}
+
+// Role returns middleware.RoleCompression
+func (m *Middleware) Role() middleware.Role {
+	return middleware.RoleCompression
+}
+
+// Describe reports the algorithm, level and index interval
+func (m *Middleware) Describe() middleware.Component {
+	props := map[string]string{"level": strconv.Itoa(m.level)}
+	if m.index.interval > 0 {
+		props["index_interval"] = strconv.FormatInt(m.index.interval, 10)
+	}
+	return middleware.Component{
+		Type:       string(middleware.RoleCompression),
+		Algorithm:  m.algorithm.String(),
+		Properties: props,
+	}
+}
+
+// ForMode returns a copy of the middleware for a chain read mode. Lenient
+// readers end the stream instead of failing on a checksum mismatch, on
+// garbage after a complete gzip member or on a truncated tail.
+func (m *Middleware) ForMode(mode middleware.ReadMode, logf middleware.Logf) middleware.Middleware {
+	c := *m
+	c.lenient = mode == middleware.LenientMode
+	c.logf = logf
+	return &c
+}
+
+// Writer wraps an io.Writer with compression. The returned writer must be
+// closed to flush the compressed tail; it does not close w.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	c, _ := lookup(m.algorithm)
+	if m.index.interval > 0 {
+		return c.indexWriter(w, m.level, m.index)
+	}
+	return c.writer(w, m.level)
+}
+
+// Reader wraps an io.Reader with decompression. Header errors are returned from Read.
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	c, _ := lookup(m.algorithm)
+	if m.lenient {
+		return &lenientReader{r: c.reader(r), logf: m.logf}
+	}
+	return c.reader(r)
+}
+
+// lazyReader defers reader construction to the first Read, so that header
+// errors can be reported through the io.Reader interface
+type lazyReader struct {
+	init  func() (io.Reader, error)
+	r     io.Reader
+	state middleware.ReaderState
+}
+
+func newLazyReader(init func() (io.Reader, error)) *lazyReader {
+	return &lazyReader{init: init, state: middleware.ReaderState{Layer: "compression"}}
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if err := l.state.Err(); err != nil {
+		return 0, err
+	}
+	if l.r == nil {
+		r, err := l.init()
+		if err != nil {
+			return l.state.Track(0, err)
+		}
+		l.r = r
+	}
+	return l.state.Track(l.r.Read(p))
+}
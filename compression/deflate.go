@@ -0,0 +1,23 @@
+//go:build !hbmw_nodeflate
+
+package compression
+
+import (
+	"compress/flate"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+func init() {
+	register(Deflate, codec{
+		caps:        fixedCaps(CapEncode | CapDecode | CapStreaming | CapDictionary),
+		flateLevels: true,
+		writer: func(w io.Writer, level int) io.Writer {
+			return newWriter(flate.NewWriter(w, level))
+		},
+		reader: func(r io.Reader) io.Reader {
+			return middleware.HardenLayerReader("compression", flate.NewReader(r))
+		},
+	})
+}
@@ -0,0 +1,23 @@
+//go:build !hbmw_nogzip
+
+package compression
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+func init() {
+	register(Gzip, codec{
+		caps:        fixedCaps(CapEncode | CapDecode | CapStreaming),
+		flateLevels: true,
+		writer: func(w io.Writer, level int) io.Writer {
+			return newWriter(gzip.NewWriterLevel(w, level))
+		},
+		reader: func(r io.Reader) io.Reader {
+			return newLazyReader(func() (io.Reader, error) { return gzip.NewReader(r) })
+		},
+		indexWriter: newGzipIndexWriter,
+		readIndex:   readGzipIndex,
+	})
+}
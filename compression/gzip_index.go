@@ -0,0 +1,197 @@
+//go:build !hbmw_nogzip
+
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// Appended indexes are stored in the FEXTRA field of empty gzip members,
+// in subfields "HI" holding index entries, followed by a final member with
+// a subfield "HX" holding the offset of the first index member.
+var (
+	// gzip header with FEXTRA, no mtime and unknown OS
+	emptyMemberHeader = []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 255}
+	// final empty stored block, CRC-32 and size of no data
+	emptyMemberTrailer = []byte{1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}
+)
+
+// locatorSize is the size of the final member pointing at the index
+const locatorSize = 10 + 2 + 4 + 8 + 13
+
+// maxIndexSubfield is the largest entry data of one index member
+const maxIndexSubfield = 65535 - 4 - (65535-4)%16
+
+// maxIndexSize bounds the index members read from a stream, about four
+// million entries, so a forged locator cannot force a huge allocation
+const maxIndexSize = 64 << 20
+
+// appendEmptyMember appends an empty gzip member with one extra subfield
+func appendEmptyMember(b []byte, id string, data []byte) []byte {
+	b = append(b, emptyMemberHeader...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(4+len(data)))
+	b = append(b, id...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(data)))
+	b = append(b, data...)
+	return append(b, emptyMemberTrailer...)
+}
+
+// parseEmptyMember parses a member written by appendEmptyMember and
+// returns the subfield data and the remaining bytes
+func parseEmptyMember(b []byte, id string) ([]byte, []byte, bool) {
+	if len(b) < 16 || !bytes.Equal(b[:10], emptyMemberHeader) {
+		return nil, nil, false
+	}
+	xlen := int(binary.LittleEndian.Uint16(b[10:]))
+	if string(b[12:14]) != id || int(binary.LittleEndian.Uint16(b[14:])) != xlen-4 {
+		return nil, nil, false
+	}
+	end := 12 + xlen
+	if xlen < 4 || len(b) < end+len(emptyMemberTrailer) || !bytes.Equal(b[end:end+len(emptyMemberTrailer)], emptyMemberTrailer) {
+		return nil, nil, false
+	}
+	return b[16:end], b[end+len(emptyMemberTrailer):], true
+}
+
+// newGzipIndexWriter returns a gzip writer starting a new member every
+// interval plaintext bytes
+func newGzipIndexWriter(w io.Writer, level int, cfg indexConfig) io.Writer {
+	cw := &countingWriter{w: w}
+	gz, err := gzip.NewWriterLevel(cw, level)
+	if err != nil {
+		return &errWriter{err: err}
+	}
+	return &gzipIndexWriter{
+		w:     cw,
+		gz:    gz,
+		cfg:   cfg,
+		index: middleware.Index{{}},
+		state: middleware.WriterState{Layer: "compression"},
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type gzipIndexWriter struct {
+	w      *countingWriter
+	gz     *gzip.Writer
+	cfg    indexConfig
+	plain  int64 // plaintext bytes written
+	member int64 // plaintext bytes in the current member
+	index  middleware.Index
+	state  middleware.WriterState
+}
+
+func (w *gzipIndexWriter) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) > 0 {
+		// members are cut when more data arrives, so there is no empty last one
+		if w.member == w.cfg.interval {
+			if err := w.gz.Close(); err != nil {
+				return written, w.state.Fail(err)
+			}
+			w.index = append(w.index, middleware.IndexEntry{Plain: w.plain, Stored: w.w.n})
+			w.gz.Reset(w.w)
+			w.member = 0
+		}
+		n := int(min(int64(len(p)), w.cfg.interval-w.member))
+		n, err := w.gz.Write(p[:n])
+		written += n
+		w.plain += int64(n)
+		w.member += int64(n)
+		p = p[n:]
+		if err != nil {
+			return written, w.state.Fail(err)
+		}
+	}
+	return written, nil
+}
+
+func (w *gzipIndexWriter) Close() error {
+	return w.state.Close(func() error {
+		if err := w.gz.Close(); err != nil {
+			return err
+		}
+		if w.cfg.appended {
+			if err := w.appendIndex(); err != nil {
+				return err
+			}
+		}
+		if w.cfg.fn != nil {
+			w.cfg.fn(w.index)
+		}
+		return nil
+	})
+}
+
+func (w *gzipIndexWriter) appendIndex() error {
+	data, _ := w.index.MarshalBinary()
+	start := w.w.n
+	var b []byte
+	for len(data) > 0 {
+		n := min(len(data), maxIndexSubfield)
+		b = appendEmptyMember(b, "HI", data[:n])
+		data = data[n:]
+	}
+	b = appendEmptyMember(b, "HX", binary.BigEndian.AppendUint64(nil, uint64(start)))
+	_, err := w.w.Write(b)
+	return err
+}
+
+// readGzipIndex reads an index appended by a gzipIndexWriter
+func readGzipIndex(r io.ReaderAt, size int64) (middleware.Index, error) {
+	if size < locatorSize {
+		return nil, ErrNoIndex
+	}
+	loc := make([]byte, locatorSize)
+	if _, err := r.ReadAt(loc, size-locatorSize); err != nil {
+		return nil, err
+	}
+	off, _, ok := parseEmptyMember(loc, "HX")
+	if !ok || len(off) != 8 {
+		return nil, ErrNoIndex
+	}
+	start := int64(binary.BigEndian.Uint64(off))
+	if start < 0 || start > size-locatorSize {
+		return nil, ErrNoIndex
+	}
+	if size-locatorSize-start > maxIndexSize {
+		return nil, fmt.Errorf("compression: index of %d bytes exceeds %d", size-locatorSize-start, maxIndexSize)
+	}
+	b := make([]byte, size-locatorSize-start)
+	if _, err := r.ReadAt(b, start); err != nil {
+		return nil, err
+	}
+	var data []byte
+	for len(b) > 0 {
+		d, rest, ok := parseEmptyMember(b, "HI")
+		if !ok {
+			return nil, ErrNoIndex
+		}
+		data = append(data, d...)
+		b = rest
+	}
+	var ix middleware.Index
+	if err := ix.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
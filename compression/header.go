@@ -0,0 +1,65 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// Ensure Middleware implements HeaderSplitter
+var _ middleware.HeaderSplitter = (*Middleware)(nil)
+
+// errHeaderChanged is returned if a compressor writes a header other than
+// the one returned by SplitWriter
+var errHeaderChanged = errors.New("compression: stream header differs from split header")
+
+// SplitWriter wraps an io.Writer like Writer, returning the framing header
+// (e.g. the 10 bytes of a gzip member header, 2 bytes for zlib) instead of
+// writing it to w. Raw deflate has no header, and indexed streams keep it
+// inline so the offsets of their index stay valid; the header is nil then.
+func (m *Middleware) SplitWriter(w io.Writer) (io.Writer, []byte, error) {
+	if m.index.interval > 0 {
+		return m.Writer(w), nil, nil
+	}
+	c, _ := lookup(m.algorithm)
+	// the compressors write their header on the first write, which is
+	// the same for every stream of a configuration
+	var probe bytes.Buffer
+	if _, err := c.writer(&probe, m.level).Write(nil); err != nil {
+		return nil, nil, err
+	}
+	if probe.Len() == 0 {
+		return m.Writer(w), nil, nil
+	}
+	header := probe.Bytes()
+	return c.writer(&headerStripper{w: w, header: header}, m.level), header, nil
+}
+
+// JoinReader wraps an io.Reader for a stream written by SplitWriter
+func (m *Middleware) JoinReader(r io.Reader, header []byte) (io.Reader, error) {
+	return m.Reader(io.MultiReader(bytes.NewReader(header), r)), nil
+}
+
+// headerStripper drops the header from the start of the stream
+type headerStripper struct {
+	w      io.Writer
+	header []byte // part of the header not yet seen
+}
+
+func (h *headerStripper) Write(p []byte) (int, error) {
+	if len(h.header) == 0 {
+		return h.w.Write(p)
+	}
+	n := min(len(p), len(h.header))
+	if !bytes.Equal(p[:n], h.header[:n]) {
+		return 0, errHeaderChanged
+	}
+	h.header = h.header[n:]
+	if n == len(p) {
+		return n, nil
+	}
+	written, err := h.w.Write(p[n:])
+	return n + written, err
+}
@@ -0,0 +1,78 @@
+package compression_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/compression"
+)
+
+func TestSplitWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("compressed "), 1000)
+	tests := []struct {
+		algorithm compression.Algorithm
+		headerLen int
+	}{
+		{compression.Gzip, 10},
+		{compression.Zlib, 2},
+		{compression.Deflate, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm.String(), func(t *testing.T) {
+			m := compression.New(compression.WithAlgorithm(tt.algorithm))
+			var stored bytes.Buffer
+			w, header, err := m.SplitWriter(&stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(header) != tt.headerLen {
+				t.Fatalf("got header %x, want %d bytes", header, tt.headerLen)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.(io.Closer).Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the joined stream equals the inline one
+			var inline bytes.Buffer
+			iw := m.Writer(&inline)
+			iw.Write(data)
+			iw.(io.Closer).Close()
+			if !bytes.Equal(append(bytes.Clone(header), stored.Bytes()...), inline.Bytes()) {
+				t.Fatal("split stream differs from inline stream")
+			}
+
+			r, err := m.JoinReader(bytes.NewReader(stored.Bytes()), header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("round trip mismatch")
+			}
+		})
+	}
+}
+
+func TestSplitWriterIndexedKeepsHeaderInline(t *testing.T) {
+	m := compression.New(compression.WithIndexInterval(1024), compression.WithAppendedIndex())
+	var stored bytes.Buffer
+	w, header, err := m.SplitWriter(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != nil {
+		t.Fatalf("got header %x for an indexed stream", header)
+	}
+	w.Write(bytes.Repeat([]byte("x"), 4096))
+	w.(io.Closer).Close()
+	if _, err := m.ReadIndex(bytes.NewReader(stored.Bytes()), int64(stored.Len())); err != nil {
+		t.Fatal(err)
+	}
+}
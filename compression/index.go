@@ -0,0 +1,116 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// DefaultIndexInterval is the plaintext distance of index entries if
+// indexing is enabled without WithIndexInterval
+const DefaultIndexInterval = 1 << 20
+
+// ErrNoIndex is returned by ReadIndex for streams without appended index
+var ErrNoIndex = errors.New("compression: stream has no index")
+
+// indexConfig configures index generation, which is enabled if interval > 0
+type indexConfig struct {
+	interval int64
+	fn       func(middleware.Index)
+	appended bool
+}
+
+// WithIndexInterval enables index generation: the compressor restarts
+// every n plaintext bytes, so decoding can start at each restart point.
+// Only Gzip supports it; the restarts are regular gzip members, so the
+// stream stays readable by every gzip implementation.
+func WithIndexInterval(n int64) Option {
+	return func(m *Middleware) {
+		m.index.interval = n
+	}
+}
+
+// WithIndexFunc calls fn with the index of every stream when its writer
+// is closed, e.g. to store it next to the buffer. It enables index
+// generation with DefaultIndexInterval unless WithIndexInterval is set.
+// The stored offsets are relative to the start of the compressed stream.
+func WithIndexFunc(fn func(middleware.Index)) Option {
+	return func(m *Middleware) {
+		m.index.fn = fn
+	}
+}
+
+// WithAppendedIndex appends the index to the stream as empty gzip members,
+// which gzip readers skip and ReadIndex finds from the end of the stream.
+// It enables index generation with DefaultIndexInterval unless
+// WithIndexInterval is set.
+func WithAppendedIndex() Option {
+	return func(m *Middleware) {
+		m.index.appended = true
+	}
+}
+
+// ReadIndex reads the index appended by WithAppendedIndex from the
+// compressed stream in r of the given size. Indexes of more than about
+// four million entries are rejected.
+func (m *Middleware) ReadIndex(r io.ReaderAt, size int64) (middleware.Index, error) {
+	c, _ := lookup(m.algorithm)
+	if c.readIndex == nil {
+		return nil, ErrNoIndex
+	}
+	return c.readIndex(r, size)
+}
+
+// Prevalidate checks the index appended by WithAppendedIndex: every entry
+// must point at the start of a gzip member in the stream. Streams without
+// appended index pass, see middleware.Prevalidator.
+func (m *Middleware) Prevalidate(r io.ReaderAt, size int64) error {
+	ix, err := m.ReadIndex(r, size)
+	if errors.Is(err, ErrNoIndex) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("compression: read index: %w", err)
+	}
+	var magic [2]byte
+	for _, e := range ix {
+		if e.Stored+int64(len(magic)) > size {
+			return fmt.Errorf("compression: index entry at %d beyond stream size %d", e.Stored, size)
+		}
+		if _, err := r.ReadAt(magic[:], e.Stored); err != nil {
+			return err
+		}
+		if magic != [2]byte{0x1f, 0x8b} {
+			return fmt.Errorf("compression: index entry at %d is not a gzip member", e.Stored)
+		}
+	}
+	return nil
+}
+
+// RangeReader returns a reader of n plaintext bytes from offset off of the
+// compressed stream in r of the given size, or of the rest of the stream if
+// n < 0. Decoding starts at the index entry before off, so only the bytes
+// from there to off are decoded and dropped; without index it starts at the
+// beginning of the stream.
+func (m *Middleware) RangeReader(r io.ReaderAt, size int64, ix middleware.Index, off, n int64) io.Reader {
+	return newLazyReader(func() (io.Reader, error) {
+		e := ix.Lookup(off)
+		if e.Stored > size {
+			return nil, fmt.Errorf("compression: index entry at %d beyond stream size %d", e.Stored, size)
+		}
+		zr := m.Reader(io.NewSectionReader(r, e.Stored, size-e.Stored))
+		if _, err := io.CopyN(io.Discard, zr, off-e.Plain); err != nil {
+			if err == io.EOF {
+				return bytes.NewReader(nil), nil
+			}
+			return nil, err
+		}
+		if n < 0 {
+			return zr, nil
+		}
+		return io.LimitReader(zr, n), nil
+	})
+}
@@ -0,0 +1,111 @@
+package compression_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/compression"
+)
+
+func writeIndexed(t *testing.T, m *compression.Middleware, data []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func TestAppendedIndex(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7 / 13)
+	}
+	var fromFunc middleware.Index
+	m := compression.New(compression.WithIndexInterval(4096), compression.WithAppendedIndex(),
+		compression.WithIndexFunc(func(ix middleware.Index) { fromFunc = ix }))
+	enc := writeIndexed(t, m, data)
+
+	got, err := io.ReadAll(m.Reader(bytes.NewReader(enc)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("round trip mismatch: %v", err)
+	}
+	ix, err := m.ReadIndex(bytes.NewReader(enc), int64(len(enc)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ix) != len(fromFunc) || len(ix) < len(data)/4096 {
+		t.Fatalf("got %d entries, index func got %d", len(ix), len(fromFunc))
+	}
+	if err := m.Prevalidate(bytes.NewReader(enc), int64(len(enc))); err != nil {
+		t.Fatal(err)
+	}
+
+	r := m.RangeReader(bytes.NewReader(enc), int64(len(enc)), ix, 50000, 1000)
+	got, err = io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, data[50000:51000]) {
+		t.Fatalf("range mismatch: %v", err)
+	}
+}
+
+func TestReadIndexWithoutIndex(t *testing.T) {
+	m := compression.New()
+	enc := writeIndexed(t, m, []byte("no index"))
+	if _, err := m.ReadIndex(bytes.NewReader(enc), int64(len(enc))); !errors.Is(err, compression.ErrNoIndex) {
+		t.Fatalf("got %v, want ErrNoIndex", err)
+	}
+}
+
+// locator returns a final index member pointing at offset start
+func locator(start uint64) []byte {
+	b := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 255, 12, 0, 'H', 'X', 8, 0}
+	b = binary.BigEndian.AppendUint64(b, start)
+	return append(b, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// sparse is a large stream of zeros ending with tail
+type sparse struct {
+	size int64
+	tail []byte
+}
+
+func (s sparse) ReadAt(p []byte, off int64) (int, error) {
+	clear(p)
+	tailStart := s.size - int64(len(s.tail))
+	for i := range p {
+		if pos := off + int64(i); pos >= tailStart && pos < s.size {
+			p[i] = s.tail[pos-tailStart]
+		}
+	}
+	return len(p), nil
+}
+
+func TestReadIndexHostileLocator(t *testing.T) {
+	m := compression.New(compression.WithAppendedIndex())
+	tests := []struct {
+		name string
+		r    io.ReaderAt
+		size int64
+	}{
+		{"negative offset", bytes.NewReader(locator(1 << 63)), 37},
+		{"max offset", bytes.NewReader(locator(1<<64 - 1)), 37},
+		{"offset beyond locator", bytes.NewReader(locator(38)), 37},
+		{"huge index", sparse{size: 1 << 40, tail: locator(0)}, 1 << 40},
+		{"garbage index", bytes.NewReader(append(make([]byte, 64), locator(0)...)), 64 + 37},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.ReadIndex(tt.r, tt.size); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package compression
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// lenientReader turns errors that occur after data was decoded into io.EOF.
+// A checksum mismatch is reported only once all data has been returned, and
+// garbage after a complete gzip member shows up as a header error or an
+// unexpected EOF, so these are skipped when recovering data. The latter
+// also ends a truncated stream early instead of failing it.
+type lenientReader struct {
+	r    io.Reader
+	logf middleware.Logf
+	n    int64
+}
+
+func (l *lenientReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	skip := errors.Is(err, gzip.ErrChecksum) || errors.Is(err, zlib.ErrChecksum) ||
+		(l.n > 0 && (errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF)))
+	if !skip {
+		return n, err
+	}
+	if l.logf != nil {
+		l.logf("compression: ignoring %v after %d bytes", err, l.n)
+	}
+	return n, io.EOF
+}
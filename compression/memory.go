@@ -0,0 +1,66 @@
+package compression
+
+import "schneider.vip/hybridbuffer/middleware"
+
+// Approximate allocations of the standard library codecs, measured with
+// compress/flate and compress/bzip2
+const (
+	flateWriterMemory      = 1200 << 10 // levels 2 to 9, hash chains and window
+	flateBestSpeedMemory   = 800 << 10
+	flateHuffmanOnlyMemory = 330 << 10
+	flateReaderMemory      = 48 << 10
+	bzip2ReaderMemory      = 3600 << 10 // 900k block of uint32 plus tables
+	unknownCodecMemory     = 1 << 20
+)
+
+// Ensure Middleware implements middleware.MemoryUser and middleware.MemoryShrinker interfaces
+var (
+	_ middleware.MemoryUser     = (*Middleware)(nil)
+	_ middleware.MemoryShrinker = (*Middleware)(nil)
+)
+
+// MemoryUsage estimates the memory of a Writer or Reader, which is
+// dominated by the DEFLATE compressor state at the configured level
+func (m *Middleware) MemoryUsage() int64 {
+	switch m.algorithm {
+	case Gzip, Zlib, Deflate:
+		return max(flateWriterLevelMemory(m.level), flateReaderMemory)
+	case Bzip2:
+		return bzip2ReaderMemory
+	default:
+		return unknownCodecMemory
+	}
+}
+
+// ForMemory returns a copy with the best compression level fitting into
+// budget, falling back to BestSpeed and then HuffmanOnly. Readers need no
+// configuration, so streams written with the smaller level stay readable
+// by the original middleware.
+func (m *Middleware) ForMemory(budget int64) (middleware.Middleware, bool) {
+	if m.MemoryUsage() <= budget {
+		return m, true
+	}
+	if c, ok := lookup(m.algorithm); !ok || !c.flateLevels {
+		return nil, false
+	}
+	for _, level := range []int{BestSpeed, HuffmanOnly} {
+		if flateWriterLevelMemory(level) <= budget && flateReaderMemory <= budget {
+			c := *m
+			c.level = level
+			return &c, true
+		}
+	}
+	return nil, false
+}
+
+// flateWriterLevelMemory returns the compressor memory at a level
+func flateWriterLevelMemory(level int) int64 {
+	switch level {
+	case HuffmanOnly:
+		return flateHuffmanOnlyMemory
+	case BestSpeed:
+		return flateBestSpeedMemory
+	default:
+		return flateWriterMemory
+	}
+}
@@ -0,0 +1,54 @@
+package compression
+
+import (
+	"io"
+	"sort"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// codec is the implementation of an algorithm. Codecs register themselves
+// from build-tagged files, so an algorithm excluded by its hbmw_no<name>
+// tag is neither linked nor reported by Available.
+type codec struct {
+	caps        func() Capability
+	flateLevels bool // level must be a compress/flate level
+	writer      func(w io.Writer, level int) io.Writer
+	reader      func(r io.Reader) io.Reader
+	indexWriter func(w io.Writer, level int, cfg indexConfig) io.Writer   // nil if indexing is not supported
+	readIndex   func(r io.ReaderAt, size int64) (middleware.Index, error) // nil if indexing is not supported
+}
+
+var codecs = map[Algorithm]codec{}
+
+// register is called from init functions only
+func register(a Algorithm, c codec) {
+	codecs[a] = c
+}
+
+func lookup(a Algorithm) (codec, bool) {
+	c, ok := codecs[a]
+	return c, ok
+}
+
+// registered returns the registered algorithms in ascending order
+func registered() []Algorithm {
+	algos := make([]Algorithm, 0, len(codecs))
+	for a := range codecs {
+		algos = append(algos, a)
+	}
+	sort.Slice(algos, func(i, j int) bool { return algos[i] < algos[j] })
+	return algos
+}
+
+func fixedCaps(c Capability) func() Capability {
+	return func() Capability { return c }
+}
+
+// newWriter hardens a freshly created compressor
+func newWriter(w io.WriteCloser, err error) io.Writer {
+	if err != nil {
+		return &errWriter{err: err}
+	}
+	return middleware.HardenLayerWriter("compression", w)
+}
@@ -0,0 +1,21 @@
+//go:build !hbmw_nozlib
+
+package compression
+
+import (
+	"compress/zlib"
+	"io"
+)
+
+func init() {
+	register(Zlib, codec{
+		caps:        fixedCaps(CapEncode | CapDecode | CapStreaming | CapDictionary),
+		flateLevels: true,
+		writer: func(w io.Writer, level int) io.Writer {
+			return newWriter(zlib.NewWriterLevel(w, level))
+		},
+		reader: func(r io.Reader) io.Reader {
+			return newLazyReader(func() (io.Reader, error) { return zlib.NewReader(r) })
+		},
+	})
+}
@@ -0,0 +1,242 @@
+// Package corpus generates reproducible test corpora of realistic content,
+// for benchmarking and checking middlewares, including custom ones. The same
+// kind, size and seed always produce the same bytes.
+//
+// The package is named corpus because the go tool ignores directories named
+// testdata.
+package corpus
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// Kind selects the content of a corpus
+type Kind int
+
+const (
+	// Text is English-like prose with punctuation and line breaks
+	Text Kind = iota
+	// JSON is JSON lines with typical record fields
+	JSON
+	// Random is incompressible random data
+	Random
+	// ZeroHeavy is mostly zero bytes with sparse runs of data, like bitmaps
+	// or zero-padded records
+	ZeroHeavy
+	// Compressed is gzip compressed Text, i.e. already compressed content.
+	// It is cut at the requested size, so it is not a complete gzip stream.
+	Compressed
+)
+
+// String returns the name of the kind
+func (k Kind) String() string {
+	switch k {
+	case Text:
+		return "text"
+	case JSON:
+		return "json"
+	case Random:
+		return "random"
+	case ZeroHeavy:
+		return "zero-heavy"
+	case Compressed:
+		return "compressed"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// Kinds returns all kinds
+func Kinds() []Kind {
+	return []Kind{Text, JSON, Random, ZeroHeavy, Compressed}
+}
+
+// ParseKind returns the kind for a name as returned by String
+func ParseKind(name string) (Kind, error) {
+	for _, k := range Kinds() {
+		if strings.EqualFold(name, k.String()) {
+			return k, nil
+		}
+	}
+	return 0, fmt.Errorf("corpus: unknown kind %q", name)
+}
+
+// Generate returns size bytes of the given kind
+func Generate(kind Kind, size int, seed uint64) []byte {
+	buf := make([]byte, size)
+	io.ReadFull(NewReader(kind, int64(size), seed), buf)
+	return buf
+}
+
+// NewReader returns a reader producing size bytes of the given kind without
+// holding the corpus in memory
+func NewReader(kind Kind, size int64, seed uint64) io.Reader {
+	rng := rand.New(rand.NewPCG(seed, uint64(kind)))
+	var g generator
+	switch kind {
+	case JSON:
+		g = &jsonGen{rng: rng}
+	case Random:
+		g = &randomGen{rng: rng}
+	case ZeroHeavy:
+		g = &zeroGen{rng: rng}
+	case Compressed:
+		g = newCompressedGen(rng)
+	default:
+		g = &textGen{rng: rng}
+	}
+	return &reader{gen: g, remain: size}
+}
+
+// generator appends the next block of content to dst
+type generator interface {
+	next(dst []byte) []byte
+}
+
+type reader struct {
+	gen    generator
+	remain int64
+	buf    []byte
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.remain <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remain {
+		p = p[:r.remain]
+	}
+	for len(r.buf) == 0 {
+		r.buf = r.gen.next(r.buf[:0])
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	r.remain -= int64(n)
+	return n, nil
+}
+
+var words = strings.Fields(`the of and to in is was that for it with as his on be at by
+this had not are but from or have an they which one you were her all she there
+would their we him been has when who will more no if out so said what up its
+about into than them can only other new some could time these two may then do
+first any my now such like our over man me even most made after also did many
+before must through back years where much your way well down should because each
+just those people how too little state good very make world still own see men
+work long get here between both life being under never day same another know
+while last might us great old year off come since against go came right used
+take three buffer stream chunk memory disk spill data record value key`)
+
+type textGen struct {
+	rng *rand.Rand
+}
+
+func (g *textGen) next(dst []byte) []byte {
+	n := 4 + g.rng.IntN(14)
+	for i := 0; i < n; i++ {
+		w := words[g.rng.IntN(len(words))]
+		if i == 0 {
+			dst = append(dst, strings.ToUpper(w[:1])...)
+			dst = append(dst, w[1:]...)
+		} else {
+			dst = append(dst, w...)
+		}
+		switch {
+		case i == n-1:
+			dst = append(dst, '.')
+		case g.rng.IntN(10) == 0:
+			dst = append(dst, ',', ' ')
+		default:
+			dst = append(dst, ' ')
+		}
+	}
+	if g.rng.IntN(6) == 0 {
+		return append(dst, '\n', '\n')
+	}
+	return append(dst, ' ')
+}
+
+type jsonGen struct {
+	rng *rand.Rand
+	id  int
+}
+
+func (g *jsonGen) next(dst []byte) []byte {
+	g.id++
+	dst = append(dst, `{"id":`...)
+	dst = strconv.AppendInt(dst, int64(g.id), 10)
+	dst = append(dst, `,"name":"`...)
+	dst = append(dst, words[g.rng.IntN(len(words))]...)
+	dst = append(dst, '-')
+	dst = append(dst, words[g.rng.IntN(len(words))]...)
+	dst = append(dst, `","active":`...)
+	dst = strconv.AppendBool(dst, g.rng.IntN(3) > 0)
+	dst = append(dst, `,"score":`...)
+	dst = strconv.AppendFloat(dst, float64(g.rng.IntN(100000))/100, 'f', 2, 64)
+	dst = append(dst, `,"tags":[`...)
+	for i, n := 0, g.rng.IntN(4); i < n; i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, '"')
+		dst = append(dst, words[g.rng.IntN(len(words))]...)
+		dst = append(dst, '"')
+	}
+	return append(dst, "]}\n"...)
+}
+
+type randomGen struct {
+	rng *rand.Rand
+}
+
+func (g *randomGen) next(dst []byte) []byte {
+	for i := 0; i < 512; i++ {
+		dst = append(dst, byte(g.rng.Uint32()))
+	}
+	return dst
+}
+
+type zeroGen struct {
+	rng *rand.Rand
+}
+
+func (g *zeroGen) next(dst []byte) []byte {
+	dst = append(dst, make([]byte, 64+g.rng.IntN(4096))...)
+	for i, n := 0, 1+g.rng.IntN(32); i < n; i++ {
+		dst = append(dst, byte(1+g.rng.IntN(255)))
+	}
+	return dst
+}
+
+// compressedGen gzips the output of a textGen
+type compressedGen struct {
+	text *textGen
+	out  bytes.Buffer
+	zw   *gzip.Writer
+	raw  []byte
+}
+
+func newCompressedGen(rng *rand.Rand) *compressedGen {
+	g := &compressedGen{text: &textGen{rng: rng}}
+	g.zw = gzip.NewWriter(&g.out)
+	return g
+}
+
+func (g *compressedGen) next(dst []byte) []byte {
+	for g.out.Len() == 0 {
+		g.raw = g.raw[:0]
+		for len(g.raw) < 32*1024 {
+			g.raw = g.text.next(g.raw)
+		}
+		g.zw.Write(g.raw)
+		g.zw.Flush()
+	}
+	dst = append(dst, g.out.Bytes()...)
+	g.out.Reset()
+	return dst
+}
@@ -0,0 +1,133 @@
+package corpus_test
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"schneider.vip/hybridbuffer/middleware/corpus"
+)
+
+// golden pins the first 4 KiB of every kind for seed 1, so corpora used in
+// stored benchmarks stay reproducible across releases. Compressed depends on
+// the gzip implementation of the Go release and is not pinned.
+var golden = map[corpus.Kind]string{
+	corpus.Text:      "3138c6a8df410b49",
+	corpus.JSON:      "7999a541ea2e959d",
+	corpus.Random:    "5be31d31f38512e6",
+	corpus.ZeroHeavy: "083683bd50b42a05",
+}
+
+func TestGolden(t *testing.T) {
+	for kind, want := range golden {
+		sum := sha256.Sum256(corpus.Generate(kind, 4096, 1))
+		if got := hex.EncodeToString(sum[:8]); got != want {
+			t.Errorf("%s: got %s, want %s", kind, got, want)
+		}
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	for _, kind := range corpus.Kinds() {
+		a := corpus.Generate(kind, 100<<10, 42)
+		if len(a) != 100<<10 {
+			t.Fatalf("%s: generated %d bytes", kind, len(a))
+		}
+		// the reader produces the same bytes however it is read
+		b, err := io.ReadAll(iotest.OneByteReader(corpus.NewReader(kind, 100<<10, 42)))
+		if err != nil || !bytes.Equal(a, b) {
+			t.Fatalf("%s: reader differs from Generate: %v", kind, err)
+		}
+		if bytes.Equal(a, corpus.Generate(kind, 100<<10, 43)) {
+			t.Fatalf("%s: seed ignored", kind)
+		}
+		// a shorter corpus is a prefix of a longer one
+		if !bytes.HasPrefix(a, corpus.Generate(kind, 1000, 42)) {
+			t.Fatalf("%s: prefix differs", kind)
+		}
+	}
+	if len(corpus.Generate(corpus.Text, 0, 1)) != 0 {
+		t.Fatal("empty corpus not empty")
+	}
+}
+
+func TestContent(t *testing.T) {
+	const size = 1 << 20
+	gzipped := func(data []byte) int {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(data)
+		zw.Close()
+		return buf.Len()
+	}
+
+	// text and JSON compress well, random and compressed data does not
+	for kind, maxRatio := range map[corpus.Kind]float64{
+		corpus.Text:       0.5,
+		corpus.JSON:       0.5,
+		corpus.ZeroHeavy:  0.1,
+		corpus.Random:     1.1,
+		corpus.Compressed: 1.1,
+	} {
+		ratio := float64(gzipped(corpus.Generate(kind, size, 7))) / size
+		if ratio > maxRatio {
+			t.Errorf("%s: compresses to %.2f, want at most %.2f", kind, ratio, maxRatio)
+		}
+		if kind == corpus.Random || kind == corpus.Compressed {
+			if ratio < 0.95 {
+				t.Errorf("%s: compresses to %.2f", kind, ratio)
+			}
+		}
+	}
+
+	// every complete JSON line is a valid record
+	sc := bufio.NewScanner(corpus.NewReader(corpus.JSON, size, 7))
+	lines := 0
+	for sc.Scan() {
+		var rec struct {
+			ID   int      `json:"id"`
+			Tags []string `json:"tags"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// only the last line may be cut
+			if sc.Scan() {
+				t.Fatalf("line %d: %v", lines+1, err)
+			}
+			break
+		}
+		lines++
+		if rec.ID != lines {
+			t.Fatalf("line %d has id %d", lines, rec.ID)
+		}
+	}
+	if lines < 1000 {
+		t.Fatalf("%d records", lines)
+	}
+
+	// compressed content is a gzip stream of text
+	zr, err := gzip.NewReader(bytes.NewReader(corpus.Generate(corpus.Compressed, size, 7)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := io.ReadAll(zr)
+	if len(text) < size || bytes.IndexByte(text, 0) >= 0 {
+		t.Fatalf("decompressed %d bytes", len(text))
+	}
+}
+
+func TestParseKind(t *testing.T) {
+	for _, kind := range corpus.Kinds() {
+		if got, err := corpus.ParseKind(kind.String()); err != nil || got != kind {
+			t.Fatalf("%s: got %v, %v", kind, got, err)
+		}
+	}
+	if _, err := corpus.ParseKind("binary"); err == nil {
+		t.Fatal("unknown kind accepted")
+	}
+}
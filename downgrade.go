@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnavailable should be returned by candidate constructors whose backend
+// (cipher hardware, KMS, HSM) is not available at runtime
+var ErrUnavailable = errors.New("middleware: backend unavailable")
+
+// DowngradePolicy controls what happens if the preferred middleware cannot be constructed
+type DowngradePolicy int
+
+const (
+	// DowngradeFail returns the construction error
+	DowngradeFail DowngradePolicy = iota
+
+	// DowngradeAlternative tries the alternative candidates in order
+	DowngradeAlternative
+
+	// DowngradePlaintext tries the alternatives and then falls back to
+	// Passthrough. Data is then stored unprotected, so the downgrade
+	// callback should alert loudly.
+	DowngradePlaintext
+)
+
+// String returns the name of the policy
+func (p DowngradePolicy) String() string {
+	switch p {
+	case DowngradeFail:
+		return "fail"
+	case DowngradeAlternative:
+		return "alternative"
+	case DowngradePlaintext:
+		return "plaintext"
+	default:
+		return fmt.Sprintf("DowngradePolicy(%d)", int(p))
+	}
+}
+
+// Candidate is a named middleware constructor
+type Candidate struct {
+	Name string
+	New  func() (Middleware, error)
+}
+
+// Recover converts a constructor that panics on misconfiguration, such as
+// encryption.New, into one that returns an error
+func Recover(fn func() Middleware) func() (Middleware, error) {
+	return func() (m Middleware, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				m, err = nil, fmt.Errorf("%w: %v", ErrUnavailable, r)
+			}
+		}()
+		return fn(), nil
+	}
+}
+
+// DowngradeEvent describes a fallback from the preferred candidate
+type DowngradeEvent struct {
+	Policy DowngradePolicy
+	From   string // name of the preferred candidate
+	To     string // name of the chosen candidate, "plaintext" for the Passthrough fallback
+	Err    error  // construction errors of all skipped candidates
+}
+
+// Downgrade constructs the preferred middleware and falls back according to
+// policy if it is unavailable. onDowngrade, if not nil, is called when a
+// fallback is chosen. The selection happens once, so Writers and Readers
+// created from the result use the same variant.
+func Downgrade(policy DowngradePolicy, onDowngrade func(DowngradeEvent), preferred Candidate, alternatives ...Candidate) (Middleware, error) {
+	m, err := preferred.New()
+	if err == nil {
+		return m, nil
+	}
+	errs := []error{fmt.Errorf("%s: %w", preferred.Name, err)}
+	if policy == DowngradeFail {
+		return nil, fmt.Errorf("middleware: %w", errs[0])
+	}
+	for _, c := range alternatives {
+		m, err := c.New()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name, err))
+			continue
+		}
+		notifyDowngrade(onDowngrade, DowngradeEvent{Policy: policy, From: preferred.Name, To: c.Name, Err: errors.Join(errs...)})
+		return m, nil
+	}
+	if policy == DowngradePlaintext {
+		notifyDowngrade(onDowngrade, DowngradeEvent{Policy: policy, From: preferred.Name, To: "plaintext", Err: errors.Join(errs...)})
+		return Passthrough(), nil
+	}
+	return nil, fmt.Errorf("middleware: no candidate available: %w", errors.Join(errs...))
+}
+
+func notifyDowngrade(fn func(DowngradeEvent), ev DowngradeEvent) {
+	if fn != nil {
+		fn(ev)
+	}
+}
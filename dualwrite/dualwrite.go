@@ -0,0 +1,255 @@
+// Package dualwrite writes a stream through two pipelines to two sinks at
+// once, e.g. the old and the new format during a migration. Which side may
+// fail without aborting the write is set by a Policy, so a cutover can be
+// rolled back at any time while both copies are produced.
+package dualwrite
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// Policy selects which failures abort the operation
+type Policy int
+
+const (
+	// AbortOnPrimary fails on primary errors only; the secondary copy is
+	// best effort. This is the default while the old format is authoritative.
+	AbortOnPrimary Policy = iota
+
+	// AbortOnSecondary fails on secondary errors only, for the phase where
+	// the new format is authoritative and the old one is kept for rollback
+	AbortOnSecondary
+
+	// AbortOnEither fails if either copy fails
+	AbortOnEither
+)
+
+// String returns the name of the policy
+func (p Policy) String() string {
+	switch p {
+	case AbortOnPrimary:
+		return "abort-on-primary"
+	case AbortOnSecondary:
+		return "abort-on-secondary"
+	case AbortOnEither:
+		return "abort-on-either"
+	default:
+		return fmt.Sprintf("Policy(%d)", int(p))
+	}
+}
+
+// Side identifies one of the two copies
+type Side int
+
+const (
+	Primary Side = iota
+	Secondary
+)
+
+// String returns the name of the side
+func (s Side) String() string {
+	if s == Secondary {
+		return "secondary"
+	}
+	return "primary"
+}
+
+// SinkFunc opens the secondary sink for a new stream. If the returned
+// writer implements io.Closer it is closed when the stream is closed.
+type SinkFunc func() (io.Writer, error)
+
+// Middleware writes through a primary pipeline to the writer passed to
+// Writer and through a secondary pipeline to a sink opened per stream
+type Middleware struct {
+	primary   middleware.Middleware
+	secondary middleware.Middleware
+	sink      SinkFunc
+	policy    Policy
+	readFrom  Side
+	onError   func(side Side, err error)
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+)
+
+// Option configures the dual-write middleware
+type Option func(*Middleware)
+
+// WithPolicy sets which failures abort the operation, the default is AbortOnPrimary
+func WithPolicy(p Policy) Option {
+	return func(m *Middleware) {
+		m.policy = p
+	}
+}
+
+// WithReadFrom selects the pipeline used by Reader, the default is Primary.
+// The reader passed to Reader must contain the copy of that side.
+func WithReadFrom(s Side) Option {
+	return func(m *Middleware) {
+		m.readFrom = s
+	}
+}
+
+// WithErrorCallback registers a function called for failures of a side that
+// do not abort the operation, so they can be logged and alerted on
+func WithErrorCallback(fn func(side Side, err error)) Option {
+	return func(m *Middleware) {
+		m.onError = fn
+	}
+}
+
+// New creates a dual-write middleware. Nil pipelines are treated as passthrough.
+func New(primary, secondary middleware.Middleware, sink SinkFunc, opts ...Option) *Middleware {
+	if primary == nil {
+		primary = middleware.Passthrough()
+	}
+	if secondary == nil {
+		secondary = middleware.Passthrough()
+	}
+	m := &Middleware{primary: primary, secondary: secondary, sink: sink}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Describe reports the policy; compliance reports do not descend into
+// both pipelines, use ComplianceReport on each of them
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:       "dualwrite",
+		Properties: map[string]string{"policy": m.policy.String(), "read_from": m.readFrom.String()},
+	}
+}
+
+// Writer wraps w with the primary pipeline and opens the secondary sink.
+// Closing the returned writer closes both pipelines and the secondary sink,
+// but not w.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	dw := &writer{m: m}
+	dw.sides[Primary].w = m.primary.Writer(noCloseWriter{w: w})
+	sink, err := m.sink()
+	if err != nil {
+		dw.fail(Secondary, fmt.Errorf("dualwrite: open secondary sink: %w", err))
+	} else {
+		dw.sink = sink
+		dw.sides[Secondary].w = m.secondary.Writer(noCloseWriter{w: sink})
+	}
+	return dw
+}
+
+// Reader unwraps r with the pipeline selected by WithReadFrom
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	if m.readFrom == Secondary {
+		return m.secondary.Reader(r)
+	}
+	return m.primary.Reader(r)
+}
+
+func (m *Middleware) aborts(s Side) bool {
+	switch m.policy {
+	case AbortOnEither:
+		return true
+	case AbortOnSecondary:
+		return s == Secondary
+	default:
+		return s == Primary
+	}
+}
+
+// noCloseWriter hides Close from the pipelines, so layers that pass Close
+// through do not close w or close the secondary sink ahead of closeSink
+type noCloseWriter struct {
+	w io.Writer
+}
+
+func (n noCloseWriter) Write(p []byte) (int, error) {
+	return n.w.Write(p)
+}
+
+type side struct {
+	w   io.Writer
+	err error
+}
+
+type writer struct {
+	m          *Middleware
+	sides      [2]side
+	sink       io.Writer
+	sinkClosed bool
+	state      middleware.WriterState
+}
+
+// fail records the failure of a side and returns an error if it aborts the operation
+func (d *writer) fail(s Side, err error) error {
+	if d.sides[s].err != nil {
+		return nil
+	}
+	d.sides[s].err = err
+	if d.m.aborts(s) {
+		return d.state.Fail(fmt.Errorf("dualwrite: %s: %w", s, err))
+	}
+	if d.m.onError != nil {
+		d.m.onError(s, err)
+	}
+	return nil
+}
+
+func (d *writer) Write(p []byte) (int, error) {
+	if err := d.state.Err(); err != nil {
+		return 0, err
+	}
+	for s := Primary; s <= Secondary; s++ {
+		if d.sides[s].err != nil {
+			continue
+		}
+		if _, err := d.sides[s].w.Write(p); err != nil {
+			if err := d.fail(s, err); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Close finalizes both pipelines and closes the secondary sink. After an
+// aborted write the sink is still closed, but the pipelines are not finalized.
+func (d *writer) Close() error {
+	err := d.state.Close(func() error {
+		var errs []error
+		for s := Primary; s <= Secondary; s++ {
+			if d.sides[s].err != nil || d.sides[s].w == nil {
+				continue
+			}
+			if c, ok := d.sides[s].w.(io.Closer); ok {
+				if err := c.Close(); err != nil {
+					errs = append(errs, d.fail(s, err))
+				}
+			}
+		}
+		if err := d.closeSink(); err != nil {
+			errs = append(errs, d.fail(Secondary, fmt.Errorf("close secondary sink: %w", err)))
+		}
+		return errors.Join(errs...)
+	})
+	d.closeSink()
+	return err
+}
+
+func (d *writer) closeSink() error {
+	if d.sinkClosed {
+		return nil
+	}
+	d.sinkClosed = true
+	if c, ok := d.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package dualwrite_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/dualwrite"
+	"schneider.vip/hybridbuffer/middleware/rle"
+)
+
+var errDisk = errors.New("disk full")
+
+// target is a sink that can fail its writes and counts calls to Close
+type target struct {
+	bytes.Buffer
+	fail   bool
+	closes int
+}
+
+func (t *target) Write(p []byte) (int, error) {
+	if t.fail {
+		return 0, errDisk
+	}
+	return t.Buffer.Write(p)
+}
+
+func (t *target) Close() error {
+	t.closes++
+	return nil
+}
+
+func TestBothCopies(t *testing.T) {
+	sec := &target{}
+	m := dualwrite.New(nil, rle.New(), func() (io.Writer, error) { return sec, nil })
+	pri := &target{}
+	w := m.Writer(pri)
+	data := append([]byte("migrated"), make([]byte, 1000)...)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if pri.closes != 0 || sec.closes != 1 {
+		t.Fatalf("primary closed %d times, secondary %d times", pri.closes, sec.closes)
+	}
+	if !bytes.Equal(pri.Bytes(), data) || sec.Len() >= len(data) {
+		t.Fatalf("primary %d bytes, secondary %d bytes", pri.Len(), sec.Len())
+	}
+
+	// each copy is read with the pipeline of its side
+	for _, tt := range []struct {
+		side dualwrite.Side
+		copy []byte
+	}{{dualwrite.Primary, pri.Bytes()}, {dualwrite.Secondary, sec.Bytes()}} {
+		r := dualwrite.New(nil, rle.New(), nil, dualwrite.WithReadFrom(tt.side)).Reader(bytes.NewReader(tt.copy))
+		if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: got %d bytes, %v", tt.side, len(got), err)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	const (
+		primaryWrite = iota
+		secondaryWrite
+		secondaryOpen
+	)
+	tests := []struct {
+		policy  dualwrite.Policy
+		failure int
+		abort   bool
+	}{
+		{dualwrite.AbortOnPrimary, primaryWrite, true},
+		{dualwrite.AbortOnPrimary, secondaryWrite, false},
+		{dualwrite.AbortOnPrimary, secondaryOpen, false},
+		{dualwrite.AbortOnSecondary, primaryWrite, false},
+		{dualwrite.AbortOnSecondary, secondaryWrite, true},
+		{dualwrite.AbortOnSecondary, secondaryOpen, true},
+		{dualwrite.AbortOnEither, primaryWrite, true},
+		{dualwrite.AbortOnEither, secondaryWrite, true},
+		{dualwrite.AbortOnEither, secondaryOpen, true},
+	}
+	for _, tt := range tests {
+		name := tt.policy.String() + "/" + []string{"primary write", "secondary write", "secondary open"}[tt.failure]
+		t.Run(name, func(t *testing.T) {
+			pri, sec := &target{fail: tt.failure == primaryWrite}, &target{fail: tt.failure == secondaryWrite}
+			sink := func() (io.Writer, error) {
+				if tt.failure == secondaryOpen {
+					return nil, errDisk
+				}
+				return sec, nil
+			}
+			var reported []dualwrite.Side
+			m := dualwrite.New(nil, nil, sink,
+				dualwrite.WithPolicy(tt.policy),
+				dualwrite.WithErrorCallback(func(s dualwrite.Side, err error) {
+					if !errors.Is(err, errDisk) {
+						t.Errorf("reported %v", err)
+					}
+					reported = append(reported, s)
+				}),
+			)
+
+			w := m.Writer(pri)
+			_, werr := w.Write([]byte("row 1\n"))
+			_, werr2 := w.Write([]byte("row 2\n"))
+			cerr := w.(io.Closer).Close()
+
+			if tt.abort {
+				if !errors.Is(werr, errDisk) || !errors.Is(werr2, errDisk) || !errors.Is(cerr, errDisk) {
+					t.Fatalf("got %v, %v, %v, want errDisk from every call", werr, werr2, cerr)
+				}
+				if len(reported) != 0 {
+					t.Fatalf("aborting failure reported to the callback: %v", reported)
+				}
+			} else {
+				if werr != nil || werr2 != nil || cerr != nil {
+					t.Fatalf("got %v, %v, %v", werr, werr2, cerr)
+				}
+				if len(reported) != 1 {
+					t.Fatalf("reported %v, want one failure", reported)
+				}
+			}
+			// the healthy side gets every record unless the write aborted
+			healthy := pri
+			if tt.failure == primaryWrite {
+				healthy = sec
+			}
+			if !tt.abort && healthy.String() != "row 1\nrow 2\n" {
+				t.Fatalf("healthy copy %q", healthy.String())
+			}
+			if tt.failure != secondaryOpen && sec.closes != 1 {
+				t.Fatalf("secondary sink closed %d times", sec.closes)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// DynamicFormatVersion is the variant header format version written by Dynamic
+	DynamicFormatVersion = 1
+
+	// MaxVariantName is the longest variant name that fits the header
+	MaxVariantName = 255
+)
+
+var dynamicMagic = [3]byte{'H', 'B', 'D'}
+
+// ErrUnknownVariant is returned when a variant name has no registered layers
+var ErrUnknownVariant = errors.New("middleware: unknown pipeline variant")
+
+// Variants maps variant names to their layers, plaintext side first
+type Variants map[string][]Middleware
+
+// VariantProvider chooses the variant for a new stream, e.g. by consulting
+// a feature flag system or a config service
+type VariantProvider func(ctx context.Context) string
+
+// DynamicPipeline chooses its layers when a Writer is created and records
+// the chosen variant in a stream header, so Readers use the same layers
+// regardless of what the provider would choose today
+type DynamicPipeline struct {
+	provider VariantProvider
+	variants Variants
+	stats    StatsSink
+}
+
+// Ensure DynamicPipeline implements Middleware and Versioned interfaces
+var (
+	_ Middleware        = (*DynamicPipeline)(nil)
+	_ Versioned         = (*DynamicPipeline)(nil)
+	_ ContextMiddleware = (*DynamicPipeline)(nil)
+)
+
+// Dynamic creates a pipeline whose layers are chosen per stream by provider.
+// Variants that were used for writing must stay registered for reading.
+func Dynamic(provider VariantProvider, variants Variants) *DynamicPipeline {
+	return &DynamicPipeline{provider: provider, variants: variants}
+}
+
+// WithStats reports the operations of every stream to sink, tagged with
+// the variant name as layer, so variants can be compared on real traffic.
+// It returns the pipeline.
+func (d *DynamicPipeline) WithStats(sink StatsSink) *DynamicPipeline {
+	d.stats = sink
+	return d
+}
+
+// variant returns the middleware for a variant name
+func (d *DynamicPipeline) variant(name string) (Middleware, error) {
+	layers, ok := d.variants[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownVariant, name)
+	}
+	var m Middleware = NewChain(layers...)
+	if d.stats != nil {
+		m = WithStats(name, m, d.stats)
+	}
+	return m, nil
+}
+
+// FormatVersion returns the header format version written by the Writer
+func (d *DynamicPipeline) FormatVersion() uint8 {
+	return DynamicFormatVersion
+}
+
+// MaxSupportedVersion returns the highest header format version the Reader understands
+func (d *DynamicPipeline) MaxSupportedVersion() uint8 {
+	return DynamicFormatVersion
+}
+
+// Writer calls WriterContext with context.Background()
+func (d *DynamicPipeline) Writer(w io.Writer) io.Writer {
+	return d.WriterContext(context.Background(), w)
+}
+
+// WriterContext asks the provider for a variant and wraps w with its layers.
+// The variant header is written ahead of the first byte of the layers.
+func (d *DynamicPipeline) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	name := d.provider(ctx)
+	m, err := d.variant(name)
+	if err != nil {
+		return &errWriter{err: err}
+	}
+	if len(name) > MaxVariantName {
+		return &errWriter{err: fmt.Errorf("middleware: variant name longer than %d bytes", MaxVariantName)}
+	}
+	header := append(dynamicMagic[:], DynamicFormatVersion, byte(len(name)))
+	header = append(header, name...)
+	pw := &prefixWriter{w: w, prefix: header}
+	return &dynamicWriter{inner: WriterContext(ctx, m, pw), prefix: pw}
+}
+
+// Reader reads the variant header from r and unwraps r with the layers of
+// that variant. Header errors are returned from Read.
+func (d *DynamicPipeline) Reader(r io.Reader) io.Reader {
+	return &dynamicReader{d: d, src: r}
+}
+
+// ReaderContext is like Reader, but passes ctx to the layers of the variant
+func (d *DynamicPipeline) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return &dynamicReader{d: d, src: r, ctx: ctx}
+}
+
+// Variant reads the variant header from r and returns the variant name,
+// leaving r positioned at the first byte of the layers
+func (d *DynamicPipeline) Variant(r io.Reader) (string, error) {
+	var hdr [len(dynamicMagic) + 2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", fmt.Errorf("middleware: read variant header: %w", err)
+	}
+	if [3]byte(hdr[:3]) != dynamicMagic {
+		return "", fmt.Errorf("middleware: missing variant header")
+	}
+	if _, err := CheckVersion("dynamic", hdr[3], DynamicFormatVersion, RejectUnknown); err != nil {
+		return "", err
+	}
+	name := make([]byte, hdr[4])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", fmt.Errorf("middleware: read variant header: %w", err)
+	}
+	return string(name), nil
+}
+
+type dynamicWriter struct {
+	inner  io.Writer
+	prefix *prefixWriter
+	state  WriterState
+}
+
+func (d *dynamicWriter) Write(p []byte) (int, error) {
+	if err := d.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := d.inner.Write(p)
+	return n, d.state.Fail(err)
+}
+
+// Close closes the layers and writes the header if no data was written
+func (d *dynamicWriter) Close() error {
+	return d.state.Close(func() error {
+		if c, ok := d.inner.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				return err
+			}
+		}
+		return d.prefix.flush()
+	})
+}
+
+// prefixWriter writes prefix ahead of the first write
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	if err := p.flush(); err != nil {
+		return 0, err
+	}
+	return p.w.Write(b)
+}
+
+func (p *prefixWriter) flush() error {
+	if p.prefix == nil {
+		return nil
+	}
+	if _, err := p.w.Write(p.prefix); err != nil {
+		return err
+	}
+	p.prefix = nil
+	return nil
+}
+
+type dynamicReader struct {
+	d     *DynamicPipeline
+	src   io.Reader
+	ctx   context.Context
+	r     io.Reader
+	state ReaderState
+}
+
+func (d *dynamicReader) Read(p []byte) (int, error) {
+	if err := d.state.Err(); err != nil {
+		return 0, err
+	}
+	if d.r == nil {
+		name, err := d.d.Variant(d.src)
+		if err != nil {
+			return d.state.Track(0, err)
+		}
+		m, err := d.d.variant(name)
+		if err != nil {
+			return d.state.Track(0, err)
+		}
+		d.r = ReaderContext(d.ctx, m, d.src)
+	}
+	return d.state.Track(d.r.Read(p))
+}
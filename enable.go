@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// LayersFormatVersion is the format version of the header recording the
+// enabled layers of a stream
+const LayersFormatVersion = 1
+
+// maxToggledLayers is the number of layers the layers header can describe
+const maxToggledLayers = 255
+
+var layersMagic = [3]byte{'H', 'B', 'N'}
+
+var (
+	// ErrLayerNotFound is returned by SetEnabled for unknown layer names
+	ErrLayerNotFound = errors.New("middleware: layer not found")
+
+	// ErrLayersMismatch is returned by Readers for streams whose layers
+	// header describes a different number of layers than the chain has
+	ErrLayersMismatch = errors.New("middleware: stream layers do not match the chain")
+)
+
+// Names returns the layer names, plaintext side first. Layers of chains
+// created with NewChain are unnamed; use a Pipeline to name them.
+func (c *Chain) Names() []string {
+	return append([]string(nil), c.names...)
+}
+
+// SetEnabled enables or disables the named layer for Writers created
+// afterwards; existing ones are not affected. It is safe for concurrent
+// use, so operators can e.g. turn off compression under CPU pressure
+// without rebuilding the chain.
+//
+// Writers created while a layer is disabled record the enabled layers in a
+// header ahead of the stream:
+//
+//	"HBN" | version | layer count (1) | enabled layers (bitmap, plaintext side first)
+//
+// Readers decode every stream with the layers it was written with,
+// whatever is enabled now; streams without the header were written with
+// all layers. Layers must therefore not be added, removed or reordered
+// while streams written with a disabled layer are stored.
+func (c *Chain) SetEnabled(name string, enabled bool) error {
+	i := c.index(name)
+	if i < 0 {
+		return fmt.Errorf("%w: %q", ErrLayerNotFound, name)
+	}
+	if len(c.layers) > maxToggledLayers {
+		return fmt.Errorf("middleware: cannot toggle layers of a chain with more than %d layers", maxToggledLayers)
+	}
+	c.disabled[i].Store(!enabled)
+	return nil
+}
+
+// Enabled reports whether the named layer exists and is enabled
+func (c *Chain) Enabled(name string) bool {
+	i := c.index(name)
+	return i >= 0 && !c.disabled[i].Load()
+}
+
+func (c *Chain) index(name string) int {
+	if name == "" {
+		return -1
+	}
+	for i, n := range c.names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// active returns the enabled layers
+func (c *Chain) active() []Middleware {
+	layers := make([]Middleware, 0, len(c.layers))
+	for i, m := range c.layers {
+		if c.isDisabled(i) {
+			continue
+		}
+		layers = append(layers, m)
+	}
+	return layers
+}
+
+// writeLayers returns the enabled layers and the layers header for a new
+// stream, which is nil if all layers are enabled
+func (c *Chain) writeLayers() ([]Middleware, []byte) {
+	layers := c.active()
+	if len(layers) == len(c.layers) {
+		return layers, nil
+	}
+	header := append(layersMagic[:], LayersFormatVersion, byte(len(c.layers)))
+	header = append(header, make([]byte, (len(c.layers)+7)/8)...)
+	for i := range c.layers {
+		if !c.isDisabled(i) {
+			header[5+i/8] |= 1 << (i % 8)
+		}
+	}
+	return layers, header
+}
+
+// toggleable reports whether layers of the chain can be disabled, i.e.
+// whether its streams may start with a layers header
+func (c *Chain) toggleable() bool {
+	if len(c.layers) > maxToggledLayers {
+		return false
+	}
+	for _, n := range c.names {
+		if n != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// streamLayers reads the layers header, if any, from the start of src. It
+// returns the layers of the stream, nil if all layers were enabled, and
+// the source positioned at the first byte after the header.
+func (c *Chain) streamLayers(src io.Reader) ([]bool, io.Reader, error) {
+	var fixed [5]byte
+	n, err := io.ReadFull(src, fixed[:])
+	if n < len(fixed) || [3]byte(fixed[:3]) != layersMagic {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		return nil, io.MultiReader(bytes.NewReader(fixed[:n]), src), nil
+	}
+	header := make([]byte, len(fixed)+(int(fixed[4])+7)/8)
+	copy(header, fixed[:])
+	if _, err := io.ReadFull(src, header[len(fixed):]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, fmt.Errorf("middleware: read layers header: %w", err)
+	}
+	enabled, err := c.parseLayers(header)
+	return enabled, src, err
+}
+
+// parseLayers decodes a complete layers header
+func (c *Chain) parseLayers(header []byte) ([]bool, error) {
+	if _, err := CheckVersion("layers", header[3], LayersFormatVersion, RejectUnknown); err != nil {
+		return nil, err
+	}
+	if int(header[4]) != len(c.layers) {
+		return nil, fmt.Errorf("%w: stream has %d layers, chain %d", ErrLayersMismatch, header[4], len(c.layers))
+	}
+	enabled := make([]bool, len(c.layers))
+	for i, b := range header[5:] {
+		for bit := 0; bit < 8; bit++ {
+			set := b&(1<<bit) != 0
+			if i*8+bit >= len(enabled) {
+				if set {
+					return nil, fmt.Errorf("%w: layers bitmap", ErrHeaderCorrupt)
+				}
+				continue
+			}
+			enabled[i*8+bit] = set
+		}
+	}
+	return enabled, nil
+}
+
+// layersReader reads the layers header at the first Read and decodes the
+// stream with the layers it was written with
+type layersReader struct {
+	c     *Chain
+	src   io.Reader
+	build func(src io.Reader, enabled []bool) io.Reader
+	r     io.Reader
+	state ReaderState
+}
+
+func (l *layersReader) Read(p []byte) (int, error) {
+	if err := l.state.Err(); err != nil {
+		return 0, err
+	}
+	if l.r == nil {
+		enabled, src, err := l.c.streamLayers(l.src)
+		if err != nil {
+			return l.state.Track(0, err)
+		}
+		l.r = l.build(src, enabled)
+	}
+	return l.state.Track(l.r.Read(p))
+}
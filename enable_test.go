@@ -0,0 +1,143 @@
+package middleware_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/checksum"
+	"schneider.vip/hybridbuffer/middleware/compression"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+func toggleChain(t *testing.T) *middleware.Chain {
+	t.Helper()
+	c, err := middleware.NewPipeline().
+		Add("compression", compression.New()).
+		Add("encryption", encryption.New()).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func decode(c *middleware.Chain, stored []byte) ([]byte, error) {
+	return io.ReadAll(c.Reader(bytes.NewReader(stored)))
+}
+
+func TestSetEnabledKeepsStreamsReadable(t *testing.T) {
+	data := bytes.Repeat([]byte("toggled "), 1000)
+	c := toggleChain(t)
+	full := encode(t, c, data)
+
+	if err := c.SetEnabled("compression", false); err != nil {
+		t.Fatal(err)
+	}
+	if c.Enabled("compression") || !c.Enabled("encryption") {
+		t.Fatal("Enabled does not reflect SetEnabled")
+	}
+	partial := encode(t, c, data)
+	empty := encode(t, c, nil)
+	if !bytes.HasPrefix(partial, []byte{'H', 'B', 'N', middleware.LayersFormatVersion, 2, 0b10}) {
+		t.Fatalf("layers header % x", partial[:6])
+	}
+	if len(empty) != 6 {
+		t.Fatalf("empty stream % x", empty)
+	}
+	if bytes.HasPrefix(full, []byte("HBN")) {
+		t.Fatal("layers header written with all layers enabled")
+	}
+
+	// every stream is read with the layers it was written with, whatever
+	// is enabled when reading
+	for _, enabled := range []bool{false, true} {
+		if err := c.SetEnabled("compression", enabled); err != nil {
+			t.Fatal(err)
+		}
+		for name, stored := range map[string][]byte{"full": full, "partial": partial} {
+			got, err := decode(c, stored)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("%s with compression enabled %v: got %d bytes, %v", name, enabled, len(got), err)
+			}
+		}
+		if got, err := decode(c, empty); err != nil || len(got) != 0 {
+			t.Fatalf("empty: got %q, %v", got, err)
+		}
+	}
+
+	info := middleware.InspectBytes(partial)
+	if len(info.Formats) < 2 || info.Formats[0].Name != "layers" || info.Formats[1].Name != "dare" {
+		t.Fatalf("formats %v", info.Formats)
+	}
+}
+
+func TestLayersHeaderErrors(t *testing.T) {
+	c := toggleChain(t)
+	c.SetEnabled("encryption", false)
+	stored := encode(t, c, []byte("payload"))
+
+	three, err := middleware.NewPipeline().
+		Add("compression", compression.New()).
+		Add("encryption", encryption.New()).
+		Add("checksum", checksum.New()).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify := func(f func(b []byte)) []byte {
+		b := bytes.Clone(stored)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name  string
+		chain *middleware.Chain
+		data  []byte
+		want  error
+	}{
+		{"layer added", three, stored, middleware.ErrLayersMismatch},
+		{"version", c, modify(func(b []byte) { b[3] = 2 }), middleware.ErrUnsupportedVersion},
+		{"unused bits", c, modify(func(b []byte) { b[5] |= 0x80 }), middleware.ErrHeaderCorrupt},
+		{"truncated", c, stored[:5], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decode(tt.chain, tt.data); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if err := c.SetEnabled("zip", false); !errors.Is(err, middleware.ErrLayerNotFound) {
+		t.Fatalf("got %v, want ErrLayerNotFound", err)
+	}
+}
+
+func TestPrevalidateToggledStream(t *testing.T) {
+	c, err := middleware.NewPipeline().
+		Add("compression", compression.New()).
+		Add("checksum", checksum.New()).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WithPrevalidation()
+	data := bytes.Repeat([]byte("prevalidated "), 100)
+	c.SetEnabled("compression", false)
+	stored := encode(t, c, data)
+	c.SetEnabled("compression", true)
+
+	if err := c.Prevalidate(bytes.NewReader(stored), int64(len(stored))); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := decode(c, stored); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	stored[len(stored)/2] ^= 1
+	if err := c.Prevalidate(bytes.NewReader(stored), int64(len(stored))); !errors.Is(err, middleware.ErrPrevalidation) {
+		t.Fatalf("got %v, want ErrPrevalidation", err)
+	}
+}
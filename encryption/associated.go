@@ -0,0 +1,52 @@
+package encryption
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+)
+
+// WithAssociatedData binds every stream to ad, e.g. a tenant ID or the
+// buffer name: it is authenticated with the stream but not stored, and
+// Readers must be configured with the same data. A stream copied to
+// another buffer with different associated data fails to decrypt like a
+// stream encrypted with another key. Empty data binds nothing, so streams
+// written without associated data stay readable.
+func WithAssociatedData(ad []byte) Option {
+	return func(m *Middleware) {
+		m.ad = func(context.Context) ([]byte, error) { return ad, nil }
+	}
+}
+
+// WithAssociatedDataFunc is like WithAssociatedData, with the data of each
+// stream returned by fn for the context of WriterContext and
+// ReaderContext, e.g. a buffer ID set with middleware.WithBufferID.
+// Writer and Reader pass context.Background(). Errors of fn fail the
+// stream.
+func WithAssociatedDataFunc(fn func(ctx context.Context) ([]byte, error)) Option {
+	return func(m *Middleware) {
+		m.ad = fn
+	}
+}
+
+// associatedData returns the associated data of a stream, nil if none
+func (m *Middleware) associatedData(ctx context.Context) ([]byte, error) {
+	if m.ad == nil {
+		return nil, nil
+	}
+	ad, err := m.ad(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: associated data: %w", err)
+	}
+	return ad, nil
+}
+
+// associatedKey derives the key of the packages bound to the associated
+// data, like headerKey binds an authenticated header
+func associatedKey(key, ad []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("hybridbuffer associated data\x00"))
+	mac.Write(ad)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,218 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// AuthFormatVersion is the format version of the authenticated stream header
+const AuthFormatVersion = 1
+
+var authMagic = [3]byte{'H', 'B', 'A'}
+
+// maxAuthHeaderSize bounds the fields of an authenticated header
+const maxAuthHeaderSize = 4096
+
+// Field types of the authenticated header. Types with the critical bit set
+// must be understood by the reader, others may be skipped.
+const (
+	fieldCritical = 0x80
+
+	fieldReplayToken = fieldCritical | 1
+	fieldNotBefore   = fieldCritical | 2
+	fieldNotAfter    = fieldCritical | 3
+	fieldBufferID    = 4
+)
+
+// ErrHeaderNotAuthentic is returned by Readers if the tag of an
+// authenticated header matches none of the keys, i.e. for forged headers
+// and streams encrypted with another key
+var ErrHeaderNotAuthentic = errors.New("encryption: stream header not authentic")
+
+// ErrHeaderCorrupt is returned for malformed stream headers. It matches
+// middleware.ErrHeaderCorrupt.
+var ErrHeaderCorrupt error = headerCorruptError{}
+
+type headerCorruptError struct{}
+
+func (headerCorruptError) Error() string { return "encryption: corrupt stream header" }
+
+// Is matches middleware.ErrHeaderCorrupt
+func (headerCorruptError) Is(target error) bool { return target == middleware.ErrHeaderCorrupt }
+
+// authHeader holds the fields of an authenticated header. The header is
+// authenticated by deriving the stream key from the key and the header
+// bytes: a modified header yields a different key and decryption fails.
+// Empty streams have no DARE package to fail, so the header is followed by
+// a tag, see headerTag.
+type authHeader struct {
+	token     []byte
+	notBefore time.Time
+	notAfter  time.Time
+	bufferID  *middleware.BufferID
+}
+
+// newAuthHeader returns the header for a new stream, or nil if the
+// middleware is not configured to write one and ctx carries no buffer ID
+func (m *Middleware) newAuthHeader(ctx context.Context) (*authHeader, error) {
+	id, withID, err := middleware.AssignBufferID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !withID && m.replayToken == nil && m.notBefore.IsZero() && m.notAfter.IsZero() && m.validFor == 0 {
+		return nil, nil
+	}
+	h := &authHeader{notBefore: m.notBefore, notAfter: m.notAfter}
+	if withID {
+		h.bufferID = &id
+	}
+	if m.validFor > 0 {
+		h.notAfter = m.clock().Add(m.validFor)
+	}
+	if m.replayToken != nil {
+		token, err := m.replayToken()
+		if err != nil {
+			return nil, fmt.Errorf("encryption: failed to get replay token: %w", err)
+		}
+		h.token = append([]byte{}, token...)
+	}
+	return h, nil
+}
+
+// checkAuthHeader runs the configured checks on an authenticated header
+// and records its buffer ID in ctx
+func (m *Middleware) checkAuthHeader(ctx context.Context, h *authHeader) error {
+	if err := m.checkValidity(h); err != nil {
+		return err
+	}
+	if h.bufferID != nil {
+		if err := middleware.RecordBufferID(ctx, *h.bufferID); err != nil {
+			return err
+		}
+	}
+	if m.replayCheck != nil {
+		return m.replayCheck(h.token)
+	}
+	return nil
+}
+
+func (h *authHeader) marshal() ([]byte, error) {
+	var body []byte
+	if h.token != nil {
+		body = appendField(body, fieldReplayToken, h.token)
+	}
+	if !h.notBefore.IsZero() {
+		body = appendField(body, fieldNotBefore, binary.BigEndian.AppendUint64(nil, uint64(h.notBefore.Unix())))
+	}
+	if !h.notAfter.IsZero() {
+		body = appendField(body, fieldNotAfter, binary.BigEndian.AppendUint64(nil, uint64(h.notAfter.Unix())))
+	}
+	if h.bufferID != nil {
+		body = appendField(body, fieldBufferID, h.bufferID[:])
+	}
+	if len(body) > maxAuthHeaderSize {
+		return nil, fmt.Errorf("encryption: stream header too large (%d bytes)", len(body))
+	}
+	hdr := make([]byte, 0, len(authMagic)+3+len(body))
+	hdr = append(hdr, authMagic[:]...)
+	hdr = append(hdr, AuthFormatVersion)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+	return append(hdr, body...), nil
+}
+
+func appendField(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	return append(b, value...)
+}
+
+// readAuthHeader reads an authenticated header and returns it together
+// with its raw bytes
+func readAuthHeader(r io.Reader) (*authHeader, []byte, error) {
+	raw := make([]byte, len(authMagic)+3)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, nil, fmt.Errorf("encryption: read stream header: %w", err)
+	}
+	if !bytes.Equal(raw[:3], authMagic[:]) {
+		return nil, nil, ErrHeaderCorrupt
+	}
+	if raw[3] != AuthFormatVersion {
+		return nil, nil, fmt.Errorf("%w: version %d", ErrHeaderCorrupt, raw[3])
+	}
+	n := int(binary.BigEndian.Uint16(raw[4:]))
+	if n > maxAuthHeaderSize {
+		return nil, nil, ErrHeaderCorrupt
+	}
+	raw = append(raw, make([]byte, n)...)
+	if _, err := io.ReadFull(r, raw[len(raw)-n:]); err != nil {
+		return nil, nil, fmt.Errorf("encryption: read stream header: %w", err)
+	}
+	h := &authHeader{}
+	for body := raw[len(raw)-n:]; len(body) > 0; {
+		if len(body) < 3 {
+			return nil, nil, ErrHeaderCorrupt
+		}
+		typ, size := body[0], int(binary.BigEndian.Uint16(body[1:]))
+		if len(body) < 3+size {
+			return nil, nil, ErrHeaderCorrupt
+		}
+		value := body[3 : 3+size]
+		body = body[3+size:]
+		switch typ {
+		case fieldReplayToken:
+			h.token = value
+		case fieldNotBefore, fieldNotAfter:
+			if size != 8 {
+				return nil, nil, ErrHeaderCorrupt
+			}
+			t := time.Unix(int64(binary.BigEndian.Uint64(value)), 0)
+			if typ == fieldNotBefore {
+				h.notBefore = t
+			} else {
+				h.notAfter = t
+			}
+		case fieldBufferID:
+			if size != len(middleware.BufferID{}) {
+				return nil, nil, ErrHeaderCorrupt
+			}
+			id := middleware.BufferID(value)
+			h.bufferID = &id
+		default:
+			if typ&fieldCritical != 0 {
+				return nil, nil, fmt.Errorf("%w: unknown critical field %#x", ErrHeaderCorrupt, typ)
+			}
+		}
+	}
+	return h, raw, nil
+}
+
+// headerTagSize is the size of the tag following an authenticated header
+const headerTagSize = sha256.Size
+
+// headerTag returns the tag following an authenticated header, computed
+// with the DARE key of the stream. Readers verify it before using any field
+// of the header, as a stream without data has no package that would prove
+// the header authentic.
+func headerTag(key, header []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("hybridbuffer header tag\x00"))
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// headerKey derives the stream key bound to an authenticated header
+func headerKey(key, header []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("hybridbuffer authenticated header\x00"))
+	mac.Write(header)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,226 @@
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, encryption.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, ctx context.Context, m *encryption.Middleware, data []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.WriterContext(ctx, &enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func decrypt(ctx context.Context, m *encryption.Middleware, enc []byte) ([]byte, error) {
+	return io.ReadAll(m.ReaderContext(ctx, bytes.NewReader(enc)))
+}
+
+func randomToken() ([]byte, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	return token, err
+}
+
+func TestAuthHeaderRoundTrip(t *testing.T) {
+	key := newKey(t)
+	now := time.Unix(1_700_000_000, 0)
+	m := encryption.New(encryption.WithKey(key),
+		encryption.WithReplayToken(randomToken),
+		encryption.WithValidity(now.Add(-time.Hour), now.Add(time.Hour)),
+		encryption.WithClock(func() time.Time { return now }))
+	id, err := middleware.NewBufferID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, 64 << 10, 64<<10 + 1} {
+		data := make([]byte, size)
+		rand.Read(data)
+		enc := encrypt(t, middleware.WithBufferID(context.Background(), id), m, data)
+		if !bytes.HasPrefix(enc, []byte("HBA")) {
+			t.Fatal("stream has no authenticated header")
+		}
+		ctx := middleware.WithBufferID(context.Background(), middleware.BufferID{})
+		got, err := decrypt(ctx, m, enc)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+		if got, _ := middleware.BufferIDFromContext(ctx); got != id {
+			t.Fatalf("recorded buffer ID %s, want %s", got, id)
+		}
+	}
+}
+
+func TestAuthHeaderValidity(t *testing.T) {
+	key := newKey(t)
+	now := time.Unix(1_700_000_000, 0)
+	at := func(t time.Time) encryption.Option {
+		return encryption.WithClock(func() time.Time { return t })
+	}
+	enc := encrypt(t, context.Background(), encryption.New(encryption.WithKey(key), encryption.WithValidFor(time.Hour), at(now)), []byte("data"))
+
+	tests := []struct {
+		name string
+		opts []encryption.Option
+		want error
+	}{
+		{"within", []encryption.Option{at(now.Add(time.Minute))}, nil},
+		{"expired", []encryption.Option{at(now.Add(2 * time.Hour))}, encryption.ErrExpired},
+		{"expired but ignored", []encryption.Option{at(now.Add(2 * time.Hour)), encryption.WithValidityPolicy(encryption.IgnoreValidity)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := encryption.New(append([]encryption.Option{encryption.WithKey(key)}, tt.opts...)...)
+			got, err := decrypt(context.Background(), m, enc)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if err != nil && len(got) != 0 {
+				t.Fatal("returned data of an invalid stream")
+			}
+		})
+	}
+
+	future := encrypt(t, context.Background(), encryption.New(encryption.WithKey(key), encryption.WithValidity(now.Add(time.Hour), time.Time{})), []byte("data"))
+	if _, err := decrypt(context.Background(), encryption.New(encryption.WithKey(key), at(now)), future); !errors.Is(err, encryption.ErrNotYetValid) {
+		t.Fatalf("got %v, want ErrNotYetValid", err)
+	}
+}
+
+// replaceAuthBody returns the stream with the body of its authenticated
+// header replaced
+func replaceAuthBody(enc []byte, body []byte) []byte {
+	n := int(binary.BigEndian.Uint16(enc[4:6]))
+	out := append([]byte("HBA\x01"), binary.BigEndian.AppendUint16(nil, uint16(len(body)))...)
+	out = append(out, body...)
+	return append(out, enc[6+n:]...)
+}
+
+func field(typ byte, value []byte) []byte {
+	b := append([]byte{typ}, binary.BigEndian.AppendUint16(nil, uint16(len(value)))...)
+	return append(b, value...)
+}
+
+func TestAuthHeaderHostile(t *testing.T) {
+	key := newKey(t)
+	seen := encryption.NewSeenSet()
+	m := encryption.New(encryption.WithKey(key), encryption.WithReplayToken(randomToken), encryption.WithReplayCheck(seen.Check))
+	valid := encrypt(t, context.Background(), m, []byte("authenticated"))
+	body := valid[6 : 6+int(binary.BigEndian.Uint16(valid[4:6]))]
+
+	modify := func(f func(b []byte)) []byte {
+		b := bytes.Clone(valid)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"truncated header", valid[:5], nil},
+		{"unknown version", modify(func(b []byte) { b[3] = 2 }), encryption.ErrHeaderCorrupt},
+		{"huge header", modify(func(b []byte) { binary.BigEndian.PutUint16(b[4:], 4097) }), encryption.ErrHeaderCorrupt},
+		{"truncated field", replaceAuthBody(valid, body[:len(body)-1]), encryption.ErrHeaderCorrupt},
+		{"field header only", replaceAuthBody(valid, append(bytes.Clone(body), 0x04)), encryption.ErrHeaderCorrupt},
+		{"short validity", replaceAuthBody(valid, append(bytes.Clone(body), field(0x83, make([]byte, 4))...)), encryption.ErrHeaderCorrupt},
+		{"short buffer ID", replaceAuthBody(valid, append(bytes.Clone(body), field(0x04, make([]byte, 4))...)), encryption.ErrHeaderCorrupt},
+		{"unknown critical field", replaceAuthBody(valid, append(bytes.Clone(body), field(0x8f, nil)...)), encryption.ErrHeaderCorrupt},
+		{"unknown optional field", replaceAuthBody(valid, append(bytes.Clone(body), field(0x0f, nil)...)), nil},
+		{"changed token", modify(func(b []byte) { b[len(b)/2] ^= 1; b[9] ^= 1 }), encryption.ErrHeaderNotAuthentic},
+		{"changed tag", modify(func(b []byte) { b[6+len(body)] ^= 1 }), encryption.ErrHeaderNotAuthentic},
+		{"truncated tag", valid[:6+len(body)+31], nil},
+		{"removed token", replaceAuthBody(valid, nil), encryption.ErrHeaderNotAuthentic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(context.Background(), m, tt.data)
+			if err == nil {
+				t.Fatal("hostile header accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if errors.Is(tt.want, encryption.ErrHeaderCorrupt) && !errors.Is(err, middleware.ErrHeaderCorrupt) {
+				t.Fatal("ErrHeaderCorrupt does not match middleware.ErrHeaderCorrupt")
+			}
+			if len(got) != 0 {
+				t.Fatalf("returned %d bytes of a hostile stream", len(got))
+			}
+		})
+	}
+	if seen.Len() != 0 {
+		t.Fatalf("hostile headers recorded %d tokens", seen.Len())
+	}
+	// the valid stream is still readable once
+	if _, err := decrypt(context.Background(), m, valid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthHeaderForgedEmptyStream(t *testing.T) {
+	key := newKey(t)
+	token := []byte("token of a stream")
+	fixedToken := encryption.WithReplayToken(func() ([]byte, error) { return token, nil })
+	id, err := middleware.NewBufferID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an empty stream has no DARE package, only the tag authenticates its
+	// header
+	forged := encrypt(t, middleware.WithBufferID(context.Background(), id),
+		encryption.New(encryption.WithKey(newKey(t)), fixedToken, encryption.WithValidFor(time.Hour)), nil)
+
+	seen := encryption.NewSeenSet()
+	m := encryption.New(encryption.WithKey(key), fixedToken, encryption.WithReplayCheck(seen.Check))
+	ctx := middleware.WithBufferID(context.Background(), middleware.BufferID{})
+	if _, err := decrypt(ctx, m, forged); !errors.Is(err, encryption.ErrHeaderNotAuthentic) {
+		t.Fatalf("got %v, want ErrHeaderNotAuthentic", err)
+	}
+	if seen.Len() != 0 {
+		t.Fatal("forged header recorded its token")
+	}
+	if got, _ := middleware.BufferIDFromContext(ctx); got == id {
+		t.Fatal("forged header recorded its buffer ID")
+	}
+
+	// the genuine stream with the token is still accepted, once
+	for _, data := range [][]byte{nil, []byte("data")} {
+		seen := encryption.NewSeenSet()
+		m := encryption.New(encryption.WithKey(key), fixedToken, encryption.WithReplayCheck(seen.Check))
+		enc := encrypt(t, context.Background(), m, data)
+		if got, err := decrypt(context.Background(), m, enc); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("got %q, %v", got, err)
+		}
+		if _, err := decrypt(context.Background(), m, enc); !errors.Is(err, encryption.ErrReplay) {
+			t.Fatalf("got %v, want ErrReplay", err)
+		}
+	}
+}
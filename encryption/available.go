@@ -0,0 +1,36 @@
+package encryption
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/cpu"
+)
+
+// Available reports whether the cipher suite is supported by this build
+func Available(cipherSuite byte) bool {
+	return supportedCipher(cipherSuite)
+}
+
+// HardwareAccelerated reports whether the cipher suite is supported by this
+// build and runs with hardware support on this machine. ChaCha20-Poly1305 is
+// fast in software and always reported as accelerated.
+func HardwareAccelerated(cipherSuite byte) bool {
+	if !supportedCipher(cipherSuite) {
+		return false
+	}
+	if cipherSuite == ChaCha20Poly1305 {
+		return true
+	}
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasGHASH
+	case "ppc64", "ppc64le":
+		return true
+	default:
+		return false
+	}
+}
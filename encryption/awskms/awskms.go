@@ -0,0 +1,106 @@
+// Package awskms implements envelope encryption with AWS KMS for the sealed
+// encryption middleware. Every stream gets its own data key from
+// GenerateDataKey; the CiphertextBlob is stored in the stream header and
+// readers recover the key with one Decrypt call. KMS ties the blob to the
+// key and to the optional encryption context, which also shows up in
+// CloudTrail for auditing.
+//
+// Client mirrors the three operations of the aws-sdk-go-v2 KMS client, so
+// an adapter only maps the input and output structs:
+//
+//	encryption.NewSealed(awskms.New(kmsClient{kms.NewFromConfig(cfg)}, "alias/hybridbuffer"))
+package awskms
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+// DefaultTimeout bounds every KMS call
+const DefaultTimeout = 10 * time.Second
+
+// Client is the subset of the AWS KMS API used by the sealer
+type Client interface {
+	// GenerateDataKey returns a new data key of size bytes in plaintext and
+	// encrypted under keyID
+	GenerateDataKey(ctx context.Context, keyID string, size int, encryptionContext map[string]string) (plaintext, ciphertextBlob []byte, err error)
+
+	// Encrypt encrypts plaintext under keyID
+	Encrypt(ctx context.Context, keyID string, plaintext []byte, encryptionContext map[string]string) ([]byte, error)
+
+	// Decrypt decrypts a ciphertext blob, which must be encrypted under keyID
+	Decrypt(ctx context.Context, keyID string, ciphertextBlob []byte, encryptionContext map[string]string) ([]byte, error)
+}
+
+// Sealer wraps stream keys with a KMS key
+type Sealer struct {
+	client  Client
+	keyID   string
+	context map[string]string
+	timeout time.Duration
+}
+
+// Ensure Sealer implements encryption.KeySealer and encryption.KeyGenerator interfaces
+var (
+	_ encryption.KeySealer    = (*Sealer)(nil)
+	_ encryption.KeyGenerator = (*Sealer)(nil)
+)
+
+// Option configures the sealer
+type Option func(*Sealer)
+
+// WithEncryptionContext sets the encryption context bound to every data
+// key. It is not stored in the stream, so readers must use the same one.
+func WithEncryptionContext(ec map[string]string) Option {
+	return func(s *Sealer) {
+		s.context = ec
+	}
+}
+
+// WithTimeout sets the timeout of every KMS call, DefaultTimeout by default
+func WithTimeout(d time.Duration) Option {
+	return func(s *Sealer) {
+		s.timeout = d
+	}
+}
+
+// New creates a sealer using the KMS key keyID, a key ID, ARN or alias
+func New(client Client, keyID string, opts ...Option) *Sealer {
+	s := &Sealer{client: client, keyID: keyID, timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// GenerateKey returns a data key from GenerateDataKey
+func (s *Sealer) GenerateKey(ctx context.Context, size int) ([]byte, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	key, blob, err := s.client.GenerateDataKey(ctx, s.keyID, size, s.context)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(blob) == 0 {
+		clear(key)
+		return nil, nil, errors.New("awskms: empty ciphertext blob")
+	}
+	return key, blob, nil
+}
+
+// Seal encrypts key with Encrypt
+func (s *Sealer) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.client.Encrypt(ctx, s.keyID, key, s.context)
+}
+
+// Unseal decrypts a ciphertext blob with Decrypt
+func (s *Sealer) Unseal(ctx context.Context, blob []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.client.Decrypt(ctx, s.keyID, blob, s.context)
+}
@@ -0,0 +1,120 @@
+// Package azurekv protects the stream keys of the sealed encryption
+// middleware with an Azure Key Vault key. Key Vault wraps each stream key;
+// the wrapped key and the key version are stored in the stream header, so
+// rotating the key in the vault keeps old streams readable.
+//
+// RESTClient calls the Key Vault REST API with tokens of the VM's managed
+// identity:
+//
+//	client := azurekv.NewRESTClient("https://myvault.vault.azure.net", azurekv.ManagedIdentity(""))
+//	encryption.NewSealed(azurekv.New(client, "hybridbuffer-kek"))
+//
+// Other credentials, e.g. workload identity on AKS, come from an azkeys
+// client adapted to Client, whose WrapKey returns resp.KID.Version().
+package azurekv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+// DefaultTimeout bounds every Key Vault call
+const DefaultTimeout = 10 * time.Second
+
+// Algorithm is a Key Vault key wrapping algorithm
+type Algorithm string
+
+// Key wrapping algorithms of RSA keys and of Managed HSM AES keys
+const (
+	RSAOAEP256 Algorithm = "RSA-OAEP-256"
+	RSAOAEP    Algorithm = "RSA-OAEP"
+	A256KW     Algorithm = "A256KW"
+)
+
+// Client is the subset of the Key Vault keys API used by the sealer
+type Client interface {
+	// WrapKey wraps key with a version of the key name, the latest one if
+	// version is empty, and returns the version used
+	WrapKey(ctx context.Context, name, version string, alg Algorithm, key []byte) (usedVersion string, wrapped []byte, err error)
+
+	// UnwrapKey unwraps a key wrapped by the given key version
+	UnwrapKey(ctx context.Context, name, version string, alg Algorithm, wrapped []byte) ([]byte, error)
+}
+
+// Sealer wraps stream keys with a Key Vault key
+type Sealer struct {
+	client  Client
+	name    string
+	version string
+	alg     Algorithm
+	timeout time.Duration
+}
+
+// Ensure Sealer implements encryption.KeySealer
+var _ encryption.KeySealer = (*Sealer)(nil)
+
+// Option configures the sealer
+type Option func(*Sealer)
+
+// WithAlgorithm sets the wrapping algorithm, RSAOAEP256 by default
+func WithAlgorithm(alg Algorithm) Option {
+	return func(s *Sealer) {
+		s.alg = alg
+	}
+}
+
+// WithKeyVersion pins the key version used for wrapping instead of the
+// latest one. Unwrapping always uses the version stored in the stream.
+func WithKeyVersion(version string) Option {
+	return func(s *Sealer) {
+		s.version = version
+	}
+}
+
+// WithTimeout sets the timeout of every Key Vault call, DefaultTimeout by default
+func WithTimeout(d time.Duration) Option {
+	return func(s *Sealer) {
+		s.timeout = d
+	}
+}
+
+// New creates a sealer using the Key Vault key name
+func New(client Client, name string, opts ...Option) *Sealer {
+	s := &Sealer{client: client, name: name, alg: RSAOAEP256, timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Seal wraps key and prefixes the wrapped key with the key version
+func (s *Sealer) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	version, wrapped, err := s.client.WrapKey(ctx, s.name, s.version, s.alg, key)
+	if err != nil {
+		return nil, err
+	}
+	if version == "" || len(version) > 255 {
+		return nil, fmt.Errorf("azurekv: invalid key version %q", version)
+	}
+	blob := make([]byte, 0, 1+len(version)+len(wrapped))
+	blob = append(blob, byte(len(version)))
+	blob = append(blob, version...)
+	return append(blob, wrapped...), nil
+}
+
+// Unseal unwraps a key sealed by Seal with the key version it names
+func (s *Sealer) Unseal(ctx context.Context, blob []byte) ([]byte, error) {
+	if len(blob) == 0 || len(blob) <= 1+int(blob[0]) {
+		return nil, errors.New("azurekv: invalid wrapped key")
+	}
+	version, wrapped := string(blob[1:1+blob[0]]), blob[1+blob[0]:]
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.client.UnwrapKey(ctx, s.name, version, s.alg, wrapped)
+}
@@ -0,0 +1,110 @@
+package azurekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeVault wraps keys by reversing them, the version is "v1"
+func fakeVault(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer mi-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"code":"Unauthorized","message":"no token"}}`)
+			return
+		}
+		var req keyOperation
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Alg != RSAOAEP256 {
+			t.Errorf("got algorithm %q", req.Alg)
+		}
+		value, _ := base64.RawURLEncoding.DecodeString(req.Value)
+		slices.Reverse(value)
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/") // keys, name, version, op
+		if op := parts[len(parts)-1]; op == "unwrapkey" && parts[2] != "v1" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"KeyNotFound","message":"unknown version"}}`)
+			return
+		}
+		json.NewEncoder(w).Encode(keyOperationResult{
+			KID:   "https://vault/keys/" + parts[1] + "/v1",
+			Value: base64.RawURLEncoding.EncodeToString(value),
+		})
+	}))
+}
+
+// fakeIMDS issues tokens valid for an hour and counts the requests
+func fakeIMDS(t *testing.T, requests *atomic.Int32) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != vaultResource {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request","error_description":"bad request"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token":"mi-token","expires_on":"%d"}`, time.Now().Add(time.Hour).Unix())
+	}))
+	t.Cleanup(srv.Close)
+	prev := imdsEndpoint
+	imdsEndpoint = srv.URL
+	t.Cleanup(func() { imdsEndpoint = prev })
+}
+
+func TestManagedIdentityRoundTrip(t *testing.T) {
+	var requests atomic.Int32
+	fakeIMDS(t, &requests)
+	vault := fakeVault(t)
+	defer vault.Close()
+
+	s := New(NewRESTClient(vault.URL, ManagedIdentity("")), "kek")
+	key := bytes.Repeat([]byte{1, 2, 3, 4}, 8)
+	blob, err := s.Seal(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(blob, []byte("\x02v1")) {
+		t.Fatalf("blob does not name the key version: %q", blob)
+	}
+	got, err := s.Unseal(context.Background(), blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Fatal("round trip mismatch")
+	}
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("got %d token requests, want the token cached", n)
+	}
+}
+
+func TestKeyVaultErrors(t *testing.T) {
+	vault := fakeVault(t)
+	defer vault.Close()
+
+	noToken := func(ctx context.Context) (string, time.Time, error) { return "wrong", time.Time{}, nil }
+	_, err := New(NewRESTClient(vault.URL, noToken), "kek").Seal(context.Background(), []byte("key"))
+	var kerr *Error
+	if !errors.As(err, &kerr) || kerr.StatusCode != http.StatusUnauthorized || kerr.Code != "Unauthorized" {
+		t.Fatalf("got %v, want an Unauthorized error", err)
+	}
+}
+
+func TestUnsealInvalidBlob(t *testing.T) {
+	s := New(nil, "kek")
+	for _, blob := range [][]byte{nil, {0}, {5, 'v', '1'}, {2, 'v', '1'}} {
+		if _, err := s.Unseal(context.Background(), blob); err == nil {
+			t.Fatalf("expected an error for %q", blob)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package azurekv
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// APIVersion is the Key Vault REST API version used by RESTClient
+const APIVersion = "7.4"
+
+// vaultResource is the resource managed identity tokens are requested for
+const vaultResource = "https://vault.azure.net"
+
+// imdsEndpoint is the token endpoint of the instance metadata service
+var imdsEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// tokenSlack is the time before expiry a cached token is replaced
+const tokenSlack = 5 * time.Minute
+
+// TokenSource returns an OAuth2 access token for Key Vault and its expiry
+type TokenSource func(ctx context.Context) (token string, expires time.Time, err error)
+
+// Error is returned for requests rejected by Key Vault or the instance
+// metadata service
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("azurekv: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("azurekv: status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// ManagedIdentity returns a TokenSource for the managed identity of the
+// Azure VM, scale set or container instance the process runs on, fetched
+// from the instance metadata service. clientID selects a user-assigned
+// identity; the system-assigned one is used if it is empty. Tokens are
+// cached until five minutes before they expire.
+func ManagedIdentity(clientID string) TokenSource {
+	var (
+		mu      sync.Mutex
+		token   string
+		expires time.Time
+	)
+	return func(ctx context.Context) (string, time.Time, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if token != "" && time.Until(expires) > tokenSlack {
+			return token, expires, nil
+		}
+		t, exp, err := fetchIMDSToken(ctx, clientID)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		token, expires = t, exp
+		return token, expires, nil
+	}
+}
+
+// fetchIMDSToken requests a Key Vault token from the instance metadata service
+func fetchIMDSToken(ctx context.Context, clientID string) (string, time.Time, error) {
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {vaultResource}}
+	if clientID != "" {
+		q.Set("client_id", clientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imdsEndpoint+"?"+q.Encode(), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata", "true")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := doJSON(http.DefaultClient, req, &resp); err != nil {
+		return "", time.Time{}, err
+	}
+	exp, err := strconv.ParseInt(resp.ExpiresOn, 10, 64)
+	if err != nil || resp.AccessToken == "" {
+		return "", time.Time{}, errors.New("azurekv: managed identity: invalid token response")
+	}
+	return resp.AccessToken, time.Unix(exp, 0), nil
+}
+
+// RESTClient is a Client calling the Key Vault REST API directly, for
+// deployments that do not use the Azure SDK
+type RESTClient struct {
+	vault  string
+	tokens TokenSource
+	client *http.Client
+}
+
+// Ensure RESTClient implements Client
+var _ Client = (*RESTClient)(nil)
+
+// ClientOption configures a RESTClient
+type ClientOption func(*RESTClient)
+
+// WithHTTPClient sets the HTTP client of Key Vault requests,
+// http.DefaultClient by default
+func WithHTTPClient(c *http.Client) ClientOption {
+	return func(r *RESTClient) {
+		r.client = c
+	}
+}
+
+// NewRESTClient creates a client for the vault at vaultURL, e.g.
+// "https://myvault.vault.azure.net", authenticating with tokens from
+// tokens, e.g. ManagedIdentity
+func NewRESTClient(vaultURL string, tokens TokenSource, opts ...ClientOption) *RESTClient {
+	r := &RESTClient{vault: strings.TrimRight(vaultURL, "/"), tokens: tokens, client: http.DefaultClient}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+type keyOperation struct {
+	Alg   Algorithm `json:"alg"`
+	Value string    `json:"value"`
+}
+
+type keyOperationResult struct {
+	KID   string `json:"kid"`
+	Value string `json:"value"`
+}
+
+// WrapKey calls the wrapkey operation of the key, the version used is
+// taken from the key ID of the result
+func (r *RESTClient) WrapKey(ctx context.Context, name, version string, alg Algorithm, key []byte) (string, []byte, error) {
+	kid, wrapped, err := r.keyOperation(ctx, name, version, "wrapkey", alg, key)
+	if err != nil {
+		return "", nil, err
+	}
+	return path.Base(kid), wrapped, nil
+}
+
+// UnwrapKey calls the unwrapkey operation of the key version
+func (r *RESTClient) UnwrapKey(ctx context.Context, name, version string, alg Algorithm, wrapped []byte) ([]byte, error) {
+	_, key, err := r.keyOperation(ctx, name, version, "unwrapkey", alg, wrapped)
+	return key, err
+}
+
+// keyOperation calls a key operation and returns the key ID and the value
+// of the result
+func (r *RESTClient) keyOperation(ctx context.Context, name, version, op string, alg Algorithm, value []byte) (string, []byte, error) {
+	token, _, err := r.tokens(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	body, err := json.Marshal(keyOperation{Alg: alg, Value: base64.RawURLEncoding.EncodeToString(value)})
+	if err != nil {
+		return "", nil, err
+	}
+	u := fmt.Sprintf("%s/keys/%s/%s/%s?api-version=%s", r.vault, url.PathEscape(name), url.PathEscape(version), op, APIVersion)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	var res keyOperationResult
+	if err := doJSON(r.client, req, &res); err != nil {
+		return "", nil, err
+	}
+	out, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(res.Value, "="))
+	if err != nil || len(out) == 0 {
+		return "", nil, fmt.Errorf("azurekv: invalid %s result", op)
+	}
+	return res.KID, out, nil
+}
+
+// doJSON sends req and decodes the JSON response into out
+func doJSON(c *http.Client, req *http.Request, out any) error {
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("azurekv: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("azurekv: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		kerr := &Error{StatusCode: resp.StatusCode}
+		// Key Vault nests the error, the metadata service uses OAuth2 errors
+		var kv struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		var oauth struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(data, &kv) == nil {
+			kerr.Code, kerr.Message = kv.Error.Code, kv.Error.Message
+		} else if json.Unmarshal(data, &oauth) == nil {
+			kerr.Code, kerr.Message = oauth.Error, oauth.Description
+		}
+		return kerr
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("azurekv: invalid response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Package breaker provides a circuit breaker around remote key services.
+//
+// When a KMS, Vault or HSM backend is down, every spill would otherwise wait
+// for its own timeout. The breaker counts consecutive failures and, once the
+// threshold is reached, fails fast with an *OpenError until a cooldown has
+// passed. A single probe call is then let through to test recovery.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+const (
+	// DefaultFailureThreshold is the default number of consecutive failures opening the circuit
+	DefaultFailureThreshold = 5
+
+	// DefaultCooldown is the default time the circuit stays open
+	DefaultCooldown = 30 * time.Second
+)
+
+var (
+	// ErrCircuitOpen matches every *OpenError via errors.Is
+	ErrCircuitOpen = errors.New("breaker: circuit open")
+
+	// ErrTimeout is returned when a call exceeds the configured timeout
+	ErrTimeout = errors.New("breaker: call timed out")
+)
+
+// OpenError is returned while the circuit is open
+type OpenError struct {
+	RetryAt time.Time // time the next probe call is allowed
+	LastErr error     // error that opened the circuit
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("breaker: circuit open until %s: %v", e.RetryAt.Format(time.RFC3339), e.LastErr)
+}
+
+// Is reports whether target is ErrCircuitOpen
+func (e *OpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// Unwrap returns the error that opened the circuit
+func (e *OpenError) Unwrap() error {
+	return e.LastErr
+}
+
+// State is the state of the circuit
+type State int
+
+const (
+	Closed   State = iota // calls pass through
+	Open                  // calls fail fast
+	HalfOpen              // one probe call is in flight
+)
+
+// String returns the name of the state
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+}
+
+// Breaker is an encryption.KeySealer guarding another KeySealer
+type Breaker struct {
+	sealer    encryption.KeySealer
+	threshold int
+	cooldown  time.Duration
+	timeout   time.Duration
+	stale     func(wrapped []byte) ([]byte, bool)
+	onState   func(State)
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	lastErr  error
+}
+
+// Ensure Breaker implements encryption.KeySealer interface
+var _ encryption.KeySealer = (*Breaker)(nil)
+
+// Option configures the breaker
+type Option func(*Breaker)
+
+// WithFailureThreshold sets the number of consecutive failures opening the circuit
+func WithFailureThreshold(n int) Option {
+	return func(b *Breaker) {
+		if n > 0 {
+			b.threshold = n
+		}
+	}
+}
+
+// WithCooldown sets how long the circuit stays open before a probe is allowed
+func WithCooldown(d time.Duration) Option {
+	return func(b *Breaker) {
+		if d > 0 {
+			b.cooldown = d
+		}
+	}
+}
+
+// WithTimeout bounds every call to the underlying sealer. A call exceeding
+// it returns ErrTimeout and counts as failure; its context is canceled, and
+// a sealer ignoring that keeps running in the background.
+func WithTimeout(d time.Duration) Option {
+	return func(b *Breaker) {
+		b.timeout = d
+	}
+}
+
+// WithStaleFallback serves unwraps from fn while the circuit is open,
+// typically (*keycache.Cache).Stale
+func WithStaleFallback(fn func(wrapped []byte) ([]byte, bool)) Option {
+	return func(b *Breaker) {
+		b.stale = fn
+	}
+}
+
+// WithStateCallback registers a function called on every state change.
+// It runs while the breaker is locked and must not call back into it.
+func WithStateCallback(fn func(State)) Option {
+	return func(b *Breaker) {
+		b.onState = fn
+	}
+}
+
+// WithClock sets the time source, for tests
+func WithClock(now func() time.Time) Option {
+	return func(b *Breaker) {
+		b.now = now
+	}
+}
+
+// New creates a circuit breaker in front of sealer
+func New(sealer encryption.KeySealer, opts ...Option) *Breaker {
+	b := &Breaker{
+		sealer:    sealer,
+		threshold: DefaultFailureThreshold,
+		cooldown:  DefaultCooldown,
+		now:       time.Now,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// State returns the current state of the circuit
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Seal wraps key with the underlying sealer unless the circuit is open
+func (b *Breaker) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	return b.do(ctx, func(ctx context.Context) ([]byte, error) { return b.sealer.Seal(ctx, key) })
+}
+
+// Unseal unwraps with the underlying sealer unless the circuit is open, in
+// which case the stale fallback is consulted before failing fast
+func (b *Breaker) Unseal(ctx context.Context, wrapped []byte) ([]byte, error) {
+	key, err := b.do(ctx, func(ctx context.Context) ([]byte, error) { return b.sealer.Unseal(ctx, wrapped) })
+	if err != nil && b.stale != nil && errors.Is(err, ErrCircuitOpen) {
+		if key, ok := b.stale(wrapped); ok {
+			return key, nil
+		}
+	}
+	return key, err
+}
+
+func (b *Breaker) do(ctx context.Context, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+	out, err := b.call(ctx, fn)
+	if err != nil && ctx.Err() != nil {
+		// canceled by the caller, which says nothing about the backend
+		b.abandon()
+		return out, err
+	}
+	b.record(err)
+	return out, err
+}
+
+func (b *Breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case Open:
+		retryAt := b.openedAt.Add(b.cooldown)
+		if b.now().Before(retryAt) {
+			return &OpenError{RetryAt: retryAt, LastErr: b.lastErr}
+		}
+		b.setState(HalfOpen)
+		return nil
+	case HalfOpen:
+		return &OpenError{RetryAt: b.now(), LastErr: b.lastErr}
+	default:
+		return nil
+	}
+}
+
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.failures = 0
+		b.lastErr = nil
+		b.setState(Closed)
+		return
+	}
+	b.failures++
+	b.lastErr = err
+	if b.state == HalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(Open)
+	}
+}
+
+// abandon ends a call without a result, letting the next call probe again
+// if it was the probe
+func (b *Breaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == HalfOpen {
+		b.setState(Open)
+	}
+}
+
+func (b *Breaker) setState(s State) {
+	if b.state == s {
+		return
+	}
+	b.state = s
+	if b.onState != nil {
+		b.onState(s)
+	}
+}
+
+func (b *Breaker) call(ctx context.Context, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	if b.timeout <= 0 {
+		return fn(ctx)
+	}
+	type result struct {
+		out []byte
+		err error
+	}
+	callCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan result, 1)
+	go func() {
+		out, err := fn(callCtx)
+		done <- result{out, err}
+	}()
+	timer := time.NewTimer(b.timeout)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return res.out, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
@@ -0,0 +1,224 @@
+package breaker_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/encryption/breaker"
+	"schneider.vip/hybridbuffer/middleware/encryption/keycache"
+)
+
+var errDown = errors.New("kms down")
+
+// flakySealer fails while down is set and blocks each call for delay,
+// reporting calls canceled while blocked to canceled
+type flakySealer struct {
+	down     bool
+	delay    time.Duration
+	calls    int
+	canceled chan error
+}
+
+func (s *flakySealer) wait(ctx context.Context) error {
+	s.calls++
+	timer := time.NewTimer(s.delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		if s.canceled != nil {
+			s.canceled <- ctx.Err()
+		}
+		return ctx.Err()
+	case <-timer.C:
+	}
+	if s.down {
+		return errDown
+	}
+	return nil
+}
+
+func (s *flakySealer) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return append([]byte("sealed:"), key...), nil
+}
+
+func (s *flakySealer) Unseal(ctx context.Context, sealed []byte) ([]byte, error) {
+	if err := s.wait(ctx); err != nil {
+		return nil, err
+	}
+	return bytes.TrimPrefix(sealed, []byte("sealed:")), nil
+}
+
+func TestBreakerStates(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	s := &flakySealer{down: true}
+	var states []breaker.State
+	b := breaker.New(s,
+		breaker.WithFailureThreshold(3),
+		breaker.WithCooldown(time.Minute),
+		breaker.WithClock(func() time.Time { return now }),
+		breaker.WithStateCallback(func(st breaker.State) { states = append(states, st) }),
+	)
+
+	for i := 0; i < 3; i++ {
+		if _, err := b.Seal(ctx, []byte("k")); !errors.Is(err, errDown) {
+			t.Fatalf("call %d: got %v, want errDown", i, err)
+		}
+	}
+	if b.State() != breaker.Open {
+		t.Fatalf("state %s after 3 failures", b.State())
+	}
+
+	// open: fails fast without calling the sealer
+	_, err := b.Unseal(ctx, []byte("sealed:k"))
+	var open *breaker.OpenError
+	if !errors.As(err, &open) || !errors.Is(err, breaker.ErrCircuitOpen) || !errors.Is(err, errDown) {
+		t.Fatalf("got %v, want an OpenError wrapping errDown", err)
+	}
+	if !open.RetryAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("retry at %v", open.RetryAt)
+	}
+	if s.calls != 3 {
+		t.Fatalf("sealer called %d times", s.calls)
+	}
+
+	// after the cooldown a failing probe opens the circuit again at once
+	now = now.Add(time.Minute)
+	if _, err := b.Seal(ctx, []byte("k")); !errors.Is(err, errDown) {
+		t.Fatalf("probe: got %v, want errDown", err)
+	}
+	if b.State() != breaker.Open {
+		t.Fatalf("state %s after failed probe", b.State())
+	}
+
+	// a successful probe closes it
+	now = now.Add(time.Minute)
+	s.down = false
+	if key, err := b.Unseal(ctx, []byte("sealed:k")); err != nil || string(key) != "k" {
+		t.Fatalf("got %q, %v", key, err)
+	}
+	want := []breaker.State{breaker.Open, breaker.HalfOpen, breaker.Open, breaker.HalfOpen, breaker.Closed}
+	if len(states) != len(want) {
+		t.Fatalf("states %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states %v, want %v", states, want)
+		}
+	}
+}
+
+func TestBreakerResetsOnSuccess(t *testing.T) {
+	ctx := context.Background()
+	s := &flakySealer{}
+	b := breaker.New(s, breaker.WithFailureThreshold(2))
+	// failures must be consecutive to open the circuit
+	for i := 0; i < 4; i++ {
+		s.down = i%2 == 0
+		b.Seal(ctx, []byte("k"))
+	}
+	if b.State() != breaker.Closed {
+		t.Fatalf("state %s, want closed", b.State())
+	}
+}
+
+func TestBreakerHalfOpenAllowsOneProbe(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	s := &flakySealer{down: true}
+	b := breaker.New(s, breaker.WithFailureThreshold(1), breaker.WithClock(func() time.Time { return now }))
+	b.Seal(ctx, []byte("k"))
+	now = now.Add(breaker.DefaultCooldown)
+
+	s.down = false
+	s.delay = 50 * time.Millisecond
+	probe := make(chan error)
+	go func() {
+		_, err := b.Seal(ctx, []byte("probe"))
+		probe <- err
+	}()
+	for b.State() != breaker.HalfOpen {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := b.Seal(ctx, []byte("k")); !errors.Is(err, breaker.ErrCircuitOpen) {
+		t.Fatalf("second call while half-open: got %v, want ErrCircuitOpen", err)
+	}
+	if err := <-probe; err != nil {
+		t.Fatal(err)
+	}
+	if b.State() != breaker.Closed {
+		t.Fatalf("state %s after successful probe", b.State())
+	}
+}
+
+func TestBreakerTimeout(t *testing.T) {
+	ctx := context.Background()
+	s := &flakySealer{delay: time.Second, canceled: make(chan error, 1)}
+	b := breaker.New(s, breaker.WithTimeout(10*time.Millisecond), breaker.WithFailureThreshold(1))
+	start := time.Now()
+	if _, err := b.Seal(ctx, []byte("k")); !errors.Is(err, breaker.ErrTimeout) {
+		t.Fatalf("got %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Fatalf("timed out after %v", d)
+	}
+	if b.State() != breaker.Open {
+		t.Fatalf("state %s, a timeout must count as failure", b.State())
+	}
+	select {
+	case <-s.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("call not canceled after the timeout")
+	}
+}
+
+func TestBreakerCallerCancels(t *testing.T) {
+	s := &flakySealer{delay: time.Second}
+	b := breaker.New(s, breaker.WithTimeout(time.Minute), breaker.WithFailureThreshold(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.Seal(ctx, []byte("k")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	// the caller gave up, the backend did not fail
+	if b.State() != breaker.Closed {
+		t.Fatalf("state %s after a canceled call", b.State())
+	}
+}
+
+func TestBreakerStaleFallback(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	s := &flakySealer{}
+	cache, err := keycache.New(s, keycache.WithTTL(time.Minute), keycache.WithMaxStale(time.Hour), keycache.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := breaker.New(cache, breaker.WithFailureThreshold(1), breaker.WithClock(clock), breaker.WithStaleFallback(cache.Stale))
+	wrapped, err := b.Seal(ctx, []byte("cached key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	s.down = true
+	if _, err := b.Unseal(ctx, wrapped); !errors.Is(err, errDown) {
+		t.Fatalf("got %v, want errDown", err)
+	}
+	// the circuit is open now, the expired entry is served instead of failing
+	key, err := b.Unseal(ctx, wrapped)
+	if err != nil || string(key) != "cached key" {
+		t.Fatalf("got %q, %v", key, err)
+	}
+	// unknown keys still fail fast
+	if _, err := b.Unseal(ctx, []byte("sealed:other")); !errors.Is(err, breaker.ErrCircuitOpen) {
+		t.Fatalf("got %v, want ErrCircuitOpen", err)
+	}
+}
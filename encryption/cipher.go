@@ -0,0 +1,26 @@
+//go:build !tinygo && !hbmw_tiny
+
+package encryption
+
+import "github.com/minio/sio"
+
+// Cipher suites supported by the middleware
+const (
+	AES256GCM        = sio.AES_256_GCM
+	ChaCha20Poly1305 = sio.CHACHA20_POLY1305
+)
+
+// defaultCipher is used if no cipher suite is configured
+const defaultCipher = AES256GCM
+
+func supportedCipher(c byte) bool {
+	return c == AES256GCM || c == ChaCha20Poly1305
+}
+
+// readCipherSuites returns the suites accepted when decrypting, preferring the configured one
+func readCipherSuites(preferred byte) []byte {
+	if preferred == ChaCha20Poly1305 {
+		return []byte{ChaCha20Poly1305, AES256GCM}
+	}
+	return []byte{AES256GCM, ChaCha20Poly1305}
+}
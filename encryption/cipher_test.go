@@ -0,0 +1,8 @@
+//go:build !tinygo && !hbmw_tiny
+
+package encryption_test
+
+import "schneider.vip/hybridbuffer/middleware/encryption"
+
+// cipherSuites are the cipher suites of the build
+var cipherSuites = []byte{encryption.AES256GCM, encryption.ChaCha20Poly1305}
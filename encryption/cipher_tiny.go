@@ -0,0 +1,22 @@
+//go:build tinygo || hbmw_tiny
+
+package encryption
+
+import "github.com/minio/sio"
+
+// The minimal profile (TinyGo, or the hbmw_tiny build tag) only supports
+// ChaCha20-Poly1305, which needs no AES hardware support. AES256GCM is not
+// defined in this profile so configurations using it fail at compile time.
+const ChaCha20Poly1305 = sio.CHACHA20_POLY1305
+
+// defaultCipher is used if no cipher suite is configured
+const defaultCipher = ChaCha20Poly1305
+
+func supportedCipher(c byte) bool {
+	return c == ChaCha20Poly1305
+}
+
+// readCipherSuites returns the suites accepted when decrypting
+func readCipherSuites(byte) []byte {
+	return []byte{ChaCha20Poly1305}
+}
@@ -0,0 +1,31 @@
+package encryption
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/minio/sio"
+)
+
+// CipherName returns the canonical name of a cipher suite
+func CipherName(cipherSuite byte) string {
+	switch cipherSuite {
+	case sio.AES_256_GCM:
+		return "aes-256-gcm"
+	case sio.CHACHA20_POLY1305:
+		return "chacha20-poly1305"
+	default:
+		return fmt.Sprintf("cipher(%#x)", cipherSuite)
+	}
+}
+
+// ParseCipher returns the cipher suite for a name as returned by CipherName.
+// It fails for suites that are not available in this build.
+func ParseCipher(name string) (byte, error) {
+	for _, suite := range []byte{sio.AES_256_GCM, sio.CHACHA20_POLY1305} {
+		if strings.EqualFold(name, CipherName(suite)) && supportedCipher(suite) {
+			return suite, nil
+		}
+	}
+	return 0, fmt.Errorf("encryption: unsupported cipher %q", name)
+}
@@ -0,0 +1,435 @@
+// Package ctrhmac provides a streaming encrypt-then-MAC mode of AES-256-CTR
+// and HMAC-SHA256, for older decryptors that only have these primitives
+// and cannot consume the DARE format of the encryption middleware.
+//
+// A stream starts with a header of 24 bytes:
+//
+//	"HBL" | version (1) | segment size (uint32, big endian) | IV (16)
+//
+// followed by the ciphertext in segments of segment size bytes, each
+// followed by a 32 byte tag. The last segment may be shorter, it is only
+// empty for an empty stream. The whole ciphertext is a single AES-CTR key
+// stream starting at the IV, the 128 bit counter block incrementing per
+// AES block. The tag of a segment is
+//
+//	HMAC-SHA256(mac key, header | index (uint64, big endian) | final (1) | ciphertext)
+//
+// with final being 1 for the last segment and 0 otherwise, so reordered,
+// dropped and appended segments are detected. The key is 64 bytes, the
+// first half keys AES-256, the second half HMAC-SHA256.
+//
+// Readers verify every segment before releasing its plaintext.
+package ctrhmac
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// FormatVersion is the header format version of CTR-HMAC streams
+const FormatVersion = 1
+
+var magic = [3]byte{'H', 'B', 'L'}
+
+const (
+	// KeySize is the size of the key, an AES-256 key followed by an HMAC key
+	KeySize = 64
+
+	// DefaultSegmentSize is the default size of authenticated segments
+	DefaultSegmentSize = 64 << 10
+
+	// MaxSegmentSize is the largest segment size Readers accept
+	MaxSegmentSize = 16 << 20
+
+	minSegmentSize = 1 << 10
+
+	ivSize     = aes.BlockSize
+	tagSize    = sha256.Size
+	headerSize = len(magic) + 1 + 4 + ivSize
+)
+
+func init() {
+	middleware.RegisterFormat("ctrhmac-header", func(p []byte) (string, int, bool) {
+		if len(p) < headerSize || [3]byte(p[:3]) != magic {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, segment size %d, iv %x", p[3], binary.BigEndian.Uint32(p[4:8]), p[8:headerSize]), headerSize, true
+	})
+}
+
+var (
+	// ErrInvalidKeySize is returned by NewE for keys that are not KeySize bytes long
+	ErrInvalidKeySize = errors.New("ctrhmac: key must be 64 bytes")
+
+	// ErrNotAuthentic is returned by Readers for modified, truncated or
+	// foreign streams
+	ErrNotAuthentic = errors.New("ctrhmac: message authentication failed")
+)
+
+// Middleware encrypts streams with AES-256-CTR and authenticates them with
+// HMAC-SHA256
+type Middleware struct {
+	block   cipher.Block
+	macKey  []byte
+	segment int
+	rand    io.Reader
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware     = (*Middleware)(nil)
+	_ middleware.Roled          = (*Middleware)(nil)
+	_ middleware.Describer      = (*Middleware)(nil)
+	_ middleware.MemoryUser     = (*Middleware)(nil)
+	_ middleware.MemoryShrinker = (*Middleware)(nil)
+)
+
+// Option configures the middleware
+type Option func(*Middleware)
+
+// WithSegmentSize sets the size of the authenticated segments written,
+// DefaultSegmentSize by default. Readers take it from the header. Sizes
+// outside 1 to MaxSegmentSize are ignored.
+func WithSegmentSize(n int) Option {
+	return func(m *Middleware) {
+		if n > 0 && n <= MaxSegmentSize {
+			m.segment = n
+		}
+	}
+}
+
+// WithRand sets the source of IVs. By default middleware.Rand() is used.
+func WithRand(r io.Reader) Option {
+	return func(m *Middleware) {
+		m.rand = r
+	}
+}
+
+// New creates a CTR-HMAC middleware with a KeySize byte key. New panics
+// if the key has an invalid size.
+func New(key []byte, opts ...Option) *Middleware {
+	m, err := NewE(key, opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return m
+}
+
+// NewE is like New, but returns ErrInvalidKeySize instead of panicking
+func NewE(key []byte, opts ...Option) (*Middleware, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("%w, got %d", ErrInvalidKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	m := &Middleware{
+		block:   block,
+		macKey:  append([]byte(nil), key[32:]...),
+		segment: DefaultSegmentSize,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.rand == nil {
+		m.rand = middleware.Rand()
+	}
+	return m, nil
+}
+
+// Role returns middleware.RoleEncryption
+func (m *Middleware) Role() middleware.Role { return middleware.RoleEncryption }
+
+// Describe reports the cipher, MAC and segment size
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:      string(middleware.RoleEncryption),
+		Algorithm: "aes-256-ctr",
+		KeyBits:   256,
+		Integrity: "hmac-sha256",
+		Properties: map[string]string{
+			"format":         "hb-ctr-hmac",
+			"key_management": "static",
+			"segment_size":   fmt.Sprint(m.segment),
+		},
+	}
+}
+
+// MemoryUsage estimates the memory of a Writer or Reader, two segment
+// buffers. Readers allocate by the segment size in the stream header.
+func (m *Middleware) MemoryUsage() int64 {
+	return int64(2 * (m.segment + tagSize))
+}
+
+// ForMemory returns a copy writing segments small enough for budget.
+// Smaller segments only add tag overhead, Readers of any configuration
+// read them.
+func (m *Middleware) ForMemory(budget int64) (middleware.Middleware, bool) {
+	if m.MemoryUsage() <= budget {
+		return m, true
+	}
+	segment := budget/2 - tagSize
+	if segment < minSegmentSize {
+		return nil, false
+	}
+	c := *m
+	c.segment = int(segment)
+	return &c, true
+}
+
+// segmentMAC computes segment tags of one stream
+type segmentMAC struct {
+	mac   hash.Hash
+	hdr   []byte
+	index uint64
+}
+
+// tag returns the tag of the next segment
+func (s *segmentMAC) tag(ciphertext []byte, final bool) []byte {
+	var buf [9]byte
+	binary.BigEndian.PutUint64(buf[:8], s.index)
+	if final {
+		buf[8] = 1
+	}
+	s.index++
+	s.mac.Reset()
+	s.mac.Write(s.hdr)
+	s.mac.Write(buf[:])
+	s.mac.Write(ciphertext)
+	return s.mac.Sum(nil)
+}
+
+// Writer encrypts to w. Closing it writes the last segment; it does not
+// close w.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return &writer{m: m, w: w, state: middleware.WriterState{Layer: "ctrhmac"}}
+}
+
+type writer struct {
+	m       *Middleware
+	w       io.Writer
+	ctr     cipher.Stream
+	mac     *segmentMAC
+	buf     []byte // ciphertext of the current segment
+	started bool
+	state   middleware.WriterState
+}
+
+// start writes the header
+func (w *writer) start() error {
+	w.started = true
+	hdr := make([]byte, headerSize)
+	copy(hdr, magic[:])
+	hdr[len(magic)] = FormatVersion
+	binary.BigEndian.PutUint32(hdr[4:8], uint32(w.m.segment))
+	if _, err := io.ReadFull(w.m.rand, hdr[8:]); err != nil {
+		return fmt.Errorf("ctrhmac: failed to generate IV: %w", err)
+	}
+	w.ctr = cipher.NewCTR(w.m.block, hdr[8:])
+	w.mac = &segmentMAC{mac: hmac.New(sha256.New, w.m.macKey), hdr: hdr}
+	w.buf = make([]byte, 0, w.m.segment+tagSize)
+	_, err := w.w.Write(hdr)
+	return err
+}
+
+// flush writes the current segment with its tag
+func (w *writer) flush(final bool) error {
+	w.buf = append(w.buf, w.mac.tag(w.buf, final)...)
+	_, err := w.w.Write(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if !w.started {
+		if err := w.start(); err != nil {
+			return 0, w.state.Fail(err)
+		}
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full segment is written once more data follows, the last one on Close
+		if len(w.buf) == w.m.segment {
+			if err := w.flush(false); err != nil {
+				return written, w.state.Fail(err)
+			}
+		}
+		n := min(len(p), w.m.segment-len(w.buf))
+		seg := w.buf[len(w.buf) : len(w.buf)+n]
+		w.ctr.XORKeyStream(seg, p[:n])
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Ensure writer implements middleware.OwnedWriter
+var _ middleware.OwnedWriter = (*writer)(nil)
+
+// WriteOwned is like Write, but encrypts whole segments of p in place
+// instead of copying them into the segment buffer, see
+// middleware.OwnedWriter
+func (w *writer) WriteOwned(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if !w.started {
+		if err := w.start(); err != nil {
+			return 0, w.state.Fail(err)
+		}
+	}
+	written := 0
+	if len(w.buf) > 0 && len(w.buf) < w.m.segment {
+		n, err := w.Write(p[:min(len(p), w.m.segment-len(w.buf))])
+		if err != nil {
+			return n, err
+		}
+		p = p[n:]
+		written += n
+	}
+	// the last segment stays buffered, it is written on Close
+	for len(p) > w.m.segment {
+		if len(w.buf) == w.m.segment {
+			if err := w.flush(false); err != nil {
+				return written, w.state.Fail(err)
+			}
+		}
+		seg := p[:w.m.segment]
+		w.ctr.XORKeyStream(seg, seg)
+		tag := w.mac.tag(seg, false)
+		if _, err := middleware.WriteOwned(w.w, seg); err != nil {
+			return written, w.state.Fail(err)
+		}
+		if _, err := w.w.Write(tag); err != nil {
+			return written, w.state.Fail(err)
+		}
+		p = p[w.m.segment:]
+		written += w.m.segment
+	}
+	n, err := w.Write(p)
+	return written + n, err
+}
+
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if !w.started {
+			if err := w.start(); err != nil {
+				return err
+			}
+		}
+		return w.flush(true)
+	})
+}
+
+// Reader decrypts r, releasing each segment once its tag was verified
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return &reader{m: m, src: r, state: middleware.ReaderState{Layer: "ctrhmac"}}
+}
+
+type reader struct {
+	m     *Middleware
+	src   io.Reader
+	br    *bufio.Reader
+	ctr   cipher.Stream
+	mac   *segmentMAC
+	seg   []byte // buffer of a segment and its tag
+	plain []byte // unread plaintext of the current segment
+	last  bool
+	state middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	if r.ctr == nil {
+		if err := r.start(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	for len(r.plain) == 0 {
+		if r.last {
+			return r.state.Track(0, io.EOF)
+		}
+		if err := r.next(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return r.state.Track(n, nil)
+}
+
+// start reads and checks the header
+func (r *reader) start() error {
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(r.src, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: truncated header", ErrNotAuthentic)
+		}
+		return err
+	}
+	if [3]byte(hdr[:3]) != magic {
+		return errors.New("ctrhmac: not a CTR-HMAC stream")
+	}
+	if _, err := middleware.CheckVersion("ctrhmac", hdr[3], FormatVersion, middleware.RejectUnknown); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(hdr[4:8])
+	if size == 0 || size > MaxSegmentSize {
+		return fmt.Errorf("ctrhmac: invalid segment size %d", size)
+	}
+	r.br = bufio.NewReaderSize(r.src, int(size)+tagSize)
+	r.ctr = cipher.NewCTR(r.m.block, hdr[8:])
+	r.mac = &segmentMAC{mac: hmac.New(sha256.New, r.m.macKey), hdr: hdr}
+	r.seg = make([]byte, int(size)+tagSize)
+	return nil
+}
+
+// next reads, verifies and decrypts the next segment
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.br, r.seg)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		_, err := r.br.Peek(1)
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if n < tagSize {
+		return fmt.Errorf("%w: truncated segment", ErrNotAuthentic)
+	}
+	ciphertext, tag := r.seg[:n-tagSize], r.seg[n-tagSize:n]
+	if !hmac.Equal(tag, r.mac.tag(ciphertext, last)) {
+		return ErrNotAuthentic
+	}
+	// only the payload of an empty stream ends with an empty segment
+	if last && len(ciphertext) == 0 && r.mac.index > 1 {
+		return fmt.Errorf("%w: empty last segment", ErrNotAuthentic)
+	}
+	r.ctr.XORKeyStream(ciphertext, ciphertext)
+	r.plain, r.last = ciphertext, last
+	return nil
+}
@@ -0,0 +1,121 @@
+package ctrhmac_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/encryption/ctrhmac"
+)
+
+const segment = 1024
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, ctrhmac.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, m *ctrhmac.Middleware, data []byte, owned bool) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	var err error
+	if owned {
+		_, err = middleware.WriteOwned(w, bytes.Clone(data))
+	} else {
+		_, err = w.Write(data)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := ctrhmac.New(newKey(t), ctrhmac.WithSegmentSize(segment))
+	for _, size := range []int{0, 1, segment - 1, segment, 3 * segment, 3*segment + 17} {
+		for _, owned := range []bool{false, true} {
+			data := make([]byte, size)
+			rand.Read(data)
+			got, err := io.ReadAll(m.Reader(bytes.NewReader(encrypt(t, m, data, owned))))
+			if err != nil {
+				t.Fatalf("size %d, owned %v: %v", size, owned, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("size %d, owned %v: round trip mismatch", size, owned)
+			}
+		}
+	}
+}
+
+func TestSegmentLayout(t *testing.T) {
+	m := ctrhmac.New(newKey(t), ctrhmac.WithSegmentSize(segment))
+	enc := encrypt(t, m, make([]byte, 2*segment+10), false)
+	if want := 24 + 2*(segment+32) + 10 + 32; len(enc) != want {
+		t.Fatalf("got %d bytes, want %d", len(enc), want)
+	}
+	if string(enc[:3]) != "HBL" || enc[3] != ctrhmac.FormatVersion || binary.BigEndian.Uint32(enc[4:8]) != segment {
+		t.Fatalf("unexpected header %x", enc[:24])
+	}
+}
+
+func TestHostileStreams(t *testing.T) {
+	key := newKey(t)
+	m := ctrhmac.New(key, ctrhmac.WithSegmentSize(segment))
+	data := make([]byte, 3*segment)
+	rand.Read(data)
+	enc := encrypt(t, m, data, false)
+	seg := segment + 32
+
+	modify := func(fn func(b []byte) []byte) []byte { return fn(bytes.Clone(enc)) }
+	tests := map[string][]byte{
+		"empty":                nil,
+		"truncated header":     enc[:10],
+		"bad magic":            modify(func(b []byte) []byte { b[0] = 'X'; return b }),
+		"unknown version":      modify(func(b []byte) []byte { b[3] = 99; return b }),
+		"zero segment size":    modify(func(b []byte) []byte { binary.BigEndian.PutUint32(b[4:], 0); return b }),
+		"huge segment size":    modify(func(b []byte) []byte { binary.BigEndian.PutUint32(b[4:], 1<<31); return b }),
+		"changed IV":           modify(func(b []byte) []byte { b[10] ^= 1; return b }),
+		"flipped ciphertext":   modify(func(b []byte) []byte { b[24+seg+5] ^= 1; return b }),
+		"flipped tag":          modify(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }),
+		"dropped last segment": enc[:24+2*seg],
+		"truncated segment":    enc[:len(enc)-5],
+		"appended segment":     append(bytes.Clone(enc), enc[24:24+seg]...),
+		"swapped segments": modify(func(b []byte) []byte {
+			s1, s2 := b[24:24+seg], b[24+seg:24+2*seg]
+			tmp := bytes.Clone(s1)
+			copy(s1, s2)
+			copy(s2, tmp)
+			return b
+		}),
+	}
+	for name, stream := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := io.ReadAll(m.Reader(bytes.NewReader(stream))); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+
+	other := ctrhmac.New(newKey(t))
+	if _, err := io.ReadAll(other.Reader(bytes.NewReader(enc))); !errors.Is(err, ctrhmac.ErrNotAuthentic) {
+		t.Fatalf("wrong key: got %v, want ErrNotAuthentic", err)
+	}
+}
+
+func TestNewRejectsKeySize(t *testing.T) {
+	if _, err := ctrhmac.NewE(make([]byte, 32)); !errors.Is(err, ctrhmac.ErrInvalidKeySize) {
+		t.Fatalf("got %v, want ErrInvalidKeySize", err)
+	}
+}
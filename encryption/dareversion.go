@@ -0,0 +1,44 @@
+package encryption
+
+import (
+	"fmt"
+
+	"github.com/minio/sio"
+)
+
+// DARE format versions of WithDAREVersions
+const (
+	DAREVersion10 = sio.Version10
+	DAREVersion20 = sio.Version20
+)
+
+// WithDAREVersions sets the DARE versions passed to minio/sio: Readers
+// accept packages of versions min to max and Writers write version max.
+// By default DARE 1.0 and 2.0 are read and 2.0 is written; pin both to
+// DAREVersion20 to reject 1.0 streams. DARE 1.0 does not detect truncated
+// streams, write it only for readers that know nothing else.
+func WithDAREVersions(min, max byte) Option {
+	return func(m *Middleware) {
+		m.minVersion, m.maxVersion = min, max
+	}
+}
+
+// checkDAREVersions validates the versions of WithDAREVersions
+func (m *Middleware) checkDAREVersions() error {
+	if m.minVersion == 0 && m.maxVersion == 0 {
+		return nil
+	}
+	valid := func(v byte) bool { return v == DAREVersion10 || v == DAREVersion20 }
+	if !valid(m.minVersion) || !valid(m.maxVersion) || m.minVersion > m.maxVersion {
+		return fmt.Errorf("encryption: invalid DARE versions %#x to %#x", m.minVersion, m.maxVersion)
+	}
+	return nil
+}
+
+// dareName returns the name of the DARE version written
+func (m *Middleware) dareName() string {
+	if m.maxVersion == DAREVersion10 {
+		return "dare-1.0"
+	}
+	return "dare-2.0"
+}
@@ -0,0 +1,310 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// DataKeyFormatVersion is the format version of the wrapped data key header
+const DataKeyFormatVersion = 1
+
+var dataKeyMagic = [3]byte{'H', 'B', 'W'}
+
+// dataKeyHeaderSize is the size of the wrapped data key header without the
+// wrapped key: magic, version, algorithm and key length
+const dataKeyHeaderSize = len(dataKeyMagic) + 3
+
+var (
+	// ErrUnwrapDataKey is returned by Readers if none of the keys unwraps
+	// the data key of a stream, because the key is unknown or the header is
+	// corrupt
+	ErrUnwrapDataKey = errors.New("encryption: data key cannot be unwrapped")
+
+	// ErrNoDataKey is returned by RewrapDataKey for streams without a
+	// wrapped data key
+	ErrNoDataKey = errors.New("encryption: stream has no wrapped data key")
+)
+
+func init() {
+	middleware.RegisterFormat("data-key-header", func(p []byte) (string, int, bool) {
+		if len(p) < dataKeyHeaderSize || [3]byte(p[:3]) != dataKeyMagic {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, %s wrapped data key", p[3], KeyWrap(p[4])), dataKeyHeaderSize + int(p[5]), true
+	})
+}
+
+// KeyWrap selects how WithDataKeys wraps data keys
+type KeyWrap byte
+
+const (
+	// AESKeyWrap wraps data keys with AES-256 key wrap (RFC 3394) into 40 bytes
+	AESKeyWrap KeyWrap = 1
+
+	// AESGCMKeyWrap wraps data keys with AES-256-GCM under a random nonce
+	// into 60 bytes, authenticating the header
+	AESGCMKeyWrap KeyWrap = 2
+)
+
+// String returns the name of the algorithm
+func (k KeyWrap) String() string {
+	switch k {
+	case AESKeyWrap:
+		return "aes-kw"
+	case AESGCMKeyWrap:
+		return "aes-gcm"
+	default:
+		return fmt.Sprintf("KeyWrap(%d)", byte(k))
+	}
+}
+
+// WithDataKeys encrypts every stream with a fresh random data key, which
+// is wrapped with the configured key and stored in a header ahead of the
+// stream. The configured key only encrypts one data key per stream, which
+// bounds the data encrypted under any single key, and it can be rotated
+// without re-encrypting data: keep the previous key in WithDecryptionKeys
+// or the KeyByIDProvider, and rewrite the headers with RewrapDataKey.
+//
+// Readers detect wrapped data keys automatically, so streams written before
+// enabling it stay readable. It works with WithKey, WithKeyProvider,
+// WithKeyFile, WithKeyEnv and WithKeyFromKeyring, and cannot be combined
+// with key derivation or recipient keys, which use a key per stream
+// already.
+func WithDataKeys(wrap KeyWrap) Option {
+	return func(m *Middleware) {
+		m.keyWrap = wrap
+	}
+}
+
+// checkDataKeys validates the WithDataKeys configuration
+func (m *Middleware) checkDataKeys() error {
+	if m.keyWrap == 0 {
+		return nil
+	}
+	if m.keyWrap != AESKeyWrap && m.keyWrap != AESGCMKeyWrap {
+		return fmt.Errorf("encryption: unsupported key wrap %s", m.keyWrap)
+	}
+	if m.secret != nil || m.recipientPub != nil {
+		return errors.New("encryption: WithDataKeys cannot be combined with key derivation or recipient keys")
+	}
+	return nil
+}
+
+// newDataKey returns a new data key and the headers of the stream, prefix
+// followed by the data key wrapped with kek
+func (m *Middleware) newDataKey(kek, prefix []byte) ([]byte, []byte, error) {
+	dek := make([]byte, KeySize)
+	if _, err := io.ReadFull(m.rand, dek); err != nil {
+		return nil, nil, fmt.Errorf("encryption: failed to generate data key: %w", err)
+	}
+	hdr, err := m.wrapDataKey(kek, dek)
+	if err != nil {
+		clear(dek)
+		return nil, nil, err
+	}
+	return dek, append(prefix, hdr...), nil
+}
+
+// wrapDataKey returns the wrapped data key header of dek
+func (m *Middleware) wrapDataKey(kek, dek []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 0, dataKeyHeaderSize+60)
+	hdr = append(hdr, dataKeyMagic[:]...)
+	hdr = append(hdr, DataKeyFormatVersion, byte(m.keyWrap), 0)
+	var wrapped []byte
+	switch m.keyWrap {
+	case AESKeyWrap:
+		wrapped = aesKeyWrap(block, dek)
+	case AESGCMKeyWrap:
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(m.rand, nonce); err != nil {
+			return nil, fmt.Errorf("encryption: failed to generate nonce: %w", err)
+		}
+		wrapped = aead.Seal(nonce, nonce, dek, hdr[:dataKeyHeaderSize-1])
+	}
+	hdr[dataKeyHeaderSize-1] = byte(len(wrapped))
+	return append(hdr, wrapped...), nil
+}
+
+// readDataKey reads the wrapped data key header from r and unwraps the
+// data key with the first of keks that succeeds. Streams without the
+// header return a nil key and r with the bytes read ahead restored.
+func readDataKey(keks [][]byte, r io.Reader) ([]byte, io.Reader, error) {
+	var hdr [dataKeyHeaderSize]byte
+	n, err := io.ReadFull(r, hdr[:len(dataKeyMagic)])
+	if n < len(dataKeyMagic) || !bytes.Equal(hdr[:3], dataKeyMagic[:]) {
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, r, err
+		}
+		return nil, io.MultiReader(bytes.NewReader(hdr[:n]), r), nil
+	}
+	if _, err := io.ReadFull(r, hdr[3:]); err != nil {
+		return nil, r, fmt.Errorf("encryption: read data key header: %w", err)
+	}
+	if _, err := middleware.CheckVersion("encryption", hdr[3], DataKeyFormatVersion, middleware.RejectUnknown); err != nil {
+		return nil, r, err
+	}
+	wrapped := make([]byte, hdr[5])
+	if _, err := io.ReadFull(r, wrapped); err != nil {
+		return nil, r, fmt.Errorf("encryption: read data key header: %w", err)
+	}
+	for _, kek := range keks {
+		if dek, ok := unwrapDataKey(KeyWrap(hdr[4]), kek, hdr[:dataKeyHeaderSize-1], wrapped); ok {
+			return dek, r, nil
+		}
+	}
+	return nil, r, ErrUnwrapDataKey
+}
+
+// unwrapDataKey unwraps a data key, authenticating the header prefix ad
+// with AES-GCM
+func unwrapDataKey(wrap KeyWrap, kek, ad, wrapped []byte) ([]byte, bool) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, false
+	}
+	var dek []byte
+	switch wrap {
+	case AESKeyWrap:
+		dek, err = aesKeyUnwrap(block, wrapped)
+	case AESGCMKeyWrap:
+		aead, _ := cipher.NewGCM(block)
+		if len(wrapped) < aead.NonceSize() {
+			return nil, false
+		}
+		n := aead.NonceSize()
+		dek, err = aead.Open(nil, wrapped[:n], wrapped[n:], ad)
+	default:
+		return nil, false
+	}
+	if err != nil || len(dek) != KeySize {
+		clear(dek)
+		return nil, false
+	}
+	return dek, true
+}
+
+// RewrapDataKey copies a stream written with WithDataKeys from src to dst,
+// replacing the wrapped data key by the data key wrapped with the current
+// key. The data key is unwrapped with the current or a previous key, the
+// encrypted data is copied unchanged. With a KeyByIDProvider the key ID
+// header is rewritten as well, and so is the key ID of a format header.
+// Streams without a wrapped data key fail with ErrNoDataKey.
+func (m *Middleware) RewrapDataKey(ctx context.Context, dst io.Writer, src io.Reader) error {
+	if err := m.checkDestroyed(); err != nil {
+		return err
+	}
+	if m.keyWrap == 0 {
+		return errors.New("encryption: RewrapDataKey needs WithDataKeys")
+	}
+	if m.secret != nil || m.recipientPub != nil {
+		return errors.New("encryption: RewrapDataKey needs WithKey or a key provider")
+	}
+	fh, _, r, err := m.readFormatHeader(src)
+	if err != nil {
+		return err
+	}
+	oldKEK, r, err := m.readStreamKey(ctx, r)
+	if err != nil {
+		return err
+	}
+	keks := append([][]byte{oldKEK}, m.decryptionKeys...)
+	if fh != nil {
+		if keks, err = fh.selectKey(keks); err != nil {
+			return err
+		}
+	}
+	dek, r, err := readDataKey(keks, r)
+	if err != nil {
+		return err
+	}
+	if dek == nil {
+		return ErrNoDataKey
+	}
+	defer clear(dek)
+	kek, prefix := m.key, []byte(nil)
+	if m.provider != nil {
+		if kek, prefix, err = m.providerKey(ctx); err != nil {
+			return err
+		}
+	}
+	hdr, err := m.wrapDataKey(kek, dek)
+	if err != nil {
+		return err
+	}
+	if fh != nil {
+		prefix = append(fh.marshal(kek), prefix...)
+	}
+	if _, err := dst.Write(append(prefix, hdr...)); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+// aesKeyWrapIV is the default initial value of RFC 3394
+const aesKeyWrapIV = 0xa6a6a6a6a6a6a6a6
+
+// aesKeyWrap wraps a key of a multiple of 8 bytes with RFC 3394
+func aesKeyWrap(block cipher.Block, key []byte) []byte {
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(out, aesKeyWrapIV)
+	copy(out[8:], key)
+	var b [16]byte
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b[:8], out[:8])
+			copy(b[8:], out[8*i:8*i+8])
+			block.Encrypt(b[:], b[:])
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out, binary.BigEndian.Uint64(b[:8])^t)
+			copy(out[8*i:], b[8:])
+		}
+	}
+	return out
+}
+
+// aesKeyUnwrap unwraps a key wrapped by aesKeyWrap and checks its integrity
+func aesKeyUnwrap(block cipher.Block, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errors.New("invalid wrapped key size")
+	}
+	n := len(wrapped)/8 - 1
+	r := append([]byte(nil), wrapped...)
+	var b [16]byte
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(r[:8])^t)
+			copy(b[8:], r[8*i:8*i+8])
+			block.Decrypt(b[:], b[:])
+			copy(r[:8], b[:8])
+			copy(r[8*i:], b[8:])
+		}
+	}
+	clear(b[:])
+	var iv [8]byte
+	binary.BigEndian.PutUint64(iv[:], aesKeyWrapIV)
+	if subtle.ConstantTimeCompare(r[:8], iv[:]) != 1 {
+		clear(r)
+		return nil, errors.New("key wrap integrity check failed")
+	}
+	return r[8:], nil
+}
@@ -0,0 +1,103 @@
+package encryption
+
+import (
+	"fmt"
+	"strconv"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// Ensure the encryption middlewares describe themselves for compliance reports
+var (
+	_ middleware.Describer = (*Middleware)(nil)
+	_ middleware.Describer = (*Ephemeral)(nil)
+	_ middleware.Describer = (*Sealed)(nil)
+)
+
+// describe returns the properties common to all DARE based middlewares
+func describe(cipherSuite byte, keyManagement string) middleware.Component {
+	return middleware.Component{
+		Type:      string(middleware.RoleEncryption),
+		Algorithm: CipherName(cipherSuite),
+		KeyBits:   KeySize * 8,
+		Integrity: "aead",
+		Properties: map[string]string{
+			"format":         "dare-2.0",
+			"key_management": keyManagement,
+		},
+	}
+}
+
+// Describe reports the cipher, key length and header options
+func (m *Middleware) Describe() middleware.Component {
+	c := describe(m.cipherSuite, "static")
+	c.Properties["format"] = m.dareName()
+	if m.minVersion != 0 {
+		c.Properties["dare_min_version"] = fmt.Sprintf("%d.%d", m.minVersion>>4, m.minVersion&0xf)
+	}
+	if m.kdf != nil {
+		c.Properties["key_management"] = "passphrase"
+		if _, ok := m.kdf.(hkdfKDF); ok {
+			c.Properties["key_management"] = "derived"
+		}
+		c.KDF = &middleware.KDF{Name: m.kdf.name(), Params: m.kdf.describe()}
+	}
+	if m.provider != nil {
+		c.Properties["key_management"] = "provider"
+	}
+	if m.recipientPub != nil {
+		c.Properties["key_management"] = "recipient"
+		c.KDF = &middleware.KDF{Name: "hkdf-sha256", Params: map[string]string{"key_agreement": "x25519"}}
+		if m.recipientPQ != nil {
+			c.KDF.Params["key_agreement"] = "x25519+" + m.recipientPQ.name()
+		}
+	}
+	if m.ad != nil {
+		c.Properties["associated_data"] = "true"
+	}
+	if m.fips {
+		c.Properties["fips_mode"] = "true"
+		if module, ok := FIPSModule(); ok {
+			c.Properties["fips_module"] = module
+		}
+	}
+	if m.formatHeader {
+		c.Properties["format_header"] = "true"
+	}
+	if m.keyWrap != 0 {
+		c.Properties["data_keys"] = m.keyWrap.String()
+	}
+	if len(m.decryptionKeys) > 0 {
+		c.Properties["decryption_keys"] = strconv.Itoa(len(m.decryptionKeys))
+	}
+	if m.replayToken == nil && m.notBefore.IsZero() && m.notAfter.IsZero() && m.validFor == 0 {
+		return c
+	}
+	if c.KDF == nil {
+		c.KDF = &middleware.KDF{
+			Name:   "hmac-sha256",
+			Params: map[string]string{"input": "authenticated header"},
+		}
+	} else {
+		c.Properties["header_kdf"] = "hmac-sha256"
+	}
+	c.Properties["replay_token"] = strconv.FormatBool(m.replayToken != nil)
+	c.Properties["replay_check"] = strconv.FormatBool(m.replayCheck != nil)
+	if m.validFor > 0 {
+		c.Properties["valid_for"] = m.validFor.String()
+	}
+	if m.validityPolicy == IgnoreValidity {
+		c.Properties["validity_enforced"] = "false"
+	}
+	return c
+}
+
+// Describe reports the cipher and the per-stream key management
+func (e *Ephemeral) Describe() middleware.Component {
+	return describe(e.cipherSuite, "ephemeral")
+}
+
+// Describe reports the cipher and the sealed per-stream key management
+func (s *Sealed) Describe() middleware.Component {
+	return describe(s.cipherSuite, "sealed")
+}
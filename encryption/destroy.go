@@ -0,0 +1,82 @@
+package encryption
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrDestroyed is returned by Writers and Readers of a destroyed middleware
+var ErrDestroyed = errors.New("encryption: middleware destroyed")
+
+// Ensure Middleware implements io.Closer
+var _ io.Closer = (*Middleware)(nil)
+
+// Destroy wipes the key material held by the middleware: the key, the
+// passphrase or master key of key derivation, the decryption keys and the
+// keys loaded with WithKeyFile or WithKeyEnv. Slices passed to WithKey,
+// WithDecryptionKeys and the key derivation options are overwritten in
+// place. Recipient private keys cannot be wiped by this package and are
+// only dropped. Afterwards Writers and Readers fail with ErrDestroyed.
+//
+// Destroy must not be called while Writers or Readers are created. Streams
+// that already wrote or read data keep working, as their ciphers hold
+// expanded copies of the key; these are released with the stream.
+func (m *Middleware) Destroy() {
+	m.destroyed.Store(true)
+	clear(m.key)
+	clear(m.secret)
+	clearKeys(m.decryptionKeys)
+	if s, ok := m.provider.(*keySource); ok {
+		s.destroy()
+	}
+	m.key, m.secret, m.decryptionKeys = nil, nil, nil
+	m.recipientPriv = nil
+}
+
+// Close calls Destroy, for owners managing the middleware as an io.Closer
+func (m *Middleware) Close() error {
+	m.Destroy()
+	return nil
+}
+
+// checkDestroyed returns ErrDestroyed after Destroy
+func (m *Middleware) checkDestroyed() error {
+	if m.destroyed.Load() {
+		return ErrDestroyed
+	}
+	return nil
+}
+
+// destroy wipes and removes all loaded keys and stops reloading
+func (s *keySource) destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, key := range s.keys {
+		clear(key)
+		delete(s.keys, id)
+	}
+	s.interval = 0
+}
+
+// wipingReader wipes intermediate keys after the first Read, when the
+// minio/sio reader below has expanded them into its ciphers
+type wipingReader struct {
+	r    io.Reader
+	keys [][]byte
+}
+
+func (w *wipingReader) Read(p []byte) (int, error) {
+	n, err := w.r.Read(p)
+	if w.keys != nil && len(p) > 0 {
+		clearKeys(w.keys)
+		w.keys = nil
+	}
+	return n, err
+}
+
+// clearKeys wipes keys
+func clearKeys(keys [][]byte) {
+	for _, k := range keys {
+		clear(k)
+	}
+}
@@ -0,0 +1,453 @@
+// Package encryption provides an authenticated encryption middleware based on
+// the DARE format implemented by github.com/minio/sio.
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/sio"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// KeySize is the required encryption key size in bytes
+const KeySize = 32
+
+var (
+	// ErrInvalidKeySize is returned by NewE for keys that are not KeySize bytes long
+	ErrInvalidKeySize = errors.New("encryption: invalid key size")
+
+	// ErrUnsupportedCipher is returned by the constructors for cipher suites
+	// not supported by this build
+	ErrUnsupportedCipher = errors.New("encryption: unsupported cipher suite")
+)
+
+// Middleware implements encryption/decryption middleware using minio/sio
+type Middleware struct {
+	key         []byte
+	cipherSuite byte
+	rand        io.Reader
+	replayToken func() ([]byte, error)
+	replayCheck func(token []byte) error
+	secret      []byte // passphrase or master key of kdf
+	kdf         kdf
+
+	decryptionKeys [][]byte // previous keys accepted by Reader
+	provider       KeyProvider
+	keyring        *keyringEntry
+	keySource      *keySource
+	keyReload      time.Duration
+
+	recipientPub  *ecdh.PublicKey
+	recipientPriv *ecdh.PrivateKey
+	recipientPQ   pqRecipient
+
+	keyWrap      KeyWrap
+	ad           func(ctx context.Context) ([]byte, error)
+	formatHeader bool
+	fips         bool
+	minVersion   byte // DARE versions, sio defaults if 0
+	maxVersion   byte
+
+	notBefore      time.Time
+	notAfter       time.Time
+	validFor       time.Duration
+	validityPolicy ValidityPolicy
+	now            func() time.Time
+
+	destroyed atomic.Bool
+}
+
+// Ensure Middleware implements middleware.ContextMiddleware and middleware.WriterE interfaces
+var (
+	_ middleware.ContextMiddleware = (*Middleware)(nil)
+	_ middleware.WriterE           = (*Middleware)(nil)
+	_ middleware.HeaderSplitter    = (*Middleware)(nil)
+)
+
+// Option configures the encryption middleware
+type Option func(*Middleware)
+
+// WithKey sets the encryption key, it must be KeySize bytes long
+func WithKey(key []byte) Option {
+	return func(m *Middleware) {
+		m.key = key
+	}
+}
+
+// WithCipher sets the cipher suite (AES256GCM or ChaCha20Poly1305).
+// The default is AES256GCM, or ChaCha20Poly1305 in the minimal profile.
+func WithCipher(cipherSuite byte) Option {
+	return func(m *Middleware) {
+		m.cipherSuite = cipherSuite
+	}
+}
+
+// WithRand sets the source of randomness used for generated keys and nonces.
+// By default middleware.Rand() is used.
+func WithRand(r io.Reader) Option {
+	return func(m *Middleware) {
+		m.rand = r
+	}
+}
+
+// New creates a new encryption middleware. If no key is configured a random
+// key is generated, which is sufficient for buffers that never outlive the process.
+// New panics if the key has an invalid size or the cipher suite is not supported.
+func New(opts ...Option) *Middleware {
+	m, err := NewE(opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return m
+}
+
+// NewE is like New, but returns configuration errors such as
+// ErrInvalidKeySize and ErrUnsupportedCipher instead of panicking
+func NewE(opts ...Option) (*Middleware, error) {
+	m := &Middleware{
+		cipherSuite: defaultCipher,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.rand == nil {
+		m.rand = middleware.Rand()
+	}
+	if !supportedCipher(m.cipherSuite) {
+		return nil, fmt.Errorf("%w %#x", ErrUnsupportedCipher, m.cipherSuite)
+	}
+	if err := m.checkFIPS(); err != nil {
+		return nil, err
+	}
+	if err := m.checkDAREVersions(); err != nil {
+		return nil, err
+	}
+	if err := m.checkDataKeys(); err != nil {
+		return nil, err
+	}
+	if m.keyring != nil {
+		if err := m.loadKeyring(); err != nil {
+			return nil, err
+		}
+	}
+	if m.keySource != nil {
+		if err := m.loadKeySource(); err != nil {
+			return nil, err
+		}
+	}
+	if m.recipientPub != nil || m.recipientPriv != nil {
+		if err := m.checkRecipient(); err != nil {
+			return nil, err
+		}
+		return m, m.checkDecryptionKeys()
+	}
+	if m.provider != nil {
+		if m.key != nil || m.secret != nil {
+			return nil, errors.New("encryption: WithKeyProvider cannot be combined with WithKey or key derivation")
+		}
+		return m, m.checkDecryptionKeys()
+	}
+	if m.secret != nil {
+		if m.key != nil {
+			return nil, errors.New("encryption: WithKey cannot be combined with key derivation")
+		}
+		if err := m.kdf.check(m.secret); err != nil {
+			return nil, err
+		}
+		if !m.kdf.static() {
+			return m, m.checkDecryptionKeys()
+		}
+		key, err := m.kdf.derive(m.secret, m.kdf.salt())
+		if err != nil {
+			return nil, fmt.Errorf("encryption: failed to derive key: %w", err)
+		}
+		m.key, m.secret = key, nil
+	}
+	if m.key == nil {
+		m.key = make([]byte, KeySize)
+		if _, err := io.ReadFull(m.rand, m.key); err != nil {
+			return nil, fmt.Errorf("encryption: failed to generate key: %w", err)
+		}
+	}
+	if len(m.key) != KeySize {
+		return nil, fmt.Errorf("%w: must be %d bytes, got %d", ErrInvalidKeySize, KeySize, len(m.key))
+	}
+	if err := m.checkDecryptionKeys(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Key returns the encryption key, or nil if stream keys are derived,
+// resolved by a KeyProvider or encrypted to a recipient. With WithDataKeys
+// it is the key wrapping the data keys.
+func (m *Middleware) Key() []byte {
+	return m.key
+}
+
+// perStreamKeys reports whether every Writer uses a key of its own, which
+// is cleared once the stream is set up
+func (m *Middleware) perStreamKeys() bool {
+	return m.secret != nil || m.recipientPub != nil || m.keyWrap != 0
+}
+
+func (m *Middleware) config(key []byte) sio.Config {
+	return sio.Config{
+		Key:          key,
+		CipherSuites: []byte{m.cipherSuite},
+		Rand:         m.rand,
+		MinVersion:   m.minVersion,
+		MaxVersion:   m.maxVersion,
+	}
+}
+
+// readConfig accepts every supported cipher suite, the suite of each
+// package is taken from the DARE header. In FIPS mode only the configured
+// suite, AES-256-GCM, is accepted.
+func (m *Middleware) readConfig(key []byte) sio.Config {
+	cfg := m.config(key)
+	if !m.fips {
+		cfg.CipherSuites = readCipherSuites(m.cipherSuite)
+	}
+	return cfg
+}
+
+// Writer wraps an io.Writer with encryption.
+// The returned writer must be closed to write the final package.
+// Setup errors are returned from the first Write or Close, see WriterE.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return writerOrErr(m.WriterE(w))
+}
+
+// WriterE is like Writer, but returns setup errors, e.g. of the
+// authenticated header, the key derivation or minio/sio, immediately
+func (m *Middleware) WriterE(w io.Writer) (io.WriteCloser, error) {
+	return m.writerE(context.Background(), w)
+}
+
+// WriterContext is like Writer, passing ctx to the KeyProvider. A buffer
+// ID set with middleware.WithBufferID is stored in the authenticated header.
+func (m *Middleware) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	return writerOrErr(m.writerE(ctx, w))
+}
+
+// SplitWriter is like WriterE, but returns the headers ahead of the DARE
+// packages instead of writing them to w: the format header, the key
+// derivation, data key or recipient header and the authenticated header.
+// The header is nil for streams encrypted with a plain key and none of
+// these headers.
+func (m *Middleware) SplitWriter(w io.Writer) (io.Writer, []byte, error) {
+	enc, header, err := m.splitWriterE(context.Background(), w, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, header, nil
+}
+
+// JoinReader wraps an io.Reader like Reader for a stream written by
+// SplitWriter. Errors are returned from Read.
+func (m *Middleware) JoinReader(r io.Reader, header []byte) (io.Reader, error) {
+	return m.Reader(io.MultiReader(bytes.NewReader(header), r)), nil
+}
+
+func (m *Middleware) writerE(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	enc, _, err := m.splitWriterE(ctx, w, false)
+	return enc, err
+}
+
+// splitWriterE creates the writer. With split the headers ahead of the
+// DARE packages are returned instead of written, see SplitWriter.
+func (m *Middleware) splitWriterE(ctx context.Context, w io.Writer, split bool) (io.WriteCloser, []byte, error) {
+	if err := m.checkDestroyed(); err != nil {
+		return nil, nil, err
+	}
+	h, err := m.newAuthHeader(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ad, err := m.associatedData(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, prefix, err := m.streamKey(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.perStreamKeys() {
+		defer clear(key)
+	}
+	cfg := m.config(key)
+	var authHdr []byte
+	if h != nil {
+		if authHdr, err = h.marshal(); err != nil {
+			return nil, nil, err
+		}
+		cfg.Key = headerKey(key, authHdr)
+		defer clear(cfg.Key)
+		prefix = append(prefix, authHdr...)
+	}
+	if m.formatHeader {
+		hdr := m.marshalFormatHeader()
+		cfg.Key = headerKey(cfg.Key, formatBinding(hdr))
+		defer clear(cfg.Key)
+		prefix = append(hdr, prefix...)
+	}
+	if len(ad) > 0 {
+		cfg.Key = associatedKey(cfg.Key, ad)
+		defer clear(cfg.Key)
+	}
+	if authHdr != nil {
+		prefix = append(prefix, headerTag(cfg.Key, authHdr)...)
+	}
+	var dst io.Writer = w
+	if prefix != nil && !split {
+		dst = &headerWriter{w: w, header: prefix}
+	}
+	enc, err := sio.EncryptWriter(dst, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: failed to create writer: %w", err)
+	}
+	return middleware.HardenLayerWriter("encryption", enc), prefix, nil
+}
+
+// Reader wraps an io.Reader with decryption. Streams with a format header
+// or an authenticated header are detected automatically; header and replay check errors are
+// returned from Read, Reader itself never fails. Replay and validity checks
+// run after the tag of the header was verified, so forged headers cannot
+// mark tokens as seen, even for streams without data.
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return m.ReaderContext(context.Background(), r)
+}
+
+// ReaderContext is like Reader, passing ctx to the KeyProvider. A buffer ID
+// in the authenticated header is recorded in ctx once authenticated.
+func (m *Middleware) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return newLazyReader(func() (io.Reader, error) {
+		if err := m.checkDestroyed(); err != nil {
+			return nil, err
+		}
+		ad, err := m.associatedData(ctx)
+		if err != nil {
+			return nil, err
+		}
+		fh, fraw, r, err := m.readFormatHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		key, r, err := m.readStreamKey(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		// derived keys, data keys and header keys are wiped once sio set up
+		// its ciphers
+		var wipe [][]byte
+		keys := append([][]byte{key}, m.decryptionKeys...)
+		if m.secret != nil || m.recipientPub != nil {
+			wipe = append(wipe, key)
+		} else {
+			if fh != nil {
+				if keys, err = fh.selectKey(keys); err != nil {
+					return nil, err
+				}
+			}
+			dek, dr, err := readDataKey(keys, r)
+			if err != nil {
+				return nil, err
+			}
+			if r = dr; dek != nil {
+				keys, wipe = [][]byte{dek}, [][]byte{dek}
+			}
+		}
+		var first [1]byte
+		if _, err := io.ReadFull(r, first[:]); err != nil {
+			clearKeys(wipe)
+			if err == io.EOF && m.replayCheck == nil {
+				return eofReader{}, nil
+			}
+			return nil, fmt.Errorf("encryption: read stream header: %w", err)
+		}
+		r = io.MultiReader(bytes.NewReader(first[:]), r)
+		// bind maps a key to the key of the packages with format header and
+		// associated data
+		bind := func(k []byte) []byte {
+			if fraw != nil {
+				k = headerKey(k, formatBinding(fraw))
+				wipe = append(wipe, k)
+			}
+			if len(ad) == 0 {
+				return k
+			}
+			k = associatedKey(k, ad)
+			wipe = append(wipe, k)
+			return k
+		}
+		cfg := m.readConfig(keys[0])
+		if fh != nil {
+			cfg.CipherSuites = []byte{fh.cipherSuite}
+		}
+		if first[0] != authMagic[0] {
+			if m.replayCheck != nil {
+				clearKeys(wipe)
+				return nil, ErrReplayTokenMissing
+			}
+			dec, err := m.decryptReader(r, cfg, keys, bind)
+			if err != nil {
+				clearKeys(wipe)
+				return nil, err
+			}
+			return &wipingReader{r: dec, keys: wipe}, nil
+		}
+		h, hdr, err := readAuthHeader(r)
+		if err != nil {
+			clearKeys(wipe)
+			return nil, err
+		}
+		var tag [headerTagSize]byte
+		if _, err := io.ReadFull(r, tag[:]); err != nil {
+			clearKeys(wipe)
+			return nil, fmt.Errorf("encryption: read stream header: %w", err)
+		}
+		// the tag selects the key and proves the header authentic before
+		// any of its fields is used
+		cfg.Key = nil
+		for _, k := range keys {
+			hk := headerKey(k, hdr)
+			wipe = append(wipe, hk)
+			if bk := bind(hk); hmac.Equal(headerTag(bk, hdr), tag[:]) {
+				cfg.Key = bk
+				break
+			}
+		}
+		if cfg.Key == nil {
+			clearKeys(wipe)
+			return nil, ErrHeaderNotAuthentic
+		}
+		if m.replayCheck != nil && h.token == nil {
+			clearKeys(wipe)
+			return nil, ErrReplayTokenMissing
+		}
+		if err := m.checkAuthHeader(ctx, h); err != nil {
+			clearKeys(wipe)
+			return nil, err
+		}
+		dec, err := sio.DecryptReader(r, cfg)
+		if err != nil {
+			clearKeys(wipe)
+			return nil, err
+		}
+		return &wipingReader{r: dec, keys: wipe}, nil
+	})
+}
+
+// eofReader is an empty stream
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
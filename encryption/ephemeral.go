@@ -0,0 +1,264 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/minio/sio"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// EphemeralFormatVersion is the header format version of ephemeral streams
+const EphemeralFormatVersion = 1
+
+var ephemeralMagic = [3]byte{'H', 'B', 'E'}
+
+// ErrUnknownStream is returned by ephemeral Readers if the registry holds no
+// key for the stream, e.g. because it was written by another process
+var ErrUnknownStream = errors.New("encryption: no key registered for stream")
+
+// StreamID identifies an ephemeral stream in a KeyRegistry
+type StreamID [16]byte
+
+// String returns the hex encoding of the stream ID
+func (id StreamID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// KeyRegistry holds per-stream keys in process memory only. Keys are never
+// serialized, so streams become unreadable once the key is forgotten or the
+// process exits.
+type KeyRegistry struct {
+	mu   sync.RWMutex
+	keys map[StreamID][]byte
+}
+
+// NewKeyRegistry creates an empty key registry
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{keys: make(map[StreamID][]byte)}
+}
+
+func (r *KeyRegistry) put(id StreamID, key []byte) {
+	r.mu.Lock()
+	r.keys[id] = key
+	r.mu.Unlock()
+}
+
+func (r *KeyRegistry) get(id StreamID) ([]byte, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.keys[id]
+	return key, ok
+}
+
+// Forget wipes and removes the key of a stream, making it unreadable
+func (r *KeyRegistry) Forget(id StreamID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key, ok := r.keys[id]; ok {
+		clear(key)
+		delete(r.keys, id)
+	}
+}
+
+// Clear wipes and removes all keys
+func (r *KeyRegistry) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, key := range r.keys {
+		clear(key)
+		delete(r.keys, id)
+	}
+}
+
+// Len returns the number of registered keys
+func (r *KeyRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.keys)
+}
+
+// Ephemeral encrypts every stream with a fresh random key that is only held
+// in a KeyRegistry. It fits the spill-to-temp use case where data never needs
+// to outlive the process but must be unreadable on disk.
+type Ephemeral struct {
+	registry    *KeyRegistry
+	cipherSuite byte
+	rand        io.Reader
+	onStream    func(StreamID)
+}
+
+// Ensure Ephemeral implements middleware.Middleware and middleware.WriterE interfaces
+var (
+	_ middleware.Middleware = (*Ephemeral)(nil)
+	_ middleware.WriterE    = (*Ephemeral)(nil)
+)
+
+// NewEphemeral creates an ephemeral encryption middleware using registry.
+// WithCipher and WithRand are honored, WithKey is ignored.
+// NewEphemeral panics if the cipher suite is not supported.
+func NewEphemeral(registry *KeyRegistry, opts ...Option) *Ephemeral {
+	e, err := NewEphemeralE(registry, opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return e
+}
+
+// NewEphemeralE is like NewEphemeral, but returns ErrUnsupportedCipher instead of panicking
+func NewEphemeralE(registry *KeyRegistry, opts ...Option) (*Ephemeral, error) {
+	cfg := &Middleware{cipherSuite: defaultCipher}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.rand == nil {
+		cfg.rand = middleware.Rand()
+	}
+	if !supportedCipher(cfg.cipherSuite) {
+		return nil, fmt.Errorf("%w %#x", ErrUnsupportedCipher, cfg.cipherSuite)
+	}
+	return &Ephemeral{
+		registry:    registry,
+		cipherSuite: cfg.cipherSuite,
+		rand:        cfg.rand,
+	}, nil
+}
+
+// OnStream registers a callback receiving the ID of every new stream, so the
+// caller can Forget the key once the buffer is discarded
+func (e *Ephemeral) OnStream(fn func(StreamID)) *Ephemeral {
+	e.onStream = fn
+	return e
+}
+
+// Registry returns the key registry of the middleware
+func (e *Ephemeral) Registry() *KeyRegistry {
+	return e.registry
+}
+
+// Writer generates a stream ID and key, registers the key and wraps w with
+// encryption. Setup errors are returned from the first Write or Close, see WriterE.
+func (e *Ephemeral) Writer(w io.Writer) io.Writer {
+	return writerOrErr(e.WriterE(w))
+}
+
+// WriterE is like Writer, but returns setup errors immediately
+func (e *Ephemeral) WriterE(w io.Writer) (io.WriteCloser, error) {
+	var id StreamID
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(e.rand, id[:]); err != nil {
+		return nil, fmt.Errorf("encryption: failed to generate stream id: %w", err)
+	}
+	if _, err := io.ReadFull(e.rand, key); err != nil {
+		return nil, fmt.Errorf("encryption: failed to generate key: %w", err)
+	}
+	e.registry.put(id, key)
+	if e.onStream != nil {
+		e.onStream(id)
+	}
+	hdr := make([]byte, 0, len(ephemeralMagic)+1+len(id))
+	hdr = append(hdr, ephemeralMagic[:]...)
+	hdr = append(hdr, EphemeralFormatVersion)
+	hdr = append(hdr, id[:]...)
+	enc, err := sio.EncryptWriter(&headerWriter{w: w, header: hdr}, sio.Config{
+		Key:          key,
+		CipherSuites: []byte{e.cipherSuite},
+		Rand:         e.rand,
+	})
+	if err != nil {
+		e.registry.Forget(id)
+		return nil, fmt.Errorf("encryption: failed to create writer: %w", err)
+	}
+	return middleware.HardenLayerWriter("encryption", enc), nil
+}
+
+// Reader reads the stream ID and decrypts with the registered key.
+// Errors, including ErrUnknownStream, are returned from Read.
+func (e *Ephemeral) Reader(r io.Reader) io.Reader {
+	return newLazyReader(func() (io.Reader, error) {
+		var hdr [len(ephemeralMagic) + 1 + len(StreamID{})]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("encryption: read stream header: %w", err)
+		}
+		if !bytes.Equal(hdr[:3], ephemeralMagic[:]) {
+			return nil, errors.New("encryption: not an ephemeral stream")
+		}
+		if _, err := middleware.CheckVersion("encryption", hdr[3], EphemeralFormatVersion, middleware.RejectUnknown); err != nil {
+			return nil, err
+		}
+		var id StreamID
+		copy(id[:], hdr[4:])
+		key, ok := e.registry.get(id)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownStream, id)
+		}
+		return sio.DecryptReader(r, sio.Config{
+			Key:          key,
+			CipherSuites: readCipherSuites(e.cipherSuite),
+		})
+	})
+}
+
+// headerWriter writes a header ahead of the first write, or on Close for
+// empty streams, and passes Close through to the underlying writer
+type headerWriter struct {
+	w      io.Writer
+	header []byte
+}
+
+func (h *headerWriter) flushHeader() error {
+	if h.header == nil {
+		return nil
+	}
+	hdr := h.header
+	h.header = nil
+	_, err := h.w.Write(hdr)
+	return err
+}
+
+func (h *headerWriter) Write(p []byte) (int, error) {
+	if err := h.flushHeader(); err != nil {
+		return 0, err
+	}
+	return h.w.Write(p)
+}
+
+func (h *headerWriter) Close() error {
+	if err := h.flushHeader(); err != nil {
+		return err
+	}
+	if c, ok := h.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// lazyReader defers reader construction to the first Read, so that header
+// parsing errors can be reported through the io.Reader interface
+type lazyReader struct {
+	init  func() (io.Reader, error)
+	r     io.Reader
+	state middleware.ReaderState
+}
+
+func newLazyReader(init func() (io.Reader, error)) *lazyReader {
+	return &lazyReader{init: init, state: middleware.ReaderState{Layer: "encryption"}}
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if err := l.state.Err(); err != nil {
+		return 0, err
+	}
+	if l.r == nil {
+		r, err := l.init()
+		if err != nil {
+			return l.state.Track(0, err)
+		}
+		l.r = r
+	}
+	return l.state.Track(l.r.Read(p))
+}
@@ -0,0 +1,68 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/minio/sio"
+)
+
+// ErrNotFIPSApproved is returned by NewE and Readers in FIPS mode for
+// algorithms that are not FIPS approved
+var ErrNotFIPSApproved = errors.New("encryption: algorithm not FIPS approved")
+
+// WithFIPSMode restricts the middleware to FIPS approved algorithms: the
+// cipher suite must be AES-256-GCM, and NewE fails with ErrNotFIPSApproved
+// if ChaCha20-Poly1305, scrypt or an X25519 recipient without ML-KEM is
+// configured. Readers reject streams using these algorithms instead of
+// decrypting them. HKDF, PBKDF2, AES key wrap and hybrid recipients remain
+// available.
+//
+// The middleware uses the standard library implementations, so with the
+// Go FIPS 140-3 module (GODEBUG=fips140=on, Go 1.24 and later) or a
+// boringcrypto toolchain all of its cryptography runs in the validated
+// module; FIPSModule reports which one is active. The system generator
+// must be kept: NewE fails with ErrNotFIPSApproved if WithRand or
+// middleware.SetRand replaced it, as that bypasses the module's DRBG.
+func WithFIPSMode() Option {
+	return func(m *Middleware) {
+		m.fips = true
+	}
+}
+
+// FIPSModule returns the name of the FIPS validated crypto module the
+// standard library runs in, or false if none is enabled
+func FIPSModule() (string, bool) {
+	return fipsModule()
+}
+
+// checkFIPS validates the configuration in FIPS mode
+func (m *Middleware) checkFIPS() error {
+	if !m.fips {
+		return nil
+	}
+	if m.rand != rand.Reader {
+		return fmt.Errorf("%w: random source other than crypto/rand", ErrNotFIPSApproved)
+	}
+	if m.cipherSuite != sio.AES_256_GCM {
+		return fmt.Errorf("%w: cipher %s", ErrNotFIPSApproved, CipherName(m.cipherSuite))
+	}
+	if m.kdf != nil {
+		if err := checkFIPSKDF(m.kdf.id()); err != nil {
+			return err
+		}
+	}
+	if m.recipientPub != nil && m.recipientPQ == nil {
+		return fmt.Errorf("%w: x25519 recipient without ML-KEM", ErrNotFIPSApproved)
+	}
+	return nil
+}
+
+// checkFIPSKDF rejects key derivation functions that are not FIPS approved
+func checkFIPSKDF(id byte) error {
+	if id == kdfScrypt {
+		return fmt.Errorf("%w: key derivation %s", ErrNotFIPSApproved, kdfName(id))
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !go1.24 && boringcrypto
+
+package encryption
+
+import "crypto/boring"
+
+func fipsModule() (string, bool) {
+	if boring.Enabled() {
+		return "boringcrypto", true
+	}
+	return "", false
+}
@@ -0,0 +1,12 @@
+//go:build go1.24
+
+package encryption
+
+import "crypto/fips140"
+
+func fipsModule() (string, bool) {
+	if fips140.Enabled() {
+		return "go-fips140", true
+	}
+	return "", false
+}
@@ -0,0 +1,7 @@
+//go:build !go1.24 && !boringcrypto
+
+package encryption
+
+func fipsModule() (string, bool) {
+	return "", false
+}
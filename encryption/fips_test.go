@@ -0,0 +1,53 @@
+//go:build !tinygo && !hbmw_tiny
+
+package encryption_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+	"schneider.vip/hybridbuffer/middleware/testrand"
+)
+
+func TestFIPSMode(t *testing.T) {
+	m, err := encryption.NewE(encryption.WithFIPSMode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	w.Write([]byte("approved"))
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(m.Reader(&enc))
+	if err != nil || string(got) != "approved" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestFIPSModeRejects(t *testing.T) {
+	tests := map[string][]encryption.Option{
+		"chacha20":    {encryption.WithCipher(encryption.ChaCha20Poly1305)},
+		"scrypt":      {encryption.WithScryptPassphrase([]byte("secret"), 1<<10, 8, 1)},
+		"custom rand": {encryption.WithRand(testrand.New("fips"))},
+	}
+	for name, opts := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := encryption.NewE(append(opts, encryption.WithFIPSMode())...)
+			if !errors.Is(err, encryption.ErrNotFIPSApproved) {
+				t.Fatalf("got %v, want ErrNotFIPSApproved", err)
+			}
+		})
+	}
+}
+
+func TestFIPSModeRejectsSetRand(t *testing.T) {
+	defer testrand.Install("fips")()
+	if _, err := encryption.NewE(encryption.WithFIPSMode()); !errors.Is(err, encryption.ErrNotFIPSApproved) {
+		t.Fatalf("got %v, want ErrNotFIPSApproved", err)
+	}
+}
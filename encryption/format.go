@@ -0,0 +1,163 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// FormatHeaderVersion is the format version of the format header
+const FormatHeaderVersion = 1
+
+var formatMagic = [3]byte{'H', 'B', 'F'}
+
+// Key modes of the format header, how the stream key was established
+const (
+	keyModeKey       = 1 // WithKey and the key sources, DARE or data key wrapping key
+	keyModeKDF       = 2 // key derivation header follows
+	keyModeProvider  = 3 // KeyProvider, key ID header follows for providers with IDs
+	keyModeRecipient = 4 // X25519 recipient key header follows
+	keyModeHybrid    = 5 // hybrid recipient key header follows
+)
+
+// ErrKeyMismatch is returned by Readers for streams whose format header
+// does not match the key configuration, e.g. a stream encrypted with a
+// passphrase read with a key, or a key that is not configured
+var ErrKeyMismatch = errors.New("encryption: stream key does not match configuration")
+
+// WithFormatHeader writes a format header ahead of every stream, recording
+// the format version, the cipher suite, how the key was established and,
+// for static keys, the fingerprint of the key:
+//
+//	"HBF" | version (1) | cipher suite (1) | key mode (1) | key ID length (1) | key ID
+//
+// Readers detect the header whatever their configuration. They decrypt
+// with the recorded cipher suite, pick the key by its fingerprint instead
+// of trying each of WithDecryptionKeys, and fail with ErrKeyMismatch
+// instead of an authentication error if they are not configured for the
+// stream, which keeps long-term storage readable as configurations drift.
+// The header is authenticated like the authenticated header, except for
+// the key ID, which only selects the key and is replaced when RewrapDataKey
+// wraps the data key with a new key.
+func WithFormatHeader() Option {
+	return func(m *Middleware) {
+		m.formatHeader = true
+	}
+}
+
+// formatHeader holds the fields of a format header
+type formatHeader struct {
+	cipherSuite byte
+	keyMode     byte
+	keyID       string
+}
+
+// keyMode returns the key mode of the configuration
+func (m *Middleware) keyMode() byte {
+	switch {
+	case m.recipientPQ != nil:
+		return keyModeHybrid
+	case m.recipientPub != nil:
+		return keyModeRecipient
+	case m.provider != nil:
+		return keyModeProvider
+	case m.secret != nil:
+		return keyModeKDF
+	default:
+		return keyModeKey
+	}
+}
+
+// keyModeName returns the name of a key mode for error messages
+func keyModeName(mode byte) string {
+	switch mode {
+	case keyModeKey:
+		return "a key"
+	case keyModeKDF:
+		return "key derivation"
+	case keyModeProvider:
+		return "a key provider"
+	case keyModeRecipient:
+		return "an x25519 recipient"
+	case keyModeHybrid:
+		return "a hybrid recipient"
+	default:
+		return fmt.Sprintf("key mode %#x", mode)
+	}
+}
+
+// marshalFormatHeader returns the format header of a new stream
+func (m *Middleware) marshalFormatHeader() []byte {
+	return (&formatHeader{cipherSuite: m.cipherSuite, keyMode: m.keyMode()}).marshal(m.key)
+}
+
+// marshal encodes the header with the fingerprint of key as key ID in key
+// mode keyModeKey
+func (h *formatHeader) marshal(key []byte) []byte {
+	var id string
+	if h.keyMode == keyModeKey {
+		id = keyFingerprint(key)
+	}
+	hdr := make([]byte, 0, len(formatMagic)+4+len(id))
+	hdr = append(hdr, formatMagic[:]...)
+	hdr = append(hdr, FormatHeaderVersion, h.cipherSuite, h.keyMode, byte(len(id)))
+	return append(hdr, id...)
+}
+
+// formatBinding returns the part of a raw format header the stream key is
+// bound to: magic, version, cipher suite and key mode. The key ID is left
+// out, so RewrapDataKey can replace it without re-encrypting the stream.
+func formatBinding(raw []byte) []byte {
+	return raw[:len(formatMagic)+3]
+}
+
+// readFormatHeader reads the format header if the stream starts with one
+// and checks it against the configuration. It returns the header, its raw
+// bytes and r with the bytes read ahead restored for streams without.
+func (m *Middleware) readFormatHeader(r io.Reader) (*formatHeader, []byte, io.Reader, error) {
+	fixed := make([]byte, len(formatMagic)+4)
+	n, err := io.ReadFull(r, fixed)
+	if n < len(formatMagic) || !bytes.Equal(fixed[:3], formatMagic[:]) {
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, r, err
+		}
+		return nil, nil, io.MultiReader(bytes.NewReader(fixed[:n]), r), nil
+	}
+	if err != nil {
+		return nil, nil, r, fmt.Errorf("encryption: read format header: %w", err)
+	}
+	if _, err := middleware.CheckVersion("encryption", fixed[3], FormatHeaderVersion, middleware.RejectUnknown); err != nil {
+		return nil, nil, r, err
+	}
+	raw := append(fixed, make([]byte, fixed[6])...)
+	if _, err := io.ReadFull(r, raw[len(fixed):]); err != nil {
+		return nil, nil, r, fmt.Errorf("encryption: read format header: %w", err)
+	}
+	h := &formatHeader{cipherSuite: fixed[4], keyMode: fixed[5], keyID: string(raw[len(fixed):])}
+	if !supportedCipher(h.cipherSuite) {
+		return nil, nil, r, fmt.Errorf("%w %s of stream", ErrUnsupportedCipher, CipherName(h.cipherSuite))
+	}
+	if m.fips && h.cipherSuite != m.cipherSuite {
+		return nil, nil, r, fmt.Errorf("%w: cipher %s of stream", ErrNotFIPSApproved, CipherName(h.cipherSuite))
+	}
+	if mode := m.keyMode(); h.keyMode != mode {
+		return nil, nil, r, fmt.Errorf("%w: stream uses %s, configured for %s", ErrKeyMismatch, keyModeName(h.keyMode), keyModeName(mode))
+	}
+	return h, raw, r, nil
+}
+
+// selectKey returns the candidate key with the fingerprint of the header
+func (h *formatHeader) selectKey(keys [][]byte) ([][]byte, error) {
+	if h.keyID == "" {
+		return keys, nil
+	}
+	for _, k := range keys {
+		if keyFingerprint(k) == h.keyID {
+			return [][]byte{k}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: key %s is not configured", ErrKeyMismatch, h.keyID)
+}
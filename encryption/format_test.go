@@ -0,0 +1,155 @@
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+// formatHeaderSize is the size of the format header of a static key
+// stream: magic, version, cipher suite, key mode, key ID length and the
+// 16 hex digit key fingerprint
+const formatHeaderSize = 3 + 4 + 16
+
+func TestFormatHeaderRoundTrip(t *testing.T) {
+	key := newKey(t)
+	ctx := context.Background()
+	for _, c := range cipherSuites {
+		w := encryption.New(encryption.WithKey(key), encryption.WithCipher(c), encryption.WithFormatHeader())
+		for _, size := range []int{0, 1, 64<<10 + 1} {
+			data := make([]byte, size)
+			enc := encrypt(t, ctx, w, data)
+			if !bytes.HasPrefix(enc, []byte("HBF")) || enc[4] != c {
+				t.Fatalf("format header %x", enc[:formatHeaderSize])
+			}
+			// readers detect the header and use the recorded cipher suite,
+			// whatever their configuration
+			for _, rc := range cipherSuites {
+				r := encryption.New(encryption.WithKey(key), encryption.WithCipher(rc))
+				got, err := decrypt(ctx, r, enc)
+				if err != nil {
+					t.Fatalf("cipher %d read with %d, size %d: %v", c, rc, size, err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("cipher %d read with %d, size %d: round trip mismatch", c, rc, size)
+				}
+			}
+		}
+	}
+
+	// readers configured for the header still read streams without
+	plain := encrypt(t, ctx, encryption.New(encryption.WithKey(key)), []byte("no header"))
+	got, err := decrypt(ctx, encryption.New(encryption.WithKey(key), encryption.WithFormatHeader()), plain)
+	if err != nil || string(got) != "no header" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestFormatHeaderSelectsKey(t *testing.T) {
+	old, cur := newKey(t), newKey(t)
+	ctx := context.Background()
+	enc := encrypt(t, ctx, encryption.New(encryption.WithKey(old), encryption.WithFormatHeader()), []byte("rotated"))
+	r := encryption.New(encryption.WithKey(cur), encryption.WithDecryptionKeys(newKey(t), old))
+	got, err := decrypt(ctx, r, enc)
+	if err != nil || string(got) != "rotated" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := decrypt(ctx, encryption.New(encryption.WithKey(cur)), enc); !errors.Is(err, encryption.ErrKeyMismatch) {
+		t.Fatalf("unknown key: got %v, want ErrKeyMismatch", err)
+	}
+	kdf := encryption.New(encryption.WithHKDF(old, nil, nil))
+	if _, err := decrypt(ctx, kdf, enc); !errors.Is(err, encryption.ErrKeyMismatch) {
+		t.Fatalf("other key mode: got %v, want ErrKeyMismatch", err)
+	}
+}
+
+func TestFormatHeaderHostile(t *testing.T) {
+	key := newKey(t)
+	ctx := context.Background()
+	m := encryption.New(encryption.WithKey(key), encryption.WithFormatHeader())
+	valid := encrypt(t, ctx, m, []byte("described"))
+
+	modify := func(f func(b []byte)) []byte {
+		b := bytes.Clone(valid)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"magic only", valid[:3], nil},
+		{"truncated header", valid[:6], nil},
+		{"truncated key ID", valid[:formatHeaderSize-1], nil},
+		{"unknown version", modify(func(b []byte) { b[3] = 99 }), nil},
+		{"unsupported cipher", modify(func(b []byte) { b[4] = 0x7f }), encryption.ErrUnsupportedCipher},
+		{"other cipher", modify(func(b []byte) { b[4] ^= 1 }), nil},
+		{"other key mode", modify(func(b []byte) { b[5] = 2 }), encryption.ErrKeyMismatch},
+		{"unknown key mode", modify(func(b []byte) { b[5] = 0xff }), encryption.ErrKeyMismatch},
+		{"changed key ID", modify(func(b []byte) { b[10] ^= 1 }), encryption.ErrKeyMismatch},
+		{"longer key ID", modify(func(b []byte) { b[6] = 0xff }), nil},
+		{"flipped package", modify(func(b []byte) { b[len(b)-1] ^= 1 }), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(ctx, m, tt.data)
+			if err == nil {
+				t.Fatal("hostile header accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if len(got) != 0 {
+				t.Fatalf("returned %d bytes of a hostile stream", len(got))
+			}
+		})
+	}
+}
+
+func TestFormatHeaderRewrapDataKey(t *testing.T) {
+	old, cur := newKey(t), newKey(t)
+	ctx := context.Background()
+	for _, wrap := range []encryption.KeyWrap{encryption.AESKeyWrap, encryption.AESGCMKeyWrap} {
+		w := encryption.New(encryption.WithKey(old), encryption.WithDataKeys(wrap), encryption.WithFormatHeader(),
+			encryption.WithReplayToken(randomToken))
+		for _, size := range []int{0, 1, 64<<10 + 1} {
+			data := make([]byte, size)
+			rand.Read(data)
+			enc := encrypt(t, ctx, w, data)
+
+			rotated := encryption.New(encryption.WithKey(cur), encryption.WithDecryptionKeys(old),
+				encryption.WithDataKeys(wrap), encryption.WithFormatHeader())
+			var rewrapped bytes.Buffer
+			if err := rotated.RewrapDataKey(ctx, &rewrapped, bytes.NewReader(enc)); err != nil {
+				t.Fatalf("%s, size %d: %v", wrap, size, err)
+			}
+			if bytes.Equal(rewrapped.Bytes()[7:formatHeaderSize], enc[7:formatHeaderSize]) {
+				t.Fatalf("%s: key ID of the old key kept", wrap)
+			}
+			// the rewrapped stream is read with the new key only
+			got, err := decrypt(ctx, encryption.New(encryption.WithKey(cur), encryption.WithDataKeys(wrap)), rewrapped.Bytes())
+			if err != nil {
+				t.Fatalf("%s, size %d: %v", wrap, size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s, size %d: round trip mismatch", wrap, size)
+			}
+			if _, err := decrypt(ctx, encryption.New(encryption.WithKey(old)), rewrapped.Bytes()); !errors.Is(err, encryption.ErrKeyMismatch) {
+				t.Fatalf("old key: got %v, want ErrKeyMismatch", err)
+			}
+		}
+	}
+
+	// the key ID selects the key wrapping the data key
+	enc := encrypt(t, ctx, encryption.New(encryption.WithKey(old), encryption.WithDataKeys(encryption.AESKeyWrap), encryption.WithFormatHeader()), []byte("data"))
+	unknown := encryption.New(encryption.WithKey(cur), encryption.WithDataKeys(encryption.AESKeyWrap), encryption.WithFormatHeader())
+	if err := unknown.RewrapDataKey(ctx, io.Discard, bytes.NewReader(enc)); !errors.Is(err, encryption.ErrKeyMismatch) {
+		t.Fatalf("unknown key: got %v, want ErrKeyMismatch", err)
+	}
+}
@@ -0,0 +1,143 @@
+// Package gcpkms wraps the stream keys of the sealed encryption middleware
+// with a symmetric Cloud KMS key, named by its full resource name
+// "projects/…/locations/…/keyRings/…/cryptoKeys/…". The ciphertext names
+// the key version, so rotated keys keep decrypting old streams. Failed
+// calls are retried with exponential backoff, see WithRetry.
+//
+// Client takes the Encrypt and Decrypt calls of the
+// cloud.google.com/go/kms/apiv1 client; credentials, e.g. a service
+// account file or workload identity, are configured on that client:
+//
+//	client, err := kms.NewKeyManagementClient(ctx, option.WithCredentialsFile(path))
+//	encryption.NewSealed(gcpkms.New(kmsClient{client}, keyName))
+package gcpkms
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+// Defaults of the call timeout and retry policy
+const (
+	DefaultTimeout  = 10 * time.Second
+	DefaultAttempts = 3
+	DefaultBackoff  = 100 * time.Millisecond
+)
+
+// Client is the subset of the Cloud KMS API used by the sealer
+type Client interface {
+	// Encrypt encrypts plaintext with the key name, binding aad
+	Encrypt(ctx context.Context, name string, plaintext, aad []byte) ([]byte, error)
+
+	// Decrypt decrypts ciphertext with the key name, checking aad
+	Decrypt(ctx context.Context, name string, ciphertext, aad []byte) ([]byte, error)
+}
+
+// Sealer wraps stream keys with a Cloud KMS key
+type Sealer struct {
+	client   Client
+	name     string
+	aad      []byte
+	timeout  time.Duration
+	attempts int
+	backoff  time.Duration
+	retryIf  func(error) bool
+}
+
+// Ensure Sealer implements encryption.KeySealer
+var _ encryption.KeySealer = (*Sealer)(nil)
+
+// Option configures the sealer
+type Option func(*Sealer)
+
+// WithAdditionalData sets the additional authenticated data bound to every
+// wrapped key. It is not stored in the stream, so readers must use the
+// same data.
+func WithAdditionalData(aad []byte) Option {
+	return func(s *Sealer) {
+		s.aad = aad
+	}
+}
+
+// WithTimeout sets the timeout of every KMS call attempt, DefaultTimeout by default
+func WithTimeout(d time.Duration) Option {
+	return func(s *Sealer) {
+		s.timeout = d
+	}
+}
+
+// WithRetry sets the number of attempts per KMS call and the backoff
+// before the first retry, which doubles with every further retry.
+// One attempt disables retries.
+func WithRetry(attempts int, backoff time.Duration) Option {
+	return func(s *Sealer) {
+		s.attempts = max(attempts, 1)
+		s.backoff = backoff
+	}
+}
+
+// WithRetryIf sets the function deciding whether a failed call is retried,
+// e.g. only for the Unavailable and DeadlineExceeded status codes.
+// By default every error except a canceled context is retried.
+func WithRetryIf(fn func(error) bool) Option {
+	return func(s *Sealer) {
+		s.retryIf = fn
+	}
+}
+
+// New creates a sealer using the CryptoKey name, of the form
+// projects/*/locations/*/keyRings/*/cryptoKeys/*
+func New(client Client, name string, opts ...Option) *Sealer {
+	s := &Sealer{
+		client:   client,
+		name:     name,
+		timeout:  DefaultTimeout,
+		attempts: DefaultAttempts,
+		backoff:  DefaultBackoff,
+		retryIf:  func(err error) bool { return !errors.Is(err, context.Canceled) },
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Seal encrypts key with Encrypt
+func (s *Sealer) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	return s.call(ctx, func(ctx context.Context) ([]byte, error) {
+		return s.client.Encrypt(ctx, s.name, key, s.aad)
+	})
+}
+
+// Unseal decrypts a wrapped key with Decrypt
+func (s *Sealer) Unseal(ctx context.Context, wrapped []byte) ([]byte, error) {
+	return s.call(ctx, func(ctx context.Context) ([]byte, error) {
+		return s.client.Decrypt(ctx, s.name, wrapped, s.aad)
+	})
+}
+
+// call runs fn with the timeout and retry policy. Waiting for the next
+// attempt ends early once ctx is done, with its error joined to the last
+// error of fn.
+func (s *Sealer) call(ctx context.Context, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	backoff := s.backoff
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, s.timeout)
+		b, err := fn(callCtx)
+		cancel()
+		if err == nil || attempt >= s.attempts || !s.retryIf(err) {
+			return b, err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errors.Join(ctx.Err(), err)
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
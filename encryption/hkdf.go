@@ -0,0 +1,71 @@
+package encryption
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const kdfHKDF = 2
+
+// maxHKDFField bounds salt and info, both are stored in the stream header
+const maxHKDFField = 255
+
+func init() {
+	kdfParsers[kdfHKDF] = func(params []byte) (kdf, error) {
+		return hkdfKDF{info: params}, nil
+	}
+}
+
+// WithHKDF derives the stream keys from masterKey with HKDF-SHA256, so one
+// master key in the configuration yields separate subkeys per purpose (info)
+// or per stream. With a nil salt every stream gets a random salt and thereby
+// its own key. Salt and info are written to the stream, so readers only
+// need the master key. masterKey must be at least KeySize bytes long; salt
+// and info at most 255 bytes. It cannot be combined with WithKey.
+func WithHKDF(masterKey, salt, info []byte) Option {
+	return func(m *Middleware) {
+		m.secret = masterKey
+		m.kdf = hkdfKDF{fixedSalt: salt, info: info}
+	}
+}
+
+type hkdfKDF struct {
+	fixedSalt []byte
+	info      []byte
+}
+
+func (h hkdfKDF) name() string    { return "hkdf-sha256" }
+func (h hkdfKDF) id() byte        { return kdfHKDF }
+func (h hkdfKDF) salt() []byte    { return h.fixedSalt }
+func (h hkdfKDF) static() bool    { return false }
+func (h hkdfKDF) marshal() []byte { return h.info }
+
+func (h hkdfKDF) describe() map[string]string {
+	salt := "per-stream"
+	if h.fixedSalt != nil {
+		salt = "fixed"
+	}
+	return map[string]string{"salt": salt, "info": hex.EncodeToString(h.info)}
+}
+
+func (h hkdfKDF) check(masterKey []byte) error {
+	if len(masterKey) < KeySize {
+		return fmt.Errorf("%w: HKDF master key must be at least %d bytes, got %d", ErrInvalidKeySize, KeySize, len(masterKey))
+	}
+	if len(h.fixedSalt) > maxHKDFField || len(h.info) > maxHKDFField {
+		return fmt.Errorf("encryption: HKDF salt and info must not exceed %d bytes", maxHKDFField)
+	}
+	return nil
+}
+
+func (h hkdfKDF) derive(masterKey, salt []byte) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, salt, h.info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
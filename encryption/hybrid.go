@@ -0,0 +1,149 @@
+//go:build go1.24
+
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/mlkem"
+	"errors"
+	"fmt"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+const (
+	// HybridPublicKeySize is the size of an encoded HybridPublicKey
+	HybridPublicKeySize = x25519KeySize + mlkem.EncapsulationKeySize768
+
+	// HybridPrivateKeySize is the size of an encoded HybridPrivateKey, the
+	// X25519 private key followed by the ML-KEM-768 seed
+	HybridPrivateKeySize = x25519KeySize + mlkem.SeedSize
+)
+
+func init() {
+	middleware.RegisterFormat("hybrid-recipient-key-header", func(p []byte) (string, int, bool) {
+		n := recipientHeaderSize + mlkem.CiphertextSize768
+		if len(p) < recipientHeaderSize || [3]byte(p[:3]) != hybridMagic {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, x25519 ephemeral key %x, mlkem768 ciphertext", p[3], p[4:recipientHeaderSize]), n, true
+	})
+}
+
+// HybridPublicKey is the public key of a hybrid recipient, an X25519 key
+// and an ML-KEM-768 encapsulation key
+type HybridPublicKey struct {
+	X25519 *ecdh.PublicKey
+	MLKEM  *mlkem.EncapsulationKey768
+}
+
+// HybridPrivateKey is the private key of a hybrid recipient
+type HybridPrivateKey struct {
+	X25519 *ecdh.PrivateKey
+	MLKEM  *mlkem.DecapsulationKey768
+}
+
+// GenerateHybridKey generates a hybrid key pair. The X25519 key is drawn
+// from middleware.Rand(); ML-KEM always uses the system generator.
+func GenerateHybridKey() (*HybridPrivateKey, error) {
+	x, err := ecdh.X25519().GenerateKey(middleware.Rand())
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed to generate X25519 key: %w", err)
+	}
+	k, err := mlkem.GenerateKey768()
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed to generate ML-KEM key: %w", err)
+	}
+	return &HybridPrivateKey{X25519: x, MLKEM: k}, nil
+}
+
+// Public returns the public key of k
+func (k *HybridPrivateKey) Public() *HybridPublicKey {
+	return &HybridPublicKey{X25519: k.X25519.PublicKey(), MLKEM: k.MLKEM.EncapsulationKey()}
+}
+
+// Bytes encodes k as HybridPrivateKeySize bytes
+func (k *HybridPrivateKey) Bytes() []byte {
+	return append(k.X25519.Bytes(), k.MLKEM.Bytes()...)
+}
+
+// Bytes encodes k as HybridPublicKeySize bytes
+func (k *HybridPublicKey) Bytes() []byte {
+	return append(k.X25519.Bytes(), k.MLKEM.Bytes()...)
+}
+
+// ParseHybridPrivateKey decodes a private key encoded by Bytes
+func ParseHybridPrivateKey(b []byte) (*HybridPrivateKey, error) {
+	if len(b) != HybridPrivateKeySize {
+		return nil, fmt.Errorf("encryption: hybrid private key must be %d bytes, got %d", HybridPrivateKeySize, len(b))
+	}
+	x, err := ecdh.X25519().NewPrivateKey(b[:x25519KeySize])
+	if err != nil {
+		return nil, fmt.Errorf("encryption: invalid hybrid private key: %w", err)
+	}
+	k, err := mlkem.NewDecapsulationKey768(b[x25519KeySize:])
+	if err != nil {
+		return nil, fmt.Errorf("encryption: invalid hybrid private key: %w", err)
+	}
+	return &HybridPrivateKey{X25519: x, MLKEM: k}, nil
+}
+
+// ParseHybridPublicKey decodes a public key encoded by Bytes
+func ParseHybridPublicKey(b []byte) (*HybridPublicKey, error) {
+	if len(b) != HybridPublicKeySize {
+		return nil, fmt.Errorf("encryption: hybrid public key must be %d bytes, got %d", HybridPublicKeySize, len(b))
+	}
+	x, err := ecdh.X25519().NewPublicKey(b[:x25519KeySize])
+	if err != nil {
+		return nil, fmt.Errorf("encryption: invalid hybrid public key: %w", err)
+	}
+	k, err := mlkem.NewEncapsulationKey768(b[x25519KeySize:])
+	if err != nil {
+		return nil, fmt.Errorf("encryption: invalid hybrid public key: %w", err)
+	}
+	return &HybridPublicKey{X25519: x, MLKEM: k}, nil
+}
+
+// WithHybridRecipient is like WithRecipientPublicKey, but combines the
+// X25519 key exchange with an ML-KEM-768 key encapsulation. Both the
+// ephemeral X25519 key and the ML-KEM ciphertext are stored in the header
+// and the stream key is derived from both shared secrets, so it stays
+// secret as long as either mechanism is unbroken. ML-KEM encapsulation
+// always uses the system random generator, not WithRand.
+func WithHybridRecipient(pub *HybridPublicKey) Option {
+	return func(m *Middleware) {
+		m.recipientPub = pub.X25519
+		m.recipientPQ = mlkemRecipient{ek: pub.MLKEM}
+	}
+}
+
+// WithHybridPrivateKey decrypts streams written with WithHybridRecipient.
+// Streams encrypted to the X25519 key alone are rejected. It implies
+// WithHybridRecipient(priv.Public()) for writing.
+func WithHybridPrivateKey(priv *HybridPrivateKey) Option {
+	return func(m *Middleware) {
+		m.recipientPub = priv.X25519.PublicKey()
+		m.recipientPriv = priv.X25519
+		m.recipientPQ = mlkemRecipient{ek: priv.MLKEM.EncapsulationKey(), dk: priv.MLKEM}
+	}
+}
+
+type mlkemRecipient struct {
+	ek *mlkem.EncapsulationKey768
+	dk *mlkem.DecapsulationKey768
+}
+
+func (r mlkemRecipient) name() string        { return "mlkem768" }
+func (r mlkemRecipient) ciphertextSize() int { return mlkem.CiphertextSize768 }
+
+func (r mlkemRecipient) encapsulate() ([]byte, []byte, error) {
+	shared, ct := r.ek.Encapsulate()
+	return shared, ct, nil
+}
+
+func (r mlkemRecipient) decapsulate(ct []byte) ([]byte, error) {
+	if r.dk == nil {
+		return nil, errors.New("no ML-KEM decapsulation key")
+	}
+	return r.dk.Decapsulate(ct)
+}
@@ -0,0 +1,85 @@
+package encryption
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+func init() {
+	middleware.RegisterFormat("ephemeral-key-header", func(p []byte) (string, int, bool) {
+		n := len(ephemeralMagic) + 1 + len(StreamID{})
+		if len(p) < n || [3]byte(p[:3]) != ephemeralMagic {
+			return "", 0, false
+		}
+		var id StreamID
+		copy(id[:], p[4:n])
+		return fmt.Sprintf("version %d, stream %s", p[3], id), n, true
+	})
+	middleware.RegisterFormat("authenticated-header", func(p []byte) (string, int, bool) {
+		if len(p) < len(authMagic)+3 || [3]byte(p[:3]) != authMagic {
+			return "", 0, false
+		}
+		size := int(binary.BigEndian.Uint16(p[4:]))
+		return fmt.Sprintf("version %d, %d bytes of fields", p[3], size), len(authMagic) + 3 + size + headerTagSize, true
+	})
+	middleware.RegisterFormat("format-header", func(p []byte) (string, int, bool) {
+		if len(p) < len(formatMagic)+4 || [3]byte(p[:3]) != formatMagic {
+			return "", 0, false
+		}
+		n := len(formatMagic) + 4 + int(p[6])
+		if len(p) < n {
+			return "", 0, false
+		}
+		detail := fmt.Sprintf("version %d, cipher %s, %s", p[3], CipherName(p[4]), keyModeName(p[5]))
+		if n > len(formatMagic)+4 {
+			detail += fmt.Sprintf(", key %s", p[len(formatMagic)+4:n])
+		}
+		return detail, n, true
+	})
+	middleware.RegisterFormat("key-derivation-header", func(p []byte) (string, int, bool) {
+		if len(p) < len(passphraseMagic)+3 || [3]byte(p[:3]) != passphraseMagic {
+			return "", 0, false
+		}
+		n := len(passphraseMagic) + 3 + int(p[5])
+		if len(p) <= n {
+			return "", 0, false
+		}
+		n += 1 + int(p[n])
+		return fmt.Sprintf("version %d, kdf %s", p[3], kdfName(p[4])), n, true
+	})
+	middleware.RegisterFormat("key-id-header", func(p []byte) (string, int, bool) {
+		if len(p) < len(keyIDMagic)+2 || [3]byte(p[:3]) != keyIDMagic {
+			return "", 0, false
+		}
+		n := len(keyIDMagic) + 2 + int(p[4])
+		if len(p) < n {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, key %q", p[3], p[5:n]), n, true
+	})
+	middleware.RegisterFormat("sealed-key-header", func(p []byte) (string, int, bool) {
+		if len(p) < len(sealedMagic)+3 || [3]byte(p[:3]) != sealedMagic {
+			return "", 0, false
+		}
+		size := int(binary.BigEndian.Uint16(p[4:]))
+		return fmt.Sprintf("version %d, sealed key %d bytes", p[3], size), len(sealedMagic) + 3 + size, true
+	})
+	middleware.RegisterFormat("session-key-header", func(p []byte) (string, int, bool) {
+		if len(p) < sessionHeaderSize || [3]byte(p[:3]) != sessionMagic {
+			return "", 0, false
+		}
+		var id SessionID
+		copy(id[:], p[4:])
+		counter := binary.BigEndian.Uint64(p[4+len(id):])
+		size := int(binary.BigEndian.Uint16(p[sessionHeaderSize-2:]))
+		return fmt.Sprintf("version %d, session %s, stream %d, sealed key %d bytes", p[3], id, counter, size), sessionHeaderSize + size + headerTagSize, true
+	})
+	middleware.RegisterFormat("recipient-key-header", func(p []byte) (string, int, bool) {
+		if len(p) < recipientHeaderSize || [3]byte(p[:3]) != recipientMagic {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, x25519 ephemeral key %x", p[3], p[4:recipientHeaderSize]), recipientHeaderSize, true
+	})
+}
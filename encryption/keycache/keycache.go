@@ -0,0 +1,312 @@
+// Package keycache provides a bounded TTL cache for unwrapped data keys.
+//
+// Reading many small buffers whose data keys are wrapped by a remote KMS
+// would otherwise cost one remote unwrap call per buffer. The cache wraps any
+// encryption.KeySealer and remembers unwrapped keys by the hash of their
+// wrapped form. Cached keys are themselves encrypted with a random,
+// process-local key, so a heap dump does not reveal them in plain form.
+package keycache
+
+import (
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+const (
+	// DefaultMaxEntries is the default cache capacity
+	DefaultMaxEntries = 1024
+
+	// DefaultTTL is the default lifetime of a cached key
+	DefaultTTL = 5 * time.Minute
+)
+
+// Stats are cache metrics
+type Stats struct {
+	Hits      uint64 // unwraps served from the cache
+	Misses    uint64 // unwraps passed to the underlying sealer
+	Shared    uint64 // unwraps that waited for a concurrent identical unwrap
+	Errors    uint64 // failed unwraps of the underlying sealer
+	Evictions uint64 // entries removed because the cache was full
+	Expired   uint64 // entries removed because their TTL passed
+	Entries   int    // current number of entries
+}
+
+// Cache is an encryption.KeySealer caching the results of Unseal
+type Cache struct {
+	sealer       encryption.KeySealer
+	maxEntries   int
+	ttl          time.Duration
+	maxStale     time.Duration
+	singleflight bool
+	now          func() time.Time
+
+	aead cipher.AEAD
+	rand io.Reader
+
+	mu       sync.Mutex
+	entries  map[[sha256.Size]byte]*list.Element
+	lru      *list.List
+	inflight map[[sha256.Size]byte]*call
+	stats    Stats
+}
+
+// Ensure Cache implements encryption.KeySealer interface
+var _ encryption.KeySealer = (*Cache)(nil)
+
+type entry struct {
+	id      [sha256.Size]byte
+	nonce   []byte
+	sealed  []byte
+	expires time.Time
+}
+
+type call struct {
+	done chan struct{} // closed once key and err are set
+	key  []byte
+	err  error
+}
+
+// Option configures the cache
+type Option func(*Cache)
+
+// WithMaxEntries bounds the number of cached keys
+func WithMaxEntries(n int) Option {
+	return func(c *Cache) {
+		if n > 0 {
+			c.maxEntries = n
+		}
+	}
+}
+
+// WithTTL sets how long an unwrapped key is cached
+func WithTTL(ttl time.Duration) Option {
+	return func(c *Cache) {
+		if ttl > 0 {
+			c.ttl = ttl
+		}
+	}
+}
+
+// WithMaxStale keeps expired keys for up to d longer, only to be served by
+// Stale, e.g. as fallback while the KMS is unreachable
+func WithMaxStale(d time.Duration) Option {
+	return func(c *Cache) {
+		if d > 0 {
+			c.maxStale = d
+		}
+	}
+}
+
+// WithSingleflight deduplicates concurrent unwraps of the same wrapped key,
+// so a burst of readers for one buffer results in a single remote call.
+// The call runs with the context of the first reader; the others stop
+// waiting for it once their own context is done.
+func WithSingleflight() Option {
+	return func(c *Cache) {
+		c.singleflight = true
+	}
+}
+
+// WithClock sets the time source, for tests
+func WithClock(now func() time.Time) Option {
+	return func(c *Cache) {
+		c.now = now
+	}
+}
+
+// New creates a cache in front of sealer
+func New(sealer encryption.KeySealer, opts ...Option) (*Cache, error) {
+	c := &Cache{
+		sealer:     sealer,
+		maxEntries: DefaultMaxEntries,
+		ttl:        DefaultTTL,
+		now:        time.Now,
+		rand:       middleware.Rand(),
+		entries:    make(map[[sha256.Size]byte]*list.Element),
+		lru:        list.New(),
+		inflight:   make(map[[sha256.Size]byte]*call),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	key := make([]byte, 32)
+	defer clear(key)
+	if _, err := io.ReadFull(c.rand, key); err != nil {
+		return nil, fmt.Errorf("keycache: generate cache key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if c.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Seal passes through to the underlying sealer and primes the cache with the result
+func (c *Cache) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	wrapped, err := c.sealer.Seal(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.store(sha256.Sum256(wrapped), key)
+	c.mu.Unlock()
+	return wrapped, nil
+}
+
+// Unseal returns the cached key for wrapped, or unwraps it with the underlying sealer
+func (c *Cache) Unseal(ctx context.Context, wrapped []byte) ([]byte, error) {
+	id := sha256.Sum256(wrapped)
+	c.mu.Lock()
+	if key, ok := c.lookup(id); ok {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return key, nil
+	}
+	if c.singleflight {
+		if cl, ok := c.inflight[id]; ok {
+			c.stats.Shared++
+			c.mu.Unlock()
+			select {
+			case <-cl.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if cl.err != nil {
+				return nil, cl.err
+			}
+			return append([]byte(nil), cl.key...), nil
+		}
+	}
+	c.stats.Misses++
+	cl := &call{done: make(chan struct{})}
+	if c.singleflight {
+		c.inflight[id] = cl
+	}
+	c.mu.Unlock()
+
+	cl.key, cl.err = c.sealer.Unseal(ctx, wrapped)
+
+	c.mu.Lock()
+	if c.singleflight {
+		delete(c.inflight, id)
+	}
+	if cl.err != nil {
+		c.stats.Errors++
+	} else {
+		c.store(id, cl.key)
+	}
+	c.mu.Unlock()
+	close(cl.done)
+	if cl.err != nil {
+		return nil, cl.err
+	}
+	return append([]byte(nil), cl.key...), nil
+}
+
+// Stale returns a cached key for wrapped even if its TTL passed, as long as
+// it is within the WithMaxStale window. It never calls the underlying sealer.
+func (c *Cache) Stale(wrapped []byte) ([]byte, bool) {
+	id := sha256.Sum256(wrapped)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if !c.now().Before(e.expires.Add(c.maxStale)) {
+		c.remove(el)
+		c.stats.Expired++
+		return nil, false
+	}
+	key, err := c.aead.Open(nil, e.nonce, e.sealed, id[:])
+	if err != nil {
+		return nil, false
+	}
+	c.stats.Hits++
+	return key, true
+}
+
+// Stats returns a snapshot of the cache metrics
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Entries = c.lru.Len()
+	return s
+}
+
+// Purge removes all cached keys
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// lookup returns the decrypted key, c.mu must be held
+func (c *Cache) lookup(id [sha256.Size]byte) ([]byte, bool) {
+	el, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if now := c.now(); !now.Before(e.expires) {
+		if !now.Before(e.expires.Add(c.maxStale)) {
+			c.remove(el)
+			c.stats.Expired++
+		}
+		return nil, false
+	}
+	key, err := c.aead.Open(nil, e.nonce, e.sealed, id[:])
+	if err != nil {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return key, true
+}
+
+// store adds a key to the cache, c.mu must be held
+func (c *Cache) store(id [sha256.Size]byte, key []byte) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(c.rand, nonce); err != nil {
+		return // not caching is always safe
+	}
+	e := &entry{
+		id:      id,
+		nonce:   nonce,
+		sealed:  c.aead.Seal(nil, nonce, key, id[:]),
+		expires: c.now().Add(c.ttl),
+	}
+	if el, ok := c.entries[id]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[id] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	clear(e.sealed)
+	delete(c.entries, e.id)
+}
@@ -0,0 +1,242 @@
+package keycache_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/encryption/keycache"
+)
+
+var errKMS = errors.New("kms unavailable")
+
+// xorSealer is a stand-in for a remote KMS. It counts Unseal calls and can
+// be made to fail or to block until released.
+type xorSealer struct {
+	unseals atomic.Int32
+	fail    atomic.Bool
+	gate    chan struct{} // if set, Unseal waits for it to be closed
+}
+
+func (s *xorSealer) Seal(_ context.Context, key []byte) ([]byte, error) {
+	out := make([]byte, len(key))
+	for i, b := range key {
+		out[i] = b ^ 0x5a
+	}
+	return out, nil
+}
+
+func (s *xorSealer) Unseal(ctx context.Context, sealed []byte) ([]byte, error) {
+	s.unseals.Add(1)
+	if s.gate != nil {
+		<-s.gate
+	}
+	if s.fail.Load() {
+		return nil, errKMS
+	}
+	return s.Seal(ctx, sealed)
+}
+
+// clock is a manually advanced time source
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time          { return c.t }
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newCache(t *testing.T, s *xorSealer, opts ...keycache.Option) *keycache.Cache {
+	t.Helper()
+	c, err := keycache.New(s, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func unseal(t *testing.T, c *keycache.Cache, wrapped, want []byte) {
+	t.Helper()
+	ctx := context.Background()
+	got, err := c.Unseal(ctx, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got key %x, want %x", got, want)
+	}
+}
+
+func TestCacheHits(t *testing.T) {
+	ctx := context.Background()
+	s := &xorSealer{}
+	c := newCache(t, s)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	wrapped, _ := s.Seal(ctx, key)
+
+	for i := 0; i < 3; i++ {
+		got, err := c.Unseal(ctx, wrapped)
+		if err != nil || !bytes.Equal(got, key) {
+			t.Fatalf("got %x, %v", got, err)
+		}
+		// callers own the returned key and may wipe it
+		clear(got)
+	}
+	if n := s.unseals.Load(); n != 1 {
+		t.Fatalf("%d remote unseals, want 1", n)
+	}
+	if st := c.Stats(); st.Hits != 2 || st.Misses != 1 || st.Entries != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+
+	// Seal primes the cache
+	other := bytes.Repeat([]byte{7}, 32)
+	wrappedOther, err := c.Seal(ctx, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unseal(t, c, wrappedOther, other)
+	if n := s.unseals.Load(); n != 1 {
+		t.Fatalf("%d remote unseals after Seal, want 1", n)
+	}
+
+	c.Purge()
+	unseal(t, c, wrapped, key)
+	if n := s.unseals.Load(); n != 2 {
+		t.Fatalf("%d remote unseals after Purge, want 2", n)
+	}
+}
+
+func TestCacheErrorsNotCached(t *testing.T) {
+	ctx := context.Background()
+	s := &xorSealer{}
+	c := newCache(t, s)
+	s.fail.Store(true)
+	if _, err := c.Unseal(ctx, []byte("wrapped")); !errors.Is(err, errKMS) {
+		t.Fatalf("got %v, want errKMS", err)
+	}
+	s.fail.Store(false)
+	want, _ := s.Seal(ctx, []byte("wrapped"))
+	unseal(t, c, []byte("wrapped"), want)
+	if st := c.Stats(); st.Errors != 1 || st.Misses != 2 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	clk := &clock{t: time.Unix(1700000000, 0)}
+	s := &xorSealer{}
+	c := newCache(t, s, keycache.WithTTL(time.Minute), keycache.WithMaxStale(time.Hour), keycache.WithClock(clk.now))
+	key := []byte("expiring")
+	wrapped, _ := c.Seal(ctx, key)
+
+	clk.advance(59 * time.Second)
+	unseal(t, c, wrapped, key)
+	if s.unseals.Load() != 0 {
+		t.Fatal("unsealed remotely within the TTL")
+	}
+
+	// past the TTL Unseal asks the sealer, Stale still serves the old entry
+	clk.advance(2 * time.Second)
+	s.fail.Store(true)
+	if _, err := c.Unseal(ctx, wrapped); !errors.Is(err, errKMS) {
+		t.Fatalf("got %v, want errKMS", err)
+	}
+	if got, ok := c.Stale(wrapped); !ok || !bytes.Equal(got, key) {
+		t.Fatalf("stale: got %x, %v", got, ok)
+	}
+
+	// past the stale window the entry is gone
+	clk.advance(time.Hour)
+	if _, ok := c.Stale(wrapped); ok {
+		t.Fatal("stale entry served after the stale window")
+	}
+	if st := c.Stats(); st.Expired != 1 || st.Entries != 0 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	s := &xorSealer{}
+	c := newCache(t, s, keycache.WithMaxEntries(2))
+	a, _ := c.Seal(ctx, []byte("a"))
+	b, _ := c.Seal(ctx, []byte("b"))
+	unseal(t, c, a, []byte("a")) // a is now most recently used
+	c.Seal(ctx, []byte("c"))     // evicts b
+
+	unseal(t, c, a, []byte("a"))
+	if s.unseals.Load() != 0 {
+		t.Fatal("recently used entry evicted")
+	}
+	unseal(t, c, b, []byte("b"))
+	if s.unseals.Load() != 1 {
+		t.Fatal("least recently used entry kept")
+	}
+	if st := c.Stats(); st.Evictions != 2 || st.Entries != 2 {
+		t.Fatalf("stats %+v", st)
+	}
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	ctx := context.Background()
+	const readers = 8
+	for _, shared := range []bool{false, true} {
+		s := &xorSealer{gate: make(chan struct{})}
+		var opts []keycache.Option
+		if shared {
+			opts = append(opts, keycache.WithSingleflight())
+		}
+		c := newCache(t, s, opts...)
+
+		var wg sync.WaitGroup
+		for i := 0; i < readers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := c.Unseal(ctx, []byte("burst")); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		// wait until every reader either called the sealer or joined a call
+		for {
+			st := c.Stats()
+			if st.Misses+st.Shared == readers {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(s.gate)
+		wg.Wait()
+
+		want := int32(readers)
+		if shared {
+			want = 1
+		}
+		if n := s.unseals.Load(); n != want {
+			t.Fatalf("singleflight %v: %d remote unseals, want %d", shared, n, want)
+		}
+	}
+}
+
+func TestCacheSingleflightWaiterCancels(t *testing.T) {
+	s := &xorSealer{gate: make(chan struct{})}
+	defer close(s.gate)
+	c := newCache(t, s, keycache.WithSingleflight())
+	go c.Unseal(context.Background(), []byte("slow"))
+	for s.unseals.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// a reader joining the blocked call stops waiting with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Unseal(ctx, []byte("slow")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want DeadlineExceeded", err)
+	}
+	if st := c.Stats(); st.Shared != 1 {
+		t.Fatalf("stats %+v, want one shared call", st)
+	}
+}
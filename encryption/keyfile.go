@@ -0,0 +1,177 @@
+package encryption
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// ErrKeyEnvNotSet is returned by NewE if the variable of WithKeyEnv is unset
+var ErrKeyEnvNotSet = errors.New("encryption: key environment variable not set")
+
+// WithKeyFile loads the key from a file when the middleware is created.
+// The file holds one key, raw or hex or base64 encoded, or several encoded
+// keys on separate lines: the first is the current key used by Writers,
+// the others are previous keys Readers still accept. Streams record the
+// fingerprint of their key, so a rotated file keeps older streams readable
+// as long as their key stays listed. See WithKeyReload to pick up rotated
+// files. It cannot be combined with WithKey, key derivation or a
+// KeyProvider.
+func WithKeyFile(path string) Option {
+	return func(m *Middleware) {
+		m.keySource = &keySource{name: "file " + path, load: func() ([]byte, error) { return os.ReadFile(path) }}
+	}
+}
+
+// WithKeyEnv loads the key from an environment variable like WithKeyFile,
+// previous keys separated by commas or whitespace
+func WithKeyEnv(name string) Option {
+	return func(m *Middleware) {
+		m.keySource = &keySource{name: "environment variable " + name, load: func() ([]byte, error) {
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				return nil, ErrKeyEnvNotSet
+			}
+			return []byte(v), nil
+		}}
+	}
+}
+
+// WithKeyReload reloads the keys of WithKeyFile or WithKeyEnv when a Writer
+// or Reader is created and the last load is older than interval, so new
+// Writers pick up a rotated key without a restart. Keys once loaded are
+// kept for Readers. Failed reloads keep the loaded keys and are reported
+// to the middleware.OnError hook.
+func WithKeyReload(interval time.Duration) Option {
+	return func(m *Middleware) {
+		m.keyReload = interval
+	}
+}
+
+// keySource is the KeyByIDProvider of WithKeyFile and WithKeyEnv
+type keySource struct {
+	name     string
+	load     func() ([]byte, error)
+	interval time.Duration
+
+	mu      sync.Mutex
+	current string
+	keys    map[string][]byte // by fingerprint
+	loaded  time.Time
+}
+
+// Ensure keySource implements KeyByIDProvider
+var _ KeyByIDProvider = (*keySource)(nil)
+
+// keyFingerprint returns the ID of a key in the key ID header
+func keyFingerprint(key []byte) string {
+	h := sha256.New()
+	h.Write([]byte("hybridbuffer key fingerprint\x00"))
+	h.Write(key)
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// reload reads the keys. The previous keys are kept.
+func (s *keySource) reload() error {
+	s.loaded = time.Now()
+	data, err := s.load()
+	if err != nil {
+		return err
+	}
+	defer clear(data)
+	keys, err := parseKeys(data)
+	if err != nil {
+		return err
+	}
+	if s.keys == nil {
+		s.keys = make(map[string][]byte)
+	}
+	for _, key := range keys {
+		s.keys[keyFingerprint(key)] = key
+	}
+	s.current = keyFingerprint(keys[0])
+	return nil
+}
+
+// parseKeys decodes one raw key or a list of encoded keys, current first
+func parseKeys(data []byte) ([][]byte, error) {
+	if len(data) == KeySize {
+		return [][]byte{append([]byte(nil), data...)}, nil
+	}
+	var keys [][]byte
+	for _, field := range strings.FieldsFunc(string(data), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		key, err := decodeKeySecret([]byte(field))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no key", ErrInvalidKeySize)
+	}
+	return keys, nil
+}
+
+// refresh reloads the keys if the interval passed
+func (s *keySource) refresh() {
+	if s.interval <= 0 || time.Since(s.loaded) < s.interval {
+		return
+	}
+	if err := s.reload(); err != nil {
+		middleware.ReportError("encryption", middleware.OpRead, fmt.Errorf("encryption: reload key from %s: %w", s.name, err))
+	}
+}
+
+// Key returns the current key
+func (s *keySource) Key(ctx context.Context) ([]byte, error) {
+	_, key, err := s.CurrentKey(ctx)
+	return key, err
+}
+
+// CurrentKey returns the current key and its fingerprint
+func (s *keySource) CurrentKey(ctx context.Context) (string, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+	return s.current, s.keys[s.current], nil
+}
+
+// KeyByID returns a loaded key by its fingerprint. Unknown fingerprints
+// trigger a reload if reloading is enabled.
+func (s *keySource) KeyByID(ctx context.Context, id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh()
+	if key, ok := s.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no key with fingerprint %s in %s", id, s.name)
+}
+
+// loadKeySource loads the keys of WithKeyFile or WithKeyEnv and installs
+// the source as key provider
+func (m *Middleware) loadKeySource() error {
+	if m.key != nil || m.secret != nil || m.provider != nil || m.keyring != nil {
+		return errors.New("encryption: WithKeyFile and WithKeyEnv cannot be combined with WithKey, key derivation, WithKeyFromKeyring or WithKeyProvider")
+	}
+	s := m.keySource
+	s.interval = m.keyReload
+	if err := s.reload(); err != nil {
+		if errors.Is(err, ErrKeyEnvNotSet) || errors.Is(err, ErrInvalidKeySize) {
+			return fmt.Errorf("%w (%s)", err, s.name)
+		}
+		return fmt.Errorf("encryption: load key from %s: %w", s.name, err)
+	}
+	m.provider, m.keySource = s, nil
+	return nil
+}
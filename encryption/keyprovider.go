@@ -0,0 +1,127 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// KeyIDFormatVersion is the format version of the key ID header
+const KeyIDFormatVersion = 1
+
+var keyIDMagic = [3]byte{'H', 'B', 'I'}
+
+// maxKeyIDSize bounds the key ID stored in the header
+const maxKeyIDSize = 255
+
+// KeyProvider supplies keys at Writer and Reader creation instead of New,
+// e.g. from a secret manager, so they can be refreshed or resolved lazily.
+// Keys must be KeySize bytes long and must not be modified after they were
+// returned.
+type KeyProvider interface {
+	// Key returns the current key
+	Key(ctx context.Context) ([]byte, error)
+}
+
+// KeyByIDProvider is implemented by providers whose keys have IDs. The ID
+// of the current key is written to every stream, so Readers resolve the key
+// a stream was written with even after the current key changed.
+type KeyByIDProvider interface {
+	KeyProvider
+
+	// CurrentKey returns the current key and its ID of at most 255 bytes
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+
+	// KeyByID returns the key with the given ID
+	KeyByID(ctx context.Context, id string) ([]byte, error)
+}
+
+// WithKeyProvider resolves the key of every stream with p. The context of
+// WriterContext and ReaderContext is passed on, Writer and Reader use
+// context.Background(). It cannot be combined with WithKey or key derivation.
+func WithKeyProvider(p KeyProvider) Option {
+	return func(m *Middleware) {
+		m.provider = p
+	}
+}
+
+// checkKey validates a key returned by the provider
+func checkKey(key []byte) error {
+	if len(key) != KeySize {
+		return fmt.Errorf("%w: provider key must be %d bytes, got %d", ErrInvalidKeySize, KeySize, len(key))
+	}
+	return nil
+}
+
+// providerKey returns the current key of the provider and the key ID
+// header to write ahead of the stream
+func (m *Middleware) providerKey(ctx context.Context) ([]byte, []byte, error) {
+	var (
+		key []byte
+		hdr []byte
+		err error
+	)
+	if p, ok := m.provider.(KeyByIDProvider); ok {
+		var id string
+		id, key, err = p.CurrentKey(ctx)
+		if err == nil && len(id) > maxKeyIDSize {
+			err = fmt.Errorf("key ID has %d bytes, at most %d are supported", len(id), maxKeyIDSize)
+		}
+		hdr = make([]byte, 0, len(keyIDMagic)+2+len(id))
+		hdr = append(hdr, keyIDMagic[:]...)
+		hdr = append(hdr, KeyIDFormatVersion, byte(len(id)))
+		hdr = append(hdr, id...)
+	} else {
+		key, err = m.provider.Key(ctx)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: key provider: %w", err)
+	}
+	if err := checkKey(key); err != nil {
+		return nil, nil, err
+	}
+	return key, hdr, nil
+}
+
+// readProviderKey resolves the key of a stream read from r by the ID in
+// its header. Streams without header, e.g. written before the provider had
+// IDs, use the current key. It returns r with the bytes read ahead restored.
+func (m *Middleware) readProviderKey(ctx context.Context, r io.Reader) ([]byte, io.Reader, error) {
+	p, ok := m.provider.(KeyByIDProvider)
+	if !ok {
+		key, err := m.provider.Key(ctx)
+		if err != nil {
+			return nil, r, fmt.Errorf("encryption: key provider: %w", err)
+		}
+		return key, r, checkKey(key)
+	}
+	var fixed [len(keyIDMagic) + 2]byte
+	n, err := io.ReadFull(r, fixed[:])
+	if n < len(keyIDMagic) || !bytes.Equal(fixed[:3], keyIDMagic[:]) {
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, r, err
+		}
+		key, err := p.Key(ctx)
+		if err != nil {
+			return nil, r, fmt.Errorf("encryption: key provider: %w", err)
+		}
+		return key, io.MultiReader(bytes.NewReader(fixed[:n]), r), checkKey(key)
+	}
+	if err != nil {
+		return nil, r, fmt.Errorf("encryption: read key ID header: %w", err)
+	}
+	if fixed[3] != KeyIDFormatVersion {
+		return nil, r, fmt.Errorf("%w: key ID header version %d", ErrHeaderCorrupt, fixed[3])
+	}
+	id := make([]byte, fixed[4])
+	if _, err := io.ReadFull(r, id); err != nil {
+		return nil, r, fmt.Errorf("encryption: read key ID header: %w", err)
+	}
+	key, err := p.KeyByID(ctx, string(id))
+	if err != nil {
+		return nil, r, fmt.Errorf("encryption: key provider: key %q: %w", id, err)
+	}
+	return key, r, checkKey(key)
+}
@@ -0,0 +1,76 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrKeyringUnsupported is returned by NewE for WithKeyFromKeyring on
+	// platforms without a supported keyring
+	ErrKeyringUnsupported = errors.New("encryption: OS keyring not supported on this platform")
+
+	// ErrKeyNotInKeyring is returned by NewE if the keyring has no entry
+	// for the service and account of WithKeyFromKeyring
+	ErrKeyNotInKeyring = errors.New("encryption: key not found in OS keyring")
+)
+
+// keyringEntry names a generic password of the OS keyring
+type keyringEntry struct {
+	service string
+	account string
+}
+
+// WithKeyFromKeyring loads the key from the OS keyring when the middleware
+// is created: the macOS Keychain (security find-generic-password), the
+// Secret Service on Linux and BSD (secret-tool, attributes service and
+// account) or the Windows Credential Manager (generic credential
+// "service:account"). The secret may be the raw KeySize bytes or their hex
+// or base64 encoding. It cannot be combined with WithKey, key derivation
+// or a KeyProvider.
+func WithKeyFromKeyring(service, account string) Option {
+	return func(m *Middleware) {
+		m.keyring = &keyringEntry{service: service, account: account}
+	}
+}
+
+// loadKeyring replaces the keyring entry by the key it holds
+func (m *Middleware) loadKeyring() error {
+	if m.key != nil || m.secret != nil || m.provider != nil {
+		return errors.New("encryption: WithKeyFromKeyring cannot be combined with WithKey, key derivation or WithKeyProvider")
+	}
+	secret, err := readKeyring(m.keyring.service, m.keyring.account)
+	if errors.Is(err, ErrKeyringUnsupported) || errors.Is(err, ErrKeyNotInKeyring) {
+		return fmt.Errorf("%w: service %q, account %q", err, m.keyring.service, m.keyring.account)
+	}
+	if err != nil {
+		return fmt.Errorf("encryption: keyring service %q, account %q: %w", m.keyring.service, m.keyring.account, err)
+	}
+	defer clear(secret)
+	key, err := decodeKeySecret(secret)
+	if err != nil {
+		return err
+	}
+	m.key, m.keyring = key, nil
+	return nil
+}
+
+// decodeKeySecret accepts a raw, hex or base64 encoded key
+func decodeKeySecret(secret []byte) ([]byte, error) {
+	if len(secret) == KeySize {
+		return append([]byte(nil), secret...), nil
+	}
+	s := bytes.TrimSpace(secret)
+	if key, err := hex.DecodeString(string(s)); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if key, err := enc.DecodeString(string(s)); err == nil && len(key) == KeySize {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: not a raw, hex or base64 encoded %d byte key", ErrInvalidKeySize, KeySize)
+}
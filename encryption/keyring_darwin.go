@@ -0,0 +1,20 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+)
+
+// readKeyring reads a generic password from the login keychain
+func readKeyring(service, account string) ([]byte, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && exit.ExitCode() == 44 {
+		return nil, ErrKeyNotInKeyring
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out, []byte("\n")), nil
+}
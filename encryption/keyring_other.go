@@ -0,0 +1,7 @@
+//go:build !darwin && !windows && !linux && !freebsd && !openbsd && !netbsd && !dragonfly
+
+package encryption
+
+func readKeyring(service, account string) ([]byte, error) {
+	return nil, ErrKeyringUnsupported
+}
@@ -0,0 +1,24 @@
+//go:build linux || freebsd || openbsd || netbsd || dragonfly
+
+package encryption
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// readKeyring looks the secret up in the Secret Service with secret-tool
+func readKeyring(service, account string) ([]byte, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", service, "account", account).Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, ErrKeyringUnsupported
+	}
+	var exit *exec.ExitError
+	if errors.As(err, &exit) && len(exit.Stderr) == 0 || err == nil && len(out) == 0 {
+		return nil, ErrKeyNotInKeyring
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,33 @@
+package encryption
+
+import "schneider.vip/hybridbuffer/middleware"
+
+// dareMemory estimates the memory of a DARE Writer or Reader, which
+// buffers a package of plaintext and one of ciphertext
+const dareMemory = 2 * (dareHeaderSize + 64<<10 + dareTagSize)
+
+// Ensure the DARE based middlewares report their memory usage
+var (
+	_ middleware.MemoryUser = (*Middleware)(nil)
+	_ middleware.MemoryUser = (*Ephemeral)(nil)
+	_ middleware.MemoryUser = (*Sealed)(nil)
+	_ middleware.MemoryUser = (*Session)(nil)
+)
+
+// MemoryUsage estimates the memory of a Writer or Reader. Readers with
+// previous decryption keys hold the first package once more.
+func (m *Middleware) MemoryUsage() int64 {
+	if len(m.decryptionKeys) > 0 {
+		return dareMemory + dareMemory/2
+	}
+	return dareMemory
+}
+
+// MemoryUsage estimates the memory of a Writer or Reader
+func (e *Ephemeral) MemoryUsage() int64 { return dareMemory }
+
+// MemoryUsage estimates the memory of a Writer or Reader
+func (s *Sealed) MemoryUsage() int64 { return dareMemory }
+
+// MemoryUsage estimates the memory of a Writer or Reader
+func (s *Session) MemoryUsage() int64 { return dareMemory }
@@ -0,0 +1,177 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// PassphraseFormatVersion is the format version of the key derivation header
+const PassphraseFormatVersion = 1
+
+var passphraseMagic = [3]byte{'H', 'B', 'P'}
+
+// saltSize is the size of the random per-stream salt
+const saltSize = 16
+
+// ErrKDFLimit is returned by Readers for streams whose key derivation
+// parameters exceed the limits accepted when reading
+var ErrKDFLimit = errors.New("encryption: key derivation parameters exceed limits")
+
+// kdf derives stream keys from a secret, a passphrase or a master key. Its
+// parameters are written to every stream, so readers only need the secret.
+type kdf interface {
+	// name returns the name of the function for compliance reports
+	name() string
+
+	// describe returns the parameters for compliance reports
+	describe() map[string]string
+
+	// check validates the parameters and the secret
+	check(secret []byte) error
+
+	// salt returns a fixed salt, or nil for a random salt per stream
+	salt() []byte
+
+	// static reports whether the key is derived once from the fixed salt
+	// and used like a key set with WithKey, without header
+	static() bool
+
+	// id identifies the function in the stream header
+	id() byte
+
+	// marshal encodes the parameters for the stream header
+	marshal() []byte
+
+	// derive returns a KeySize bytes key
+	derive(secret, salt []byte) ([]byte, error)
+}
+
+// kdfParsers decode the parameters of a header by KDF id. Parsers enforce
+// the limits accepted when reading, so hostile headers cannot make a reader
+// spend unbounded memory or time.
+var kdfParsers = map[byte]func(params []byte) (kdf, error){}
+
+// kdfName returns the name of a KDF id for diagnostics
+func kdfName(id byte) string {
+	switch id {
+	case kdfScrypt:
+		return "scrypt"
+	case kdfHKDF:
+		return "hkdf-sha256"
+	case kdfPBKDF2:
+		return "pbkdf2"
+	default:
+		return fmt.Sprintf("%#x", id)
+	}
+}
+
+// marshalKDFHeader returns the header of a new stream: magic, version, KDF
+// id, parameters and salt
+func marshalKDFHeader(k kdf, salt []byte) []byte {
+	params := k.marshal()
+	hdr := make([]byte, 0, len(passphraseMagic)+4+len(params)+len(salt))
+	hdr = append(hdr, passphraseMagic[:]...)
+	hdr = append(hdr, PassphraseFormatVersion, k.id(), byte(len(params)))
+	hdr = append(hdr, params...)
+	hdr = append(hdr, byte(len(salt)))
+	return append(hdr, salt...)
+}
+
+// readKDFHeader reads the key derivation header and returns the KDF and salt
+func readKDFHeader(r io.Reader) (kdf, []byte, error) {
+	var fixed [len(passphraseMagic) + 3]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, nil, fmt.Errorf("encryption: read key derivation header: %w", err)
+	}
+	if !bytes.Equal(fixed[:3], passphraseMagic[:]) {
+		return nil, nil, errors.New("encryption: no key derivation header")
+	}
+	if fixed[3] != PassphraseFormatVersion {
+		return nil, nil, fmt.Errorf("%w: key derivation header version %d", ErrHeaderCorrupt, fixed[3])
+	}
+	parse, ok := kdfParsers[fixed[4]]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unknown key derivation function %#x", ErrHeaderCorrupt, fixed[4])
+	}
+	params := make([]byte, fixed[5]+1)
+	if _, err := io.ReadFull(r, params); err != nil {
+		return nil, nil, fmt.Errorf("encryption: read key derivation header: %w", err)
+	}
+	salt := make([]byte, params[len(params)-1])
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, nil, fmt.Errorf("encryption: read key derivation header: %w", err)
+	}
+	k, err := parse(params[:len(params)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	return k, salt, nil
+}
+
+// streamKey returns the key of a new stream and the header to write ahead of
+// it. With key derivation the key is derived from the secret and a salt,
+// with a recipient from a key exchange and with WithDataKeys it is random;
+// these keys must be cleared by the caller.
+func (m *Middleware) streamKey(ctx context.Context) ([]byte, []byte, error) {
+	if m.recipientPub != nil {
+		return m.recipientKey()
+	}
+	if m.provider != nil {
+		key, hdr, err := m.providerKey(ctx)
+		if err != nil || m.keyWrap == 0 {
+			return key, hdr, err
+		}
+		return m.newDataKey(key, hdr)
+	}
+	if m.secret == nil {
+		if m.keyWrap != 0 {
+			return m.newDataKey(m.key, nil)
+		}
+		return m.key, nil, nil
+	}
+	salt := m.kdf.salt()
+	if salt == nil {
+		salt = make([]byte, saltSize)
+		if _, err := io.ReadFull(m.rand, salt); err != nil {
+			return nil, nil, fmt.Errorf("encryption: failed to generate salt: %w", err)
+		}
+	}
+	key, err := m.kdf.derive(m.secret, salt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: failed to derive key: %w", err)
+	}
+	return key, marshalKDFHeader(m.kdf, salt), nil
+}
+
+// readStreamKey returns the key of a stream read from r, deriving it from
+// the secret and the key derivation header if key derivation is configured.
+// The returned reader continues the stream after the key headers.
+func (m *Middleware) readStreamKey(ctx context.Context, r io.Reader) ([]byte, io.Reader, error) {
+	if m.recipientPub != nil {
+		key, err := m.readRecipientKey(r)
+		return key, r, err
+	}
+	if m.provider != nil {
+		return m.readProviderKey(ctx, r)
+	}
+	if m.secret == nil {
+		return m.key, r, nil
+	}
+	k, salt, err := readKDFHeader(r)
+	if err != nil {
+		return nil, r, err
+	}
+	if m.fips {
+		if err := checkFIPSKDF(k.id()); err != nil {
+			return nil, r, err
+		}
+	}
+	key, err := k.derive(m.secret, salt)
+	if err != nil {
+		return nil, r, fmt.Errorf("encryption: failed to derive key: %w", err)
+	}
+	return key, r, nil
+}
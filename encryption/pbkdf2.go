@@ -0,0 +1,125 @@
+package encryption
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strconv"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// PBKDF2Hash selects the PRF of PBKDF2
+type PBKDF2Hash byte
+
+// Hash functions for WithPBKDF2
+const (
+	PBKDF2SHA1   PBKDF2Hash = 1
+	PBKDF2SHA256 PBKDF2Hash = 2
+	PBKDF2SHA512 PBKDF2Hash = 3
+)
+
+// String returns the name of the hash function
+func (h PBKDF2Hash) String() string {
+	switch h {
+	case PBKDF2SHA1:
+		return "sha1"
+	case PBKDF2SHA256:
+		return "sha256"
+	case PBKDF2SHA512:
+		return "sha512"
+	default:
+		return fmt.Sprintf("PBKDF2Hash(%d)", byte(h))
+	}
+}
+
+func (h PBKDF2Hash) new() func() hash.Hash {
+	switch h {
+	case PBKDF2SHA1:
+		return sha1.New
+	case PBKDF2SHA256:
+		return sha256.New
+	case PBKDF2SHA512:
+		return sha512.New
+	default:
+		return nil
+	}
+}
+
+// maxPBKDF2Iterations bounds the iterations accepted when reading
+const maxPBKDF2Iterations = 10_000_000
+
+const kdfPBKDF2 = 3
+
+func init() {
+	kdfParsers[kdfPBKDF2] = parsePBKDF2
+}
+
+// WithPBKDF2 derives keys from passphrase with PBKDF2 using the given
+// iteration count and hash.
+//
+// With a nil salt every stream gets a random salt, written to the stream
+// together with the parameters like WithScryptPassphrase. With a fixed salt
+// the key is derived once and used like a key set with WithKey, without any
+// header, which reads and writes blobs encrypted with a PBKDF2-derived key
+// by other tools. It cannot be combined with WithKey.
+func WithPBKDF2(passphrase, salt []byte, iterations int, h PBKDF2Hash) Option {
+	return func(m *Middleware) {
+		m.secret = passphrase
+		m.kdf = pbkdf2KDF{fixedSalt: salt, iterations: iterations, hash: h}
+	}
+}
+
+type pbkdf2KDF struct {
+	fixedSalt  []byte
+	iterations int
+	hash       PBKDF2Hash
+}
+
+func (p pbkdf2KDF) name() string { return "pbkdf2" }
+func (p pbkdf2KDF) id() byte     { return kdfPBKDF2 }
+func (p pbkdf2KDF) salt() []byte { return p.fixedSalt }
+func (p pbkdf2KDF) static() bool { return p.fixedSalt != nil }
+
+func (p pbkdf2KDF) describe() map[string]string {
+	return map[string]string{
+		"hash":       p.hash.String(),
+		"iterations": strconv.Itoa(p.iterations),
+	}
+}
+
+func (p pbkdf2KDF) check([]byte) error {
+	if p.hash.new() == nil {
+		return fmt.Errorf("encryption: unsupported PBKDF2 hash %v", p.hash)
+	}
+	if p.iterations <= 0 || uint64(p.iterations) > 1<<32-1 {
+		return fmt.Errorf("encryption: invalid PBKDF2 iteration count %d", p.iterations)
+	}
+	return nil
+}
+
+// marshal encodes the hash and the iteration count
+func (p pbkdf2KDF) marshal() []byte {
+	return binary.BigEndian.AppendUint32([]byte{byte(p.hash)}, uint32(p.iterations))
+}
+
+func (p pbkdf2KDF) derive(passphrase, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(passphrase, salt, p.iterations, KeySize, p.hash.new()), nil
+}
+
+func parsePBKDF2(params []byte) (kdf, error) {
+	if len(params) != 5 {
+		return nil, fmt.Errorf("%w: PBKDF2 parameters", ErrHeaderCorrupt)
+	}
+	p := pbkdf2KDF{hash: PBKDF2Hash(params[0]), iterations: int(binary.BigEndian.Uint32(params[1:]))}
+	if err := p.check(nil); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHeaderCorrupt, err)
+	}
+	if p.iterations > maxPBKDF2Iterations {
+		return nil, fmt.Errorf("%w: PBKDF2 iterations %d", ErrKDFLimit, p.iterations)
+	}
+	return p, nil
+}
@@ -0,0 +1,156 @@
+// Package pkcs11 wraps the stream keys of the sealed encryption middleware
+// with a key on a PKCS#11 token, like an HSM or a smartcard. The wrapping
+// key never leaves the token; only the key of the current stream is held
+// in process memory. The CKA_LABEL of the wrapping key and the mechanism
+// are stored with every wrapped key, so readers find the right token key
+// after writers moved on to a new label.
+//
+// Token is implemented over a logged in session of a binding such as
+// github.com/miekg/pkcs11, which keeps this package free of cgo. Calls
+// are serialized unless WithConcurrentToken is set:
+//
+//	encryption.NewSealed(pkcs11.New(session, "hybridbuffer-kek"))
+package pkcs11
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+// DefaultTimeout bounds every token call
+const DefaultTimeout = 10 * time.Second
+
+// Mechanism is a PKCS#11 mechanism type (CKM_*)
+type Mechanism uint32
+
+// Key wrapping mechanisms of AES and RSA keys
+const (
+	// AESKeyWrapPad is CKM_AES_KEY_WRAP_PAD, AES key wrap with padding (RFC 5649)
+	AESKeyWrapPad Mechanism = 0x210a
+
+	// AESKeyWrap is CKM_AES_KEY_WRAP, AES key wrap (RFC 3394)
+	AESKeyWrap Mechanism = 0x2109
+
+	// RSAOAEP is CKM_RSA_PKCS_OAEP. Its parameters are chosen by the Token.
+	RSAOAEP Mechanism = 0x0009
+)
+
+// ErrInvalidBlob is returned by Unseal for sealed keys not written by Seal
+var ErrInvalidBlob = errors.New("pkcs11: invalid wrapped key")
+
+// Token is the subset of a PKCS#11 session used by the sealer. The key is
+// the secret or private key object with the given CKA_LABEL, respectively
+// the public key for RSA encryption.
+type Token interface {
+	// Encrypt encrypts plaintext with the key label (C_EncryptInit, C_Encrypt)
+	Encrypt(ctx context.Context, label string, mech Mechanism, plaintext []byte) ([]byte, error)
+
+	// Decrypt decrypts ciphertext with the key label (C_DecryptInit, C_Decrypt)
+	Decrypt(ctx context.Context, label string, mech Mechanism, ciphertext []byte) ([]byte, error)
+}
+
+// Sealer wraps stream keys with a token key
+type Sealer struct {
+	token      Token
+	label      string
+	mech       Mechanism
+	timeout    time.Duration
+	concurrent bool
+	mu         sync.Mutex
+}
+
+// Ensure Sealer implements encryption.KeySealer
+var _ encryption.KeySealer = (*Sealer)(nil)
+
+// Option configures the sealer
+type Option func(*Sealer)
+
+// WithMechanism sets the wrapping mechanism, AESKeyWrapPad by default
+func WithMechanism(mech Mechanism) Option {
+	return func(s *Sealer) {
+		s.mech = mech
+	}
+}
+
+// WithTimeout sets the timeout of every token call, DefaultTimeout by
+// default. Most PKCS#11 libraries cannot abort a call, so the Token should
+// check the context before starting one.
+func WithTimeout(d time.Duration) Option {
+	return func(s *Sealer) {
+		s.timeout = d
+	}
+}
+
+// WithConcurrentToken lets the sealer call the token from several
+// goroutines at once. By default calls are serialized, since a PKCS#11
+// session must not be used by concurrent operations; set it for tokens
+// that use a session pool.
+func WithConcurrentToken() Option {
+	return func(s *Sealer) {
+		s.concurrent = true
+	}
+}
+
+// New creates a sealer using the token key with CKA_LABEL label, of at
+// most 255 bytes. New panics if the label is empty or too long.
+func New(token Token, label string, opts ...Option) *Sealer {
+	if label == "" || len(label) > 255 {
+		panic(fmt.Sprintf("pkcs11: invalid key label %q", label))
+	}
+	s := &Sealer{token: token, label: label, mech: AESKeyWrapPad, timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// lock serializes token calls unless the token is concurrent
+func (s *Sealer) lock() func() {
+	if s.concurrent {
+		return func() {}
+	}
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// Seal wraps key and prefixes the wrapped key with the key label and the
+// mechanism
+func (s *Sealer) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	defer s.lock()()
+	wrapped, err := s.token.Encrypt(ctx, s.label, s.mech, key)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: wrap key: %w", err)
+	}
+	blob := make([]byte, 0, 1+len(s.label)+4+len(wrapped))
+	blob = append(blob, byte(len(s.label)))
+	blob = append(blob, s.label...)
+	blob = binary.BigEndian.AppendUint32(blob, uint32(s.mech))
+	return append(blob, wrapped...), nil
+}
+
+// Unseal unwraps a key sealed by Seal with the key label and mechanism it
+// names
+func (s *Sealer) Unseal(ctx context.Context, blob []byte) ([]byte, error) {
+	if len(blob) == 0 || len(blob) <= 1+int(blob[0])+4 {
+		return nil, ErrInvalidBlob
+	}
+	n := 1 + int(blob[0])
+	label := string(blob[1:n])
+	mech := Mechanism(binary.BigEndian.Uint32(blob[n : n+4]))
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	defer s.lock()()
+	key, err := s.token.Decrypt(ctx, label, mech, blob[n+4:])
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11: unwrap key with %q: %w", label, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,193 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// RecipientFormatVersion is the format version of the recipient key header
+const RecipientFormatVersion = 1
+
+var (
+	recipientMagic = [3]byte{'H', 'B', 'R'}
+	hybridMagic    = [3]byte{'H', 'B', 'Q'}
+)
+
+// x25519KeySize is the size of an encoded X25519 public key
+const x25519KeySize = 32
+
+// recipientHeaderSize is the size of the recipient key header, magic,
+// version and ephemeral public key
+const recipientHeaderSize = len(recipientMagic) + 1 + x25519KeySize
+
+// pqRecipient adds a post-quantum key encapsulation to the X25519 key
+// exchange of a recipient, see WithHybridRecipient
+type pqRecipient interface {
+	// name returns the name of the mechanism for compliance reports
+	name() string
+
+	// encapsulate returns a new shared secret and its ciphertext
+	encapsulate() (shared, ciphertext []byte, err error)
+
+	// decapsulate returns the shared secret of a ciphertext
+	decapsulate(ciphertext []byte) ([]byte, error)
+
+	// ciphertextSize returns the size of the ciphertext
+	ciphertextSize() int
+}
+
+// ErrNoPrivateKey is returned by Readers of a middleware configured with
+// WithRecipientPublicKey only
+var ErrNoPrivateKey = errors.New("encryption: decryption needs the recipient private key")
+
+// WithRecipientPublicKey encrypts every stream to the holder of the X25519
+// private key belonging to pub. Writers generate an ephemeral key pair per
+// stream, store its public key in the header and derive the stream key
+// from the shared secret with HKDF-SHA256, so producers need no secret at
+// all. It cannot be combined with WithKey, key derivation or a KeyProvider.
+func WithRecipientPublicKey(pub *ecdh.PublicKey) Option {
+	return func(m *Middleware) {
+		m.recipientPub = pub
+	}
+}
+
+// WithRecipientPrivateKey decrypts streams written with
+// WithRecipientPublicKey for the public key of priv. It implies
+// WithRecipientPublicKey(priv.PublicKey()) for writing.
+func WithRecipientPrivateKey(priv *ecdh.PrivateKey) Option {
+	return func(m *Middleware) {
+		m.recipientPriv = priv
+	}
+}
+
+// checkRecipient validates the recipient keys
+func (m *Middleware) checkRecipient() error {
+	if m.key != nil || m.secret != nil || m.provider != nil {
+		return errors.New("encryption: recipient keys cannot be combined with WithKey, key derivation or WithKeyProvider")
+	}
+	if m.recipientPriv != nil {
+		if m.recipientPriv.Curve() != ecdh.X25519() {
+			return errors.New("encryption: recipient private key must be an X25519 key")
+		}
+		if m.recipientPub == nil {
+			m.recipientPub = m.recipientPriv.PublicKey()
+		}
+	}
+	if m.recipientPub.Curve() != ecdh.X25519() {
+		return errors.New("encryption: recipient public key must be an X25519 key")
+	}
+	return nil
+}
+
+// recipientKey returns the key of a new stream encrypted to the recipient
+// and the header holding the ephemeral public key, followed by the
+// post-quantum ciphertext in hybrid mode
+func (m *Middleware) recipientKey() ([]byte, []byte, error) {
+	eph, err := ecdh.X25519().GenerateKey(m.rand)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: failed to generate ephemeral key: %w", err)
+	}
+	shared, err := eph.ECDH(m.recipientPub)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: key exchange: %w", err)
+	}
+	defer clear(shared)
+	ephPub := eph.PublicKey().Bytes()
+	if m.recipientPQ == nil {
+		key, err := recipientStreamKey(shared, ephPub, m.recipientPub.Bytes(), nil, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		hdr := make([]byte, 0, recipientHeaderSize)
+		hdr = append(hdr, recipientMagic[:]...)
+		hdr = append(hdr, RecipientFormatVersion)
+		return key, append(hdr, ephPub...), nil
+	}
+	pqShared, ct, err := m.recipientPQ.encapsulate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: key encapsulation: %w", err)
+	}
+	ikm := append(pqShared, shared...)
+	defer clear(ikm)
+	key, err := recipientStreamKey(ikm, ephPub, m.recipientPub.Bytes(), ct, m.recipientPQ.name())
+	if err != nil {
+		return nil, nil, err
+	}
+	hdr := make([]byte, 0, recipientHeaderSize+len(ct))
+	hdr = append(hdr, hybridMagic[:]...)
+	hdr = append(hdr, RecipientFormatVersion)
+	hdr = append(hdr, ephPub...)
+	return key, append(hdr, ct...), nil
+}
+
+// readRecipientKey reads the recipient key header from r and derives the
+// stream key with the private key
+func (m *Middleware) readRecipientKey(r io.Reader) ([]byte, error) {
+	if m.recipientPriv == nil {
+		return nil, ErrNoPrivateKey
+	}
+	magic := recipientMagic
+	if m.recipientPQ != nil {
+		magic = hybridMagic
+	}
+	var hdr [recipientHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("encryption: read recipient key header: %w", err)
+	}
+	if !bytes.Equal(hdr[:3], magic[:]) {
+		if m.recipientPQ != nil {
+			return nil, errors.New("encryption: no hybrid recipient key header")
+		}
+		return nil, errors.New("encryption: no recipient key header")
+	}
+	if hdr[3] != RecipientFormatVersion {
+		return nil, fmt.Errorf("%w: recipient key header version %d", ErrHeaderCorrupt, hdr[3])
+	}
+	ephPub := hdr[4:]
+	eph, err := ecdh.X25519().NewPublicKey(ephPub)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHeaderCorrupt, err)
+	}
+	shared, err := m.recipientPriv.ECDH(eph)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHeaderCorrupt, err)
+	}
+	defer clear(shared)
+	if m.recipientPQ == nil {
+		return recipientStreamKey(shared, ephPub, m.recipientPub.Bytes(), nil, "")
+	}
+	ct := make([]byte, m.recipientPQ.ciphertextSize())
+	if _, err := io.ReadFull(r, ct); err != nil {
+		return nil, fmt.Errorf("encryption: read recipient key header: %w", err)
+	}
+	pqShared, err := m.recipientPQ.decapsulate(ct)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHeaderCorrupt, err)
+	}
+	ikm := append(pqShared, shared...)
+	defer clear(ikm)
+	return recipientStreamKey(ikm, ephPub, m.recipientPub.Bytes(), ct, m.recipientPQ.name())
+}
+
+// recipientStreamKey derives the stream key from the shared secret, bound
+// to both public keys and, in hybrid mode, the post-quantum ciphertext and
+// mechanism pq
+func recipientStreamKey(shared, ephPub, recipientPub, ct []byte, pq string) ([]byte, error) {
+	salt := make([]byte, 0, 2*x25519KeySize+len(ct))
+	salt = append(append(append(salt, ephPub...), recipientPub...), ct...)
+	info := "hybridbuffer x25519 recipient"
+	if pq != "" {
+		info = "hybridbuffer x25519+" + pq + " recipient"
+	}
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(info)), key); err != nil {
+		return nil, fmt.Errorf("encryption: failed to derive key: %w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,71 @@
+package encryption
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrReplay is returned by replay checks for tokens that were seen before
+	ErrReplay = errors.New("encryption: replayed stream")
+
+	// ErrReplayTokenMissing is returned by a Reader with a replay check for
+	// streams written without a token
+	ErrReplayTokenMissing = errors.New("encryption: stream has no replay token")
+)
+
+// WithReplayToken embeds a token returned by fn, e.g. a unique nonce or a
+// sequence number, in the authenticated header of every stream. The token
+// cannot be changed without failing decryption.
+func WithReplayToken(fn func() ([]byte, error)) Option {
+	return func(m *Middleware) {
+		m.replayToken = fn
+	}
+}
+
+// WithReplayCheck calls fn with the token of every stream before any data
+// is returned. If fn fails, reading fails with its error. Streams without
+// token fail with ErrReplayTokenMissing.
+func WithReplayCheck(fn func(token []byte) error) Option {
+	return func(m *Middleware) {
+		m.replayCheck = fn
+	}
+}
+
+// SeenSet is a replay check remembering every token it has accepted.
+// It is safe for concurrent use.
+type SeenSet struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// NewSeenSet creates an empty seen-set
+func NewSeenSet() *SeenSet {
+	return &SeenSet{seen: make(map[string]struct{})}
+}
+
+// Check accepts a token once and returns ErrReplay afterwards.
+// It can be passed to WithReplayCheck.
+func (s *SeenSet) Check(token []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[string(token)]; ok {
+		return ErrReplay
+	}
+	s.seen[string(token)] = struct{}{}
+	return nil
+}
+
+// Forget removes a token, e.g. once the stream it belongs to expired
+func (s *SeenSet) Forget(token []byte) {
+	s.mu.Lock()
+	delete(s.seen, string(token))
+	s.mu.Unlock()
+}
+
+// Len returns the number of remembered tokens
+func (s *SeenSet) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.seen)
+}
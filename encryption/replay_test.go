@@ -0,0 +1,47 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReplayCheck(t *testing.T) {
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	seen := NewSeenSet()
+	m := New(WithKey(key), WithReplayToken(func() ([]byte, error) {
+		token := make([]byte, 16)
+		_, err := rand.Read(token)
+		return token, err
+	}), WithReplayCheck(seen.Check))
+
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	w.Write([]byte("replay protected"))
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(m.Reader(bytes.NewReader(enc.Bytes())))
+	if err != nil || string(got) != "replay protected" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := io.ReadAll(m.Reader(bytes.NewReader(enc.Bytes()))); !errors.Is(err, ErrReplay) {
+		t.Fatalf("got %v, want ErrReplay", err)
+	}
+
+	// a forged header must not mark its token as seen
+	forged := bytes.Clone(enc.Bytes())
+	forged[len(forged)/2] ^= 1
+	fresh := NewSeenSet()
+	r := New(WithKey(key), WithReplayCheck(fresh.Check)).Reader(bytes.NewReader(forged))
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("expected an error for a forged stream")
+	}
+	if fresh.Len() != 0 {
+		t.Fatal("forged stream recorded its token")
+	}
+}
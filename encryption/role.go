@@ -0,0 +1,19 @@
+package encryption
+
+import "schneider.vip/hybridbuffer/middleware"
+
+// Ensure the encryption middlewares declare their pipeline role
+var (
+	_ middleware.Roled = (*Middleware)(nil)
+	_ middleware.Roled = (*Ephemeral)(nil)
+	_ middleware.Roled = (*Sealed)(nil)
+)
+
+// Role returns middleware.RoleEncryption
+func (m *Middleware) Role() middleware.Role { return middleware.RoleEncryption }
+
+// Role returns middleware.RoleEncryption
+func (e *Ephemeral) Role() middleware.Role { return middleware.RoleEncryption }
+
+// Role returns middleware.RoleEncryption
+func (s *Sealed) Role() middleware.Role { return middleware.RoleEncryption }
@@ -0,0 +1,98 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/minio/sio"
+)
+
+// DARE package layout: a 16 byte header holding the payload length - 1 at
+// offset 2, the payload and a 16 byte tag
+const (
+	dareHeaderSize = 16
+	dareTagSize    = 16
+)
+
+// WithDecryptionKeys sets previous keys accepted by Reader in addition to
+// the current key, which Writer keeps using exclusively. This allows
+// rotating keys without rewriting long-lived buffers.
+//
+// DARE streams carry no key identifier, so Reader tries the current key and
+// then each previous key in order on the first package, which costs one
+// package decryption per rejected key. With WithDataKeys the previous keys
+// unwrap the data keys instead. It cannot be combined with per-stream key
+// derivation.
+func WithDecryptionKeys(keys ...[]byte) Option {
+	return func(m *Middleware) {
+		m.decryptionKeys = keys
+	}
+}
+
+// checkDecryptionKeys validates the previous keys after the current key was set up
+func (m *Middleware) checkDecryptionKeys() error {
+	if len(m.decryptionKeys) == 0 {
+		return nil
+	}
+	if m.secret != nil || m.recipientPub != nil {
+		return errors.New("encryption: WithDecryptionKeys cannot be combined with per-stream key derivation")
+	}
+	for i, k := range m.decryptionKeys {
+		if len(k) != KeySize {
+			return fmt.Errorf("%w: decryption key %d must be %d bytes, got %d", ErrInvalidKeySize, i, KeySize, len(k))
+		}
+	}
+	return nil
+}
+
+// decryptReader returns a DARE decryption reader for r. keyFor maps a
+// stream key to the key of the packages, e.g. binding an authenticated
+// header. With more than one candidate key, the current key followed by
+// the previous keys, the first package is buffered to find the key it was
+// encrypted with.
+func (m *Middleware) decryptReader(r io.Reader, cfg sio.Config, keys [][]byte, keyFor func([]byte) []byte) (io.Reader, error) {
+	if len(keys) == 1 {
+		cfg.Key = keyFor(keys[0])
+		return sio.DecryptReader(r, cfg)
+	}
+	pkg, err := readPackage(r)
+	r = io.MultiReader(bytes.NewReader(pkg), r)
+	if err != nil {
+		// incomplete stream, let sio report it
+		cfg.Key = keyFor(keys[0])
+		return sio.DecryptReader(r, cfg)
+	}
+	var first error
+	for _, k := range keys {
+		cfg.Key = keyFor(k)
+		dec, err := sio.DecryptReader(bytes.NewReader(pkg), cfg)
+		if err != nil {
+			return nil, err
+		}
+		var b [1]byte
+		_, err = dec.Read(b[:])
+		var serr sio.Error
+		if err == nil || err == io.EOF || !errors.As(err, &serr) {
+			return sio.DecryptReader(r, cfg)
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return nil, first
+}
+
+// readPackage reads the first DARE package of a stream
+func readPackage(r io.Reader) ([]byte, error) {
+	pkg := make([]byte, dareHeaderSize)
+	if n, err := io.ReadFull(r, pkg); err != nil {
+		return pkg[:n], err
+	}
+	size := dareHeaderSize + int(binary.LittleEndian.Uint16(pkg[2:4])) + 1 + dareTagSize
+	pkg = append(pkg, make([]byte, size-dareHeaderSize)...)
+	n, err := io.ReadFull(r, pkg[dareHeaderSize:])
+	return pkg[:dareHeaderSize+n], err
+}
@@ -0,0 +1,308 @@
+package s3cse
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+const (
+	ivSize  = 12
+	tagSize = 16
+
+	// maxContentSize is the GCM limit of 2^32 - 2 blocks per message
+	maxContentSize = (1<<32 - 2) * 16
+)
+
+var errContentTooLarge = errors.New("s3cse: content exceeds the AES-GCM limit")
+
+// ghash computes the GCM authenticator incrementally, so that objects of
+// any size can be encrypted as a single AES-GCM message like the S3
+// Encryption Client does, without holding them in memory. It uses the 4 bit
+// table of the generic crypto/cipher implementation.
+type ghash struct {
+	table [16]fieldElement
+	y     fieldElement
+	buf   [16]byte
+	n     int   // bytes in buf
+	size  int64 // bytes hashed
+}
+
+// fieldElement holds a GF(2^128) element, low being the first 8 bytes
+type fieldElement struct {
+	low, high uint64
+}
+
+var reductionTable = [16]uint16{
+	0x0000, 0x1c20, 0x3840, 0x2460, 0x7080, 0x6ca0, 0x48c0, 0x54e0,
+	0xe100, 0xfd20, 0xd940, 0xc560, 0x9180, 0x8da0, 0xa9c0, 0xb5e0,
+}
+
+func reverseBits(i int) int {
+	i = ((i << 2) & 0xc) | ((i >> 2) & 0x3)
+	i = ((i << 1) & 0xa) | ((i >> 1) & 0x5)
+	return i
+}
+
+func double(x fieldElement) fieldElement {
+	d := fieldElement{low: x.low >> 1, high: x.high>>1 | x.low<<63}
+	if x.high&1 == 1 {
+		d.low ^= 0xe100000000000000
+	}
+	return d
+}
+
+func newGHASH(block cipher.Block) *ghash {
+	var h [16]byte
+	block.Encrypt(h[:], h[:])
+	g := &ghash{}
+	x := fieldElement{binary.BigEndian.Uint64(h[:8]), binary.BigEndian.Uint64(h[8:])}
+	g.table[reverseBits(1)] = x
+	for i := 2; i < 16; i += 2 {
+		g.table[reverseBits(i)] = double(g.table[reverseBits(i/2)])
+		t := g.table[reverseBits(i)]
+		g.table[reverseBits(i+1)] = fieldElement{t.low ^ x.low, t.high ^ x.high}
+	}
+	return g
+}
+
+// mul sets y to y * H
+func (g *ghash) mul() {
+	var z fieldElement
+	for i := 0; i < 2; i++ {
+		word := g.y.high
+		if i == 1 {
+			word = g.y.low
+		}
+		for j := 0; j < 64; j += 4 {
+			msw := z.high & 0xf
+			z.high = z.high>>4 | z.low<<60
+			z.low = z.low>>4 ^ uint64(reductionTable[msw])<<48
+			t := &g.table[word&0xf]
+			z.low ^= t.low
+			z.high ^= t.high
+			word >>= 4
+		}
+	}
+	g.y = z
+}
+
+func (g *ghash) block(b []byte) {
+	g.y.low ^= binary.BigEndian.Uint64(b[:8])
+	g.y.high ^= binary.BigEndian.Uint64(b[8:16])
+	g.mul()
+}
+
+// write hashes ciphertext
+func (g *ghash) write(p []byte) {
+	g.size += int64(len(p))
+	if g.n > 0 {
+		k := copy(g.buf[g.n:], p)
+		g.n += k
+		p = p[k:]
+		if g.n < len(g.buf) {
+			return
+		}
+		g.block(g.buf[:])
+		g.n = 0
+	}
+	for len(p) >= 16 {
+		g.block(p[:16])
+		p = p[16:]
+	}
+	g.n = copy(g.buf[:], p)
+}
+
+// sum returns the tag, masked with the encrypted initial counter block j0.
+// There is no additional data.
+func (g *ghash) sum(block cipher.Block, j0 []byte) []byte {
+	if g.n > 0 {
+		clear(g.buf[g.n:])
+		g.block(g.buf[:])
+		g.n = 0
+	}
+	var lens [16]byte
+	binary.BigEndian.PutUint64(lens[8:], uint64(g.size)*8)
+	g.block(lens[:])
+	tag := make([]byte, tagSize)
+	binary.BigEndian.PutUint64(tag[:8], g.y.low)
+	binary.BigEndian.PutUint64(tag[8:], g.y.high)
+	var mask [16]byte
+	block.Encrypt(mask[:], j0)
+	subtle.XORBytes(tag, tag, mask[:])
+	return tag
+}
+
+// gcmStream is the keystream and authenticator of one AES-GCM message
+type gcmStream struct {
+	block cipher.Block
+	j0    []byte
+	ctr   cipher.Stream
+	hash  *ghash
+}
+
+// newGCMStream starts a message with a 12 byte IV. The CTR mode counter
+// increments all 128 bits while GCM increments the low 32 bits; both agree
+// below maxContentSize, which is enforced.
+func newGCMStream(block cipher.Block, iv []byte) *gcmStream {
+	j0 := make([]byte, 16)
+	copy(j0, iv)
+	j0[15] = 1
+	counter := make([]byte, 16)
+	copy(counter, iv)
+	counter[15] = 2
+	return &gcmStream{block: block, j0: j0, ctr: cipher.NewCTR(block, counter), hash: newGHASH(block)}
+}
+
+// writer encrypts the content and appends the tag on Close
+type writer struct {
+	w     io.Writer
+	s     *gcmStream
+	buf   []byte
+	state middleware.WriterState
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if w.s.hash.size+int64(len(p)) > maxContentSize {
+		return 0, w.state.Fail(errContentTooLarge)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), 32<<10)
+		if cap(w.buf) < n {
+			w.buf = make([]byte, 32<<10)
+		}
+		c := w.buf[:n]
+		w.s.ctr.XORKeyStream(c, p[:n])
+		w.s.hash.write(c)
+		if _, err := w.w.Write(c); err != nil {
+			return written, w.state.Fail(err)
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close writes the tag and closes the underlying writer if it is an io.Closer
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if _, err := w.w.Write(w.s.hash.sum(w.s.block, w.s.j0)); err != nil {
+			return err
+		}
+		if c, ok := w.w.(io.Closer); ok {
+			return c.Close()
+		}
+		return nil
+	})
+}
+
+// reader buffers the content and verifies the tag before returning any
+// plaintext
+type reader struct {
+	r       io.Reader
+	s       *gcmStream
+	maxSize int
+	plain   *bytes.Reader
+	state   middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	if r.plain == nil {
+		plain, err := r.open()
+		if err != nil {
+			return r.state.Track(0, err)
+		}
+		r.plain = bytes.NewReader(plain)
+	}
+	return r.state.Track(r.plain.Read(p))
+}
+
+// open reads and authenticates the content and decrypts it in place
+func (r *reader) open() ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r.r, int64(r.maxSize)+tagSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > r.maxSize+tagSize || int64(len(data)-tagSize) > maxContentSize {
+		return nil, ErrTooLarge
+	}
+	if len(data) < tagSize {
+		return nil, ErrTruncated
+	}
+	c, tag := data[:len(data)-tagSize], data[len(data)-tagSize:]
+	r.s.hash.write(c)
+	if subtle.ConstantTimeCompare(r.s.hash.sum(r.s.block, r.s.j0), tag) != 1 {
+		return nil, ErrNotAuthentic
+	}
+	r.s.ctr.XORKeyStream(c, c)
+	return c, nil
+}
+
+// delayedReader decrypts the content as it is read, holding back the last
+// tagSize bytes which are checked against the computed tag at EOF
+type delayedReader struct {
+	r     io.Reader
+	s     *gcmStream
+	buf   []byte // read ahead ciphertext, the last tagSize bytes may be the tag
+	eof   bool
+	state middleware.ReaderState
+}
+
+func (r *delayedReader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	return r.state.Track(r.read(p))
+}
+
+func (r *delayedReader) read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.buf) <= tagSize {
+		if r.eof {
+			return 0, r.finish()
+		}
+		if cap(r.buf)-len(r.buf) < 4<<10 {
+			r.buf = append(make([]byte, 0, tagSize+32<<10), r.buf...)
+		}
+		n, err := r.r.Read(r.buf[len(r.buf):cap(r.buf)])
+		r.buf = r.buf[:len(r.buf)+n]
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	c := r.buf[:min(len(p), len(r.buf)-tagSize)]
+	if r.s.hash.size+int64(len(c)) > maxContentSize {
+		return 0, errContentTooLarge
+	}
+	r.s.hash.write(c)
+	r.s.ctr.XORKeyStream(p, c)
+	r.buf = r.buf[len(c):]
+	return len(c), nil
+}
+
+// finish authenticates the content once the tag was read
+func (r *delayedReader) finish() error {
+	if len(r.buf) != tagSize {
+		return ErrTruncated
+	}
+	if subtle.ConstantTimeCompare(r.s.hash.sum(r.s.block, r.s.j0), r.buf) != 1 {
+		return ErrNotAuthentic
+	}
+	return io.EOF
+}
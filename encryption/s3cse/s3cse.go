@@ -0,0 +1,331 @@
+// Package s3cse encrypts buffers in the envelope format of the Amazon S3
+// Encryption Client, so objects uploaded with the produced metadata can be
+// decrypted by the AWS SDK encryption clients in other languages.
+//
+// Every stream is encrypted as a single AES-256-GCM message with a fresh
+// content key, the ciphertext being followed by the 16 byte tag. The content
+// key is wrapped by a KeyWrapper and stored with the IV in the object
+// metadata. The V2 metadata format is written; S3 Encryption Client v3 reads
+// it with its default commitment policy.
+//
+// Like the AWS clients, the Reader buffers the object and verifies the tag
+// at its end before releasing any plaintext, which limits objects to
+// WithMaxSize. WithDelayedAuthentication releases plaintext before the tag
+// was verified instead, like the delayed authentication mode of the AWS
+// clients.
+package s3cse
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// Metadata keys of the V2 format, without the "x-amz-meta-" prefix S3
+// adds to user metadata
+const (
+	MetaKeyV2         = "x-amz-key-v2"
+	MetaIV            = "x-amz-iv"
+	MetaMatDesc       = "x-amz-matdesc"
+	MetaWrapAlg       = "x-amz-wrap-alg"
+	MetaCEKAlg        = "x-amz-cek-alg"
+	MetaTagLen        = "x-amz-tag-len"
+	MetaKeyV1         = "x-amz-key"
+	MetaContentLength = "x-amz-unencrypted-content-length"
+)
+
+// ContentAlgorithm is the x-amz-cek-alg value of the content encryption
+const ContentAlgorithm = "AES/GCM/NoPadding"
+
+// DefaultMaxSize is the default limit of the content size Readers buffer
+// to authenticate it, the buffer size of the AWS clients
+const DefaultMaxSize = 64 << 20
+
+const (
+	contentKeySize = 32
+	contentTagLen  = "128"
+)
+
+var (
+	// ErrNotAuthentic is returned by Readers if the content tag does not match
+	ErrNotAuthentic = errors.New("s3cse: message authentication failed")
+
+	// ErrTruncated is returned by Readers for content shorter than the tag
+	ErrTruncated = errors.New("s3cse: truncated content")
+
+	// ErrTooLarge is returned by Readers for content exceeding the maximum
+	// size, see WithMaxSize
+	ErrTooLarge = errors.New("s3cse: content exceeds maximum size")
+
+	// ErrUnsupportedFormat is returned by Readers for metadata of other
+	// formats, e.g. the AES-CBC based V1 format
+	ErrUnsupportedFormat = errors.New("s3cse: unsupported encryption format")
+
+	// ErrNoMetadata is returned if no metadata callback is configured
+	ErrNoMetadata = errors.New("s3cse: no metadata callback configured")
+)
+
+// Metadata is the user metadata of an encrypted object
+type Metadata map[string]string
+
+// KeyWrapper encrypts and decrypts content keys. Its algorithm name is
+// stored in the x-amz-wrap-alg metadata, the material description in
+// x-amz-matdesc.
+type KeyWrapper interface {
+	// WrapAlgorithm returns the x-amz-wrap-alg value, e.g. "AES/GCM" or "kms+context"
+	WrapAlgorithm() string
+
+	// WrapKey encrypts a content key for the given content algorithm and
+	// returns the wrapped key with its material description
+	WrapKey(cek []byte, cekAlg string) (wrapped []byte, matDesc map[string]string, err error)
+
+	// UnwrapKey decrypts a wrapped content key
+	UnwrapKey(wrapped []byte, cekAlg string, matDesc map[string]string) ([]byte, error)
+}
+
+// Middleware encrypts streams in the S3 Encryption Client format
+type Middleware struct {
+	wrapper  KeyWrapper
+	rand     io.Reader
+	onWrite  func(Metadata)
+	metadata func() (Metadata, error)
+	maxSize  int
+	delayed  bool
+}
+
+// Ensure Middleware implements middleware.Middleware, middleware.WriterE and middleware.MemoryUser interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.WriterE    = (*Middleware)(nil)
+	_ middleware.MemoryUser = (*Middleware)(nil)
+)
+
+// Option configures the middleware
+type Option func(*Middleware)
+
+// WithRand sets the source of content keys and IVs.
+// By default middleware.Rand() is used.
+func WithRand(r io.Reader) Option {
+	return func(m *Middleware) {
+		m.rand = r
+	}
+}
+
+// OnMetadata registers the callback receiving the metadata of every new
+// stream before its first byte is written, to be sent with the upload
+func OnMetadata(fn func(Metadata)) Option {
+	return func(m *Middleware) {
+		m.onWrite = fn
+	}
+}
+
+// WithMetadataSource sets the function returning the metadata of the
+// object read by Reader, e.g. from the HeadObject response
+func WithMetadataSource(fn func() (Metadata, error)) Option {
+	return func(m *Middleware) {
+		m.metadata = fn
+	}
+}
+
+// WithMaxSize sets the maximum content size of an object, DefaultMaxSize
+// by default. Readers hold up to this many bytes in memory.
+func WithMaxSize(n int) Option {
+	return func(m *Middleware) {
+		m.maxSize = n
+	}
+}
+
+// WithDelayedAuthentication makes Readers release plaintext before the tag
+// at the end of the object was verified, so objects of any size are read
+// without buffering them. Data is only authentic once Read returned io.EOF;
+// ErrNotAuthentic is returned instead for tampered objects. Only use it if
+// the consumer discards everything read on an error: in a chain, the next
+// layers parse unauthenticated data.
+func WithDelayedAuthentication() Option {
+	return func(m *Middleware) {
+		m.delayed = true
+	}
+}
+
+// New creates a middleware wrapping content keys with w
+func New(w KeyWrapper, opts ...Option) *Middleware {
+	m := &Middleware{wrapper: w, maxSize: DefaultMaxSize}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.rand == nil {
+		m.rand = middleware.Rand()
+	}
+	return m
+}
+
+// MemoryUsage reports the content buffered by Readers, unless
+// authentication is delayed
+func (m *Middleware) MemoryUsage() int64 {
+	if m.delayed {
+		return 32<<10 + tagSize
+	}
+	return int64(m.maxSize) + tagSize
+}
+
+// Writer encrypts w and reports the metadata to the OnMetadata callback.
+// Errors are returned from the first Write or Close, see WriterE.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	wc, err := m.WriterE(w)
+	if err != nil {
+		return &errWriter{err: err}
+	}
+	return wc
+}
+
+// WriterE is like Writer, but returns key generation and wrapping errors
+// immediately
+func (m *Middleware) WriterE(w io.Writer) (io.WriteCloser, error) {
+	if m.onWrite == nil {
+		return nil, ErrNoMetadata
+	}
+	wc, md, err := m.Encrypt(w)
+	if err != nil {
+		return nil, err
+	}
+	m.onWrite(md)
+	return wc, nil
+}
+
+// Encrypt starts a new encrypted stream on w and returns its metadata.
+// The writer must be closed to append the tag.
+func (m *Middleware) Encrypt(w io.Writer) (io.WriteCloser, Metadata, error) {
+	buf := make([]byte, contentKeySize+ivSize)
+	if _, err := io.ReadFull(m.rand, buf); err != nil {
+		return nil, nil, fmt.Errorf("s3cse: failed to generate content key: %w", err)
+	}
+	defer clear(buf)
+	cek, iv := buf[:contentKeySize], buf[contentKeySize:]
+	wrapped, matDesc, err := m.wrapper.WrapKey(cek, ContentAlgorithm)
+	if err != nil {
+		return nil, nil, fmt.Errorf("s3cse: failed to wrap content key: %w", err)
+	}
+	if matDesc == nil {
+		matDesc = map[string]string{}
+	}
+	desc, err := json.Marshal(matDesc)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, nil, err
+	}
+	md := Metadata{
+		MetaKeyV2:   base64.StdEncoding.EncodeToString(wrapped),
+		MetaIV:      base64.StdEncoding.EncodeToString(iv),
+		MetaMatDesc: string(desc),
+		MetaWrapAlg: m.wrapper.WrapAlgorithm(),
+		MetaCEKAlg:  ContentAlgorithm,
+		MetaTagLen:  contentTagLen,
+	}
+	return &writer{w: w, s: newGCMStream(block, iv), state: middleware.WriterState{Layer: "s3cse"}}, md, nil
+}
+
+// Reader decrypts r with the metadata of the WithMetadataSource function.
+// Errors are returned from Read.
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	if m.metadata == nil {
+		return &errReader{err: ErrNoMetadata}
+	}
+	md, err := m.metadata()
+	if err != nil {
+		return &errReader{err: err}
+	}
+	dec, err := m.Decrypt(r, md)
+	if err != nil {
+		return &errReader{err: err}
+	}
+	return dec
+}
+
+// Decrypt returns a reader decrypting the content r of an object with metadata md
+func (m *Middleware) Decrypt(r io.Reader, md Metadata) (io.Reader, error) {
+	if md[MetaKeyV2] == "" {
+		if md[MetaKeyV1] != "" {
+			return nil, fmt.Errorf("%w: V1 metadata", ErrUnsupportedFormat)
+		}
+		return nil, fmt.Errorf("%w: no %s metadata", ErrUnsupportedFormat, MetaKeyV2)
+	}
+	if alg := md[MetaCEKAlg]; alg != ContentAlgorithm {
+		return nil, fmt.Errorf("%w: content algorithm %q", ErrUnsupportedFormat, alg)
+	}
+	if tl := md[MetaTagLen]; tl != "" && tl != contentTagLen {
+		return nil, fmt.Errorf("%w: tag length %s", ErrUnsupportedFormat, tl)
+	}
+	if alg := md[MetaWrapAlg]; alg != m.wrapper.WrapAlgorithm() {
+		return nil, fmt.Errorf("%w: wrapping algorithm %q", ErrUnsupportedFormat, alg)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(md[MetaKeyV2])
+	if err != nil {
+		return nil, fmt.Errorf("s3cse: invalid %s metadata: %w", MetaKeyV2, err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(md[MetaIV])
+	if err != nil || len(iv) != ivSize {
+		return nil, fmt.Errorf("s3cse: invalid %s metadata", MetaIV)
+	}
+	matDesc := map[string]string{}
+	if desc := md[MetaMatDesc]; desc != "" {
+		if err := json.Unmarshal([]byte(desc), &matDesc); err != nil {
+			return nil, fmt.Errorf("s3cse: invalid %s metadata: %w", MetaMatDesc, err)
+		}
+	}
+	cek, err := m.wrapper.UnwrapKey(wrapped, ContentAlgorithm, matDesc)
+	if err != nil {
+		return nil, fmt.Errorf("s3cse: failed to unwrap content key: %w", err)
+	}
+	defer clear(cek)
+	if len(cek) != contentKeySize {
+		return nil, fmt.Errorf("s3cse: content key has %d bytes", len(cek))
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	s := newGCMStream(block, iv)
+	if m.delayed {
+		return &delayedReader{r: r, s: s, state: middleware.ReaderState{Layer: "s3cse"}}, nil
+	}
+	return &reader{r: r, s: s, maxSize: m.maxSize, state: middleware.ReaderState{Layer: "s3cse"}}, nil
+}
+
+type errWriter struct {
+	err error
+}
+
+func (e *errWriter) Write([]byte) (int, error) { return 0, e.err }
+func (e *errWriter) Close() error              { return e.err }
+
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) { return 0, e.err }
+
+// Ensure Middleware describes itself for compliance reports
+var _ middleware.Describer = (*Middleware)(nil)
+
+// Describe reports the content cipher and the key wrapping algorithm
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:      string(middleware.RoleEncryption),
+		Algorithm: "aes-256-gcm",
+		KeyBits:   contentKeySize * 8,
+		Integrity: "aead",
+		Properties: map[string]string{
+			"format":         "s3-cse-v2",
+			"key_management": "envelope",
+			"wrap_alg":       m.wrapper.WrapAlgorithm(),
+		},
+	}
+}
@@ -0,0 +1,371 @@
+package s3cse_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"schneider.vip/hybridbuffer/middleware/encryption/s3cse"
+)
+
+func newWrapper(t *testing.T) *s3cse.AESGCMWrapper {
+	t.Helper()
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+	w, err := s3cse.NewAESGCMWrapper(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+// encrypt writes data in chunks of the given size and returns the object
+// content and metadata
+func encrypt(t *testing.T, m *s3cse.Middleware, data []byte, chunk int) ([]byte, s3cse.Metadata) {
+	t.Helper()
+	var enc bytes.Buffer
+	w, md, err := m.Encrypt(&enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := data; len(p) > 0; {
+		n := min(len(p), chunk)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes(), md
+}
+
+func decrypt(m *s3cse.Middleware, enc []byte, md s3cse.Metadata) ([]byte, error) {
+	r, err := m.Decrypt(bytes.NewReader(enc), md)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+var sizes = []int{0, 1, 15, 16, 17, 255, 4 << 10, 32<<10 + 3, 100<<10 + 5}
+
+func TestMatchesAESGCM(t *testing.T) {
+	// the content is a single AES-GCM message of the content key and IV
+	keyIV := make([]byte, 32+12)
+	rand.Read(keyIV)
+	block, err := aes.NewCipher(keyIV[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range sizes {
+		for _, chunk := range []int{1, 7, 16, 1 << 20} {
+			if size > 4<<10 && chunk < 16 {
+				continue
+			}
+			m := s3cse.New(newWrapper(t), s3cse.WithRand(bytes.NewReader(keyIV)))
+			data := make([]byte, size)
+			rand.Read(data)
+			enc, md := encrypt(t, m, data, chunk)
+			if iv, _ := base64.StdEncoding.DecodeString(md[s3cse.MetaIV]); !bytes.Equal(iv, keyIV[32:]) {
+				t.Fatalf("IV metadata %q", md[s3cse.MetaIV])
+			}
+			want := gcm.Seal(nil, keyIV[32:], data, nil)
+			if !bytes.Equal(enc, want) {
+				t.Fatalf("size %d, chunk %d: content differs from AES-GCM", size, chunk)
+			}
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	wrapper := newWrapper(t)
+	for _, m := range []*s3cse.Middleware{s3cse.New(wrapper), s3cse.New(wrapper, s3cse.WithDelayedAuthentication())} {
+		for _, size := range sizes {
+			data := make([]byte, size)
+			rand.Read(data)
+			enc, md := encrypt(t, m, data, 1<<20)
+			r, err := m.Decrypt(iotest.OneByteReader(bytes.NewReader(enc)), md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("size %d: %v", size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("size %d: round trip mismatch", size)
+			}
+		}
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	wrapper := newWrapper(t)
+	enc, md := encrypt(t, s3cse.New(wrapper), make([]byte, 1000), 1<<20)
+	if got, err := decrypt(s3cse.New(wrapper, s3cse.WithMaxSize(1000)), enc, md); err != nil || len(got) != 1000 {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	if got, err := decrypt(s3cse.New(wrapper, s3cse.WithMaxSize(999)), enc, md); !errors.Is(err, s3cse.ErrTooLarge) || len(got) != 0 {
+		t.Fatalf("got %d bytes, %v; want ErrTooLarge", len(got), err)
+	}
+	// delayed authentication needs no buffer
+	delayed := s3cse.New(wrapper, s3cse.WithMaxSize(999), s3cse.WithDelayedAuthentication())
+	if got, err := decrypt(delayed, enc, md); err != nil || len(got) != 1000 {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestMetadataCallbacks(t *testing.T) {
+	var md s3cse.Metadata
+	m := s3cse.New(newWrapper(t),
+		s3cse.OnMetadata(func(m s3cse.Metadata) { md = m }),
+		s3cse.WithMetadataSource(func() (s3cse.Metadata, error) { return md, nil }))
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	if _, err := w.Write([]byte("object")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		s3cse.MetaCEKAlg:  s3cse.ContentAlgorithm,
+		s3cse.MetaWrapAlg: s3cse.WrapAESGCM,
+		s3cse.MetaTagLen:  "128",
+		s3cse.MetaMatDesc: "{}",
+	} {
+		if md[key] != want {
+			t.Fatalf("%s = %q, want %q", key, md[key], want)
+		}
+	}
+	got, err := io.ReadAll(m.Reader(&enc))
+	if err != nil || string(got) != "object" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	plain := s3cse.New(newWrapper(t))
+	if _, err := plain.WriterE(io.Discard); !errors.Is(err, s3cse.ErrNoMetadata) {
+		t.Fatalf("got %v, want ErrNoMetadata", err)
+	}
+	if _, err := io.ReadAll(plain.Reader(&enc)); !errors.Is(err, s3cse.ErrNoMetadata) {
+		t.Fatalf("got %v, want ErrNoMetadata", err)
+	}
+}
+
+func TestHostileContent(t *testing.T) {
+	wrapper := newWrapper(t)
+	m := s3cse.New(wrapper)
+	delayed := s3cse.New(wrapper, s3cse.WithDelayedAuthentication())
+	msg := make([]byte, 1000)
+	rand.Read(msg)
+	valid, md := encrypt(t, m, msg, 1<<20)
+
+	flip := func(i int) []byte {
+		b := bytes.Clone(valid)
+		b[i] ^= 1
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, s3cse.ErrTruncated},
+		{"shorter than tag", valid[:15], s3cse.ErrTruncated},
+		{"tag only", valid[len(valid)-16:], s3cse.ErrNotAuthentic},
+		{"flipped content", flip(0), s3cse.ErrNotAuthentic},
+		{"flipped tag", flip(len(valid) - 1), s3cse.ErrNotAuthentic},
+		{"truncated", valid[:len(valid)-1], s3cse.ErrNotAuthentic},
+		{"appended data", append(bytes.Clone(valid), 0), s3cse.ErrNotAuthentic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(m, tt.data, md)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if len(got) != 0 {
+				t.Fatalf("returned %d bytes of unauthentic content", len(got))
+			}
+			if _, err := decrypt(delayed, tt.data, md); !errors.Is(err, tt.want) {
+				t.Fatalf("delayed authentication: got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// shortKeyWrapper unwraps keys of the wrong size
+type shortKeyWrapper struct{ s3cse.KeyWrapper }
+
+func (shortKeyWrapper) UnwrapKey([]byte, string, map[string]string) ([]byte, error) {
+	return make([]byte, 16), nil
+}
+
+func TestHostileMetadata(t *testing.T) {
+	wrapper := newWrapper(t)
+	m := s3cse.New(wrapper)
+	enc, valid := encrypt(t, m, []byte("object"), 1<<20)
+
+	with := func(key, value string) s3cse.Metadata {
+		md := s3cse.Metadata{}
+		for k, v := range valid {
+			md[k] = v
+		}
+		if value == "" {
+			delete(md, key)
+		} else {
+			md[key] = value
+		}
+		return md
+	}
+	wrapped, _ := base64.StdEncoding.DecodeString(valid[s3cse.MetaKeyV2])
+	wrapped[len(wrapped)-1] ^= 1
+	v1 := with(s3cse.MetaKeyV2, "")
+	v1[s3cse.MetaKeyV1] = valid[s3cse.MetaKeyV2]
+
+	tests := []struct {
+		name string
+		md   s3cse.Metadata
+		want error // nil for any error
+	}{
+		{"no metadata", s3cse.Metadata{}, s3cse.ErrUnsupportedFormat},
+		{"V1 metadata", v1, s3cse.ErrUnsupportedFormat},
+		{"CBC content", with(s3cse.MetaCEKAlg, "AES/CBC/PKCS5Padding"), s3cse.ErrUnsupportedFormat},
+		{"no content algorithm", with(s3cse.MetaCEKAlg, ""), s3cse.ErrUnsupportedFormat},
+		{"short tag", with(s3cse.MetaTagLen, "96"), s3cse.ErrUnsupportedFormat},
+		{"other wrapping", with(s3cse.MetaWrapAlg, "kms+context"), s3cse.ErrUnsupportedFormat},
+		{"malformed key", with(s3cse.MetaKeyV2, "!!!"), nil},
+		{"changed key", with(s3cse.MetaKeyV2, base64.StdEncoding.EncodeToString(wrapped)), nil},
+		{"short wrapped key", with(s3cse.MetaKeyV2, base64.StdEncoding.EncodeToString(wrapped[:20])), nil},
+		{"no IV", with(s3cse.MetaIV, ""), nil},
+		{"short IV", with(s3cse.MetaIV, base64.StdEncoding.EncodeToString(make([]byte, 8))), nil},
+		{"malformed material description", with(s3cse.MetaMatDesc, "{"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decrypt(m, enc, tt.md)
+			if err == nil {
+				t.Fatal("hostile metadata accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	short := s3cse.New(shortKeyWrapper{wrapper})
+	if _, err := decrypt(short, enc, valid); err == nil {
+		t.Fatal("content key of the wrong size accepted")
+	}
+}
+
+// kmsContextWrapper is the KMS stand-in the reference objects were created
+// with: data keys are sealed with AES-GCM under kmsKey, authenticating the
+// encryption context as JSON, and the sealed key is prefixed by its nonce
+type kmsContextWrapper struct {
+	aead cipher.AEAD
+}
+
+var kmsKey = []byte("hybridbuffer s3cse test kms key!")
+
+func newKMSContextWrapper(t *testing.T) *kmsContextWrapper {
+	t.Helper()
+	block, err := aes.NewCipher(kmsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &kmsContextWrapper{aead: aead}
+}
+
+func (k *kmsContextWrapper) WrapAlgorithm() string { return "kms+context" }
+
+func (k *kmsContextWrapper) WrapKey(cek []byte, cekAlg string) ([]byte, map[string]string, error) {
+	matDesc := map[string]string{"aws:x-amz-cek-alg": cekAlg}
+	ad, err := json.Marshal(matDesc)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	rand.Read(nonce)
+	return k.aead.Seal(nonce, nonce, cek, ad), matDesc, nil
+}
+
+func (k *kmsContextWrapper) UnwrapKey(wrapped []byte, cekAlg string, matDesc map[string]string) ([]byte, error) {
+	if matDesc["aws:x-amz-cek-alg"] != cekAlg {
+		return nil, errors.New("content algorithm does not match the encryption context")
+	}
+	ad, err := json.Marshal(matDesc)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < k.aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+	return k.aead.Open(nil, wrapped[:k.aead.NonceSize()], wrapped[k.aead.NonceSize():], ad)
+}
+
+// TestS3EncryptionClientObjects decrypts objects uploaded by the V2
+// encryption client of github.com/aws/aws-sdk-go v1.55.7 (s3crypto) with
+// the kms+context key generator, using kmsContextWrapper as KMS
+func TestS3EncryptionClientObjects(t *testing.T) {
+	objects := []struct {
+		plaintext, content, iv, key string
+	}{{
+		plaintext: "hello from the S3 Encryption Client\n",
+		content:   "S9OLDKL/O3T5hY7/240bgGO/BKQAvC9I+c6as7mau9azRdtq3QBPsEV9UxvwvW32kB2C6A==",
+		iv:        "0ltaOQva8iwsZCpl",
+		key:       "lpF9em5mNZR1z8a6z7F3Gdub95e1UbNs1O0agBF7QPFqJfCiTtvh/4R9ZCxLkPVEF0UCYkiCMD9+8P7t",
+	}, {
+		plaintext: strings.Repeat("0123456789abcdef", 6) + "tail",
+		content: "uTRwPj4jx2HRG8x6pwoLHjH3078LbxrKHV6/7f0DW5eZUp7ivmTTshIH7gkOJuTLbXphxa+8aw1QelaNdPq3VbS4qeACLeSDiY3r4PetrVDGeg8zEOT4" +
+			"ZovYdou3wB2Z0aJOkuVSO5LmB++aTNjyBKRzA/g=",
+		iv:  "oa3Y/29K95ZyNxYt",
+		key: "CGeSpwQeVyUuQdSDAXeZD1mudv4Dg16gW6QzQADsQLrrDcRv+3RVf7Ww/Y4FblXZPtJhQdKAOsBGIT4r",
+	}}
+	wrapper := newKMSContextWrapper(t)
+	for _, m := range []*s3cse.Middleware{s3cse.New(wrapper), s3cse.New(wrapper, s3cse.WithDelayedAuthentication())} {
+		for _, o := range objects {
+			md := s3cse.Metadata{
+				s3cse.MetaKeyV2:         o.key,
+				s3cse.MetaIV:            o.iv,
+				s3cse.MetaMatDesc:       `{"aws:x-amz-cek-alg":"AES/GCM/NoPadding"}`,
+				s3cse.MetaWrapAlg:       "kms+context",
+				s3cse.MetaCEKAlg:        "AES/GCM/NoPadding",
+				s3cse.MetaTagLen:        "128",
+				s3cse.MetaContentLength: strconv.Itoa(len(o.plaintext)),
+			}
+			content, err := base64.StdEncoding.DecodeString(o.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := decrypt(m, content, md)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != o.plaintext {
+				t.Fatalf("got %q, want %q", got, o.plaintext)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package s3cse
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// WrapAESGCM is the x-amz-wrap-alg value of AESGCMWrapper
+const WrapAESGCM = "AES/GCM"
+
+// AESGCMWrapper wraps content keys with a local AES key, like the AES
+// keyring of the S3 Encryption Client: the wrapped key is a 12 byte nonce
+// followed by the AES-GCM encryption of the content key, authenticating
+// the content algorithm name.
+type AESGCMWrapper struct {
+	aead cipher.AEAD
+	rand io.Reader
+}
+
+// Ensure AESGCMWrapper implements KeyWrapper
+var _ KeyWrapper = (*AESGCMWrapper)(nil)
+
+// NewAESGCMWrapper creates a wrapper for a 16, 24 or 32 bytes AES key
+func NewAESGCMWrapper(kek []byte) (*AESGCMWrapper, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("s3cse: invalid wrapping key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMWrapper{aead: aead, rand: middleware.Rand()}, nil
+}
+
+// WrapAlgorithm returns WrapAESGCM
+func (a *AESGCMWrapper) WrapAlgorithm() string { return WrapAESGCM }
+
+// WrapKey encrypts cek, the material description is empty
+func (a *AESGCMWrapper) WrapKey(cek []byte, cekAlg string) ([]byte, map[string]string, error) {
+	nonce := make([]byte, a.aead.NonceSize(), a.aead.NonceSize()+len(cek)+a.aead.Overhead())
+	if _, err := io.ReadFull(a.rand, nonce); err != nil {
+		return nil, nil, err
+	}
+	return a.aead.Seal(nonce, nonce, cek, []byte(cekAlg)), nil, nil
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey
+func (a *AESGCMWrapper) UnwrapKey(wrapped []byte, cekAlg string, _ map[string]string) ([]byte, error) {
+	if len(wrapped) < a.aead.NonceSize()+a.aead.Overhead() {
+		return nil, errors.New("s3cse: wrapped key too short")
+	}
+	n := a.aead.NonceSize()
+	return a.aead.Open(nil, wrapped[:n], wrapped[n:], []byte(cekAlg))
+}
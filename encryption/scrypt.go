@@ -0,0 +1,112 @@
+package encryption
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Default scrypt parameters, the interactive login values recommended by
+// the scrypt paper and RFC 7914
+const (
+	ScryptN = 1 << 15
+	ScryptR = 8
+	ScryptP = 1
+)
+
+// Limits on scrypt parameters accepted when reading: 256 MiB of memory
+// (128 * N * r bytes) and a parallelization of 16
+const (
+	maxScryptMemory = 256 << 20
+	maxScryptP      = 16
+)
+
+const kdfScrypt = 1
+
+func init() {
+	kdfParsers[kdfScrypt] = parseScrypt
+}
+
+// WithScryptPassphrase derives a fresh key for every stream from passphrase
+// with scrypt, using a random salt. Parameters and salt are written to the
+// stream, so readers only need the passphrase. N must be a power of two
+// greater than 1; zero values select ScryptN, ScryptR and ScryptP.
+// It cannot be combined with WithKey.
+func WithScryptPassphrase(passphrase []byte, n, r, p int) Option {
+	return func(m *Middleware) {
+		if n == 0 {
+			n = ScryptN
+		}
+		if r == 0 {
+			r = ScryptR
+		}
+		if p == 0 {
+			p = ScryptP
+		}
+		m.secret = passphrase
+		m.kdf = scryptKDF{n: n, r: r, p: p}
+	}
+}
+
+type scryptKDF struct {
+	n, r, p int
+}
+
+func (s scryptKDF) name() string { return "scrypt" }
+func (s scryptKDF) id() byte     { return kdfScrypt }
+func (s scryptKDF) salt() []byte { return nil }
+func (s scryptKDF) static() bool { return false }
+
+func (s scryptKDF) describe() map[string]string {
+	return map[string]string{
+		"N": strconv.Itoa(s.n),
+		"r": strconv.Itoa(s.r),
+		"p": strconv.Itoa(s.p),
+	}
+}
+
+// check validates the parameters, passphrases of any length are accepted
+func (s scryptKDF) check([]byte) error {
+	if s.n <= 1 || s.n&(s.n-1) != 0 {
+		return fmt.Errorf("encryption: scrypt N must be a power of two greater than 1, got %d", s.n)
+	}
+	if s.r <= 0 || s.r > 0xffff || s.p <= 0 || s.p > 0xffff || uint64(s.r)*uint64(s.p) >= 1<<30 {
+		return fmt.Errorf("encryption: invalid scrypt parameters r=%d p=%d", s.r, s.p)
+	}
+	return nil
+}
+
+// marshal encodes log2(N), r and p
+func (s scryptKDF) marshal() []byte {
+	b := []byte{byte(bits.TrailingZeros(uint(s.n)))}
+	b = binary.BigEndian.AppendUint16(b, uint16(s.r))
+	return binary.BigEndian.AppendUint16(b, uint16(s.p))
+}
+
+func (s scryptKDF) derive(passphrase, salt []byte) ([]byte, error) {
+	return scrypt.Key(passphrase, salt, s.n, s.r, s.p, KeySize)
+}
+
+func parseScrypt(params []byte) (kdf, error) {
+	if len(params) != 5 {
+		return nil, fmt.Errorf("%w: scrypt parameters", ErrHeaderCorrupt)
+	}
+	if params[0] > 30 {
+		return nil, fmt.Errorf("%w: scrypt N=2^%d", ErrKDFLimit, params[0])
+	}
+	s := scryptKDF{
+		n: 1 << params[0],
+		r: int(binary.BigEndian.Uint16(params[1:])),
+		p: int(binary.BigEndian.Uint16(params[3:])),
+	}
+	if err := s.check(nil); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHeaderCorrupt, err)
+	}
+	if uint64(s.n)*uint64(s.r) > maxScryptMemory/128 || s.p > maxScryptP {
+		return nil, fmt.Errorf("%w: scrypt N=%d r=%d p=%d", ErrKDFLimit, s.n, s.r, s.p)
+	}
+	return s, nil
+}
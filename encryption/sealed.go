@@ -0,0 +1,215 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/minio/sio"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// SealedFormatVersion is the header format version of sealed-key streams
+const SealedFormatVersion = 1
+
+var sealedMagic = [3]byte{'H', 'B', 'K'}
+
+// maxSealedKeySize bounds the sealed key blob stored in the header
+const maxSealedKeySize = 4096
+
+// KeySealer binds key material to a machine, for example by sealing it with
+// the local TPM 2.0 (TPM2_Create of a sealed data object under the storage
+// root key, optionally with a PCR policy). Unseal must fail on other machines.
+// The context is the one of the stream, see middleware.WriterContext and
+// middleware.ReaderContext; remote sealers abort calls once it is done.
+type KeySealer interface {
+	Seal(ctx context.Context, key []byte) ([]byte, error)
+	Unseal(ctx context.Context, sealed []byte) ([]byte, error)
+}
+
+// KeyGenerator is implemented by sealers that generate keys themselves,
+// like the GenerateDataKey call of a KMS. Sealed uses it instead of
+// generating a random key and calling Seal.
+type KeyGenerator interface {
+	// GenerateKey returns a new key of size bytes and its sealed form
+	GenerateKey(ctx context.Context, size int) (key, sealed []byte, err error)
+}
+
+// Sealed encrypts every stream with a fresh random key which is sealed by a
+// KeySealer and stored in the stream header. Spilled buffers can therefore
+// only be decrypted on the machine that wrote them, protecting against stolen
+// disks and copied temp directories.
+type Sealed struct {
+	sealer      KeySealer
+	cipherSuite byte
+	rand        io.Reader
+}
+
+// Ensure Sealed implements middleware.Middleware, middleware.ContextMiddleware and middleware.WriterE interfaces
+var (
+	_ middleware.Middleware        = (*Sealed)(nil)
+	_ middleware.ContextMiddleware = (*Sealed)(nil)
+	_ middleware.WriterE           = (*Sealed)(nil)
+)
+
+// NewSealed creates a sealed-key encryption middleware.
+// WithCipher and WithRand are honored, WithKey is ignored.
+// NewSealed panics if the cipher suite is not supported.
+func NewSealed(sealer KeySealer, opts ...Option) *Sealed {
+	s, err := NewSealedE(sealer, opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return s
+}
+
+// NewSealedE is like NewSealed, but returns ErrUnsupportedCipher instead of panicking
+func NewSealedE(sealer KeySealer, opts ...Option) (*Sealed, error) {
+	cfg := &Middleware{cipherSuite: defaultCipher}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.rand == nil {
+		cfg.rand = middleware.Rand()
+	}
+	if !supportedCipher(cfg.cipherSuite) {
+		return nil, fmt.Errorf("%w %#x", ErrUnsupportedCipher, cfg.cipherSuite)
+	}
+	return &Sealed{
+		sealer:      sealer,
+		cipherSuite: cfg.cipherSuite,
+		rand:        cfg.rand,
+	}, nil
+}
+
+// Writer generates and seals a stream key and wraps w with encryption.
+// Sealing errors are returned from the first Write or Close, see WriterE.
+func (s *Sealed) Writer(w io.Writer) io.Writer {
+	return s.WriterContext(context.Background(), w)
+}
+
+// WriterContext is like Writer, passing ctx to the KeySealer
+func (s *Sealed) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	return writerOrErr(s.writer(ctx, w))
+}
+
+// WriterE is like Writer, but returns key generation and sealing errors immediately
+func (s *Sealed) WriterE(w io.Writer) (io.WriteCloser, error) {
+	return s.writer(context.Background(), w)
+}
+
+func (s *Sealed) writer(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	key, blob, err := s.newKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	if len(blob) > maxSealedKeySize {
+		return nil, fmt.Errorf("encryption: sealed key too large (%d bytes)", len(blob))
+	}
+	hdr := make([]byte, 0, len(sealedMagic)+3+len(blob))
+	hdr = append(hdr, sealedMagic[:]...)
+	hdr = append(hdr, SealedFormatVersion)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(blob)))
+	hdr = append(hdr, blob...)
+	enc, err := sio.EncryptWriter(&headerWriter{w: w, header: hdr}, sio.Config{
+		Key:          key,
+		CipherSuites: []byte{s.cipherSuite},
+		Rand:         s.rand,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed to create writer: %w", err)
+	}
+	return middleware.HardenLayerWriter("encryption", enc), nil
+}
+
+// newKey returns a new stream key and its sealed form
+func (s *Sealed) newKey(ctx context.Context) ([]byte, []byte, error) {
+	if g, ok := s.sealer.(KeyGenerator); ok {
+		key, blob, err := g.GenerateKey(ctx, KeySize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("encryption: failed to generate key: %w", err)
+		}
+		if len(key) != KeySize {
+			clear(key)
+			return nil, nil, fmt.Errorf("encryption: generated key must be %d bytes, got %d", KeySize, len(key))
+		}
+		return key, blob, nil
+	}
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(s.rand, key); err != nil {
+		return nil, nil, fmt.Errorf("encryption: failed to generate key: %w", err)
+	}
+	blob, err := s.sealer.Seal(ctx, key)
+	if err != nil {
+		clear(key)
+		return nil, nil, fmt.Errorf("encryption: failed to seal key: %w", err)
+	}
+	return key, blob, nil
+}
+
+// Reader unseals the stream key from the header and decrypts.
+// Errors are returned from Read.
+func (s *Sealed) Reader(r io.Reader) io.Reader {
+	return s.ReaderContext(context.Background(), r)
+}
+
+// ReaderContext is like Reader, passing ctx to the KeySealer
+func (s *Sealed) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return newLazyReader(func() (io.Reader, error) {
+		var hdr [len(sealedMagic) + 3]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("encryption: read stream header: %w", err)
+		}
+		if !bytes.Equal(hdr[:3], sealedMagic[:]) {
+			return nil, errors.New("encryption: not a sealed-key stream")
+		}
+		if _, err := middleware.CheckVersion("encryption", hdr[3], SealedFormatVersion, middleware.RejectUnknown); err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint16(hdr[4:])
+		if n == 0 || n > maxSealedKeySize {
+			return nil, errors.New("encryption: invalid sealed key size")
+		}
+		blob := make([]byte, n)
+		if _, err := io.ReadFull(r, blob); err != nil {
+			return nil, fmt.Errorf("encryption: read sealed key: %w", err)
+		}
+		key, err := s.sealer.Unseal(ctx, blob)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: failed to unseal key: %w", err)
+		}
+		if len(key) != KeySize {
+			clear(key)
+			return nil, fmt.Errorf("encryption: unsealed key must be %d bytes, got %d", KeySize, len(key))
+		}
+		dec, err := sio.DecryptReader(r, sio.Config{
+			Key:          key,
+			CipherSuites: readCipherSuites(s.cipherSuite),
+		})
+		if err != nil {
+			clear(key)
+			return nil, err
+		}
+		return &wipingReader{r: dec, keys: [][]byte{key}}, nil
+	})
+}
+
+// errWriter reports a deferred construction error on every call
+type errWriter struct {
+	err error
+}
+
+func (e *errWriter) Write([]byte) (int, error) { return 0, e.err }
+func (e *errWriter) Close() error              { return e.err }
+
+// writerOrErr returns w, or an errWriter reporting err
+func writerOrErr(w io.WriteCloser, err error) io.Writer {
+	if err != nil {
+		return &errWriter{err: err}
+	}
+	return w
+}
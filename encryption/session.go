@@ -0,0 +1,334 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/minio/sio"
+	"golang.org/x/crypto/hkdf"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// SessionFormatVersion is the header format version of session streams
+const SessionFormatVersion = 1
+
+var sessionMagic = [3]byte{'H', 'B', 'M'}
+
+// sessionHeaderSize is the size of the fixed part of the session header,
+// magic, version, session ID, stream counter and sealed key size
+const sessionHeaderSize = len(sessionMagic) + 1 + len(SessionID{}) + 8 + 2
+
+// ErrStreamOrder is returned by session Readers for streams whose counter
+// is not above the counter of the last stream read from the same session,
+// i.e. for replayed or reordered streams
+var ErrStreamOrder = errors.New("encryption: stream counter not increasing")
+
+// SessionID identifies a session key
+type SessionID [16]byte
+
+// String returns the hex encoding of the session ID
+func (id SessionID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Session encrypts many streams with keys derived from one session key,
+// which is sealed once per session instead of once per stream like Sealed
+// does. Batch jobs writing thousands of buffers thereby make a single KMS
+// call.
+//
+// Every stream header holds the session ID, the sealed session key and a
+// stream counter that increases with every Writer. The stream key is
+// derived from the session key with HKDF-SHA256 over the session ID and
+// counter, so no two streams of a session share a key and a modified
+// counter fails decryption. The header is followed by a tag computed with
+// the stream key, which Readers verify before trusting the counter, also
+// for streams without data. Readers unseal each session key once and
+// reject streams whose counter is not above the last one read from their
+// session, so streams must be read in the order they were written.
+type Session struct {
+	sealer      KeySealer
+	cipherSuite byte
+	rand        io.Reader
+
+	mu      sync.Mutex
+	id      SessionID
+	key     []byte // session key of writers, nil until the first Writer
+	blob    []byte
+	counter uint64
+
+	readMu sync.Mutex
+	read   map[SessionID]*readSession
+}
+
+// readSession is a session key unsealed by a Reader
+type readSession struct {
+	key  []byte
+	last uint64
+	seen bool
+}
+
+// Ensure Session implements middleware.Middleware, middleware.ContextMiddleware, middleware.WriterE and middleware.Describer interfaces
+var (
+	_ middleware.Middleware        = (*Session)(nil)
+	_ middleware.ContextMiddleware = (*Session)(nil)
+	_ middleware.WriterE           = (*Session)(nil)
+	_ middleware.Describer         = (*Session)(nil)
+)
+
+// NewSession creates a session encryption middleware sealing its session
+// keys with sealer. WithCipher and WithRand are honored, WithKey is ignored.
+// NewSession panics if the cipher suite is not supported.
+func NewSession(sealer KeySealer, opts ...Option) *Session {
+	s, err := NewSessionE(sealer, opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return s
+}
+
+// NewSessionE is like NewSession, but returns ErrUnsupportedCipher instead of panicking
+func NewSessionE(sealer KeySealer, opts ...Option) (*Session, error) {
+	sealed, err := NewSealedE(sealer, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{
+		sealer:      sealer,
+		cipherSuite: sealed.cipherSuite,
+		rand:        sealed.rand,
+		read:        make(map[SessionID]*readSession),
+	}, nil
+}
+
+// Describe reports the cipher and the session key management
+func (s *Session) Describe() middleware.Component {
+	c := describe(s.cipherSuite, "session")
+	c.KDF = &middleware.KDF{
+		Name:   "hkdf-sha256",
+		Params: map[string]string{"input": "session key", "salt": "session id", "info": "stream counter"},
+	}
+	return c
+}
+
+// Rotate discards the session key, the next Writer starts a new session
+// with a freshly sealed key
+func (s *Session) Rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.key)
+	s.key, s.blob, s.counter = nil, nil, 0
+}
+
+// Forget wipes and removes a session key unsealed by Readers, together
+// with the counter of its last stream
+func (s *Session) Forget(id SessionID) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if rs, ok := s.read[id]; ok {
+		clear(rs.key)
+		delete(s.read, id)
+	}
+}
+
+// Writer derives the key of the next stream of the session and wraps w
+// with encryption. The first Writer of a session seals the session key.
+// Errors are returned from the first Write or Close, see WriterE.
+func (s *Session) Writer(w io.Writer) io.Writer {
+	return s.WriterContext(context.Background(), w)
+}
+
+// WriterContext is like Writer, passing ctx to the KeySealer
+func (s *Session) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	return writerOrErr(s.writer(ctx, w))
+}
+
+// WriterE is like Writer, but returns sealing errors immediately
+func (s *Session) WriterE(w io.Writer) (io.WriteCloser, error) {
+	return s.writer(context.Background(), w)
+}
+
+func (s *Session) writer(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	id, blob, counter, key, err := s.next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	hdr := make([]byte, 0, sessionHeaderSize+len(blob))
+	hdr = append(hdr, sessionMagic[:]...)
+	hdr = append(hdr, SessionFormatVersion)
+	hdr = append(hdr, id[:]...)
+	hdr = binary.BigEndian.AppendUint64(hdr, counter)
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(blob)))
+	hdr = append(hdr, blob...)
+	hdr = append(hdr, headerTag(key, hdr)...)
+	enc, err := sio.EncryptWriter(&headerWriter{w: w, header: hdr}, sio.Config{
+		Key:          key,
+		CipherSuites: []byte{s.cipherSuite},
+		Rand:         s.rand,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encryption: failed to create writer: %w", err)
+	}
+	return middleware.HardenLayerWriter("encryption", enc), nil
+}
+
+// next returns the session and counter of a new stream and its key,
+// starting a session if there is none
+func (s *Session) next(ctx context.Context) (SessionID, []byte, uint64, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key == nil {
+		var id SessionID
+		if _, err := io.ReadFull(s.rand, id[:]); err != nil {
+			return id, nil, 0, nil, fmt.Errorf("encryption: failed to generate session id: %w", err)
+		}
+		key, blob, err := (&Sealed{sealer: s.sealer, rand: s.rand}).newKey(ctx)
+		if err != nil {
+			return id, nil, 0, nil, err
+		}
+		if len(blob) > maxSealedKeySize {
+			clear(key)
+			return id, nil, 0, nil, fmt.Errorf("encryption: sealed key too large (%d bytes)", len(blob))
+		}
+		s.id, s.key, s.blob, s.counter = id, key, blob, 0
+	}
+	if s.counter == ^uint64(0) {
+		return s.id, nil, 0, nil, errors.New("encryption: session exhausted, call Rotate")
+	}
+	s.counter++
+	key, err := streamKey(s.key, s.id, s.counter)
+	return s.id, s.blob, s.counter, key, err
+}
+
+// streamKey derives the key of stream counter of a session
+func streamKey(sessionKey []byte, id SessionID, counter uint64) ([]byte, error) {
+	info := binary.BigEndian.AppendUint64([]byte("hybridbuffer session stream "), counter)
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sessionKey, id[:], info), key); err != nil {
+		return nil, fmt.Errorf("encryption: failed to derive stream key: %w", err)
+	}
+	return key, nil
+}
+
+// Reader unseals the session key, checks the stream counter and decrypts.
+// Errors, including ErrStreamOrder, are returned from Read.
+func (s *Session) Reader(r io.Reader) io.Reader {
+	return s.ReaderContext(context.Background(), r)
+}
+
+// ReaderContext is like Reader, passing ctx to the KeySealer
+func (s *Session) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return newLazyReader(func() (io.Reader, error) {
+		var hdr [sessionHeaderSize]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return nil, fmt.Errorf("encryption: read stream header: %w", err)
+		}
+		if !bytes.Equal(hdr[:3], sessionMagic[:]) {
+			return nil, errors.New("encryption: not a session stream")
+		}
+		if _, err := middleware.CheckVersion("encryption", hdr[3], SessionFormatVersion, middleware.RejectUnknown); err != nil {
+			return nil, err
+		}
+		var id SessionID
+		copy(id[:], hdr[4:])
+		counter := binary.BigEndian.Uint64(hdr[4+len(id):])
+		n := binary.BigEndian.Uint16(hdr[sessionHeaderSize-2:])
+		if n == 0 || n > maxSealedKeySize {
+			return nil, errors.New("encryption: invalid sealed key size")
+		}
+		blob := make([]byte, n)
+		if _, err := io.ReadFull(r, blob); err != nil {
+			return nil, fmt.Errorf("encryption: read sealed key: %w", err)
+		}
+		var tag [headerTagSize]byte
+		if _, err := io.ReadFull(r, tag[:]); err != nil {
+			return nil, fmt.Errorf("encryption: read stream header: %w", err)
+		}
+		key, sessionKey, err := s.accept(ctx, id, counter, blob)
+		if err != nil {
+			return nil, err
+		}
+		// the tag proves the counter and sealed key authentic before they
+		// are committed, streams without data have no package that would
+		if !hmac.Equal(headerTag(key, append(hdr[:], blob...)), tag[:]) {
+			clear(sessionKey)
+			return nil, ErrHeaderNotAuthentic
+		}
+		if err := s.commit(id, counter, sessionKey); err != nil {
+			return nil, err
+		}
+		return sio.DecryptReader(r, sio.Config{
+			Key:          key,
+			CipherSuites: readCipherSuites(s.cipherSuite),
+		})
+	})
+}
+
+// accept checks the counter of a stream against the last one read from its
+// session and returns the stream key. The session key is unsealed on the
+// first stream of a session and returned as well, to be kept by commit
+// once the header tag was verified, so a forged header cannot bind another
+// key to the session.
+func (s *Session) accept(ctx context.Context, id SessionID, counter uint64, blob []byte) ([]byte, []byte, error) {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	if rs, ok := s.read[id]; ok {
+		if err := rs.check(id, counter); err != nil {
+			return nil, nil, err
+		}
+		key, err := streamKey(rs.key, id, counter)
+		return key, nil, err
+	}
+	sessionKey, err := s.sealer.Unseal(ctx, blob)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption: failed to unseal key: %w", err)
+	}
+	if len(sessionKey) != KeySize {
+		clear(sessionKey)
+		return nil, nil, fmt.Errorf("encryption: unsealed key must be %d bytes, got %d", KeySize, len(sessionKey))
+	}
+	key, err := streamKey(sessionKey, id, counter)
+	if err != nil {
+		clear(sessionKey)
+		return nil, nil, err
+	}
+	return key, sessionKey, nil
+}
+
+// commit records counter as the last stream read from a session, keeping
+// sessionKey if it was unsealed for the stream and the session is new
+func (s *Session) commit(id SessionID, counter uint64, sessionKey []byte) error {
+	s.readMu.Lock()
+	defer s.readMu.Unlock()
+	rs, ok := s.read[id]
+	switch {
+	case !ok && sessionKey == nil:
+		// forgotten since accept
+		return nil
+	case !ok:
+		rs = &readSession{key: sessionKey}
+		s.read[id] = rs
+	default:
+		clear(sessionKey)
+	}
+	if err := rs.check(id, counter); err != nil {
+		return err
+	}
+	rs.last, rs.seen = counter, true
+	return nil
+}
+
+func (rs *readSession) check(id SessionID, counter uint64) error {
+	if rs.seen && counter <= rs.last {
+		return fmt.Errorf("%w: session %s, stream %d after %d", ErrStreamOrder, id, counter, rs.last)
+	}
+	return nil
+}
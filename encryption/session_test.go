@@ -0,0 +1,279 @@
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+// gcmSealer seals keys with a local AES-GCM key and counts its calls
+type gcmSealer struct {
+	aead          cipher.AEAD
+	seals, unseal int
+}
+
+func newSealer(t *testing.T) *gcmSealer {
+	t.Helper()
+	kek := make([]byte, 32)
+	rand.Read(kek)
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &gcmSealer{aead: aead}
+}
+
+func (s *gcmSealer) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.seals++
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (s *gcmSealer) Unseal(ctx context.Context, sealed []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.unseal++
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("sealed key too short")
+	}
+	return s.aead.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+func writeStream(t *testing.T, s *encryption.Session, data []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := s.Writer(&enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func readStream(s *encryption.Session, enc []byte) ([]byte, error) {
+	return io.ReadAll(s.Reader(bytes.NewReader(enc)))
+}
+
+// sessionHeader is the size of the session header before the sealed key:
+// magic, version, session ID, counter and sealed key size
+const sessionHeader = 3 + 1 + 16 + 8 + 2
+
+func TestSessionRoundTrip(t *testing.T) {
+	sealer := newSealer(t)
+	w := encryption.NewSession(sealer)
+	r := encryption.NewSession(sealer)
+
+	var streams, data [][]byte
+	for _, size := range []int{0, 1, 64 << 10, 64<<10 + 1, 200 << 10} {
+		d := make([]byte, size)
+		rand.Read(d)
+		data = append(data, d)
+		streams = append(streams, writeStream(t, w, d))
+	}
+	if sealer.seals != 1 {
+		t.Fatalf("session key sealed %d times, want once", sealer.seals)
+	}
+	for i, enc := range streams {
+		got, err := readStream(r, enc)
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		if !bytes.Equal(got, data[i]) {
+			t.Fatalf("stream %d: round trip mismatch", i)
+		}
+	}
+	if sealer.unseal != 1 {
+		t.Fatalf("session key unsealed %d times, want once", sealer.unseal)
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	sealer := newSealer(t)
+	s := encryption.NewSession(sealer)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the contexts of streams reach the sealer
+	if _, err := s.WriterContext(canceled, io.Discard).Write([]byte("data")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want Canceled", err)
+	}
+	enc := writeStream(t, s, []byte("data"))
+	r := encryption.NewSession(sealer)
+	if _, err := io.ReadAll(r.ReaderContext(canceled, bytes.NewReader(enc))); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want Canceled", err)
+	}
+	// a canceled unseal leaves the session readable
+	if got, err := readStream(r, enc); err != nil || string(got) != "data" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestSessionRotate(t *testing.T) {
+	sealer := newSealer(t)
+	s := encryption.NewSession(sealer)
+	a := writeStream(t, s, []byte("first session"))
+	s.Rotate()
+	b := writeStream(t, s, []byte("second session"))
+	if sealer.seals != 2 {
+		t.Fatalf("sealed %d times, want 2", sealer.seals)
+	}
+	if bytes.Equal(a[4:20], b[4:20]) {
+		t.Fatal("rotation kept the session ID")
+	}
+	// both sessions start counting at 1
+	r := encryption.NewSession(sealer)
+	for _, enc := range [][]byte{a, b} {
+		if _, err := readStream(r, enc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSessionStreamOrder(t *testing.T) {
+	sealer := newSealer(t)
+	w := encryption.NewSession(sealer)
+	first := writeStream(t, w, []byte("first"))
+	second := writeStream(t, w, []byte("second"))
+
+	r := encryption.NewSession(sealer)
+	if _, err := readStream(r, second); err != nil {
+		t.Fatal(err)
+	}
+	for name, enc := range map[string][]byte{"replayed": second, "reordered": first} {
+		if _, err := readStream(r, enc); !errors.Is(err, encryption.ErrStreamOrder) {
+			t.Fatalf("%s: got %v, want ErrStreamOrder", name, err)
+		}
+	}
+
+	// forgetting the session also forgets its counter
+	r.Forget([16]byte(second[4:20]))
+	if _, err := readStream(r, first); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionHostileStreams(t *testing.T) {
+	sealer := newSealer(t)
+	s := encryption.NewSession(sealer)
+	msg := make([]byte, 1000)
+	rand.Read(msg)
+	valid := writeStream(t, s, msg)
+
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(bytes.Clone(valid))
+	}
+	blobSize := func(n uint16) []byte {
+		return modify(func(b []byte) []byte {
+			binary.BigEndian.PutUint16(b[sessionHeader-2:], n)
+			return b
+		})
+	}
+	tests := map[string][]byte{
+		"empty":                nil,
+		"truncated header":     valid[:sessionHeader-1],
+		"bad magic":            modify(func(b []byte) []byte { b[0] = 'X'; return b }),
+		"unknown version":      modify(func(b []byte) []byte { b[3] = 99; return b }),
+		"zero sealed key":      blobSize(0),
+		"huge sealed key":      blobSize(4097),
+		"truncated sealed key": valid[:sessionHeader+10],
+		"changed sealed key":   modify(func(b []byte) []byte { b[sessionHeader] ^= 1; return b }),
+		"changed session ID":   modify(func(b []byte) []byte { b[4] ^= 1; return b }),
+		"changed counter":      modify(func(b []byte) []byte { b[sessionHeader-3] ^= 1; return b }),
+		"truncated tag":        valid[:len(valid)-len(msg)-32-17],
+		"changed tag":          modify(func(b []byte) []byte { b[len(b)-len(msg)-32-1] ^= 1; return b }),
+		"flipped payload":      modify(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }),
+		"truncated payload":    valid[:len(valid)-1],
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := readStream(encryption.NewSession(sealer), data)
+			if err == nil {
+				t.Fatal("hostile stream accepted")
+			}
+			if len(got) != 0 {
+				t.Fatalf("returned %d bytes of a hostile stream", len(got))
+			}
+		})
+	}
+}
+
+func TestSessionForgedCounterDoesNotAdvance(t *testing.T) {
+	sealer := newSealer(t)
+	w := encryption.NewSession(sealer)
+	first := writeStream(t, w, []byte("first"))
+
+	forged := bytes.Clone(first)
+	binary.BigEndian.PutUint64(forged[20:], 1000)
+	r := encryption.NewSession(sealer)
+	if _, err := readStream(r, forged); err == nil {
+		t.Fatal("forged counter accepted")
+	}
+	if _, err := readStream(r, first); err != nil {
+		t.Fatalf("stream rejected after a forged counter: %v", err)
+	}
+}
+
+func TestSessionForgedSealedKeyDoesNotPoison(t *testing.T) {
+	sealer := newSealer(t)
+	victim := writeStream(t, encryption.NewSession(sealer), []byte("victim"))
+	other := writeStream(t, encryption.NewSession(sealer), []byte("other"))
+
+	// the session ID of the victim with the sealed key of another session
+	// unseals, but must not become the key of the victim session
+	forged := append(bytes.Clone(victim[:20]), other[20:]...)
+	r := encryption.NewSession(sealer)
+	if _, err := readStream(r, forged); err == nil {
+		t.Fatal("forged stream accepted")
+	}
+	got, err := readStream(r, victim)
+	if err != nil || string(got) != "victim" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestSessionForgedEmptyStreamDoesNotAdvance(t *testing.T) {
+	sealer := newSealer(t)
+	w := encryption.NewSession(sealer)
+	first := writeStream(t, w, []byte("first"))
+	empty := writeStream(t, w, nil)
+	if _, err := readStream(encryption.NewSession(sealer), empty); err != nil {
+		t.Fatalf("empty stream rejected: %v", err)
+	}
+
+	// a stream without packages copying the sealed key of a genuine one,
+	// with and without its tag
+	header := empty[:len(empty)-32]
+	for _, forged := range [][]byte{header, empty} {
+		forged = bytes.Clone(forged)
+		binary.BigEndian.PutUint64(forged[20:], 1<<64-2)
+		r := encryption.NewSession(sealer)
+		if _, err := readStream(r, forged); err == nil {
+			t.Fatal("forged counter accepted")
+		}
+		if got, err := readStream(r, first); err != nil || string(got) != "first" {
+			t.Fatalf("stream rejected after a forged empty stream: %q, %v", got, err)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package siv
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+)
+
+// cmac computes AES-CMAC (RFC 4493)
+type cmac struct {
+	block  cipher.Block
+	k1, k2 [16]byte
+}
+
+func newCMAC(block cipher.Block) *cmac {
+	c := &cmac{block: block}
+	var l [16]byte
+	block.Encrypt(l[:], l[:])
+	c.k1 = dbl(l)
+	c.k2 = dbl(c.k1)
+	return c
+}
+
+// dbl multiplies by x in GF(2^128)
+func dbl(b [16]byte) [16]byte {
+	var d [16]byte
+	carry := b[0] >> 7
+	for i := 0; i < 15; i++ {
+		d[i] = b[i]<<1 | b[i+1]>>7
+	}
+	d[15] = b[15] << 1
+	d[15] ^= 0x87 * carry
+	return d
+}
+
+// sum returns the MAC of msg
+func (c *cmac) sum(msg []byte) [16]byte {
+	var x [16]byte
+	for len(msg) > 16 {
+		subtle.XORBytes(x[:], x[:], msg[:16])
+		c.block.Encrypt(x[:], x[:])
+		msg = msg[16:]
+	}
+	var last [16]byte
+	copy(last[:], msg)
+	if len(msg) == 16 {
+		subtle.XORBytes(last[:], last[:], c.k1[:])
+	} else {
+		last[len(msg)] = 0x80
+		subtle.XORBytes(last[:], last[:], c.k2[:])
+	}
+	subtle.XORBytes(x[:], x[:], last[:])
+	c.block.Encrypt(x[:], x[:])
+	return x
+}
+
+// s2v computes the synthetic IV of RFC 5297 over the associated data
+// components and the plaintext
+func (c *cmac) s2v(plaintext []byte, ad ...[]byte) [16]byte {
+	var zero [16]byte
+	d := c.sum(zero[:])
+	for _, a := range ad {
+		m := c.sum(a)
+		d = dbl(d)
+		subtle.XORBytes(d[:], d[:], m[:])
+	}
+	if len(plaintext) >= 16 {
+		t := append([]byte(nil), plaintext...)
+		subtle.XORBytes(t[len(t)-16:], t[len(t)-16:], d[:])
+		return c.sum(t)
+	}
+	t := dbl(d)
+	var pad [16]byte
+	copy(pad[:], plaintext)
+	pad[len(plaintext)] = 0x80
+	subtle.XORBytes(t[:], t[:], pad[:])
+	return c.sum(t[:])
+}
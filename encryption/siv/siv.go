@@ -0,0 +1,268 @@
+// Package siv provides nonce-misuse resistant AES-SIV (RFC 5297)
+// encryption for small buffers, for pipelines encrypting millions of tiny
+// buffers under one key where random nonces may collide.
+//
+// AES-SIV needs two passes over the plaintext, so the Writer buffers the
+// whole stream and seals it on Close, and the Reader reads and opens the
+// whole stream on the first Read. Streams are limited to WithMaxSize bytes.
+//
+// Every stream carries a random nonce as associated data, so equal buffers
+// encrypt differently. A repeated nonce only reveals whether two buffers
+// were equal.
+package siv
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// FormatVersion is the header format version of SIV streams
+const FormatVersion = 1
+
+var magic = [3]byte{'H', 'B', 'V'}
+
+const (
+	nonceSize  = 16
+	headerSize = len(magic) + 1 + nonceSize
+
+	// DefaultMaxSize is the default limit of the plaintext size
+	DefaultMaxSize = 1 << 20
+)
+
+func init() {
+	middleware.RegisterFormat("siv-header", func(p []byte) (string, int, bool) {
+		if len(p) < headerSize || [3]byte(p[:3]) != magic {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, nonce %x", p[3], p[4:headerSize]), headerSize, true
+	})
+}
+
+var (
+	// ErrInvalidKeySize is returned by NewE for keys that are not 32 or 64 bytes long
+	ErrInvalidKeySize = errors.New("siv: key must be 32 or 64 bytes")
+
+	// ErrTooLarge is returned if a stream exceeds the maximum size
+	ErrTooLarge = errors.New("siv: stream exceeds maximum size")
+
+	// ErrNotAuthentic is returned by Readers for modified or foreign streams
+	ErrNotAuthentic = errors.New("siv: message authentication failed")
+)
+
+// Middleware encrypts every stream with AES-SIV
+type Middleware struct {
+	mac     *cmac
+	ctr     cipher.Block
+	keyBits int
+	rand    io.Reader
+	maxSize int
+	ad      []byte
+}
+
+// Ensure Middleware implements middleware.Middleware, middleware.Describer and middleware.MemoryUser interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+	_ middleware.MemoryUser = (*Middleware)(nil)
+)
+
+// Option configures the middleware
+type Option func(*Middleware)
+
+// WithMaxSize sets the maximum plaintext size of a stream, DefaultMaxSize
+// by default. Writers hold up to this many bytes in memory.
+func WithMaxSize(n int) Option {
+	return func(m *Middleware) {
+		m.maxSize = n
+	}
+}
+
+// WithAssociatedData sets data authenticated with every stream, e.g. the
+// buffer name, it must be the same when reading
+func WithAssociatedData(ad []byte) Option {
+	return func(m *Middleware) {
+		m.ad = ad
+	}
+}
+
+// WithRand sets the source of nonces. By default middleware.Rand() is used.
+func WithRand(r io.Reader) Option {
+	return func(m *Middleware) {
+		m.rand = r
+	}
+}
+
+// New creates an AES-SIV middleware. A 64 byte key selects AES-256-SIV, a
+// 32 byte key AES-128-SIV; the first half keys the MAC, the second half
+// the encryption. New panics if the key has an invalid size.
+func New(key []byte, opts ...Option) *Middleware {
+	m, err := NewE(key, opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return m
+}
+
+// NewE is like New, but returns ErrInvalidKeySize instead of panicking
+func NewE(key []byte, opts ...Option) (*Middleware, error) {
+	if len(key) != 32 && len(key) != 64 {
+		return nil, fmt.Errorf("%w, got %d", ErrInvalidKeySize, len(key))
+	}
+	macBlock, err := aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	ctr, err := aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+	m := &Middleware{mac: newCMAC(macBlock), ctr: ctr, keyBits: len(key) * 4, maxSize: DefaultMaxSize}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.rand == nil {
+		m.rand = middleware.Rand()
+	}
+	return m, nil
+}
+
+// MemoryUsage returns the memory of a Writer or Reader at the maximum
+// stream size, which holds the whole plaintext and ciphertext
+func (m *Middleware) MemoryUsage() int64 { return 2 * int64(m.maxSize) }
+
+// Describe reports the cipher and size limit
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:      string(middleware.RoleEncryption),
+		Algorithm: fmt.Sprintf("aes-%d-siv", m.keyBits),
+		KeyBits:   m.keyBits * 2,
+		Integrity: "aead",
+		Properties: map[string]string{
+			"format":         "hb-siv",
+			"key_management": "static",
+			"nonce_misuse":   "resistant",
+			"max_size":       fmt.Sprint(m.maxSize),
+		},
+	}
+}
+
+// seal returns the SIV followed by the ciphertext
+func (m *Middleware) seal(hdr, plaintext []byte) []byte {
+	v := m.mac.s2v(plaintext, m.ad, hdr)
+	out := make([]byte, len(v)+len(plaintext))
+	copy(out, v[:])
+	m.xorKeyStream(out[len(v):], plaintext, v)
+	return out
+}
+
+// open checks and decrypts the SIV and ciphertext in sealed
+func (m *Middleware) open(hdr, sealed []byte) ([]byte, error) {
+	if len(sealed) < 16 {
+		return nil, ErrNotAuthentic
+	}
+	var v [16]byte
+	copy(v[:], sealed)
+	plaintext := make([]byte, len(sealed)-16)
+	m.xorKeyStream(plaintext, sealed[16:], v)
+	want := m.mac.s2v(plaintext, m.ad, hdr)
+	if subtle.ConstantTimeCompare(v[:], want[:]) != 1 {
+		clear(plaintext)
+		return nil, ErrNotAuthentic
+	}
+	return plaintext, nil
+}
+
+// xorKeyStream runs AES-CTR with the SIV as counter, with the top bits of
+// its last two 32 bit words cleared
+func (m *Middleware) xorKeyStream(dst, src []byte, v [16]byte) {
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+	cipher.NewCTR(m.ctr, v[:]).XORKeyStream(dst, src)
+}
+
+// Writer buffers the stream and writes it sealed on Close, w is not closed
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return &writer{m: m, w: w, state: middleware.WriterState{Layer: "siv"}}
+}
+
+type writer struct {
+	m     *Middleware
+	w     io.Writer
+	buf   []byte
+	state middleware.WriterState
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if len(w.buf)+len(p) > w.m.maxSize {
+		return 0, w.state.Fail(ErrTooLarge)
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		defer clear(w.buf)
+		hdr := make([]byte, headerSize)
+		copy(hdr, magic[:])
+		hdr[len(magic)] = FormatVersion
+		if _, err := io.ReadFull(w.m.rand, hdr[len(magic)+1:]); err != nil {
+			return fmt.Errorf("siv: failed to generate nonce: %w", err)
+		}
+		_, err := w.w.Write(append(hdr, w.m.seal(hdr, w.buf)...))
+		return err
+	})
+}
+
+// Reader reads and opens the whole stream on the first Read
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return &reader{m: m, r: r, state: middleware.ReaderState{Layer: "siv"}}
+}
+
+type reader struct {
+	m     *Middleware
+	r     io.Reader
+	plain *bytes.Reader
+	state middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	if r.plain == nil {
+		plain, err := r.open()
+		if err != nil {
+			return r.state.Track(0, err)
+		}
+		r.plain = bytes.NewReader(plain)
+	}
+	return r.state.Track(r.plain.Read(p))
+}
+
+func (r *reader) open() ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r.r, int64(headerSize+16+r.m.maxSize+1)))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > headerSize+16+r.m.maxSize {
+		return nil, ErrTooLarge
+	}
+	if len(data) < headerSize || [3]byte(data[:3]) != magic {
+		return nil, errors.New("siv: not an SIV stream")
+	}
+	if _, err := middleware.CheckVersion("siv", data[3], FormatVersion, middleware.RejectUnknown); err != nil {
+		return nil, err
+	}
+	return r.m.open(data[:headerSize], data[headerSize:])
+}
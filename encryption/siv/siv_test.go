@@ -0,0 +1,148 @@
+package siv_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/encryption/siv"
+)
+
+func newKey(t *testing.T, size int) []byte {
+	t.Helper()
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, m *siv.Middleware, data []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func decrypt(m *siv.Middleware, enc []byte) ([]byte, error) {
+	return io.ReadAll(m.Reader(bytes.NewReader(enc)))
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, keySize := range []int{32, 64} {
+		m := siv.New(newKey(t, keySize), siv.WithMaxSize(4096), siv.WithAssociatedData([]byte("buffer")))
+		for _, size := range []int{0, 1, 15, 16, 17, 4096} {
+			data := make([]byte, size)
+			rand.Read(data)
+			got, err := decrypt(m, encrypt(t, m, data))
+			if err != nil {
+				t.Fatalf("key %d, size %d: %v", keySize, size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("key %d, size %d: round trip mismatch", keySize, size)
+			}
+		}
+	}
+}
+
+func TestEqualBuffersEncryptDifferently(t *testing.T) {
+	m := siv.New(newKey(t, 64))
+	data := []byte("the same buffer")
+	if bytes.Equal(encrypt(t, m, data), encrypt(t, m, data)) {
+		t.Fatal("equal buffers encrypted to the same stream")
+	}
+}
+
+func TestRepeatedNonce(t *testing.T) {
+	// a fixed nonce source must still decrypt, only equality leaks
+	m := siv.New(newKey(t, 64), siv.WithRand(bytes.NewReader(make([]byte, 64))))
+	a := encrypt(t, m, []byte("first buffer"))
+	b := encrypt(t, m, []byte("other buffer"))
+	if bytes.Equal(a, b) {
+		t.Fatal("different buffers encrypted to the same stream")
+	}
+	for _, enc := range [][]byte{a, b} {
+		if _, err := decrypt(m, enc); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriterRejectsTooLarge(t *testing.T) {
+	m := siv.New(newKey(t, 32), siv.WithMaxSize(8))
+	w := m.Writer(io.Discard)
+	if _, err := w.Write(make([]byte, 9)); !errors.Is(err, siv.ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+}
+
+func TestHostileStreams(t *testing.T) {
+	m := siv.New(newKey(t, 64), siv.WithMaxSize(64))
+	valid := encrypt(t, m, []byte("attack at dawn"))
+	const headerSize = 20
+
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(bytes.Clone(valid))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"empty", nil, nil},
+		{"truncated header", valid[:headerSize-1], nil},
+		{"bad magic", modify(func(b []byte) []byte { b[0] = 'X'; return b }), nil},
+		{"unknown version", modify(func(b []byte) []byte { b[3] = 99; return b }), nil},
+		{"header only", valid[:headerSize], siv.ErrNotAuthentic},
+		{"changed nonce", modify(func(b []byte) []byte { b[4] ^= 1; return b }), siv.ErrNotAuthentic},
+		{"flipped siv", modify(func(b []byte) []byte { b[headerSize] ^= 1; return b }), siv.ErrNotAuthentic},
+		{"flipped ciphertext", modify(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }), siv.ErrNotAuthentic},
+		{"truncated ciphertext", valid[:len(valid)-1], siv.ErrNotAuthentic},
+		{"appended data", append(bytes.Clone(valid), 0), siv.ErrNotAuthentic},
+		{"too large", append(bytes.Clone(valid), make([]byte, 64)...), siv.ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(m, tt.data)
+			if err == nil {
+				t.Fatal("hostile stream accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if len(got) != 0 {
+				t.Fatalf("returned %d bytes of a hostile stream", len(got))
+			}
+		})
+	}
+}
+
+func TestWrongKeyOrAssociatedData(t *testing.T) {
+	key := newKey(t, 64)
+	enc := encrypt(t, siv.New(key, siv.WithAssociatedData([]byte("a"))), []byte("secret"))
+	for name, m := range map[string]*siv.Middleware{
+		"wrong key":               siv.New(newKey(t, 64), siv.WithAssociatedData([]byte("a"))),
+		"wrong associated data":   siv.New(key, siv.WithAssociatedData([]byte("b"))),
+		"missing associated data": siv.New(key),
+	} {
+		if _, err := decrypt(m, enc); !errors.Is(err, siv.ErrNotAuthentic) {
+			t.Fatalf("%s: got %v, want ErrNotAuthentic", name, err)
+		}
+	}
+}
+
+func TestInvalidKeySize(t *testing.T) {
+	for _, size := range []int{0, 16, 48, 65} {
+		if _, err := siv.NewE(make([]byte, size)); !errors.Is(err, siv.ErrInvalidKeySize) {
+			t.Fatalf("key size %d: got %v, want ErrInvalidKeySize", size, err)
+		}
+	}
+}
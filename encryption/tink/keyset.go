@@ -0,0 +1,324 @@
+package tink
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+)
+
+// StreamingKeyTypeURL is the type URL of AES-GCM-HKDF streaming keys
+const StreamingKeyTypeURL = "type.googleapis.com/google.crypto.tink.AesGcmHkdfStreamingKey"
+
+var (
+	// ErrInvalidKeyset is returned for keysets that cannot be parsed
+	ErrInvalidKeyset = errors.New("tink: invalid keyset")
+
+	// ErrNoPrimaryKey is returned for keysets without an enabled primary
+	// AES-GCM-HKDF streaming key
+	ErrNoPrimaryKey = errors.New("tink: keyset has no usable primary key")
+)
+
+// Key status and hash type values of the Tink protos
+const (
+	statusEnabled = 1
+
+	hashSHA1   = 1
+	hashSHA256 = 3
+	hashSHA512 = 4
+)
+
+// AEAD decrypts encrypted keysets, e.g. a Tink KMS AEAD. It matches the
+// tink.AEAD interface.
+type AEAD interface {
+	Encrypt(plaintext, associatedData []byte) ([]byte, error)
+	Decrypt(ciphertext, associatedData []byte) ([]byte, error)
+}
+
+// Keyset holds the enabled AES-GCM-HKDF streaming keys of a Tink keyset.
+// Keys of other types are ignored.
+type Keyset struct {
+	primary uint32
+	keys    []streamingKey
+}
+
+// streamingKey is an AesGcmHkdfStreamingKey
+type streamingKey struct {
+	id          uint32
+	value       []byte
+	segmentSize int
+	keySize     int
+	hash        func() hash.Hash
+}
+
+// headerSize returns the size of the ciphertext header: its length byte,
+// the salt and the nonce prefix
+func (k *streamingKey) headerSize() int {
+	return 1 + k.keySize + noncePrefixSize
+}
+
+// PrimaryKeyID returns the ID of the key used for encryption
+func (ks *Keyset) PrimaryKeyID() uint32 {
+	return ks.primary
+}
+
+// Len returns the number of usable keys
+func (ks *Keyset) Len() int {
+	return len(ks.keys)
+}
+
+func (ks *Keyset) primaryKey() *streamingKey {
+	for i := range ks.keys {
+		if ks.keys[i].id == ks.primary {
+			return &ks.keys[i]
+		}
+	}
+	return nil
+}
+
+// ParseKeyset parses a cleartext keyset in the binary or JSON format
+func ParseKeyset(data []byte) (*Keyset, error) {
+	if isJSON(data) {
+		return parseJSONKeyset(data)
+	}
+	return parseBinaryKeyset(data)
+}
+
+// ParseEncryptedKeyset parses a keyset encrypted with kek, in the binary or
+// JSON format. associatedData must match the data used when the keyset was
+// written, it is empty for keysets written without.
+func ParseEncryptedKeyset(data []byte, kek AEAD, associatedData []byte) (*Keyset, error) {
+	var enc []byte
+	if isJSON(data) {
+		var v struct {
+			EncryptedKeyset []byte `json:"encryptedKeyset"`
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidKeyset, err)
+		}
+		enc = v.EncryptedKeyset
+	} else {
+		err := walkFields(data, func(field int, _ uint64, b []byte) error {
+			if field == 2 {
+				enc = b
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(enc) == 0 {
+		return nil, fmt.Errorf("%w: no encrypted keyset", ErrInvalidKeyset)
+	}
+	if associatedData == nil {
+		associatedData = []byte{}
+	}
+	plain, err := kek.Decrypt(enc, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("tink: failed to decrypt keyset: %w", err)
+	}
+	return parseBinaryKeyset(plain)
+}
+
+func isJSON(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{'
+}
+
+func parseJSONKeyset(data []byte) (*Keyset, error) {
+	var v struct {
+		PrimaryKeyID uint32 `json:"primaryKeyId"`
+		Key          []struct {
+			KeyData struct {
+				TypeURL string `json:"typeUrl"`
+				Value   []byte `json:"value"`
+			} `json:"keyData"`
+			Status string `json:"status"`
+			KeyID  uint32 `json:"keyId"`
+		} `json:"key"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidKeyset, err)
+	}
+	ks := &Keyset{primary: v.PrimaryKeyID}
+	for _, k := range v.Key {
+		if k.Status != "ENABLED" || k.KeyData.TypeURL != StreamingKeyTypeURL {
+			continue
+		}
+		sk, err := parseStreamingKey(k.KeyID, k.KeyData.Value)
+		if err != nil {
+			return nil, err
+		}
+		ks.keys = append(ks.keys, sk)
+	}
+	return ks.check()
+}
+
+func parseBinaryKeyset(data []byte) (*Keyset, error) {
+	ks := &Keyset{}
+	err := walkFields(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			ks.primary = uint32(v)
+		case 2:
+			var (
+				typeURL string
+				value   []byte
+				status  uint64
+				id      uint64
+			)
+			err := walkFields(b, func(field int, v uint64, b []byte) error {
+				switch field {
+				case 1:
+					return walkFields(b, func(field int, _ uint64, b []byte) error {
+						switch field {
+						case 1:
+							typeURL = string(b)
+						case 2:
+							value = b
+						}
+						return nil
+					})
+				case 2:
+					status = v
+				case 3:
+					id = v
+				}
+				return nil
+			})
+			if err != nil || status != statusEnabled || typeURL != StreamingKeyTypeURL {
+				return err
+			}
+			sk, err := parseStreamingKey(uint32(id), value)
+			if err != nil {
+				return err
+			}
+			ks.keys = append(ks.keys, sk)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ks.check()
+}
+
+func (ks *Keyset) check() (*Keyset, error) {
+	if ks.primaryKey() == nil {
+		return nil, ErrNoPrimaryKey
+	}
+	return ks, nil
+}
+
+// parseStreamingKey decodes an AesGcmHkdfStreamingKey: version (1),
+// params (2) with segment size (1), derived key size (2) and HKDF hash (3),
+// and the key value (3)
+func parseStreamingKey(id uint32, data []byte) (streamingKey, error) {
+	k := streamingKey{id: id}
+	var version, hashType uint64
+	err := walkFields(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			version = v
+		case 2:
+			return walkFields(b, func(field int, v uint64, _ []byte) error {
+				switch field {
+				case 1:
+					k.segmentSize = int(min(v, math.MaxInt32))
+				case 2:
+					k.keySize = int(min(v, math.MaxInt32))
+				case 3:
+					hashType = v
+				}
+				return nil
+			})
+		case 3:
+			k.value = b
+		}
+		return nil
+	})
+	if err != nil {
+		return k, err
+	}
+	if version != 0 {
+		return k, fmt.Errorf("%w: key %d has version %d", ErrInvalidKeyset, id, version)
+	}
+	switch hashType {
+	case hashSHA1:
+		k.hash = sha1.New
+	case hashSHA256:
+		k.hash = sha256.New
+	case hashSHA512:
+		k.hash = sha512.New
+	default:
+		return k, fmt.Errorf("%w: key %d has unsupported HKDF hash %d", ErrInvalidKeyset, id, hashType)
+	}
+	if k.keySize != 16 && k.keySize != 32 {
+		return k, fmt.Errorf("%w: key %d has derived key size %d", ErrInvalidKeyset, id, k.keySize)
+	}
+	if len(k.value) < k.keySize {
+		return k, fmt.Errorf("%w: key %d is shorter than its derived keys", ErrInvalidKeyset, id)
+	}
+	if k.segmentSize <= k.headerSize()+tagSize || k.segmentSize > maxSegmentSize {
+		return k, fmt.Errorf("%w: key %d has segment size %d", ErrInvalidKeyset, id, k.segmentSize)
+	}
+	return k, nil
+}
+
+// walkFields calls fn for every field of a protobuf message with the value
+// of varint fields or the content of length-delimited fields. Fixed-size
+// fields are skipped.
+func walkFields(data []byte, fn func(field int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("%w: malformed protobuf", ErrInvalidKeyset)
+		}
+		data = data[n:]
+		field := int(tag >> 3)
+		var (
+			v uint64
+			b []byte
+		)
+		switch tag & 7 {
+		case 0:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("%w: malformed protobuf", ErrInvalidKeyset)
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return fmt.Errorf("%w: malformed protobuf", ErrInvalidKeyset)
+			}
+			data = data[8:]
+			continue
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return fmt.Errorf("%w: malformed protobuf", ErrInvalidKeyset)
+			}
+			b = data[n : n+int(size)]
+			data = data[n+int(size):]
+		case 5:
+			if len(data) < 4 {
+				return fmt.Errorf("%w: malformed protobuf", ErrInvalidKeyset)
+			}
+			data = data[4:]
+			continue
+		default:
+			return fmt.Errorf("%w: unsupported protobuf wire type %d", ErrInvalidKeyset, tag&7)
+		}
+		if err := fn(field, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
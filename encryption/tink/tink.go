@@ -0,0 +1,365 @@
+// Package tink encrypts buffers in the Tink streaming AEAD format with keys
+// of Tink keysets, for organizations standardized on Tink across languages.
+// Streams written by the middleware are decrypted by the AES-GCM-HKDF
+// streaming primitive of the Tink libraries and vice versa.
+//
+// Keysets are read in the binary or JSON format, in cleartext with
+// ParseKeyset or encrypted with a key encryption AEAD, e.g. a KMS key, with
+// ParseEncryptedKeyset. Only AES-GCM-HKDF streaming keys are supported.
+//
+// The ciphertext is a header of its length byte, a random salt and a nonce
+// prefix, followed by AES-GCM segments whose key is derived with HKDF from
+// the key value, the salt and the associated data. Every segment is
+// authenticated before it is returned by Reader.
+package tink
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"golang.org/x/crypto/hkdf"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+const (
+	noncePrefixSize = 7
+	tagSize         = 16
+
+	// maxSegmentSize bounds the segment buffers of Readers
+	maxSegmentSize = 64 << 20
+)
+
+var (
+	// ErrNotAuthentic is returned by Readers if no key of the keyset
+	// authenticates the stream or a segment was modified
+	ErrNotAuthentic = errors.New("tink: message authentication failed")
+
+	// ErrTruncated is returned by Readers for streams missing the last segment
+	ErrTruncated = errors.New("tink: truncated ciphertext")
+)
+
+// Middleware encrypts with the primary key of a keyset and decrypts with
+// any of its keys
+type Middleware struct {
+	keyset *Keyset
+	ad     []byte
+	rand   io.Reader
+}
+
+// Ensure Middleware implements middleware.Middleware and middleware.Describer interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+)
+
+// Option configures the middleware
+type Option func(*Middleware)
+
+// WithAssociatedData sets the associated data authenticated with every
+// stream, it must be the same when reading
+func WithAssociatedData(ad []byte) Option {
+	return func(m *Middleware) {
+		m.ad = ad
+	}
+}
+
+// WithRand sets the source of salts and nonce prefixes.
+// By default middleware.Rand() is used.
+func WithRand(r io.Reader) Option {
+	return func(m *Middleware) {
+		m.rand = r
+	}
+}
+
+// New creates a middleware using the keys of ks
+func New(ks *Keyset, opts ...Option) *Middleware {
+	m := &Middleware{keyset: ks}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.rand == nil {
+		m.rand = middleware.Rand()
+	}
+	return m
+}
+
+// Describe reports the streaming AEAD of the primary key
+func (m *Middleware) Describe() middleware.Component {
+	k := m.keyset.primaryKey()
+	return middleware.Component{
+		Type:      string(middleware.RoleEncryption),
+		Algorithm: fmt.Sprintf("aes-%d-gcm-hkdf", k.keySize*8),
+		KeyBits:   k.keySize * 8,
+		Integrity: "aead",
+		Properties: map[string]string{
+			"format":         "tink-streaming-aead",
+			"key_management": "keyset",
+			"segment_size":   strconv.Itoa(k.segmentSize),
+			"keys":           strconv.Itoa(m.keyset.Len()),
+		},
+	}
+}
+
+// segmentCipher derives the AES-GCM cipher of a stream
+func (m *Middleware) segmentCipher(k *streamingKey, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, k.keySize)
+	defer clear(key)
+	if _, err := io.ReadFull(hkdf.New(k.hash, k.value, salt, m.ad), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// segmentNonce returns the nonce of segment i: the nonce prefix, the
+// big-endian segment number and 1 for the last segment, 0 otherwise
+func segmentNonce(dst, prefix []byte, i uint32, last bool) []byte {
+	dst = append(dst[:0], prefix...)
+	dst = binary.BigEndian.AppendUint32(dst, i)
+	if last {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// Writer wraps w with encryption under the primary key. The writer must be
+// closed to write the last segment. Errors are returned from Write and Close.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	k := m.keyset.primaryKey()
+	hdr := make([]byte, k.headerSize())
+	hdr[0] = byte(len(hdr))
+	if _, err := io.ReadFull(m.rand, hdr[1:]); err != nil {
+		return &errWriter{err: fmt.Errorf("tink: failed to generate salt: %w", err)}
+	}
+	aead, err := m.segmentCipher(k, hdr[1:1+k.keySize])
+	if err != nil {
+		return &errWriter{err: err}
+	}
+	return &writer{
+		w:      w,
+		aead:   aead,
+		header: hdr,
+		prefix: hdr[1+k.keySize:],
+		buf:    make([]byte, 0, k.segmentSize-tagSize),
+		first:  k.segmentSize - k.headerSize() - tagSize,
+		state:  middleware.WriterState{Layer: "tink"},
+	}
+}
+
+type writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	header []byte // written with the first segment
+	prefix []byte
+	buf    []byte // plaintext of the current segment
+	first  int    // plaintext size of the first segment
+	seg    uint32
+	nonce  []byte
+	out    []byte
+	state  middleware.WriterState
+}
+
+// segmentSize returns the plaintext size of the current segment
+func (w *writer) segmentSize() int {
+	if w.seg == 0 {
+		return w.first
+	}
+	return cap(w.buf)
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full segment is only known not to be the last when more data follows
+		if len(w.buf) == w.segmentSize() {
+			if err := w.flush(false); err != nil {
+				return written, w.state.Fail(err)
+			}
+		}
+		n := min(len(p), w.segmentSize()-len(w.buf))
+		w.buf = append(w.buf, p[:n]...)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// flush encrypts and writes the current segment
+func (w *writer) flush(last bool) error {
+	if !last && w.seg == 1<<32-1 {
+		return errors.New("tink: too many segments")
+	}
+	w.nonce = segmentNonce(w.nonce, w.prefix, w.seg, last)
+	w.out = append(w.out[:0], w.header...)
+	w.out = w.aead.Seal(w.out, w.nonce, w.buf, nil)
+	w.header = nil
+	w.buf = w.buf[:0]
+	w.seg++
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+// Close writes the last segment, w is not closed
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		return w.flush(true)
+	})
+}
+
+// Reader wraps r with decryption. The key is selected by trying the keys
+// of the keyset on the first segment. Errors are returned from Read.
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return &reader{m: m, r: r, state: middleware.ReaderState{Layer: "tink"}}
+}
+
+type reader struct {
+	m      *Middleware
+	r      io.Reader
+	aead   cipher.AEAD // nil until the header was read
+	prefix []byte
+	size   int    // ciphertext size of full segments
+	in     []byte // ciphertext read ahead
+	plain  []byte // decrypted segment
+	out    []byte // decrypted plaintext not yet returned
+	seg    uint32
+	last   bool
+	nonce  []byte
+	state  middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	return r.state.Track(r.read(p))
+}
+
+func (r *reader) read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		var err error
+		if r.aead == nil {
+			err = r.start()
+		} else {
+			err = r.next()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// fill reads ahead until in holds size bytes plus one, which tells whether
+// the segment is the last one. It reports whether the stream ended.
+func (r *reader) fill(size int) (bool, error) {
+	if cap(r.in) < size+1 {
+		r.in = append(make([]byte, 0, size+1), r.in...)
+	}
+	for len(r.in) <= size {
+		n, err := r.r.Read(r.in[len(r.in) : size+1])
+		r.in = r.in[:len(r.in)+n]
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// start reads the header and finds the key authenticating the first segment
+func (r *reader) start() error {
+	var n [1]byte
+	if _, err := io.ReadFull(r.r, n[:]); err != nil {
+		if err == io.EOF {
+			return ErrTruncated
+		}
+		return err
+	}
+	// the length byte counts itself, so no key has a header of length 0
+	hdr := make([]byte, max(int(n[0]), 1))
+	hdr[0] = n[0]
+	if _, err := io.ReadFull(r.r, hdr[1:]); err != nil {
+		return fmt.Errorf("tink: read header: %w", err)
+	}
+	var tried bool
+	for i := range r.m.keyset.keys {
+		k := &r.m.keyset.keys[i]
+		if k.headerSize() != len(hdr) {
+			continue
+		}
+		size := k.segmentSize - len(hdr)
+		eof, err := r.fill(size)
+		if err != nil {
+			return err
+		}
+		aead, err := r.m.segmentCipher(k, hdr[1:1+k.keySize])
+		if err != nil {
+			return err
+		}
+		tried = true
+		r.aead, r.prefix, r.size = aead, hdr[1+k.keySize:], k.segmentSize
+		if err := r.decrypt(min(size, len(r.in)), eof); err == nil {
+			return nil
+		}
+		r.aead, r.seg, r.last = nil, 0, false
+	}
+	if !tried {
+		return fmt.Errorf("%w: no key matches header length %d", ErrNotAuthentic, len(hdr))
+	}
+	return ErrNotAuthentic
+}
+
+// next decrypts the following segment
+func (r *reader) next() error {
+	eof, err := r.fill(r.size)
+	if err != nil {
+		return err
+	}
+	return r.decrypt(min(r.size, len(r.in)), eof)
+}
+
+// decrypt opens the first n bytes of in as the current segment
+func (r *reader) decrypt(n int, eof bool) error {
+	if n < tagSize {
+		return ErrTruncated
+	}
+	last := eof && n == len(r.in)
+	r.nonce = segmentNonce(r.nonce, r.prefix, r.seg, last)
+	plain, err := r.aead.Open(r.plain[:0], r.nonce, r.in[:n], nil)
+	if err != nil {
+		return ErrNotAuthentic
+	}
+	r.plain, r.out = plain, plain
+	r.in = append(r.in[:0], r.in[n:]...)
+	r.seg++
+	r.last = last
+	if !last && r.seg == 0 {
+		return errors.New("tink: too many segments")
+	}
+	return nil
+}
+
+type errWriter struct {
+	err error
+}
+
+func (e *errWriter) Write([]byte) (int, error) { return 0, e.err }
+func (e *errWriter) Close() error              { return e.err }
@@ -0,0 +1,401 @@
+package tink_test
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/encryption/tink"
+	"schneider.vip/hybridbuffer/middleware/testrand"
+)
+
+// Streams written by github.com/google/tink/go v1.7.0 under its AES-GCM-HKDF
+// streaming keys of vectorKeyset, and by the middleware with the source
+// testrand.New("tink interop") under the primary key, which Tink decrypts
+const (
+	vectorKeyset = `{"primaryKeyId":2550401975, "key":[{"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmHkdfStreamingKey", "value":"EgcIgAEQEBgDGhDdjkQ6x8uFe3TqVKnIoj6F", "keyMaterialType":"SYMMETRIC"}, "status":"ENABLED", "keyId":2903595780, "outputPrefixType":"RAW"}, {"keyData":{"typeUrl":"type.googleapis.com/google.crypto.tink.AesGcmHkdfStreamingKey", "value":"EgcIgAIQIBgEGiBLRNjxiivwNvnHQ0fWU6CDwz8MnMdgFkjX1q7rDOGjSA==", "keyMaterialType":"SYMMETRIC"}, "status":"ENABLED", "keyId":2550401975, "outputPrefixType":"RAW"}]}`
+	vectorAD     = "hybridbuffer tink vectors"
+
+	// AES-128, HKDF-SHA256, 128 byte segments
+	vectorTinkAES128 = "GB/bab8f1XFPEDghVWOIJ0HcWdNAElBhUw7h3kytiXvud64fITkjl6zpcz9kO2jvQjdQlDyn5ykPqzuDp19wIRznZXjoihoug1BBbPgxFMb4Y8dKlcZkbg94VFSORNeTUzturumfmAJnpAmEWz8qiXZBRDj8ex2PSK9EZtFvV9VePpP2CvADk+UdDpjWhBXgMfl3y+qBiSsWw4VwPPIC5XRoHNt7v3jxYbCaQPaw908rrNkhXbM3Ah995/MTS+q1G3kfo3NBjNmYegxxcdcoIJp7M75XcQJ5nlG/7/u6JwGJYVKaGmMhFactMHnaJapYnT7q+gbObFAUzM19Isnm7Q3oW5LXt/fByJAqAgjqq5A5Z4L5gja/EtaYSv7ZAvLnBU6mo8uvHT9iWeS03FA1ZrLJ2TMzCbA/tX54QBA07MGCSRt0ch/j2XIHmGOsDXFVshLIKPap/eYa0S8T1pS9RHQnhVMu/YgvslEKaKxznKmUX1aFFoEAJiq/S5o2hUZausDOBfqdkgk1mIfyd1JtHvmxPBqsKJhB"
+	vectorTinkEmpty  = "GHONpry+9T2tkDRYg/ldsfp8VXX0QDuUzdIrK+zm1k/NHeCvM7nZ9w=="
+	// AES-256, HKDF-SHA512, 256 byte segments, the primary key
+	vectorTinkAES256 = "KLrFKuiOtTPUw73i2v7DHudqfpdIkkRtb76BW76J/pCzTtUzqRBTNFDZQ/6iMAqUa4NankyLfcZ4C/fj5qOjMW/DoKrhnoscQ2EQgjeDHT991L2RRbpRqUFxV+NLc/oIi8mzGmRcGDA7dPcNrzaDW7RxrQukjp6iVlAu4SVv/Y1HktLZnhDi2mbwE1DMQ8uhTilnrOFAEfCZ8iS8lVtMmYCTcG93h6869VqHn4YUDQ2oEO9NsqNQ3K2xYzkNbh/VNdfYkAwyZymNJDsg7TfEcxdoXa4Y8DVljg13Otc1ew+d0RmOlYlYMvG98cNvQC+nnoM2KXAzCjXIaGAuMvYq58O830imasZnkInzK/+MVyPGxqIDBDjzGwHPPIsq6+KsBuyqXIbHkDp5lXugsjTcHnJQSylzs2D0vh90cbr7uF14EojQI+jJW4ZwISY5C8IlmtzTN/IxiLNCQAe1X9IBfoDcSXiNTnn4xn9n/b2p0wdEEa3IW2BNZC87bXcpTstvsbEOZcKYUJU="
+	vectorMiddleware = "KBYaMKEhM4vVBFAlE/3X64FxD3/8Kbfj5h77rEkGVB3E/sNUq1PJw3V6AapKIiKxOU9UIRKXiLrgZgHLbDBxLWmrC6Eg+tnx/STHLC0VEviq4iA0YoHlP8mIj9/9Ti5KlszsOXLLR+cNuvTdnvl5cotDc07OFYsPr10kGz4RekeJIPvcslpcyRI2DPYExoc5YTriP7X/i7mWc8aa+J4++jrHRS6fVMPeOoCal1Wg/I+7nsYnfTr5AVaPHdqo7IqHSv/r6warUG2QQxVe+DY9+2bkTiYaBLSaDh/NLE1CQ1vcLIttCQFaVWxQkKG35l9i6czxJBmtyoHaa4kVCuTZwmCm/zzqEhFInS2v6Ncd1PCC7wSQNgYSpAZJkQGG6OHm60ySH5y3NI2lk63uM5F3YM/fWFXIiTt5JMIp0wdVzLYhxlnycdn69YDJXydahgVS3j6qa2IqXdNa1lgVDyW4EVa1USuapRJisNPhbGuZBFGpSdSScL8PtlhtBbzBenr4ApFMmo6usxc="
+)
+
+// vectorPlaintext is the plaintext of the non-empty vectors
+var vectorPlaintext = strings.Repeat("hello from Tink ", 20)
+
+func vector(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Protobuf encoding of the keyset messages
+
+func varintField(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func bytesField(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+type keyParams struct {
+	version     uint64
+	segmentSize uint64
+	keySize     uint64
+	hash        uint64 // 1 SHA1, 3 SHA256, 4 SHA512
+	value       []byte
+}
+
+func defaultParams(t *testing.T) keyParams {
+	t.Helper()
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		t.Fatal(err)
+	}
+	return keyParams{segmentSize: 128, keySize: 16, hash: 3, value: value}
+}
+
+// streamingKey encodes an AesGcmHkdfStreamingKey
+func (p keyParams) streamingKey() []byte {
+	var params []byte
+	params = varintField(params, 1, p.segmentSize)
+	params = varintField(params, 2, p.keySize)
+	params = varintField(params, 3, p.hash)
+	var b []byte
+	b = varintField(b, 1, p.version)
+	b = bytesField(b, 2, params)
+	return bytesField(b, 3, p.value)
+}
+
+type keysetKey struct {
+	id     uint32
+	status uint64 // 1 enabled, 2 disabled
+	params keyParams
+}
+
+// binaryKeyset encodes a Keyset
+func binaryKeyset(primary uint32, keys ...keysetKey) []byte {
+	b := varintField(nil, 1, uint64(primary))
+	for _, k := range keys {
+		var data []byte
+		data = bytesField(data, 1, []byte(tink.StreamingKeyTypeURL))
+		data = bytesField(data, 2, k.params.streamingKey())
+		var key []byte
+		key = bytesField(key, 1, data)
+		key = varintField(key, 2, k.status)
+		key = varintField(key, 3, uint64(k.id))
+		b = bytesField(b, 2, key)
+	}
+	return b
+}
+
+func parseKeyset(t *testing.T, data []byte) *tink.Keyset {
+	t.Helper()
+	ks, err := tink.ParseKeyset(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func encrypt(t *testing.T, m *tink.Middleware, data []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func decrypt(m *tink.Middleware, enc []byte) ([]byte, error) {
+	return io.ReadAll(m.Reader(bytes.NewReader(enc)))
+}
+
+func TestRoundTrip(t *testing.T) {
+	p := defaultParams(t)
+	for _, hash := range []uint64{1, 3, 4} {
+		for _, keySize := range []uint64{16, 32} {
+			p.hash, p.keySize = hash, keySize
+			ks := parseKeyset(t, binaryKeyset(7, keysetKey{id: 7, status: 1, params: p}))
+			m := tink.New(ks, tink.WithAssociatedData([]byte("buffer")))
+			// the first segment holds less plaintext than the others, as
+			// it also carries the header
+			first := int(p.segmentSize) - (1 + int(keySize) + 7) - 16
+			for _, size := range []int{0, 1, first - 1, first, first + 1, first + 112, first + 3*112 + 5} {
+				data := make([]byte, size)
+				rand.Read(data)
+				got, err := decrypt(m, encrypt(t, m, data))
+				if err != nil {
+					t.Fatalf("hash %d, key size %d, size %d: %v", hash, keySize, size, err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("hash %d, key size %d, size %d: round trip mismatch", hash, keySize, size)
+				}
+			}
+		}
+	}
+}
+
+func TestDecryptTinkStreams(t *testing.T) {
+	ks := parseKeyset(t, []byte(vectorKeyset))
+	m := tink.New(ks, tink.WithAssociatedData([]byte(vectorAD)))
+	tests := []struct {
+		name   string
+		vector string
+		want   string
+	}{
+		{"AES-128", vectorTinkAES128, vectorPlaintext},
+		{"AES-256", vectorTinkAES256, vectorPlaintext},
+		{"empty", vectorTinkEmpty, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(m, vector(t, tt.vector))
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestWriterMatchesTinkVector(t *testing.T) {
+	// the stream is byte for byte the one Tink decrypted, so Writers still
+	// write streams Tink reads
+	ks := parseKeyset(t, []byte(vectorKeyset))
+	m := tink.New(ks, tink.WithAssociatedData([]byte(vectorAD)), tink.WithRand(testrand.New("tink interop")))
+	if got := encrypt(t, m, []byte(vectorPlaintext)); !bytes.Equal(got, vector(t, vectorMiddleware)) {
+		t.Fatalf("stream differs from the vector: %s", base64.StdEncoding.EncodeToString(got))
+	}
+}
+
+func TestJSONKeyset(t *testing.T) {
+	p := defaultParams(t)
+	type keyData struct {
+		TypeURL string `json:"typeUrl"`
+		Value   []byte `json:"value"`
+	}
+	type key struct {
+		KeyData keyData `json:"keyData"`
+		Status  string  `json:"status"`
+		KeyID   uint32  `json:"keyId"`
+	}
+	data, err := json.Marshal(struct {
+		PrimaryKeyID uint32 `json:"primaryKeyId"`
+		Key          []key  `json:"key"`
+	}{42, []key{{keyData{tink.StreamingKeyTypeURL, p.streamingKey()}, "ENABLED", 42}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := tink.New(parseKeyset(t, data))
+	fromBinary := tink.New(parseKeyset(t, binaryKeyset(42, keysetKey{id: 42, status: 1, params: p})))
+	msg := []byte("same key in both formats")
+	got, err := decrypt(fromBinary, encrypt(t, fromJSON, msg))
+	if err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := keysetKey{id: 1, status: 1, params: defaultParams(t)}
+	cur := keysetKey{id: 2, status: 1, params: defaultParams(t)}
+	cur.params.keySize, cur.params.segmentSize = 32, 256
+	before := tink.New(parseKeyset(t, binaryKeyset(1, old)))
+	after := tink.New(parseKeyset(t, binaryKeyset(2, old, cur)))
+
+	msg := bytes.Repeat([]byte("rotated "), 100)
+	for name, enc := range map[string][]byte{
+		"old key":     encrypt(t, before, msg),
+		"primary key": encrypt(t, after, msg),
+	} {
+		got, err := decrypt(after, enc)
+		if err != nil || !bytes.Equal(got, msg) {
+			t.Fatalf("%s: got %d bytes, %v", name, len(got), err)
+		}
+	}
+	// a disabled key no longer decrypts
+	old.status = 2
+	disabled := tink.New(parseKeyset(t, binaryKeyset(2, old, cur)))
+	if _, err := decrypt(disabled, encrypt(t, before, msg)); !errors.Is(err, tink.ErrNotAuthentic) {
+		t.Fatalf("got %v, want ErrNotAuthentic", err)
+	}
+}
+
+func TestHostileStreams(t *testing.T) {
+	p := defaultParams(t)
+	m := tink.New(parseKeyset(t, binaryKeyset(1, keysetKey{id: 1, status: 1, params: p})))
+	msg := make([]byte, 300)
+	rand.Read(msg)
+	valid := encrypt(t, m, msg)
+	const headerSize = 1 + 16 + 7
+	segment := int(p.segmentSize)
+
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(bytes.Clone(valid))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"empty", nil, tink.ErrTruncated},
+		{"zero header length", []byte{0}, tink.ErrNotAuthentic},
+		{"one byte header", []byte{1, 0, 0}, tink.ErrNotAuthentic},
+		{"unknown header length", modify(func(b []byte) []byte { b[0]++; return b }), tink.ErrNotAuthentic},
+		{"truncated header", valid[:headerSize-1], nil},
+		{"header only", valid[:headerSize], nil},
+		{"changed salt", modify(func(b []byte) []byte { b[1] ^= 1; return b }), tink.ErrNotAuthentic},
+		{"changed nonce prefix", modify(func(b []byte) []byte { b[headerSize-1] ^= 1; return b }), tink.ErrNotAuthentic},
+		{"flipped first segment", modify(func(b []byte) []byte { b[headerSize] ^= 1; return b }), tink.ErrNotAuthentic},
+		{"flipped last segment", modify(func(b []byte) []byte { b[len(b)-1] ^= 1; return b }), tink.ErrNotAuthentic},
+		{"dropped last segment", valid[:2*segment], tink.ErrNotAuthentic},
+		{"truncated last segment", valid[:len(valid)-1], tink.ErrNotAuthentic},
+		{"appended segment", append(bytes.Clone(valid), valid[segment:2*segment]...), tink.ErrNotAuthentic},
+		{"swapped segments", append(append(bytes.Clone(valid[:segment]), valid[2*segment:]...), valid[segment:2*segment]...), tink.ErrNotAuthentic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(m, tt.data)
+			if err == nil {
+				t.Fatal("hostile stream accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if !bytes.HasPrefix(msg, got) {
+				t.Fatal("returned data that is not part of the plaintext")
+			}
+		})
+	}
+}
+
+func TestWrongAssociatedData(t *testing.T) {
+	ks := parseKeyset(t, binaryKeyset(1, keysetKey{id: 1, status: 1, params: defaultParams(t)}))
+	enc := encrypt(t, tink.New(ks, tink.WithAssociatedData([]byte("a"))), []byte("secret"))
+	if _, err := decrypt(tink.New(ks, tink.WithAssociatedData([]byte("b"))), enc); !errors.Is(err, tink.ErrNotAuthentic) {
+		t.Fatalf("got %v, want ErrNotAuthentic", err)
+	}
+}
+
+func TestHostileKeysets(t *testing.T) {
+	key := func(f func(p *keyParams)) []byte {
+		p := defaultParams(t)
+		f(&p)
+		return binaryKeyset(1, keysetKey{id: 1, status: 1, params: p})
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, tink.ErrNoPrimaryKey},
+		{"malformed varint", []byte{0x08, 0x80}, tink.ErrInvalidKeyset},
+		{"length beyond data", []byte{0x12, 0x7f, 0}, tink.ErrInvalidKeyset},
+		{"huge length", binary.AppendUvarint([]byte{0x12}, 1<<63), tink.ErrInvalidKeyset},
+		{"group wire type", []byte{0x0b}, tink.ErrInvalidKeyset},
+		{"truncated fixed64", []byte{0x09, 0, 0}, tink.ErrInvalidKeyset},
+		{"no primary key", binaryKeyset(2, keysetKey{id: 1, status: 1, params: defaultParams(t)}), tink.ErrNoPrimaryKey},
+		{"disabled primary key", binaryKeyset(1, keysetKey{id: 1, status: 2, params: defaultParams(t)}), tink.ErrNoPrimaryKey},
+		{"unknown version", key(func(p *keyParams) { p.version = 1 }), tink.ErrInvalidKeyset},
+		{"unknown hash", key(func(p *keyParams) { p.hash = 2 }), tink.ErrInvalidKeyset},
+		{"invalid key size", key(func(p *keyParams) { p.keySize = 24 }), tink.ErrInvalidKeyset},
+		{"short key value", key(func(p *keyParams) { p.value = p.value[:15] }), tink.ErrInvalidKeyset},
+		{"segment size below header", key(func(p *keyParams) { p.segmentSize = 1 + 16 + 7 + 16 }), tink.ErrInvalidKeyset},
+		{"huge segment size", key(func(p *keyParams) { p.segmentSize = 1 << 40 }), tink.ErrInvalidKeyset},
+		{"invalid JSON", []byte(`{"primaryKeyId": "x"}`), tink.ErrInvalidKeyset},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tink.ParseKeyset(tt.data); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// gcmAEAD is a key encryption AEAD for encrypted keysets
+type gcmAEAD struct {
+	aead cipher.AEAD
+}
+
+func newGCMAEAD(t *testing.T) *gcmAEAD {
+	t.Helper()
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &gcmAEAD{aead: aead}
+}
+
+func (g *gcmAEAD) Encrypt(plaintext, ad []byte) ([]byte, error) {
+	nonce := make([]byte, g.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return g.aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+func (g *gcmAEAD) Decrypt(ciphertext, ad []byte) ([]byte, error) {
+	n := g.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return g.aead.Open(nil, ciphertext[:n], ciphertext[n:], ad)
+}
+
+func TestEncryptedKeyset(t *testing.T) {
+	kek := newGCMAEAD(t)
+	plain := binaryKeyset(5, keysetKey{id: 5, status: 1, params: defaultParams(t)})
+	enc, err := kek.Encrypt(plain, []byte("keyset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytesField(nil, 2, enc)
+	ks, err := tink.ParseEncryptedKeyset(data, kek, []byte("keyset"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks.PrimaryKeyID() != 5 || ks.Len() != 1 {
+		t.Fatalf("got primary %d with %d keys", ks.PrimaryKeyID(), ks.Len())
+	}
+	jsonData, err := json.Marshal(map[string][]byte{"encryptedKeyset": enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tink.ParseEncryptedKeyset(jsonData, kek, []byte("keyset")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tink.ParseEncryptedKeyset(data, kek, nil); err == nil {
+		t.Fatal("keyset decrypted with wrong associated data")
+	}
+	if _, err := tink.ParseEncryptedKeyset(varintField(nil, 1, 1), kek, nil); !errors.Is(err, tink.ErrInvalidKeyset) {
+		t.Fatalf("got %v, want ErrInvalidKeyset", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Package tpm seals the stream keys of the sealed encryption middleware
+// with the local TPM 2.0, so spilled buffers can only be decrypted on the
+// host that wrote them. Each stream key becomes a sealed data object under
+// the storage root key, optionally bound to PCR values with WithPCRs; its
+// public and private areas and the PCR selection are stored in the stream
+// header.
+//
+// Device is implemented over a TPM library such as github.com/google/go-tpm,
+// e.g. with tpm2.Seal, tpm2.Load and tpm2.Unseal on /dev/tpmrm0:
+//
+//	encryption.NewSealed(tpm.New(device, tpm.WithPCRs(tpm.SHA256, 7)))
+//
+// A TPM needs tens of milliseconds per command, so readers of many
+// streams benefit from the keycache package.
+package tpm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+// DefaultTimeout bounds every TPM call
+const DefaultTimeout = 10 * time.Second
+
+// blobVersion is the version of the sealed key blob
+const blobVersion = 1
+
+// maxPCR is the highest PCR index of a PC client TPM
+const maxPCR = 23
+
+// Algorithm is a TPM_ALG_ID of a PCR bank
+type Algorithm uint16
+
+// PCR banks
+const (
+	SHA1   Algorithm = 0x0004
+	SHA256 Algorithm = 0x000b
+	SHA384 Algorithm = 0x000c
+)
+
+// PCRSelection selects the PCRs a sealed key is bound to. The zero value
+// binds to no PCRs, so the key can be unsealed on the same TPM regardless
+// of the boot state.
+type PCRSelection struct {
+	Bank Algorithm
+	PCRs []int
+}
+
+// ErrInvalidBlob is returned by Unseal for sealed keys not written by Seal
+var ErrInvalidBlob = errors.New("tpm: invalid sealed key")
+
+// Device is the subset of a TPM 2.0 used by the sealer
+type Device interface {
+	// Seal creates a sealed data object holding secret under the storage
+	// root key, with a PolicyPCR policy for sel if it selects PCRs, and
+	// returns its public and private areas (TPM2B_PUBLIC, TPM2B_PRIVATE)
+	Seal(ctx context.Context, secret []byte, sel PCRSelection) (public, private []byte, err error)
+
+	// Unseal loads a sealed data object and returns its secret, satisfying
+	// the policy for sel
+	Unseal(ctx context.Context, public, private []byte, sel PCRSelection) ([]byte, error)
+}
+
+// Sealer seals stream keys with a TPM
+type Sealer struct {
+	device  Device
+	pcrs    PCRSelection
+	timeout time.Duration
+	mu      sync.Mutex
+}
+
+// Ensure Sealer implements encryption.KeySealer
+var _ encryption.KeySealer = (*Sealer)(nil)
+
+// Option configures the sealer
+type Option func(*Sealer)
+
+// WithPCRs binds new sealed keys to the given PCRs of a bank, so they can
+// only be unsealed while the PCRs hold the values they had at sealing,
+// e.g. PCR 7 for the Secure Boot state. The selection is stored with every
+// key, so changing it does not affect existing streams. Indices above 23
+// are ignored.
+func WithPCRs(bank Algorithm, pcrs ...int) Option {
+	return func(s *Sealer) {
+		s.pcrs = PCRSelection{Bank: bank}
+		for _, pcr := range pcrs {
+			if pcr >= 0 && pcr <= maxPCR {
+				s.pcrs.PCRs = append(s.pcrs.PCRs, pcr)
+			}
+		}
+	}
+}
+
+// WithTimeout sets the timeout of every TPM call, DefaultTimeout by default
+func WithTimeout(d time.Duration) Option {
+	return func(s *Sealer) {
+		s.timeout = d
+	}
+}
+
+// New creates a sealer using device. Calls to the device are serialized,
+// since a TPM executes one command at a time.
+func New(device Device, opts ...Option) *Sealer {
+	s := &Sealer{device: device, timeout: DefaultTimeout}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Seal seals key and encodes the PCR selection and the object areas as
+//
+//	version (1) | bank (uint16) | PCR mask (uint32) | public (uint16 length prefixed) | private (uint16 length prefixed)
+func (s *Sealer) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	s.mu.Lock()
+	pub, priv, err := s.device.Seal(ctx, key, s.pcrs)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("tpm: seal key: %w", err)
+	}
+	if len(pub) > 0xffff || len(priv) > 0xffff {
+		return nil, errors.New("tpm: sealed object too large")
+	}
+	var mask uint32
+	for _, pcr := range s.pcrs.PCRs {
+		mask |= 1 << pcr
+	}
+	blob := make([]byte, 0, 11+len(pub)+len(priv))
+	blob = append(blob, blobVersion)
+	blob = binary.BigEndian.AppendUint16(blob, uint16(s.pcrs.Bank))
+	blob = binary.BigEndian.AppendUint32(blob, mask)
+	blob = binary.BigEndian.AppendUint16(blob, uint16(len(pub)))
+	blob = append(blob, pub...)
+	blob = binary.BigEndian.AppendUint16(blob, uint16(len(priv)))
+	return append(blob, priv...), nil
+}
+
+// Unseal unseals a key sealed by Seal with the PCR selection it names
+func (s *Sealer) Unseal(ctx context.Context, blob []byte) ([]byte, error) {
+	if len(blob) < 9 || blob[0] != blobVersion {
+		return nil, ErrInvalidBlob
+	}
+	sel := PCRSelection{Bank: Algorithm(binary.BigEndian.Uint16(blob[1:3]))}
+	mask := binary.BigEndian.Uint32(blob[3:7])
+	for pcr := 0; pcr <= maxPCR; pcr++ {
+		if mask&(1<<pcr) != 0 {
+			sel.PCRs = append(sel.PCRs, pcr)
+		}
+	}
+	rest := blob[7:]
+	pub, rest, ok := cutLengthPrefixed(rest)
+	if !ok {
+		return nil, ErrInvalidBlob
+	}
+	priv, rest, ok := cutLengthPrefixed(rest)
+	if !ok || len(rest) != 0 {
+		return nil, ErrInvalidBlob
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, err := s.device.Unseal(ctx, pub, priv, sel)
+	if err != nil {
+		return nil, fmt.Errorf("tpm: unseal key: %w", err)
+	}
+	return key, nil
+}
+
+// cutLengthPrefixed splits a uint16 length prefixed field off b
+func cutLengthPrefixed(b []byte) (field, rest []byte, ok bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
@@ -0,0 +1,80 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrNotYetValid is returned for streams read before their not-before time
+	ErrNotYetValid = errors.New("encryption: stream is not yet valid")
+
+	// ErrExpired is returned for streams read after their not-after time
+	ErrExpired = errors.New("encryption: stream has expired")
+)
+
+// ValidityPolicy controls whether Readers enforce embedded validity times
+type ValidityPolicy int
+
+const (
+	// EnforceValidity fails reading outside the validity window
+	EnforceValidity ValidityPolicy = iota
+
+	// IgnoreValidity reads streams regardless of their validity window,
+	// e.g. for an administrative recovery
+	IgnoreValidity
+)
+
+// WithValidity embeds a validity window in the authenticated header of every
+// stream. A zero time leaves that side of the window open.
+func WithValidity(notBefore, notAfter time.Time) Option {
+	return func(m *Middleware) {
+		m.notBefore, m.notAfter, m.validFor = notBefore, notAfter, 0
+	}
+}
+
+// WithValidFor embeds a not-after time of d after the stream was created,
+// so exported data becomes unreadable by policy even if files linger
+func WithValidFor(d time.Duration) Option {
+	return func(m *Middleware) {
+		m.notBefore, m.notAfter, m.validFor = time.Time{}, time.Time{}, d
+	}
+}
+
+// WithValidityPolicy sets whether Readers enforce validity windows, the
+// default is EnforceValidity
+func WithValidityPolicy(p ValidityPolicy) Option {
+	return func(m *Middleware) {
+		m.validityPolicy = p
+	}
+}
+
+// WithClock sets the time source for validity windows, the default is time.Now
+func WithClock(now func() time.Time) Option {
+	return func(m *Middleware) {
+		m.now = now
+	}
+}
+
+func (m *Middleware) clock() time.Time {
+	if m.now != nil {
+		return m.now()
+	}
+	return time.Now()
+}
+
+// checkValidity enforces the validity window of a header
+func (m *Middleware) checkValidity(h *authHeader) error {
+	if m.validityPolicy == IgnoreValidity {
+		return nil
+	}
+	now := m.clock()
+	if !h.notBefore.IsZero() && now.Before(h.notBefore) {
+		return fmt.Errorf("%w: valid from %s", ErrNotYetValid, h.notBefore.UTC().Format(time.RFC3339))
+	}
+	if !h.notAfter.IsZero() && now.After(h.notAfter) {
+		return fmt.Errorf("%w: valid until %s", ErrExpired, h.notAfter.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package vaulttransit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type authResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+}
+
+// authorized sends a request with a valid token, renewing or replacing the
+// token first if needed and retrying once with a new token from the token
+// source if Vault denies the request
+func (s *Sealer) authorized(ctx context.Context, method, path string, body, out any) error {
+	token, err := s.validToken(ctx)
+	if err != nil {
+		return err
+	}
+	err = s.do(ctx, method, path, token, body, out)
+	if s.source == nil || !denied(err) {
+		return err
+	}
+	if token, err = s.replaceToken(ctx, token); err != nil {
+		return err
+	}
+	return s.do(ctx, method, path, token, body, out)
+}
+
+// validToken returns the current token after renewing it if renewal is
+// enabled and it is about to expire
+func (s *Sealer) validToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token == "" {
+		if err := s.login(ctx); err != nil {
+			return "", err
+		}
+	}
+	if s.increment <= 0 {
+		return s.token, nil
+	}
+	if !s.looked {
+		if err := s.lookup(ctx); err != nil {
+			if !denied(err) || s.source == nil {
+				return "", err
+			}
+			if err := s.login(ctx); err != nil {
+				return "", err
+			}
+		}
+	}
+	if s.expiry.IsZero() || time.Until(s.expiry) > s.increment/3 {
+		return s.token, nil
+	}
+	if s.renewable {
+		err := s.renew(ctx)
+		if err == nil || s.source == nil {
+			return s.token, err
+		}
+	}
+	if s.source != nil {
+		if err := s.login(ctx); err != nil {
+			return "", err
+		}
+	}
+	return s.token, nil
+}
+
+// replaceToken gets a new token from the token source unless another call
+// already replaced the denied one
+func (s *Sealer) replaceToken(ctx context.Context, denied string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != denied {
+		return s.token, nil
+	}
+	if err := s.login(ctx); err != nil {
+		return "", err
+	}
+	return s.token, nil
+}
+
+// login replaces the token with one from the token source
+func (s *Sealer) login(ctx context.Context) error {
+	if s.source == nil {
+		return errors.New("vaulttransit: no token")
+	}
+	token, err := s.source(ctx)
+	if err != nil {
+		return fmt.Errorf("vaulttransit: token source: %w", err)
+	}
+	s.token = token
+	s.looked = false
+	if s.increment > 0 {
+		return s.lookup(ctx)
+	}
+	return nil
+}
+
+// lookup reads the TTL of the token
+func (s *Sealer) lookup(ctx context.Context) error {
+	var resp struct {
+		Data struct {
+			TTL       int64 `json:"ttl"`
+			Renewable bool  `json:"renewable"`
+		} `json:"data"`
+	}
+	if err := s.do(ctx, http.MethodGet, "auth/token/lookup-self", s.token, nil, &resp); err != nil {
+		return err
+	}
+	s.looked = true
+	s.renewable = resp.Data.Renewable
+	s.expiry = expiry(resp.Data.TTL)
+	return nil
+}
+
+// renew extends the token lease by the renewal increment
+func (s *Sealer) renew(ctx context.Context) error {
+	var resp authResponse
+	req := map[string]any{"increment": fmt.Sprintf("%ds", int64(s.increment/time.Second))}
+	if err := s.do(ctx, http.MethodPost, "auth/token/renew-self", s.token, req, &resp); err != nil {
+		return err
+	}
+	if resp.Auth.ClientToken != "" {
+		s.token = resp.Auth.ClientToken
+	}
+	// a lease shorter than the increment reached the token's max TTL
+	s.renewable = resp.Auth.Renewable && time.Duration(resp.Auth.LeaseDuration)*time.Second >= s.increment
+	s.expiry = expiry(resp.Auth.LeaseDuration)
+	return nil
+}
+
+// denied reports whether Vault rejected the token
+func denied(err error) bool {
+	var verr *Error
+	return errors.As(err, &verr) && verr.StatusCode == http.StatusForbidden
+}
+
+func expiry(ttl int64) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
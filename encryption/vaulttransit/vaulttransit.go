@@ -0,0 +1,294 @@
+// Package vaulttransit wraps the stream keys of the sealed encryption
+// middleware with a key of the HashiCorp Vault transit secrets engine. The
+// "vault:v1:..." ciphertext is stored in the stream header and names the
+// key version, so rotating the key in Vault keeps old streams readable.
+//
+// The transit API is plain HTTP, so the package calls Vault directly and
+// manages its token itself: WithTokenRenewal renews it before it expires
+// and WithTokenSource logs in again once it cannot be renewed.
+//
+//	encryption.NewSealed(vaulttransit.New("https://vault:8200", token, "hybridbuffer",
+//		vaulttransit.WithTokenRenewal(time.Hour),
+//	))
+//
+// With WithDataKeys, Vault's datakey endpoint generates the stream keys.
+package vaulttransit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+// Defaults of the mount path and call timeout
+const (
+	DefaultMount   = "transit"
+	DefaultTimeout = 10 * time.Second
+)
+
+// Error is returned for requests rejected by Vault
+type Error struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vaulttransit: status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("vaulttransit: status %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// Sealer wraps stream keys with a transit key
+type Sealer struct {
+	addr      string
+	name      string
+	mount     string
+	namespace string
+	context   []byte
+	datakeys  bool
+	client    *http.Client
+	timeout   time.Duration
+
+	mu        sync.Mutex
+	token     string
+	source    func(ctx context.Context) (string, error)
+	increment time.Duration
+	expiry    time.Time // zero if unknown or the token does not expire
+	renewable bool
+	looked    bool
+}
+
+// Ensure Sealer implements encryption.KeySealer and encryption.KeyGenerator interfaces
+var (
+	_ encryption.KeySealer    = (*Sealer)(nil)
+	_ encryption.KeyGenerator = (*Sealer)(nil)
+)
+
+// Option configures the sealer
+type Option func(*Sealer)
+
+// WithMount sets the mount path of the transit engine, DefaultMount by default
+func WithMount(path string) Option {
+	return func(s *Sealer) {
+		s.mount = strings.Trim(path, "/")
+	}
+}
+
+// WithNamespace sets the Vault Enterprise namespace of all requests
+func WithNamespace(ns string) Option {
+	return func(s *Sealer) {
+		s.namespace = ns
+	}
+}
+
+// WithContext sets the key derivation context, required by transit keys
+// created with derived=true. It is not stored in the stream, so readers
+// must use the same context.
+func WithContext(ctx []byte) Option {
+	return func(s *Sealer) {
+		s.context = ctx
+	}
+}
+
+// WithDataKeys generates stream keys with Vault's datakey endpoint
+// instead of a local random source
+func WithDataKeys() Option {
+	return func(s *Sealer) {
+		s.datakeys = true
+	}
+}
+
+// WithHTTPClient sets the HTTP client, e.g. one with a custom CA pool or
+// client certificates. http.DefaultClient is used by default.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Sealer) {
+		s.client = c
+	}
+}
+
+// WithTimeout sets the timeout of every Vault call, DefaultTimeout by default
+func WithTimeout(d time.Duration) Option {
+	return func(s *Sealer) {
+		s.timeout = d
+	}
+}
+
+// WithTokenRenewal renews a renewable token by increment with renew-self
+// once a third of its remaining lifetime is left. The token's TTL is looked
+// up on first use.
+func WithTokenRenewal(increment time.Duration) Option {
+	return func(s *Sealer) {
+		s.increment = increment
+	}
+}
+
+// WithTokenSource sets a function returning a new token, e.g. by an AppRole
+// or Kubernetes login. It is called if no token was given, when the token
+// expires and cannot be renewed, and once if Vault denies a request.
+func WithTokenSource(fn func(ctx context.Context) (string, error)) Option {
+	return func(s *Sealer) {
+		s.source = fn
+	}
+}
+
+// New creates a sealer using the transit key name of the Vault server at
+// addr, authenticating with token
+func New(addr, token, name string, opts ...Option) *Sealer {
+	s := &Sealer{
+		addr:    strings.TrimRight(addr, "/"),
+		token:   token,
+		name:    name,
+		mount:   DefaultMount,
+		client:  http.DefaultClient,
+		timeout: DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// GenerateKey returns a key from the datakey endpoint with WithDataKeys,
+// otherwise a random key sealed with Seal
+func (s *Sealer) GenerateKey(ctx context.Context, size int) ([]byte, []byte, error) {
+	if !s.datakeys {
+		key := make([]byte, size)
+		if _, err := io.ReadFull(middleware.Rand(), key); err != nil {
+			return nil, nil, err
+		}
+		blob, err := s.Seal(ctx, key)
+		if err != nil {
+			clear(key)
+			return nil, nil, err
+		}
+		return key, blob, nil
+	}
+	var resp struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	req := map[string]any{"bits": size * 8}
+	if err := s.transit(ctx, "datakey/plaintext", req, &resp); err != nil {
+		return nil, nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("vaulttransit: invalid data key: %w", err)
+	}
+	if resp.Ciphertext == "" {
+		clear(key)
+		return nil, nil, errors.New("vaulttransit: empty ciphertext")
+	}
+	return key, []byte(resp.Ciphertext), nil
+}
+
+// Seal encrypts key with the transit key
+func (s *Sealer) Seal(ctx context.Context, key []byte) ([]byte, error) {
+	var resp struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	req := map[string]any{"plaintext": base64.StdEncoding.EncodeToString(key)}
+	if err := s.transit(ctx, "encrypt", req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Ciphertext == "" {
+		return nil, errors.New("vaulttransit: empty ciphertext")
+	}
+	return []byte(resp.Ciphertext), nil
+}
+
+// Unseal decrypts a ciphertext with the transit key
+func (s *Sealer) Unseal(ctx context.Context, blob []byte) ([]byte, error) {
+	if !bytes.HasPrefix(blob, []byte("vault:")) {
+		return nil, errors.New("vaulttransit: not a transit ciphertext")
+	}
+	var resp struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := s.transit(ctx, "decrypt", map[string]any{"ciphertext": string(blob)}, &resp); err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("vaulttransit: invalid plaintext: %w", err)
+	}
+	return key, nil
+}
+
+// transit calls the transit endpoint op for the key, adding the derivation
+// context, and decodes the data of the response into out
+func (s *Sealer) transit(ctx context.Context, op string, req map[string]any, out any) error {
+	if s.context != nil {
+		req["context"] = base64.StdEncoding.EncodeToString(s.context)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	path := s.mount + "/" + op + "/" + url.PathEscape(s.name)
+	var resp struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := s.authorized(ctx, http.MethodPost, path, req, &resp); err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.Data, out)
+}
+
+// do sends a request to the Vault API and decodes the JSON response into out
+func (s *Sealer) do(ctx context.Context, method, path, token string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, s.addr+"/v1/"+path, rd)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("X-Vault-Request", "true")
+	if s.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vaulttransit: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("vaulttransit: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		verr := &Error{StatusCode: resp.StatusCode}
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &e) == nil {
+			verr.Errors = e.Errors
+		}
+		return verr
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("vaulttransit: invalid response: %w", err)
+	}
+	return nil
+}
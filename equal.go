@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// DiffContext is the number of bytes of context reported around a difference
+const DiffContext = 16
+
+// Diff describes the first difference between two decoded streams
+type Diff struct {
+	Offset int64  // offset of the first differing byte
+	A, B   []byte // decoded bytes of both streams around Offset
+	Start  int64  // offset of the first byte of A and B
+	ALen   int64  // length of stream A if it ended at or before Offset, else -1
+	BLen   int64  // length of stream B if it ended at or before Offset, else -1
+}
+
+// String returns a human readable description of the difference
+func (d Diff) String() string {
+	switch {
+	case d.ALen >= 0 && d.BLen < 0:
+		return fmt.Sprintf("a ends at offset %d, b continues", d.ALen)
+	case d.BLen >= 0 && d.ALen < 0:
+		return fmt.Sprintf("b ends at offset %d, a continues", d.BLen)
+	default:
+		return fmt.Sprintf("streams differ at offset %d: a=%x b=%x (context from offset %d)", d.Offset, d.A, d.B, d.Start)
+	}
+}
+
+// Equal decodes aReader with aChain and bReader with bChain and compares the
+// plaintexts as streams. If they differ the first differing offset is
+// reported with surrounding context. It is useful to validate format
+// migrations or re-encryption jobs. Either chain may be nil for plain input.
+func Equal(aChain Middleware, aReader io.Reader, bChain Middleware, bReader io.Reader) (bool, Diff, error) {
+	if aChain != nil {
+		aReader = aChain.Reader(aReader)
+	}
+	if bChain != nil {
+		bReader = bChain.Reader(bReader)
+	}
+	const blockSize = 32 * 1024
+	bufA := make([]byte, DiffContext+blockSize)
+	bufB := make([]byte, DiffContext+blockSize)
+	var (
+		offset int64 // stream offset of bufX[DiffContext]
+		keep   int   // valid context bytes before bufX[DiffContext]
+	)
+	for {
+		na, errA := io.ReadFull(aReader, bufA[DiffContext:])
+		if errA != nil && errA != io.EOF && errA != io.ErrUnexpectedEOF {
+			return false, Diff{}, fmt.Errorf("middleware: read a at offset %d: %w", offset+int64(na), errA)
+		}
+		nb, errB := io.ReadFull(bReader, bufB[DiffContext:])
+		if errB != nil && errB != io.EOF && errB != io.ErrUnexpectedEOF {
+			return false, Diff{}, fmt.Errorf("middleware: read b at offset %d: %w", offset+int64(nb), errB)
+		}
+		n := min(na, nb)
+		blockA, blockB := bufA[DiffContext:DiffContext+na], bufB[DiffContext:DiffContext+nb]
+		if !bytes.Equal(blockA[:n], blockB[:n]) {
+			i := 0
+			for blockA[i] == blockB[i] {
+				i++
+			}
+			return false, diffAt(bufA[:DiffContext+na], bufB[:DiffContext+nb], keep, i, offset), nil
+		}
+		if na != nb {
+			d := diffAt(bufA[:DiffContext+na], bufB[:DiffContext+nb], keep, n, offset)
+			if na < nb {
+				d.ALen = offset + int64(na)
+			} else {
+				d.BLen = offset + int64(nb)
+			}
+			return false, d, nil
+		}
+		if errA != nil {
+			// both streams ended at the same offset
+			return true, Diff{}, nil
+		}
+		offset += int64(n)
+		keep = min(DiffContext, keep+n)
+		copy(bufA[:DiffContext], bufA[n:n+DiffContext])
+		copy(bufB[:DiffContext], bufB[n:n+DiffContext])
+	}
+}
+
+// diffAt builds a Diff for a difference at block index i, the block starts
+// at bufX[DiffContext] and keep bytes of context precede it
+func diffAt(a, b []byte, keep, i int, offset int64) Diff {
+	from := DiffContext + i - DiffContext
+	if from < DiffContext-keep {
+		from = DiffContext - keep
+	}
+	end := DiffContext + i + DiffContext
+	return Diff{
+		Offset: offset + int64(i),
+		Start:  offset + int64(from-DiffContext),
+		A:      append([]byte(nil), a[from:min(end, len(a))]...),
+		B:      append([]byte(nil), b[from:min(end, len(b))]...),
+		ALen:   -1,
+		BLen:   -1,
+	}
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// ErrorHook receives errors surfaced by the built-in middlewares. op is
+// "write", "read" or "close".
+type ErrorHook func(layer string, op string, err error)
+
+var errorHook atomic.Pointer[ErrorHook]
+
+// OnError installs fn as process-wide error hook, so applications can alert
+// on integrity failures in one place instead of at every Read and Write.
+// Every layer of a stream reports its first error once, so an error may also
+// be reported by the layers it passes through; io.EOF is not reported.
+// fn is called synchronously and must not block. Passing nil removes the hook.
+func OnError(fn func(layer string, op string, err error)) {
+	if fn == nil {
+		errorHook.Store(nil)
+		return
+	}
+	hook := ErrorHook(fn)
+	errorHook.Store(&hook)
+}
+
+// ReportError passes err to the OnError hook. Middlewares that do not use
+// WriterState or ReaderState call it for errors they produce themselves.
+func ReportError(layer string, op Op, err error) {
+	if layer == "" {
+		return
+	}
+	reportError(layer, op, err)
+}
+
+func reportError(layer string, op Op, err error) {
+	if layer == "" || err == nil || errors.Is(err, io.EOF) {
+		return
+	}
+	if hook := errorHook.Load(); hook != nil {
+		(*hook)(layer, op.String(), err)
+	}
+}
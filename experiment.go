@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Arm is one variant of an Experiment with its relative weight
+type Arm struct {
+	Variant string
+	Weight  uint32
+}
+
+// Experiment assigns streams to variants of a DynamicPipeline by a caller
+// provided key, e.g. a tenant or object ID. The assignment is deterministic:
+// the same key always lands in the same arm as long as name and arms do not
+// change, and different experiments bucket independently.
+type Experiment struct {
+	Name string
+	Arms []Arm
+}
+
+type bucketKey struct{}
+
+// WithBucketKey returns a context carrying the key used by Experiment.Provider
+func WithBucketKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, bucketKey{}, key)
+}
+
+// BucketKey returns the key set with WithBucketKey
+func BucketKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(bucketKey{}).(string)
+	return key, ok
+}
+
+// Bucket returns the variant of the arm key falls into, or "" if no arm has
+// a positive weight
+func (e *Experiment) Bucket(key string) string {
+	var total uint64
+	for _, a := range e.Arms {
+		total += uint64(a.Weight)
+	}
+	if total == 0 {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(e.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	point := binary.BigEndian.Uint64(h.Sum(nil)) % total
+	for _, a := range e.Arms {
+		if point < uint64(a.Weight) {
+			return a.Variant
+		}
+		point -= uint64(a.Weight)
+	}
+	return ""
+}
+
+// Provider returns a VariantProvider bucketing by the key of the context.
+// Streams without a key, e.g. written with Writer instead of WriterContext,
+// get the control variant.
+func (e *Experiment) Provider(control string) VariantProvider {
+	return func(ctx context.Context) string {
+		key, ok := BucketKey(ctx)
+		if !ok {
+			return control
+		}
+		if v := e.Bucket(key); v != "" {
+			return v
+		}
+		return control
+	}
+}
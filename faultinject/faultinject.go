@@ -0,0 +1,272 @@
+// Package faultinject provides a middleware corrupting streams on purpose,
+// to verify that a checksum or encryption configuration detects corruption
+// end-to-end. It simulates bit rot with bit flips and block swaps at fixed
+// offsets of the stream passing the layer.
+//
+// Place it outermost in a chain to corrupt the stored bytes, like a failing
+// disk would. It must never be part of a production pipeline.
+package faultinject
+
+import (
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// Side selects which direction is corrupted
+type Side int
+
+const (
+	// OnRead corrupts data while reading, the stored data stays intact
+	OnRead Side = iota
+
+	// OnWrite corrupts data while writing, so the stored data is damaged
+	OnWrite
+)
+
+// Middleware corrupts the stream at configured offsets
+type Middleware struct {
+	side     Side
+	flips    []flip
+	swaps    []swap
+	onInject func(offset int64)
+}
+
+// Ensure Middleware implements middleware.Middleware and middleware.Describer interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+)
+
+type flip struct {
+	offset int64
+	mask   byte
+}
+
+type swap struct {
+	a, b int64
+	size int64
+}
+
+// Option configures the fault injection middleware
+type Option func(*Middleware)
+
+// WithSide sets the corrupted direction, the default is OnRead
+func WithSide(side Side) Option {
+	return func(m *Middleware) {
+		m.side = side
+	}
+}
+
+// WithBitFlip XORs the byte at offset with mask
+func WithBitFlip(offset int64, mask byte) Option {
+	return func(m *Middleware) {
+		if offset >= 0 && mask != 0 {
+			m.flips = append(m.flips, flip{offset: offset, mask: mask})
+		}
+	}
+}
+
+// WithBlockSwap exchanges the size bytes at offset a with those at offset b.
+// The blocks must not overlap. Bytes between the blocks are held back until
+// the second block passed; a swap reaching past the end of the stream is
+// not applied.
+func WithBlockSwap(a, b int64, size int) Option {
+	return func(m *Middleware) {
+		if a > b {
+			a, b = b, a
+		}
+		if a >= 0 && size > 0 && a+int64(size) <= b {
+			m.swaps = append(m.swaps, swap{a: a, b: b, size: int64(size)})
+		}
+	}
+}
+
+// WithInjectCallback sets a function called with the offset of every
+// corrupted byte range
+func WithInjectCallback(fn func(offset int64)) Option {
+	return func(m *Middleware) {
+		m.onInject = fn
+	}
+}
+
+// New creates a fault injection middleware. Without faults it is a passthrough.
+func New(opts ...Option) *Middleware {
+	m := &Middleware{}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Describe reports the layer, so compliance reports reveal a leftover injector
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{Type: "fault-injection"}
+}
+
+// Writer wraps w, corrupting the written data if the side is OnWrite.
+// Close releases held back bytes; it does not close w.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	if m.side != OnWrite {
+		return w
+	}
+	return &writer{w: w, c: m.newCorrupter()}
+}
+
+// Reader wraps r, corrupting the read data if the side is OnRead
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	if m.side != OnRead {
+		return r
+	}
+	return &reader{r: r, c: m.newCorrupter(), buf: make([]byte, 32*1024)}
+}
+
+type writer struct {
+	w     io.Writer
+	c     *corrupter
+	state middleware.WriterState
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if out := w.c.feed(append([]byte(nil), p...)); len(out) > 0 {
+		if _, err := w.w.Write(out); err != nil {
+			return 0, w.state.Fail(err)
+		}
+	}
+	return len(p), nil
+}
+
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if out := w.c.finish(); len(out) > 0 {
+			_, err := w.w.Write(out)
+			return err
+		}
+		return nil
+	})
+}
+
+type reader struct {
+	r     io.Reader
+	c     *corrupter
+	buf   []byte
+	ready []byte
+	state middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(r.ready) > 0 {
+		n := copy(p, r.ready)
+		r.ready = r.ready[n:]
+		return n, nil
+	}
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	for len(r.ready) == 0 {
+		n, err := r.r.Read(r.buf)
+		if n > 0 {
+			r.ready = r.c.feed(append([]byte(nil), r.buf[:n]...))
+		}
+		if err == io.EOF {
+			r.ready = append(r.ready, r.c.finish()...)
+			if len(r.ready) == 0 {
+				return r.state.Track(0, io.EOF)
+			}
+			r.state.Track(0, io.EOF)
+			break
+		}
+		if err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	n := copy(p, r.ready)
+	r.ready = r.ready[n:]
+	return n, nil
+}
+
+// corrupter applies the faults to a stream fed in pieces. Bytes from the
+// first to the last swapped byte are held back until all of them arrived.
+type corrupter struct {
+	m       *Middleware
+	off     int64  // stream offset of the next fed byte
+	lo, hi  int64  // held back range, empty if lo == hi
+	pending []byte // held back bytes starting at lo
+	done    bool   // held back range released
+}
+
+func (m *Middleware) newCorrupter() *corrupter {
+	c := &corrupter{m: m}
+	for i, s := range m.swaps {
+		if i == 0 || s.a < c.lo {
+			c.lo = s.a
+		}
+		if end := s.b + s.size; end > c.hi {
+			c.hi = end
+		}
+	}
+	c.done = c.lo == c.hi
+	return c
+}
+
+// feed corrupts p in place and returns the bytes ready to be passed on
+func (c *corrupter) feed(p []byte) []byte {
+	start := c.off
+	c.off += int64(len(p))
+	for _, f := range c.m.flips {
+		if f.offset >= start && f.offset < c.off {
+			p[f.offset-start] ^= f.mask
+			c.injected(f.offset)
+		}
+	}
+	if c.done || c.off <= c.lo {
+		return p
+	}
+	var out []byte
+	if start < c.lo {
+		out, p = p[:c.lo-start], p[c.lo-start:]
+	}
+	c.pending = append(c.pending, p...)
+	if c.off < c.hi {
+		return out
+	}
+	return append(out, c.release()...)
+}
+
+// finish returns the held back bytes at the end of the stream
+func (c *corrupter) finish() []byte {
+	if c.done {
+		return nil
+	}
+	return c.release()
+}
+
+// release applies the swaps that lie within the held back bytes
+func (c *corrupter) release() []byte {
+	c.done = true
+	end := c.lo + int64(len(c.pending))
+	var tmp []byte
+	for _, s := range c.m.swaps {
+		if s.b+s.size > end {
+			continue
+		}
+		a := c.pending[s.a-c.lo : s.a-c.lo+s.size]
+		b := c.pending[s.b-c.lo : s.b-c.lo+s.size]
+		tmp = append(tmp[:0], a...)
+		copy(a, b)
+		copy(b, tmp)
+		c.injected(s.a)
+	}
+	out := c.pending
+	c.pending = nil
+	return out
+}
+
+func (c *corrupter) injected(offset int64) {
+	if c.m.onInject != nil {
+		c.m.onInject(offset)
+	}
+}
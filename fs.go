@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// FS returns a filesystem whose files are read through the read side of m,
+// e.g. to serve an encrypted spill directory with http.FileServer or to load
+// templates from it. Directories are passed through unchanged and their
+// listings report the stored sizes.
+//
+// Files implement io.Seeker so they can be served with range requests.
+// Seeking backwards reopens the file and decodes it from the start; Stat and
+// seeking relative to the end decode the whole file once to learn its size.
+func FS(fsys fs.FS, m Middleware) fs.FS {
+	return &pipelineFS{fsys: fsys, m: m}
+}
+
+type pipelineFS struct {
+	fsys fs.FS
+	m    Middleware
+}
+
+func (p *pipelineFS) Open(name string) (fs.File, error) {
+	f, err := p.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return f, nil
+	}
+	return &fsFile{fsys: p, name: name, f: f, r: p.m.Reader(f), info: info, size: -1}, nil
+}
+
+// fsFile is a decoded file of a pipelineFS
+type fsFile struct {
+	fsys *pipelineFS
+	name string
+	f    fs.File   // stored file
+	r    io.Reader // decoded content of f
+	pos  int64     // offset in the decoded content
+	info fs.FileInfo
+	size int64 // decoded size, -1 if not known yet
+}
+
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.r == nil {
+		return 0, fs.ErrClosed
+	}
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *fsFile) Close() error {
+	if f.r == nil {
+		return fs.ErrClosed
+	}
+	f.r = nil
+	return f.f.Close()
+}
+
+// Stat returns the info of the stored file with the decoded size
+func (f *fsFile) Stat() (fs.FileInfo, error) {
+	size, err := f.decodedSize()
+	if err != nil {
+		return nil, err
+	}
+	return fsFileInfo{FileInfo: f.info, size: size}, nil
+}
+
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if f.r == nil {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		size, err := f.decodedSize()
+		if err != nil {
+			return f.pos, err
+		}
+		offset += size
+	default:
+		return f.pos, errors.New("middleware: invalid whence")
+	}
+	if offset < 0 {
+		return f.pos, errors.New("middleware: negative position")
+	}
+	if offset < f.pos {
+		if err := f.reopen(); err != nil {
+			return f.pos, err
+		}
+	}
+	n, err := io.CopyN(io.Discard, f.r, offset-f.pos)
+	f.pos += n
+	if err != nil && err != io.EOF {
+		return f.pos, err
+	}
+	return offset, nil
+}
+
+// reopen restarts decoding at the beginning of the file
+func (f *fsFile) reopen() error {
+	nf, err := f.fsys.fsys.Open(f.name)
+	if err != nil {
+		return err
+	}
+	f.f.Close()
+	f.f, f.r, f.pos = nf, f.fsys.m.Reader(nf), 0
+	return nil
+}
+
+// decodedSize decodes a separate copy of the file to count its bytes
+func (f *fsFile) decodedSize() (int64, error) {
+	if f.size >= 0 {
+		return f.size, nil
+	}
+	sf, err := f.fsys.fsys.Open(f.name)
+	if err != nil {
+		return 0, err
+	}
+	defer sf.Close()
+	n, err := io.Copy(io.Discard, f.fsys.m.Reader(sf))
+	if err != nil {
+		return 0, &fs.PathError{Op: "stat", Path: f.name, Err: err}
+	}
+	f.size = n
+	return n, nil
+}
+
+// fsFileInfo reports the decoded size of a file
+type fsFileInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i fsFileInfo) Size() int64 { return i.size }
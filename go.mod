@@ -2,4 +2,13 @@ module schneider.vip/hybridbuffer/middleware
 
 go 1.23.0
 
-toolchain go1.24.0
\ No newline at end of file
+toolchain go1.24.0
+
+require (
+	github.com/ProtonMail/go-crypto v1.3.0
+	github.com/minio/sio v0.2.1
+	golang.org/x/crypto v0.36.0
+	golang.org/x/sys v0.31.0
+)
+
+require github.com/cloudflare/circl v1.6.1 // indirect
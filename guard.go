@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	// ErrWriterReused is returned when a guarded middleware creates a second Writer
+	ErrWriterReused = errors.New("middleware: writer already created")
+
+	// ErrWriteAfterClose is returned for writes to a closed guarded writer
+	ErrWriteAfterClose = fmt.Errorf("%w: write after close", ErrClosed)
+
+	// ErrNotSealed is returned when reading before the guarded writer was
+	// closed, or after closing it failed
+	ErrNotSealed = errors.New("middleware: read before writer was closed")
+
+	// ErrReadAfterEOF is returned when a guarded reader is read again after io.EOF
+	ErrReadAfterEOF = errors.New("middleware: read after EOF")
+)
+
+// Guard wraps m with write-once read-many semantics: exactly one Writer may
+// be created and it must not be used after Close; Readers may only be
+// created once that writer was closed successfully, and each Reader fails with
+// ErrReadAfterEOF instead of silently returning io.EOF again. This turns
+// silent misuse of a buffer into explicit errors.
+func Guard(m Middleware) Middleware {
+	return &guard{m: m}
+}
+
+type guard struct {
+	m Middleware
+
+	mu      sync.Mutex
+	written bool // a Writer was created
+	sealed  bool // the Writer was closed
+}
+
+func (g *guard) Writer(w io.Writer) io.Writer {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.written {
+		return &errWriter{err: ErrWriterReused}
+	}
+	g.written = true
+	return &guardWriter{g: g, w: g.m.Writer(w)}
+}
+
+func (g *guard) Reader(r io.Reader) io.Reader {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.written && !g.sealed {
+		return &errReader{err: ErrNotSealed}
+	}
+	return &guardReader{r: g.m.Reader(r)}
+}
+
+type guardWriter struct {
+	g     *guard
+	w     io.Writer
+	state WriterState
+}
+
+func (w *guardWriter) Write(p []byte) (int, error) {
+	if w.state.Closed() {
+		return 0, ErrWriteAfterClose
+	}
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.w.Write(p)
+	return n, w.state.Fail(err)
+}
+
+func (w *guardWriter) Close() error {
+	return w.state.Close(func() error {
+		var err error
+		if c, ok := w.w.(io.Closer); ok {
+			err = c.Close()
+		}
+		if err != nil {
+			return err
+		}
+		w.g.mu.Lock()
+		w.g.sealed = true
+		w.g.mu.Unlock()
+		return nil
+	})
+}
+
+type guardReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (r *guardReader) Read(p []byte) (int, error) {
+	if r.eof {
+		return 0, ErrReadAfterEOF
+	}
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// errWriter reports a fixed error on every call
+type errWriter struct {
+	err error
+}
+
+func (e *errWriter) Write([]byte) (int, error) { return 0, e.err }
+func (e *errWriter) Close() error              { return e.err }
+
+// errReader reports a fixed error on every call
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read([]byte) (int, error) { return 0, e.err }
+
+// Unwrap returns the guarded middleware
+func (g *guard) Unwrap() Middleware {
+	return g.m
+}
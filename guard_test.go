@@ -0,0 +1,69 @@
+package middleware_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// passthrough is a middleware whose writers fail to close with closeErr
+type passthrough struct {
+	closeErr error
+}
+
+func (p passthrough) Writer(w io.Writer) io.Writer { return &closeWriter{w: w, err: p.closeErr} }
+func (p passthrough) Reader(r io.Reader) io.Reader { return r }
+
+type closeWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (c *closeWriter) Write(p []byte) (int, error) { return c.w.Write(p) }
+func (c *closeWriter) Close() error                { return c.err }
+
+func TestGuard(t *testing.T) {
+	g := middleware.Guard(passthrough{})
+	var buf bytes.Buffer
+
+	w := g.Writer(&buf)
+	if _, err := g.Writer(&buf).Write(nil); !errors.Is(err, middleware.ErrWriterReused) {
+		t.Fatalf("got %v, want ErrWriterReused", err)
+	}
+	if _, err := g.Reader(&buf).Read(make([]byte, 1)); !errors.Is(err, middleware.ErrNotSealed) {
+		t.Fatalf("got %v, want ErrNotSealed", err)
+	}
+	w.Write([]byte("data"))
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("more")); !errors.Is(err, middleware.ErrWriteAfterClose) {
+		t.Fatalf("got %v, want ErrWriteAfterClose", err)
+	}
+
+	r := g.Reader(bytes.NewReader(buf.Bytes()))
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "data" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, middleware.ErrReadAfterEOF) {
+		t.Fatalf("got %v, want ErrReadAfterEOF", err)
+	}
+}
+
+func TestGuardFailedCloseDoesNotSeal(t *testing.T) {
+	closeErr := errors.New("close failed")
+	g := middleware.Guard(passthrough{closeErr: closeErr})
+	var buf bytes.Buffer
+	w := g.Writer(&buf)
+	w.Write([]byte("data"))
+	if err := w.(io.Closer).Close(); !errors.Is(err, closeErr) {
+		t.Fatalf("got %v, want the close error", err)
+	}
+	if _, err := g.Reader(&buf).Read(make([]byte, 1)); !errors.Is(err, middleware.ErrNotSealed) {
+		t.Fatalf("got %v, want ErrNotSealed", err)
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import "io"
+
+// HeaderSplitter is implemented by middlewares that can hand their stream
+// header to the caller instead of writing it inline. The hybridbuffer core
+// can store the header in its own metadata, which allows introspecting the
+// encryption/compression parameters of a stored buffer without reading it.
+type HeaderSplitter interface {
+	Middleware
+
+	// SplitWriter wraps an io.Writer like Writer, but returns the header
+	// bytes instead of writing them to w
+	SplitWriter(w io.Writer) (io.Writer, []byte, error)
+
+	// JoinReader wraps an io.Reader like Reader for a stream written by
+	// SplitWriter, using the separately stored header
+	JoinReader(r io.Reader, header []byte) (io.Reader, error)
+}
+
+// SplitHeaderWriter wraps w with m. If m implements HeaderSplitter its header
+// is returned separately, otherwise the header is written inline and nil is returned.
+func SplitHeaderWriter(m Middleware, w io.Writer) (io.Writer, []byte, error) {
+	if hs, ok := m.(HeaderSplitter); ok {
+		return hs.SplitWriter(w)
+	}
+	return m.Writer(w), nil, nil
+}
+
+// JoinHeaderReader is the counterpart of SplitHeaderWriter. A nil header
+// means the header was written inline.
+func JoinHeaderReader(m Middleware, r io.Reader, header []byte) (io.Reader, error) {
+	if hs, ok := m.(HeaderSplitter); ok && header != nil {
+		return hs.JoinReader(r, header)
+	}
+	return m.Reader(r), nil
+}
+
+// Ensure Chain implements HeaderSplitter
+var _ HeaderSplitter = (*Chain)(nil)
+
+// SplitWriter wraps w like Writer, returning the header of the outermost
+// enabled layer instead of writing it. The header is nil if that layer
+// does not implement HeaderSplitter and writes its header inline.
+func (c *Chain) SplitWriter(w io.Writer) (io.Writer, []byte, error) {
+	cw, header, err := c.splitWriter(nil, w, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cw, header, nil
+}
+
+// JoinReader wraps r like Reader for a stream written by SplitWriter.
+// Errors of the outermost layer are returned from Read.
+func (c *Chain) JoinReader(r io.Reader, header []byte) (io.Reader, error) {
+	return c.joinReader(nil, r, header), nil
+}
@@ -0,0 +1,78 @@
+package middleware_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/compression"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+func TestChainSplitHeader(t *testing.T) {
+	data := bytes.Repeat([]byte("split header "), 1000)
+	tests := []struct {
+		name   string
+		chain  *middleware.Chain
+		header bool
+	}{
+		{"compression outermost", middleware.NewChain(encryption.New(), compression.New()), true},
+		{"encryption outermost", middleware.NewChain(compression.New(), encryption.New(encryption.WithFormatHeader())), true},
+		{"inline header", middleware.NewChain(compression.New(), encryption.New()), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stored bytes.Buffer
+			w, header, err := middleware.SplitHeaderWriter(tt.chain, &stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (header != nil) != tt.header {
+				t.Fatalf("got header %x, want header: %v", header, tt.header)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.(io.Closer).Close(); err != nil {
+				t.Fatal(err)
+			}
+			if header != nil && bytes.HasPrefix(stored.Bytes(), header) {
+				t.Fatal("header written inline")
+			}
+
+			r, err := middleware.JoinHeaderReader(tt.chain, bytes.NewReader(stored.Bytes()), header)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("round trip mismatch")
+			}
+		})
+	}
+}
+
+func TestChainJoinReaderRejectsBadHeader(t *testing.T) {
+	chain := middleware.NewChain(compression.New())
+	var stored bytes.Buffer
+	w, header, err := chain.SplitWriter(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	w.(io.Closer).Close()
+
+	bad := bytes.Clone(header)
+	bad[0] ^= 0xff
+	r, err := chain.JoinReader(bytes.NewReader(stored.Bytes()), bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Fatal("expected an error for a corrupt header")
+	}
+}
@@ -0,0 +1,281 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// HeaderCRCFormatVersion is the frame format version written by ProtectHeader
+const HeaderCRCFormatVersion = 1
+
+// MaxProtectedHeader is the largest header ProtectHeader frames. Longer
+// header sequences are protected up to this size.
+const MaxProtectedHeader = 64 << 10
+
+var headerCRCMagic = [3]byte{'H', 'B', 'H'}
+
+const headerCRCFrameSize = len(headerCRCMagic) + 1 + 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func init() {
+	RegisterFormat("header-crc", func(p []byte) (string, int, bool) {
+		if len(p) < headerCRCFrameSize || !hasPrefix(p, headerCRCMagic[:]...) {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, %d header bytes", p[3], binary.BigEndian.Uint32(p[4:8])), headerCRCFrameSize, true
+	})
+}
+
+var (
+	// ErrHeaderCorrupt matches errors of layers that found their stream
+	// header damaged, so metadata rather than data needs recovery
+	ErrHeaderCorrupt = errors.New("middleware: corrupt stream header")
+
+	// ErrPayloadCorrupt matches errors of layers that found their payload
+	// damaged or truncated behind an intact header
+	ErrPayloadCorrupt = errors.New("middleware: corrupt stream payload")
+)
+
+// CorruptionError reports which part of the stream of a layer is damaged.
+// It matches ErrHeaderCorrupt or ErrPayloadCorrupt with errors.Is.
+type CorruptionError struct {
+	Layer string
+
+	// Header is true for a damaged header, false for a damaged payload
+	Header bool
+
+	// Offset is the number of encoded bytes of the layer read when the
+	// damage was detected
+	Offset int64
+
+	Err error
+}
+
+// Error describes the damaged part
+func (e *CorruptionError) Error() string {
+	part := "payload"
+	if e.Header {
+		part = "header"
+	}
+	return fmt.Sprintf("%s: corrupt %s at offset %d: %v", e.Layer, part, e.Offset, e.Err)
+}
+
+// Unwrap returns the error of the layer
+func (e *CorruptionError) Unwrap() error { return e.Err }
+
+// Is matches ErrHeaderCorrupt or ErrPayloadCorrupt
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrHeaderCorrupt && e.Header || target == ErrPayloadCorrupt && !e.Header
+}
+
+// ProtectHeader wraps m so the header m writes is framed with its own
+// CRC-32C:
+//
+//	"HBH" | version (1) | header length (uint32, big endian) | header | CRC-32C (uint32, big endian)
+//
+// with the CRC over everything before it. The header length is found with
+// the detectors of RegisterFormat, so the headers of m's format must be
+// registered and written with a single Write each; consecutive headers,
+// like a key header in front of an authenticated header, are framed
+// together. Formats without a registered header length, like DARE or gzip,
+// get an empty frame.
+//
+// Readers check the CRC before m sees the header and return a
+// CorruptionError matching ErrHeaderCorrupt if it fails. Errors m returns
+// behind an intact header are returned as a CorruptionError matching
+// ErrPayloadCorrupt, unless they are errors of the underlying reader.
+func ProtectHeader(layer string, m Middleware) Middleware {
+	return &protectHeader{layer: layer, m: m}
+}
+
+type protectHeader struct {
+	layer string
+	m     Middleware
+}
+
+// Ensure protectHeader implements the ContextMiddleware, Wrapper and Versioned interfaces
+var (
+	_ ContextMiddleware = (*protectHeader)(nil)
+	_ Wrapper           = (*protectHeader)(nil)
+	_ Versioned         = (*protectHeader)(nil)
+)
+
+// FormatVersion returns the frame format version written by the Writer
+func (p *protectHeader) FormatVersion() uint8 { return HeaderCRCFormatVersion }
+
+// MaxSupportedVersion returns the highest frame format version the Reader understands
+func (p *protectHeader) MaxSupportedVersion() uint8 { return HeaderCRCFormatVersion }
+
+// Unwrap returns the protected middleware
+func (p *protectHeader) Unwrap() Middleware { return p.m }
+
+func (p *protectHeader) Writer(w io.Writer) io.Writer {
+	return p.WriterContext(context.Background(), w)
+}
+
+// WriterContext wraps w with m, passing ctx on, and frames its header
+func (p *protectHeader) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	fw := &headerFrameWriter{w: w}
+	return &protectHeaderWriter{inner: WriterContext(ctx, p.m, fw), frame: fw, state: WriterState{Layer: p.layer}}
+}
+
+func (p *protectHeader) Reader(r io.Reader) io.Reader {
+	return p.ReaderContext(context.Background(), r)
+}
+
+// ReaderContext checks the header frame and unwraps r with m, passing ctx on
+func (p *protectHeader) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return &protectHeaderReader{p: p, ctx: ctx, src: &sourceReader{r: r}, state: ReaderState{Layer: p.layer}}
+}
+
+// headerFrameWriter buffers the output of the layer until its header is
+// complete and writes it framed
+type headerFrameWriter struct {
+	w    io.Writer
+	buf  []byte
+	done bool
+}
+
+func (f *headerFrameWriter) Write(p []byte) (int, error) {
+	if f.done {
+		return f.w.Write(p)
+	}
+	f.buf = append(f.buf, p...)
+	if n := min(headerLength(f.buf), MaxProtectedHeader); n < len(f.buf) || n == MaxProtectedHeader {
+		if err := f.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// flush writes the frame and the buffered bytes behind the header
+func (f *headerFrameWriter) flush() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	n := min(headerLength(f.buf), MaxProtectedHeader)
+	frame := make([]byte, 0, headerCRCFrameSize+n+4)
+	frame = append(frame, headerCRCMagic[:]...)
+	frame = append(frame, HeaderCRCFormatVersion)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(n))
+	frame = append(frame, f.buf[:n]...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.Checksum(frame, castagnoli))
+	frame = append(frame, f.buf[n:]...)
+	f.buf = nil
+	_, err := f.w.Write(frame)
+	return err
+}
+
+type protectHeaderWriter struct {
+	inner io.Writer
+	frame *headerFrameWriter
+	state WriterState
+}
+
+func (w *protectHeaderWriter) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.inner.Write(p)
+	return n, w.state.Fail(err)
+}
+
+// Close closes the layer and writes the frame if the layer wrote no payload
+func (w *protectHeaderWriter) Close() error {
+	return w.state.Close(func() error {
+		if c, ok := w.inner.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				return err
+			}
+		}
+		return w.frame.flush()
+	})
+}
+
+// sourceReader counts the bytes read from r and remembers its error, so
+// errors of the layer can be told apart from errors of the source
+type sourceReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	s.n += int64(n)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+type protectHeaderReader struct {
+	p     *protectHeader
+	ctx   context.Context
+	src   *sourceReader
+	r     io.Reader
+	state ReaderState
+}
+
+// open checks the header frame and creates the reader of the layer
+func (r *protectHeaderReader) open() error {
+	frame := make([]byte, headerCRCFrameSize)
+	if _, err := io.ReadFull(r.src, frame); err != nil {
+		if r.src.err != nil {
+			return err
+		}
+		return r.corrupt(true, fmt.Errorf("read header frame: %w", err))
+	}
+	if [3]byte(frame[:3]) != headerCRCMagic {
+		return r.corrupt(true, errors.New("missing header frame"))
+	}
+	if _, err := CheckVersion("header-crc", frame[3], HeaderCRCFormatVersion, RejectUnknown); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(frame[4:])
+	if n > MaxProtectedHeader {
+		return r.corrupt(true, fmt.Errorf("header length %d", n))
+	}
+	frame = append(frame, make([]byte, n+4)...)
+	if _, err := io.ReadFull(r.src, frame[headerCRCFrameSize:]); err != nil {
+		if r.src.err != nil {
+			return err
+		}
+		return r.corrupt(true, fmt.Errorf("read header: %w", err))
+	}
+	end := len(frame) - 4
+	if crc32.Checksum(frame[:end], castagnoli) != binary.BigEndian.Uint32(frame[end:]) {
+		return r.corrupt(true, errors.New("header CRC mismatch"))
+	}
+	r.r = ReaderContext(r.ctx, r.p.m, io.MultiReader(bytes.NewReader(frame[headerCRCFrameSize:end]), r.src))
+	return nil
+}
+
+func (r *protectHeaderReader) corrupt(header bool, err error) error {
+	return &CorruptionError{Layer: r.p.layer, Header: header, Offset: r.src.n, Err: err}
+}
+
+func (r *protectHeaderReader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	if r.r == nil {
+		if err := r.open(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && !errors.Is(err, ErrHeaderCorrupt) && !errors.Is(err, ErrPayloadCorrupt) &&
+		(r.src.err == nil || !errors.Is(err, r.src.err)) {
+		err = r.corrupt(false, err)
+	}
+	return r.state.Track(n, err)
+}
@@ -0,0 +1,88 @@
+package honeytoken
+
+import (
+	"bytes"
+	"io"
+	"sort"
+)
+
+// Match is a canary found by a Detector
+type Match struct {
+	// Canary is the index of the canary as passed to NewDetector
+	Canary int
+	// Offset is the position of the canary in the scanned stream
+	Offset int64
+}
+
+// Detector finds known canaries in arbitrary data, e.g. a leaked dump
+type Detector struct {
+	canaries [][]byte
+	maxLen   int
+}
+
+// NewDetector creates a detector for the given canaries, empty ones are ignored
+func NewDetector(canaries ...[]byte) *Detector {
+	d := &Detector{}
+	for _, c := range canaries {
+		d.canaries = append(d.canaries, append([]byte(nil), c...))
+		if len(c) > d.maxLen {
+			d.maxLen = len(c)
+		}
+	}
+	return d
+}
+
+// Scan reads r to the end and returns all canary occurrences in stream order
+func (d *Detector) Scan(r io.Reader) ([]Match, error) {
+	if d.maxLen == 0 {
+		_, err := io.Copy(io.Discard, r)
+		return nil, err
+	}
+	var (
+		matches []Match
+		window  []byte // tail of the previous block followed by the new block
+		base    int64  // stream offset of window[0]
+		buf     = make([]byte, 64*1024)
+	)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			// Canaries starting in the kept tail were not complete before,
+			// so every occurrence is reported exactly once
+			prev := len(window)
+			window = append(window, buf[:n]...)
+			for i, c := range d.canaries {
+				if len(c) == 0 {
+					continue
+				}
+				from := max(prev-len(c)+1, 0)
+				for off := from; ; {
+					j := bytes.Index(window[off:], c)
+					if j < 0 {
+						break
+					}
+					matches = append(matches, Match{Canary: i, Offset: base + int64(off+j)})
+					off += j + 1
+				}
+			}
+			if keep := d.maxLen - 1; len(window) > keep {
+				drop := len(window) - keep
+				base += int64(drop)
+				window = append(window[:0], window[drop:]...)
+			}
+		}
+		if err == io.EOF {
+			sort.SliceStable(matches, func(i, j int) bool { return matches[i].Offset < matches[j].Offset })
+			return matches, nil
+		}
+		if err != nil {
+			return matches, err
+		}
+	}
+}
+
+// Contains reports whether any canary occurs in r
+func (d *Detector) Contains(r io.Reader) (bool, error) {
+	m, err := d.Scan(r)
+	return len(m) > 0, err
+}
@@ -0,0 +1,159 @@
+// Package honeytoken provides an opt-in middleware injecting canary records
+// into outgoing copies of a stream, such as exports or tee paths, and a
+// Detector finding them again. A canary showing up in an unexpected place
+// traces a leak back to the export that contained it.
+//
+// Records are delimited by a byte, newline by default. Canaries are only
+// inserted between complete records, so record based formats like CSV or
+// JSON lines stay well-formed if the canaries are.
+package honeytoken
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// DefaultProbability is the default chance of a canary after each record
+const DefaultProbability = 0.001
+
+// Middleware injects canary records on write; reading is a passthrough
+type Middleware struct {
+	canary      func() []byte
+	probability float64
+	delimiter   byte
+	random      func() float64
+	onInject    func(canary []byte, offset int64)
+}
+
+// Ensure Middleware implements middleware.Middleware and middleware.Describer interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+)
+
+// Option configures the honeytoken middleware
+type Option func(*Middleware)
+
+// WithProbability sets the chance of a canary after each record, between 0 and 1
+func WithProbability(p float64) Option {
+	return func(m *Middleware) {
+		if p >= 0 && p <= 1 {
+			m.probability = p
+		}
+	}
+}
+
+// WithDelimiter sets the record delimiter, the default is '\n'
+func WithDelimiter(d byte) Option {
+	return func(m *Middleware) {
+		m.delimiter = d
+	}
+}
+
+// WithRandom sets the source of the injection decisions, a function
+// returning values in [0, 1). The default is math/rand/v2.Float64.
+func WithRandom(fn func() float64) Option {
+	return func(m *Middleware) {
+		m.random = fn
+	}
+}
+
+// WithInjectCallback registers a function called for every injected canary
+// with the offset of the canary in the output, e.g. to record which export
+// carried which canary
+func WithInjectCallback(fn func(canary []byte, offset int64)) Option {
+	return func(m *Middleware) {
+		m.onInject = fn
+	}
+}
+
+// New creates a honeytoken middleware. canary returns the record to inject,
+// without delimiter; it may return a different record on every call.
+func New(canary func() []byte, opts ...Option) *Middleware {
+	m := &Middleware{
+		canary:      canary,
+		probability: DefaultProbability,
+		delimiter:   '\n',
+		random:      rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Describe reports the injection settings
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{Type: "honeytoken"}
+}
+
+// Writer wraps w, injecting canaries after complete records
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return &writer{m: m, w: w, state: middleware.WriterState{Layer: "honeytoken"}}
+}
+
+// Reader returns r unchanged, canaries are part of the data
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return r
+}
+
+type writer struct {
+	m     *Middleware
+	w     io.Writer
+	off   int64
+	state middleware.WriterState
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, w.m.delimiter)
+		if i < 0 {
+			n, err := w.w.Write(p)
+			w.off += int64(n)
+			return written + n, w.state.Fail(err)
+		}
+		n, err := w.w.Write(p[:i+1])
+		w.off += int64(n)
+		written += n
+		if err != nil {
+			return written, w.state.Fail(err)
+		}
+		p = p[i+1:]
+		if err := w.maybeInject(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (w *writer) maybeInject() error {
+	if w.m.probability == 0 || w.m.random() >= w.m.probability {
+		return nil
+	}
+	canary := w.m.canary()
+	if len(canary) == 0 {
+		return nil
+	}
+	rec := append(append(make([]byte, 0, len(canary)+1), canary...), w.m.delimiter)
+	n, err := w.w.Write(rec)
+	if err != nil {
+		return w.state.Fail(err)
+	}
+	if w.m.onInject != nil {
+		w.m.onInject(canary, w.off)
+	}
+	w.off += int64(n)
+	return nil
+}
+
+// Close does not close the underlying writer
+func (w *writer) Close() error {
+	return w.state.Close(func() error { return nil })
+}
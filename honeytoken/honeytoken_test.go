@@ -0,0 +1,155 @@
+package honeytoken_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"schneider.vip/hybridbuffer/middleware/honeytoken"
+)
+
+// every returns a random source that triggers on every nth call
+func every(n int) func() float64 {
+	calls := 0
+	return func() float64 {
+		calls++
+		if calls%n == 0 {
+			return 0
+		}
+		return 0.999
+	}
+}
+
+func TestInjectBetweenRecords(t *testing.T) {
+	serial := 0
+	canary := func() []byte {
+		serial++
+		return []byte(fmt.Sprintf("canary-%d", serial))
+	}
+	var offsets []int64
+	m := honeytoken.New(canary,
+		honeytoken.WithProbability(0.5),
+		honeytoken.WithRandom(every(2)),
+		honeytoken.WithInjectCallback(func(c []byte, off int64) { offsets = append(offsets, off) }),
+	)
+
+	var out bytes.Buffer
+	w := m.Writer(&out)
+	// records are split across writes, canaries still only follow complete ones
+	for _, chunk := range []string{"a,", "1\nb,2", "\nc,3\nd", ",4\ne,5"} {
+		if _, err := io.WriteString(w, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.(io.Closer).Close()
+
+	want := "a,1\nb,2\ncanary-1\nc,3\nd,4\ncanary-2\ne,5"
+	if out.String() != want {
+		t.Fatalf("got %q, want %q", out.String(), want)
+	}
+	for i, off := range offsets {
+		if got := out.String()[off:]; !strings.HasPrefix(got, fmt.Sprintf("canary-%d\n", i+1)) {
+			t.Fatalf("canary %d reported at %d: %q", i+1, off, got)
+		}
+	}
+
+	// reading returns the canaries as part of the data
+	if got, _ := io.ReadAll(m.Reader(&out)); string(got) != want {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestInjectOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []honeytoken.Option
+		want string
+	}{
+		{"never", []honeytoken.Option{honeytoken.WithProbability(0)}, "x;y;"},
+		{"no complete record", []honeytoken.Option{honeytoken.WithProbability(1), honeytoken.WithRandom(every(1))}, "x;y;"},
+		{"delimiter", []honeytoken.Option{honeytoken.WithDelimiter(';'), honeytoken.WithProbability(1)}, "x;CANARY;y;CANARY;"},
+		{"out of range", []honeytoken.Option{honeytoken.WithDelimiter(';'), honeytoken.WithProbability(2), honeytoken.WithRandom(every(1))}, "x;CANARY;y;CANARY;"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := honeytoken.New(func() []byte { return []byte("CANARY") }, tt.opts...).Writer(&out)
+			io.WriteString(w, "x;y;")
+			if out.String() != tt.want {
+				t.Fatalf("got %q, want %q", out.String(), tt.want)
+			}
+		})
+	}
+
+	// an empty canary is skipped
+	var out bytes.Buffer
+	w := honeytoken.New(func() []byte { return nil }, honeytoken.WithProbability(1)).Writer(&out)
+	io.WriteString(w, "1\n2\n")
+	if out.String() != "1\n2\n" {
+		t.Fatalf("got %q", out.String())
+	}
+}
+
+func TestDetector(t *testing.T) {
+	// canaries straddling read boundaries, overlapping and repeated
+	data := make([]byte, 200<<10)
+	copy(data[64<<10-3:], "leak-a")
+	copy(data[100<<10:], "leak-aleak-b")
+	copy(data[len(data)-6:], "leak-b")
+	d := honeytoken.NewDetector([]byte("leak-a"), nil, []byte("leak-b"), []byte("k-a"))
+
+	for _, r := range []io.Reader{bytes.NewReader(data), iotest.HalfReader(bytes.NewReader(data))} {
+		matches, err := d.Scan(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []honeytoken.Match{
+			{Canary: 0, Offset: 64<<10 - 3},
+			{Canary: 3, Offset: 64 << 10},
+			{Canary: 0, Offset: 100 << 10},
+			{Canary: 3, Offset: 100<<10 + 3},
+			{Canary: 2, Offset: 100<<10 + 6},
+			{Canary: 2, Offset: int64(len(data) - 6)},
+		}
+		if fmt.Sprint(matches) != fmt.Sprint(want) {
+			t.Fatalf("got %v, want %v", matches, want)
+		}
+	}
+
+	if found, err := honeytoken.NewDetector([]byte("absent")).Contains(bytes.NewReader(data)); found || err != nil {
+		t.Fatalf("got %v, %v", found, err)
+	}
+	if found, err := honeytoken.NewDetector().Contains(bytes.NewReader(data)); found || err != nil {
+		t.Fatalf("no canaries: got %v, %v", found, err)
+	}
+}
+
+func TestDetectorFindsInjected(t *testing.T) {
+	var injected []int64
+	m := honeytoken.New(func() []byte { return []byte(`{"user":"canary@example.com"}`) },
+		honeytoken.WithProbability(0.1),
+		honeytoken.WithRandom(every(7)),
+		honeytoken.WithInjectCallback(func(_ []byte, off int64) { injected = append(injected, off) }),
+	)
+	var out bytes.Buffer
+	w := m.Writer(&out)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(w, `{"user":"user%d@example.com"}`+"\n", i)
+	}
+
+	matches, err := honeytoken.NewDetector([]byte("canary@example.com")).Scan(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != len(injected) || len(injected) != 14 {
+		t.Fatalf("found %d of %d canaries", len(matches), len(injected))
+	}
+	for i, m := range matches {
+		if m.Offset != injected[i]+int64(len(`{"user":"`)) {
+			t.Fatalf("match %d at %d, injected at %d", i, m.Offset, injected[i])
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Package httpmw applies a pipeline to HTTP bodies, so services can use the
+// same compression and encryption stack for network transfer as for spills.
+//
+// Encoded bodies are marked with a Content-Encoding token, by default
+// DefaultContentEncoding. ResponseWriterWrapper encodes response bodies and
+// decodes marked request bodies on the server; RoundTripper does the reverse
+// on the client. Bodies without the token are passed through unchanged.
+package httpmw
+
+import (
+	"io"
+	"net/http"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// DefaultContentEncoding is the Content-Encoding token of encoded bodies
+const DefaultContentEncoding = "x-hybridbuffer"
+
+type config struct {
+	token string
+}
+
+// Option configures the HTTP adapters
+type Option func(*config)
+
+// WithContentEncoding sets the Content-Encoding token marking encoded
+// bodies, e.g. "gzip" if the pipeline is plain gzip compression so that
+// other HTTP clients can decode the bodies too
+func WithContentEncoding(token string) Option {
+	return func(c *config) {
+		if token != "" {
+			c.token = token
+		}
+	}
+}
+
+func newConfig(opts []Option) config {
+	c := config{token: DefaultContentEncoding}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// ResponseWriterWrapper returns an HTTP middleware encoding response bodies
+// with m and decoding request bodies marked with the token. Responses
+// without a body, e.g. for HEAD requests or with status 204 and 304, are
+// not marked. Errors finalizing the encoding after the handler returned
+// cannot be reported to the client and truncate the body.
+func ResponseWriterWrapper(m middleware.Middleware, opts ...Option) func(http.Handler) http.Handler {
+	c := newConfig(opts)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Content-Encoding") == c.token {
+				r.Body = readCloser{Reader: m.Reader(r.Body), Closer: r.Body}
+				r.Header.Del("Content-Encoding")
+				r.ContentLength = -1
+			}
+			rw := &responseWriter{ResponseWriter: w, m: m, token: c.token, code: http.StatusOK}
+			defer rw.finish()
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// responseWriter delays the header until the first body byte, so the
+// encoding is only announced for responses with a body
+type responseWriter struct {
+	http.ResponseWriter
+	m           middleware.Middleware
+	token       string
+	code        int
+	wroteHeader bool
+	enc         io.Writer
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if rw.wroteHeader || rw.enc != nil {
+		return
+	}
+	if code < 200 {
+		// informational responses are sent right away and do not end the header
+		rw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	rw.code, rw.wroteHeader = code, true
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	if rw.enc == nil {
+		h := rw.Header()
+		h.Set("Content-Encoding", rw.token)
+		h.Del("Content-Length")
+		h.Add("Vary", "Content-Encoding")
+		rw.ResponseWriter.WriteHeader(rw.code)
+		rw.enc = rw.m.Writer(rw.ResponseWriter)
+	}
+	return rw.enc.Write(p)
+}
+
+// finish finalizes the encoding, or sends the delayed header of a response
+// without body
+func (rw *responseWriter) finish() {
+	if rw.enc != nil {
+		if c, ok := rw.enc.(io.Closer); ok {
+			c.Close()
+		}
+		return
+	}
+	if rw.wroteHeader {
+		rw.ResponseWriter.WriteHeader(rw.code)
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// RoundTripper returns a transport encoding request bodies with m and
+// decoding response bodies marked with the token. A nil base uses
+// http.DefaultTransport.
+func RoundTripper(m middleware.Middleware, base http.RoundTripper, opts ...Option) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &roundTripper{m: m, base: base, token: newConfig(opts).token}
+}
+
+type roundTripper struct {
+	m     middleware.Middleware
+	base  http.RoundTripper
+	token string
+}
+
+func (t *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = t.encode(req.Body)
+		if getBody := req.GetBody; getBody != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				body, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return t.encode(body), nil
+			}
+		}
+		req.ContentLength = -1
+		req.Header.Set("Content-Encoding", t.token)
+		req.Header.Del("Content-Length")
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Header.Get("Content-Encoding") == t.token {
+		resp.Body = readCloser{Reader: t.m.Reader(resp.Body), Closer: resp.Body}
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+	}
+	return resp, nil
+}
+
+// encode returns the encoded form of body, produced lazily as the transport reads
+func (t *roundTripper) encode(body io.ReadCloser) io.ReadCloser {
+	return readCloser{Reader: middleware.ReaderFromWriterChain(t.m, body), Closer: body}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
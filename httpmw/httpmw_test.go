@@ -0,0 +1,141 @@
+package httpmw_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+	"schneider.vip/hybridbuffer/middleware/httpmw"
+)
+
+func pipeline(t *testing.T) middleware.Middleware {
+	t.Helper()
+	key := make([]byte, encryption.KeySize)
+	rand.Read(key)
+	return encryption.New(encryption.WithKey(key))
+}
+
+// echo returns the request body upper cased, and handles the paths
+// /empty (204) and /redirect (307 to /)
+func echo(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/empty":
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "/redirect":
+		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(bytes.ToUpper(body))
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := pipeline(t)
+	srv := httptest.NewServer(httpmw.ResponseWriterWrapper(m)(http.HandlerFunc(echo)))
+	defer srv.Close()
+	client := &http.Client{Transport: httpmw.RoundTripper(m, nil)}
+
+	for _, path := range []string{"/", "/redirect"} {
+		body := strings.Repeat("payload ", 20000)
+		resp, err := client.Post(srv.URL+path, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if resp.StatusCode != http.StatusCreated || string(got) != strings.ToUpper(body) {
+			t.Fatalf("%s: status %d, %d bytes", path, resp.StatusCode, len(got))
+		}
+		if resp.Header.Get("Content-Encoding") != "" || resp.ContentLength != -1 {
+			t.Fatalf("%s: decoded response still marked: %v, length %d", path, resp.Header, resp.ContentLength)
+		}
+	}
+}
+
+func TestWireFormat(t *testing.T) {
+	m := pipeline(t)
+	srv := httptest.NewServer(httpmw.ResponseWriterWrapper(m, httpmw.WithContentEncoding("x-test"))(http.HandlerFunc(echo)))
+	defer srv.Close()
+
+	// a plain client gets an encoded, marked response
+	resp, err := http.Post(srv.URL, "text/plain", strings.NewReader("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "x-test" || resp.Header.Get("Vary") != "Content-Encoding" {
+		t.Fatalf("header %v", resp.Header)
+	}
+	if bytes.Contains(raw, []byte("SECRET")) {
+		t.Fatal("response body not encoded")
+	}
+	plain, err := io.ReadAll(m.Reader(bytes.NewReader(raw)))
+	if err != nil || string(plain) != "SECRET" {
+		t.Fatalf("got %q, %v", plain, err)
+	}
+
+	// a request body encoded by hand is decoded if marked
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	io.WriteString(w, "marked")
+	w.(io.Closer).Close()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, &enc)
+	req.Header.Set("Content-Encoding", "x-test")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(m.Reader(resp.Body))
+	if err != nil || string(got) != "MARKED" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+	m := pipeline(t)
+	srv := httptest.NewServer(httpmw.ResponseWriterWrapper(m)(http.HandlerFunc(echo)))
+	defer srv.Close()
+
+	// unmarked requests reach the handler unchanged
+	resp, err := http.Post(srv.URL, "text/plain", strings.NewReader("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(m.Reader(resp.Body))
+	resp.Body.Close()
+	if err != nil || string(got) != "PLAIN" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	// responses without body are not marked
+	client := &http.Client{Transport: httpmw.RoundTripper(m, nil)}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req, _ := http.NewRequest(method, srv.URL+"/empty", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Content-Encoding") != "" {
+			t.Fatalf("%s: status %d, header %v", method, resp.StatusCode, resp.Header)
+		}
+	}
+}
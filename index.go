@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// IndexEntry is a point of a stored stream where decoding can start
+type IndexEntry struct {
+	// Plain is the offset in the plaintext
+	Plain int64
+	// Stored is the offset in the stream written by the layer
+	Stored int64
+}
+
+// Index is an offset table of a layer's output, sorted by offset, which
+// lets readers start decoding near a plaintext offset instead of at the
+// beginning. Its first entry is always {0, 0}.
+type Index []IndexEntry
+
+// Lookup returns the last entry at or before the plaintext offset off
+func (ix Index) Lookup(off int64) IndexEntry {
+	i := sort.Search(len(ix), func(i int) bool { return ix[i].Plain > off })
+	if i == 0 {
+		return IndexEntry{}
+	}
+	return ix[i-1]
+}
+
+// indexEntrySize is the size of an entry in the binary form
+const indexEntrySize = 16
+
+// MarshalBinary encodes the index as big-endian offset pairs
+func (ix Index) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 0, len(ix)*indexEntrySize)
+	for _, e := range ix {
+		b = binary.BigEndian.AppendUint64(b, uint64(e.Plain))
+		b = binary.BigEndian.AppendUint64(b, uint64(e.Stored))
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes an index encoded by MarshalBinary
+func (ix *Index) UnmarshalBinary(b []byte) error {
+	if len(b)%indexEntrySize != 0 {
+		return errors.New("middleware: invalid index size")
+	}
+	out := make(Index, 0, len(b)/indexEntrySize)
+	for ; len(b) > 0; b = b[indexEntrySize:] {
+		e := IndexEntry{
+			Plain:  int64(binary.BigEndian.Uint64(b)),
+			Stored: int64(binary.BigEndian.Uint64(b[8:])),
+		}
+		if n := len(out); e.Plain < 0 || e.Stored < 0 || n > 0 && (e.Plain < out[n-1].Plain || e.Stored < out[n-1].Stored) {
+			return errors.New("middleware: index is not sorted")
+		}
+		out = append(out, e)
+	}
+	*ix = out
+	return nil
+}
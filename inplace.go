@@ -0,0 +1,59 @@
+package middleware
+
+import "io"
+
+// OwnedWriter is implemented by writers that can transform data in place,
+// like XOR splitting, counter mode encryption or checksumming. WriteOwned
+// is like Write, but the caller hands over ownership of p: the writer may
+// overwrite p with its output and pass it on instead of copying it to a
+// buffer of its own. The caller must neither read nor modify p after the
+// call; the writer must not retain p once WriteOwned returns.
+//
+// This is an expert API for large spills, where the copies of a layer cost
+// noticeable memory bandwidth. Writers whose output is not the same size
+// as their input, like compression, have nothing to gain and do not
+// implement it.
+type OwnedWriter interface {
+	io.Writer
+	WriteOwned(p []byte) (int, error)
+}
+
+// Ensure the chain and the wrapper writers pass ownership on
+var (
+	_ OwnedWriter = (*chainWriter)(nil)
+	_ OwnedWriter = noCloseWriter{}
+	_ OwnedWriter = (*hardenedWriter)(nil)
+	_ OwnedWriter = (*countingWriter)(nil)
+)
+
+// WriteOwned writes p to w, handing over ownership of p if w implements
+// OwnedWriter. Otherwise p is written with Write and stays unmodified.
+func WriteOwned(w io.Writer, p []byte) (int, error) {
+	if ow, ok := w.(OwnedWriter); ok {
+		return ow.WriteOwned(p)
+	}
+	return w.Write(p)
+}
+
+// WriteOwned is like Write, handing ownership of p to the first layer
+func (c *chainWriter) WriteOwned(p []byte) (int, error) {
+	if err := c.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.write(p, true)
+	return n, c.state.Fail(err)
+}
+
+// WriteOwned hands ownership of p to the wrapped writer
+func (n noCloseWriter) WriteOwned(p []byte) (int, error) {
+	return WriteOwned(n.w, p)
+}
+
+// WriteOwned hands ownership of p to the wrapped writer
+func (h *hardenedWriter) WriteOwned(p []byte) (int, error) {
+	if err := h.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := WriteOwned(h.w, p)
+	return n, h.state.Fail(err)
+}
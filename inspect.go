@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// InspectPrefixSize is the maximum number of bytes Inspect looks at
+const InspectPrefixSize = 512
+
+// Format describes a stream format detected by Inspect
+type Format struct {
+	Name   string // e.g. "gzip", "zstd", "dare"
+	Detail string // optional parameters, e.g. version or cipher
+	Offset int    // offset of the format header within the stream
+}
+
+// String returns the format name with its detail
+func (f Format) String() string {
+	if f.Detail == "" {
+		return f.Name
+	}
+	return f.Name + " (" + f.Detail + ")"
+}
+
+// Info is the result of Inspect
+type Info struct {
+	// Formats lists the detected formats from the outside in. A header
+	// followed by another recognized header (e.g. a key header in front of
+	// DARE packages) yields multiple entries.
+	Formats []Format
+
+	// Prefix is the number of bytes examined
+	Prefix int
+}
+
+// Known reports whether any format was detected
+func (i Info) Known() bool {
+	return len(i.Formats) > 0
+}
+
+// Detector recognizes a format from a stream prefix. It returns the detail
+// and, if the format has a fixed header after which another format may
+// follow, the header length. A headerLen of 0 stops nested detection.
+type Detector func(prefix []byte) (detail string, headerLen int, ok bool)
+
+type detector struct {
+	name   string
+	detect Detector
+}
+
+var (
+	detectorsMu sync.RWMutex
+	detectors   []detector
+)
+
+// RegisterFormat registers a format detector for Inspect. Middlewares with
+// their own header register themselves in an init function.
+func RegisterFormat(name string, detect Detector) {
+	detectorsMu.Lock()
+	defer detectorsMu.Unlock()
+	detectors = append(detectors, detector{name: name, detect: detect})
+}
+
+// ErrEmptyStream is returned by Inspect for empty input
+var ErrEmptyStream = errors.New("middleware: empty stream")
+
+// Inspect reports which known formats the stream starts with, without
+// constructing any pipeline. It consumes at most InspectPrefixSize bytes
+// from r; if r is a *bufio.Reader the prefix is peeked and not consumed.
+// Formats of middleware subpackages are recognized once the package is imported.
+func Inspect(r io.Reader) (Info, error) {
+	var prefix []byte
+	if br, ok := r.(*bufio.Reader); ok {
+		p, err := br.Peek(InspectPrefixSize)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			return Info{}, err
+		}
+		prefix = p
+	} else {
+		buf := make([]byte, InspectPrefixSize)
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return Info{}, err
+		}
+		prefix = buf[:n]
+	}
+	if len(prefix) == 0 {
+		return Info{}, ErrEmptyStream
+	}
+	return InspectBytes(prefix), nil
+}
+
+// InspectBytes is like Inspect for an in-memory prefix
+func InspectBytes(prefix []byte) Info {
+	info := Info{Prefix: len(prefix)}
+	detectorsMu.RLock()
+	defer detectorsMu.RUnlock()
+	offset := 0
+	for offset < len(prefix) {
+		matched := false
+		for _, d := range detectors {
+			detail, headerLen, ok := d.detect(prefix[offset:])
+			if !ok {
+				continue
+			}
+			info.Formats = append(info.Formats, Format{Name: d.name, Detail: detail, Offset: offset})
+			matched = true
+			offset += headerLen
+			if headerLen == 0 {
+				return info
+			}
+			break
+		}
+		if !matched {
+			break
+		}
+	}
+	return info
+}
+
+// headerLength returns the length of the consecutive headers of known
+// length at the start of b
+func headerLength(b []byte) int {
+	detectorsMu.RLock()
+	defer detectorsMu.RUnlock()
+	offset := 0
+	for offset < len(b) {
+		headerLen := 0
+		for _, d := range detectors {
+			if _, n, ok := d.detect(b[offset:]); ok {
+				headerLen = n
+				break
+			}
+		}
+		if headerLen == 0 {
+			break
+		}
+		offset += headerLen
+	}
+	return min(offset, len(b))
+}
+
+func hasPrefix(p []byte, magic ...byte) bool {
+	if len(p) < len(magic) {
+		return false
+	}
+	for i, b := range magic {
+		if p[i] != b {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	RegisterFormat("gzip", func(p []byte) (string, int, bool) {
+		return "", 0, hasPrefix(p, 0x1f, 0x8b, 0x08)
+	})
+	RegisterFormat("zstd", func(p []byte) (string, int, bool) {
+		return "", 0, hasPrefix(p, 0x28, 0xb5, 0x2f, 0xfd)
+	})
+	RegisterFormat("zstd-skippable", func(p []byte) (string, int, bool) {
+		if len(p) < 8 || p[0]&0xf0 != 0x50 || !hasPrefix(p[1:], 0x2a, 0x4d, 0x18) {
+			return "", 0, false
+		}
+		return "", 8 + int(binary.LittleEndian.Uint32(p[4:])), true
+	})
+	RegisterFormat("xz", func(p []byte) (string, int, bool) {
+		return "", 0, hasPrefix(p, 0xfd, '7', 'z', 'X', 'Z', 0x00)
+	})
+	RegisterFormat("bzip2", func(p []byte) (string, int, bool) {
+		if !hasPrefix(p, 'B', 'Z', 'h') || len(p) < 4 || p[3] < '1' || p[3] > '9' {
+			return "", 0, false
+		}
+		return fmt.Sprintf("block size %c00k", p[3]), 0, true
+	})
+	RegisterFormat("lz4", func(p []byte) (string, int, bool) {
+		return "", 0, hasPrefix(p, 0x04, 0x22, 0x4d, 0x18)
+	})
+	RegisterFormat("snappy-framed", func(p []byte) (string, int, bool) {
+		return "", 0, hasPrefix(p, 0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y')
+	})
+	RegisterFormat("s2-framed", func(p []byte) (string, int, bool) {
+		return "", 0, hasPrefix(p, 0xff, 0x06, 0x00, 0x00, 'S', '2', 's', 'T', 'w', 'O')
+	})
+	RegisterFormat("dynamic-variant", func(p []byte) (string, int, bool) {
+		if len(p) < 5 || !hasPrefix(p, dynamicMagic[:]...) || len(p) < 5+int(p[4]) {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, variant %q", p[3], p[5:5+int(p[4])]), 5 + int(p[4]), true
+	})
+	RegisterFormat("layers", func(p []byte) (string, int, bool) {
+		if len(p) < 5 || !hasPrefix(p, layersMagic[:]...) {
+			return "", 0, false
+		}
+		n := 5 + (int(p[4])+7)/8
+		if len(p) < n {
+			return "", 0, false
+		}
+		var enabled []string
+		for i := 0; i < int(p[4]); i++ {
+			if p[5+i/8]&(1<<(i%8)) != 0 {
+				enabled = append(enabled, fmt.Sprint(i))
+			}
+		}
+		return fmt.Sprintf("version %d, %d layers, enabled [%s]", p[3], p[4], strings.Join(enabled, " ")), n, true
+	})
+	RegisterFormat("dare", detectDARE)
+	RegisterFormat("zlib", func(p []byte) (string, int, bool) {
+		if len(p) < 2 || p[0]&0x0f != 8 || p[0]>>4 > 7 || (uint16(p[0])<<8|uint16(p[1]))%31 != 0 {
+			return "", 0, false
+		}
+		return "", 0, true
+	})
+}
+
+// detectDARE recognizes DARE (minio/sio) packages
+func detectDARE(p []byte) (string, int, bool) {
+	const headerSize, tagSize = 16, 16
+	if len(p) < headerSize {
+		return "", 0, false
+	}
+	var version string
+	switch p[0] {
+	case 0x10:
+		version = "1.0"
+	case 0x20:
+		version = "2.0"
+	default:
+		return "", 0, false
+	}
+	var cipher string
+	switch p[1] {
+	case 0x00:
+		cipher = "AES-256-GCM"
+	case 0x01:
+		cipher = "ChaCha20-Poly1305"
+	default:
+		return "", 0, false
+	}
+	payload := int(binary.LittleEndian.Uint16(p[2:4])) + 1
+	return fmt.Sprintf("version %s, %s, first package %d bytes", version, cipher, headerSize+payload+tagSize), 0, true
+}
@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultHandoffSize is the default size of the buffers an
+// InterruptibleReader hands from its helper goroutine to Read
+const DefaultHandoffSize = 32 << 10
+
+// InterruptibleReader reads a source that cannot be cancelled, e.g. a pipe
+// or a vendor SDK stream, in a helper goroutine, so Read returns once its
+// context is done or its deadline passed even if the source blocks
+// forever. At most two buffers of the hand-off size are held: the one Read
+// copies from and the one the goroutine reads into.
+//
+// An interrupted source Read keeps blocking in the goroutine, which exits
+// once it returns. Callers that abandon a reader should cancel its context
+// or call Close so the goroutine does not wait for hand-off forever.
+type InterruptibleReader struct {
+	ctx  context.Context
+	src  io.Reader
+	size int
+
+	once  sync.Once
+	ch    chan handoff
+	free  chan []byte
+	done  chan struct{}
+	close sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+
+	cur  handoff
+	left []byte
+	err  error
+}
+
+type handoff struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// NewInterruptibleReader returns a reader reading r in a helper goroutine
+// in chunks of size bytes, DefaultHandoffSize if size is not positive.
+// Read returns ctx.Err() once ctx is done. A nil ctx never ends.
+func NewInterruptibleReader(ctx context.Context, r io.Reader, size int) *InterruptibleReader {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if size <= 0 {
+		size = DefaultHandoffSize
+	}
+	return &InterruptibleReader{ctx: ctx, src: r, size: size, done: make(chan struct{})}
+}
+
+// SetReadDeadline makes Read return os.ErrDeadlineExceeded once t passed.
+// Unlike a done context, a passed deadline is not permanent: reading can
+// resume after it was extended. A zero t disables the deadline.
+func (r *InterruptibleReader) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	r.deadline = t
+	r.mu.Unlock()
+	return nil
+}
+
+// start launches the helper goroutine
+func (r *InterruptibleReader) start() {
+	r.ch = make(chan handoff)
+	r.free = make(chan []byte, 2)
+	r.free <- make([]byte, r.size)
+	r.free <- make([]byte, r.size)
+	go r.run()
+}
+
+func (r *InterruptibleReader) run() {
+	for {
+		var buf []byte
+		select {
+		case buf = <-r.free:
+		case <-r.done:
+			return
+		case <-r.ctx.Done():
+			return
+		}
+		n, err := r.src.Read(buf)
+		select {
+		case r.ch <- handoff{buf: buf, n: n, err: err}:
+		case <-r.done:
+			return
+		case <-r.ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read copies data handed off by the helper goroutine, waiting for it
+// until the context is done or the deadline passed
+func (r *InterruptibleReader) Read(p []byte) (int, error) {
+	if len(r.left) == 0 && r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r.once.Do(r.start)
+	for len(r.left) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.cur.buf != nil {
+			r.free <- r.cur.buf
+			r.cur = handoff{}
+		}
+		h, err := r.wait()
+		if err != nil {
+			return 0, err
+		}
+		r.cur, r.left, r.err = h, h.buf[:h.n], h.err
+	}
+	n := copy(p, r.left)
+	r.left = r.left[n:]
+	if len(r.left) == 0 && r.err != nil {
+		return n, r.err
+	}
+	return n, nil
+}
+
+// wait receives the next hand-off
+func (r *InterruptibleReader) wait() (handoff, error) {
+	r.mu.Lock()
+	deadline := r.deadline
+	r.mu.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return handoff{}, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case h := <-r.ch:
+		return h, nil
+	case <-r.ctx.Done():
+		r.err = r.ctx.Err()
+		return handoff{}, r.err
+	case <-r.done:
+		r.err = os.ErrClosed
+		return handoff{}, r.err
+	case <-timeout:
+		return handoff{}, os.ErrDeadlineExceeded
+	}
+}
+
+// Close stops the helper goroutine once its pending source Read returns.
+// It does not close the source. Read returns os.ErrClosed afterwards.
+func (r *InterruptibleReader) Close() error {
+	r.close.Do(func() { close(r.done) })
+	return nil
+}
+
+// WithInterruptibleReads wraps m so that readers created with ReaderContext
+// read their source through an InterruptibleReader with buffers of size
+// bytes, honoring cancellation and the deadline of the context even when
+// the source blocks. Reader and the writers are not affected.
+func WithInterruptibleReads(m Middleware, size int) Middleware {
+	return &interruptible{m: m, size: size}
+}
+
+type interruptible struct {
+	m    Middleware
+	size int
+}
+
+// Ensure interruptible implements the ContextMiddleware and Wrapper interfaces
+var (
+	_ ContextMiddleware = (*interruptible)(nil)
+	_ Wrapper           = (*interruptible)(nil)
+)
+
+func (i *interruptible) Writer(w io.Writer) io.Writer {
+	return i.m.Writer(w)
+}
+
+func (i *interruptible) Reader(r io.Reader) io.Reader {
+	return i.m.Reader(r)
+}
+
+func (i *interruptible) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	return WriterContext(ctx, i.m, w)
+}
+
+func (i *interruptible) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return ReaderContext(ctx, i.m, NewInterruptibleReader(ctx, r, i.size))
+}
+
+// Unwrap returns the wrapped middleware
+func (i *interruptible) Unwrap() Middleware {
+	return i.m
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+)
+
+// invertBlockSize is the amount read from the source per refill
+const invertBlockSize = 32 * 1024
+
+// ReaderFromWriterChain returns a reader producing what m.Writer would write
+// for the content of src, e.g. the compressed form of a file. The write side
+// runs lazily as the consumer reads, without a goroutine and without
+// buffering more than one block of output.
+func ReaderFromWriterChain(m Middleware, src io.Reader) io.Reader {
+	r := &invertedReader{src: src, block: make([]byte, invertBlockSize)}
+	r.w = m.Writer(&r.buf)
+	return r
+}
+
+type invertedReader struct {
+	src   io.Reader
+	w     io.Writer
+	buf   bytes.Buffer
+	block []byte
+	done  bool
+	state ReaderState
+}
+
+func (r *invertedReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for r.buf.Len() == 0 {
+		if err := r.state.Err(); err != nil {
+			return 0, err
+		}
+		if r.done {
+			return r.state.Track(0, io.EOF)
+		}
+		if err := r.fill(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	return r.buf.Read(p)
+}
+
+// fill passes one block of src through the writer, closing it at EOF
+func (r *invertedReader) fill() error {
+	n, err := r.src.Read(r.block)
+	if n > 0 {
+		if _, werr := r.w.Write(r.block[:n]); werr != nil {
+			return werr
+		}
+	}
+	if err == io.EOF {
+		r.done = true
+		if c, ok := r.w.(io.Closer); ok {
+			return c.Close()
+		}
+		return nil
+	}
+	return err
+}
+
+// WriterFromReaderChain is the inverse: it returns a writer applying the read
+// side of m to everything written, e.g. decompressing an upload on the fly,
+// and writing the result to dst. The read side runs in a goroutine; Close
+// waits for it and returns its error. dst is not closed.
+func WriterFromReaderChain(m Middleware, dst io.Writer) io.WriteCloser {
+	pr, pw := io.Pipe()
+	w := &invertedWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := io.Copy(dst, m.Reader(pr))
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+type invertedWriter struct {
+	pw    *io.PipeWriter
+	done  chan error
+	state WriterState
+}
+
+func (w *invertedWriter) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := w.pw.Write(p)
+	return n, w.state.Fail(err)
+}
+
+func (w *invertedWriter) Close() error {
+	return w.state.Close(func() error {
+		w.pw.Close()
+		return <-w.done
+	})
+}
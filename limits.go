@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultExpansionAllowance is the output a chain may always produce before
+// MaxExpansion is enforced, so tiny highly compressible inputs are not rejected
+const DefaultExpansionAllowance = 1 << 20
+
+// ErrExpansionLimit is returned by a chain reader that exceeds its Limits
+var ErrExpansionLimit = errors.New("middleware: expansion limit exceeded")
+
+// Limits bound the read side of a Chain as a whole. Stacked decompressors
+// multiply their expansion, so per-layer limits alone do not stop a nested
+// decompression bomb. Zero values disable the respective limit.
+type Limits struct {
+	// MaxExpansion is the highest allowed ratio of bytes returned by the
+	// chain reader to bytes read from the underlying reader
+	MaxExpansion float64
+
+	// Allowance is the output permitted regardless of MaxExpansion,
+	// 0 means DefaultExpansionAllowance
+	Allowance int64
+
+	// MaxOutput is the highest number of bytes the chain reader returns
+	MaxOutput int64
+
+	// MaxDepth is the highest number of read-side layers, counting the
+	// layers of nested chains individually
+	MaxDepth int
+}
+
+// WithLimits sets the read-side limits of the chain and returns it
+func (c *Chain) WithLimits(l Limits) *Chain {
+	c.limits = l
+	return c
+}
+
+// Depth returns the number of layers, counting the layers of nested chains individually
+func (c *Chain) Depth() int {
+	d := 0
+	for _, m := range c.layers {
+		if nested, ok := m.(*Chain); ok {
+			d += nested.Depth()
+		} else {
+			d++
+		}
+	}
+	return d
+}
+
+// limitReader enforces Limits on the output of a chain reader
+type limitReader struct {
+	r      io.Reader
+	src    *countReader
+	limits Limits
+	out    int64
+	state  ReaderState
+}
+
+func newLimitReader(c *Chain, r io.Reader, build func(io.Reader) io.Reader) io.Reader {
+	l := c.limits
+	if l.MaxDepth > 0 && c.Depth() > l.MaxDepth {
+		return &errReader{err: fmt.Errorf("%w: depth %d exceeds %d", ErrExpansionLimit, c.Depth(), l.MaxDepth)}
+	}
+	if l.MaxExpansion <= 0 && l.MaxOutput <= 0 {
+		return build(r)
+	}
+	if l.Allowance == 0 {
+		l.Allowance = DefaultExpansionAllowance
+	}
+	src := &countReader{r: r}
+	return &limitReader{r: build(src), src: src, limits: l}
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if err := l.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := l.r.Read(p)
+	l.out += int64(n)
+	if l.limits.MaxOutput > 0 && l.out > l.limits.MaxOutput {
+		return l.fail(fmt.Errorf("%w: output exceeds %d bytes", ErrExpansionLimit, l.limits.MaxOutput))
+	}
+	if l.limits.MaxExpansion > 0 && l.out > l.limits.Allowance &&
+		float64(l.out) > l.limits.MaxExpansion*float64(l.src.n) {
+		return l.fail(fmt.Errorf("%w: %d bytes from %d exceed ratio %g",
+			ErrExpansionLimit, l.out, l.src.n, l.limits.MaxExpansion))
+	}
+	return l.state.Track(n, err)
+}
+
+// fail reports a limit violation; errors of the layers are reported by the layers
+func (l *limitReader) fail(err error) (int, error) {
+	ReportError("chain", OpRead, err)
+	return l.state.Track(0, err)
+}
+
+// countReader counts the bytes read from the underlying reader
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
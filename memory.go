@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrMemoryLimit is returned when the layers of a chain cannot be fitted
+// into its memory limit
+var ErrMemoryLimit = errors.New("middleware: memory limit cannot be met")
+
+// MemoryUser is implemented by layers holding sizeable internal buffers,
+// like compression windows and encryption packages. MemoryUsage returns an
+// estimate of the bytes a single Writer or Reader of the layer holds,
+// whichever is more.
+type MemoryUser interface {
+	MemoryUsage() int64
+}
+
+// MemoryShrinker is implemented by layers that can trade throughput or
+// compression ratio for memory. ForMemory returns a copy of the layer
+// using at most budget bytes, or false if the layer cannot get that small;
+// the layer itself must not be modified.
+type MemoryShrinker interface {
+	ForMemory(budget int64) (Middleware, bool)
+}
+
+// Ensure Chain implements MemoryUser and MemoryShrinker interfaces
+var (
+	_ MemoryUser     = (*Chain)(nil)
+	_ MemoryShrinker = (*Chain)(nil)
+)
+
+// memoryUsage returns the usage of m, looking through wrappers. Layers not
+// implementing MemoryUser are not accounted.
+func memoryUsage(m Middleware) int64 {
+	switch l := m.(type) {
+	case MemoryUser:
+		return l.MemoryUsage()
+	case Wrapper:
+		return memoryUsage(l.Unwrap())
+	}
+	return 0
+}
+
+// MemoryUsage returns the sum of the memory usage of the enabled layers
+func (c *Chain) MemoryUsage() int64 {
+	var n int64
+	for _, m := range c.active() {
+		n += memoryUsage(m)
+	}
+	return n
+}
+
+// ForMemory returns the chain fitted into budget, see WithMemoryLimit
+func (c *Chain) ForMemory(budget int64) (Middleware, bool) {
+	fitted, err := c.WithMemoryLimit(budget)
+	return fitted, err == nil
+}
+
+// WithMemoryLimit returns a copy of the chain whose enabled layers use at
+// most limit bytes together, as estimated by MemoryUser layers. If the
+// layers use more, the budget left by the layers that cannot shrink is
+// shared among the MemoryShrinker layers in proportion to their usage, and
+// they are replaced by smaller copies, e.g. with a faster compression level
+// or smaller encryption segments. It fails with ErrMemoryLimit if the
+// budget cannot be met. Layers enabled later are not accounted.
+func (c *Chain) WithMemoryLimit(limit int64) (*Chain, error) {
+	layers := append([]Middleware(nil), c.layers...)
+	usage := make([]int64, len(layers))
+	var total, fixed int64
+	for i, m := range layers {
+		if c.isDisabled(i) {
+			continue
+		}
+		usage[i] = memoryUsage(m)
+		total += usage[i]
+		if _, ok := m.(MemoryShrinker); !ok {
+			fixed += usage[i]
+		}
+	}
+	if total > limit {
+		avail := limit - fixed
+		if avail <= 0 {
+			return nil, fmt.Errorf("%w: %d bytes needed by layers that cannot shrink, limit %d", ErrMemoryLimit, fixed, limit)
+		}
+		scale := float64(avail) / float64(total-fixed)
+		total = fixed
+		for i, m := range layers {
+			s, ok := m.(MemoryShrinker)
+			if !ok || c.isDisabled(i) || usage[i] == 0 {
+				continue
+			}
+			shrunk, ok := s.ForMemory(int64(float64(usage[i]) * scale))
+			if !ok {
+				return nil, fmt.Errorf("%w: layer %s cannot shrink to %d bytes", ErrMemoryLimit, c.layerName(i), int64(float64(usage[i])*scale))
+			}
+			layers[i] = shrunk
+			total += memoryUsage(shrunk)
+		}
+		if total > limit {
+			return nil, fmt.Errorf("%w: %d bytes needed, limit %d", ErrMemoryLimit, total, limit)
+		}
+	}
+	fitted := &Chain{
+		layers:   layers,
+		names:    append([]string(nil), c.names...),
+		disabled: make([]atomic.Bool, len(layers)),
+		limits:   c.limits,
+		maxWrite: c.maxWrite,
+		mode:     c.mode,
+		logf:     c.logf,
+
+		prevalidate: c.prevalidate,
+	}
+	for i := range fitted.disabled {
+		fitted.disabled[i].Store(c.isDisabled(i))
+	}
+	return fitted, nil
+}
+
+func (c *Chain) isDisabled(i int) bool {
+	return i < len(c.disabled) && c.disabled[i].Load()
+}
+
+// layerName returns the name of layer i, or its position in unnamed chains
+func (c *Chain) layerName(i int) string {
+	if i < len(c.names) && c.names[i] != "" {
+		return c.names[i]
+	}
+	return fmt.Sprint(i)
+}
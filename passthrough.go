@@ -0,0 +1,15 @@
+package middleware
+
+import "io"
+
+type passthrough struct{}
+
+// Passthrough returns a middleware that leaves data unchanged
+func Passthrough() Middleware {
+	return passthrough{}
+}
+
+func (passthrough) Writer(w io.Writer) io.Writer { return w }
+func (passthrough) Reader(r io.Reader) io.Reader { return r }
+
+func (passthrough) Describe() Component { return Component{Type: "passthrough"} }
@@ -0,0 +1,320 @@
+// Package pgp provides an encryption middleware writing OpenPGP messages
+// (RFC 4880, RFC 9580) encrypted to one or more public keys, for teams whose
+// downstream tooling is GnuPG based:
+//
+//	gpg --decrypt spilled.bin > plain
+//
+// Readers decrypt with a private keyring and verify the integrity
+// protection of the message, MDC or AEAD, and its signature if one is
+// required. Messages without integrity protection (symmetrically encrypted
+// data packets) are rejected before anything is decrypted.
+//
+// The package builds on github.com/ProtonMail/go-crypto/openpgp, which
+// also reads the Curve25519 keys GnuPG creates by default since 2.3.
+package pgp
+
+import (
+	"bufio"
+	"bytes"
+	_ "crypto/sha512" // SHA-384 and SHA-512 are common key preferences
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+var (
+	// ErrNoRecipients is returned by NewE without recipients and keyring
+	ErrNoRecipients = errors.New("pgp: no recipients")
+
+	// ErrNotSigned is returned by Readers requiring a signature for
+	// unsigned messages
+	ErrNotSigned = errors.New("pgp: message is not signed")
+)
+
+// Middleware encrypts streams to OpenPGP public keys
+type Middleware struct {
+	recipients openpgp.EntityList
+	keyring    openpgp.EntityList
+	signer     *openpgp.Entity
+	prompt     openpgp.PromptFunction
+	armor      bool
+	requireSig bool
+	config     *packet.Config
+}
+
+// Ensure Middleware implements middleware.Middleware, middleware.Roled and middleware.Describer interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Roled      = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+)
+
+// Option configures the middleware
+type Option func(*Middleware)
+
+// WithRecipients adds the public keys written streams are encrypted to
+func WithRecipients(keys openpgp.EntityList) Option {
+	return func(m *Middleware) {
+		m.recipients = append(m.recipients, keys...)
+	}
+}
+
+// WithKeyring sets the private keys used to decrypt streams. Keys
+// protected by a passphrase need WithPrompt.
+func WithKeyring(keys openpgp.EntityList) Option {
+	return func(m *Middleware) {
+		m.keyring = keys
+	}
+}
+
+// WithPrompt sets the function asked for passphrases of protected private
+// keys, see openpgp.ReadMessage
+func WithPrompt(fn openpgp.PromptFunction) Option {
+	return func(m *Middleware) {
+		m.prompt = fn
+	}
+}
+
+// WithSigner signs written streams with the private key of signer
+func WithSigner(signer *openpgp.Entity) Option {
+	return func(m *Middleware) {
+		m.signer = signer
+	}
+}
+
+// WithRequireSignature makes Readers fail on unsigned messages and on
+// messages signed by a key that is not in the keyring
+func WithRequireSignature() Option {
+	return func(m *Middleware) {
+		m.requireSig = true
+	}
+}
+
+// WithArmor writes ASCII armored messages. Readers accept both forms.
+func WithArmor() Option {
+	return func(m *Middleware) {
+		m.armor = true
+	}
+}
+
+// WithConfig sets the packet configuration, e.g. the preferred cipher and
+// compression algorithm. By default the cipher is the first one all
+// recipients prefer and the stream is not compressed. NewE rejects
+// configurations allowing unauthenticated messages.
+func WithConfig(cfg *packet.Config) Option {
+	return func(m *Middleware) {
+		m.config = cfg
+	}
+}
+
+// New creates an OpenPGP middleware. New panics on an invalid configuration.
+func New(opts ...Option) *Middleware {
+	m, err := NewE(opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return m
+}
+
+// NewE is like New, but returns an error instead of panicking
+func NewE(opts ...Option) (*Middleware, error) {
+	m := &Middleware{}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if len(m.recipients) == 0 && len(m.keyring) == 0 {
+		return nil, ErrNoRecipients
+	}
+	if m.signer != nil && (m.signer.PrivateKey == nil || m.signer.PrivateKey.Encrypted) {
+		return nil, errors.New("pgp: signer needs a decrypted private key")
+	}
+	if m.config.AllowUnauthenticatedMessages() {
+		return nil, errors.New("pgp: messages without integrity protection cannot be allowed")
+	}
+	return m, nil
+}
+
+// ReadKeyring reads a keyring in binary or ASCII armored form, e.g. the
+// output of gpg --export or gpg --export-secret-keys
+func ReadKeyring(r io.Reader) (openpgp.EntityList, error) {
+	br := bufio.NewReader(r)
+	if armored(br) {
+		return openpgp.ReadArmoredKeyRing(br)
+	}
+	return openpgp.ReadKeyRing(br)
+}
+
+// armored reports whether the stream in br starts with an armor header
+func armored(br *bufio.Reader) bool {
+	p, _ := br.Peek(64)
+	return bytes.HasPrefix(bytes.TrimLeft(p, " \t\r\n"), []byte("-----BEGIN PGP"))
+}
+
+// Role returns middleware.RoleEncryption
+func (m *Middleware) Role() middleware.Role { return middleware.RoleEncryption }
+
+// Describe reports the OpenPGP format and the number of recipients
+func (m *Middleware) Describe() middleware.Component {
+	integrity := "mdc"
+	if m.config.AEAD() != nil {
+		integrity = "aead"
+	}
+	c := middleware.Component{
+		Type:      string(middleware.RoleEncryption),
+		Algorithm: "openpgp",
+		Integrity: integrity,
+		Properties: map[string]string{
+			"format":         "openpgp",
+			"key_management": "recipients",
+			"recipients":     fmt.Sprint(len(m.recipients)),
+			"signed":         fmt.Sprint(m.signer != nil),
+		},
+	}
+	if m.config != nil && m.config.DefaultCipher != 0 {
+		c.KeyBits = m.config.DefaultCipher.KeySize() * 8
+	}
+	return c
+}
+
+// Writer encrypts to the recipients. Closing it writes the end of the
+// message; it does not close w.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return &writer{m: m, w: w, state: middleware.WriterState{Layer: "pgp"}}
+}
+
+type writer struct {
+	m       *Middleware
+	w       io.Writer
+	armor   io.WriteCloser
+	plain   io.WriteCloser
+	started bool
+	state   middleware.WriterState
+}
+
+func (w *writer) start() error {
+	w.started = true
+	if len(w.m.recipients) == 0 {
+		return ErrNoRecipients
+	}
+	dst := w.w
+	if w.m.armor {
+		a, err := armor.Encode(dst, "PGP MESSAGE", nil)
+		if err != nil {
+			return err
+		}
+		w.armor, dst = a, a
+	}
+	hints := &openpgp.FileHints{IsBinary: true}
+	plain, err := openpgp.Encrypt(dst, w.m.recipients, w.m.signer, hints, w.m.config)
+	if err != nil {
+		return fmt.Errorf("pgp: %w", err)
+	}
+	w.plain = plain
+	return nil
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if !w.started {
+		if err := w.start(); err != nil {
+			return 0, w.state.Fail(err)
+		}
+	}
+	n, err := w.plain.Write(p)
+	return n, w.state.Fail(err)
+}
+
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if !w.started {
+			if err := w.start(); err != nil {
+				return err
+			}
+		}
+		if err := w.plain.Close(); err != nil {
+			return err
+		}
+		if w.armor != nil {
+			return w.armor.Close()
+		}
+		return nil
+	})
+}
+
+// Reader decrypts with the keyring
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return &reader{m: m, src: r, state: middleware.ReaderState{Layer: "pgp"}}
+}
+
+type reader struct {
+	m     *Middleware
+	src   io.Reader
+	md    *openpgp.MessageDetails
+	state middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	if r.md == nil {
+		if err := r.start(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	n, err := r.md.UnverifiedBody.Read(p)
+	if err == io.EOF {
+		err = r.verify()
+	}
+	return r.state.Track(n, err)
+}
+
+func (r *reader) start() error {
+	if len(r.m.keyring) == 0 {
+		return errors.New("pgp: no keyring to decrypt with")
+	}
+	var src io.Reader = r.src
+	if br := bufio.NewReader(src); armored(br) {
+		block, err := armor.Decode(br)
+		if err != nil {
+			return fmt.Errorf("pgp: %w", err)
+		}
+		src = block.Body
+	} else {
+		src = br
+	}
+	md, err := openpgp.ReadMessage(src, r.m.keyring, r.m.prompt, r.m.config)
+	if err != nil {
+		return fmt.Errorf("pgp: %w", err)
+	}
+	if !md.IsEncrypted {
+		return errors.New("pgp: message is not encrypted")
+	}
+	if r.m.requireSig && !md.IsSigned {
+		return ErrNotSigned
+	}
+	r.md = md
+	return nil
+}
+
+// verify checks the signature once the body was read, the MDC or AEAD tag
+// is checked by the body reader itself
+func (r *reader) verify() error {
+	if !r.md.IsSigned {
+		return io.EOF
+	}
+	if r.md.SignatureError != nil {
+		return fmt.Errorf("pgp: %w", r.md.SignatureError)
+	}
+	if r.m.requireSig && r.md.SignedBy == nil {
+		return fmt.Errorf("pgp: signed by unknown key %X", r.md.SignedByKeyId)
+	}
+	return io.EOF
+}
@@ -0,0 +1,129 @@
+package pgp_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"schneider.vip/hybridbuffer/middleware/pgp"
+)
+
+func newEntity(t *testing.T) *openpgp.Entity {
+	t.Helper()
+	e, err := openpgp.NewEntity("test", "", "test@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func encrypt(t *testing.T, m *pgp.Middleware, data []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	e := newEntity(t)
+	keys := openpgp.EntityList{e}
+	data := bytes.Repeat([]byte("openpgp "), 10000)
+	for name, opts := range map[string][]pgp.Option{
+		"binary": nil,
+		"armor":  {pgp.WithArmor()},
+		"signed": {pgp.WithSigner(e), pgp.WithRequireSignature()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := pgp.New(append([]pgp.Option{pgp.WithRecipients(keys), pgp.WithKeyring(keys)}, opts...)...)
+			got, err := io.ReadAll(m.Reader(bytes.NewReader(encrypt(t, m, data))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("round trip mismatch")
+			}
+		})
+	}
+}
+
+func TestRequireSignature(t *testing.T) {
+	keys := openpgp.EntityList{newEntity(t)}
+	enc := encrypt(t, pgp.New(pgp.WithRecipients(keys)), []byte("unsigned"))
+	m := pgp.New(pgp.WithKeyring(keys), pgp.WithRequireSignature())
+	if _, err := io.ReadAll(m.Reader(bytes.NewReader(enc))); !errors.Is(err, pgp.ErrNotSigned) {
+		t.Fatalf("got %v, want ErrNotSigned", err)
+	}
+}
+
+func TestTamperedMessage(t *testing.T) {
+	keys := openpgp.EntityList{newEntity(t)}
+	m := pgp.New(pgp.WithRecipients(keys), pgp.WithKeyring(keys))
+	enc := encrypt(t, m, bytes.Repeat([]byte("x"), 1000))
+	enc[len(enc)-10] ^= 1
+	if _, err := io.ReadAll(m.Reader(bytes.NewReader(enc))); err == nil {
+		t.Fatal("expected an error for a tampered message")
+	}
+}
+
+// downgrade turns the integrity protected data packet (tag 18) of a message
+// into a symmetrically encrypted data packet without MDC (tag 9)
+func downgrade(t *testing.T, msg []byte) []byte {
+	t.Helper()
+	b := bytes.Clone(msg)
+	for i := 0; i+1 < len(b); {
+		if b[i]&0xc0 != 0xc0 {
+			t.Fatalf("old format packet header at %d", i)
+		}
+		if b[i]&0x3f == 18 {
+			b[i] = 0xc0 | 9
+			return b
+		}
+		var n, hdr int
+		switch l := int(b[i+1]); {
+		case l < 192:
+			n, hdr = l, 2
+		case l < 224:
+			n, hdr = (l-192)<<8+int(b[i+2])+192, 3
+		case l == 255:
+			n, hdr = int(b[i+2])<<24|int(b[i+3])<<16|int(b[i+4])<<8|int(b[i+5]), 6
+		default:
+			t.Fatalf("partial length ahead of the data packet at %d", i)
+		}
+		i += hdr + n
+	}
+	t.Fatal("no integrity protected data packet")
+	return nil
+}
+
+func TestRejectsMessageWithoutMDC(t *testing.T) {
+	keys := openpgp.EntityList{newEntity(t)}
+	m := pgp.New(pgp.WithRecipients(keys), pgp.WithKeyring(keys))
+	enc := downgrade(t, encrypt(t, m, []byte("malleable")))
+	n, err := m.Reader(bytes.NewReader(enc)).Read(make([]byte, 64))
+	if n != 0 || err == nil {
+		t.Fatalf("got %d, %v; want an error for a message without MDC", n, err)
+	}
+}
+
+func TestNewRejectsUnauthenticatedConfig(t *testing.T) {
+	keys := openpgp.EntityList{newEntity(t)}
+	_, err := pgp.NewE(pgp.WithKeyring(keys), pgp.WithConfig(&packet.Config{InsecureAllowUnauthenticatedMessages: true}))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestNewWithoutKeys(t *testing.T) {
+	if _, err := pgp.NewE(); !errors.Is(err, pgp.ErrNoRecipients) {
+		t.Fatalf("got %v, want ErrNoRecipients", err)
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import "io"
+
+// PipeWriterTo bridges push-style producers to consumers that pull from an
+// io.Reader, such as http.Post or an object store upload. Data written to
+// the returned writer is encoded by m and handed to sink, which runs in its
+// own goroutine and reads from a pipe until EOF.
+//
+// Close finalizes m and signals EOF to sink; the result of sink is delivered
+// on the channel, which is buffered and receives exactly one value. If sink
+// returns early, further writes fail with its error, or io.ErrClosedPipe if
+// it returned nil.
+func PipeWriterTo(m Middleware, sink func(r io.Reader) error) (io.WriteCloser, <-chan error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := sink(pr)
+		pr.CloseWithError(err)
+		done <- err
+	}()
+	return &pipeWriter{w: m.Writer(pw), pw: pw}, done
+}
+
+type pipeWriter struct {
+	w     io.Writer
+	pw    *io.PipeWriter
+	state WriterState
+}
+
+func (p *pipeWriter) Write(b []byte) (int, error) {
+	if err := p.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.w.Write(b)
+	if err != nil {
+		p.pw.CloseWithError(err)
+	}
+	return n, p.state.Fail(err)
+}
+
+// Close finalizes the middleware and closes the pipe. A failed write closes
+// the pipe with its error, so sink does not mistake a partial stream for a
+// complete one.
+func (p *pipeWriter) Close() error {
+	err := p.state.Close(func() error {
+		if c, ok := p.w.(io.Closer); ok {
+			return c.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		p.pw.CloseWithError(err)
+		return err
+	}
+	return p.pw.Close()
+}
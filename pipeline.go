@@ -0,0 +1,219 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// ErrOrder is returned by Pipeline.Build when the layers violate an ordering rule
+var ErrOrder = errors.New("middleware: invalid layer order")
+
+// Role classifies a layer for ordering rules
+type Role string
+
+// Built-in roles
+const (
+	RoleCompression Role = "compression"
+	RoleEncryption  Role = "encryption"
+	RoleChecksum    Role = "checksum"
+	RoleThrottle    Role = "throttle"
+)
+
+// Roled is implemented by middlewares that declare their role
+type Roled interface {
+	Role() Role
+}
+
+// Constrained is implemented by middlewares that declare ordering rules for
+// the pipelines they are used in
+type Constrained interface {
+	Constraints() []Rule
+}
+
+// Layer is a named layer of a pipeline
+type Layer struct {
+	Name       string
+	Role       Role
+	Middleware Middleware
+}
+
+// Rule validates the order of pipeline layers, plaintext side first
+type Rule interface {
+	Check(layers []Layer) error
+}
+
+// RuleFunc adapts a function to the Rule interface
+type RuleFunc func(layers []Layer) error
+
+// Check calls f
+func (f RuleFunc) Check(layers []Layer) error {
+	return f(layers)
+}
+
+// Before requires every layer with role a to be closer to the plaintext than
+// every layer with role b, e.g. Before(RoleCompression, RoleEncryption)
+func Before(a, b Role) Rule {
+	return RuleFunc(func(layers []Layer) error {
+		for i, la := range layers {
+			if la.Role != a {
+				continue
+			}
+			for _, lb := range layers[:i] {
+				if lb.Role == b {
+					return fmt.Errorf("%w: %s layer %q must come before %s layer %q",
+						ErrOrder, a, la.Name, b, lb.Name)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Outermost requires layers with the role to be outermost, i.e. closest to
+// the stored data
+func Outermost(role Role) Rule {
+	return RuleFunc(func(layers []Layer) error {
+		for i, l := range layers {
+			if l.Role == role && !allRole(layers[i+1:], role) {
+				return fmt.Errorf("%w: %s layer %q must be outermost", ErrOrder, role, l.Name)
+			}
+		}
+		return nil
+	})
+}
+
+// Innermost requires layers with the role to be innermost, i.e. closest to
+// the plaintext
+func Innermost(role Role) Rule {
+	return RuleFunc(func(layers []Layer) error {
+		for i, l := range layers {
+			if l.Role == role && !allRole(layers[:i], role) {
+				return fmt.Errorf("%w: %s layer %q must be innermost", ErrOrder, role, l.Name)
+			}
+		}
+		return nil
+	})
+}
+
+// AtEdge requires layers with the role to be either innermost or outermost
+func AtEdge(role Role) Rule {
+	inner, outer := Innermost(role), Outermost(role)
+	return RuleFunc(func(layers []Layer) error {
+		if inner.Check(layers) == nil || outer.Check(layers) == nil {
+			return nil
+		}
+		for _, l := range layers {
+			if l.Role == role {
+				return fmt.Errorf("%w: %s layer %q must be innermost or outermost", ErrOrder, role, l.Name)
+			}
+		}
+		return nil
+	})
+}
+
+func allRole(layers []Layer, role Role) bool {
+	for _, l := range layers {
+		if l.Role != role {
+			return false
+		}
+	}
+	return true
+}
+
+// DefaultRules returns the rules used by NewPipeline: compression before
+// encryption (ciphertext does not compress), checksums outermost and
+// throttling at either edge
+func DefaultRules() []Rule {
+	return []Rule{
+		Before(RoleCompression, RoleEncryption),
+		Outermost(RoleChecksum),
+		AtEdge(RoleThrottle),
+	}
+}
+
+// Pipeline builds a Chain from named layers, validating their order
+type Pipeline struct {
+	layers   []Layer
+	rules    []Rule
+	memLimit int64
+}
+
+// NewPipeline creates a pipeline builder using DefaultRules
+func NewPipeline() *Pipeline {
+	return &Pipeline{rules: DefaultRules()}
+}
+
+// WithRules adds ordering rules and returns the pipeline
+func (p *Pipeline) WithRules(rules ...Rule) *Pipeline {
+	p.rules = append(p.rules, rules...)
+	return p
+}
+
+// WithoutRules drops all rules added so far, including the default rules
+func (p *Pipeline) WithoutRules() *Pipeline {
+	p.rules = nil
+	return p
+}
+
+// WithMemoryLimit makes Build fit the layers into limit bytes, see
+// Chain.WithMemoryLimit, and returns the pipeline
+func (p *Pipeline) WithMemoryLimit(limit int64) *Pipeline {
+	p.memLimit = limit
+	return p
+}
+
+// Add appends a layer on the outside of the pipeline. If the middleware
+// implements Roled its role is used, otherwise the layer has no role.
+func (p *Pipeline) Add(name string, m Middleware) *Pipeline {
+	var role Role
+	if r, ok := m.(Roled); ok {
+		role = r.Role()
+	}
+	return p.AddRole(name, role, m)
+}
+
+// AddRole appends a layer with an explicit role
+func (p *Pipeline) AddRole(name string, role Role, m Middleware) *Pipeline {
+	p.layers = append(p.layers, Layer{Name: name, Role: role, Middleware: m})
+	return p
+}
+
+// Build validates the layers against all rules, including those declared by
+// Constrained middlewares, and returns the chain, fitted into the memory
+// limit if one is set
+func (p *Pipeline) Build() (*Chain, error) {
+	rules := append([]Rule(nil), p.rules...)
+	seen := make(map[string]bool, len(p.layers))
+	for i, l := range p.layers {
+		if l.Middleware == nil {
+			return nil, fmt.Errorf("middleware: layer %d (%s) is nil", i, l.Name)
+		}
+		if l.Name == "" || seen[l.Name] {
+			return nil, fmt.Errorf("middleware: layer %d: missing or duplicate name %q", i, l.Name)
+		}
+		seen[l.Name] = true
+		if c, ok := l.Middleware.(Constrained); ok {
+			rules = append(rules, c.Constraints()...)
+		}
+	}
+	var errs []error
+	for _, r := range rules {
+		if err := r.Check(p.layers); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	c := &Chain{}
+	for _, l := range p.layers {
+		c.layers = append(c.layers, l.Middleware)
+		c.names = append(c.names, l.Name)
+	}
+	c.disabled = make([]atomic.Bool, len(c.layers))
+	if p.memLimit > 0 {
+		return c.WithMemoryLimit(p.memLimit)
+	}
+	return c, nil
+}
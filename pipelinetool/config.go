@@ -0,0 +1,218 @@
+package pipelinetool
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/compression"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+	"schneider.vip/hybridbuffer/middleware/rle"
+)
+
+// Config describes a pipeline, layers are ordered from the plaintext outwards
+type Config struct {
+	Layers []LayerConfig `json:"layers"`
+}
+
+// LayerConfig describes one layer of a pipeline
+type LayerConfig struct {
+	Type    string            `json:"type"`
+	Name    string            `json:"name,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// ParseConfig decodes a JSON pipeline config
+func ParseConfig(r io.Reader) (Config, error) {
+	var cfg Config
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return Config{}, fmt.Errorf("pipelinetool: parse config: %w", err)
+	}
+	return cfg, nil
+}
+
+// LoadConfig reads a JSON pipeline config from a file
+func LoadConfig(path string) (Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer f.Close()
+	return ParseConfig(f)
+}
+
+// Factory creates a layer from its options
+type Factory func(options map[string]string) (middleware.Middleware, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{
+		"rle":         newRLE,
+		"compression": newCompression,
+		"encryption":  newEncryption,
+	}
+)
+
+// Register makes a layer type available to Build, so custom middlewares can
+// be used from a pipeline config. Registering an existing type replaces it.
+func Register(layerType string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[layerType] = f
+}
+
+// Types returns the registered layer types
+func Types() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// ErrUnknownLayer is returned by Build for unregistered layer types
+var ErrUnknownLayer = errors.New("pipelinetool: unknown layer type")
+
+// Build creates the middleware chain described by cfg. The layer order is
+// validated with the default rules of middleware.NewPipeline. Layers are
+// named by their type unless a name is configured or the type occurs twice.
+func Build(cfg Config) (*middleware.Chain, error) {
+	p := middleware.NewPipeline()
+	count := make(map[string]int)
+	for _, l := range cfg.Layers {
+		count[l.Type]++
+	}
+	for i, l := range cfg.Layers {
+		factoriesMu.RLock()
+		f, ok := factories[l.Type]
+		factoriesMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("%w: layer %d: %q", ErrUnknownLayer, i, l.Type)
+		}
+		m, err := f(l.Options)
+		if err != nil {
+			return nil, fmt.Errorf("pipelinetool: layer %d (%s): %w", i, l.Type, err)
+		}
+		name := l.Name
+		if name == "" {
+			name = l.Type
+			if count[l.Type] > 1 {
+				name = fmt.Sprintf("%s.%d", l.Type, i)
+			}
+		}
+		p.Add(name, m)
+	}
+	c, err := p.Build()
+	if err != nil {
+		return nil, fmt.Errorf("pipelinetool: %w", err)
+	}
+	return c, nil
+}
+
+func newRLE(options map[string]string) (middleware.Middleware, error) {
+	var opts []rle.Option
+	if v, ok := options["min_run"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("min_run: %w", err)
+		}
+		opts = append(opts, rle.WithMinRun(n))
+	}
+	if v, ok := options["zeros_only"]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("zeros_only: %w", err)
+		}
+		if b {
+			opts = append(opts, rle.WithZerosOnly())
+		}
+	}
+	return rle.New(opts...), nil
+}
+
+// newCompression supports the options algorithm (see compression.Available) and level
+func newCompression(options map[string]string) (middleware.Middleware, error) {
+	var opts []compression.Option
+	if v, ok := options["algorithm"]; ok {
+		algo, err := compression.ParseAlgorithm(v)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, compression.WithAlgorithm(algo))
+	}
+	if v, ok := options["level"]; ok {
+		level, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("level: %w", err)
+		}
+		opts = append(opts, compression.WithLevel(level))
+	}
+	return middleware.Recover(func() middleware.Middleware {
+		return compression.New(opts...)
+	})()
+}
+
+// newEncryption supports the options key (hex), key_file (raw or hex key)
+// and cipher (aes-256-gcm or chacha20-poly1305)
+func newEncryption(options map[string]string) (middleware.Middleware, error) {
+	var key []byte
+	switch {
+	case options["key"] != "":
+		k, err := hex.DecodeString(options["key"])
+		if err != nil {
+			return nil, fmt.Errorf("key: %w", err)
+		}
+		key = k
+	case options["key_file"] != "":
+		k, err := readKeyFile(options["key_file"])
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	default:
+		return nil, errors.New("key or key_file is required")
+	}
+	if len(key) != encryption.KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", encryption.KeySize, len(key))
+	}
+	opts := []encryption.Option{encryption.WithKey(key)}
+	if c, ok := options["cipher"]; ok {
+		suite, err := encryption.ParseCipher(c)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, encryption.WithCipher(suite))
+	}
+	return middleware.Recover(func() middleware.Middleware {
+		return encryption.New(opts...)
+	})()
+}
+
+// readKeyFile reads a key stored either raw or hex encoded
+func readKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == encryption.KeySize {
+		return data, nil
+	}
+	k, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key_file: neither %d raw bytes nor hex: %w", encryption.KeySize, err)
+	}
+	return k, nil
+}
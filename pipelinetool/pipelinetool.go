@@ -0,0 +1,112 @@
+// Package pipelinetool provides programmatic entry points for offline work
+// on stored buffers: encoding, decoding and verifying files with a pipeline
+// described by a Config. It is intended to back a debugging CLI, so operators
+// can recover or inspect spilled buffers outside the original application.
+package pipelinetool
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// Encode writes src through the write side of the pipeline to dst
+func Encode(cfg Config, dst io.Writer, src io.Reader) (int64, error) {
+	chain, err := Build(cfg)
+	if err != nil {
+		return 0, err
+	}
+	w := chain.Writer(dst)
+	n, err := io.Copy(w, src)
+	if cerr := w.(io.Closer).Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// Decode reads src through the read side of the pipeline into dst
+func Decode(cfg Config, dst io.Writer, src io.Reader) (int64, error) {
+	chain, err := Build(cfg)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, chain.Reader(src))
+}
+
+// EncodeFile encodes the file src into dst. dst is replaced atomically and
+// is left untouched if encoding fails.
+func EncodeFile(cfg Config, src, dst string) error {
+	return transformFile(src, dst, func(w io.Writer, r io.Reader) error {
+		_, err := Encode(cfg, w, r)
+		return err
+	})
+}
+
+// DecodeFile decodes the file src into dst. dst is replaced atomically and
+// is left untouched if decoding fails.
+func DecodeFile(cfg Config, src, dst string) error {
+	return transformFile(src, dst, func(w io.Writer, r io.Reader) error {
+		_, err := Decode(cfg, w, r)
+		return err
+	})
+}
+
+// VerifyResult describes a verified file
+type VerifyResult struct {
+	StoredSize  int64           // size of the file
+	DecodedSize int64           // size of the decoded plaintext
+	Info        middleware.Info // formats detected at the start of the file
+}
+
+// VerifyFile decodes src completely without writing the plaintext anywhere,
+// which checks every authenticated or checksummed layer of the pipeline
+func VerifyFile(cfg Config, src string) (VerifyResult, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return VerifyResult{}, err
+	}
+	defer f.Close()
+	var res VerifyResult
+	if st, err := f.Stat(); err == nil {
+		res.StoredSize = st.Size()
+	}
+	if res.Info, err = middleware.Inspect(f); err != nil && err != middleware.ErrEmptyStream {
+		return res, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return res, err
+	}
+	res.DecodedSize, err = Decode(cfg, io.Discard, f)
+	if err != nil {
+		return res, fmt.Errorf("pipelinetool: verify %s: decoded %d bytes: %w", src, res.DecodedSize, err)
+	}
+	return res, nil
+}
+
+func transformFile(src, dst string, fn func(io.Writer, io.Reader) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := fn(tmp, in); err != nil {
+		tmp.Close()
+		return fmt.Errorf("pipelinetool: %s: %w", src, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,189 @@
+package pipelinetool_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/pipelinetool"
+)
+
+const testKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+const configJSON = `{"layers": [
+	{"type": "rle", "options": {"zeros_only": "true"}},
+	{"type": "compression", "options": {"algorithm": "gzip", "level": "9"}},
+	{"type": "encryption", "options": {"key": "` + testKey + `", "cipher": "chacha20-poly1305"}}
+]}`
+
+func parse(t *testing.T, s string) pipelinetool.Config {
+	t.Helper()
+	cfg, err := pipelinetool.ParseConfig(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestBuildNamesLayers(t *testing.T) {
+	c, err := pipelinetool.Build(parse(t, `{"layers": [
+		{"type": "rle", "name": "sparse"},
+		{"type": "rle"},
+		{"type": "compression"},
+		{"type": "rle"},
+		{"type": "encryption", "options": {"key": "`+testKey+`"}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(c.Names(), " "), "sparse rle.1 compression rle.3 encryption"; got != want {
+		t.Fatalf("layers %q, want %q", got, want)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers string
+		want   error
+	}{
+		{"unknown type", `[{"type": "zip"}]`, pipelinetool.ErrUnknownLayer},
+		{"wrong order", `[{"type": "encryption", "options": {"key": "` + testKey + `"}}, {"type": "compression"}]`, middleware.ErrOrder},
+		{"min_run", `[{"type": "rle", "options": {"min_run": "many"}}]`, nil},
+		{"zeros_only", `[{"type": "rle", "options": {"zeros_only": "yes please"}}]`, nil},
+		{"algorithm", `[{"type": "compression", "options": {"algorithm": "lzw"}}]`, nil},
+		{"level", `[{"type": "compression", "options": {"level": "max"}}]`, nil},
+		{"no key", `[{"type": "encryption"}]`, nil},
+		{"key not hex", `[{"type": "encryption", "options": {"key": "secret"}}]`, nil},
+		{"short key", `[{"type": "encryption", "options": {"key": "0011"}}]`, nil},
+		{"cipher", `[{"type": "encryption", "options": {"key": "` + testKey + `", "cipher": "rot13"}}]`, nil},
+		{"missing key file", `[{"type": "encryption", "options": {"key_file": "/nonexistent/key"}}]`, os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pipelinetool.Build(parse(t, `{"layers": `+tt.layers+`}`))
+			if err == nil {
+				t.Fatal("invalid config accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := pipelinetool.ParseConfig(strings.NewReader(`{"layers": [], "verbose": true}`)); err == nil {
+		t.Fatal("unknown config field accepted")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	raw, _ := hex.DecodeString(testKey)
+	files := map[string][]byte{
+		"raw": raw,
+		"hex": []byte(testKey + "\n"),
+	}
+	data := []byte("key file contents")
+	var encoded [][]byte
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cfg := pipelinetool.Config{Layers: []pipelinetool.LayerConfig{{Type: "encryption", Options: map[string]string{"key_file": path}}}}
+		var buf bytes.Buffer
+		if _, err := pipelinetool.Encode(cfg, &buf, bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		encoded = append(encoded, buf.Bytes())
+	}
+	// both files hold the same key, so each stream decodes with the hex key
+	cfg := pipelinetool.Config{Layers: []pipelinetool.LayerConfig{{Type: "encryption", Options: map[string]string{"key": testKey}}}}
+	for _, enc := range encoded {
+		var out bytes.Buffer
+		if _, err := pipelinetool.Decode(cfg, &out, bytes.NewReader(enc)); err != nil || !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("got %q, %v", out.Bytes(), err)
+		}
+	}
+}
+
+func TestFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := parse(t, configJSON)
+	plain := filepath.Join(dir, "plain")
+	data := append(bytes.Repeat([]byte("spilled buffer "), 1000), make([]byte, 4096)...)
+	if err := os.WriteFile(plain, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := filepath.Join(dir, "stored")
+	if err := pipelinetool.EncodeFile(cfg, plain, stored); err != nil {
+		t.Fatal(err)
+	}
+	res, err := pipelinetool.VerifyFile(cfg, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.DecodedSize != int64(len(data)) || res.StoredSize == 0 || res.StoredSize >= res.DecodedSize {
+		t.Fatalf("verify result %+v", res)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := pipelinetool.DecodeFile(cfg, stored, restored); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(restored); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("restored %d bytes, %v", len(got), err)
+	}
+
+	// a damaged file fails verification and leaves an existing target alone
+	enc, _ := os.ReadFile(stored)
+	enc[len(enc)-1] ^= 1
+	if err := os.WriteFile(stored, enc, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipelinetool.VerifyFile(cfg, stored); err == nil {
+		t.Fatal("damaged file verified")
+	}
+	if err := pipelinetool.DecodeFile(cfg, stored, restored); err == nil {
+		t.Fatal("damaged file decoded")
+	}
+	if got, _ := os.ReadFile(restored); !bytes.Equal(got, data) {
+		t.Fatal("failed decode replaced the target")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Fatalf("%d files in the directory, temporary file left behind", len(entries))
+	}
+}
+
+// upper is a layer that upper cases on write and leaves reads alone
+type upper struct{}
+
+func (upper) Writer(w io.Writer) io.Writer { return &upperWriter{w} }
+func (upper) Reader(r io.Reader) io.Reader { return r }
+
+type upperWriter struct{ w io.Writer }
+
+func (u *upperWriter) Write(p []byte) (int, error) { return u.w.Write(bytes.ToUpper(p)) }
+
+func TestRegister(t *testing.T) {
+	pipelinetool.Register("upper", func(map[string]string) (middleware.Middleware, error) { return upper{}, nil })
+	found := false
+	for _, typ := range pipelinetool.Types() {
+		found = found || typ == "upper"
+	}
+	if !found {
+		t.Fatalf("types %v", pipelinetool.Types())
+	}
+	var buf bytes.Buffer
+	cfg := pipelinetool.Config{Layers: []pipelinetool.LayerConfig{{Type: "upper"}}}
+	if _, err := pipelinetool.Encode(cfg, &buf, strings.NewReader("shout")); err != nil || buf.String() != "SHOUT" {
+		t.Fatalf("got %q, %v", buf.String(), err)
+	}
+}
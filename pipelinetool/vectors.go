@@ -0,0 +1,163 @@
+package pipelinetool
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/corpus"
+)
+
+// WriteFS is a filesystem files can be written to, the counterpart of
+// fs.FS for ExportVectors. Names are slash separated paths as in io/fs.
+type WriteFS interface {
+	WriteFile(name string, data []byte) error
+}
+
+// DirFS returns a WriteFS creating files and directories below dir
+func DirFS(dir string) WriteFS {
+	return dirFS(dir)
+}
+
+type dirFS string
+
+func (d dirFS) WriteFile(name string, data []byte) error {
+	p := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0o644)
+}
+
+// Sample is a plaintext input of a vector bundle
+type Sample struct {
+	Name string
+	Data []byte
+}
+
+// DefaultSamples returns the inputs used by ExportVectors without samples:
+// an empty and a one byte input, text, JSON, zero-heavy and random data of
+// a few KiB, and text one byte longer than 64 KiB, which spans two packages
+// of chunked formats like DARE. The same seed gives the same samples.
+func DefaultSamples(seed uint64) []Sample {
+	return []Sample{
+		{Name: "empty", Data: []byte{}},
+		{Name: "one-byte", Data: []byte{'x'}},
+		{Name: "text", Data: corpus.Generate(corpus.Text, 4096, seed)},
+		{Name: "json", Data: corpus.Generate(corpus.JSON, 4096, seed)},
+		{Name: "zero-heavy", Data: corpus.Generate(corpus.ZeroHeavy, 4096, seed)},
+		{Name: "random", Data: corpus.Generate(corpus.Random, 4096, seed)},
+		{Name: "text-64k-plus-1", Data: corpus.Generate(corpus.Text, 64<<10+1, seed)},
+	}
+}
+
+// VectorManifest describes a vector bundle, it is written as manifest.json
+type VectorManifest struct {
+	// Config is the pipeline the outputs were written with, including keys
+	Config Config `json:"config"`
+	// Layers describes the layers as in a compliance report
+	Layers []middleware.Component `json:"layers"`
+	// Samples lists the inputs and outputs
+	Samples []VectorSample `json:"samples"`
+}
+
+// VectorSample describes one input and its encoded output in a bundle
+type VectorSample struct {
+	Name         string   `json:"name"`
+	Input        string   `json:"input"`  // path of the plaintext
+	Output       string   `json:"output"` // path of the encoded stream
+	InputSize    int      `json:"input_size"`
+	OutputSize   int      `json:"output_size"`
+	InputSHA256  string   `json:"input_sha256"`
+	OutputSHA256 string   `json:"output_sha256"`
+	Formats      []string `json:"formats,omitempty"` // headers detected at the start of the output
+}
+
+// ExportVectors writes a bundle for testing implementations in other
+// languages against the pipeline of cfg to fsys: every sample as
+// inputs/<name>.bin, its encoding by the Go implementation as
+// outputs/<name>.bin and manifest.json describing the config, the layers
+// and the samples. DefaultSamples(1) are used if samples is empty.
+//
+// Nonces, salts and per-stream keys are random, so outputs differ between
+// runs; other implementations must decode them to the inputs. Every output
+// is decoded again before it is written, so a bundle only contains streams
+// the Go implementation reads back. The config is written as is, use test
+// keys only.
+func ExportVectors(cfg Config, fsys WriteFS, samples ...Sample) (VectorManifest, error) {
+	chain, err := Build(cfg)
+	if err != nil {
+		return VectorManifest{}, err
+	}
+	if len(samples) == 0 {
+		samples = DefaultSamples(1)
+	}
+	manifest := VectorManifest{
+		Config: cfg,
+		Layers: middleware.ComplianceReport(chain).Components,
+	}
+	seen := make(map[string]bool)
+	for _, s := range samples {
+		if s.Name == "" || !fsValidName(s.Name) || seen[s.Name] {
+			return manifest, fmt.Errorf("pipelinetool: invalid or duplicate sample name %q", s.Name)
+		}
+		seen[s.Name] = true
+		var out bytes.Buffer
+		w := chain.Writer(&out)
+		_, err := w.Write(s.Data)
+		if cerr := w.(io.Closer).Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return manifest, fmt.Errorf("pipelinetool: encode sample %s: %w", s.Name, err)
+		}
+		decoded, err := io.ReadAll(chain.Reader(bytes.NewReader(out.Bytes())))
+		if err != nil {
+			return manifest, fmt.Errorf("pipelinetool: decode sample %s: %w", s.Name, err)
+		}
+		if !bytes.Equal(decoded, s.Data) {
+			return manifest, fmt.Errorf("pipelinetool: sample %s does not decode to its input", s.Name)
+		}
+		v := VectorSample{
+			Name:         s.Name,
+			Input:        path.Join("inputs", s.Name+".bin"),
+			Output:       path.Join("outputs", s.Name+".bin"),
+			InputSize:    len(s.Data),
+			OutputSize:   out.Len(),
+			InputSHA256:  sha256Hex(s.Data),
+			OutputSHA256: sha256Hex(out.Bytes()),
+		}
+		for _, f := range middleware.InspectBytes(out.Bytes()).Formats {
+			v.Formats = append(v.Formats, f.String())
+		}
+		if err := fsys.WriteFile(v.Input, s.Data); err != nil {
+			return manifest, err
+		}
+		if err := fsys.WriteFile(v.Output, out.Bytes()); err != nil {
+			return manifest, err
+		}
+		manifest.Samples = append(manifest.Samples, v)
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, fsys.WriteFile("manifest.json", append(data, '\n'))
+}
+
+// fsValidName reports whether a sample name is a single path element
+func fsValidName(name string) bool {
+	return path.Base(name) == name && name != "." && name != ".."
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
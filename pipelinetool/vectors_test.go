@@ -0,0 +1,174 @@
+package pipelinetool_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/pipelinetool"
+)
+
+// memFS collects written files, failing for names in fail
+type memFS struct {
+	files map[string][]byte
+	fail  map[string]error
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string][]byte), fail: make(map[string]error)}
+}
+
+func (m *memFS) WriteFile(name string, data []byte) error {
+	if err := m.fail[name]; err != nil {
+		return err
+	}
+	m.files[name] = bytes.Clone(data)
+	return nil
+}
+
+func TestDefaultSamples(t *testing.T) {
+	a, b := pipelinetool.DefaultSamples(1), pipelinetool.DefaultSamples(1)
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("samples differ for the same seed")
+	}
+	var names []string
+	for i, s := range a {
+		names = append(names, s.Name)
+		if s.Data == nil {
+			t.Fatalf("%s: nil data", s.Name)
+		}
+		if len(s.Data) > 1 && bytes.Equal(s.Data, pipelinetool.DefaultSamples(2)[i].Data) {
+			t.Fatalf("%s: seed ignored", s.Name)
+		}
+	}
+	if got := strings.Join(names, " "); got != "empty one-byte text json zero-heavy random text-64k-plus-1" {
+		t.Fatalf("samples %s", got)
+	}
+	if n := len(a[len(a)-1].Data); n != 64<<10+1 {
+		t.Fatalf("long sample of %d bytes", n)
+	}
+}
+
+func TestExportVectors(t *testing.T) {
+	cfg := parse(t, configJSON)
+	fsys := newMemFS()
+	manifest, err := pipelinetool.ExportVectors(cfg, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written pipelinetool.VectorManifest
+	if err := json.Unmarshal(fsys.files["manifest.json"], &written); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written, manifest) {
+		t.Fatalf("manifest.json differs from the returned manifest")
+	}
+	if len(manifest.Layers) != 3 || manifest.Config.Layers[2].Options["key"] != testKey {
+		t.Fatalf("layers %+v, config %+v", manifest.Layers, manifest.Config)
+	}
+	if len(manifest.Samples) != len(pipelinetool.DefaultSamples(1)) || len(fsys.files) != 2*len(manifest.Samples)+1 {
+		t.Fatalf("%d samples, %d files", len(manifest.Samples), len(fsys.files))
+	}
+
+	for _, s := range manifest.Samples {
+		in, out := fsys.files[s.Input], fsys.files[s.Output]
+		if s.Input != "inputs/"+s.Name+".bin" || s.Output != "outputs/"+s.Name+".bin" {
+			t.Fatalf("%s: paths %s, %s", s.Name, s.Input, s.Output)
+		}
+		inSum, outSum := sha256.Sum256(in), sha256.Sum256(out)
+		if s.InputSize != len(in) || s.OutputSize != len(out) ||
+			s.InputSHA256 != hex.EncodeToString(inSum[:]) || s.OutputSHA256 != hex.EncodeToString(outSum[:]) {
+			t.Fatalf("%s: sizes or digests do not match the files: %+v", s.Name, s)
+		}
+		if len(s.Formats) == 0 {
+			t.Fatalf("%s: no format detected", s.Name)
+		}
+		var decoded bytes.Buffer
+		if _, err := pipelinetool.Decode(cfg, &decoded, bytes.NewReader(out)); err != nil || !bytes.Equal(decoded.Bytes(), in) {
+			t.Fatalf("%s: output does not decode to the input: %v", s.Name, err)
+		}
+	}
+
+	// outputs are not reproducible, but always decode
+	again := newMemFS()
+	if _, err := pipelinetool.ExportVectors(cfg, again); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(again.files["outputs/text.bin"], fsys.files["outputs/text.bin"]) {
+		t.Fatal("encryption nonce reused between exports")
+	}
+}
+
+func TestExportVectorsErrors(t *testing.T) {
+	cfg := parse(t, configJSON)
+	errDisk := errors.New("disk full")
+	tests := []struct {
+		name    string
+		cfg     pipelinetool.Config
+		samples []pipelinetool.Sample
+		fail    string
+		want    error // nil for any error
+	}{
+		{"empty name", cfg, []pipelinetool.Sample{{Name: ""}}, "", nil},
+		{"path", cfg, []pipelinetool.Sample{{Name: "a/b"}}, "", nil},
+		{"parent", cfg, []pipelinetool.Sample{{Name: ".."}}, "", nil},
+		{"duplicate", cfg, []pipelinetool.Sample{{Name: "a"}, {Name: "a"}}, "", nil},
+		{"unknown layer", pipelinetool.Config{Layers: []pipelinetool.LayerConfig{{Type: "zip"}}}, nil, "", pipelinetool.ErrUnknownLayer},
+		{"not decodable", pipelinetool.Config{Layers: []pipelinetool.LayerConfig{{Type: "vectors-upper"}}},
+			[]pipelinetool.Sample{{Name: "lower", Data: []byte("lower")}}, "", nil},
+		{"output not written", cfg, nil, "outputs/json.bin", errDisk},
+		{"manifest not written", cfg, nil, "manifest.json", errDisk},
+	}
+	pipelinetool.Register("vectors-upper", func(map[string]string) (middleware.Middleware, error) { return upper{}, nil })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := newMemFS()
+			if tt.fail != "" {
+				fsys.fail[tt.fail] = errDisk
+			}
+			_, err := pipelinetool.ExportVectors(tt.cfg, fsys, tt.samples...)
+			if err == nil {
+				t.Fatal("export succeeded")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if _, ok := fsys.files["manifest.json"]; ok {
+				t.Fatal("manifest written for a failed export")
+			}
+		})
+	}
+}
+
+func TestDirFS(t *testing.T) {
+	dir := t.TempDir()
+	samples := []pipelinetool.Sample{{Name: "hello", Data: []byte("hello")}}
+	if _, err := pipelinetool.ExportVectors(parse(t, configJSON), pipelinetool.DirFS(dir), samples...); err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.ReadFile(filepath.Join(dir, "inputs", "hello.bin"))
+	if err != nil || string(in) != "hello" {
+		t.Fatalf("input %q, %v", in, err)
+	}
+	f, err := os.Open(filepath.Join(dir, "outputs", "hello.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var out bytes.Buffer
+	if _, err := pipelinetool.Decode(parse(t, configJSON), &out, f); err != nil || out.String() != "hello" {
+		t.Fatalf("decoded %q, %v", out.String(), err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,46 @@
+package policy
+
+import (
+	"context"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// AuditType is the component type of audit layers in compliance reports
+const AuditType = "audit"
+
+// Audit wraps m so that every operation is reported to sink, satisfying
+// RequireAudit. The layer name passed to sink is "audit".
+func Audit(m middleware.Middleware, sink middleware.StatsSink) middleware.Middleware {
+	return &audit{m: middleware.WithStats(AuditType, m, sink), inner: m}
+}
+
+type audit struct {
+	m     middleware.Middleware
+	inner middleware.Middleware
+}
+
+func (a *audit) Writer(w io.Writer) io.Writer { return a.m.Writer(w) }
+func (a *audit) Reader(r io.Reader) io.Reader { return a.m.Reader(r) }
+
+// WriterContext is like Writer; a trace context set with middleware.WithTrace
+// is passed to sink if it implements middleware.TraceSink
+func (a *audit) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	return middleware.WriterContext(ctx, a.m, w)
+}
+
+// ReaderContext is like Reader and passes the trace context on like WriterContext
+func (a *audit) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return middleware.ReaderContext(ctx, a.m, r)
+}
+
+// Describe reports the audit layer
+func (a *audit) Describe() middleware.Component {
+	return middleware.Component{Type: AuditType}
+}
+
+// Unwrap returns the audited middleware
+func (a *audit) Unwrap() middleware.Middleware {
+	return a.inner
+}
@@ -0,0 +1,213 @@
+// Package policy enforces minimum pipeline requirements per data
+// classification. A policy middleware refuses to create Writers for
+// pipelines that do not meet the requirements of its classification, e.g.
+// confidential data is never spilled without encryption and auditing.
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// ErrPolicyViolation is returned by Writers of non-compliant pipelines
+var ErrPolicyViolation = errors.New("policy: pipeline violates data classification policy")
+
+// Classification is a data classification label
+type Classification int
+
+const (
+	Public Classification = iota
+	Internal
+	Confidential
+	Restricted
+)
+
+// String returns the name of the classification
+func (c Classification) String() string {
+	switch c {
+	case Public:
+		return "public"
+	case Internal:
+		return "internal"
+	case Confidential:
+		return "confidential"
+	case Restricted:
+		return "restricted"
+	default:
+		return fmt.Sprintf("Classification(%d)", int(c))
+	}
+}
+
+// ParseClassification returns the classification for a name as returned by String
+func ParseClassification(name string) (Classification, error) {
+	for c := Public; c <= Restricted; c++ {
+		if strings.EqualFold(name, c.String()) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("policy: unknown classification %q", name)
+}
+
+// Requirement checks the compliance report of a pipeline
+type Requirement func(r middleware.Report) error
+
+// RequireType requires a layer of the given component type, e.g. "encryption"
+func RequireType(typ string) Requirement {
+	return func(r middleware.Report) error {
+		for _, c := range r.Components {
+			if c.Type == typ {
+				return nil
+			}
+		}
+		return fmt.Errorf("no %s layer", typ)
+	}
+}
+
+// RequireEncryption requires an encryption layer
+func RequireEncryption() Requirement {
+	return RequireType(string(middleware.RoleEncryption))
+}
+
+// RequireAudit requires an audit layer, see Audit
+func RequireAudit() Requirement {
+	return RequireType(AuditType)
+}
+
+// RequireMinKeyBits requires every encryption layer to use keys of at least bits
+func RequireMinKeyBits(bits int) Requirement {
+	return func(r middleware.Report) error {
+		for _, c := range r.Components {
+			if c.Type == string(middleware.RoleEncryption) && c.KeyBits < bits {
+				return fmt.Errorf("layer %s uses %d bit keys, %d required", c.Layer, c.KeyBits, bits)
+			}
+		}
+		return nil
+	}
+}
+
+// DefaultRequirements returns the requirements of a classification:
+// none for public and internal data, encryption and auditing for
+// confidential data, and additionally 256 bit keys for restricted data
+func DefaultRequirements(c Classification) []Requirement {
+	switch {
+	case c >= Restricted:
+		return []Requirement{RequireEncryption(), RequireMinKeyBits(256), RequireAudit()}
+	case c >= Confidential:
+		return []Requirement{RequireEncryption(), RequireAudit()}
+	default:
+		return nil
+	}
+}
+
+// Middleware enforces the requirements of a classification on a pipeline
+type Middleware struct {
+	label        Classification
+	m            middleware.Middleware
+	requirements []Requirement
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware        = (*Middleware)(nil)
+	_ middleware.Describer         = (*Middleware)(nil)
+	_ middleware.Wrapper           = (*Middleware)(nil)
+	_ middleware.ContextMiddleware = (*Middleware)(nil)
+)
+
+// Option configures the policy middleware
+type Option func(*Middleware)
+
+// WithRequirements replaces the default requirements of the classification
+func WithRequirements(reqs ...Requirement) Option {
+	return func(p *Middleware) {
+		p.requirements = reqs
+	}
+}
+
+// New wraps the pipeline m with the policy of a classification
+func New(label Classification, m middleware.Middleware, opts ...Option) *Middleware {
+	p := &Middleware{
+		label:        label,
+		m:            m,
+		requirements: DefaultRequirements(label),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Classification returns the classification label
+func (p *Middleware) Classification() Classification {
+	return p.label
+}
+
+// Check returns an ErrPolicyViolation if the pipeline, with its layers as
+// currently enabled, does not meet the requirements
+func (p *Middleware) Check() error {
+	report := middleware.ComplianceReport(p.m)
+	var problems []string
+	for _, req := range p.requirements {
+		if err := req(report); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w (%s): %s", ErrPolicyViolation, p.label, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Writer checks the pipeline and wraps w with it. Violations are returned
+// from every Write and Close; no data reaches w.
+func (p *Middleware) Writer(w io.Writer) io.Writer {
+	if err := p.Check(); err != nil {
+		return &errWriter{err: err}
+	}
+	return p.m.Writer(w)
+}
+
+// WriterContext is like Writer, but passes ctx to the pipeline
+func (p *Middleware) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	if err := p.Check(); err != nil {
+		return &errWriter{err: err}
+	}
+	return middleware.WriterContext(ctx, p.m, w)
+}
+
+// ReaderContext is like Reader, but passes ctx to the pipeline
+func (p *Middleware) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	return middleware.ReaderContext(ctx, p.m, r)
+}
+
+// Reader wraps r with the pipeline. Reading is not restricted, so data
+// written under an older policy stays readable.
+func (p *Middleware) Reader(r io.Reader) io.Reader {
+	return p.m.Reader(r)
+}
+
+// Describe reports the classification
+func (p *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:       "policy",
+		Properties: map[string]string{"classification": p.label.String()},
+	}
+}
+
+// Unwrap returns the wrapped pipeline
+func (p *Middleware) Unwrap() middleware.Middleware {
+	return p.m
+}
+
+// errWriter reports a fixed error on every call
+type errWriter struct {
+	err error
+}
+
+func (e *errWriter) Write([]byte) (int, error) { return 0, e.err }
+func (e *errWriter) Close() error              { return e.err }
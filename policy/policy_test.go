@@ -0,0 +1,174 @@
+package policy_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+	"schneider.vip/hybridbuffer/middleware/policy"
+	"schneider.vip/hybridbuffer/middleware/rle"
+)
+
+// recorder is a StatsSink remembering the operations per layer
+type recorder struct {
+	mu  sync.Mutex
+	ops map[string][]middleware.Op
+}
+
+func (r *recorder) Observe(layer string, op middleware.Op, in, out int64, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ops == nil {
+		r.ops = make(map[string][]middleware.Op)
+	}
+	r.ops[layer] = append(r.ops[layer], op)
+}
+
+func newEncryption(t *testing.T) middleware.Middleware {
+	t.Helper()
+	key := make([]byte, encryption.KeySize)
+	rand.Read(key)
+	return encryption.New(encryption.WithKey(key))
+}
+
+func TestDefaultRequirements(t *testing.T) {
+	enc := newEncryption(t)
+	pipelines := map[string]middleware.Middleware{
+		"plain":           rle.New(),
+		"encrypted":       middleware.NewChain(rle.New(), enc),
+		"audited":         policy.Audit(rle.New(), &recorder{}),
+		"encrypted+audit": policy.Audit(middleware.NewChain(rle.New(), enc), &recorder{}),
+	}
+	tests := []struct {
+		label     policy.Classification
+		compliant []string
+	}{
+		{policy.Public, []string{"plain", "encrypted", "audited", "encrypted+audit"}},
+		{policy.Internal, []string{"plain", "encrypted", "audited", "encrypted+audit"}},
+		{policy.Confidential, []string{"encrypted+audit"}},
+		{policy.Restricted, []string{"encrypted+audit"}},
+	}
+	for _, tt := range tests {
+		for name, m := range pipelines {
+			want := false
+			for _, c := range tt.compliant {
+				want = want || c == name
+			}
+			err := policy.New(tt.label, m).Check()
+			if (err == nil) != want {
+				t.Errorf("%s pipeline for %s data: got %v", name, tt.label, err)
+			}
+			if err != nil && !errors.Is(err, policy.ErrPolicyViolation) {
+				t.Errorf("%s pipeline for %s data: got %v, want ErrPolicyViolation", name, tt.label, err)
+			}
+		}
+	}
+}
+
+func TestCustomRequirements(t *testing.T) {
+	enc := newEncryption(t)
+	p := policy.New(policy.Public, enc, policy.WithRequirements(policy.RequireMinKeyBits(512), policy.RequireType("checksum")))
+	err := p.Check()
+	if !errors.Is(err, policy.ErrPolicyViolation) {
+		t.Fatalf("got %v, want ErrPolicyViolation", err)
+	}
+	// all problems are reported at once
+	for _, want := range []string{"256 bit keys, 512 required", "no checksum layer", "(public)"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q does not mention %q", err, want)
+		}
+	}
+	if err := policy.New(policy.Restricted, rle.New(), policy.WithRequirements()).Check(); err != nil {
+		t.Fatalf("no requirements: %v", err)
+	}
+}
+
+func TestViolationBlocksWriter(t *testing.T) {
+	p := policy.New(policy.Confidential, rle.New())
+	var sink bytes.Buffer
+	w := p.Writer(&sink)
+	if _, err := w.Write([]byte("secret")); !errors.Is(err, policy.ErrPolicyViolation) {
+		t.Fatalf("write: got %v, want ErrPolicyViolation", err)
+	}
+	if err := w.(io.Closer).Close(); !errors.Is(err, policy.ErrPolicyViolation) {
+		t.Fatalf("close: got %v, want ErrPolicyViolation", err)
+	}
+	if sink.Len() != 0 {
+		t.Fatalf("%d bytes reached the sink", sink.Len())
+	}
+
+	// data written before the policy was tightened stays readable
+	var old bytes.Buffer
+	ow := rle.New().Writer(&old)
+	ow.Write([]byte("legacy"))
+	ow.(io.Closer).Close()
+	got, err := io.ReadAll(p.Reader(&old))
+	if err != nil || string(got) != "legacy" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestDisabledLayerViolates(t *testing.T) {
+	c, err := middleware.NewPipeline().Add("rle", rle.New()).Add("encryption", newEncryption(t)).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := policy.New(policy.Internal, c, policy.WithRequirements(policy.RequireEncryption()))
+	if err := p.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetEnabled("encryption", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Check(); !errors.Is(err, policy.ErrPolicyViolation) {
+		t.Fatalf("got %v, want ErrPolicyViolation", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	rec := &recorder{}
+	p := policy.New(policy.Restricted, policy.Audit(middleware.NewChain(rle.New(), newEncryption(t)), rec))
+	var buf bytes.Buffer
+	w := p.Writer(&buf)
+	if _, err := w.Write([]byte("audited")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(p.Reader(&buf))
+	if err != nil || string(got) != "audited" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	seen := map[middleware.Op]bool{}
+	for _, op := range rec.ops[policy.AuditType] {
+		seen[op] = true
+	}
+	for _, op := range []middleware.Op{middleware.OpWrite, middleware.OpClose, middleware.OpRead} {
+		if !seen[op] {
+			t.Errorf("%v not audited, got %v", op, rec.ops)
+		}
+	}
+}
+
+func TestParseClassification(t *testing.T) {
+	for c := policy.Public; c <= policy.Restricted; c++ {
+		got, err := policy.ParseClassification(c.String())
+		if err != nil || got != c {
+			t.Fatalf("%s: got %v, %v", c, got, err)
+		}
+	}
+	if got, err := policy.ParseClassification("CONFIDENTIAL"); err != nil || got != policy.Confidential {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	if _, err := policy.ParseClassification("top secret"); err == nil {
+		t.Fatal("unknown classification accepted")
+	}
+}
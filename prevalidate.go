@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrPrevalidation is returned by Chain.Prevalidate, together with the
+// error of the layer, for corrupt streams
+var ErrPrevalidation = errors.New("middleware: prevalidation failed")
+
+// Prevalidator is implemented by layers that can check a stored stream
+// without decoding it, e.g. by verifying a checksum trailer or the offsets
+// of an appended index. Prevalidate checks the size bytes of r, a stream
+// written by the layer, and returns an error if it is corrupt. Streams the
+// layer has nothing to check in, e.g. without index, pass.
+type Prevalidator interface {
+	Prevalidate(r io.ReaderAt, size int64) error
+}
+
+// Ensure Chain implements Prevalidator
+var _ Prevalidator = (*Chain)(nil)
+
+// Prevalidate checks the size bytes of r written by m if m, or the layer
+// it wraps, implements Prevalidator. Other layers pass.
+func Prevalidate(m Middleware, r io.ReaderAt, size int64) error {
+	switch l := m.(type) {
+	case Prevalidator:
+		return l.Prevalidate(r, size)
+	case Wrapper:
+		return Prevalidate(l.Unwrap(), r, size)
+	}
+	return nil
+}
+
+// Prevalidate checks the stream with the outermost layer it was written
+// with, the only one whose output is stored as is; inner layers cannot be
+// reached without decoding.
+func (c *Chain) Prevalidate(r io.ReaderAt, size int64) error {
+	var enabled []bool
+	if c.toggleable() {
+		src := io.NewSectionReader(r, 0, size)
+		var err error
+		if enabled, _, err = c.streamLayers(src); err != nil {
+			return fmt.Errorf("%w: %w", ErrPrevalidation, err)
+		}
+		if enabled != nil {
+			offset, _ := src.Seek(0, io.SeekCurrent)
+			r, size = io.NewSectionReader(r, offset, size-offset), size-offset
+		}
+	}
+	for i := len(c.layers) - 1; i >= 0; i-- {
+		if enabled != nil && !enabled[i] {
+			continue
+		}
+		if err := Prevalidate(c.layers[i], r, size); err != nil {
+			return fmt.Errorf("%w: layer %s: %w", ErrPrevalidation, c.layerName(i), err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// WithPrevalidation makes Reader and ReaderContext check seekable sources,
+// which implement io.ReaderAt and io.Seeker like *os.File, with Prevalidate
+// before any data is decoded, and returns the chain. A corrupt stream is
+// then rejected by the first Read instead of failing after part of it was
+// returned, e.g. halfway through a download. The check reads the stream
+// from the current offset to the end once; other sources are not checked.
+func (c *Chain) WithPrevalidation() *Chain {
+	c.prevalidate = true
+	return c
+}
+
+// prevalidateSource checks src if it is seekable
+func (c *Chain) prevalidateSource(src io.Reader) error {
+	s, ok := src.(interface {
+		io.ReaderAt
+		io.Seeker
+	})
+	if !ok {
+		return nil
+	}
+	start, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := s.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	return c.Prevalidate(io.NewSectionReader(s, start, end-start), end-start)
+}
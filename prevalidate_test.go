@@ -0,0 +1,93 @@
+package middleware_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/checksum"
+	"schneider.vip/hybridbuffer/middleware/compression"
+)
+
+func encode(t *testing.T, m middleware.Middleware, data []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+// gzipMember returns an empty gzip member with one extra subfield, like
+// the members of an appended index
+func gzipMember(id string, data []byte) []byte {
+	b := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 255}
+	b = binary.LittleEndian.AppendUint16(b, uint16(4+len(data)))
+	b = append(b, id...)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(data)))
+	b = append(b, data...)
+	return append(b, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func TestPrevalidation(t *testing.T) {
+	data := bytes.Repeat([]byte("prevalidated "), 1000)
+	chain := middleware.NewChain(compression.New(), checksum.New()).WithPrevalidation()
+	enc := encode(t, chain, data)
+
+	got, err := io.ReadAll(chain.Reader(bytes.NewReader(enc)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("round trip mismatch: %v", err)
+	}
+
+	corrupt := bytes.Clone(enc)
+	corrupt[len(corrupt)/2] ^= 1
+	n, err := chain.Reader(bytes.NewReader(corrupt)).Read(make([]byte, 64))
+	if n != 0 || !errors.Is(err, middleware.ErrPrevalidation) {
+		t.Fatalf("got %d, %v; want ErrPrevalidation before any data", n, err)
+	}
+}
+
+func TestPrevalidationHostileIndex(t *testing.T) {
+	data := bytes.Repeat([]byte("indexed "), 1000)
+	m := compression.New(compression.WithIndexInterval(1024), compression.WithAppendedIndex())
+	chain := middleware.NewChain(m).WithPrevalidation()
+	plain := encode(t, compression.New(), data)
+
+	// index members located at the end of the plain stream
+	entry := binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, 0), 5)
+	bogus := append(bytes.Clone(plain), gzipMember("HI", entry)...)
+	bogus = append(bogus, gzipMember("HX", binary.BigEndian.AppendUint64(nil, uint64(len(plain))))...)
+
+	tests := []struct {
+		name    string
+		stream  []byte
+		wantErr bool
+	}{
+		{"negative locator offset", append(bytes.Clone(plain), gzipMember("HX", binary.BigEndian.AppendUint64(nil, 1<<63))...), false},
+		{"locator offset beyond stream", append(bytes.Clone(plain), gzipMember("HX", binary.BigEndian.AppendUint64(nil, 1<<40))...), false},
+		{"entry not at a member", bogus, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(chain.Reader(bytes.NewReader(tt.stream)))
+			if tt.wantErr {
+				if !errors.Is(err, middleware.ErrPrevalidation) {
+					t.Fatalf("got %v, want ErrPrevalidation", err)
+				}
+				return
+			}
+			// the locator is an empty gzip member, the stream reads as
+			// if it had no index
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("round trip mismatch: %v", err)
+			}
+		})
+	}
+}
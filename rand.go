@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+)
+
+var (
+	randMu     sync.RWMutex
+	randSource io.Reader = rand.Reader
+)
+
+// SetRand replaces the source of randomness used by the built-in middlewares
+// for keys, nonces and salts. This is useful on platforms such as GOOS=js or
+// wasip1 where the host provides its own entropy source.
+// Passing nil restores crypto/rand.Reader.
+func SetRand(r io.Reader) {
+	if r == nil {
+		r = rand.Reader
+	}
+	randMu.Lock()
+	randSource = r
+	randMu.Unlock()
+}
+
+// Rand returns the current source of randomness
+func Rand() io.Reader {
+	randMu.RLock()
+	defer randMu.RUnlock()
+	return randSource
+}
@@ -0,0 +1,145 @@
+// Package repairread reads a stream from several replicas of the same
+// encoded data and transparently switches to another replica when one fails
+// mid-stream, e.g. with an integrity error of the encryption layer or an IO
+// error of the storage, so a single corrupt copy does not fail a restore.
+//
+// Replicas must be byte-identical copies, so every replica decodes to the
+// same plaintext. On a switch the next replica is decoded from the start and
+// the plaintext already returned is skipped; block-structured layers such as
+// encryption and snapshot fail at the damaged block, so a replica that is
+// corrupt further into the stream still serves the part before the damage.
+package repairread
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// ErrAllReplicasFailed is returned when no replica can serve the next byte
+var ErrAllReplicasFailed = errors.New("repairread: all replicas failed")
+
+// Source opens a replica from its beginning. It is called again for every
+// switch to the replica.
+type Source func() (io.Reader, error)
+
+// Seeker returns a Source rewinding rs to its start
+func Seeker(rs io.ReadSeeker) Source {
+	return func() (io.Reader, error) {
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return rs, nil
+	}
+}
+
+// Option configures the reader
+type Option func(*reader)
+
+// WithSwitchCallback sets a function called when the reader gives up on a
+// replica at plaintext offset, e.g. to schedule a repair of that copy
+func WithSwitchCallback(fn func(replica int, offset int64, err error)) Option {
+	return func(r *reader) {
+		r.onSwitch = fn
+	}
+}
+
+// NewReader decodes the replicas with m, starting with the first one.
+// m must decode every replica to the same plaintext.
+func NewReader(m middleware.Middleware, replicas []Source, opts ...Option) io.Reader {
+	r := &reader{
+		m:        m,
+		replicas: replicas,
+		failedAt: make([]int64, len(replicas)),
+		errs:     make([]error, len(replicas)),
+		cur:      -1,
+		state:    middleware.ReaderState{Layer: "repairread"},
+	}
+	for i := range r.failedAt {
+		r.failedAt[i] = -1
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+type reader struct {
+	m        middleware.Middleware
+	replicas []Source
+	onSwitch func(replica int, offset int64, err error)
+
+	failedAt []int64 // plaintext offset each replica failed at, -1 if never
+	errs     []error // last error of each replica
+	cur      int     // index of the active replica, -1 if none
+	r        io.Reader
+	pos      int64 // plaintext bytes returned so far
+	state    middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	for {
+		if r.r == nil {
+			if err := r.open(); err != nil {
+				return r.state.Track(0, err)
+			}
+		}
+		n, err := r.r.Read(p)
+		r.pos += int64(n)
+		if err == nil || err == io.EOF {
+			return r.state.Track(n, err)
+		}
+		r.fail(r.cur, r.pos, err)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// open switches to the first usable replica and skips it to the current offset
+func (r *reader) open() error {
+	for i := range r.replicas {
+		if !r.usable(i) {
+			continue
+		}
+		src, err := r.replicas[i]()
+		if err != nil {
+			r.fail(i, r.pos, fmt.Errorf("repairread: open replica %d: %w", i, err))
+			continue
+		}
+		dec := r.m.Reader(src)
+		skipped, err := io.CopyN(io.Discard, dec, r.pos)
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("repairread: replica %d ends at %d: %w", i, skipped, io.ErrUnexpectedEOF)
+			}
+			r.fail(i, skipped, err)
+			continue
+		}
+		r.cur, r.r = i, dec
+		return nil
+	}
+	return fmt.Errorf("%w: %w", ErrAllReplicasFailed, errors.Join(r.errs...))
+}
+
+// usable reports whether replica i may serve the byte at the current offset
+func (r *reader) usable(i int) bool {
+	return r.failedAt[i] < 0 || r.failedAt[i] > r.pos
+}
+
+// fail records that replica i failed at plaintext offset
+func (r *reader) fail(i int, offset int64, err error) {
+	r.failedAt[i] = offset
+	r.errs[i] = err
+	if i == r.cur {
+		r.cur, r.r = -1, nil
+	}
+	if r.onSwitch != nil {
+		r.onSwitch(i, offset, err)
+	}
+}
@@ -0,0 +1,141 @@
+package repairread_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/encryption"
+	"schneider.vip/hybridbuffer/middleware/repairread"
+)
+
+// packageSize is the plaintext size of an encryption package
+const packageSize = 64 << 10
+
+// replicaSet encodes five packages of random plaintext
+type replicaSet struct {
+	m     *encryption.Middleware
+	plain []byte
+	enc   []byte
+}
+
+func newReplicaSet(t *testing.T) *replicaSet {
+	t.Helper()
+	key := make([]byte, encryption.KeySize)
+	rand.Read(key)
+	s := &replicaSet{m: encryption.New(encryption.WithKey(key)), plain: make([]byte, 5*packageSize)}
+	rand.Read(s.plain)
+	var buf bytes.Buffer
+	w := s.m.Writer(&buf)
+	w.Write(s.plain)
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	s.enc = buf.Bytes()
+	return s
+}
+
+// damaged returns a replica with a flipped byte in package i
+func (s *replicaSet) damaged(i int) repairread.Source {
+	b := bytes.Clone(s.enc)
+	b[len(b)*i/5+1000] ^= 1
+	return repairread.Seeker(bytes.NewReader(b))
+}
+
+func (s *replicaSet) intact() repairread.Source {
+	return repairread.Seeker(bytes.NewReader(s.enc))
+}
+
+type switchEvent struct {
+	replica int
+	offset  int64
+}
+
+func TestSwitchesPastDamage(t *testing.T) {
+	s := newReplicaSet(t)
+	var events []switchEvent
+	r := repairread.NewReader(s.m, []repairread.Source{s.damaged(1), s.damaged(3), s.intact()},
+		repairread.WithSwitchCallback(func(replica int, offset int64, err error) {
+			events = append(events, switchEvent{replica, offset})
+		}))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, s.plain) {
+		t.Fatal("plaintext differs")
+	}
+	want := []switchEvent{{0, 1 * packageSize}, {1, 3 * packageSize}}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("switches %v, want %v", events, want)
+	}
+}
+
+func TestAllReplicasDamaged(t *testing.T) {
+	s := newReplicaSet(t)
+	r := repairread.NewReader(s.m, []repairread.Source{s.damaged(1), s.damaged(3)})
+	got, err := io.ReadAll(r)
+	if !errors.Is(err, repairread.ErrAllReplicasFailed) {
+		t.Fatalf("got %v, want ErrAllReplicasFailed", err)
+	}
+	// everything before the later damage was served
+	if !bytes.Equal(got, s.plain[:3*packageSize]) {
+		t.Fatalf("got %d bytes, want %d", len(got), 3*packageSize)
+	}
+	if _, again := r.Read(make([]byte, 1)); again != err {
+		t.Fatalf("read after failure: got %v, want %v", again, err)
+	}
+}
+
+func TestUnavailableReplicas(t *testing.T) {
+	s := newReplicaSet(t)
+	errOffline := errors.New("replica offline")
+	offline := func() (io.Reader, error) { return nil, errOffline }
+	truncated := repairread.Seeker(bytes.NewReader(s.enc[:len(s.enc)/2]))
+
+	var events []switchEvent
+	var errs []error
+	r := repairread.NewReader(s.m, []repairread.Source{offline, truncated, s.intact()},
+		repairread.WithSwitchCallback(func(replica int, offset int64, err error) {
+			events = append(events, switchEvent{replica, offset})
+			errs = append(errs, err)
+		}))
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, s.plain) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+	if len(events) != 2 || events[0] != (switchEvent{0, 0}) || events[1].replica != 1 {
+		t.Fatalf("switches %v", events)
+	}
+	if !errors.Is(errs[0], errOffline) {
+		t.Fatalf("got %v, want errOffline", errs[0])
+	}
+
+	// no replica at all
+	if _, err := io.ReadAll(repairread.NewReader(s.m, nil)); !errors.Is(err, repairread.ErrAllReplicasFailed) {
+		t.Fatalf("got %v, want ErrAllReplicasFailed", err)
+	}
+}
+
+func TestReplicaEndsEarly(t *testing.T) {
+	// a replica that is shorter than the position reached on another one
+	// cannot serve it, the skip reports the unexpected end
+	s := newReplicaSet(t)
+	var buf bytes.Buffer
+	w := s.m.Writer(&buf)
+	w.Write(s.plain[:packageSize])
+	w.(io.Closer).Close()
+
+	var errs []error
+	r := repairread.NewReader(s.m, []repairread.Source{s.damaged(2), repairread.Seeker(bytes.NewReader(buf.Bytes()))},
+		repairread.WithSwitchCallback(func(_ int, _ int64, err error) { errs = append(errs, err) }))
+	if _, err := io.ReadAll(r); !errors.Is(err, repairread.ErrAllReplicasFailed) {
+		t.Fatalf("got %v, want ErrAllReplicasFailed", err)
+	}
+	if len(errs) != 2 || !errors.Is(errs[1], io.ErrUnexpectedEOF) {
+		t.Fatalf("errors %v", errs)
+	}
+}
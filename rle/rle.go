@@ -0,0 +1,454 @@
+// Package rle provides a lightweight run-length / zero-suppression middleware
+// for sparse buffers such as bitmap indexes or zero-padded records. It is cheap
+// enough to run standalone when the CPU budget is tiny, or as a pre-pass in
+// front of a general purpose compressor.
+package rle
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// Token kinds, stored in the low two bits of every token header
+const (
+	kindLiteral = 0 // header is followed by n literal bytes
+	kindZeros   = 1 // n zero bytes, no payload
+	kindRun     = 2 // header is followed by the repeated byte
+)
+
+const (
+	// FormatVersion is the stream format version written by this package.
+	// Every stream starts with a single version byte. Version 2 streams end
+	// with a zero token header, so readers detect truncation and stop
+	// before trailing data; version 1 streams end with the source.
+	FormatVersion = 2
+
+	// DefaultMinRun is the shortest run that is collapsed into a run token
+	DefaultMinRun = 8
+
+	// maxLiteral bounds the size of a single literal token
+	maxLiteral = 64 * 1024
+)
+
+// ErrCorrupt is returned by the Reader when the encoded stream is malformed
+var ErrCorrupt = errors.New("rle: corrupt stream")
+
+// Middleware implements run-length encoding of byte runs
+type Middleware struct {
+	minRun    int
+	zerosOnly bool
+	policy    middleware.VersionPolicy
+	logf      middleware.Logf
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware     = (*Middleware)(nil)
+	_ middleware.Versioned      = (*Middleware)(nil)
+	_ middleware.HeaderSplitter = (*Middleware)(nil)
+	_ middleware.ModeSetter     = (*Middleware)(nil)
+	_ middleware.Roled          = (*Middleware)(nil)
+	_ middleware.Describer      = (*Middleware)(nil)
+)
+
+// Option configures the RLE middleware
+type Option func(*Middleware)
+
+// WithMinRun sets the shortest run that is encoded as a run token.
+// Shorter runs are emitted as literals. Values below 2 are ignored.
+func WithMinRun(n int) Option {
+	return func(m *Middleware) {
+		if n >= 2 {
+			m.minRun = n
+		}
+	}
+}
+
+// WithZerosOnly restricts run encoding to runs of zero bytes (zero suppression)
+func WithZerosOnly() Option {
+	return func(m *Middleware) {
+		m.zerosOnly = true
+	}
+}
+
+// WithVersionPolicy sets how the Reader treats streams with an unknown format version
+func WithVersionPolicy(p middleware.VersionPolicy) Option {
+	return func(m *Middleware) {
+		m.policy = p
+	}
+}
+
+// New creates a new RLE middleware
+func New(opts ...Option) *Middleware {
+	m := &Middleware{
+		minRun: DefaultMinRun,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// FormatVersion returns the format version written by the Writer
+func (m *Middleware) FormatVersion() uint8 {
+	return FormatVersion
+}
+
+// MaxSupportedVersion returns the highest format version the Reader understands
+func (m *Middleware) MaxSupportedVersion() uint8 {
+	return FormatVersion
+}
+
+// Role returns middleware.RoleCompression
+func (m *Middleware) Role() middleware.Role {
+	return middleware.RoleCompression
+}
+
+// Describe reports the run-length settings
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:      string(middleware.RoleCompression),
+		Algorithm: "rle",
+		Properties: map[string]string{
+			"min_run":    strconv.Itoa(m.minRun),
+			"zeros_only": strconv.FormatBool(m.zerosOnly),
+		},
+	}
+}
+
+// ForMode returns a copy of the middleware for a chain read mode. Strict
+// rejects unknown format versions, lenient decodes them on a best effort basis.
+func (m *Middleware) ForMode(mode middleware.ReadMode, logf middleware.Logf) middleware.Middleware {
+	c := *m
+	switch mode {
+	case middleware.StrictMode:
+		c.policy = middleware.RejectUnknown
+	case middleware.LenientMode:
+		c.policy = middleware.BestEffort
+		c.logf = logf
+	}
+	return &c
+}
+
+// Writer wraps an io.Writer with run-length encoding.
+// The returned writer must be closed to flush the pending run.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return m.newWriter(w)
+}
+
+func (m *Middleware) newWriter(w io.Writer) *writer {
+	return &writer{
+		w:         w,
+		minRun:    m.minRun,
+		zerosOnly: m.zerosOnly,
+		lit:       make([]byte, 0, maxLiteral),
+		state:     middleware.WriterState{Layer: "rle"},
+	}
+}
+
+// SplitWriter wraps an io.Writer like Writer, returning the version byte
+// header instead of writing it to w
+func (m *Middleware) SplitWriter(w io.Writer) (io.Writer, []byte, error) {
+	rw := m.newWriter(w)
+	rw.started = true
+	return rw, []byte{FormatVersion}, nil
+}
+
+// Reader wraps an io.Reader with run-length decoding
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return middleware.HardenLayerReader("rle", m.newReader(r))
+}
+
+func (m *Middleware) newReader(r io.Reader) *reader {
+	rr := &reader{policy: m.policy, logf: m.logf}
+	if br, ok := r.(io.ByteReader); ok {
+		rr.r = br
+	} else {
+		rr.buf = bufio.NewReader(r)
+		rr.r = rr.buf
+	}
+	return rr
+}
+
+// JoinReader wraps an io.Reader for a stream written by SplitWriter
+func (m *Middleware) JoinReader(r io.Reader, header []byte) (io.Reader, error) {
+	if len(header) != 1 {
+		return nil, ErrCorrupt
+	}
+	v, err := middleware.CheckVersion("rle", header[0], FormatVersion, m.policy)
+	if err != nil {
+		return nil, err
+	}
+	rr := m.newReader(r)
+	rr.started, rr.version = true, v
+	return middleware.HardenLayerReader("rle", rr), nil
+}
+
+type writer struct {
+	w         io.Writer
+	minRun    int
+	zerosOnly bool
+
+	lit     []byte // pending literal bytes
+	runByte byte   // byte of the current run
+	runLen  uint64 // length of the current run, 0 if none
+	hdr     [binary.MaxVarintLen64 + 1]byte
+	started bool
+	state   middleware.WriterState
+}
+
+// start writes the version byte ahead of the first token
+func (w *writer) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	_, err := w.w.Write([]byte{FormatVersion})
+	return w.state.Fail(err)
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(p); {
+		b := p[i]
+		if w.runLen > 0 && b == w.runByte {
+			// Extend the current run as far as possible in one go
+			j := i + 1
+			for j < len(p) && p[j] == b {
+				j++
+			}
+			w.runLen += uint64(j - i)
+			i = j
+			continue
+		}
+		if err := w.endRun(); err != nil {
+			return i, err
+		}
+		w.runByte = b
+		w.runLen = 1
+		i++
+	}
+	return len(p), nil
+}
+
+// Close flushes pending data. It does not close the underlying writer.
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if err := w.start(); err != nil {
+			return err
+		}
+		if err := w.endRun(); err != nil {
+			return err
+		}
+		if err := w.flushLiteral(); err != nil {
+			return err
+		}
+		_, err := w.w.Write([]byte{0})
+		return w.state.Fail(err)
+	})
+}
+
+// endRun terminates the current run, either as run token or as literal bytes
+func (w *writer) endRun() error {
+	n := w.runLen
+	if n == 0 {
+		return nil
+	}
+	w.runLen = 0
+	if n >= uint64(w.minRun) && (!w.zerosOnly || w.runByte == 0) {
+		if err := w.flushLiteral(); err != nil {
+			return err
+		}
+		if w.runByte == 0 {
+			return w.emit(n<<2|kindZeros, nil)
+		}
+		return w.emit(n<<2|kindRun, []byte{w.runByte})
+	}
+	for ; n > 0; n-- {
+		w.lit = append(w.lit, w.runByte)
+		if len(w.lit) == maxLiteral {
+			if err := w.flushLiteral(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *writer) flushLiteral() error {
+	if len(w.lit) == 0 {
+		return nil
+	}
+	err := w.emit(uint64(len(w.lit))<<2|kindLiteral, w.lit)
+	w.lit = w.lit[:0]
+	return err
+}
+
+func (w *writer) emit(header uint64, payload []byte) error {
+	n := binary.PutUvarint(w.hdr[:], header)
+	if len(payload) == 1 {
+		w.hdr[n] = payload[0]
+		n++
+		payload = nil
+	}
+	if _, err := w.w.Write(w.hdr[:n]); err != nil {
+		return w.state.Fail(err)
+	}
+	if len(payload) > 0 {
+		if _, err := w.w.Write(payload); err != nil {
+			return w.state.Fail(err)
+		}
+	}
+	return nil
+}
+
+type reader struct {
+	r       io.ByteReader
+	buf     *bufio.Reader // buffer of r, if the source is no io.ByteReader
+	policy  middleware.VersionPolicy
+	logf    middleware.Logf
+	started bool
+	version uint8 // version the stream is decoded as
+
+	kind    uint64
+	remain  uint64 // bytes left in the current token
+	runByte byte
+	err     error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !r.started {
+		if err := r.readVersion(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(p) {
+		if r.remain == 0 {
+			if err := r.next(n > 0); err != nil {
+				if n > 0 && err == errNoProgress {
+					return n, nil
+				}
+				r.err = err
+				return n, err
+			}
+			continue
+		}
+		want := uint64(len(p) - n)
+		if want > r.remain {
+			want = r.remain
+		}
+		switch r.kind {
+		case kindLiteral:
+			for i := uint64(0); i < want; i++ {
+				b, err := r.r.ReadByte()
+				if err != nil {
+					r.err = unexpected(err)
+					return n, r.err
+				}
+				p[n] = b
+				n++
+			}
+		default:
+			for i := uint64(0); i < want; i++ {
+				p[n] = r.runByte
+				n++
+			}
+		}
+		r.remain -= want
+	}
+	return n, nil
+}
+
+// Buffered returns the number of bytes read ahead from the source, which
+// after the end token are trailing data
+func (r *reader) Buffered() int {
+	if r.buf == nil {
+		return 0
+	}
+	return r.buf.Buffered()
+}
+
+func (r *reader) readVersion() error {
+	r.started = true
+	v, err := r.r.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	if r.version, err = middleware.CheckVersion("rle", v, FormatVersion, r.policy); err != nil {
+		return err
+	}
+	if v > FormatVersion && r.logf != nil {
+		r.logf("rle: decoding version %d stream as version %d", v, FormatVersion)
+	}
+	return nil
+}
+
+// errNoProgress signals that the next token header is not available yet,
+// which only matters if data was already returned to the caller
+var errNoProgress = errors.New("rle: no progress")
+
+func (r *reader) next(haveData bool) error {
+	header, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		if err == io.EOF {
+			if haveData {
+				return errNoProgress
+			}
+			if r.version >= 2 {
+				return io.ErrUnexpectedEOF
+			}
+			return io.EOF
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		return ErrCorrupt
+	}
+	if header == 0 && r.version >= 2 {
+		return io.EOF
+	}
+	r.kind = header & 3
+	r.remain = header >> 2
+	if r.remain == 0 {
+		return ErrCorrupt
+	}
+	switch r.kind {
+	case kindLiteral:
+		if r.remain > maxLiteral {
+			return ErrCorrupt
+		}
+	case kindZeros:
+		r.runByte = 0
+	case kindRun:
+		b, err := r.r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		r.runByte = b
+	default:
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
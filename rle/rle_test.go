@@ -0,0 +1,190 @@
+package rle_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/rle"
+)
+
+func encode(t *testing.T, m *rle.Middleware, chunks ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := m.Writer(&buf)
+	for _, c := range chunks {
+		if _, err := w.Write(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sparse has a literal, a zero run and a run of another byte
+var sparse = append(append([]byte("abc"), make([]byte, 10)...), bytes.Repeat([]byte("x"), 9)...)
+
+func TestTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *rle.Middleware
+		want []byte
+	}{
+		{"default", rle.New(), []byte{2, 3<<2 | 0, 'a', 'b', 'c', 10<<2 | 1, 9<<2 | 2, 'x', 0}},
+		{"zeros only", rle.New(rle.WithZerosOnly()),
+			append(append([]byte{2, 3<<2 | 0, 'a', 'b', 'c', 10<<2 | 1, 9 << 2}, bytes.Repeat([]byte("x"), 9)...), 0)},
+		{"long min run", rle.New(rle.WithMinRun(16)), append(append([]byte{2, 22 << 2}, sparse...), 0)},
+		{"min run ignored", rle.New(rle.WithMinRun(1)), []byte{2, 3<<2 | 0, 'a', 'b', 'c', 10<<2 | 1, 9<<2 | 2, 'x', 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// runs spanning several writes are joined
+			got := encode(t, tt.m, sparse[:5], sparse[5:14], sparse[14:])
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("got %x, want %x", got, tt.want)
+			}
+			dec, err := io.ReadAll(iotest.OneByteReader(tt.m.Reader(bytes.NewReader(got))))
+			if err != nil || !bytes.Equal(dec, sparse) {
+				t.Fatalf("decoded %q, %v", dec, err)
+			}
+		})
+	}
+}
+
+func TestLargeRuns(t *testing.T) {
+	// a long run is a single token, long literals are split
+	data := append(make([]byte, 10<<20), bytes.Repeat([]byte{1, 2}, 100<<10)...)
+	m := rle.New()
+	enc := encode(t, m, data)
+	if len(enc) > 200<<10+64 {
+		t.Fatalf("encoded %d bytes", len(enc))
+	}
+	got, err := io.ReadAll(m.Reader(bytes.NewReader(enc)))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("round trip: %d bytes, %v", len(got), err)
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	m := rle.New()
+	enc := encode(t, m)
+	if !bytes.Equal(enc, []byte{rle.FormatVersion, 0}) {
+		t.Fatalf("got %x", enc)
+	}
+	got, err := io.ReadAll(m.Reader(bytes.NewReader(enc)))
+	if err != nil || len(got) != 0 {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestSplitJoin(t *testing.T) {
+	m := rle.New()
+	var body bytes.Buffer
+	w, hdr, err := m.SplitWriter(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(sparse)
+	w.(io.Closer).Close()
+	if !bytes.Equal(append(hdr, body.Bytes()...), encode(t, m, sparse)) {
+		t.Fatal("split stream differs")
+	}
+	r, err := m.JoinReader(&body, hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, sparse) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	for _, hdr := range [][]byte{nil, {1, 1}, {3}} {
+		if _, err := m.JoinReader(&body, hdr); err == nil {
+			t.Fatalf("header %x accepted", hdr)
+		}
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	var tooLong [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tooLong[:], (64<<10+1)<<2)
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, io.ErrUnexpectedEOF},
+		{"unknown version", []byte{3, 4, 'a', 0}, middleware.ErrUnsupportedVersion},
+		{"empty token in version 1", []byte{1, 0}, rle.ErrCorrupt},
+		{"no end token", []byte{2, 4, 'a'}, io.ErrUnexpectedEOF},
+		{"no token", []byte{2}, io.ErrUnexpectedEOF},
+		{"unknown kind", []byte{1, 1<<2 | 3}, rle.ErrCorrupt},
+		{"literal too long", append([]byte{1}, tooLong[:n]...), rle.ErrCorrupt},
+		{"truncated literal", []byte{1, 3 << 2, 'a'}, io.ErrUnexpectedEOF},
+		{"run without byte", []byte{1, 9<<2 | 2}, io.ErrUnexpectedEOF},
+		{"truncated header", []byte{1, 0x80}, io.ErrUnexpectedEOF},
+		{"overlong header", append([]byte{1}, bytes.Repeat([]byte{0xff}, 11)...), rle.ErrCorrupt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := io.ReadAll(rle.New().Reader(bytes.NewReader(tt.data)))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionPolicy(t *testing.T) {
+	future := []byte{rle.FormatVersion + 1, 2 << 2, 'o', 'k', 0}
+	var logged bool
+	lenient := rle.New().ForMode(middleware.LenientMode, func(string, ...any) { logged = true })
+	got, err := io.ReadAll(lenient.Reader(bytes.NewReader(future)))
+	if err != nil || string(got) != "ok" || !logged {
+		t.Fatalf("lenient: got %q, %v, logged %v", got, err, logged)
+	}
+	strict := rle.New(rle.WithVersionPolicy(middleware.BestEffort)).ForMode(middleware.StrictMode, nil)
+	if _, err := io.ReadAll(strict.Reader(bytes.NewReader(future))); !errors.Is(err, middleware.ErrUnsupportedVersion) {
+		t.Fatalf("strict: got %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestVersion1(t *testing.T) {
+	// version 1 streams have no end token and end with the source
+	v1 := []byte{1, 3<<2 | 0, 'a', 'b', 'c', 10<<2 | 1, 9<<2 | 2, 'x'}
+	got, err := io.ReadAll(rle.New().Reader(bytes.NewReader(v1)))
+	if err != nil || !bytes.Equal(got, sparse) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	r, err := rle.New().JoinReader(bytes.NewReader(v1[1:]), v1[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, sparse) {
+		t.Fatalf("joined: got %q, %v", got, err)
+	}
+}
+
+func TestEndToken(t *testing.T) {
+	// the reader stops at the end token, data behind it is left unread or
+	// reported as buffered
+	enc := encode(t, rle.New(), sparse)
+	src := bytes.NewReader(append(bytes.Clone(enc), "garbage"...))
+	got, err := io.ReadAll(rle.New().Reader(src))
+	if err != nil || !bytes.Equal(got, sparse) || src.Len() != len("garbage") {
+		t.Fatalf("got %q, %v, %d bytes left", got, err, src.Len())
+	}
+
+	// hide io.ByteReader, so the reader buffers
+	r := rle.New().Reader(struct{ io.Reader }{bytes.NewReader(append(bytes.Clone(enc), "garbage"...))})
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if n := r.(middleware.Buffered).Buffered(); n != len("garbage") {
+		t.Fatalf("%d bytes buffered", n)
+	}
+}
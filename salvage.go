@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+)
+
+// SalvageError is returned by a SalvageReader once the stream turned out
+// to be damaged. The plaintext returned before it is all that could be
+// decoded.
+type SalvageError struct {
+	// Offset is the number of plaintext bytes returned before the damage
+	Offset int64
+
+	// Encoded is the number of encoded bytes read from the source when the
+	// damage was detected
+	Encoded int64
+
+	// Err is the error of the layers, e.g. an authentication failure or
+	// io.ErrUnexpectedEOF for a truncated stream
+	Err error
+}
+
+// Error reports the offsets reached
+func (e *SalvageError) Error() string {
+	return fmt.Sprintf("middleware: stream damaged after %d plaintext bytes (%d encoded bytes read): %v", e.Offset, e.Encoded, e.Err)
+}
+
+// Unwrap returns the error of the layers
+func (e *SalvageError) Unwrap() error { return e.Err }
+
+// SalvageReader reads the plaintext of a possibly damaged stream with m.
+// Everything the layers release before the damage is returned, then Read
+// fails with a *SalvageError carrying the offsets reached, so recovery
+// workflows can keep the readable prefix instead of discarding the stream.
+// Panics of layers decoding garbage are reported the same way.
+//
+// The prefix is as trustworthy as the layers make it: block-authenticated
+// layers like encryption release only verified blocks, while layers that
+// verify at the end, like a checksum trailer, release unverified data.
+func SalvageReader(m Middleware, r io.Reader) io.Reader {
+	src := &countingReader{r: r}
+	return &salvageReader{r: m.Reader(src), src: src}
+}
+
+type salvageReader struct {
+	r   io.Reader
+	src *countingReader
+	n   int64
+	err error
+}
+
+func (s *salvageReader) Read(p []byte) (n int, err error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			n, err = 0, fmt.Errorf("layer panicked: %v", v)
+		}
+		s.n += int64(n)
+		if err != nil && err != io.EOF {
+			err = &SalvageError{Offset: s.n, Encoded: s.src.n, Err: err}
+		}
+		s.err = err
+	}()
+	return s.r.Read(p)
+}
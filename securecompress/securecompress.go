@@ -0,0 +1,538 @@
+// Package securecompress provides a combined compression and encryption
+// middleware. Each chunk is compressed with DEFLATE directly into the frame
+// buffer and sealed in place with an AEAD, so data is traversed once and
+// both steps share one framing, instead of the copies and buffers of a
+// compression layer stacked below an encryption layer.
+//
+// A stream starts with a header of 25 bytes:
+//
+//	"HBZ" | version (1) | cipher (1) | chunk size (uint32, big endian) | salt (16)
+//
+// followed by frames of
+//
+//	length (uint32, big endian, top bit set for the last frame) | sealed chunk
+//
+// The stream key is HKDF-SHA256 of the key with the salt and the info
+// "hybridbuffer securecompress". A chunk is sealed with the 12 byte nonce
+// 0 (3) | index (uint64, big endian) | final (1) and the header as
+// associated data; its plaintext is a mode byte, 0 for stored and 1 for
+// DEFLATE, followed by the data, which decompresses to at most chunk size
+// bytes. Every stream ends with a final frame, which is the only frame that
+// may be empty and must not be followed by other data. Readers verify every
+// chunk before releasing it.
+package securecompress
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// FormatVersion is the header format version of securecompress streams
+const FormatVersion = 1
+
+var magic = [3]byte{'H', 'B', 'Z'}
+
+const (
+	// KeySize is the size of the key
+	KeySize = 32
+
+	// DefaultChunkSize is the default size of the plaintext chunks
+	DefaultChunkSize = 64 << 10
+
+	// MaxChunkSize is the largest chunk size Readers accept
+	MaxChunkSize = 4 << 20
+
+	saltSize   = 16
+	tagSize    = 16
+	headerSize = len(magic) + 2 + 4 + saltSize
+	finalFlag  = 1 << 31
+)
+
+// Cipher suites of the chunks, numbered like the DARE suites of the
+// encryption middleware
+const (
+	AES256GCM        byte = 0x00
+	ChaCha20Poly1305 byte = 0x01
+)
+
+// Modes of a chunk
+const (
+	modeStored  = 0
+	modeDeflate = 1
+)
+
+func init() {
+	middleware.RegisterFormat("securecompress-header", func(p []byte) (string, int, bool) {
+		if len(p) < headerSize || [3]byte(p[:3]) != magic {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, %s, chunk size %d", p[3], cipherName(p[4]), binary.BigEndian.Uint32(p[5:9])), headerSize, true
+	})
+}
+
+var (
+	// ErrInvalidKeySize is returned by NewE for keys that are not KeySize bytes long
+	ErrInvalidKeySize = errors.New("securecompress: key must be 32 bytes")
+
+	// ErrUnsupportedCipher is returned by NewE and Readers for unknown cipher suites
+	ErrUnsupportedCipher = errors.New("securecompress: unsupported cipher suite")
+
+	// ErrNotAuthentic is returned by Readers for modified, truncated or
+	// foreign streams
+	ErrNotAuthentic = errors.New("securecompress: message authentication failed")
+)
+
+// Middleware compresses and encrypts streams chunk by chunk
+type Middleware struct {
+	key    []byte
+	cipher byte
+	level  int
+	chunk  int
+	rand   io.Reader
+}
+
+// Ensure Middleware implements the middleware interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Roled      = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+	_ middleware.MemoryUser = (*Middleware)(nil)
+)
+
+// Option configures the middleware
+type Option func(*Middleware)
+
+// WithCipher sets the cipher suite, AES256GCM by default
+func WithCipher(c byte) Option {
+	return func(m *Middleware) {
+		m.cipher = c
+	}
+}
+
+// WithLevel sets the DEFLATE level, flate.BestSpeed by default for low
+// latency. flate.NoCompression stores every chunk.
+func WithLevel(level int) Option {
+	return func(m *Middleware) {
+		m.level = level
+	}
+}
+
+// WithChunkSize sets the size of the plaintext chunks written,
+// DefaultChunkSize by default. Readers take it from the header. Sizes
+// outside 1 to MaxChunkSize are ignored.
+func WithChunkSize(n int) Option {
+	return func(m *Middleware) {
+		if n > 0 && n <= MaxChunkSize {
+			m.chunk = n
+		}
+	}
+}
+
+// WithRand sets the source of salts. By default middleware.Rand() is used.
+func WithRand(r io.Reader) Option {
+	return func(m *Middleware) {
+		m.rand = r
+	}
+}
+
+// New creates a securecompress middleware with a KeySize byte key. New
+// panics if the key has an invalid size or the configuration is invalid.
+func New(key []byte, opts ...Option) *Middleware {
+	m, err := NewE(key, opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return m
+}
+
+// NewE is like New, but returns configuration errors instead of panicking
+func NewE(key []byte, opts ...Option) (*Middleware, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("%w, got %d", ErrInvalidKeySize, len(key))
+	}
+	m := &Middleware{
+		key:   append([]byte(nil), key...),
+		level: flate.BestSpeed,
+		chunk: DefaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.cipher != AES256GCM && m.cipher != ChaCha20Poly1305 {
+		return nil, fmt.Errorf("%w %#x", ErrUnsupportedCipher, m.cipher)
+	}
+	if m.level < flate.HuffmanOnly || m.level > flate.BestCompression {
+		return nil, fmt.Errorf("securecompress: invalid level %d", m.level)
+	}
+	if m.rand == nil {
+		m.rand = middleware.Rand()
+	}
+	return m, nil
+}
+
+// Role returns middleware.RoleEncryption; the layer compresses before it
+// encrypts, so it satisfies the ordering rules on its own
+func (m *Middleware) Role() middleware.Role { return middleware.RoleEncryption }
+
+// Describe reports the cipher, compression and chunk size
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:      string(middleware.RoleEncryption),
+		Algorithm: cipherName(m.cipher),
+		KeyBits:   256,
+		KDF:       &middleware.KDF{Name: "hkdf-sha256", Params: map[string]string{"salt": "per stream"}},
+		Integrity: "aead",
+		Properties: map[string]string{
+			"format":         "hb-securecompress",
+			"key_management": "static",
+			"compression":    "deflate",
+			"level":          fmt.Sprint(m.level),
+			"chunk_size":     fmt.Sprint(m.chunk),
+		},
+	}
+}
+
+// Approximate allocations of compress/flate, see the compression package
+const (
+	flateWriterMemory    = 1200 << 10
+	flateBestSpeedMemory = 800 << 10
+	flateReaderMemory    = 48 << 10
+)
+
+// MemoryUsage estimates the memory of a Writer, the compressor state and
+// two chunk buffers. Readers need the decompressor and two chunk buffers
+// of the size in the stream header.
+func (m *Middleware) MemoryUsage() int64 {
+	compressor := int64(flateWriterMemory)
+	switch m.level {
+	case flate.NoCompression:
+		compressor = 0
+	case flate.BestSpeed, flate.HuffmanOnly:
+		compressor = flateBestSpeedMemory
+	}
+	return max(compressor, flateReaderMemory) + int64(2*(m.chunk+1+tagSize))
+}
+
+func cipherName(c byte) string {
+	switch c {
+	case AES256GCM:
+		return "aes-256-gcm"
+	case ChaCha20Poly1305:
+		return "chacha20-poly1305"
+	default:
+		return fmt.Sprintf("cipher %#x", c)
+	}
+}
+
+// newAEAD returns the AEAD of a stream with the header hdr
+func (m *Middleware) newAEAD(hdr []byte) (cipher.AEAD, error) {
+	key := make([]byte, KeySize)
+	defer clear(key)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, m.key, hdr[headerSize-saltSize:headerSize], []byte("hybridbuffer securecompress")), key); err != nil {
+		return nil, err
+	}
+	switch hdr[4] {
+	case AES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case ChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("%w %#x", ErrUnsupportedCipher, hdr[4])
+	}
+}
+
+// nonce returns the nonce of chunk index
+func nonce(index uint64, final bool) []byte {
+	var n [12]byte
+	binary.BigEndian.PutUint64(n[3:11], index)
+	if final {
+		n[11] = 1
+	}
+	return n[:]
+}
+
+// Writer compresses and encrypts to w. Closing it writes the last chunk;
+// it does not close w.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	return &writer{m: m, w: w, state: middleware.WriterState{Layer: "securecompress"}}
+}
+
+type writer struct {
+	m     *Middleware
+	w     io.Writer
+	hdr   []byte
+	aead  cipher.AEAD
+	zw    *flate.Writer
+	chunk []byte // plaintext of the current chunk
+	frame []byte // length, mode, payload and tag of the frame being sealed
+	index uint64
+	state middleware.WriterState
+}
+
+// start writes the header
+func (w *writer) start() error {
+	hdr := make([]byte, headerSize)
+	copy(hdr, magic[:])
+	hdr[3] = FormatVersion
+	hdr[4] = w.m.cipher
+	binary.BigEndian.PutUint32(hdr[5:9], uint32(w.m.chunk))
+	if _, err := io.ReadFull(w.m.rand, hdr[9:]); err != nil {
+		return fmt.Errorf("securecompress: failed to generate salt: %w", err)
+	}
+	aead, err := w.m.newAEAD(hdr)
+	if err != nil {
+		return err
+	}
+	if w.m.level != flate.NoCompression {
+		if w.zw, err = flate.NewWriter(nil, w.m.level); err != nil {
+			return err
+		}
+	}
+	w.hdr, w.aead = hdr, aead
+	w.chunk = make([]byte, 0, w.m.chunk)
+	w.frame = make([]byte, 0, 4+1+w.m.chunk+tagSize)
+	_, err = w.w.Write(hdr)
+	return err
+}
+
+// appendWriter appends to a slice without growing it past its capacity
+type appendWriter struct{ b *[]byte }
+
+var errFull = errors.New("full")
+
+func (a appendWriter) Write(p []byte) (int, error) {
+	if len(*a.b)+len(p) > cap(*a.b) {
+		return 0, errFull
+	}
+	*a.b = append(*a.b, p...)
+	return len(p), nil
+}
+
+// flush compresses the current chunk into the frame buffer, falling back
+// to storing it if it does not shrink, seals it in place and writes it
+func (w *writer) flush(final bool) error {
+	frame := w.frame[:5]
+	frame[4] = modeStored
+	if w.zw != nil && len(w.chunk) > 0 {
+		// compressed data must be smaller than the chunk to be used
+		payload := frame[5:5:min(5+len(w.chunk)-1, cap(frame))]
+		w.zw.Reset(appendWriter{&payload})
+		_, err := w.zw.Write(w.chunk)
+		if err == nil {
+			err = w.zw.Close()
+		}
+		switch {
+		case err == nil:
+			frame[4] = modeDeflate
+			frame = frame[:5+len(payload)]
+		case !errors.Is(err, errFull):
+			return err
+		}
+	}
+	if frame[4] == modeStored {
+		frame = append(frame, w.chunk...)
+	}
+	sealed := w.aead.Seal(frame[4:4], nonce(w.index, final), frame[4:], w.hdr)
+	length := uint32(len(sealed))
+	if final {
+		length |= finalFlag
+	}
+	binary.BigEndian.PutUint32(frame[:4], length)
+	w.index++
+	w.chunk = w.chunk[:0]
+	_, err := w.w.Write(frame[:4+len(sealed)])
+	return err
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if w.hdr == nil {
+		if err := w.start(); err != nil {
+			return 0, w.state.Fail(err)
+		}
+	}
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is written once more data follows, the last one on Close
+		if len(w.chunk) == w.m.chunk {
+			if err := w.flush(false); err != nil {
+				return written, w.state.Fail(err)
+			}
+		}
+		n := min(len(p), w.m.chunk-len(w.chunk))
+		w.chunk = append(w.chunk, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *writer) Close() error {
+	return w.state.Close(func() error {
+		if w.hdr == nil {
+			if err := w.start(); err != nil {
+				return err
+			}
+		}
+		return w.flush(true)
+	})
+}
+
+// Reader decrypts and decompresses r, releasing each chunk once it was
+// verified
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return &reader{m: m, src: r, state: middleware.ReaderState{Layer: "securecompress"}}
+}
+
+type reader struct {
+	m     *Middleware
+	src   io.Reader
+	hdr   []byte
+	aead  cipher.AEAD
+	size  int    // chunk size of the stream
+	frame []byte // buffer of a sealed chunk
+	out   []byte // buffer of a decompressed chunk
+	zr    io.ReadCloser
+	plain []byte // unread plaintext of the current chunk
+	index uint64
+	last  bool
+	state middleware.ReaderState
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	if r.hdr == nil {
+		if err := r.start(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	for len(r.plain) == 0 {
+		if r.last {
+			return r.state.Track(0, io.EOF)
+		}
+		if err := r.next(); err != nil {
+			return r.state.Track(0, err)
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return r.state.Track(n, nil)
+}
+
+// start reads and checks the header
+func (r *reader) start() error {
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(r.src, hdr); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: truncated header", ErrNotAuthentic)
+		}
+		return err
+	}
+	if [3]byte(hdr[:3]) != magic {
+		return errors.New("securecompress: not a securecompress stream")
+	}
+	if _, err := middleware.CheckVersion("securecompress", hdr[3], FormatVersion, middleware.RejectUnknown); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(hdr[5:9])
+	if size == 0 || size > MaxChunkSize {
+		return fmt.Errorf("securecompress: invalid chunk size %d", size)
+	}
+	aead, err := r.m.newAEAD(hdr)
+	if err != nil {
+		return err
+	}
+	r.hdr, r.aead, r.size = hdr, aead, int(size)
+	r.frame = make([]byte, 1+r.size+tagSize)
+	return nil
+}
+
+// next reads, verifies and decompresses the next chunk
+func (r *reader) next() error {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r.src, lenBuf[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: truncated stream", ErrNotAuthentic)
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(lenBuf[:])
+	final := length&finalFlag != 0
+	length &^= finalFlag
+	if length < 1+tagSize || int(length) > len(r.frame) {
+		return fmt.Errorf("%w: invalid frame length %d", ErrNotAuthentic, length)
+	}
+	sealed := r.frame[:length]
+	if _, err := io.ReadFull(r.src, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: truncated stream", ErrNotAuthentic)
+		}
+		return err
+	}
+	chunk, err := r.aead.Open(sealed[:0], nonce(r.index, final), sealed, r.hdr)
+	if err != nil {
+		return ErrNotAuthentic
+	}
+	r.index++
+	r.last = final
+	if final {
+		// data after the final chunk is not authenticated
+		switch _, err := io.ReadFull(r.src, lenBuf[:1]); {
+		case err == nil:
+			return fmt.Errorf("%w: data after final chunk", ErrNotAuthentic)
+		case err != io.EOF:
+			return err
+		}
+	}
+	// only an empty stream ends with an empty chunk
+	if len(chunk) == 1 && (!final || r.index > 1) {
+		return fmt.Errorf("%w: empty chunk", ErrNotAuthentic)
+	}
+	switch chunk[0] {
+	case modeStored:
+		r.plain = chunk[1:]
+	case modeDeflate:
+		return r.inflate(chunk[1:])
+	default:
+		return fmt.Errorf("securecompress: unknown chunk mode %d", chunk[0])
+	}
+	return nil
+}
+
+// inflate decompresses a chunk of at most the chunk size
+func (r *reader) inflate(data []byte) error {
+	if r.zr == nil {
+		r.zr = flate.NewReader(bytes.NewReader(data))
+		r.out = make([]byte, r.size+1)
+	} else if err := r.zr.(flate.Resetter).Reset(bytes.NewReader(data), nil); err != nil {
+		return err
+	}
+	n, err := io.ReadFull(r.zr, r.out)
+	switch {
+	case err == nil:
+		return fmt.Errorf("securecompress: chunk decompresses to more than %d bytes", r.size)
+	case err != io.ErrUnexpectedEOF && err != io.EOF:
+		return fmt.Errorf("securecompress: decompress chunk: %w", err)
+	}
+	r.plain = r.out[:n]
+	return nil
+}
@@ -0,0 +1,183 @@
+package securecompress_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/securecompress"
+)
+
+const chunkSize = 1024
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, securecompress.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func encrypt(t *testing.T, m *securecompress.Middleware, data []byte) []byte {
+	t.Helper()
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return enc.Bytes()
+}
+
+func decrypt(m *securecompress.Middleware, enc []byte) ([]byte, error) {
+	return io.ReadAll(m.Reader(bytes.NewReader(enc)))
+}
+
+// testData returns compressible data with random runs, which makes some
+// chunks compress and others be stored
+func testData(size int) []byte {
+	data := bytes.Repeat([]byte("compressible "), size/13+1)[:size]
+	for i := 0; i+64 <= size; i += 3 * chunkSize {
+		rand.Read(data[i : i+min(chunkSize, size-i)])
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newKey(t)
+	for _, c := range []byte{securecompress.AES256GCM, securecompress.ChaCha20Poly1305} {
+		for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.BestCompression, flate.HuffmanOnly} {
+			m := securecompress.New(key, securecompress.WithCipher(c), securecompress.WithLevel(level), securecompress.WithChunkSize(chunkSize))
+			for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 10*chunkSize + 7} {
+				data := testData(size)
+				got, err := decrypt(m, encrypt(t, m, data))
+				if err != nil {
+					t.Fatalf("cipher %d, level %d, size %d: %v", c, level, size, err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("cipher %d, level %d, size %d: round trip mismatch", c, level, size)
+				}
+			}
+		}
+	}
+}
+
+func TestCompresses(t *testing.T) {
+	m := securecompress.New(newKey(t))
+	data := bytes.Repeat([]byte("compressible "), 100000)
+	if enc := encrypt(t, m, data); len(enc) > len(data)/10 {
+		t.Fatalf("%d bytes compressed to %d", len(data), len(enc))
+	}
+}
+
+func TestReaderTakesChunkSizeFromHeader(t *testing.T) {
+	key := newKey(t)
+	data := testData(5*chunkSize + 3)
+	enc := encrypt(t, securecompress.New(key, securecompress.WithChunkSize(chunkSize)), data)
+	got, err := decrypt(securecompress.New(key), enc)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+}
+
+// frames returns the offsets of the frames of a stream
+func frames(t *testing.T, enc []byte) []int {
+	t.Helper()
+	var offsets []int
+	for off := 25; off < len(enc); {
+		offsets = append(offsets, off)
+		length := binary.BigEndian.Uint32(enc[off:]) &^ (1 << 31)
+		off += 4 + int(length)
+	}
+	return offsets
+}
+
+func TestHostileStreams(t *testing.T) {
+	m := securecompress.New(newKey(t), securecompress.WithChunkSize(chunkSize))
+	msg := testData(3*chunkSize + 100)
+	valid := encrypt(t, m, msg)
+	offsets := frames(t, valid)
+	if len(offsets) != 4 {
+		t.Fatalf("got %d frames, want 4", len(offsets))
+	}
+	last := offsets[3]
+
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(bytes.Clone(valid))
+	}
+	setLength := func(off int, length uint32) []byte {
+		return modify(func(b []byte) []byte { binary.BigEndian.PutUint32(b[off:], length); return b })
+	}
+	// the frames of another stream of the same key
+	other := encrypt(t, m, msg)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error // nil for any error
+	}{
+		{"empty", nil, securecompress.ErrNotAuthentic},
+		{"truncated header", valid[:24], securecompress.ErrNotAuthentic},
+		{"header only", valid[:25], securecompress.ErrNotAuthentic},
+		{"bad magic", modify(func(b []byte) []byte { b[0] = 'X'; return b }), nil},
+		{"unknown version", modify(func(b []byte) []byte { b[3] = 99; return b }), nil},
+		{"unknown cipher", modify(func(b []byte) []byte { b[4] = 7; return b }), securecompress.ErrUnsupportedCipher},
+		{"other cipher", modify(func(b []byte) []byte { b[4] = securecompress.ChaCha20Poly1305; return b }), securecompress.ErrNotAuthentic},
+		{"zero chunk size", modify(func(b []byte) []byte { binary.BigEndian.PutUint32(b[5:], 0); return b }), nil},
+		{"huge chunk size", modify(func(b []byte) []byte { binary.BigEndian.PutUint32(b[5:], 1<<31); return b }), nil},
+		{"changed chunk size", modify(func(b []byte) []byte { binary.BigEndian.PutUint32(b[5:], 2*chunkSize); return b }), securecompress.ErrNotAuthentic},
+		{"changed salt", modify(func(b []byte) []byte { b[24] ^= 1; return b }), securecompress.ErrNotAuthentic},
+		{"frame too short", setLength(offsets[0], 16), securecompress.ErrNotAuthentic},
+		{"frame too long", setLength(offsets[0], 1+chunkSize+16+1), securecompress.ErrNotAuthentic},
+		{"flipped frame", modify(func(b []byte) []byte { b[offsets[1]+10] ^= 1; return b }), securecompress.ErrNotAuthentic},
+		{"early final flag", modify(func(b []byte) []byte { b[offsets[0]] |= 0x80; return b }), securecompress.ErrNotAuthentic},
+		{"no final flag", modify(func(b []byte) []byte { b[last] &^= 0x80; return b }), securecompress.ErrNotAuthentic},
+		{"dropped last frame", valid[:last], securecompress.ErrNotAuthentic},
+		{"truncated last frame", valid[:len(valid)-1], securecompress.ErrNotAuthentic},
+		{"dropped frame", append(bytes.Clone(valid[:offsets[1]]), valid[offsets[2]:]...), securecompress.ErrNotAuthentic},
+		{"swapped frames", append(append(bytes.Clone(valid[:offsets[1]]), valid[offsets[2]:last]...), valid[offsets[1]:offsets[2]]...), securecompress.ErrNotAuthentic},
+		{"frame of another stream", append(bytes.Clone(valid[:offsets[1]]), other[offsets[1]:]...), securecompress.ErrNotAuthentic},
+		{"appended frame", append(bytes.Clone(valid), valid[offsets[1]:offsets[2]]...), securecompress.ErrNotAuthentic},
+		{"appended byte", append(bytes.Clone(valid), 0), securecompress.ErrNotAuthentic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(m, tt.data)
+			if err == nil {
+				t.Fatal("hostile stream accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if !bytes.HasPrefix(msg, got) {
+				t.Fatal("returned data that is not part of the plaintext")
+			}
+		})
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	enc := encrypt(t, securecompress.New(newKey(t)), []byte("secret"))
+	if _, err := decrypt(securecompress.New(newKey(t)), enc); !errors.Is(err, securecompress.ErrNotAuthentic) {
+		t.Fatalf("got %v, want ErrNotAuthentic", err)
+	}
+}
+
+func TestInvalidConfiguration(t *testing.T) {
+	if _, err := securecompress.NewE(make([]byte, 16)); !errors.Is(err, securecompress.ErrInvalidKeySize) {
+		t.Fatalf("got %v, want ErrInvalidKeySize", err)
+	}
+	if _, err := securecompress.NewE(newKey(t), securecompress.WithCipher(9)); !errors.Is(err, securecompress.ErrUnsupportedCipher) {
+		t.Fatalf("got %v, want ErrUnsupportedCipher", err)
+	}
+	if _, err := securecompress.NewE(newKey(t), securecompress.WithLevel(10)); err == nil {
+		t.Fatal("invalid level accepted")
+	}
+}
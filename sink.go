@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// Completer is implemented by sinks that need an explicit commit once all
+// data was written, such as multipart uploads
+type Completer interface {
+	Complete() error
+}
+
+// Aborter is implemented by sinks that need an explicit abort when writing
+// failed, so no orphaned parts are left behind
+type Aborter interface {
+	Abort(cause error) error
+}
+
+// SinkHooks coordinate the end of a write pipeline with its sink
+type SinkHooks struct {
+	// OnSinkComplete is called once after every layer flushed its buffered tail successfully
+	OnSinkComplete func() error
+
+	// OnSinkAbort is called once when a write or flush failed, or Abort was called
+	OnSinkAbort func(cause error) error
+}
+
+// ErrAborted is returned by a SinkWriter after it was aborted
+var ErrAborted = errors.New("middleware: writer aborted")
+
+// SinkWriter applies a middleware on top of a sink and calls the sink hooks
+// exactly once, depending on whether the pipeline finished successfully
+type SinkWriter struct {
+	w     io.Writer
+	hooks SinkHooks
+
+	mu   sync.Mutex
+	done bool
+	err  error
+}
+
+// NewSinkWriter wraps sink with m. Hooks that are nil default to the sink's
+// Complete and Abort methods if it implements Completer or Aborter.
+func NewSinkWriter(m Middleware, sink io.Writer, hooks SinkHooks) *SinkWriter {
+	if hooks.OnSinkComplete == nil {
+		if c, ok := sink.(Completer); ok {
+			hooks.OnSinkComplete = c.Complete
+		}
+	}
+	if hooks.OnSinkAbort == nil {
+		if a, ok := sink.(Aborter); ok {
+			hooks.OnSinkAbort = a.Abort
+		}
+	}
+	return &SinkWriter{
+		w:     m.Writer(sink),
+		hooks: hooks,
+	}
+}
+
+// Write writes p through the middleware. A failed write aborts the sink.
+func (s *SinkWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		if s.err != nil {
+			return 0, s.err
+		}
+		return 0, ErrClosed
+	}
+	n, err := s.w.Write(p)
+	if err != nil {
+		s.abort(err)
+	}
+	return n, err
+}
+
+// Close flushes the middleware and completes the sink. If flushing fails the
+// sink is aborted instead and the flush error is returned.
+func (s *SinkWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return s.err
+	}
+	if c, ok := s.w.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			s.abort(err)
+			return err
+		}
+	}
+	s.done = true
+	if s.hooks.OnSinkComplete != nil {
+		s.err = s.hooks.OnSinkComplete()
+	}
+	return s.err
+}
+
+// Abort discards the pipeline and aborts the sink. It is a no-op if the
+// writer was already closed or aborted.
+func (s *SinkWriter) Abort(cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return nil
+	}
+	if cause == nil {
+		cause = ErrAborted
+	}
+	return s.abort(cause)
+}
+
+func (s *SinkWriter) abort(cause error) error {
+	s.done = true
+	s.err = cause
+	if s.hooks.OnSinkAbort != nil {
+		return s.hooks.OnSinkAbort(cause)
+	}
+	return nil
+}
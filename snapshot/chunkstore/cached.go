@@ -0,0 +1,60 @@
+package chunkstore
+
+import (
+	"errors"
+
+	"schneider.vip/hybridbuffer/middleware/snapshot"
+)
+
+// Cached puts a fast store, typically a size limited Memory, in front of a
+// durable one. Chunks are written through to both and read from the cache
+// first.
+type Cached struct {
+	cache   snapshot.ChunkStore
+	backing snapshot.Collectable
+}
+
+// Ensure Cached implements snapshot.Collectable
+var _ snapshot.Collectable = (*Cached)(nil)
+
+// NewCached creates a store caching the chunks of backing in cache
+func NewCached(cache snapshot.ChunkStore, backing snapshot.Collectable) *Cached {
+	return &Cached{cache: cache, backing: backing}
+}
+
+// Put stores a chunk in the backing store and the cache
+func (c *Cached) Put(h snapshot.Hash, data []byte) error {
+	if err := c.backing.Put(h, data); err != nil {
+		return err
+	}
+	// a failing cache only costs a later read from the backing store
+	_ = c.cache.Put(h, data)
+	return nil
+}
+
+// Get reads a chunk from the cache or, filling the cache, from the backing store
+func (c *Cached) Get(h snapshot.Hash) ([]byte, error) {
+	if data, err := c.cache.Get(h); err == nil {
+		return data, nil
+	}
+	data, err := c.backing.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	_ = c.cache.Put(h, data)
+	return data, nil
+}
+
+// Chunks lists the chunks of the backing store
+func (c *Cached) Chunks(fn func(h snapshot.Hash) error) error {
+	return c.backing.Chunks(fn)
+}
+
+// Delete removes a chunk from the backing store and the cache
+func (c *Cached) Delete(h snapshot.Hash) error {
+	var err error
+	if col, ok := c.cache.(snapshot.Collectable); ok {
+		err = col.Delete(h)
+	}
+	return errors.Join(c.backing.Delete(h), err)
+}
@@ -0,0 +1,97 @@
+package chunkstore
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"schneider.vip/hybridbuffer/middleware/snapshot"
+)
+
+// Dir stores every chunk in a file named by its hash below a local
+// directory, fanned out into subdirectories by the first hash byte
+type Dir struct {
+	root string
+}
+
+// Ensure Dir implements snapshot.Collectable
+var _ snapshot.Collectable = (*Dir)(nil)
+
+// NewDir creates a store in the directory root, creating it if needed
+func NewDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, err
+	}
+	return &Dir{root: root}, nil
+}
+
+func (d *Dir) path(h snapshot.Hash) string {
+	name := h.String()
+	return filepath.Join(d.root, name[:2], name)
+}
+
+// Put writes a chunk to a temporary file and renames it into place, so
+// readers never see partial chunks
+func (d *Dir) Put(h snapshot.Hash, data []byte) error {
+	p := d.path(h)
+	if _, err := os.Stat(p); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+// Get reads a chunk, returning snapshot.ErrChunkNotFound for unknown hashes
+func (d *Dir) Get(h snapshot.Hash) ([]byte, error) {
+	data, err := os.ReadFile(d.path(h))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, snapshot.ErrChunkNotFound
+	}
+	return data, err
+}
+
+// Chunks calls fn for every stored chunk, skipping unrelated files
+func (d *Dir) Chunks(fn func(h snapshot.Hash) error) error {
+	return filepath.WalkDir(d.root, func(p string, e fs.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		var h snapshot.Hash
+		if len(e.Name()) != 2*len(h) {
+			return nil
+		}
+		if _, err := hex.Decode(h[:], []byte(e.Name())); err != nil {
+			return nil
+		}
+		return fn(h)
+	})
+}
+
+// Delete removes a chunk file
+func (d *Dir) Delete(h snapshot.Hash) error {
+	err := os.Remove(d.path(h))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
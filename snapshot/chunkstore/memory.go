@@ -0,0 +1,105 @@
+// Package chunkstore provides ready-made chunk stores for the snapshot
+// middleware: an in-memory store with optional LRU eviction, a local
+// directory and S3-compatible object storage. All of them can be wrapped
+// with snapshot.NewGCStore to reclaim chunks of deleted snapshots.
+package chunkstore
+
+import (
+	"container/list"
+	"sync"
+
+	"schneider.vip/hybridbuffer/middleware/snapshot"
+)
+
+// Memory keeps chunks in process memory. With a size limit it evicts the
+// least recently used chunks, which makes it a cache: snapshots referencing
+// evicted chunks can no longer be read, so limited stores suit short-lived
+// buffers or sit in front of a durable store with NewCached.
+type Memory struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List // of *memEntry, most recently used first
+	chunks   map[snapshot.Hash]*list.Element
+}
+
+type memEntry struct {
+	hash snapshot.Hash
+	data []byte
+}
+
+// Ensure Memory implements snapshot.Collectable
+var _ snapshot.Collectable = (*Memory)(nil)
+
+// NewMemory creates an in-memory store holding at most maxBytes of chunk
+// data, or an unlimited one if maxBytes is 0
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{maxBytes: maxBytes, lru: list.New(), chunks: make(map[snapshot.Hash]*list.Element)}
+}
+
+// Put stores a chunk, evicting least recently used chunks if needed
+func (m *Memory) Put(h snapshot.Hash, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.chunks[h]; ok {
+		m.lru.MoveToFront(e)
+		return nil
+	}
+	m.chunks[h] = m.lru.PushFront(&memEntry{hash: h, data: data})
+	m.size += int64(len(data))
+	for m.maxBytes > 0 && m.size > m.maxBytes && m.lru.Len() > 1 {
+		m.remove(m.lru.Back())
+	}
+	return nil
+}
+
+// Get returns a chunk or snapshot.ErrChunkNotFound
+func (m *Memory) Get(h snapshot.Hash) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.chunks[h]
+	if !ok {
+		return nil, snapshot.ErrChunkNotFound
+	}
+	m.lru.MoveToFront(e)
+	return e.Value.(*memEntry).data, nil
+}
+
+// Chunks calls fn for every stored chunk
+func (m *Memory) Chunks(fn func(h snapshot.Hash) error) error {
+	m.mu.Lock()
+	hashes := make([]snapshot.Hash, 0, len(m.chunks))
+	for h := range m.chunks {
+		hashes = append(hashes, h)
+	}
+	m.mu.Unlock()
+	for _, h := range hashes {
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes a chunk
+func (m *Memory) Delete(h snapshot.Hash) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.chunks[h]; ok {
+		m.remove(e)
+	}
+	return nil
+}
+
+// Size returns the stored chunk data in bytes
+func (m *Memory) Size() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.size
+}
+
+func (m *Memory) remove(e *list.Element) {
+	entry := m.lru.Remove(e).(*memEntry)
+	delete(m.chunks, entry.hash)
+	m.size -= int64(len(entry.data))
+}
@@ -0,0 +1,127 @@
+package chunkstore
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"strings"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware/snapshot"
+)
+
+// DefaultS3Timeout bounds every object storage call
+const DefaultS3Timeout = 30 * time.Second
+
+// S3Client is the subset of an S3-compatible object storage API used by
+// the store. Like the KMS sealers, the package does not depend on an SDK;
+// an adapter around aws-sdk-go-v2 or minio-go takes a few lines:
+//
+//	func (a adapter) GetObject(ctx context.Context, bucket, key string) ([]byte, error) {
+//		obj, err := a.c.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+//		if err != nil {
+//			return nil, err
+//		}
+//		defer obj.Close()
+//		data, err := io.ReadAll(obj)
+//		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+//			return nil, fs.ErrNotExist
+//		}
+//		return data, err
+//	}
+type S3Client interface {
+	PutObject(ctx context.Context, bucket, key string, data []byte) error
+
+	// GetObject returns an error matching fs.ErrNotExist for missing keys
+	GetObject(ctx context.Context, bucket, key string) ([]byte, error)
+
+	// DeleteObject deletes a key, missing keys are not an error
+	DeleteObject(ctx context.Context, bucket, key string) error
+
+	// ListObjects calls fn for every key with the prefix, stopping at the first error
+	ListObjects(ctx context.Context, bucket, prefix string, fn func(key string) error) error
+}
+
+// S3 stores every chunk as an object named by its hash below a prefix
+type S3 struct {
+	client  S3Client
+	bucket  string
+	prefix  string
+	timeout time.Duration
+}
+
+// Ensure S3 implements snapshot.Collectable
+var _ snapshot.Collectable = (*S3)(nil)
+
+// S3Option configures the S3 store
+type S3Option func(*S3)
+
+// WithPrefix sets the key prefix of chunk objects, e.g. "chunks/"
+func WithPrefix(prefix string) S3Option {
+	return func(s *S3) {
+		s.prefix = prefix
+	}
+}
+
+// WithTimeout sets the timeout of every call, DefaultS3Timeout by default
+func WithTimeout(d time.Duration) S3Option {
+	return func(s *S3) {
+		s.timeout = d
+	}
+}
+
+// NewS3 creates a store in bucket
+func NewS3(client S3Client, bucket string, opts ...S3Option) *S3 {
+	s := &S3{client: client, bucket: bucket, timeout: DefaultS3Timeout}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *S3) key(h snapshot.Hash) string {
+	return s.prefix + h.String()
+}
+
+// Put uploads a chunk. Chunks are immutable, so uploading an existing one
+// again is harmless.
+func (s *S3) Put(h snapshot.Hash, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.client.PutObject(ctx, s.bucket, s.key(h), data)
+}
+
+// Get downloads a chunk, returning snapshot.ErrChunkNotFound for unknown hashes
+func (s *S3) Get(h snapshot.Hash) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	data, err := s.client.GetObject(ctx, s.bucket, s.key(h))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, snapshot.ErrChunkNotFound
+	}
+	return data, err
+}
+
+// Chunks calls fn for every chunk object below the prefix. The listing is
+// not bounded by the call timeout.
+func (s *S3) Chunks(fn func(h snapshot.Hash) error) error {
+	return s.client.ListObjects(context.Background(), s.bucket, s.prefix, func(key string) error {
+		name := strings.TrimPrefix(key, s.prefix)
+		var h snapshot.Hash
+		if len(name) != 2*len(h) {
+			return nil
+		}
+		if _, err := hex.Decode(h[:], []byte(name)); err != nil {
+			return nil
+		}
+		return fn(h)
+	})
+}
+
+// Delete deletes a chunk object
+func (s *S3) Delete(h snapshot.Hash) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	return s.client.DeleteObject(ctx, s.bucket, s.key(h))
+}
@@ -0,0 +1,102 @@
+package snapshot
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Collectable is implemented by chunk stores whose chunks can be listed
+// and deleted, which garbage collection needs
+type Collectable interface {
+	ChunkStore
+
+	// Chunks calls fn for every stored chunk, stopping at the first error
+	Chunks(fn func(h Hash) error) error
+
+	// Delete removes a chunk. Deleting an unknown chunk is not an error.
+	Delete(h Hash) error
+}
+
+// GCStore adds garbage collection to a Collectable store. Writers of
+// middlewares using it hold a reference to every chunk of their snapshot
+// until they are closed, so GC never deletes chunks of a snapshot whose
+// manifest was not stored yet.
+type GCStore struct {
+	Collectable
+
+	mu   sync.Mutex
+	refs map[Hash]int
+}
+
+// referencer is implemented by stores tracking the chunks of open writers
+type referencer interface {
+	acquire(h Hash)
+	release(hs []Hash)
+}
+
+// Ensure GCStore implements ChunkStore and referencer interfaces
+var (
+	_ ChunkStore = (*GCStore)(nil)
+	_ referencer = (*GCStore)(nil)
+)
+
+// NewGCStore wraps store with reference counting and garbage collection
+func NewGCStore(store Collectable) *GCStore {
+	return &GCStore{Collectable: store, refs: make(map[Hash]int)}
+}
+
+func (s *GCStore) acquire(h Hash) {
+	s.mu.Lock()
+	s.refs[h]++
+	s.mu.Unlock()
+}
+
+func (s *GCStore) release(hs []Hash) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, h := range hs {
+		if s.refs[h]--; s.refs[h] <= 0 {
+			delete(s.refs, h)
+		}
+	}
+}
+
+// GC deletes the chunks referenced neither by one of the live manifests nor
+// by an open writer and returns the number of deleted chunks. Manifests of
+// all retained buffers must be passed, including the previous manifests of
+// writers that are still open, since their unchanged chunks are not
+// referenced again until the writer stores them in its manifest.
+func (s *GCStore) GC(live ...*Manifest) (int, error) {
+	keep := make(map[Hash]struct{})
+	for _, m := range live {
+		for _, c := range m.Chunks {
+			keep[c.Hash] = struct{}{}
+		}
+	}
+	var orphans []Hash
+	err := s.Chunks(func(h Hash) error {
+		if _, ok := keep[h]; !ok {
+			orphans = append(orphans, h)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("snapshot: list chunks: %w", err)
+	}
+	deleted := 0
+	for _, h := range orphans {
+		// re-checked under the lock, writers acquire a chunk before storing it
+		s.mu.Lock()
+		if s.refs[h] > 0 {
+			s.mu.Unlock()
+			continue
+		}
+		err := s.Delete(h)
+		s.mu.Unlock()
+		if err != nil {
+			return deleted, fmt.Errorf("snapshot: delete chunk %s: %w", h, err)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
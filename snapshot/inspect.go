@@ -0,0 +1,16 @@
+package snapshot
+
+import (
+	"fmt"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+func init() {
+	middleware.RegisterFormat("snapshot-manifest", func(p []byte) (string, int, bool) {
+		if len(p) < 4 || [3]byte(p[:3]) != manifestMagic {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d", p[3]), 0, true
+	})
+}
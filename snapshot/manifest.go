@@ -0,0 +1,158 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+// manifestMagic identifies an encoded manifest, it is followed by the format version
+var manifestMagic = [3]byte{'H', 'B', 'S'}
+
+// maxManifestChunks bounds the number of entries accepted when decoding
+const maxManifestChunks = 1 << 26
+
+// manifestChunksHint caps the entries preallocated from the count of a
+// manifest, larger manifests grow as their entries are read
+const manifestChunksHint = 4096
+
+// ErrInvalidManifest is returned when a manifest cannot be decoded
+var ErrInvalidManifest = errors.New("snapshot: invalid manifest")
+
+// Hash is the SHA-256 content hash of a chunk
+type Hash [sha256.Size]byte
+
+// HashOf returns the content hash of data
+func HashOf(data []byte) Hash {
+	return sha256.Sum256(data)
+}
+
+// String returns the hex encoding of the hash
+func (h Hash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// Chunk describes one chunk of a snapshot
+type Chunk struct {
+	Hash Hash
+	Size uint32
+}
+
+// Manifest lists the chunks a snapshot is made of, in stream order
+type Manifest struct {
+	ChunkSize int
+	Chunks    []Chunk
+}
+
+// Size returns the total size of the materialized stream
+func (m *Manifest) Size() int64 {
+	var n int64
+	for _, c := range m.Chunks {
+		n += int64(c.Size)
+	}
+	return n
+}
+
+// Contains reports whether the manifest references a chunk with hash h
+func (m *Manifest) Contains(h Hash) bool {
+	for _, c := range m.Chunks {
+		if c.Hash == h {
+			return true
+		}
+	}
+	return false
+}
+
+// hashSet returns the set of distinct chunk hashes in the manifest
+func (m *Manifest) hashSet() map[Hash]struct{} {
+	set := make(map[Hash]struct{}, len(m.Chunks))
+	for _, c := range m.Chunks {
+		set[c.Hash] = struct{}{}
+	}
+	return set
+}
+
+// MarshalBinary encodes the manifest
+func (m *Manifest) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a manifest produced by MarshalBinary
+func (m *Manifest) UnmarshalBinary(data []byte) error {
+	dec, err := ReadManifest(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	*m = *dec
+	return nil
+}
+
+// WriteTo writes the encoded manifest to w
+func (m *Manifest) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, len(manifestMagic)+1+2*binary.MaxVarintLen64+len(m.Chunks)*(sha256.Size+binary.MaxVarintLen32))
+	buf = append(buf, manifestMagic[:]...)
+	buf = append(buf, FormatVersion)
+	buf = binary.AppendUvarint(buf, uint64(m.ChunkSize))
+	buf = binary.AppendUvarint(buf, uint64(len(m.Chunks)))
+	for _, c := range m.Chunks {
+		buf = append(buf, c.Hash[:]...)
+		buf = binary.AppendUvarint(buf, uint64(c.Size))
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadManifest decodes a manifest from r, rejecting unknown format versions
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	return readManifest(r, middleware.RejectUnknown)
+}
+
+func readManifest(r io.Reader, policy middleware.VersionPolicy) (*Manifest, error) {
+	br := bufio.NewReader(r)
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+	}
+	if [3]byte(magic[:3]) != manifestMagic {
+		return nil, ErrInvalidManifest
+	}
+	if _, err := middleware.CheckVersion("snapshot", magic[3], FormatVersion, policy); err != nil {
+		return nil, err
+	}
+	chunkSize, err := binary.ReadUvarint(br)
+	if err != nil || chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, ErrInvalidManifest
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil || count > maxManifestChunks {
+		return nil, ErrInvalidManifest
+	}
+	m := &Manifest{
+		ChunkSize: int(chunkSize),
+		Chunks:    make([]Chunk, 0, min(count, manifestChunksHint)),
+	}
+	for i := uint64(0); i < count; i++ {
+		var c Chunk
+		if _, err := io.ReadFull(br, c.Hash[:]); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidManifest, err)
+		}
+		size, err := binary.ReadUvarint(br)
+		if err != nil || size == 0 || size > chunkSize {
+			return nil, ErrInvalidManifest
+		}
+		c.Size = uint32(size)
+		m.Chunks = append(m.Chunks, c)
+	}
+	return m, nil
+}
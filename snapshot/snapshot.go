@@ -0,0 +1,298 @@
+// Package snapshot provides a backup-style incremental snapshot middleware.
+//
+// The stream written through the middleware is split into fixed-size chunks
+// which are stored in a ChunkStore. Chunks already referenced by the previous
+// snapshot's manifest are not stored again, so only changed chunks are written.
+// The underlying writer receives the new manifest, from which the Reader
+// materializes the full stream using the same chunk store.
+//
+// Chunks of deleted snapshots are reclaimed by wrapping the store with
+// NewGCStore and calling GC with the manifests of the retained snapshots.
+package snapshot
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+const (
+	// FormatVersion is the manifest format version written by this package
+	FormatVersion = 1
+
+	// DefaultChunkSize is the default snapshot chunk size
+	DefaultChunkSize = 1 << 20
+
+	maxChunkSize = 1 << 30
+)
+
+var (
+	// ErrChunkNotFound should be returned by a ChunkStore for unknown hashes
+	ErrChunkNotFound = errors.New("snapshot: chunk not found")
+
+	// ErrChunkMismatch is returned when a stored chunk does not match its hash
+	ErrChunkMismatch = errors.New("snapshot: chunk content does not match hash")
+)
+
+// ChunkStore stores chunks by their content hash.
+// Put must be idempotent, storing the same hash twice is not an error.
+type ChunkStore interface {
+	Put(h Hash, data []byte) error
+	Get(h Hash) ([]byte, error)
+}
+
+// Middleware implements incremental snapshots on top of a ChunkStore
+type Middleware struct {
+	store      ChunkStore
+	chunkSize  int
+	previous   *Manifest
+	onManifest func(*Manifest)
+	policy     middleware.VersionPolicy
+}
+
+// Ensure Middleware implements middleware.Middleware and middleware.Versioned interfaces
+var (
+	_ middleware.Middleware = (*Middleware)(nil)
+	_ middleware.Versioned  = (*Middleware)(nil)
+	_ middleware.ModeSetter = (*Middleware)(nil)
+	_ middleware.Describer  = (*Middleware)(nil)
+	_ middleware.MemoryUser = (*Middleware)(nil)
+)
+
+// Option configures the snapshot middleware
+type Option func(*Middleware)
+
+// WithChunkSize sets the chunk size used for new snapshots
+func WithChunkSize(size int) Option {
+	return func(m *Middleware) {
+		if size > 0 && size <= maxChunkSize {
+			m.chunkSize = size
+		}
+	}
+}
+
+// WithPrevious sets the manifest of the previous snapshot. Chunks referenced
+// by it are assumed to be present in the store and are not written again.
+func WithPrevious(prev *Manifest) Option {
+	return func(m *Middleware) {
+		m.previous = prev
+	}
+}
+
+// WithManifestCallback registers a function receiving the new manifest
+// when a Writer is closed, e.g. to keep it as previous for the next snapshot
+func WithManifestCallback(fn func(*Manifest)) Option {
+	return func(m *Middleware) {
+		m.onManifest = fn
+	}
+}
+
+// WithVersionPolicy sets how the Reader treats manifests with an unknown format version
+func WithVersionPolicy(p middleware.VersionPolicy) Option {
+	return func(m *Middleware) {
+		m.policy = p
+	}
+}
+
+// New creates a new snapshot middleware backed by store
+func New(store ChunkStore, opts ...Option) *Middleware {
+	m := &Middleware{
+		store:     store,
+		chunkSize: DefaultChunkSize,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// FormatVersion returns the manifest format version written by the Writer
+func (m *Middleware) FormatVersion() uint8 {
+	return FormatVersion
+}
+
+// MaxSupportedVersion returns the highest manifest format version the Reader understands
+func (m *Middleware) MaxSupportedVersion() uint8 {
+	return FormatVersion
+}
+
+// MemoryUsage returns the chunk buffer of a Writer or Reader. The chunk
+// size is part of the manifests, so it is not shrunk.
+func (m *Middleware) MemoryUsage() int64 { return int64(m.chunkSize) }
+
+// Describe reports the chunking and the chunk integrity check
+func (m *Middleware) Describe() middleware.Component {
+	return middleware.Component{
+		Type:       "snapshot",
+		Integrity:  "sha-256",
+		Properties: map[string]string{"chunk_size": strconv.Itoa(m.chunkSize)},
+	}
+}
+
+// ForMode returns a copy of the middleware for a chain read mode. Strict
+// rejects unknown manifest versions, lenient reads them on a best effort basis.
+func (m *Middleware) ForMode(mode middleware.ReadMode, _ middleware.Logf) middleware.Middleware {
+	c := *m
+	switch mode {
+	case middleware.StrictMode:
+		c.policy = middleware.RejectUnknown
+	case middleware.LenientMode:
+		c.policy = middleware.BestEffort
+	}
+	return &c
+}
+
+// Writer wraps an io.Writer. Chunks go to the chunk store, the manifest is
+// written to w when the returned writer is closed.
+func (m *Middleware) Writer(w io.Writer) io.Writer {
+	sw := &writer{
+		m:        m,
+		w:        w,
+		buf:      make([]byte, 0, m.chunkSize),
+		manifest: &Manifest{ChunkSize: m.chunkSize},
+		state:    middleware.WriterState{Layer: "snapshot"},
+	}
+	if m.previous != nil {
+		sw.known = m.previous.hashSet()
+	} else {
+		sw.known = make(map[Hash]struct{})
+	}
+	return sw
+}
+
+// Reader reads a manifest from r and materializes the stream from the store
+func (m *Middleware) Reader(r io.Reader) io.Reader {
+	return middleware.HardenLayerReader("snapshot", &reader{store: m.store, src: r, policy: m.policy})
+}
+
+type writer struct {
+	m        *Middleware
+	w        io.Writer
+	buf      []byte
+	manifest *Manifest
+	known    map[Hash]struct{}
+	held     []Hash // chunks referenced in a GCStore until Close
+	state    middleware.WriterState
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flushChunk(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *writer) flushChunk() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	h := HashOf(w.buf)
+	if ref, ok := w.m.store.(referencer); ok {
+		ref.acquire(h)
+		w.held = append(w.held, h)
+	}
+	if _, ok := w.known[h]; !ok {
+		if err := w.m.store.Put(h, append([]byte(nil), w.buf...)); err != nil {
+			return w.state.Fail(fmt.Errorf("snapshot: store chunk %s: %w", h, err))
+		}
+		w.known[h] = struct{}{}
+	}
+	w.manifest.Chunks = append(w.manifest.Chunks, Chunk{Hash: h, Size: uint32(len(w.buf))})
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close stores the final chunk and writes the manifest. Chunk references
+// held in a GCStore are released after the manifest callback returned.
+func (w *writer) Close() error {
+	if ref, ok := w.m.store.(referencer); ok {
+		defer func() {
+			ref.release(w.held)
+			w.held = nil
+		}()
+	}
+	return w.state.Close(func() error {
+		if err := w.flushChunk(); err != nil {
+			return err
+		}
+		if _, err := w.manifest.WriteTo(w.w); err != nil {
+			return err
+		}
+		if w.m.onManifest != nil {
+			w.m.onManifest(w.manifest)
+		}
+		return nil
+	})
+}
+
+type reader struct {
+	store    ChunkStore
+	src      io.Reader
+	br       *bufio.Reader // buffer of src while reading the manifest
+	policy   middleware.VersionPolicy
+	manifest *Manifest
+	next     int    // index of the next chunk to load
+	cur      []byte // unread part of the current chunk
+	err      error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.manifest == nil {
+		r.br = bufio.NewReader(r.src)
+		m, err := readManifest(r.br, r.policy)
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		r.manifest = m
+	}
+	for len(r.cur) == 0 {
+		if r.next >= len(r.manifest.Chunks) {
+			r.err = io.EOF
+			return 0, io.EOF
+		}
+		c := r.manifest.Chunks[r.next]
+		data, err := r.store.Get(c.Hash)
+		if err != nil {
+			r.err = fmt.Errorf("snapshot: load chunk %s: %w", c.Hash, err)
+			return 0, r.err
+		}
+		if len(data) != int(c.Size) || HashOf(data) != c.Hash {
+			r.err = fmt.Errorf("%w: %s", ErrChunkMismatch, c.Hash)
+			return 0, r.err
+		}
+		r.cur = data
+		r.next++
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Buffered returns the number of bytes read ahead of the manifest end,
+// which are trailing data
+func (r *reader) Buffered() int {
+	if r.br == nil {
+		return 0
+	}
+	return r.br.Buffered()
+}
@@ -0,0 +1,128 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware/snapshot"
+	"schneider.vip/hybridbuffer/middleware/snapshot/chunkstore"
+)
+
+func TestRoundTrip(t *testing.T) {
+	store := chunkstore.NewMemory(0)
+	data := bytes.Repeat([]byte("snapshot data "), 10000)
+
+	var manifest *snapshot.Manifest
+	m := snapshot.New(store, snapshot.WithChunkSize(4096), snapshot.WithManifestCallback(func(mf *snapshot.Manifest) {
+		manifest = mf
+	}))
+	var enc bytes.Buffer
+	w := m.Writer(&enc)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if manifest == nil || manifest.Size() != int64(len(data)) {
+		t.Fatalf("manifest size mismatch: %+v", manifest)
+	}
+
+	got, err := io.ReadAll(m.Reader(bytes.NewReader(enc.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("round trip mismatch")
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	in := &snapshot.Manifest{ChunkSize: 1024, Chunks: []snapshot.Chunk{
+		{Hash: snapshot.HashOf([]byte("a")), Size: 1024},
+		{Hash: snapshot.HashOf([]byte("b")), Size: 17},
+	}}
+	enc, err := in.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out snapshot.Manifest
+	if err := out.UnmarshalBinary(enc); err != nil {
+		t.Fatal(err)
+	}
+	if out.ChunkSize != in.ChunkSize || len(out.Chunks) != len(in.Chunks) {
+		t.Fatalf("got %+v, want %+v", out, *in)
+	}
+	for i := range in.Chunks {
+		if out.Chunks[i] != in.Chunks[i] {
+			t.Fatalf("chunk %d: got %+v, want %+v", i, out.Chunks[i], in.Chunks[i])
+		}
+	}
+}
+
+// manifestHeader returns the fixed part of an encoded manifest
+func manifestHeader(chunkSize, count uint64) []byte {
+	b := []byte{'H', 'B', 'S', snapshot.FormatVersion}
+	b = binary.AppendUvarint(b, chunkSize)
+	return binary.AppendUvarint(b, count)
+}
+
+func TestHostileManifest(t *testing.T) {
+	valid, err := (&snapshot.Manifest{ChunkSize: 16, Chunks: []snapshot.Chunk{{Size: 16}}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte("XXX"), valid[3:]...)},
+		{"zero chunk size", manifestHeader(0, 0)},
+		{"huge chunk size", manifestHeader(1<<40, 0)},
+		{"too many chunks", manifestHeader(16, 1<<40)},
+		{"truncated", valid[:len(valid)-1]},
+		{"chunk larger than chunk size", append(append(manifestHeader(16, 1), make([]byte, 32)...), 17)},
+		{"zero size chunk", append(append(manifestHeader(16, 1), make([]byte, 32)...), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := snapshot.ReadManifest(bytes.NewReader(tt.data))
+			if !errors.Is(err, snapshot.ErrInvalidManifest) {
+				t.Fatalf("got %v, want ErrInvalidManifest", err)
+			}
+		})
+	}
+}
+
+func TestHostileManifestCountDoesNotPreallocate(t *testing.T) {
+	// the largest accepted count without any entries must fail without
+	// allocating memory for all of them
+	data := manifestHeader(16, 1<<26)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := snapshot.ReadManifest(bytes.NewReader(data))
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, snapshot.ErrInvalidManifest) {
+		t.Fatalf("got %v, want ErrInvalidManifest", err)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+		t.Fatalf("allocated %d bytes for an empty manifest", alloc)
+	}
+}
+
+func TestReaderRejectsMissingChunk(t *testing.T) {
+	mf := &snapshot.Manifest{ChunkSize: 16, Chunks: []snapshot.Chunk{{Hash: snapshot.HashOf([]byte("missing")), Size: 7}}}
+	enc, err := mf.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := snapshot.New(chunkstore.NewMemory(0))
+	if _, err := io.ReadAll(m.Reader(bytes.NewReader(enc))); err == nil {
+		t.Fatal("expected an error for a chunk missing from the store")
+	}
+}
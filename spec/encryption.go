@@ -0,0 +1,473 @@
+package spec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Key modes of a FormatHeader
+const (
+	KeyModeKey       = 1 // static key, KeyID is its fingerprint
+	KeyModeKDF       = 2 // a KDFHeader follows
+	KeyModeProvider  = 3 // a KeyIDHeader follows for providers with key IDs
+	KeyModeRecipient = 4 // a RecipientHeader with magic RecipientMagic follows
+	KeyModeHybrid    = 5 // a RecipientHeader with magic HybridMagic follows
+)
+
+// FormatHeader is written by the encryption middleware with
+// WithFormatHeader, ahead of all other encryption headers:
+//
+//	"HBF" | version | cipher suite (1) | key mode (1) | key ID length (1) | key ID
+//
+// The key ID of KeyModeKey is the hex encoding of the first 8 bytes of
+// SHA-256("hybridbuffer key fingerprint" | 0x00 | key), empty otherwise.
+// The header is bound like an AuthHeader: the DARE key is
+// HMAC-SHA256(key, "hybridbuffer authenticated header" | 0x00 | header),
+// applied after the AuthHeader binding, over the first six header bytes.
+// The key ID is not bound, as rotating the key wrapping a data key
+// replaces it.
+type FormatHeader struct {
+	CipherSuite uint8
+	KeyMode     uint8
+	KeyID       string
+}
+
+// Magic returns FormatMagic
+func (h *FormatHeader) Magic() [3]byte { return FormatMagic }
+
+// MarshalBinary encodes the header
+func (h *FormatHeader) MarshalBinary() ([]byte, error) {
+	if len(h.KeyID) > 255 {
+		return nil, fmt.Errorf("%w: key ID of %d bytes", ErrInvalidHeader, len(h.KeyID))
+	}
+	b := append(begin(FormatMagic, 7+len(h.KeyID)), h.CipherSuite, h.KeyMode, byte(len(h.KeyID)))
+	return append(b, h.KeyID...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *FormatHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *FormatHeader) decode(b []byte) (int, error) {
+	if err := start(b, FormatMagic, 7); err != nil {
+		return 0, err
+	}
+	id, n, err := lengthPrefixed8(b, 6)
+	if err != nil {
+		return 0, err
+	}
+	h.CipherSuite, h.KeyMode, h.KeyID = b[4], b[5], string(id)
+	return n, nil
+}
+
+// Key derivation functions of a KDFHeader
+const (
+	KDFScrypt = 1 // params: log2(N) (1) | r (uint16) | p (uint16)
+	KDFHKDF   = 2 // params: HKDF-SHA256 info; the secret is the IKM
+	KDFPBKDF2 = 3 // params: hash (1: SHA-1, 2: SHA-256, 3: SHA-512) | iterations (uint32)
+)
+
+// KDFHeader is written by the encryption middleware with a passphrase or
+// HKDF master key:
+//
+//	"HBP" | version | KDF (1) | params length (1) | params | salt length (1) | salt
+//
+// The 32 byte DARE key is the output of the KDF for the secret and salt.
+type KDFHeader struct {
+	KDF    uint8
+	Params []byte
+	Salt   []byte
+}
+
+// Magic returns KDFMagic
+func (h *KDFHeader) Magic() [3]byte { return KDFMagic }
+
+// MarshalBinary encodes the header
+func (h *KDFHeader) MarshalBinary() ([]byte, error) {
+	if len(h.Params) > 255 || len(h.Salt) > 255 {
+		return nil, fmt.Errorf("%w: params or salt longer than 255 bytes", ErrInvalidHeader)
+	}
+	b := append(begin(KDFMagic, 7+len(h.Params)+len(h.Salt)), h.KDF, byte(len(h.Params)))
+	b = append(append(b, h.Params...), byte(len(h.Salt)))
+	return append(b, h.Salt...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *KDFHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *KDFHeader) decode(b []byte) (int, error) {
+	if err := start(b, KDFMagic, 6); err != nil {
+		return 0, err
+	}
+	h.KDF = b[4]
+	params, n, err := lengthPrefixed8(b, 5)
+	if err != nil {
+		return 0, err
+	}
+	salt, n, err := lengthPrefixed8(b, n)
+	if err != nil {
+		return 0, err
+	}
+	h.Params, h.Salt = params, salt
+	return n, nil
+}
+
+// KeyIDHeader is written by the encryption middleware with a key provider
+// that names its keys:
+//
+//	"HBI" | version | key ID length (1) | key ID
+//
+// The DARE key is the provider's key of that ID.
+type KeyIDHeader struct {
+	KeyID string
+}
+
+// Magic returns KeyIDMagic
+func (h *KeyIDHeader) Magic() [3]byte { return KeyIDMagic }
+
+// MarshalBinary encodes the header
+func (h *KeyIDHeader) MarshalBinary() ([]byte, error) {
+	if len(h.KeyID) > 255 {
+		return nil, fmt.Errorf("%w: key ID of %d bytes", ErrInvalidHeader, len(h.KeyID))
+	}
+	return append(append(begin(KeyIDMagic, 5+len(h.KeyID)), byte(len(h.KeyID))), h.KeyID...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *KeyIDHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *KeyIDHeader) decode(b []byte) (int, error) {
+	if err := start(b, KeyIDMagic, 5); err != nil {
+		return 0, err
+	}
+	id, n, err := lengthPrefixed8(b, 4)
+	if err != nil {
+		return 0, err
+	}
+	h.KeyID = string(id)
+	return n, nil
+}
+
+// Key wrapping algorithms of a DataKeyHeader
+const (
+	WrapAESKW  = 1 // AES-256 key wrap (RFC 3394) with the default IV
+	WrapAESGCM = 2 // nonce (12) | AES-256-GCM ciphertext and tag, the first 6 header bytes as associated data
+)
+
+// DataKeyHeader is written by the encryption middleware with WithDataKeys,
+// after any KeyIDHeader:
+//
+//	"HBW" | version | algorithm (1) | wrapped key length (1) | wrapped key
+//
+// The DARE key is the 32 byte data key unwrapped with the configured key.
+type DataKeyHeader struct {
+	Algorithm  uint8
+	WrappedKey []byte
+}
+
+// Magic returns DataKeyMagic
+func (h *DataKeyHeader) Magic() [3]byte { return DataKeyMagic }
+
+// MarshalBinary encodes the header
+func (h *DataKeyHeader) MarshalBinary() ([]byte, error) {
+	if len(h.WrappedKey) > 255 {
+		return nil, fmt.Errorf("%w: wrapped key of %d bytes", ErrInvalidHeader, len(h.WrappedKey))
+	}
+	b := append(begin(DataKeyMagic, 6+len(h.WrappedKey)), h.Algorithm, byte(len(h.WrappedKey)))
+	return append(b, h.WrappedKey...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *DataKeyHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *DataKeyHeader) decode(b []byte) (int, error) {
+	if err := start(b, DataKeyMagic, 6); err != nil {
+		return 0, err
+	}
+	key, n, err := lengthPrefixed8(b, 5)
+	if err != nil {
+		return 0, err
+	}
+	h.Algorithm, h.WrappedKey = b[4], key
+	return n, nil
+}
+
+// Field types of an AuthHeader. Readers must reject unknown types with the
+// critical bit 0x80 set and skip others.
+const (
+	FieldReplayToken = 0x81 // opaque token
+	FieldNotBefore   = 0x82 // Unix seconds (uint64)
+	FieldNotAfter    = 0x83 // Unix seconds (uint64)
+	FieldBufferID    = 0x04 // buffer ID (16)
+)
+
+// AuthField is one type-length-value field of an AuthHeader
+type AuthField struct {
+	Type  uint8
+	Value []byte
+}
+
+// AuthHeader is written by the encryption middleware with replay tokens,
+// validity periods or a buffer ID, after any KDFHeader, KeyIDHeader or
+// RecipientHeader:
+//
+//	"HBA" | version | fields length (uint16) | fields | tag (32)
+//
+// with every field encoded as type (1) | length (uint16) | value. The
+// header is authenticated by the DARE key, which is
+//
+//	HMAC-SHA256(stream key, "hybridbuffer authenticated header" | 0x00 | header)
+//
+// over the header bytes before the tag, and by the tag
+//
+//	HMAC-SHA256(DARE key, "hybridbuffer header tag" | 0x00 | header)
+//
+// computed with the final DARE key, after any FormatHeader and associated
+// data binding. Readers must verify the tag before using any field, as an
+// empty stream has no DARE package.
+type AuthHeader struct {
+	Fields []AuthField
+	Tag    [32]byte
+}
+
+// Magic returns AuthMagic
+func (h *AuthHeader) Magic() [3]byte { return AuthMagic }
+
+// Field returns the value of the first field of a type
+func (h *AuthHeader) Field(typ uint8) ([]byte, bool) {
+	for _, f := range h.Fields {
+		if f.Type == typ {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Time returns the time of a FieldNotBefore or FieldNotAfter field
+func (h *AuthHeader) Time(typ uint8) (time.Time, bool) {
+	v, ok := h.Field(typ)
+	if !ok || len(v) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(binary.BigEndian.Uint64(v)), 0), true
+}
+
+// MarshalBinary encodes the header
+func (h *AuthHeader) MarshalBinary() ([]byte, error) {
+	var body []byte
+	for _, f := range h.Fields {
+		if len(f.Value) > 0xffff {
+			return nil, fmt.Errorf("%w: field of %d bytes", ErrInvalidHeader, len(f.Value))
+		}
+		body = append(body, f.Type)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(f.Value)))
+		body = append(body, f.Value...)
+	}
+	if len(body) > 4096 {
+		return nil, fmt.Errorf("%w: %d bytes of fields, at most 4096", ErrInvalidHeader, len(body))
+	}
+	b := binary.BigEndian.AppendUint16(begin(AuthMagic, 38+len(body)), uint16(len(body)))
+	b = append(b, body...)
+	return append(b, h.Tag[:]...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *AuthHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *AuthHeader) decode(b []byte) (int, error) {
+	if err := start(b, AuthMagic, 6); err != nil {
+		return 0, err
+	}
+	body, n, err := lengthPrefixed16(b, 4)
+	if err != nil {
+		return 0, err
+	}
+	h.Fields = nil
+	for len(body) > 0 {
+		value, end, err := lengthPrefixed16(body, 1)
+		if err != nil {
+			return 0, fmt.Errorf("%w: truncated field", ErrInvalidHeader)
+		}
+		h.Fields = append(h.Fields, AuthField{Type: body[0], Value: value})
+		body = body[end:]
+	}
+	if len(b) < n+32 {
+		return 0, ErrShortHeader
+	}
+	h.Tag = [32]byte(b[n:])
+	return n + 32, nil
+}
+
+// SealedHeader is written by encryption.Sealed:
+//
+//	"HBK" | version | sealed key length (uint16) | sealed key
+//
+// The DARE key is the sealed key unsealed by the KeySealer; its format is
+// defined by the sealer.
+type SealedHeader struct {
+	SealedKey []byte
+}
+
+// Magic returns SealedMagic
+func (h *SealedHeader) Magic() [3]byte { return SealedMagic }
+
+// MarshalBinary encodes the header
+func (h *SealedHeader) MarshalBinary() ([]byte, error) {
+	if len(h.SealedKey) > 4096 {
+		return nil, fmt.Errorf("%w: sealed key of %d bytes", ErrInvalidHeader, len(h.SealedKey))
+	}
+	b := binary.BigEndian.AppendUint16(begin(SealedMagic, 6+len(h.SealedKey)), uint16(len(h.SealedKey)))
+	return append(b, h.SealedKey...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *SealedHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *SealedHeader) decode(b []byte) (int, error) {
+	if err := start(b, SealedMagic, 6); err != nil {
+		return 0, err
+	}
+	key, n, err := lengthPrefixed16(b, 4)
+	if err != nil {
+		return 0, err
+	}
+	h.SealedKey = key
+	return n, nil
+}
+
+// EphemeralHeader is written by encryption.Ephemeral:
+//
+//	"HBE" | version | stream ID (16)
+//
+// The key is only held in the memory of the writing process.
+type EphemeralHeader struct {
+	StreamID [16]byte
+}
+
+// Magic returns EphemeralMagic
+func (h *EphemeralHeader) Magic() [3]byte { return EphemeralMagic }
+
+// MarshalBinary encodes the header
+func (h *EphemeralHeader) MarshalBinary() ([]byte, error) {
+	return append(begin(EphemeralMagic, 20), h.StreamID[:]...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *EphemeralHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *EphemeralHeader) decode(b []byte) (int, error) {
+	if err := start(b, EphemeralMagic, 20); err != nil {
+		return 0, err
+	}
+	h.StreamID = [16]byte(b[4:20])
+	return 20, nil
+}
+
+// SessionHeader is written by encryption.Session:
+//
+//	"HBM" | version | session ID (16) | counter (uint64) | sealed key length (uint16) | sealed session key | tag (32)
+//
+// The DARE key is HKDF-SHA256 with the unsealed session key as IKM, the
+// session ID as salt and "hybridbuffer session stream " followed by the
+// counter (uint64) as info. The tag is computed like the tag of an
+// AuthHeader, with the DARE key over the header bytes before the tag.
+type SessionHeader struct {
+	SessionID [16]byte
+	Counter   uint64
+	SealedKey []byte
+	Tag       [32]byte
+}
+
+// Magic returns SessionMagic
+func (h *SessionHeader) Magic() [3]byte { return SessionMagic }
+
+// MarshalBinary encodes the header
+func (h *SessionHeader) MarshalBinary() ([]byte, error) {
+	if len(h.SealedKey) > 4096 {
+		return nil, fmt.Errorf("%w: sealed key of %d bytes", ErrInvalidHeader, len(h.SealedKey))
+	}
+	b := append(begin(SessionMagic, 62+len(h.SealedKey)), h.SessionID[:]...)
+	b = binary.BigEndian.AppendUint64(b, h.Counter)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(h.SealedKey)))
+	b = append(b, h.SealedKey...)
+	return append(b, h.Tag[:]...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *SessionHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *SessionHeader) decode(b []byte) (int, error) {
+	if err := start(b, SessionMagic, 30); err != nil {
+		return 0, err
+	}
+	key, n, err := lengthPrefixed16(b, 28)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < n+32 {
+		return 0, ErrShortHeader
+	}
+	h.SessionID, h.Counter, h.SealedKey = [16]byte(b[4:20]), binary.BigEndian.Uint64(b[20:]), key
+	h.Tag = [32]byte(b[n:])
+	return n + 32, nil
+}
+
+// MLKEM768CiphertextSize is the size of the ML-KEM-768 ciphertext of a
+// hybrid RecipientHeader
+const MLKEM768CiphertextSize = 1088
+
+// RecipientHeader is written by the encryption middleware encrypting to an
+// X25519 recipient ("HBR") or a hybrid X25519 and ML-KEM-768 recipient
+// ("HBQ"):
+//
+//	"HBR" | version | ephemeral X25519 public key (32)
+//	"HBQ" | version | ephemeral X25519 public key (32) | ML-KEM-768 ciphertext (1088)
+//
+// The DARE key is HKDF-SHA256 with IKM the X25519 shared secret, preceded
+// by the ML-KEM shared secret in hybrid mode, salt the ephemeral public
+// key, the recipient public key and the ML-KEM ciphertext concatenated,
+// and info "hybridbuffer x25519 recipient", respectively
+// "hybridbuffer x25519+mlkem768 recipient".
+type RecipientHeader struct {
+	Ephemeral     [32]byte
+	KEMCiphertext []byte // hybrid mode only
+}
+
+// Magic returns RecipientMagic, or HybridMagic with a KEM ciphertext
+func (h *RecipientHeader) Magic() [3]byte {
+	if h.KEMCiphertext != nil {
+		return HybridMagic
+	}
+	return RecipientMagic
+}
+
+// MarshalBinary encodes the header
+func (h *RecipientHeader) MarshalBinary() ([]byte, error) {
+	if h.KEMCiphertext != nil && len(h.KEMCiphertext) != MLKEM768CiphertextSize {
+		return nil, fmt.Errorf("%w: KEM ciphertext of %d bytes", ErrInvalidHeader, len(h.KEMCiphertext))
+	}
+	b := append(begin(h.Magic(), 36+len(h.KEMCiphertext)), h.Ephemeral[:]...)
+	return append(b, h.KEMCiphertext...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *RecipientHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *RecipientHeader) decode(b []byte) (int, error) {
+	magic := RecipientMagic
+	if len(b) >= 3 && [3]byte(b[:3]) == HybridMagic {
+		magic = HybridMagic
+	}
+	if err := start(b, magic, 36); err != nil {
+		return 0, err
+	}
+	h.Ephemeral, h.KEMCiphertext = [32]byte(b[4:36]), nil
+	if magic == RecipientMagic {
+		return 36, nil
+	}
+	if len(b) < 36+MLKEM768CiphertextSize {
+		return 0, ErrShortHeader
+	}
+	h.KEMCiphertext = b[36 : 36+MLKEM768CiphertextSize]
+	return 36 + MLKEM768CiphertextSize, nil
+}
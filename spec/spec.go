@@ -0,0 +1,528 @@
+// Package spec describes the wire formats written by the middlewares as Go
+// structs, for implementing compatible readers in other languages. Every
+// header has MarshalBinary and UnmarshalBinary methods producing and
+// accepting exactly the bytes the middleware writes, and Vectors returns
+// canonical streams to test other implementations against.
+//
+// Common conventions: every header starts with a three byte magic "HB"
+// followed by a letter and a one byte format version, which is 1 for all
+// formats described here. Integers are big endian. Headers are followed
+// directly by the payload of their layer, which may start with the header
+// of the next layer. Payloads of the encryption middlewares are DARE 2.0
+// packages as written by github.com/minio/sio: a 16 byte header (version
+// 0x20, cipher suite, payload size - 1 as little endian uint16, 12 byte
+// nonce), up to 64 KiB of ciphertext and a 16 byte tag.
+// With associated data configured, the DARE key is
+// HMAC-SHA256(key, "hybridbuffer associated data" | 0x00 | data), applied
+// to the key bound to an AuthHeader and FormatHeader if there are any.
+//
+// The layouts of snapshot manifests and catalogs are documented in their
+// packages.
+package spec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Version is the format version of every header described here
+const Version = 1
+
+// Cipher suites of DARE packages
+const (
+	AES256GCM        = 0x00
+	ChaCha20Poly1305 = 0x01
+)
+
+var (
+	// ErrUnknownHeader is returned by ParseHeader for prefixes without a
+	// known magic
+	ErrUnknownHeader = errors.New("spec: unknown header")
+
+	// ErrShortHeader is returned for truncated headers
+	ErrShortHeader = errors.New("spec: header truncated")
+
+	// ErrInvalidHeader is returned for headers violating their layout
+	ErrInvalidHeader = errors.New("spec: invalid header")
+)
+
+// Header is implemented by all header structs
+type Header interface {
+	// Magic returns the three magic bytes of the header
+	Magic() [3]byte
+
+	// MarshalBinary encodes the header
+	MarshalBinary() ([]byte, error)
+
+	// UnmarshalBinary decodes exactly one header
+	UnmarshalBinary(b []byte) error
+
+	// decode decodes a header at the start of b and returns its size
+	decode(b []byte) (int, error)
+}
+
+// Magics of the headers
+var (
+	DynamicMagic   = [3]byte{'H', 'B', 'D'}
+	LayersMagic    = [3]byte{'H', 'B', 'N'}
+	BufferIDMagic  = [3]byte{'H', 'B', 'U'}
+	HeaderCRCMagic = [3]byte{'H', 'B', 'H'}
+	ChecksumMagic  = [3]byte{'H', 'B', 'C'}
+	XorSplitMagic  = [3]byte{'H', 'B', 'X'}
+	FormatMagic    = [3]byte{'H', 'B', 'F'}
+	KDFMagic       = [3]byte{'H', 'B', 'P'}
+	KeyIDMagic     = [3]byte{'H', 'B', 'I'}
+	DataKeyMagic   = [3]byte{'H', 'B', 'W'}
+	AuthMagic      = [3]byte{'H', 'B', 'A'}
+	SealedMagic    = [3]byte{'H', 'B', 'K'}
+	EphemeralMagic = [3]byte{'H', 'B', 'E'}
+	SessionMagic   = [3]byte{'H', 'B', 'M'}
+	RecipientMagic = [3]byte{'H', 'B', 'R'}
+	HybridMagic    = [3]byte{'H', 'B', 'Q'}
+	CTRHMACMagic   = [3]byte{'H', 'B', 'L'}
+	SIVMagic       = [3]byte{'H', 'B', 'V'}
+
+	SecureCompressMagic = [3]byte{'H', 'B', 'Z'}
+)
+
+// ParseHeader decodes the header at the start of prefix and returns it
+// with its size, so nested headers can be parsed from prefix[n:]
+func ParseHeader(prefix []byte) (Header, int, error) {
+	if len(prefix) < 4 {
+		return nil, 0, ErrShortHeader
+	}
+	var h Header
+	switch [3]byte(prefix[:3]) {
+	case DynamicMagic:
+		h = &DynamicHeader{}
+	case LayersMagic:
+		h = &LayersHeader{}
+	case BufferIDMagic:
+		h = &BufferIDHeader{}
+	case HeaderCRCMagic:
+		h = &HeaderFrame{}
+	case ChecksumMagic:
+		h = &ChecksumHeader{}
+	case XorSplitMagic:
+		h = &XorSplitHeader{}
+	case FormatMagic:
+		h = &FormatHeader{}
+	case KDFMagic:
+		h = &KDFHeader{}
+	case KeyIDMagic:
+		h = &KeyIDHeader{}
+	case DataKeyMagic:
+		h = &DataKeyHeader{}
+	case AuthMagic:
+		h = &AuthHeader{}
+	case SealedMagic:
+		h = &SealedHeader{}
+	case EphemeralMagic:
+		h = &EphemeralHeader{}
+	case SessionMagic:
+		h = &SessionHeader{}
+	case RecipientMagic, HybridMagic:
+		h = &RecipientHeader{}
+	case CTRHMACMagic:
+		h = &CTRHMACHeader{}
+	case SIVMagic:
+		h = &SIVHeader{}
+	case SecureCompressMagic:
+		h = &SecureCompressHeader{}
+	default:
+		return nil, 0, fmt.Errorf("%w: magic %q", ErrUnknownHeader, prefix[:3])
+	}
+	n, err := h.decode(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h, n, nil
+}
+
+// start checks the magic and version of b
+func start(b []byte, magic [3]byte, fixed int) error {
+	if len(b) < fixed {
+		return ErrShortHeader
+	}
+	if [3]byte(b[:3]) != magic {
+		return fmt.Errorf("%w: magic %q, want %q", ErrInvalidHeader, b[:3], magic[:])
+	}
+	if b[3] != Version {
+		return fmt.Errorf("%w: version %d", ErrInvalidHeader, b[3])
+	}
+	return nil
+}
+
+// begin returns a new header of magic and version
+func begin(magic [3]byte, size int) []byte {
+	return append(append(make([]byte, 0, size), magic[:]...), Version)
+}
+
+// unmarshalExact decodes a header that must span all of b
+func unmarshalExact(h Header, b []byte) error {
+	n, err := h.decode(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidHeader, len(b)-n)
+	}
+	return nil
+}
+
+// lengthPrefixed8 reads a field with a one byte length at b[off]
+func lengthPrefixed8(b []byte, off int) ([]byte, int, error) {
+	if len(b) < off+1 || len(b) < off+1+int(b[off]) {
+		return nil, 0, ErrShortHeader
+	}
+	end := off + 1 + int(b[off])
+	return b[off+1 : end], end, nil
+}
+
+// lengthPrefixed16 reads a field with a uint16 length at b[off]
+func lengthPrefixed16(b []byte, off int) ([]byte, int, error) {
+	if len(b) < off+2 {
+		return nil, 0, ErrShortHeader
+	}
+	end := off + 2 + int(binary.BigEndian.Uint16(b[off:]))
+	if len(b) < end {
+		return nil, 0, ErrShortHeader
+	}
+	return b[off+2 : end], end, nil
+}
+
+// DynamicHeader is written by middleware.Dynamic ahead of the layers of
+// the chosen variant:
+//
+//	"HBD" | version | name length (1) | variant name
+type DynamicHeader struct {
+	Variant string
+}
+
+// Magic returns DynamicMagic
+func (h *DynamicHeader) Magic() [3]byte { return DynamicMagic }
+
+// MarshalBinary encodes the header
+func (h *DynamicHeader) MarshalBinary() ([]byte, error) {
+	if len(h.Variant) > 255 {
+		return nil, fmt.Errorf("%w: variant name of %d bytes", ErrInvalidHeader, len(h.Variant))
+	}
+	b := begin(DynamicMagic, 5+len(h.Variant))
+	return append(append(b, byte(len(h.Variant))), h.Variant...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *DynamicHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *DynamicHeader) decode(b []byte) (int, error) {
+	if err := start(b, DynamicMagic, 5); err != nil {
+		return 0, err
+	}
+	name, n, err := lengthPrefixed8(b, 4)
+	if err != nil {
+		return 0, err
+	}
+	h.Variant = string(name)
+	return n, nil
+}
+
+// LayersHeader is written by a middleware.Chain ahead of streams written
+// while a layer was disabled with SetEnabled:
+//
+//	"HBN" | version | layer count (1) | enabled layers (bitmap, (count+7)/8 bytes)
+//
+// Bit i%8 of byte i/8 is set if layer i, counted from the plaintext side,
+// was enabled; unused bits are zero. Streams without the header were
+// written with all layers of the chain.
+type LayersHeader struct {
+	Enabled []bool
+}
+
+// Magic returns LayersMagic
+func (h *LayersHeader) Magic() [3]byte { return LayersMagic }
+
+// MarshalBinary encodes the header
+func (h *LayersHeader) MarshalBinary() ([]byte, error) {
+	if len(h.Enabled) > 255 {
+		return nil, fmt.Errorf("%w: %d layers", ErrInvalidHeader, len(h.Enabled))
+	}
+	b := append(begin(LayersMagic, 5+(len(h.Enabled)+7)/8), byte(len(h.Enabled)))
+	b = append(b, make([]byte, (len(h.Enabled)+7)/8)...)
+	for i, on := range h.Enabled {
+		if on {
+			b[5+i/8] |= 1 << (i % 8)
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *LayersHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *LayersHeader) decode(b []byte) (int, error) {
+	if err := start(b, LayersMagic, 5); err != nil {
+		return 0, err
+	}
+	count := int(b[4])
+	n := 5 + (count+7)/8
+	if len(b) < n {
+		return 0, ErrShortHeader
+	}
+	h.Enabled = make([]bool, count)
+	for i := range h.Enabled {
+		h.Enabled[i] = b[5+i/8]&(1<<(i%8)) != 0
+	}
+	if count%8 != 0 && b[n-1]>>(count%8) != 0 {
+		return 0, fmt.Errorf("%w: unused layer bits set", ErrInvalidHeader)
+	}
+	return n, nil
+}
+
+// BufferIDHeader is written by middleware.BufferIDHeader:
+//
+//	"HBU" | version | buffer ID (16, a UUID)
+type BufferIDHeader struct {
+	ID [16]byte
+}
+
+// Magic returns BufferIDMagic
+func (h *BufferIDHeader) Magic() [3]byte { return BufferIDMagic }
+
+// MarshalBinary encodes the header
+func (h *BufferIDHeader) MarshalBinary() ([]byte, error) {
+	return append(begin(BufferIDMagic, 20), h.ID[:]...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *BufferIDHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *BufferIDHeader) decode(b []byte) (int, error) {
+	if err := start(b, BufferIDMagic, 20); err != nil {
+		return 0, err
+	}
+	h.ID = [16]byte(b[4:20])
+	return 20, nil
+}
+
+// HeaderFrame is written by middleware.ProtectHeader around the headers
+// of the protected layer:
+//
+//	"HBH" | version | header length (uint32) | header | CRC-32C (uint32)
+//
+// The CRC (Castagnoli polynomial) covers all bytes before it. The layer's
+// payload follows the frame.
+type HeaderFrame struct {
+	Header []byte
+}
+
+// Magic returns HeaderCRCMagic
+func (h *HeaderFrame) Magic() [3]byte { return HeaderCRCMagic }
+
+// MarshalBinary encodes the frame and computes its CRC
+func (h *HeaderFrame) MarshalBinary() ([]byte, error) {
+	b := begin(HeaderCRCMagic, 12+len(h.Header))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(h.Header)))
+	b = append(b, h.Header...)
+	return binary.BigEndian.AppendUint32(b, crc32.Checksum(b, crc32.MakeTable(crc32.Castagnoli))), nil
+}
+
+// UnmarshalBinary decodes the frame and verifies its CRC
+func (h *HeaderFrame) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *HeaderFrame) decode(b []byte) (int, error) {
+	if err := start(b, HeaderCRCMagic, 8); err != nil {
+		return 0, err
+	}
+	end := 8 + int(binary.BigEndian.Uint32(b[4:]))
+	if end < 8 || len(b) < end+4 {
+		return 0, ErrShortHeader
+	}
+	if crc32.Checksum(b[:end], crc32.MakeTable(crc32.Castagnoli)) != binary.BigEndian.Uint32(b[end:]) {
+		return 0, fmt.Errorf("%w: CRC mismatch", ErrInvalidHeader)
+	}
+	h.Header = b[8:end]
+	return end + 4, nil
+}
+
+// Checksum algorithms
+const (
+	ChecksumSHA256 = 1
+	ChecksumSHA512 = 2
+	ChecksumCRC32C = 3
+)
+
+// ChecksumHeader is written by the checksum middleware:
+//
+//	"HBC" | version | flags (1) | algorithm (1) | digest size (1) | digest
+//
+// Flag 1 marks header placement, where the digest of the payload is part
+// of the header. In trailer placement the header ends after the digest
+// size and the digest follows the payload as its last digest size bytes.
+// CRC-32C digests are big endian.
+type ChecksumHeader struct {
+	HeaderPlacement bool
+	Algorithm       uint8
+	DigestSize      uint8
+	Digest          []byte // header placement only
+}
+
+// Magic returns ChecksumMagic
+func (h *ChecksumHeader) Magic() [3]byte { return ChecksumMagic }
+
+// MarshalBinary encodes the header
+func (h *ChecksumHeader) MarshalBinary() ([]byte, error) {
+	if h.HeaderPlacement != (len(h.Digest) > 0) || h.HeaderPlacement && len(h.Digest) != int(h.DigestSize) {
+		return nil, fmt.Errorf("%w: digest of %d bytes", ErrInvalidHeader, len(h.Digest))
+	}
+	var flags byte
+	if h.HeaderPlacement {
+		flags = 1
+	}
+	b := append(begin(ChecksumMagic, 7+len(h.Digest)), flags, h.Algorithm, h.DigestSize)
+	return append(b, h.Digest...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *ChecksumHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *ChecksumHeader) decode(b []byte) (int, error) {
+	if err := start(b, ChecksumMagic, 7); err != nil {
+		return 0, err
+	}
+	h.HeaderPlacement = b[4]&1 != 0
+	h.Algorithm, h.DigestSize, h.Digest = b[5], b[6], nil
+	if !h.HeaderPlacement {
+		return 7, nil
+	}
+	if len(b) < 7+int(h.DigestSize) {
+		return 0, ErrShortHeader
+	}
+	h.Digest = b[7 : 7+int(h.DigestSize)]
+	return 7 + int(h.DigestSize), nil
+}
+
+// XorSplitHeader starts every share written by xorsplit:
+//
+//	"HBX" | version | share index (1) | share count (1) | stream ID (16)
+//
+// The plaintext is the XOR of the payloads of all shares.
+type XorSplitHeader struct {
+	Index    uint8
+	Count    uint8
+	StreamID [16]byte
+}
+
+// Magic returns XorSplitMagic
+func (h *XorSplitHeader) Magic() [3]byte { return XorSplitMagic }
+
+// MarshalBinary encodes the header
+func (h *XorSplitHeader) MarshalBinary() ([]byte, error) {
+	return append(append(begin(XorSplitMagic, 22), h.Index, h.Count), h.StreamID[:]...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *XorSplitHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *XorSplitHeader) decode(b []byte) (int, error) {
+	if err := start(b, XorSplitMagic, 22); err != nil {
+		return 0, err
+	}
+	h.Index, h.Count, h.StreamID = b[4], b[5], [16]byte(b[6:22])
+	return 22, nil
+}
+
+// CTRHMACHeader starts streams of the ctrhmac middleware:
+//
+//	"HBL" | version | segment size (uint32) | IV (16)
+//
+// See the ctrhmac package for the segment layout.
+type CTRHMACHeader struct {
+	SegmentSize uint32
+	IV          [16]byte
+}
+
+// Magic returns CTRHMACMagic
+func (h *CTRHMACHeader) Magic() [3]byte { return CTRHMACMagic }
+
+// MarshalBinary encodes the header
+func (h *CTRHMACHeader) MarshalBinary() ([]byte, error) {
+	b := binary.BigEndian.AppendUint32(begin(CTRHMACMagic, 24), h.SegmentSize)
+	return append(b, h.IV[:]...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *CTRHMACHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *CTRHMACHeader) decode(b []byte) (int, error) {
+	if err := start(b, CTRHMACMagic, 24); err != nil {
+		return 0, err
+	}
+	h.SegmentSize, h.IV = binary.BigEndian.Uint32(b[4:]), [16]byte(b[8:24])
+	return 24, nil
+}
+
+// SIVHeader starts streams of the siv middleware:
+//
+//	"HBV" | version | nonce (16)
+//
+// It is followed by the 16 byte synthetic IV and the AES-CTR ciphertext.
+// The associated data of AES-SIV are the configured data, empty if none,
+// and the 20 header bytes, in that order.
+type SIVHeader struct {
+	Nonce [16]byte
+}
+
+// Magic returns SIVMagic
+func (h *SIVHeader) Magic() [3]byte { return SIVMagic }
+
+// MarshalBinary encodes the header
+func (h *SIVHeader) MarshalBinary() ([]byte, error) {
+	return append(begin(SIVMagic, 20), h.Nonce[:]...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *SIVHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *SIVHeader) decode(b []byte) (int, error) {
+	if err := start(b, SIVMagic, 20); err != nil {
+		return 0, err
+	}
+	h.Nonce = [16]byte(b[4:20])
+	return 20, nil
+}
+
+// SecureCompressHeader starts streams of the securecompress middleware:
+//
+//	"HBZ" | version | cipher suite (1) | chunk size (uint32) | salt (16)
+//
+// It is followed by frames of a length (uint32, top bit set for the last
+// frame) and a sealed chunk; the package documentation of securecompress
+// describes the key derivation, nonces and chunk modes.
+type SecureCompressHeader struct {
+	CipherSuite uint8
+	ChunkSize   uint32
+	Salt        [16]byte
+}
+
+// Magic returns SecureCompressMagic
+func (h *SecureCompressHeader) Magic() [3]byte { return SecureCompressMagic }
+
+// MarshalBinary encodes the header
+func (h *SecureCompressHeader) MarshalBinary() ([]byte, error) {
+	b := append(begin(SecureCompressMagic, 25), h.CipherSuite)
+	b = binary.BigEndian.AppendUint32(b, h.ChunkSize)
+	return append(b, h.Salt[:]...), nil
+}
+
+// UnmarshalBinary decodes the header
+func (h *SecureCompressHeader) UnmarshalBinary(b []byte) error { return unmarshalExact(h, b) }
+
+func (h *SecureCompressHeader) decode(b []byte) (int, error) {
+	if err := start(b, SecureCompressMagic, 25); err != nil {
+		return 0, err
+	}
+	h.CipherSuite, h.ChunkSize, h.Salt = b[4], binary.BigEndian.Uint32(b[5:]), [16]byte(b[9:25])
+	return 25, nil
+}
@@ -0,0 +1,284 @@
+package spec_test
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/minio/sio"
+
+	"schneider.vip/hybridbuffer/middleware/spec"
+)
+
+// headers has one populated header of every type
+var headers = []spec.Header{
+	&spec.DynamicHeader{Variant: "fast"},
+	&spec.LayersHeader{Enabled: []bool{false, true, true, false, true, true, true, true, false, true}},
+	&spec.BufferIDHeader{ID: [16]byte{1, 2, 3}},
+	&spec.HeaderFrame{Header: []byte("HBC\x01\x00\x01\x20")},
+	&spec.ChecksumHeader{Algorithm: spec.ChecksumSHA256, DigestSize: 32},
+	&spec.ChecksumHeader{HeaderPlacement: true, Algorithm: spec.ChecksumCRC32C, DigestSize: 4, Digest: []byte{1, 2, 3, 4}},
+	&spec.XorSplitHeader{Index: 1, Count: 3, StreamID: [16]byte{9}},
+	&spec.FormatHeader{CipherSuite: spec.ChaCha20Poly1305, KeyMode: spec.KeyModeKey, KeyID: "0123456789abcdef"},
+	&spec.KDFHeader{KDF: spec.KDFPBKDF2, Params: []byte{2, 0, 0, 3, 0xe8}, Salt: make([]byte, 32)},
+	&spec.KeyIDHeader{KeyID: "projects/p/keys/k"},
+	&spec.DataKeyHeader{Algorithm: spec.WrapAESKW, WrappedKey: make([]byte, 40)},
+	&spec.AuthHeader{Fields: []spec.AuthField{{Type: spec.FieldReplayToken, Value: []byte("t")}, {Type: 0x10, Value: []byte{}}}, Tag: [32]byte{7}},
+	&spec.SealedHeader{SealedKey: []byte("sealed")},
+	&spec.EphemeralHeader{StreamID: [16]byte{5}},
+	&spec.SessionHeader{SessionID: [16]byte{4}, Counter: 1 << 40, SealedKey: []byte("session"), Tag: [32]byte{8}},
+	&spec.RecipientHeader{Ephemeral: [32]byte{3}},
+	&spec.RecipientHeader{Ephemeral: [32]byte{3}, KEMCiphertext: make([]byte, spec.MLKEM768CiphertextSize)},
+	&spec.CTRHMACHeader{SegmentSize: 1 << 16, IV: [16]byte{6}},
+	&spec.SIVHeader{Nonce: [16]byte{2}},
+	&spec.SecureCompressHeader{CipherSuite: spec.AES256GCM, ChunkSize: 1 << 20, Salt: [16]byte{1}},
+}
+
+func TestHeaderEncoding(t *testing.T) {
+	for _, h := range headers {
+		b, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T: %v", h, err)
+		}
+		magic := h.Magic()
+		if !bytes.HasPrefix(b, append(magic[:], spec.Version)) {
+			t.Fatalf("%T: starts with %q", h, b[:4])
+		}
+
+		// ParseHeader stops at the end of the header
+		parsed, n, err := spec.ParseHeader(append(bytes.Clone(b), "payload"...))
+		if err != nil || n != len(b) {
+			t.Fatalf("%T: parsed %d of %d bytes: %v", h, n, len(b), err)
+		}
+		if !reflect.DeepEqual(parsed, h) {
+			t.Fatalf("%T: parsed %+v, want %+v", h, parsed, h)
+		}
+
+		// UnmarshalBinary takes exactly one header
+		fresh := reflect.New(reflect.TypeOf(h).Elem()).Interface().(spec.Header)
+		if err := fresh.UnmarshalBinary(b); err != nil || !reflect.DeepEqual(fresh, h) {
+			t.Fatalf("%T: unmarshaled %+v: %v", h, fresh, err)
+		}
+		if err := fresh.UnmarshalBinary(append(bytes.Clone(b), 0)); !errors.Is(err, spec.ErrInvalidHeader) {
+			t.Fatalf("%T: trailing byte: got %v, want ErrInvalidHeader", h, err)
+		}
+		for i := range b {
+			if _, _, err := spec.ParseHeader(b[:i]); !errors.Is(err, spec.ErrShortHeader) {
+				t.Fatalf("%T: truncated to %d bytes: got %v, want ErrShortHeader", h, i, err)
+			}
+		}
+	}
+}
+
+func TestParseHeaderErrors(t *testing.T) {
+	frame, _ := (&spec.HeaderFrame{Header: []byte("HBU\x01")}).MarshalBinary()
+	auth, _ := (&spec.AuthHeader{Fields: []spec.AuthField{{Type: spec.FieldNotBefore, Value: make([]byte, 8)}}}).MarshalBinary()
+	modify := func(b []byte, f func(b []byte)) []byte {
+		b = bytes.Clone(b)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name   string
+		prefix []byte
+		want   error
+	}{
+		{"unknown magic", []byte("HBY\x01\x00"), spec.ErrUnknownHeader},
+		{"no magic", []byte("PK\x03\x04"), spec.ErrUnknownHeader},
+		{"version", []byte("HBD\x02\x00"), spec.ErrInvalidHeader},
+		{"unused layer bits", []byte("HBN\x01\x03\x0f"), spec.ErrInvalidHeader},
+		{"frame CRC", modify(frame, func(b []byte) { b[len(b)-1] ^= 1 }), spec.ErrInvalidHeader},
+		{"framed header changed", modify(frame, func(b []byte) { b[8] = 'X' }), spec.ErrInvalidHeader},
+		{"frame length", modify(frame, func(b []byte) { b[4] = 0xff }), spec.ErrShortHeader},
+		{"auth field truncated", modify(auth, func(b []byte) { b[8]++ }), spec.ErrInvalidHeader},
+		{"hybrid recipient short", append([]byte("HBQ\x01"), make([]byte, 100)...), spec.ErrShortHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := spec.ParseHeader(tt.prefix); !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalLimits(t *testing.T) {
+	long := strings.Repeat("x", 256)
+	tests := []struct {
+		name string
+		h    spec.Header
+	}{
+		{"variant name", &spec.DynamicHeader{Variant: long}},
+		{"key ID", &spec.KeyIDHeader{KeyID: long}},
+		{"format key ID", &spec.FormatHeader{KeyID: long}},
+		{"KDF salt", &spec.KDFHeader{Salt: []byte(long)}},
+		{"wrapped key", &spec.DataKeyHeader{WrappedKey: []byte(long)}},
+		{"auth fields", &spec.AuthHeader{Fields: []spec.AuthField{{Value: make([]byte, 4094)}}}},
+		{"sealed key", &spec.SealedHeader{SealedKey: make([]byte, 4097)}},
+		{"digest in trailer placement", &spec.ChecksumHeader{DigestSize: 4, Digest: []byte{1, 2, 3, 4}}},
+		{"digest size", &spec.ChecksumHeader{HeaderPlacement: true, DigestSize: 32, Digest: []byte{1}}},
+		{"KEM ciphertext", &spec.RecipientHeader{KEMCiphertext: make([]byte, 32)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.h.MarshalBinary(); !errors.Is(err, spec.ErrInvalidHeader) {
+				t.Fatalf("got %v, want ErrInvalidHeader", err)
+			}
+		})
+	}
+}
+
+func vectors(t *testing.T) map[string]spec.Vector {
+	t.Helper()
+	list, err := spec.Vectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]spec.Vector)
+	for _, v := range list {
+		m[v.Name] = v
+	}
+	return m
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func mac(key []byte, label string, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func TestVectorsDeterministic(t *testing.T) {
+	a, err := spec.Vectors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := spec.Vectors()
+	if !reflect.DeepEqual(a, b) {
+		t.Fatal("vectors differ between calls")
+	}
+
+	var buf bytes.Buffer
+	if err := spec.WriteVectors(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var written []spec.Vector
+	if err := json.Unmarshal(buf.Bytes(), &written); err != nil || !reflect.DeepEqual(written, a) {
+		t.Fatalf("written vectors differ: %v", err)
+	}
+}
+
+// TestVectorsFollowSpec decodes vectors with the layouts documented in the
+// package, without the middlewares that wrote them
+func TestVectorsFollowSpec(t *testing.T) {
+	vs := vectors(t)
+	dare := func(t *testing.T, key, payload []byte) []byte {
+		t.Helper()
+		plain, err := sio.DecryptBuffer(nil, payload, sio.Config{Key: key, MinVersion: sio.Version20,
+			CipherSuites: []byte{sio.AES_256_GCM, sio.CHACHA20_POLY1305}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plain
+	}
+
+	for _, name := range []string{"encryption-aes256gcm", "encryption-aes256gcm-multipackage", "encryption-chacha20poly1305"} {
+		v, ok := vs[name]
+		if !ok {
+			continue // cipher not available
+		}
+		enc := decodeHex(t, v.Encoded)
+		if got := dare(t, decodeHex(t, v.Params["key"]), enc); !bytes.Equal(got, decodeHex(t, v.Plaintext)) {
+			t.Fatalf("%s: plaintext differs", name)
+		}
+		if name == "encryption-aes256gcm-multipackage" && (enc[16+64<<10+16] != 0x20 || enc[16+64<<10+16+2] != 0) {
+			t.Fatalf("%s: second package header % x", name, enc[16+64<<10+16:][:4])
+		}
+	}
+
+	if v, ok := vs["encryption-auth-header"]; ok {
+		enc := decodeHex(t, v.Encoded)
+		h, n, err := spec.ParseHeader(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth := h.(*spec.AuthHeader)
+		if nb, _ := auth.Time(spec.FieldNotBefore); nb.Unix() != 1700000000 {
+			t.Fatalf("not before %v", nb)
+		}
+		if id, _ := auth.Field(spec.FieldBufferID); hex.EncodeToString(id) != strings.ReplaceAll(v.Params["buffer_id"], "-", "") {
+			t.Fatalf("buffer ID %x", id)
+		}
+		key := mac(decodeHex(t, v.Params["key"]), "hybridbuffer authenticated header", enc[:n-32])
+		if !hmac.Equal(mac(key, "hybridbuffer header tag", enc[:n-32]), auth.Tag[:]) {
+			t.Fatal("tag does not match")
+		}
+		if got := dare(t, key, enc[n:]); !bytes.Equal(got, decodeHex(t, v.Plaintext)) {
+			t.Fatal("auth header: plaintext differs")
+		}
+	}
+
+	if v, ok := vs["encryption-format-header"]; ok {
+		enc := decodeHex(t, v.Encoded)
+		h, n, err := spec.ParseHeader(enc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		format := h.(*spec.FormatHeader)
+		key := decodeHex(t, v.Params["key"])
+		fp := sha256.Sum256(append([]byte("hybridbuffer key fingerprint\x00"), key...))
+		if format.CipherSuite != spec.ChaCha20Poly1305 || format.KeyMode != spec.KeyModeKey || format.KeyID != hex.EncodeToString(fp[:8]) {
+			t.Fatalf("format header %+v", format)
+		}
+		if got := dare(t, mac(key, "hybridbuffer authenticated header", enc[:6]), enc[n:]); !bytes.Equal(got, decodeHex(t, v.Plaintext)) {
+			t.Fatal("format header: plaintext differs")
+		}
+	}
+
+	for _, name := range []string{"checksum-sha256-trailer", "headercrc-checksum"} {
+		enc := decodeHex(t, vs[name].Encoded)
+		h, n, err := spec.ParseHeader(enc)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if frame, ok := h.(*spec.HeaderFrame); ok {
+			if h, _, err = spec.ParseHeader(frame.Header); err != nil {
+				t.Fatalf("%s: framed header: %v", name, err)
+			}
+		}
+		sum := h.(*spec.ChecksumHeader)
+		payload, digest := enc[n:len(enc)-int(sum.DigestSize)], enc[len(enc)-int(sum.DigestSize):]
+		if want := sha256.Sum256(payload); sum.Algorithm != spec.ChecksumSHA256 || !bytes.Equal(digest, want[:]) {
+			t.Fatalf("%s: header %+v, digest %x", name, sum, digest)
+		}
+		if !bytes.Equal(payload, decodeHex(t, vs[name].Plaintext)) {
+			t.Fatalf("%s: payload differs", name)
+		}
+	}
+
+	// every other vector starts with a header of the package
+	for name, v := range vs {
+		if strings.HasPrefix(name, "encryption-aes") || strings.HasPrefix(name, "encryption-chacha") {
+			continue
+		}
+		if _, _, err := spec.ParseHeader(decodeHex(t, v.Encoded)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package spec
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/checksum"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+	"schneider.vip/hybridbuffer/middleware/encryption/ctrhmac"
+	"schneider.vip/hybridbuffer/middleware/encryption/siv"
+)
+
+// Vector is a canonical stream written by a middleware. Readers in other
+// languages should decode Encoded into Plaintext with the parameters, and
+// reject it after flipping any byte.
+type Vector struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Params      map[string]string `json:"params,omitempty"`
+	Plaintext   string            `json:"plaintext"` // hex
+	Encoded     string            `json:"encoded"`   // hex
+}
+
+// vectorSeed seeds the random source of every vector, so nonces and salts
+// are the same on each run
+var vectorSeed = [32]byte([]byte("hybridbuffer spec test vectors!!"))
+
+type vectorCase struct {
+	name, description string
+	params            map[string]string
+	plaintext         []byte
+	ctx               context.Context
+	layer             func(rand io.Reader) (middleware.Middleware, error)
+}
+
+// Vectors returns the canonical test vectors. Ciphers not available in
+// this build are left out.
+func Vectors() ([]Vector, error) {
+	key := make([]byte, 32)
+	longKey := make([]byte, 64)
+	for i := range longKey {
+		longKey[i] = byte(i)
+	}
+	copy(key, longKey)
+	short := []byte("The quick brown fox jumps over the lazy dog")
+	long := make([]byte, 64<<10+1)
+	for i := range long {
+		long[i] = byte(i % 251)
+	}
+	notBefore, notAfter := time.Unix(1700000000, 0), time.Unix(1900000000, 0)
+	id := middleware.BufferID{0x6b, 0xa7, 0xb8, 0x10, 0x9d, 0xad, 0x41, 0xd1, 0x80, 0xb4, 0x00, 0xc0, 0x4f, 0xd4, 0x30, 0xc8}
+	hexKey := hex.EncodeToString(key)
+
+	encrypt := func(opts ...encryption.Option) func(io.Reader) (middleware.Middleware, error) {
+		return func(r io.Reader) (middleware.Middleware, error) {
+			return encryption.NewE(append(opts, encryption.WithRand(r))...)
+		}
+	}
+	cases := []vectorCase{{
+		name:        "encryption-aes256gcm",
+		description: "DARE packages with AES-256-GCM under a static key, no header",
+		params:      map[string]string{"key": hexKey, "cipher": "AES-256-GCM"},
+		plaintext:   short,
+		layer:       encrypt(encryption.WithKey(key), encryption.WithCipher(AES256GCM)),
+	}, {
+		name:        "encryption-aes256gcm-multipackage",
+		description: "two DARE packages, the second holding a single byte",
+		params:      map[string]string{"key": hexKey, "cipher": "AES-256-GCM"},
+		plaintext:   long,
+		layer:       encrypt(encryption.WithKey(key), encryption.WithCipher(AES256GCM)),
+	}, {
+		name:        "encryption-chacha20poly1305",
+		description: "DARE packages with ChaCha20-Poly1305 under a static key, no header",
+		params:      map[string]string{"key": hexKey, "cipher": "ChaCha20-Poly1305"},
+		plaintext:   short,
+		layer:       encrypt(encryption.WithKey(key), encryption.WithCipher(ChaCha20Poly1305)),
+	}, {
+		name:        "encryption-pbkdf2",
+		description: "KDFHeader with PBKDF2-SHA256 and a random salt, then DARE packages with AES-256-GCM",
+		params:      map[string]string{"passphrase": "correct horse battery staple", "cipher": "AES-256-GCM"},
+		plaintext:   short,
+		layer: encrypt(encryption.WithPBKDF2([]byte("correct horse battery staple"), nil, 1000, encryption.PBKDF2SHA256),
+			encryption.WithCipher(AES256GCM)),
+	}, {
+		name:        "encryption-auth-header",
+		description: "AuthHeader with validity period, buffer ID and tag, then DARE packages keyed by the header HMAC",
+		params: map[string]string{"key": hexKey, "cipher": "AES-256-GCM",
+			"not_before": strconv.FormatInt(notBefore.Unix(), 10), "not_after": strconv.FormatInt(notAfter.Unix(), 10),
+			"buffer_id": id.String()},
+		plaintext: short,
+		ctx:       middleware.WithBufferID(context.Background(), id),
+		layer: encrypt(encryption.WithKey(key), encryption.WithCipher(AES256GCM),
+			encryption.WithValidity(notBefore, notAfter)),
+	}, {
+		name:        "encryption-data-key",
+		description: "DataKeyHeader with a random data key wrapped by AES key wrap, then DARE packages under the data key",
+		params:      map[string]string{"key": hexKey, "cipher": "AES-256-GCM", "key_wrap": "AES-KW"},
+		plaintext:   short,
+		layer: encrypt(encryption.WithKey(key), encryption.WithCipher(AES256GCM),
+			encryption.WithDataKeys(encryption.AESKeyWrap)),
+	}, {
+		name:        "encryption-format-header",
+		description: "FormatHeader with cipher suite, key mode and key fingerprint, then DARE packages keyed by the header HMAC",
+		params:      map[string]string{"key": hexKey, "cipher": "ChaCha20-Poly1305", "format_header": "true"},
+		plaintext:   short,
+		layer: encrypt(encryption.WithKey(key), encryption.WithCipher(ChaCha20Poly1305),
+			encryption.WithFormatHeader()),
+	}, {
+		name:        "checksum-sha256-trailer",
+		description: "ChecksumHeader, payload and SHA-256 trailer",
+		params:      map[string]string{"algorithm": "SHA-256", "placement": "trailer"},
+		plaintext:   short,
+		layer:       func(io.Reader) (middleware.Middleware, error) { return checksum.New(), nil },
+	}, {
+		name:        "checksum-crc32c-header",
+		description: "ChecksumHeader carrying the CRC-32C digest, then the payload",
+		params:      map[string]string{"algorithm": "CRC-32C", "placement": "header"},
+		plaintext:   short,
+		layer: func(io.Reader) (middleware.Middleware, error) {
+			return checksum.New(checksum.WithAlgorithm(checksum.CRC32C), checksum.WithPlacement(checksum.Header)), nil
+		},
+	}, {
+		name:        "headercrc-checksum",
+		description: "HeaderFrame protecting the ChecksumHeader, then payload and SHA-256 trailer",
+		params:      map[string]string{"algorithm": "SHA-256", "placement": "trailer"},
+		plaintext:   short,
+		layer: func(io.Reader) (middleware.Middleware, error) {
+			return middleware.ProtectHeader("checksum", checksum.New()), nil
+		},
+	}, {
+		name:        "ctrhmac",
+		description: "CTRHMACHeader, then AES-256-CTR segments authenticated with HMAC-SHA256",
+		params:      map[string]string{"key": hex.EncodeToString(longKey)},
+		plaintext:   short,
+		layer: func(r io.Reader) (middleware.Middleware, error) {
+			return ctrhmac.NewE(longKey, ctrhmac.WithRand(r))
+		},
+	}, {
+		name:        "siv",
+		description: "SIVHeader, synthetic IV and ciphertext of AES-256-SIV with associated data",
+		params:      map[string]string{"key": hex.EncodeToString(longKey), "associated_data": "buffer-1"},
+		plaintext:   short,
+		layer: func(r io.Reader) (middleware.Middleware, error) {
+			return siv.NewE(longKey, siv.WithAssociatedData([]byte("buffer-1")), siv.WithRand(r))
+		},
+	}}
+
+	var vectors []Vector
+	for _, c := range cases {
+		if cipher := c.params["cipher"]; cipher == "ChaCha20-Poly1305" && !encryption.Available(ChaCha20Poly1305) ||
+			cipher == "AES-256-GCM" && !encryption.Available(AES256GCM) {
+			continue
+		}
+		encoded, err := c.encode()
+		if err != nil {
+			return nil, fmt.Errorf("spec: vector %s: %w", c.name, err)
+		}
+		vectors = append(vectors, Vector{
+			Name:        c.name,
+			Description: c.description,
+			Params:      c.params,
+			Plaintext:   hex.EncodeToString(c.plaintext),
+			Encoded:     hex.EncodeToString(encoded),
+		})
+	}
+	return vectors, nil
+}
+
+// encode writes the plaintext through a layer drawing from a fresh seeded
+// random source
+func (c *vectorCase) encode() ([]byte, error) {
+	m, err := c.layer(rand.NewChaCha8(vectorSeed))
+	if err != nil {
+		return nil, err
+	}
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var buf bytes.Buffer
+	w := middleware.WriterContext(ctx, m, &buf)
+	if _, err := w.Write(c.plaintext); err != nil {
+		return nil, err
+	}
+	if wc, ok := w.(io.Closer); ok {
+		if err := wc.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteVectors writes the vectors to w as an indented JSON array
+func WriteVectors(w io.Writer) error {
+	vectors, err := Vectors()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(vectors)
+}
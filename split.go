@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"io"
+)
+
+// WithMaxWrite splits Writes larger than n bytes into sub-writes of at most
+// n bytes, and returns the chain. Writers created with WriterContext check
+// their context between sub-writes, so a huge single Write, e.g. 512 MiB
+// through encryption, can be cancelled mid-way. A value of 0 disables
+// splitting.
+func (c *Chain) WithMaxWrite(n int) *Chain {
+	if n >= 0 {
+		c.maxWrite = n
+	}
+	return c
+}
+
+// WriterContext is like Writer, but stops writing once ctx is done. The
+// context is checked before every Write and, with WithMaxWrite, between
+// sub-writes. A cancelled writer fails with the context's error, which is
+// sticky because the stream is incomplete. ctx is passed to the layers too.
+func (c *Chain) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	cw := c.writer(ctx, w)
+	cw.ctx = ctx
+	return cw
+}
+
+// write passes p to the top layer, split and checked as configured. With
+// owned, ownership of p is handed to the top layer, see OwnedWriter.
+func (c *chainWriter) write(p []byte, owned bool) (int, error) {
+	if c.maxWrite == 0 && c.ctx == nil {
+		return c.writeTop(p, owned)
+	}
+	written := 0
+	for len(p) > 0 {
+		if c.ctx != nil {
+			if err := c.ctx.Err(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if c.maxWrite > 0 && len(chunk) > c.maxWrite {
+			chunk = chunk[:c.maxWrite]
+		}
+		n, err := c.writeTop(chunk, owned)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *chainWriter) writeTop(p []byte, owned bool) (int, error) {
+	if owned {
+		return WriteOwned(c.top, p)
+	}
+	return c.top.Write(p)
+}
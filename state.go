@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrClosed is returned by built-in writers that are used after Close
+var ErrClosed = errors.New("middleware: use of closed writer")
+
+// WriterState tracks the lifecycle of a writer, so that all wrappers behave
+// the same: Close is idempotent, Write after Close returns ErrClosed and a
+// failed write makes every following call fail with the same error.
+// The zero value is ready to use. It is not safe for concurrent use.
+type WriterState struct {
+	// Layer names the middleware in reports to the OnError hook. States
+	// without a layer do not report, so generic wrappers do not repeat the
+	// errors of the layers they wrap.
+	Layer string
+
+	closed   bool
+	err      error
+	closeErr error
+}
+
+// Err returns the error a Write must fail with before doing any work,
+// or nil if writing may proceed
+func (s *WriterState) Err() error {
+	if s.closed {
+		return ErrClosed
+	}
+	return s.err
+}
+
+// Fail records err as sticky write error and returns it. A nil err is ignored.
+func (s *WriterState) Fail(err error) error {
+	if err != nil && s.err == nil {
+		s.err = err
+		reportError(s.Layer, OpWrite, err)
+	}
+	return err
+}
+
+// Close runs finalize on the first call unless a write failed before, in
+// which case the write error is returned. Every further call returns the
+// result of the first one.
+func (s *WriterState) Close(finalize func() error) error {
+	if s.closed {
+		return s.closeErr
+	}
+	s.closed = true
+	if s.err != nil {
+		s.closeErr = s.err
+	} else if finalize != nil {
+		s.closeErr = finalize()
+		reportError(s.Layer, OpClose, s.closeErr)
+	}
+	return s.closeErr
+}
+
+// Closed reports whether Close was called
+func (s *WriterState) Closed() bool {
+	return s.closed
+}
+
+// ReaderState makes reader errors sticky: once a Read returned an error,
+// including io.EOF, every following Read returns the same error.
+// The zero value is ready to use. It is not safe for concurrent use.
+type ReaderState struct {
+	// Layer names the middleware in reports to the OnError hook, see WriterState
+	Layer string
+
+	err error
+}
+
+// Err returns the sticky error, or nil
+func (s *ReaderState) Err() error {
+	return s.err
+}
+
+// Track records the error of a Read and passes its results through
+func (s *ReaderState) Track(n int, err error) (int, error) {
+	if err != nil && s.err == nil {
+		s.err = err
+		reportError(s.Layer, OpRead, err)
+	}
+	return n, err
+}
+
+// HardenWriter wraps a writer of another library with WriterState semantics.
+// Close is passed through to w if it implements io.Closer.
+func HardenWriter(w io.Writer) io.WriteCloser {
+	return &hardenedWriter{w: w}
+}
+
+// HardenLayerWriter is like HardenWriter and reports errors to the OnError
+// hook under the given layer name
+func HardenLayerWriter(layer string, w io.Writer) io.WriteCloser {
+	return &hardenedWriter{w: w, state: WriterState{Layer: layer}}
+}
+
+type hardenedWriter struct {
+	w     io.Writer
+	state WriterState
+}
+
+func (h *hardenedWriter) Write(p []byte) (int, error) {
+	if err := h.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := h.w.Write(p)
+	return n, h.state.Fail(err)
+}
+
+func (h *hardenedWriter) Close() error {
+	return h.state.Close(func() error {
+		if c, ok := h.w.(io.Closer); ok {
+			return c.Close()
+		}
+		return nil
+	})
+}
+
+// HardenReader wraps a reader of another library with ReaderState semantics
+func HardenReader(r io.Reader) io.Reader {
+	return &hardenedReader{r: r}
+}
+
+// HardenLayerReader is like HardenReader and reports errors to the OnError
+// hook under the given layer name
+func HardenLayerReader(layer string, r io.Reader) io.Reader {
+	return &hardenedReader{r: r, state: ReaderState{Layer: layer}}
+}
+
+type hardenedReader struct {
+	r     io.Reader
+	state ReaderState
+}
+
+func (h *hardenedReader) Read(p []byte) (int, error) {
+	if err := h.state.Err(); err != nil {
+		return 0, err
+	}
+	return h.state.Track(h.r.Read(p))
+}
+
+// Buffered returns the bytes buffered by the wrapped reader, see Buffered
+func (h *hardenedReader) Buffered() int {
+	if b, ok := h.r.(Buffered); ok {
+		return b.Buffered()
+	}
+	return 0
+}
@@ -0,0 +1,236 @@
+package middleware_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+	"schneider.vip/hybridbuffer/middleware/rle"
+	"schneider.vip/hybridbuffer/middleware/snapshot"
+	"schneider.vip/hybridbuffer/middleware/snapshot/chunkstore"
+	"schneider.vip/hybridbuffer/middleware/xorsplit"
+)
+
+var errSink = errors.New("sink failed")
+
+// failingSink fails every write, and counts calls to Close
+type failingSink struct {
+	closes int
+}
+
+func (s *failingSink) Write(p []byte) (int, error) { return 0, errSink }
+func (s *failingSink) Close() error                { s.closes++; return nil }
+
+// countingSink accepts every write, and counts calls to Close
+type countingSink struct {
+	bytes.Buffer
+	closes int
+}
+
+func (s *countingSink) Close() error { s.closes++; return nil }
+
+// nopStats discards all observations
+type nopStats struct{}
+
+func (nopStats) Observe(string, middleware.Op, int64, int64, time.Duration) {}
+
+func TestWriterState(t *testing.T) {
+	t.Run("close once", func(t *testing.T) {
+		var s middleware.WriterState
+		calls := 0
+		finalize := func() error { calls++; return errSink }
+		for i := 0; i < 3; i++ {
+			if err := s.Close(finalize); err != errSink {
+				t.Fatalf("close %d: got %v, want errSink", i, err)
+			}
+		}
+		if calls != 1 {
+			t.Fatalf("finalize ran %d times", calls)
+		}
+		if !s.Closed() || s.Err() != middleware.ErrClosed {
+			t.Fatalf("closed %v, err %v", s.Closed(), s.Err())
+		}
+	})
+	t.Run("sticky write error", func(t *testing.T) {
+		var s middleware.WriterState
+		if s.Fail(nil) != nil || s.Err() != nil {
+			t.Fatal("nil error recorded")
+		}
+		s.Fail(errSink)
+		s.Fail(io.ErrShortWrite)
+		if s.Err() != errSink {
+			t.Fatalf("got %v, want the first error", s.Err())
+		}
+		ran := false
+		if err := s.Close(func() error { ran = true; return nil }); err != errSink {
+			t.Fatalf("close: got %v, want errSink", err)
+		}
+		if ran {
+			t.Fatal("finalize ran after a failed write")
+		}
+		if s.Err() != middleware.ErrClosed {
+			t.Fatalf("after close: got %v, want ErrClosed", s.Err())
+		}
+	})
+}
+
+func TestReaderState(t *testing.T) {
+	for _, want := range []error{io.EOF, errSink} {
+		var s middleware.ReaderState
+		if n, err := s.Track(3, want); n != 3 || err != want {
+			t.Fatalf("got %d, %v", n, err)
+		}
+		s.Track(0, io.ErrUnexpectedEOF)
+		if s.Err() != want {
+			t.Fatalf("got %v, want %v", s.Err(), want)
+		}
+	}
+
+	// a source that returns data again after io.EOF is not read again
+	r := middleware.HardenReader(&lateReader{data: []byte("late")})
+	for i := 0; i < 3; i++ {
+		if n, err := r.Read(make([]byte, 8)); n != 0 || err != io.EOF {
+			t.Fatalf("read %d: got %d, %v", i, n, err)
+		}
+	}
+}
+
+// lateReader returns io.EOF on the first Read and data afterwards
+type lateReader struct {
+	data []byte
+	eof  bool
+}
+
+func (r *lateReader) Read(p []byte) (int, error) {
+	if !r.eof {
+		r.eof = true
+		return 0, io.EOF
+	}
+	return copy(p, r.data), nil
+}
+
+// stateWriters are the built-in writers that track their lifecycle with a
+// WriterState
+func stateWriters(t *testing.T) []struct {
+	name   string
+	writer func(w io.Writer) io.Writer
+} {
+	t.Helper()
+	key := make([]byte, encryption.KeySize)
+	rand.Read(key)
+	layer := func(m middleware.Middleware) func(w io.Writer) io.Writer { return m.Writer }
+	return []struct {
+		name   string
+		writer func(w io.Writer) io.Writer
+	}{
+		{"harden", func(w io.Writer) io.Writer { return middleware.HardenWriter(w) }},
+		{"chain", layer(middleware.NewChain(rle.New(), encryption.New(encryption.WithKey(key))))},
+		{"guard", func(w io.Writer) io.Writer { return middleware.Guard(middleware.Passthrough()).Writer(w) }},
+		{"stats", layer(middleware.WithStats("rle", rle.New(), nopStats{}))},
+		{"rle", layer(rle.New())},
+		{"encryption", layer(encryption.New(encryption.WithKey(key)))},
+		{"snapshot", layer(snapshot.New(chunkstore.NewMemory(0)))},
+		{"xorsplit", func(w io.Writer) io.Writer {
+			x, err := xorsplit.NewWriter(w, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return x
+		}},
+	}
+}
+
+func TestWriterStateWrappers(t *testing.T) {
+	// large enough to get past the buffers of all layers
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	for _, tt := range stateWriters(t) {
+		t.Run(tt.name+"/double close", func(t *testing.T) {
+			sink := &countingSink{}
+			w := tt.writer(sink).(io.WriteCloser)
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			n := sink.Len()
+			if err := w.Close(); err != nil {
+				t.Fatalf("second close: %v", err)
+			}
+			if sink.Len() != n || sink.closes > 1 {
+				t.Fatalf("second close wrote %d bytes, closed the sink %d times", sink.Len()-n, sink.closes)
+			}
+		})
+		t.Run(tt.name+"/write after close", func(t *testing.T) {
+			w := tt.writer(&countingSink{}).(io.WriteCloser)
+			w.Close()
+			if _, err := w.Write([]byte("late")); !errors.Is(err, middleware.ErrClosed) {
+				t.Fatalf("got %v, want ErrClosed", err)
+			}
+		})
+		t.Run(tt.name+"/sticky error", func(t *testing.T) {
+			w := tt.writer(&failingSink{}).(io.WriteCloser)
+			var err error
+			for i := 0; i < 4 && err == nil; i++ {
+				_, err = w.Write(data)
+			}
+			if err != nil {
+				// every call after a failed write repeats it
+				if _, err := w.Write(data[:1]); !errors.Is(err, errSink) {
+					t.Fatalf("write after failure: got %v, want errSink", err)
+				}
+			}
+			if err := w.Close(); !errors.Is(err, errSink) {
+				t.Fatalf("close: got %v, want errSink", err)
+			}
+			if err := w.Close(); !errors.Is(err, errSink) {
+				t.Fatalf("second close: got %v, want errSink", err)
+			}
+			if _, err := w.Write(data[:1]); !errors.Is(err, middleware.ErrClosed) {
+				t.Fatalf("write after close: got %v, want ErrClosed", err)
+			}
+		})
+	}
+}
+
+func TestReaderStateWrappers(t *testing.T) {
+	key := make([]byte, encryption.KeySize)
+	rand.Read(key)
+	tests := []struct {
+		name string
+		m    middleware.Middleware
+	}{
+		{"rle", rle.New()},
+		{"encryption", encryption.New(encryption.WithKey(key))},
+		{"chain", middleware.NewChain(rle.New(), encryption.New(encryption.WithKey(key)))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := tt.m.Writer(&buf)
+			w.Write(bytes.Repeat([]byte("state"), 1000))
+			w.(io.Closer).Close()
+
+			// a source failing halfway through the stream
+			src := io.MultiReader(bytes.NewReader(buf.Bytes()[:buf.Len()/2]), iotest.ErrReader(errSink))
+			r := tt.m.Reader(src)
+			_, err := io.Copy(io.Discard, r)
+			if !errors.Is(err, errSink) {
+				t.Fatalf("got %v, want errSink", err)
+			}
+			for i := 0; i < 2; i++ {
+				if n, again := r.Read(make([]byte, 64)); n != 0 || again != err {
+					t.Fatalf("read after error: got %d, %v, want %v", n, again, err)
+				}
+			}
+		})
+	}
+}
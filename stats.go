@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Op identifies the kind of operation reported to a StatsSink
+type Op int
+
+const (
+	OpWrite Op = iota
+	OpRead
+	OpClose
+)
+
+// String returns the name of the operation
+func (o Op) String() string {
+	switch o {
+	case OpWrite:
+		return "write"
+	case OpRead:
+		return "read"
+	case OpClose:
+		return "close"
+	default:
+		return fmt.Sprintf("Op(%d)", int(o))
+	}
+}
+
+// StatsSink receives per-operation statistics from middlewares. The
+// hybridbuffer core can implement it to expose spill overhead per buffer.
+// Observe is called synchronously and must be cheap.
+type StatsSink interface {
+	// Observe reports one operation of a layer. For writes in is the number of
+	// bytes accepted from the caller and out the number of bytes passed to the
+	// underlying writer. For reads in is the number of bytes consumed from the
+	// underlying reader and out the number of bytes returned to the caller.
+	Observe(layer string, op Op, in, out int64, d time.Duration)
+}
+
+// StatsFunc adapts a function to the StatsSink interface
+type StatsFunc func(layer string, op Op, in, out int64, d time.Duration)
+
+// Observe calls f
+func (f StatsFunc) Observe(layer string, op Op, in, out int64, d time.Duration) {
+	f(layer, op, in, out, d)
+}
+
+// WithStats wraps m so that every Write, Read and Close is reported to sink
+// under the given layer name. Sinks implementing CompletionSink also
+// receive the totals of every stream.
+func WithStats(layer string, m Middleware, sink StatsSink) Middleware {
+	return &statsMiddleware{layer: layer, m: m, sink: sink}
+}
+
+type statsMiddleware struct {
+	layer string
+	m     Middleware
+	sink  StatsSink
+}
+
+func (s *statsMiddleware) Writer(w io.Writer) io.Writer {
+	cw := &countingWriter{w: w}
+	return &statsWriter{s: s, w: s.m.Writer(cw), count: cw, done: newCompletion(context.Background(), s.sink, s.layer, OpWrite)}
+}
+
+func (s *statsMiddleware) Reader(r io.Reader) io.Reader {
+	cr := &countingReader{r: r}
+	return &statsReader{s: s, r: s.m.Reader(cr), count: cr, done: newCompletion(context.Background(), s.sink, s.layer, OpRead)}
+}
+
+// WriterContext is like Writer, but reports the trace context of ctx
+func (s *statsMiddleware) WriterContext(ctx context.Context, w io.Writer) io.Writer {
+	cw := &countingWriter{w: w}
+	tc, _ := TraceFromContext(ctx)
+	return &statsWriter{s: s, w: WriterContext(ctx, s.m, cw), count: cw, trace: tc, done: newCompletion(ctx, s.sink, s.layer, OpWrite)}
+}
+
+// ReaderContext is like Reader, but reports the trace context of ctx
+func (s *statsMiddleware) ReaderContext(ctx context.Context, r io.Reader) io.Reader {
+	cr := &countingReader{r: r}
+	tc, _ := TraceFromContext(ctx)
+	return &statsReader{s: s, r: ReaderContext(ctx, s.m, cr), count: cr, trace: tc, done: newCompletion(ctx, s.sink, s.layer, OpRead)}
+}
+
+// observe reports an operation, with the trace context if there is one
+func (s *statsMiddleware) observe(tc TraceContext, op Op, in, out int64, d time.Duration) {
+	if ts, ok := s.sink.(TraceSink); ok && tc.Valid() {
+		ts.ObserveTrace(tc, s.layer, op, in, out, d)
+		return
+	}
+	s.sink.Observe(s.layer, op, in, out, d)
+}
+
+type statsWriter struct {
+	s     *statsMiddleware
+	w     io.Writer
+	count *countingWriter
+	trace TraceContext
+	done  *completion
+	state WriterState
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	start, before := time.Now(), w.count.n
+	n, err := w.w.Write(p)
+	d := time.Since(start)
+	w.s.observe(w.trace, OpWrite, int64(n), w.count.n-before, d)
+	w.done.add(p[:n], int64(n), w.count.n-before, d)
+	return n, w.state.Fail(err)
+}
+
+func (w *statsWriter) Close() error {
+	err := w.state.Close(func() error {
+		start, before := time.Now(), w.count.n
+		var err error
+		if c, ok := w.w.(io.Closer); ok {
+			err = c.Close()
+		}
+		d := time.Since(start)
+		w.s.observe(w.trace, OpClose, 0, w.count.n-before, d)
+		w.done.add(nil, 0, w.count.n-before, d)
+		return err
+	})
+	w.done.finish(err)
+	return err
+}
+
+type statsReader struct {
+	s     *statsMiddleware
+	r     io.Reader
+	count *countingReader
+	trace TraceContext
+	done  *completion
+	state ReaderState
+}
+
+func (r *statsReader) Read(p []byte) (int, error) {
+	if err := r.state.Err(); err != nil {
+		return 0, err
+	}
+	start, before := time.Now(), r.count.n
+	n, err := r.r.Read(p)
+	d := time.Since(start)
+	r.s.observe(r.trace, OpRead, r.count.n-before, int64(n), d)
+	r.done.add(p[:n], r.count.n-before, int64(n), d)
+	if err == io.EOF {
+		r.done.finish(nil)
+	} else if err != nil {
+		r.done.finish(err)
+	}
+	return r.state.Track(n, err)
+}
+
+// countingWriter counts the bytes written to w and passes Close through
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// WriteOwned hands ownership of p to w, see OwnedWriter
+func (c *countingWriter) WriteOwned(p []byte) (int, error) {
+	n, err := WriteOwned(c.w, p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Close() error {
+	if cl, ok := c.w.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped middleware
+func (s *statsMiddleware) Unwrap() Middleware {
+	return s.m
+}
@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrTrailingData is returned in StrictMode when data follows the end of the stream
+var ErrTrailingData = errors.New("middleware: trailing data after end of stream")
+
+// ReadMode sets how tolerant the read side of a Chain is
+type ReadMode int
+
+const (
+	// DefaultMode leaves every layer as configured and does not check for trailing data
+	DefaultMode ReadMode = iota
+
+	// StrictMode fails on trailing data, unknown header fields and checksum
+	// mismatches. Use it for ingest pipelines that must not accept damaged input.
+	StrictMode
+
+	// LenientMode logs and continues where that is safe, e.g. ignores
+	// trailing data or decodes unknown versions on a best effort basis.
+	// Use it for recovering data from damaged or foreign streams.
+	LenientMode
+)
+
+// String returns the name of the mode
+func (m ReadMode) String() string {
+	switch m {
+	case DefaultMode:
+		return "default"
+	case StrictMode:
+		return "strict"
+	case LenientMode:
+		return "lenient"
+	default:
+		return fmt.Sprintf("ReadMode(%d)", int(m))
+	}
+}
+
+// Logf receives the problems skipped in LenientMode
+type Logf func(format string, args ...any)
+
+// ModeSetter is implemented by layers with configurable read tolerance.
+// ForMode returns a copy of the layer configured for mode; the layer
+// itself must not be modified.
+type ModeSetter interface {
+	ForMode(mode ReadMode, logf Logf) Middleware
+}
+
+// WithReadMode sets the read mode of the chain and returns it. Layers
+// implementing ModeSetter are configured accordingly, logf may be nil.
+func (c *Chain) WithReadMode(mode ReadMode, logf Logf) *Chain {
+	c.mode = mode
+	c.logf = logf
+	return c
+}
+
+// readLayers returns the layers of a stream configured for the read mode
+// of the chain: the enabled ones, all layers if enabled is nil
+func (c *Chain) readLayers(enabled []bool) []Middleware {
+	layers := make([]Middleware, 0, len(c.layers))
+	for i, m := range c.layers {
+		if enabled == nil || enabled[i] {
+			layers = append(layers, m)
+		}
+	}
+	if c.mode == DefaultMode {
+		return layers
+	}
+	for i, m := range layers {
+		switch l := m.(type) {
+		case *Chain:
+			nested := *l
+			nested.mode, nested.logf = c.mode, c.logf
+			layers[i] = &nested
+		case ModeSetter:
+			layers[i] = l.ForMode(c.mode, c.logf)
+		}
+	}
+	return layers
+}
+
+// Buffered is implemented by Readers of layers that read ahead of their
+// stream, e.g. through a bufio.Reader. After the Reader returned io.EOF,
+// Buffered returns the number of bytes read from the source beyond the end
+// of the stream, so chains in StrictMode and LenientMode see trailing data
+// hidden in the buffer. Layers ending with their source need not
+// implement it.
+type Buffered interface {
+	Buffered() int
+}
+
+// trailingReader drains the outer layers once the innermost layer reported
+// EOF, so their checks run even if the inner stream ends before its source,
+// and in StrictMode and LenientMode checks for data left after the end of
+// any layer, including data buffered by a layer
+type trailingReader struct {
+	readers []io.Reader // layer readers, innermost first
+	src     io.Reader
+	mode    ReadMode
+	logf    Logf
+	state   ReaderState
+}
+
+func (t *trailingReader) Read(p []byte) (int, error) {
+	if err := t.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := t.readers[0].Read(p)
+	if err != io.EOF {
+		return t.state.Track(n, err)
+	}
+	trailing, err := t.finish()
+	if err != nil {
+		return t.state.Track(n, err)
+	}
+	if trailing && t.mode != DefaultMode {
+		if t.mode == StrictMode {
+			ReportError("chain", OpRead, ErrTrailingData)
+			return t.state.Track(n, ErrTrailingData)
+		}
+		if t.logf != nil {
+			t.logf("middleware: ignoring trailing data after end of stream")
+		}
+	}
+	return t.state.Track(n, io.EOF)
+}
+
+// finish reads every outer layer to its end and reports whether data
+// followed the end of a layer. The source is only checked for a byte
+// beyond the stream outside of DefaultMode.
+func (t *trailingReader) finish() (bool, error) {
+	trailing := false
+	for i, r := range t.readers {
+		if b, ok := r.(Buffered); ok && b.Buffered() > 0 {
+			trailing = true
+		}
+		if i+1 < len(t.readers) {
+			n, err := io.Copy(io.Discard, t.readers[i+1])
+			if err != nil {
+				return trailing, err
+			}
+			trailing = trailing || n > 0
+			continue
+		}
+		if t.mode != DefaultMode {
+			var b [1]byte
+			m, _ := io.ReadFull(t.src, b[:])
+			trailing = trailing || m > 0
+		}
+	}
+	return trailing, nil
+}
@@ -0,0 +1,77 @@
+package middleware_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/checksum"
+	"schneider.vip/hybridbuffer/middleware/encryption/ctrhmac"
+	"schneider.vip/hybridbuffer/middleware/rle"
+	"schneider.vip/hybridbuffer/middleware/snapshot"
+	"schneider.vip/hybridbuffer/middleware/snapshot/chunkstore"
+)
+
+// opaque hides io.ByteReader and io.WriterTo of a source, so layers
+// buffer it like a network stream
+type opaque struct{ r io.Reader }
+
+func (o opaque) Read(p []byte) (int, error) { return o.r.Read(p) }
+
+func TestTrailingGarbage(t *testing.T) {
+	data := bytes.Repeat([]byte("trailing garbage "), 500)
+	garbage := []byte("garbage")
+	tests := []struct {
+		name   string
+		layers []middleware.Middleware
+		strict error // error of StrictMode
+		other  error // error of the other modes, nil if the data is decoded
+	}{
+		{"rle", []middleware.Middleware{rle.New()}, middleware.ErrTrailingData, nil},
+		{"snapshot", []middleware.Middleware{snapshot.New(chunkstore.NewMemory(0))}, middleware.ErrTrailingData, nil},
+		{"ctrhmac", []middleware.Middleware{ctrhmac.New(make([]byte, 64))}, ctrhmac.ErrNotAuthentic, ctrhmac.ErrNotAuthentic},
+		{"rle in checksum", []middleware.Middleware{rle.New(), checksum.New()}, checksum.ErrChecksum, checksum.ErrChecksum},
+		{"rle in snapshot", []middleware.Middleware{rle.New(), snapshot.New(chunkstore.NewMemory(0))}, middleware.ErrTrailingData, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := encode(t, middleware.NewChain(tt.layers...), data)
+			damaged := append(bytes.Clone(stored), garbage...)
+			for _, mode := range []middleware.ReadMode{middleware.DefaultMode, middleware.StrictMode, middleware.LenientMode} {
+				c := middleware.NewChain(tt.layers...).WithReadMode(mode, nil)
+				// the intact stream decodes in every mode
+				if got, err := io.ReadAll(c.Reader(opaque{bytes.NewReader(stored)})); err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("%s: intact stream: %d bytes, %v", mode, len(got), err)
+				}
+				got, err := io.ReadAll(c.Reader(opaque{bytes.NewReader(damaged)}))
+				want := tt.other
+				if mode == middleware.StrictMode {
+					want = tt.strict
+				}
+				switch {
+				case want == nil:
+					if err != nil || !bytes.Equal(got, data) {
+						t.Fatalf("%s: %d bytes, %v", mode, len(got), err)
+					}
+				case !errors.Is(err, want):
+					t.Fatalf("%s: got %v, want %v", mode, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInnerStreamEndsEarly(t *testing.T) {
+	// the checksum trailer is verified although the rle stream ends at its
+	// end token, before the checksum layer reached its end
+	c := middleware.NewChain(rle.New(), checksum.New())
+	stored := encode(t, c, bytes.Repeat([]byte{0, 1}, 1000))
+	stored[len(stored)-1] ^= 1
+	for _, mode := range []middleware.ReadMode{middleware.DefaultMode, middleware.LenientMode} {
+		if _, err := io.ReadAll(c.WithReadMode(mode, nil).Reader(bytes.NewReader(stored))); !errors.Is(err, checksum.ErrChecksum) {
+			t.Fatalf("%s: got %v, want ErrChecksum", mode, err)
+		}
+	}
+}
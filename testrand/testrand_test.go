@@ -0,0 +1,92 @@
+package testrand_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"sync"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+	"schneider.vip/hybridbuffer/middleware/testrand"
+)
+
+func TestSeed(t *testing.T) {
+	// the stream of a seed is part of the golden files of other tests
+	b := make([]byte, 16)
+	testrand.New("golden").Read(b)
+	if got := hex.EncodeToString(b); got != "17228871c30c61e2c6ba1a13000a8d6e" {
+		t.Fatalf("got %s", got)
+	}
+
+	// the stream does not depend on how it is read
+	whole := make([]byte, 1000)
+	testrand.New("golden").Read(whole)
+	r := testrand.New("golden")
+	var parts []byte
+	for _, n := range []int{1, 7, 500, 492} {
+		p := make([]byte, n)
+		r.Read(p)
+		parts = append(parts, p...)
+	}
+	if !bytes.Equal(whole, parts) {
+		t.Fatal("stream depends on the read sizes")
+	}
+
+	other := make([]byte, 16)
+	testrand.New("golden2").Read(other)
+	if bytes.Equal(other, b) {
+		t.Fatal("seeds yield the same stream")
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	r := testrand.New("concurrent")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p := make([]byte, 64)
+			for j := 0; j < 100; j++ {
+				if n, err := r.Read(p); n != len(p) || err != nil {
+					t.Errorf("read %d, %v", n, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func encrypt(t *testing.T, key []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := encryption.New(encryption.WithKey(key)).Writer(&buf)
+	io.WriteString(w, "golden plaintext")
+	if err := w.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInstall(t *testing.T) {
+	key := make([]byte, encryption.KeySize)
+	prev := middleware.Rand()
+
+	restore := testrand.Install("install")
+	a := encrypt(t, key)
+	restore()
+	if middleware.Rand() != prev {
+		t.Fatal("previous source not restored")
+	}
+
+	defer testrand.Install("install")()
+	if b := encrypt(t, key); !bytes.Equal(a, b) {
+		t.Fatal("output differs for the same seed")
+	}
+	// every layer draws from the one installed source
+	if c := encrypt(t, key); bytes.Equal(a, c) {
+		t.Fatal("nonce repeated within a seed")
+	}
+}
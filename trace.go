@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrInvalidTraceparent is returned by ParseTraceparent for malformed headers
+var ErrInvalidTraceparent = errors.New("middleware: invalid traceparent")
+
+// TraceContext is a W3C trace context (https://www.w3.org/TR/trace-context/)
+// identifying the request a stream belongs to
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// ParseTraceparent parses a version 00 traceparent header value such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+func ParseTraceparent(s string) (TraceContext, error) {
+	var tc TraceContext
+	if len(s) != 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return tc, fmt.Errorf("%w: %q", ErrInvalidTraceparent, s)
+	}
+	var version [1]byte
+	var flags [1]byte
+	for _, f := range []struct {
+		dst []byte
+		src string
+	}{
+		{version[:], s[0:2]},
+		{tc.TraceID[:], s[3:35]},
+		{tc.SpanID[:], s[36:52]},
+		{flags[:], s[53:55]},
+	} {
+		if _, err := hex.Decode(f.dst, []byte(f.src)); err != nil {
+			return TraceContext{}, fmt.Errorf("%w: %q", ErrInvalidTraceparent, s)
+		}
+	}
+	if version[0] != 0 || !tc.Valid() {
+		return TraceContext{}, fmt.Errorf("%w: %q", ErrInvalidTraceparent, s)
+	}
+	tc.Flags = flags[0]
+	return tc, nil
+}
+
+// Valid reports whether trace and span ID are non-zero
+func (tc TraceContext) Valid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// Sampled reports whether the sampled flag is set
+func (tc TraceContext) Sampled() bool {
+	return tc.Flags&1 != 0
+}
+
+// String returns the traceparent header value
+func (tc TraceContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tc.TraceID, tc.SpanID, tc.Flags)
+}
+
+type traceKey struct{}
+
+// WithTrace returns a context carrying tc. Writers and Readers created with
+// WriterContext and ReaderContext report it to a TraceSink.
+func WithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+// TraceFromContext returns the trace context set with WithTrace
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(TraceContext)
+	return tc, ok && tc.Valid()
+}
+
+// TraceSink is a StatsSink that also receives the trace context of the
+// stream, so metrics and audit records can be joined with request traces.
+// ObserveTrace is called instead of Observe for streams with a trace context.
+type TraceSink interface {
+	StatsSink
+	ObserveTrace(tc TraceContext, layer string, op Op, in, out int64, d time.Duration)
+}
+
+// ContextMiddleware is implemented by middlewares taking per-stream values,
+// like the trace context, from a context
+type ContextMiddleware interface {
+	Middleware
+	WriterContext(ctx context.Context, w io.Writer) io.Writer
+	ReaderContext(ctx context.Context, r io.Reader) io.Reader
+}
+
+// WriterContext wraps w with m, passing ctx on if m is a ContextMiddleware
+func WriterContext(ctx context.Context, m Middleware, w io.Writer) io.Writer {
+	if cm, ok := m.(ContextMiddleware); ok && ctx != nil {
+		return cm.WriterContext(ctx, w)
+	}
+	return m.Writer(w)
+}
+
+// ReaderContext wraps r with m, passing ctx on if m is a ContextMiddleware
+func ReaderContext(ctx context.Context, m Middleware, r io.Reader) io.Reader {
+	if cm, ok := m.(ContextMiddleware); ok && ctx != nil {
+		return cm.ReaderContext(ctx, r)
+	}
+	return m.Reader(r)
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+)
+
+// Transcode copies src, encoded with from, to dst encoded with to, e.g. to
+// migrate a stored gzip buffer to another compression without an offline
+// conversion step. It returns the number of plaintext bytes copied. dst is
+// not closed.
+func Transcode(dst io.Writer, src io.Reader, from, to Middleware) (int64, error) {
+	w := to.Writer(dst)
+	n, err := io.Copy(w, from.Reader(src))
+	if c, ok := w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return n, err
+}
+
+// Transcoder returns a middleware storing data encoded with stored while
+// its callers see the served encoding: Reader decodes stored and re-encodes
+// with served on the fly, e.g. to serve stored gzip buffers in another
+// format, and Writer does the reverse for uploads in the served encoding.
+func Transcoder(stored, served Middleware) Middleware {
+	return &transcoder{stored: stored, served: served}
+}
+
+type transcoder struct {
+	stored Middleware
+	served Middleware
+}
+
+// Reader re-encodes lazily as the consumer reads, see ReaderFromWriterChain
+func (t *transcoder) Reader(r io.Reader) io.Reader {
+	return ReaderFromWriterChain(t.served, t.stored.Reader(r))
+}
+
+// Writer decodes the served encoding in a goroutine, see
+// WriterFromReaderChain. Close finalizes both encodings; w is not closed.
+func (t *transcoder) Writer(w io.Writer) io.Writer {
+	sw := t.stored.Writer(w)
+	return &transcodeWriter{dec: WriterFromReaderChain(t.served, sw), enc: sw}
+}
+
+type transcodeWriter struct {
+	dec   io.WriteCloser
+	enc   io.Writer
+	state WriterState
+}
+
+func (t *transcodeWriter) Write(p []byte) (int, error) {
+	if err := t.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := t.dec.Write(p)
+	return n, t.state.Fail(err)
+}
+
+func (t *transcodeWriter) Close() error {
+	return t.state.Close(func() error {
+		err := t.dec.Close()
+		if c, ok := t.enc.(io.Closer); ok {
+			err = errors.Join(err, c.Close())
+		}
+		return err
+	})
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotSeekable is returned by Reserve if the sink is not seekable
+var ErrNotSeekable = errors.New("middleware: sink is not seekable")
+
+// SeekableSink returns the io.WriteSeeker behind w. Writers that pass
+// writes through unchanged and unbuffered, like the ones between the
+// layers of a Chain, expose their destination with an Unwrap() io.Writer
+// method and are looked through.
+func SeekableSink(w io.Writer) (io.WriteSeeker, bool) {
+	for {
+		if ws, ok := w.(io.WriteSeeker); ok {
+			return ws, true
+		}
+		u, ok := w.(interface{ Unwrap() io.Writer })
+		if !ok {
+			return nil, false
+		}
+		w = u.Unwrap()
+	}
+}
+
+// Reservation is space in a seekable sink that is written by a first pass
+// as placeholder and backfilled on Close, for formats that need totals like
+// sizes, digests or chunk indexes up front without buffering the stream
+type Reservation struct {
+	ws  io.WriteSeeker
+	off int64
+	n   int
+}
+
+// Reserve writes n zero bytes at the current position of w's seekable sink
+// and returns the reservation to fill them later. It returns
+// ErrNotSeekable if w has no seekable sink, callers then fall back to
+// buffering.
+func Reserve(w io.Writer, n int) (*Reservation, error) {
+	ws, ok := SeekableSink(w)
+	if !ok {
+		return nil, ErrNotSeekable
+	}
+	off, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotSeekable, err)
+	}
+	if _, err := ws.Write(make([]byte, n)); err != nil {
+		return nil, err
+	}
+	return &Reservation{ws: ws, off: off, n: n}, nil
+}
+
+// Offset returns the position of the reserved space in the sink
+func (r *Reservation) Offset() int64 {
+	return r.off
+}
+
+// Len returns the size of the reserved space
+func (r *Reservation) Len() int {
+	return r.n
+}
+
+// Fill writes p at offset off of the reserved space and seeks back to
+// where the sink was, so later writes continue the stream
+func (r *Reservation) Fill(off int, p []byte) error {
+	if off < 0 || off+len(p) > r.n {
+		return fmt.Errorf("middleware: fill of %d bytes at %d exceeds reservation of %d bytes", len(p), off, r.n)
+	}
+	end, err := r.ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := r.ws.Seek(r.off+int64(off), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := r.ws.Write(p); err != nil {
+		return err
+	}
+	_, err = r.ws.Seek(end, io.SeekStart)
+	return err
+}
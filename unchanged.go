@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+)
+
+// ErrUnchanged is returned by Close of a SkipUnchanged writer if the content
+// matches the previous version. A SinkWriter then aborts its sink instead of
+// committing the redundant upload.
+var ErrUnchanged = errors.New("middleware: content unchanged")
+
+// ContentHash returns the content digest SkipUnchanged compares, the
+// SHA-256 of the plaintext
+func ContentHash(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// SkipUnchanged wraps m so its writers hash the plaintext as it is written
+// and report on Close whether it equals the previous version with digest
+// previous, as returned by ContentHash or the last call of fn. fn, if not
+// nil, receives the digest of every closed stream. The stream is still
+// written in full, since the outcome is only known at the end; if it is
+// unchanged, Close returns ErrUnchanged once m's writer was closed
+// successfully, so the caller can skip committing the new object. A nil
+// previous digest never matches.
+func SkipUnchanged(m Middleware, previous []byte, fn func(sum []byte, unchanged bool)) Middleware {
+	return &skipUnchanged{m: m, previous: previous, fn: fn}
+}
+
+type skipUnchanged struct {
+	m        Middleware
+	previous []byte
+	fn       func(sum []byte, unchanged bool)
+}
+
+func (s *skipUnchanged) Writer(w io.Writer) io.Writer {
+	return &unchangedWriter{s: s, w: s.m.Writer(w), h: sha256.New()}
+}
+
+func (s *skipUnchanged) Reader(r io.Reader) io.Reader {
+	return s.m.Reader(r)
+}
+
+// Unwrap returns the wrapped middleware
+func (s *skipUnchanged) Unwrap() Middleware {
+	return s.m
+}
+
+type unchangedWriter struct {
+	s     *skipUnchanged
+	w     io.Writer
+	h     hash.Hash
+	state WriterState
+}
+
+func (u *unchangedWriter) Write(p []byte) (int, error) {
+	if err := u.state.Err(); err != nil {
+		return 0, err
+	}
+	n, err := u.w.Write(p)
+	u.h.Write(p[:n])
+	return n, u.state.Fail(err)
+}
+
+func (u *unchangedWriter) Close() error {
+	return u.state.Close(func() error {
+		if cl, ok := u.w.(io.Closer); ok {
+			if err := cl.Close(); err != nil {
+				return err
+			}
+		}
+		sum := u.h.Sum(nil)
+		unchanged := u.s.previous != nil && bytes.Equal(sum, u.s.previous)
+		if u.s.fn != nil {
+			u.s.fn(sum, unchanged)
+		}
+		if unchanged {
+			return ErrUnchanged
+		}
+		return nil
+	})
+}
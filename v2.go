@@ -0,0 +1,99 @@
+package middleware
+
+import "io"
+
+// MiddlewareV2 is the successor of Middleware. It returns closers, so
+// finalization needs no type assertion, and reports wrap-time errors such as
+// a failed key setup directly. Closing a returned writer or reader finalizes
+// the layer but does not close the wrapped writer or reader.
+type MiddlewareV2 interface {
+	// Writer wraps an io.Writer to apply the middleware
+	Writer(io.Writer) (io.WriteCloser, error)
+
+	// Reader wraps an io.Reader to reverse the middleware
+	Reader(io.Reader) (io.ReadCloser, error)
+}
+
+// WriterE is implemented by middlewares that can report wrap-time errors of
+// their writer, e.g. encryption.Middleware. V2 uses it when available.
+type WriterE interface {
+	WriterE(io.Writer) (io.WriteCloser, error)
+}
+
+// V2 adapts a Middleware to MiddlewareV2. The layer gets the wrapped writer
+// or reader with its Close method hidden, so closing finalizes the layer
+// only. Writers without Close get one with WriterState semantics. Reader
+// errors of existing middlewares are still returned from Read.
+func V2(m Middleware) MiddlewareV2 {
+	if a, ok := m.(*v1Adapter); ok {
+		return a.m
+	}
+	return &v2Adapter{m: m}
+}
+
+// V1 adapts a MiddlewareV2 to Middleware. Wrap-time errors are returned from
+// the first Write, Close or Read.
+func V1(m MiddlewareV2) Middleware {
+	if a, ok := m.(*v2Adapter); ok {
+		return a.m
+	}
+	return &v1Adapter{m: m}
+}
+
+type v2Adapter struct {
+	m Middleware
+}
+
+func (a *v2Adapter) Writer(w io.Writer) (io.WriteCloser, error) {
+	w = noCloseWriter{w: w}
+	if we, ok := a.m.(WriterE); ok {
+		return we.WriterE(w)
+	}
+	lw := a.m.Writer(w)
+	if wc, ok := lw.(io.WriteCloser); ok {
+		return wc, nil
+	}
+	return HardenWriter(lw), nil
+}
+
+func (a *v2Adapter) Reader(r io.Reader) (io.ReadCloser, error) {
+	lr := a.m.Reader(noCloseReader{r: r})
+	if rc, ok := lr.(io.ReadCloser); ok {
+		return rc, nil
+	}
+	return io.NopCloser(lr), nil
+}
+
+// Unwrap returns the adapted middleware
+func (a *v2Adapter) Unwrap() Middleware {
+	return a.m
+}
+
+type v1Adapter struct {
+	m MiddlewareV2
+}
+
+func (a *v1Adapter) Writer(w io.Writer) io.Writer {
+	wc, err := a.m.Writer(w)
+	if err != nil {
+		return &errWriter{err: err}
+	}
+	return wc
+}
+
+func (a *v1Adapter) Reader(r io.Reader) io.Reader {
+	rc, err := a.m.Reader(r)
+	if err != nil {
+		return &errReader{err: err}
+	}
+	return rc
+}
+
+// noCloseReader hides the Close method of a reader, like noCloseWriter
+type noCloseReader struct {
+	r io.Reader
+}
+
+func (n noCloseReader) Read(p []byte) (int, error) {
+	return n.r.Read(p)
+}
@@ -0,0 +1,86 @@
+package middleware_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/encryption"
+)
+
+// closeTracker records whether it was closed
+type closeTracker struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestV2DoesNotCloseWrapped(t *testing.T) {
+	tests := map[string]middleware.Middleware{
+		"passthrough":  middleware.Passthrough(),
+		"close writer": passthrough{},
+		"encryption":   encryption.New(),
+	}
+	for name, m := range tests {
+		t.Run(name, func(t *testing.T) {
+			v2 := middleware.V2(m)
+			dst := &closeTracker{}
+			w, err := v2.Writer(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte("data")); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if dst.closed {
+				t.Fatal("Close closed the wrapped writer")
+			}
+
+			src := &closeTracker{}
+			src.Write(dst.Bytes())
+			r, err := v2.Reader(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || string(got) != "data" {
+				t.Fatalf("got %q, %v", got, err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if src.closed {
+				t.Fatal("Close closed the wrapped reader")
+			}
+		})
+	}
+}
+
+func TestV2WriterWithoutClose(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := middleware.V2(middleware.Passthrough()).Writer(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if _, err := w.Write([]byte("more")); err != middleware.ErrClosed {
+		t.Fatalf("got %v, want ErrClosed", err)
+	}
+	if buf.String() != "data" {
+		t.Fatalf("wrote %q", buf.String())
+	}
+}
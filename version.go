@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupportedVersion is returned by Readers that encounter a stream
+// written in a newer format version than they understand
+var ErrUnsupportedVersion = errors.New("middleware: unsupported format version")
+
+// Versioned is implemented by middlewares with a versioned wire format
+type Versioned interface {
+	// FormatVersion returns the format version written by the Writer
+	FormatVersion() uint8
+
+	// MaxSupportedVersion returns the highest format version the Reader understands
+	MaxSupportedVersion() uint8
+}
+
+// VersionPolicy controls how Readers treat streams with an unknown (newer) format version
+type VersionPolicy int
+
+const (
+	// RejectUnknown fails with ErrUnsupportedVersion on unknown versions
+	RejectUnknown VersionPolicy = iota
+
+	// BestEffort decodes unknown versions as the highest supported version.
+	// This allows rolling back a release without losing access to streams
+	// written by the newer release, as long as the format change was additive.
+	BestEffort
+)
+
+// String returns the name of the policy
+func (p VersionPolicy) String() string {
+	switch p {
+	case RejectUnknown:
+		return "reject-unknown"
+	case BestEffort:
+		return "best-effort"
+	default:
+		return fmt.Sprintf("VersionPolicy(%d)", int(p))
+	}
+}
+
+// CheckVersion validates a format version read from a stream against the
+// highest supported version. It returns the version to decode as.
+func CheckVersion(layer string, got, max uint8, policy VersionPolicy) (uint8, error) {
+	if got == 0 {
+		return 0, fmt.Errorf("%w: %s version 0", ErrUnsupportedVersion, layer)
+	}
+	if got <= max {
+		return got, nil
+	}
+	if policy == BestEffort {
+		return max, nil
+	}
+	return 0, fmt.Errorf("%w: %s version %d, max supported %d", ErrUnsupportedVersion, layer, got, max)
+}
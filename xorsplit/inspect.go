@@ -0,0 +1,16 @@
+package xorsplit
+
+import (
+	"fmt"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+func init() {
+	middleware.RegisterFormat("xorsplit-share", func(p []byte) (string, int, bool) {
+		if len(p) < headerSize || [3]byte(p[:3]) != magic {
+			return "", 0, false
+		}
+		return fmt.Sprintf("version %d, share %d of %d", p[3], p[4]+1, p[5]), 0, true
+	})
+}
@@ -0,0 +1,254 @@
+// Package xorsplit splits a stream into N XOR shares written to different
+// sinks, so that no single storage location holds recoverable data. All
+// shares but one are random pads, the last share is the plaintext XORed with
+// every pad. The combining Reader needs all N shares to restore the data.
+//
+// This is an alternative to encryption for threat models where the storage
+// locations are trusted not to collude, and where no key must be managed.
+package xorsplit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"schneider.vip/hybridbuffer/middleware"
+)
+
+const (
+	// FormatVersion is the share header format version
+	FormatVersion = 1
+
+	// MaxShares is the maximum number of shares
+	MaxShares = 255
+
+	idSize     = 16
+	headerSize = 3 + 1 + 1 + 1 + idSize // magic, version, index, count, stream id
+	bufSize    = 32 * 1024
+)
+
+var magic = [3]byte{'H', 'B', 'X'}
+
+var (
+	// ErrTooFewShares is returned when fewer than two shares are given
+	ErrTooFewShares = errors.New("xorsplit: at least two shares are required")
+
+	// ErrShareMismatch is returned when the given shares do not belong to the same stream
+	ErrShareMismatch = errors.New("xorsplit: shares do not belong together")
+)
+
+// NewWriter returns a writer that splits all data written to it into one
+// share per sink. The writer must be closed to make sure every share header
+// is written, even for empty streams. Close does not close the sinks.
+func NewWriter(sinks ...io.Writer) (io.WriteCloser, error) {
+	return newWriter(middleware.Rand(), sinks)
+}
+
+// NewWriterRand is like NewWriter but draws pads and the stream ID from rand
+func NewWriterRand(rand io.Reader, sinks ...io.Writer) (io.WriteCloser, error) {
+	return newWriter(rand, sinks)
+}
+
+func newWriter(rand io.Reader, sinks []io.Writer) (io.WriteCloser, error) {
+	if len(sinks) < 2 {
+		return nil, ErrTooFewShares
+	}
+	if len(sinks) > MaxShares {
+		return nil, fmt.Errorf("xorsplit: at most %d shares are supported", MaxShares)
+	}
+	w := &writer{
+		rand:  rand,
+		sinks: sinks,
+		pad:   make([]byte, bufSize),
+		out:   make([]byte, bufSize),
+		state: middleware.WriterState{Layer: "xorsplit"},
+	}
+	if _, err := io.ReadFull(rand, w.id[:]); err != nil {
+		return nil, fmt.Errorf("xorsplit: generate stream id: %w", err)
+	}
+	return w, nil
+}
+
+type writer struct {
+	rand    io.Reader
+	sinks   []io.Writer
+	id      [idSize]byte
+	pad     []byte
+	out     []byte
+	started bool
+	state   middleware.WriterState
+}
+
+func (w *writer) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	for i, s := range w.sinks {
+		hdr := header(w.id, i, len(w.sinks))
+		if _, err := s.Write(hdr); err != nil {
+			return w.state.Fail(err)
+		}
+	}
+	return nil
+}
+
+// Ensure writer implements middleware.OwnedWriter
+var _ middleware.OwnedWriter = (*writer)(nil)
+
+func (w *writer) Write(p []byte) (int, error) {
+	return w.write(p, false)
+}
+
+// WriteOwned is like Write, but XORs the pads into p in place and hands
+// p on to the last sink, see middleware.OwnedWriter
+func (w *writer) WriteOwned(p []byte) (int, error) {
+	return w.write(p, true)
+}
+
+func (w *writer) write(p []byte, owned bool) (int, error) {
+	if err := w.state.Err(); err != nil {
+		return 0, err
+	}
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > bufSize {
+			n = bufSize
+		}
+		out := p[:n]
+		if !owned {
+			out = w.out[:n]
+			copy(out, p[:n])
+		}
+		last := len(w.sinks) - 1
+		for _, s := range w.sinks[:last] {
+			pad := w.pad[:n]
+			if _, err := io.ReadFull(w.rand, pad); err != nil {
+				return written, w.state.Fail(fmt.Errorf("xorsplit: generate pad: %w", err))
+			}
+			if _, err := s.Write(pad); err != nil {
+				return written, w.state.Fail(err)
+			}
+			xor(out, pad)
+		}
+		if _, err := middleware.WriteOwned(w.sinks[last], out); err != nil {
+			return written, w.state.Fail(err)
+		}
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the share headers if nothing was written yet
+func (w *writer) Close() error {
+	return w.state.Close(w.start)
+}
+
+// NewReader returns a reader that combines the given shares. The shares may
+// be passed in any order.
+func NewReader(shares ...io.Reader) io.Reader {
+	return middleware.HardenLayerReader("xorsplit", &reader{shares: shares})
+}
+
+type reader struct {
+	shares  []io.Reader
+	started bool
+	buf     []byte
+	err     error
+}
+
+func (r *reader) start() error {
+	r.started = true
+	if len(r.shares) < 2 {
+		return ErrTooFewShares
+	}
+	var id [idSize]byte
+	seen := make([]bool, len(r.shares))
+	for i, s := range r.shares {
+		var hdr [headerSize]byte
+		if _, err := io.ReadFull(s, hdr[:]); err != nil {
+			return fmt.Errorf("xorsplit: read header of share %d: %w", i, err)
+		}
+		if !bytes.Equal(hdr[:3], magic[:]) {
+			return fmt.Errorf("%w: share %d has no share header", ErrShareMismatch, i)
+		}
+		if _, err := middleware.CheckVersion("xorsplit", hdr[3], FormatVersion, middleware.RejectUnknown); err != nil {
+			return err
+		}
+		index, count := int(hdr[4]), int(hdr[5])
+		if count != len(r.shares) || index >= count || seen[index] {
+			return fmt.Errorf("%w: share %d is %d of %d", ErrShareMismatch, i, index, count)
+		}
+		seen[index] = true
+		if i == 0 {
+			copy(id[:], hdr[6:])
+		} else if !bytes.Equal(id[:], hdr[6:]) {
+			return fmt.Errorf("%w: share %d has a different stream id", ErrShareMismatch, i)
+		}
+	}
+	return nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if !r.started {
+		if err := r.start(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	if len(p) > bufSize {
+		p = p[:bufSize]
+	}
+	n, err := r.shares[0].Read(p)
+	if n == 0 && err == nil {
+		return 0, nil
+	}
+	if r.buf == nil {
+		r.buf = make([]byte, bufSize)
+	}
+	for i, s := range r.shares[1:] {
+		if n == 0 {
+			break
+		}
+		if _, rerr := io.ReadFull(s, r.buf[:n]); rerr != nil {
+			r.err = fmt.Errorf("%w: share %d is shorter: %v", ErrShareMismatch, i+1, rerr)
+			return 0, r.err
+		}
+		xor(p[:n], r.buf[:n])
+	}
+	if err == io.EOF {
+		// every share must end at the same offset
+		for i, s := range r.shares[1:] {
+			if m, _ := s.Read(r.buf[:1]); m > 0 {
+				r.err = fmt.Errorf("%w: share %d is longer", ErrShareMismatch, i+1)
+				return n, r.err
+			}
+		}
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func header(id [idSize]byte, index, count int) []byte {
+	hdr := make([]byte, 0, headerSize)
+	hdr = append(hdr, magic[:]...)
+	hdr = append(hdr, FormatVersion, byte(index), byte(count))
+	return append(hdr, id[:]...)
+}
+
+func xor(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,157 @@
+package xorsplit_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"schneider.vip/hybridbuffer/middleware"
+	"schneider.vip/hybridbuffer/middleware/xorsplit"
+)
+
+const headerSize = 22
+
+func split(t *testing.T, n int, data []byte, owned bool) [][]byte {
+	t.Helper()
+	bufs := make([]*bytes.Buffer, n)
+	sinks := make([]io.Writer, n)
+	for i := range bufs {
+		bufs[i] = &bytes.Buffer{}
+		sinks[i] = bufs[i]
+	}
+	w, err := xorsplit.NewWriter(sinks...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owned {
+		_, err = middleware.WriteOwned(w, bytes.Clone(data))
+	} else {
+		_, err = w.Write(data)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	shares := make([][]byte, n)
+	for i, b := range bufs {
+		shares[i] = b.Bytes()
+	}
+	return shares
+}
+
+func combine(shares ...[]byte) ([]byte, error) {
+	readers := make([]io.Reader, len(shares))
+	for i, s := range shares {
+		readers[i] = bytes.NewReader(s)
+	}
+	return io.ReadAll(xorsplit.NewReader(readers...))
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, n := range []int{2, 3, xorsplit.MaxShares} {
+		for _, size := range []int{0, 1, 32 << 10, 32<<10 + 1, 100 << 10} {
+			if n == xorsplit.MaxShares && size > 1 {
+				continue
+			}
+			for _, owned := range []bool{false, true} {
+				data := make([]byte, size)
+				rand.Read(data)
+				shares := split(t, n, data, owned)
+				for _, s := range shares {
+					if len(s) != headerSize+size {
+						t.Fatalf("share of %d bytes for %d bytes of data", len(s), size)
+					}
+				}
+				got, err := combine(shares...)
+				if err != nil {
+					t.Fatalf("%d shares, size %d, owned %v: %v", n, size, owned, err)
+				}
+				if !bytes.Equal(got, data) {
+					t.Fatalf("%d shares, size %d, owned %v: round trip mismatch", n, size, owned)
+				}
+			}
+		}
+	}
+}
+
+func TestSharesInAnyOrder(t *testing.T) {
+	data := []byte("no single location holds this")
+	s := split(t, 3, data, false)
+	readers := []io.Reader{
+		iotest.OneByteReader(bytes.NewReader(s[2])),
+		iotest.HalfReader(bytes.NewReader(s[0])),
+		bytes.NewReader(s[1]),
+	}
+	got, err := io.ReadAll(xorsplit.NewReader(readers...))
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
+
+func TestShareRevealsNothing(t *testing.T) {
+	data := make([]byte, 4096)
+	for _, s := range split(t, 2, data, false) {
+		if bytes.Count(s[headerSize:], []byte{0}) > len(data)/16 {
+			t.Fatal("share contains the plaintext")
+		}
+	}
+}
+
+func TestTooFewShares(t *testing.T) {
+	if _, err := xorsplit.NewWriter(io.Discard); !errors.Is(err, xorsplit.ErrTooFewShares) {
+		t.Fatalf("got %v, want ErrTooFewShares", err)
+	}
+	s := split(t, 2, []byte("data"), false)
+	if _, err := combine(s[0]); !errors.Is(err, xorsplit.ErrTooFewShares) {
+		t.Fatalf("got %v, want ErrTooFewShares", err)
+	}
+	if _, err := xorsplit.NewWriter(make([]io.Writer, xorsplit.MaxShares+1)...); err == nil {
+		t.Fatal("too many shares accepted")
+	}
+}
+
+func TestHostileShares(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+	s := split(t, 3, data, false)
+	other := split(t, 3, data, false)
+
+	modify := func(b []byte, f func(b []byte)) []byte {
+		b = bytes.Clone(b)
+		f(b)
+		return b
+	}
+	tests := []struct {
+		name   string
+		shares [][]byte
+		want   error // nil for any error
+	}{
+		{"missing share", [][]byte{s[0], s[1]}, xorsplit.ErrShareMismatch},
+		{"duplicate share", [][]byte{s[0], s[1], s[1]}, xorsplit.ErrShareMismatch},
+		{"share of another stream", [][]byte{s[0], s[1], other[2]}, xorsplit.ErrShareMismatch},
+		{"bad magic", [][]byte{s[0], s[1], modify(s[2], func(b []byte) { b[0] = 'X' })}, xorsplit.ErrShareMismatch},
+		{"unknown version", [][]byte{s[0], s[1], modify(s[2], func(b []byte) { b[3] = 99 })}, nil},
+		{"index beyond count", [][]byte{s[0], s[1], modify(s[2], func(b []byte) { b[4] = 3 })}, xorsplit.ErrShareMismatch},
+		{"larger count", [][]byte{s[0], s[1], modify(s[2], func(b []byte) { b[5] = 4 })}, xorsplit.ErrShareMismatch},
+		{"truncated header", [][]byte{s[0], s[1], s[2][:headerSize-1]}, nil},
+		{"shorter share", [][]byte{s[0], s[1], s[2][:len(s[2])-1]}, xorsplit.ErrShareMismatch},
+		{"shorter first share", [][]byte{s[0][:len(s[0])-1], s[1], s[2]}, xorsplit.ErrShareMismatch},
+		{"longer share", [][]byte{s[0], s[1], append(bytes.Clone(s[2]), 0)}, xorsplit.ErrShareMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := combine(tt.shares...)
+			if err == nil {
+				t.Fatal("hostile shares accepted")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}